@@ -0,0 +1,87 @@
+//go:build integration
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// TestCancelledCopyStopsRemoteTar runs against the cluster of the current
+// kubeconfig context with rexec installed, e.g. the one scripts/e2e.sh leaves
+// behind with REXEC_KEEP_CLUSTER=true. REXEC_NAMESPACE and REXEC_POD pick the
+// pod, which needs tar and a large enough /usr to still be copying after a
+// second.
+func TestCancelledCopyStopsRemoteTar(t *testing.T) {
+	namespace, podName := os.Getenv("REXEC_NAMESPACE"), os.Getenv("REXEC_POD")
+	if namespace == "" {
+		namespace = "default"
+	}
+	if podName == "" {
+		podName = "test-pod"
+	}
+
+	configFlags := genericclioptions.NewConfigFlags(true)
+	configFlags.Namespace = &namespace
+	f := cmdutil.NewFactory(cmdutil.NewMatchVersionFlags(configFlags))
+	o := &CopyOptions{IOStreams: genericiooptions.NewTestIOStreamsDiscard()}
+	dest := filepath.Join(t.TempDir(), "usr")
+	if err := o.Complete(f, &cobra.Command{}, []string{podName + ":/usr", dest}); err != nil {
+		t.Fatal(err)
+	}
+	pod, err := o.Clientset.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- o.RunWithArgs(ctx, podName+":/usr", dest) }()
+	if !waitForRemoteTar(t, o, pod, true) {
+		cancel()
+		t.Skipf("the copy of /usr finished before tar was seen running: %v", <-errc)
+	}
+	cancel()
+
+	err = <-errc
+	var cancelled copyCancelledError
+	if !errors.As(err, &cancelled) || !cancelled.terminated {
+		t.Fatalf("err = %v, want the remote process reported terminated", err)
+	}
+	if !waitForRemoteTar(t, o, pod, false) {
+		t.Fatal("the remote tar is still running after the cancelled copy reported it terminated")
+	}
+}
+
+// waitForRemoteTar polls the processes of the pod for up to 10s until a tar
+// of the copy is running, or is gone, as running asks.
+func waitForRemoteTar(t *testing.T, o *CopyOptions, pod *corev1.Pod, running bool) bool {
+	t.Helper()
+	// no ps or pgrep in many images, the command lines are read from /proc
+	list := []string{"sh", "-c", `for p in /proc/[0-9]*; do tr '\0' ' ' < "$p/cmdline"; echo; done 2>/dev/null`}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var stdout, stderr bytes.Buffer
+		if err := (rexecExecutor{config: o.ClientConfig}).Execute(context.Background(), pod, pod.Spec.Containers[0].Name, list, &stdout, &stderr); err != nil {
+			t.Fatalf("listing the processes of the pod: %v: %s", err, stderr.String())
+		}
+		if strings.Contains(stdout.String(), "tar cf - -C / -- usr") == running {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return false
+}
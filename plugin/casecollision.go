@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The values of --on-case-collision, what a copy does with an entry whose
+// name differs only in case from one it extracted, on a destination that
+// can't keep the two apart.
+const (
+	caseCollisionRename = "rename"
+	caseCollisionError  = "error"
+)
+
+// caseInsensitive reports whether the filesystem of dir ignores the case of
+// names, swapped in tests.
+var caseInsensitive = probeCaseInsensitive
+
+// probeCaseInsensitive creates a file in dir and looks it up with its name
+// in upper case, which finds it where names are case-insensitive, such as on
+// APFS or NTFS by default.
+func probeCaseInsensitive(dir string) bool {
+	f, err := os.CreateTemp(dir, ".rexec-case-probe-")
+	if err != nil {
+		return false
+	}
+	name := f.Name()
+	//nolint:errcheck
+	_ = f.Close()
+	//nolint:errcheck
+	defer func() { _ = os.Remove(name) }()
+	_, err = os.Lstat(filepath.Join(dir, strings.ToUpper(filepath.Base(name))))
+	return err == nil
+}
+
+// caseRename is an entry extracted under another name, as it differs only in
+// case from one extracted before.
+type caseRename struct {
+	name, as string
+}
+
+// caseCollisions tracks the paths an extraction wrote onto a case-insensitive
+// filesystem by their names in lower case.
+type caseCollisions struct {
+	written map[string]caseWritten
+	// renamed maps the paths of the renamed entries to where they were
+	// extracted, for the hard links to them.
+	renamed map[string]string
+	renames []caseRename
+}
+
+// caseWritten is an entry an extraction wrote.
+type caseWritten struct {
+	name, target string
+	dir          bool
+}
+
+// checkCaseCollision returns where to extract header, whose path is
+// targetAbs, and records it. On a case-insensitive destination an entry
+// whose path differs only in case from one extracted before would overwrite
+// it: it is renamed with a __N suffix, or fails the copy with
+// --on-case-collision=error. Directories are merged, their entries are
+// checked in turn.
+func (o *CopyOptions) checkCaseCollision(header *tar.Header, targetAbs string) (string, error) {
+	if o.cases == nil {
+		return targetAbs, nil
+	}
+	dir := header.Typeflag == tar.TypeDir
+	key := strings.ToLower(targetAbs)
+	prev, ok := o.cases.written[key]
+	if !ok || prev.target == targetAbs || dir && prev.dir {
+		o.cases.written[key] = caseWritten{name: header.Name, target: targetAbs, dir: dir}
+		return targetAbs, nil
+	}
+	if o.OnCaseCollision == caseCollisionError {
+		return "", fmt.Errorf("%s and %s differ only in case, which the case-insensitive filesystem of the destination can't keep apart; pass --on-case-collision=rename to extract the second under another name", prev.name, header.Name)
+	}
+	var suffix, renamed string
+	for n := 1; ; n++ {
+		suffix = "__" + strconv.Itoa(n)
+		renamed = targetAbs + suffix
+		if _, taken := o.cases.written[strings.ToLower(renamed)]; taken {
+			continue
+		}
+		if _, err := os.Lstat(renamed); os.IsNotExist(err) {
+			break
+		}
+	}
+	o.cases.written[strings.ToLower(renamed)] = caseWritten{name: header.Name, target: renamed, dir: dir}
+	o.cases.renamed[targetAbs] = renamed
+	as := strings.TrimSuffix(header.Name, "/") + suffix
+	o.cases.renames = append(o.cases.renames, caseRename{name: header.Name, as: as})
+	o.warnings.warn(warnCaseCollision, "%s differs only in case from %s, which the destination can't keep apart, extracting it as %s", header.Name, prev.name, as)
+	return renamed, nil
+}
+
+// caseRenamed returns where the entry at targetAbs was extracted, renamed or
+// not.
+func (o *CopyOptions) caseRenamed(targetAbs string) string {
+	if o.cases != nil {
+		if renamed, ok := o.cases.renamed[targetAbs]; ok {
+			return renamed
+		}
+	}
+	return targetAbs
+}
+
+// caseSummary is what the summary of a copy says of the entries it renamed,
+// listing them, as the local tree is not the one copied.
+func (o *CopyOptions) caseSummary() string {
+	if o.cases == nil || len(o.cases.renames) == 0 {
+		return ""
+	}
+	var list []string
+	for _, r := range o.cases.renames[:min(len(o.cases.renames), warningExamples)] {
+		list = append(list, r.name+" as "+r.as)
+	}
+	if more := len(o.cases.renames) - warningExamples; more > 0 {
+		list = append(list, fmt.Sprintf("%d more", more))
+	}
+	return fmt.Sprintf(", %d entries renamed as they differ only in case from another (%s)", len(o.cases.renames), strings.Join(list, ", "))
+}
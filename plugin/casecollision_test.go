@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func withCaseInsensitive(t *testing.T, insensitive bool) {
+	t.Helper()
+	old := caseInsensitive
+	t.Cleanup(func() { caseInsensitive = old })
+	caseInsensitive = func(string) bool { return insensitive }
+}
+
+// caseTar holds names that differ only in case, as a Linux tree may, and a
+// hard link to one of them.
+func caseTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{
+		{"repo/", ""},
+		{"repo/README", "upper\n"},
+		{"repo/ReadMe", "mixed\n"},
+		{"repo/Docs/", ""},
+		{"repo/docs/", ""},
+		{"repo/Docs/a.md", "a\n"},
+		{"repo/docs/A.md", "A\n"},
+	} {
+		h := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.content))}
+		if strings.HasSuffix(f.name, "/") {
+			h.Typeflag, h.Mode = tar.TypeDir, 0o755
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, f.name, err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatalf(errWriteTarContentForFmt, f.name, err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "repo/readme.link", Typeflag: tar.TypeLink, Linkname: "repo/ReadMe"}); err != nil {
+		t.Fatalf(errWriteTarHeaderForFmt, "repo/readme.link", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return buf.Bytes()
+}
+
+func TestCopyCaseCollisionRename(t *testing.T) {
+	withCaseInsensitive(t, true)
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: caseTar(t)})
+	o.Container = "app"
+	o.OnCaseCollision = caseCollisionRename
+	var out, errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/src/repo", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	repo := filepath.Join(dest, "repo")
+	assertFileContent(t, filepath.Join(repo, "README"), "upper\n")
+	assertFileContent(t, filepath.Join(repo, "ReadMe__1"), "mixed\n")
+	assertFileContent(t, filepath.Join(repo, "docs", "A.md__1"), "A\n")
+	// the link is to the file that was renamed
+	assertFileContent(t, filepath.Join(repo, "readme.link"), "mixed\n")
+	for _, want := range []string{
+		"Warning: repo/ReadMe differs only in case from repo/README, which the destination can't keep apart, extracting it as repo/ReadMe__1\n",
+		"Warning: repo/docs/A.md differs only in case from repo/Docs/a.md, which the destination can't keep apart, extracting it as repo/docs/A.md__1\n",
+	} {
+		assertContains(t, errOut.String(), want)
+	}
+	wantSummary := ", 2 entries renamed as they differ only in case from another (repo/ReadMe as repo/ReadMe__1, repo/docs/A.md as repo/docs/A.md__1)\n"
+	if !strings.HasSuffix(out.String(), wantSummary) {
+		t.Errorf("summary = %q, want ending in %q", out.String(), wantSummary)
+	}
+}
+
+func TestCopyCaseCollisionError(t *testing.T) {
+	withCaseInsensitive(t, true)
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: caseTar(t)})
+	o.Container = "app"
+	o.OnCaseCollision = caseCollisionError
+	dest := mustTempDir(t)
+
+	err := o.RunWithArgs(context.Background(), "pod:/src/repo", dest)
+	want := "repo/README and repo/ReadMe differ only in case, which the case-insensitive filesystem of the destination can't keep apart"
+	if err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Fatalf("RunWithArgs() error = %v, want %q", err, want)
+	}
+}
+
+func TestCopyCaseSensitiveDestination(t *testing.T) {
+	withCaseInsensitive(t, false)
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: caseTar(t)})
+	o.Container = "app"
+	var errOut bytes.Buffer
+	o.IOStreams.ErrOut = &errOut
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/src/repo", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	assertFileContent(t, filepath.Join(dest, "repo", "ReadMe"), "mixed\n")
+	if strings.Contains(errOut.String(), "differs only in case") {
+		t.Errorf("stderr = %q, want no collision", errOut.String())
+	}
+}
+
+func TestProbeCaseInsensitive(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the case-sensitivity of the temporary directory is only known on linux")
+	}
+	dir := mustTempDir(t)
+	if probeCaseInsensitive(dir) {
+		t.Error("probeCaseInsensitive() = true on linux")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("the probe left %v", entries)
+	}
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// isDirectoryMarkers are what cat says of a directory.
+var isDirectoryMarkers = []string{"Is a directory", "EISDIR"}
+
+// tarMissingError is the failure of a copy from a container without tar.
+type tarMissingError struct {
+	pod       string
+	container string
+}
+
+func (e tarMissingError) Error() string {
+	return fmt.Sprintf("pod %s: tar binary not found in container %s", e.pod, e.container)
+}
+
+// maxSizeWriter fails the writes that would take the bytes written through
+// it over limit, 0 for no limit.
+type maxSizeWriter struct {
+	w        io.Writer
+	n, limit int64
+	exceeded bool
+}
+
+func (w *maxSizeWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.n+int64(len(p)) > w.limit {
+		w.exceeded = true
+		return 0, fmt.Errorf("--max-size exceeded")
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// copyWithCat copies src, a single regular file, with cat where the container
+// has no tar, through a temporary file renamed to its destination once
+// complete. The file gets mode 0644, the mode, owner and modification time it
+// has in the container are lost. tarErr, the failure of tar, is returned with
+// a hint for a directory, and as it is when there is no cat either.
+func (o *CopyOptions) copyWithCat(ctx context.Context, pod *corev1.Pod, container string, src, dest *fileSpec, tarErr error) error {
+	srcBase := filepath.Base(src.File)
+	target := copiedPath(dest.File, srcBase)
+	if abs, err := filepath.Abs(target); err == nil {
+		if err := o.checkManifestPath(abs); err != nil {
+			return err
+		}
+	}
+	if o.keepExisting(target) {
+		if _, err := fmt.Fprintf(o.summaryOut(), "Kept the existing %s, %s was not copied\n", target, src.remote()); err != nil {
+			return fmt.Errorf("failed to write output: %v", err)
+		}
+		return nil
+	}
+	command, err := o.remoteCommand(ctx, pod, container, []string{"cat", "--", src.File})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".rexec-*")
+	if err != nil {
+		return fmt.Errorf("create file failed: %v", err)
+	}
+	defer func() {
+		//nolint:errcheck
+		_ = os.Remove(tmp.Name())
+	}()
+
+	limit, err := parseMaxSize(o.MaxSize)
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	w := &maxSizeWriter{w: io.MultiWriter(tmp, sum), limit: limit}
+	var stderr stderrCapture
+	progress := o.startProgress()
+	defer progress.stop()
+	stderrOut, waitStderr := stderr.drain()
+	execErr := o.execute(ctx, pod, container, command, progress.counting(w), stderrOut)
+	waitStderr()
+	progress.stop()
+	if closeErr := tmp.Close(); closeErr != nil && execErr == nil {
+		return fmt.Errorf("close file failed: %v", closeErr)
+	}
+	var cancelled copyCancelledError
+	switch {
+	case execErr == nil:
+	case errors.As(execErr, &cancelled):
+		return execErr
+	case w.exceeded:
+		return fmt.Errorf("copy aborted, %s would exceed --max-size %s: %d bytes were received before it", src.File, o.MaxSize, w.n)
+	case containsAny(stderr.String(), isDirectoryMarkers):
+		return fmt.Errorf("%w; without tar only a single file can be copied, and %s is a directory", tarErr, src.File)
+	case binaryMissing(execErr, stderr.String()):
+		return tarErr
+	default:
+		return o.handleExecError(execErr, stderr.String(), src, container)
+	}
+
+	modes, err := parseChmod(o.Chmod)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), modes.entryMode(false, 0o644)); err != nil {
+		return fmt.Errorf("create file failed: %v", err)
+	}
+	if err := removeReadOnly(target); err != nil {
+		return fmt.Errorf("create file failed: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("create file failed: %v", err)
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: tar binary not found in container %s, copied %s with cat: its mode, owner and modification time are not kept\n", container, src.File)
+
+	o.copiedBytes = w.n
+	o.Result = CopyResult{Files: 1, Bytes: w.n, Duration: progress.elapsed()}
+	o.extracted = []string{target}
+	if o.Checksum {
+		o.checksummed = []checksummedFile{{remote: srcBase, local: target}}
+	}
+	o.own(target)
+	if err := o.applyOwner(); err != nil {
+		return err
+	}
+	if o.warnings != nil {
+		o.warnings.summary()
+	}
+	if o.manifest != nil {
+		o.manifest.Entries = append(o.manifest.Entries, sourceEntry{
+			Path: srcBase, Type: "file", Size: w.n, SHA256: hex.EncodeToString(sum.Sum(nil)),
+		})
+	}
+	return o.finishCopy(ctx, pod, container, src, dest, target)
+}
+
+// catCopyable reports whether the failure err of the tar of a copy is its
+// container lacking tar, for a copy copyWithCat can do instead.
+func (o *CopyOptions) catCopyable(err error) bool {
+	var tarMissing tarMissingError
+	return errors.As(err, &tarMissing) && !o.DryRun && o.selected == nil
+}
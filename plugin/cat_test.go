@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeDistrolessContainer has cat but no tar, and serves files and dirs.
+type fakeDistrolessContainer struct {
+	files    map[string]string
+	dirs     []string
+	commands [][]string
+}
+
+func (f *fakeDistrolessContainer) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, stderr io.Writer) error {
+	f.commands = append(f.commands, command)
+	switch {
+	case command[len(command)-1] == "true":
+		return nil
+	case slices.Contains(command, "tar"):
+		_, _ = io.WriteString(stderr, `exec: "tar": executable file not found in $PATH`)
+		return exitCodeError(127)
+	case slices.Contains(f.dirs, command[len(command)-1]):
+		_, _ = io.WriteString(stderr, "cat: read error: Is a directory\n")
+		return exitCodeError(1)
+	}
+	content, ok := f.files[command[len(command)-1]]
+	if !ok {
+		_, _ = io.WriteString(stderr, "cat: "+command[len(command)-1]+": No such file or directory\n")
+		return exitCodeError(1)
+	}
+	_, err := io.WriteString(stdout, content)
+	return err
+}
+
+func TestCopyWithCatWithoutTar(t *testing.T) {
+	executor := &fakeDistrolessContainer{files: map[string]string{"/var/log/app.log": "GET / 200\n"}}
+	o := newFakePodCopyOptions(executor)
+	var out, errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+	dir := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", dir); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "app.log")
+	assertFileContent(t, dest, "GET / 200\n")
+	if info, err := os.Stat(dest); err != nil || info.Mode().Perm() != 0o644 {
+		t.Errorf("copied file = %v, %v, want mode 0644", info, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("the temporary file is left in %v", entries)
+	}
+	if got := executor.commands[len(executor.commands)-1]; !slices.Equal(got[3:], []string{"cat", "--", "/var/log/app.log"}) {
+		t.Errorf("command = %q", got)
+	}
+	assertContains(t, errOut.String(), "Warning: tar binary not found in container app, copied /var/log/app.log with cat: its mode, owner and modification time are not kept\n")
+	assertContains(t, out.String(), "Copied 1 file (10 B) from pod:/var/log/app.log to "+dest+" in ")
+}
+
+func TestCopyWithCatFails(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		maxSize string
+		wantErr string
+	}{
+		{"directory", "pod:/var/log", "0", "pod default/pod: tar binary not found in container app; without tar only a single file can be copied, and /var/log is a directory"},
+		{"missing file", "pod:/var/log/gone.log", "0", "pod default/pod: file not found: /var/log/gone.log"},
+		{"max size", "pod:/var/log/app.log", "4", "copy aborted, /var/log/app.log would exceed --max-size 4: 0 bytes were received before it"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executor := &fakeDistrolessContainer{files: map[string]string{"/var/log/app.log": "GET / 200\n"}, dirs: []string{"/var/log"}}
+			o := newFakePodCopyOptions(executor)
+			o.MaxSize = tt.maxSize
+			dir := mustTempDir(t)
+
+			err := o.RunWithArgs(context.Background(), tt.src, dir)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("nothing may be left behind, found %v", entries)
+			}
+		})
+	}
+}
+
+func TestCopyWithoutTarOrCat(t *testing.T) {
+	executor := &fakeExecutor{stderr: `exec: "tar": executable file not found in $PATH`, err: exitCodeError(127)}
+	o := newFakePodCopyOptions(executor)
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t))
+	if err == nil || err.Error() != "pod default/pod: tar binary not found in container app" {
+		t.Fatalf("err = %v, want tar missing", err)
+	}
+	if !strings.Contains(strings.Join(executor.commands[len(executor.commands)-1], " "), "cat -- /var/log/app.log") {
+		t.Errorf("cat was not tried, ran %q", executor.commands)
+	}
+}
@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	restclient "k8s.io/client-go/rest"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+// rootfsDiffName is the entry of a checkpoint archive holding the changes the
+// container made to its image's filesystem.
+const rootfsDiffName = "rootfs-diff.tar"
+
+// CheckpointOptions contains the options for checkpointing a container and
+// extracting the files it changed.
+type CheckpointOptions struct {
+	Namespace    string
+	PodName      string
+	Container    string
+	Dest         string
+	ClientConfig *restclient.Config
+	IOStreams    genericiooptions.IOStreams
+
+	// Archive is a checkpoint archive fetched from the node. When it is set
+	// nothing is checkpointed, its rootfs-diff is extracted to Dest.
+	Archive string
+	// ShowAllWarnings prints every extraction warning instead of a few
+	// examples per category.
+	ShowAllWarnings bool
+}
+
+// checkpointResult is the answer of the rexec proxy to a checkpoint.
+type checkpointResult struct {
+	Node  string   `json:"node"`
+	Items []string `json:"items"`
+}
+
+// NewCmdCheckpointCp creates the 'checkpoint-cp' command, which checkpoints a
+// container through the rexec proxy and extracts the files the container
+// changed from the checkpoint archive.
+func NewCmdCheckpointCp(f cmdutil.Factory, ioStreams genericiooptions.IOStreams) *cobra.Command {
+	o := &CheckpointOptions{IOStreams: ioStreams}
+
+	cmd := &cobra.Command{
+		Use:                   "checkpoint-cp POD LOCAL_DIR -c CONTAINER [--archive FILE]",
+		DisableFlagsInUseLine: true,
+		Short:                 i18n.T("Checkpoint a container and copy the files it changed (with audit)"),
+		Long: templates.LongDesc(`
+			Checkpoint a running container through the kubelet checkpoint API and
+			copy the files the container changed since it started, without running
+			anything inside it. This works for distroless and crashlooping
+			containers where cp, which needs tar in the container, can't.
+
+			The checkpoint is audited by the rexec proxy and only allowed for the
+			groups the proxy was started with --checkpoint-allow-group for. The
+			kubelet writes the archive to /var/lib/kubelet/checkpoints on the node
+			and has no API to download or delete it: fetch it from the node, pass
+			it back with --archive to extract its rootfs-diff into LOCAL_DIR, and
+			remove it from the node when done. The archive also holds the memory
+			of the container, handle it like a secret.`),
+		Example: templates.Examples(`
+			# Checkpoint the app container, prints the node and the archive path
+			kubectl rexec checkpoint-cp my-pod ./evidence -c app
+
+			# Extract the files the container changed from the fetched archive
+			kubectl rexec checkpoint-cp my-pod ./evidence -c app --archive ./checkpoint-my-pod_default-app.tar`),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f, args))
+			cmdutil.CheckErr(o.Validate())
+			cmdutil.CheckErr(explainClockSkew(cmd.Context(), o.Run(cmd.Context()), o.ClientConfig))
+		},
+	}
+
+	cmd.Flags().StringVarP(&o.Container, "container", "c", "", "Container to checkpoint")
+	cmd.Flags().StringVar(&o.Archive, "archive", "", "Checkpoint archive fetched from the node, extract its rootfs-diff instead of checkpointing")
+	cmd.Flags().BoolVar(&o.ShowAllWarnings, "show-all-warnings", false, "Print every skipped entry instead of a few examples per kind of warning")
+	return cmd
+}
+
+// Complete takes the pod and the destination from args and sets up the client
+// configuration.
+func (o *CheckpointOptions) Complete(f cmdutil.Factory, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("a pod and a local destination directory are required")
+	}
+	o.PodName, o.Dest = args[0], args[1]
+
+	var err error
+	o.Namespace, _, err = f.ToRawKubeConfigLoader().Namespace()
+	if err != nil {
+		return err
+	}
+	o.ClientConfig, err = f.ToRESTConfig()
+	return err
+}
+
+// Validate checks the options.
+func (o *CheckpointOptions) Validate() error {
+	if o.Container == "" {
+		return fmt.Errorf("the container to checkpoint must be given with -c, a checkpoint is taken of one container")
+	}
+	if info, err := os.Stat(o.Dest); err == nil && !info.IsDir() {
+		return fmt.Errorf("destination %s exists and is not a directory", o.Dest)
+	}
+	return nil
+}
+
+// Run checkpoints the container, or extracts the rootfs-diff of Archive.
+func (o *CheckpointOptions) Run(ctx context.Context) error {
+	if o.Archive != "" {
+		return o.extractArchive(ctx)
+	}
+	result, err := o.checkpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if len(result.Items) == 0 {
+		return fmt.Errorf("the kubelet of node %s reported no checkpoint archive", result.Node)
+	}
+	out := o.IOStreams.Out
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(out, "Checkpointed container %s of pod %s/%s on node %s:\n", o.Container, o.Namespace, o.PodName, result.Node)
+	for _, item := range result.Items {
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(out, "  %s\n", item)
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(out, "The kubelet can't serve the archive. Fetch it from the node, then run:\n  kubectl rexec checkpoint-cp %s %s -n %s -c %s --archive %s\nand delete it from the node afterwards, it holds the memory of the container.\n",
+		o.PodName, o.Dest, o.Namespace, o.Container, path.Base(result.Items[0]))
+	return nil
+}
+
+// checkpointPath is the checkpoint subresource of pod in the rexec API.
+func checkpointPath(namespace, pod, container string) string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/pods/%s/checkpoint?container=%s",
+		rexecAPIGroup, RexecAPIVersion, namespace, pod, url.QueryEscape(container))
+}
+
+// checkpoint asks the rexec proxy to checkpoint the container.
+func (o *CheckpointOptions) checkpoint(ctx context.Context) (checkpointResult, error) {
+	client, err := restclient.HTTPClientFor(o.ClientConfig)
+	if err != nil {
+		return checkpointResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(o.ClientConfig.Host, "/")+checkpointPath(o.Namespace, o.PodName, o.Container), nil)
+	if err != nil {
+		return checkpointResult{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return checkpointResult{}, err
+	}
+	defer func() {
+		//nolint:errcheck
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return checkpointResult{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var status metav1.Status
+		if json.Unmarshal(body, &status) == nil && status.Message != "" {
+			return checkpointResult{}, fmt.Errorf("checkpoint of %s/%s container %s failed: %s", o.Namespace, o.PodName, o.Container, status.Message)
+		}
+		return checkpointResult{}, fmt.Errorf("checkpoint of %s/%s container %s failed: %s", o.Namespace, o.PodName, o.Container, http.StatusText(resp.StatusCode))
+	}
+	var result checkpointResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return checkpointResult{}, fmt.Errorf("unexpected checkpoint answer: %v", err)
+	}
+	return result, nil
+}
+
+// extractArchive extracts the rootfs-diff of the checkpoint archive to Dest,
+// through the same hardened extraction cp uses. The rest of the archive, the
+// memory pages and the runtime state, is never written out.
+func (o *CheckpointOptions) extractArchive(ctx context.Context) error {
+	f, err := os.Open(o.Archive)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		//nolint:errcheck
+		_ = f.Close()
+	}()
+
+	archive := tar.NewReader(f)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s has no %s, is it a checkpoint archive of a container that changed files?", o.Archive, rootfsDiffName)
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not a checkpoint archive: %v", o.Archive, err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Clean(header.Name) != rootfsDiffName {
+			continue
+		}
+
+		if err := os.MkdirAll(o.Dest, 0755); err != nil {
+			return err
+		}
+		cp := &CopyOptions{IOStreams: o.IOStreams, ShowAllWarnings: o.ShowAllWarnings}
+		result, err := cp.extractTar(ctx, archive, o.Dest, "")
+		if err != nil {
+			return err
+		}
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(o.IOStreams.Out, "Extracted the files container %s changed to %s (%d files)\n", o.Container, o.Dest, result.Files)
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	restclient "k8s.io/client-go/rest"
+)
+
+// checkpointArchive builds a checkpoint archive like the kubelet writes, with
+// the memory pages and runtime state next to a rootfs-diff.tar holding diff.
+func checkpointArchive(t *testing.T, diff []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		name    string
+		content []byte
+	}{
+		{"config.dump", []byte(`{"id":"abc"}`)},
+		{"checkpoint/pages-1.img", []byte("memory with secrets")},
+		{rootfsDiffName, diff},
+	}
+	for _, e := range entries {
+		if diff == nil && e.name == rootfsDiffName {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(e.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(mustTempDir(t), "checkpoint-pod_default-app.tar")
+	if err := os.WriteFile(archive, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func newCheckpointOptions(host string, out, errOut *bytes.Buffer) *CheckpointOptions {
+	return &CheckpointOptions{
+		Namespace:    "default",
+		PodName:      "pod",
+		Container:    "app",
+		ClientConfig: &restclient.Config{Host: host},
+		IOStreams:    genericiooptions.IOStreams{Out: out, ErrOut: errOut},
+	}
+}
+
+func TestCheckpointThroughProxy(t *testing.T) {
+	var gotMethod, gotPath, gotContainer string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod, gotPath, gotContainer = r.Method, r.URL.Path, r.URL.Query().Get("container")
+		//nolint:errcheck
+		_, _ = w.Write([]byte(`{"node":"node-1","items":["/var/lib/kubelet/checkpoints/checkpoint-pod_default-app-2026.tar"]}`))
+	}))
+	defer srv.Close()
+
+	var out, errOut bytes.Buffer
+	o := newCheckpointOptions(srv.URL, &out, &errOut)
+	o.Dest = "./evidence"
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if gotMethod != http.MethodPost || gotPath != "/apis/audit.adyen.internal/v1beta1/namespaces/default/pods/pod/checkpoint" || gotContainer != "app" {
+		t.Fatalf("unexpected request %s %s container=%s", gotMethod, gotPath, gotContainer)
+	}
+	assertContains(t, out.String(), "on node node-1")
+	assertContains(t, out.String(), "/var/lib/kubelet/checkpoints/checkpoint-pod_default-app-2026.tar")
+	assertContains(t, out.String(), "--archive checkpoint-pod_default-app-2026.tar")
+}
+
+func TestCheckpointUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotImplemented)
+		//nolint:errcheck
+		_, _ = w.Write([]byte(`{"kind":"Status","status":"Failure","code":501,"message":"container checkpointing is not available on node node-1: it needs the ContainerCheckpoint feature gate and a runtime that supports it"}`))
+	}))
+	defer srv.Close()
+
+	var out, errOut bytes.Buffer
+	err := newCheckpointOptions(srv.URL, &out, &errOut).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "ContainerCheckpoint feature gate") {
+		t.Fatalf("want the unavailable checkpoint explained, got %v", err)
+	}
+}
+
+func TestCheckpointExtractsOnlyRootfsDiff(t *testing.T) {
+	var out, errOut bytes.Buffer
+	o := newCheckpointOptions("", &out, &errOut)
+	o.Archive = checkpointArchive(t, evidenceTar(t))
+	o.Dest = filepath.Join(mustTempDir(t), "evidence")
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertFileExists(t, filepath.Join(o.Dest, "logs", "app.log"))
+	assertFileExists(t, filepath.Join(o.Dest, "logs", "err.log"))
+	assertFileDoesNotExist(t, filepath.Join(o.Dest, "logs", "current"))
+	assertFileDoesNotExist(t, filepath.Join(o.Dest, "checkpoint"))
+	assertFileDoesNotExist(t, filepath.Join(o.Dest, "config.dump"))
+	assertContains(t, out.String(), "(2 files)")
+}
+
+func TestCheckpointRejectsTraversalInRootfsDiff(t *testing.T) {
+	var diff bytes.Buffer
+	tw := tar.NewWriter(&diff)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut bytes.Buffer
+	o := newCheckpointOptions("", &out, &errOut)
+	o.Archive = checkpointArchive(t, diff.Bytes())
+	o.Dest = filepath.Join(mustTempDir(t), "evidence")
+	err := o.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "path traversal") {
+		t.Fatalf("want a path traversal error, got %v", err)
+	}
+	assertFileDoesNotExist(t, filepath.Join(filepath.Dir(o.Dest), "escape"))
+}
+
+func TestCheckpointArchiveWithoutRootfsDiff(t *testing.T) {
+	var out, errOut bytes.Buffer
+	o := newCheckpointOptions("", &out, &errOut)
+	o.Archive = checkpointArchive(t, nil)
+	o.Dest = mustTempDir(t)
+	if err := o.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "has no rootfs-diff.tar") {
+		t.Fatalf("want a missing rootfs-diff error, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// checksumScript prints the digest the tool $1 computes of every file named
+// after it, a line each, and - for a file it can't read. It exits 127 when
+// there is no such tool.
+const checksumScript = `sum=$1; shift; command -v "$sum" >/dev/null 2>&1 || exit 127; for f do if h=$("$sum" 2>/dev/null < "$f"); then echo "${h%% *}"; else echo -; fi; done`
+
+// checksumBatch is how many files one exec of checksumScript digests, to keep
+// its arguments well below the limits of the container.
+const checksumBatch = 512
+
+// checksumAlgorithm is a digest --checksum computes in the container with
+// tool and locally with newHash.
+type checksumAlgorithm struct {
+	name    string
+	tool    string
+	newHash func() hash.Hash
+}
+
+// checksumAlgorithms are tried in order, md5 only where sha256sum is missing.
+var checksumAlgorithms = []checksumAlgorithm{
+	{"sha256", "sha256sum", sha256.New},
+	{"md5", "md5sum", md5.New},
+}
+
+var errChecksumToolMissing = errors.New("checksum tool missing")
+
+// checksummedFile is a regular file extracted with --checksum: its entry
+// name, relative to the directory tar ran in, and where it was written.
+type checksummedFile struct {
+	remote string
+	local  string
+}
+
+// fileDigest is the verified digest of a copied file.
+type fileDigest struct {
+	local  string
+	digest string
+}
+
+// verifyChecksums checks every regular file the copy extracted against the
+// digest the container computes of it, dir being the directory tar ran in. It
+// returns the digests, or an error listing the files that differ. A container
+// without sha256sum or md5sum is not verified, with a warning.
+func (o *CopyOptions) verifyChecksums(ctx context.Context, pod *corev1.Pod, container string, src *fileSpec, dir string) (checksumAlgorithm, []fileDigest, error) {
+	for _, alg := range checksumAlgorithms {
+		remote, err := o.remoteDigests(ctx, pod, container, src, dir, alg.tool)
+		if errors.Is(err, errChecksumToolMissing) {
+			continue
+		}
+		if err != nil {
+			return alg, nil, err
+		}
+		digests, err := o.compareDigests(pod, alg, remote)
+		return alg, digests, err
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: pod %s/%s has no sh with sha256sum or md5sum in container %s, the copied files are not verified\n", pod.Namespace, pod.Name, container)
+	return checksumAlgorithm{}, nil, nil
+}
+
+// remoteDigests returns the digests tool computes in the container of the
+// files checksummed, in their order, - for those it can't read.
+func (o *CopyOptions) remoteDigests(ctx context.Context, pod *corev1.Pod, container string, src *fileSpec, dir, tool string) ([]string, error) {
+	var digests []string
+	for start := 0; start < len(o.checksummed); start += checksumBatch {
+		batch := o.checksummed[start:min(start+checksumBatch, len(o.checksummed))]
+		command := []string{"sh", "-c", checksumScript, "sh", tool}
+		for _, f := range batch {
+			command = append(command, path.Join(dir, f.remote))
+		}
+		command, err := o.remoteCommand(ctx, pod, container, command)
+		if err != nil {
+			return nil, err
+		}
+		var stdout, stderr bytes.Buffer
+		if err := o.execute(ctx, pod, container, command, &stdout, &stderr); err != nil {
+			var cancelled copyCancelledError
+			if errors.As(err, &cancelled) {
+				return nil, err
+			}
+			if shellMissing(err, stderr.String()) {
+				return nil, errChecksumToolMissing
+			}
+			return nil, o.handleExecError(err, stderr.String(), src, container)
+		}
+		lines := strings.Fields(stdout.String())
+		if len(lines) != len(batch) {
+			return nil, fmt.Errorf("pod %s/%s: %s printed %d digests for %d files", pod.Namespace, pod.Name, tool, len(lines), len(batch))
+		}
+		digests = append(digests, lines...)
+	}
+	return digests, nil
+}
+
+// compareDigests compares the files checksummed, as written locally, with
+// the digests of the container.
+func (o *CopyOptions) compareDigests(pod *corev1.Pod, alg checksumAlgorithm, remote []string) ([]fileDigest, error) {
+	digests := make([]fileDigest, 0, len(o.checksummed))
+	var mismatches []string
+	for i, f := range o.checksummed {
+		local, err := fileHash(f.local, alg.newHash())
+		switch {
+		case remote[i] == "-":
+			mismatches = append(mismatches, fmt.Sprintf("%s can't be read in the pod anymore", f.remote))
+		case err != nil:
+			mismatches = append(mismatches, fmt.Sprintf("%s can't be read back: %v", f.local, err))
+		case local != remote[i]:
+			mismatches = append(mismatches, fmt.Sprintf("%s (%s %s, pod %s)", f.local, alg.name, local, remote[i]))
+		default:
+			digests = append(digests, fileDigest{local: f.local, digest: local})
+		}
+	}
+	if len(mismatches) > 0 {
+		return nil, fmt.Errorf("pod %s/%s: %d of %d copied files differ from the pod: %s", pod.Namespace, pod.Name, len(mismatches), len(o.checksummed), strings.Join(mismatches, ", "))
+	}
+	return digests, nil
+}
+
+func fileHash(name string, h hash.Hash) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	//nolint:errcheck
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// printDigests prints the verified digests after the summary of a copy, in the
+// format sha256sum -c and md5sum -c read.
+func (o *CopyOptions) printDigests(alg checksumAlgorithm, digests []fileDigest) {
+	if len(digests) == 0 {
+		return
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.Out, "Verified %d files against the %s computed in the pod:\n", len(digests), alg.name)
+	for _, d := range digests {
+		//nolint:errcheck
+		_, _ = fmt.Fprintln(o.IOStreams.Out, digestLine(d))
+	}
+}
+
+// digestLine is the line of d as sha256sum prints it: a name with a newline
+// or a backslash is escaped, and the line starts with a backslash then.
+func digestLine(d fileDigest) string {
+	if !strings.ContainsAny(d.local, "\\\n\r") {
+		return d.digest + "  " + d.local
+	}
+	name := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(d.local)
+	return `\` + d.digest + "  " + name
+}
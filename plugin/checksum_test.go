@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeChecksumContainer answers the checksum script with the digests of
+// files, by remote path, computed with the tools it has, and any other command
+// like tar. A path in changed is digested as if it changed since the copy.
+type fakeChecksumContainer struct {
+	fakeExecutor
+	files   map[string]string
+	tools   map[string]bool
+	changed string
+}
+
+func (f *fakeChecksumContainer) Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	for i, arg := range command {
+		if arg != "sh" || i+3 >= len(command) || command[i+2] != checksumScript {
+			continue
+		}
+		f.commands = append(f.commands, command)
+		tool := command[i+4]
+		if !f.tools[tool] {
+			return exitCodeError(127)
+		}
+		for _, name := range command[i+5:] {
+			content, ok := f.files[name]
+			if !ok {
+				_, _ = io.WriteString(stdout, "-\n")
+				continue
+			}
+			if name == f.changed {
+				content += "appended since"
+			}
+			var sum []byte
+			if tool == "sha256sum" {
+				s := sha256.Sum256([]byte(content))
+				sum = s[:]
+			} else {
+				s := md5.Sum([]byte(content))
+				sum = s[:]
+			}
+			_, _ = io.WriteString(stdout, hex.EncodeToString(sum)+"\n")
+		}
+		return nil
+	}
+	return f.fakeExecutor.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func newChecksumContainer(t *testing.T, tools ...string) *fakeChecksumContainer {
+	files := map[string]string{"log/app.log": "app\n", "log/gc/0.log": "gc\n"}
+	remote := map[string]string{}
+	for name, content := range files {
+		remote["/var/"+name] = content
+	}
+	f := &fakeChecksumContainer{fakeExecutor: fakeExecutor{stdout: createTestTar(t, files).Bytes()}, files: remote, tools: map[string]bool{}}
+	for _, tool := range tools {
+		f.tools[tool] = true
+	}
+	return f
+}
+
+func runChecksumCopy(t *testing.T, executor remoteExecutor) (string, string, string, error) {
+	t.Helper()
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	o.Checksum = true
+	var out, errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+	dest := filepath.Join(mustTempDir(t), "log")
+	err := o.RunWithArgs(context.Background(), "pod:/var/log", dest)
+	return dest, out.String(), errOut.String(), err
+}
+
+func TestCopyChecksum(t *testing.T) {
+	executor := newChecksumContainer(t, "sha256sum", "md5sum")
+	dest, out, _, err := runChecksumCopy(t, executor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appSum := sha256.Sum256([]byte("app\n"))
+	gcSum := sha256.Sum256([]byte("gc\n"))
+	for _, want := range []string{
+		"Verified 2 files against the sha256 computed in the pod:\n",
+		hex.EncodeToString(appSum[:]) + "  " + filepath.Join(dest, "app.log") + "\n",
+		hex.EncodeToString(gcSum[:]) + "  " + filepath.Join(dest, "gc", "0.log") + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output %q lacks %q", out, want)
+		}
+	}
+	last := executor.commands[len(executor.commands)-1]
+	if got := strings.Join(last[len(last)-3:], " "); got != "sha256sum /var/log/app.log /var/log/gc/0.log" && got != "sha256sum /var/log/gc/0.log /var/log/app.log" {
+		t.Errorf("checksum command = %q", last)
+	}
+}
+
+func TestCopyChecksumMismatch(t *testing.T) {
+	executor := newChecksumContainer(t, "sha256sum")
+	executor.changed = "/var/log/gc/0.log"
+	dest, out, _, err := runChecksumCopy(t, executor)
+	if err == nil || !strings.Contains(err.Error(), "pod default/pod: 1 of 2 copied files differ from the pod: "+filepath.Join(dest, "gc", "0.log")+" (sha256 ") {
+		t.Fatalf("err = %v, want the mismatch", err)
+	}
+	if strings.Contains(out, "Copied") {
+		t.Errorf("a copy that failed verification is reported: %q", out)
+	}
+}
+
+func TestCopyChecksumGoneInPod(t *testing.T) {
+	executor := newChecksumContainer(t, "sha256sum")
+	delete(executor.files, "/var/log/app.log")
+	_, _, _, err := runChecksumCopy(t, executor)
+	if err == nil || !strings.Contains(err.Error(), "log/app.log can't be read in the pod anymore") {
+		t.Fatalf("err = %v, want the file the pod can't read", err)
+	}
+}
+
+func TestCopyChecksumFallsBackToMD5(t *testing.T) {
+	_, out, _, err := runChecksumCopy(t, newChecksumContainer(t, "md5sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appSum := md5.Sum([]byte("app\n"))
+	if !strings.Contains(out, "against the md5 computed in the pod") || !strings.Contains(out, hex.EncodeToString(appSum[:])) {
+		t.Errorf("output = %q, want the md5 digests", out)
+	}
+}
+
+func TestCopyChecksumWithoutTools(t *testing.T) {
+	dest, out, errOut, err := runChecksumCopy(t, newChecksumContainer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errOut, "Warning: pod default/pod has no sh with sha256sum or md5sum in container app, the copied files are not verified") {
+		t.Errorf("stderr = %q, want the warning", errOut)
+	}
+	if strings.Contains(out, "Verified") {
+		t.Errorf("output = %q, claims a verification", out)
+	}
+	assertFileContent(t, filepath.Join(dest, "app.log"), "app\n")
+}
+
+func TestCopyChecksumBatches(t *testing.T) {
+	files := map[string]string{}
+	remote := map[string]string{}
+	for i := range checksumBatch + 3 {
+		name := fmt.Sprintf("log/%04d", i)
+		files[name] = name
+		remote["/var/"+name] = name
+	}
+	executor := &fakeChecksumContainer{fakeExecutor: fakeExecutor{stdout: createTestTar(t, files).Bytes()}, files: remote, tools: map[string]bool{"sha256sum": true}}
+	_, out, _, err := runChecksumCopy(t, executor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Verified 515 files") {
+		t.Errorf("output = %q", out)
+	}
+	var checksums int
+	for _, c := range executor.commands {
+		if strings.Contains(strings.Join(c, " "), checksumScript) {
+			checksums++
+		}
+	}
+	if checksums != 2 {
+		t.Errorf("ran %d checksum commands, want 2 batches", checksums)
+	}
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// chmodModes is --chmod parsed: the modes the extracted files and directories
+// get instead of those of the archive, where setFile and setDir are set.
+type chmodModes struct {
+	file, dir       os.FileMode
+	setFile, setDir bool
+}
+
+// parseChmod parses --chmod, an octal mode for files and directories alike,
+// or D and F modes for either, such as D755,F644. Empty keeps the modes of
+// the archive.
+func parseChmod(value string) (chmodModes, error) {
+	var m chmodModes
+	if value == "" {
+		return m, nil
+	}
+	invalid := fmt.Errorf("invalid --chmod %q, want an octal mode such as 644, or D and F modes such as D755,F644", value)
+	for _, part := range strings.Split(value, ",") {
+		kind := byte(0)
+		if part != "" && (part[0] == 'D' || part[0] == 'F') {
+			kind, part = part[0], part[1:]
+		}
+		n, err := strconv.ParseUint(part, 8, 32)
+		if err != nil || part == "" {
+			return m, invalid
+		}
+		if n > 0o777 {
+			return m, fmt.Errorf("invalid --chmod %q, setuid, setgid and sticky bits can't be given to copied files", value)
+		}
+		mode := os.FileMode(n)
+		switch {
+		case kind == 'D' && !m.setDir:
+			m.dir, m.setDir = mode, true
+		case kind == 'F' && !m.setFile:
+			m.file, m.setFile = mode, true
+		case kind == 0 && !m.setDir && !m.setFile && !strings.Contains(value, ","):
+			m.dir, m.file, m.setDir, m.setFile = mode, mode, true, true
+		default:
+			return m, invalid
+		}
+	}
+	return m, nil
+}
+
+// entryMode is the mode of a file, or of a directory when dir is set: mode,
+// that of the archive, unless --chmod replaces it.
+func (m chmodModes) entryMode(dir bool, mode os.FileMode) os.FileMode {
+	switch {
+	case dir && m.setDir:
+		return m.dir
+	case !dir && m.setFile:
+		return m.file
+	}
+	return mode
+}
@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+func TestParseChmod(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    chmodModes
+		wantErr string
+	}{
+		{"", chmodModes{}, ""},
+		{"644", chmodModes{file: 0o644, dir: 0o644, setFile: true, setDir: true}, ""},
+		{"0640", chmodModes{file: 0o640, dir: 0o640, setFile: true, setDir: true}, ""},
+		{"D755,F644", chmodModes{file: 0o644, dir: 0o755, setFile: true, setDir: true}, ""},
+		{"F600", chmodModes{file: 0o600, setFile: true}, ""},
+		{"D750", chmodModes{dir: 0o750, setDir: true}, ""},
+		{"4755", chmodModes{}, "setuid, setgid and sticky bits"},
+		{"F2644", chmodModes{}, "setuid, setgid and sticky bits"},
+		{"D1777", chmodModes{}, "setuid, setgid and sticky bits"},
+		{"u+r", chmodModes{}, "want an octal mode"},
+		{"888", chmodModes{}, "want an octal mode"},
+		{"D", chmodModes{}, "want an octal mode"},
+		{"D755,D700", chmodModes{}, "want an octal mode"},
+		{"644,F600", chmodModes{}, "want an octal mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseChmod(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseChmod(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("parseChmod(%q) = %+v, %v, want %+v", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// rootOnlyTar is a tree as a container running as root leaves it, readable
+// by its owner only.
+func rootOnlyTar(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "dump/", Typeflag: tar.TypeDir, Mode: 0o700},
+		{Name: "dump/heap.hprof", Typeflag: tar.TypeReg, Mode: 0o600, Size: int64(len(contentStr))},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if h.Size > 0 {
+			if _, err := tw.Write([]byte(contentStr)); err != nil {
+				t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return &buf
+}
+
+func TestExtractChmod(t *testing.T) {
+	tests := []struct {
+		chmod             string
+		wantDir, wantFile os.FileMode
+	}{
+		{"D755,F644", 0o755, 0o644},
+		{"F640", 0o700, 0o640},
+		// a directory its entries can't be written to at first
+		{"D555,F444", 0o555, 0o444},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chmod, func(t *testing.T) {
+			o := newDefaultCopyOptions()
+			o.Chmod = tt.chmod
+			dest := mustTempDir(t)
+			t.Cleanup(func() {
+				//nolint:errcheck
+				_ = os.Chmod(filepath.Join(dest, "dump"), 0o755)
+			})
+
+			if _, err := o.extractTar(context.Background(), rootOnlyTar(t), dest, ""); err != nil {
+				t.Fatalf("extractTar() error = %v", err)
+			}
+			if info, err := os.Stat(filepath.Join(dest, "dump")); err != nil || info.Mode().Perm() != tt.wantDir {
+				t.Errorf("dump = %v, %v, want mode %04o", info, err, tt.wantDir)
+			}
+			if info, err := os.Stat(filepath.Join(dest, "dump", "heap.hprof")); err != nil || info.Mode().Perm() != tt.wantFile {
+				t.Errorf("heap.hprof = %v, %v, want mode %04o", info, err, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestCopyValidateChmod(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(o *CopyOptions)
+		wantErr string
+	}{
+		{"preserve", func(o *CopyOptions) { o.Preserve = true }, "--chmod can't be used with --preserve"},
+		{"chunked", func(o *CopyOptions) { o.Chunked = true }, "--chmod can't be used with --preserve, which keeps the modes of the archive, or --chunked"},
+		{"setuid", func(o *CopyOptions) { o.Chmod = "4755" }, "setuid, setgid and sticky bits"},
+		{"invalid", func(o *CopyOptions) { o.Chmod = "a+r" }, `invalid --chmod "a+r"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.ClientConfig = &restclient.Config{}
+			o.Chmod = "644"
+			tt.set(o)
+			if err := o.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// defaultChunkSize is the size of the ranges --chunked transfers.
+const defaultChunkSize = "64Mi"
+
+// chunkAttempts is how often a chunk is fetched before a copy gives up on it
+// failing verification.
+const chunkAttempts = 3
+
+// chunkReader writes chunk $3 of $2 bytes of the file $1 to stdout, with dd or,
+// in containers without it, tail and head. $4 is the offset of the chunk
+// counted from 1, as tail takes it.
+const chunkReader = `if command -v dd >/dev/null 2>&1; then dd if="$1" bs="$2" skip="$3" count=1; else tail -c +"$4" -- "$1" | head -c "$2"; fi`
+
+// chunkState is the sidecar of a chunked copy: the chunks of the partial file
+// that were verified, in order. A later run with the same source, size and
+// chunk size resumes after them.
+type chunkState struct {
+	Source    string   `json:"source"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	Verified  []string `json:"verified"`
+}
+
+// chunkedCopy is one --chunked copy of a single remote file.
+type chunkedCopy struct {
+	o         *CopyOptions
+	pod       *corev1.Pod
+	container string
+	src       *fileSpec
+	dest      string
+	size      int64
+	state     chunkState
+	// file hashes the whole partial file, for the sources manifest.
+	file hash.Hash
+}
+
+func (c *chunkedCopy) partialPath() string { return c.dest + ".rexec-partial" }
+func (c *chunkedCopy) statePath() string   { return c.dest + ".rexec-chunks.json" }
+
+func (c *chunkedCopy) chunks() int64 {
+	return (c.size + c.state.ChunkSize - 1) / c.state.ChunkSize
+}
+
+// chunkLen is the length of chunk i, the last one is short.
+func (c *chunkedCopy) chunkLen(i int64) int64 {
+	return min(c.state.ChunkSize, c.size-i*c.state.ChunkSize)
+}
+
+// copyChunked copies the single file src in chunks of ChunkSize, each through
+// an audited exec of its own and verified against a sha256 computed in the
+// container before it is kept. The chunks go to a partial file next to the
+// destination, renamed over it once complete, and a sidecar records the
+// verified ones so an interrupted copy resumes where it stopped.
+func (o *CopyOptions) copyChunked(ctx context.Context, src, dest *fileSpec) error {
+	chunkSize, err := parseChunkSize(o.ChunkSize)
+	if err != nil {
+		return err
+	}
+	pod, container, err := o.validateAndGetPodContainer(ctx, src)
+	if err != nil {
+		return err
+	}
+	c := &chunkedCopy{
+		o: o, pod: pod, container: container, src: src,
+		dest:  copiedPath(dest.File, filepath.Base(src.File)),
+		state: chunkState{ChunkSize: chunkSize},
+		file:  sha256.New(),
+	}
+	if abs, err := filepath.Abs(c.dest); err == nil {
+		if err := o.checkManifestPath(abs); err != nil {
+			return err
+		}
+	}
+	if o.manifest != nil {
+		o.manifest.Namespace = pod.Namespace
+		o.manifest.Pod = pod.Name
+		o.manifest.PodUID = string(pod.UID)
+		o.manifest.Container = container
+		o.manifest.RequestedPath = src.File
+		o.manifest.RemoteDir = filepath.Dir(src.File)
+	}
+
+	if c.size, err = c.remoteSize(ctx); err != nil {
+		return err
+	}
+	if limits := notices.current(); limits != nil && limits.OutputCapBytes > 0 && min(chunkSize, c.size) > limits.OutputCapBytes {
+		newOutput(o.IOStreams.ErrOut).printf("Warning: chunks of %s are over the output cap of %s of the session and will be cut off, pass a --chunk-size of at most %s\n",
+			binarySize(chunkSize), binarySize(limits.OutputCapBytes), binarySize(limits.OutputCapBytes))
+	}
+	partial, resumed, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if partial != nil {
+			//nolint:errcheck
+			_ = partial.Close()
+		}
+	}()
+
+	for i := int64(len(c.state.Verified)); i < c.chunks(); i++ {
+		if err := c.fetchVerified(ctx, partial, i); err != nil {
+			return err
+		}
+	}
+	if err := partial.Sync(); err != nil {
+		return err
+	}
+	if err := partial.Close(); err != nil {
+		return err
+	}
+	partial = nil
+	if err := os.Rename(c.partialPath(), c.dest); err != nil {
+		return err
+	}
+	if o.owner != nil {
+		o.own(c.dest)
+		if err := o.applyOwner(); err != nil {
+			return err
+		}
+		o.warnings.summary()
+	}
+	if err := os.Remove(c.statePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if o.manifest != nil {
+		o.manifest.Entries = append(o.manifest.Entries, sourceEntry{
+			Path: filepath.Base(src.File), Type: "file", Size: c.size, SHA256: hex.EncodeToString(c.file.Sum(nil)),
+		})
+	}
+
+	if _, err := fmt.Fprintf(o.summaryOut(), "Copied %s to %s (%d chunks verified, %d resumed)\n",
+		src.remote(), c.dest, c.chunks()-resumed, resumed); err != nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	if o.Open || o.OpenWith != "" {
+		o.openDestination(c.dest)
+	}
+	return nil
+}
+
+// remoteSizer prints the size of the file $1 from stat, or from wc where there
+// is no stat, which may read the whole file. A directory is refused, dd can't
+// read it.
+const remoteSizer = `[ -d "$1" ] && { echo "$1 is a directory, --chunked copies a single file" >&2; exit 1; }; stat -L -c %s -- "$1" || wc -c < "$1"`
+
+// remoteSize is the size of the remote file.
+func (c *chunkedCopy) remoteSize(ctx context.Context) (int64, error) {
+	stdout, err := c.run(ctx, []string{"sh", "-c", remoteSizer, "sh", c.src.File})
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	field, _, _ := strings.Cut(strings.TrimSpace(lines[len(lines)-1]), " ")
+	size, err := strconv.ParseInt(field, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("pod %s/%s: unexpected size of %s: %q", c.src.PodNamespace, c.src.PodName, c.src.File, stdout.String())
+	}
+	return size, nil
+}
+
+// open opens the partial file, resuming after the chunks of the sidecar that
+// are still intact in it, and returns how many chunks were resumed.
+func (c *chunkedCopy) open() (*os.File, int64, error) {
+	fresh := chunkState{
+		Source:    fmt.Sprintf("%s/%s/%s:%s", c.pod.Namespace, c.pod.Name, c.container, c.src.File),
+		Size:      c.size,
+		ChunkSize: c.state.ChunkSize,
+		Verified:  []string{},
+	}
+	c.state = fresh
+	partial, err := os.OpenFile(c.partialPath(), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var previous chunkState
+	if data, err := os.ReadFile(c.statePath()); err == nil && json.Unmarshal(data, &previous) == nil {
+		if previous.Source == fresh.Source && previous.Size == fresh.Size && previous.ChunkSize == fresh.ChunkSize {
+			c.state.Verified = c.intactChunks(partial, previous.Verified)
+		} else {
+			//nolint:errcheck
+			_, _ = fmt.Fprintf(c.o.IOStreams.ErrOut, "Warning: %s is from another source, size or chunk size, starting over\n", c.statePath())
+		}
+	}
+	resumed := int64(len(c.state.Verified))
+	if err := partial.Truncate(resumed * c.state.ChunkSize); err != nil {
+		//nolint:errcheck
+		_ = partial.Close()
+		return nil, 0, err
+	}
+	if err := c.saveState(); err != nil {
+		//nolint:errcheck
+		_ = partial.Close()
+		return nil, 0, err
+	}
+	return partial, resumed, nil
+}
+
+// intactChunks re-hashes the partial file and keeps the verified chunks up to
+// the first one that no longer matches, the file may have been touched since.
+func (c *chunkedCopy) intactChunks(partial *os.File, verified []string) []string {
+	intact := []string{}
+	for i, want := range verified {
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(h, c.file), io.NewSectionReader(partial, int64(i)*c.state.ChunkSize, c.chunkLen(int64(i))))
+		if err != nil || n != c.chunkLen(int64(i)) || hex.EncodeToString(h.Sum(nil)) != want {
+			//nolint:errcheck
+			_, _ = fmt.Fprintf(c.o.IOStreams.ErrOut, "Warning: chunk %d of %s changed since it was verified, resuming from it\n", i, c.partialPath())
+			// the running hash took the bytes of the bad chunk, start it over
+			c.file.Reset()
+			if _, err := io.Copy(c.file, io.NewSectionReader(partial, 0, int64(i)*c.state.ChunkSize)); err != nil {
+				c.file.Reset()
+				return []string{}
+			}
+			return intact
+		}
+		intact = append(intact, want)
+	}
+	return intact
+}
+
+// saveState replaces the sidecar, through a rename so it is never half written.
+func (c *chunkedCopy) saveState() error {
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	tmp := c.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.statePath())
+}
+
+// fetchVerified appends chunk i to partial once its sha256 matches the one
+// computed in the container, fetching it up to chunkAttempts times.
+func (c *chunkedCopy) fetchVerified(ctx context.Context, partial *os.File, i int64) error {
+	offset := i * c.state.ChunkSize
+	args := []string{c.src.File, strconv.FormatInt(c.state.ChunkSize, 10), strconv.FormatInt(i, 10), strconv.FormatInt(offset+1, 10)}
+	for attempt := 1; ; attempt++ {
+		if err := partial.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		h := sha256.New()
+		var stderr bytes.Buffer
+		counter := &countingWriter{w: io.MultiWriter(partial, h)}
+		if err := c.runTo(ctx, append([]string{"sh", "-c", chunkReader, "sh"}, args...), counter, &stderr); err != nil {
+			return err
+		}
+		if counter.n != c.chunkLen(i) {
+			return fmt.Errorf("pod %s/%s: chunk %d of %s is %d bytes instead of %d, the file changed during the copy; run again to start over",
+				c.src.PodNamespace, c.src.PodName, i, c.src.File, counter.n, c.chunkLen(i))
+		}
+
+		remote, err := c.run(ctx, append([]string{"sh", "-c", chunkReader + " | sha256sum", "sh"}, args...))
+		if err != nil {
+			return err
+		}
+		want, _, _ := strings.Cut(strings.TrimSpace(remote.String()), " ")
+		if _, err := hex.DecodeString(want); err != nil || len(want) != sha256.Size*2 {
+			return fmt.Errorf("pod %s/%s: unexpected sha256sum output %q", c.src.PodNamespace, c.src.PodName, remote.String())
+		}
+		got := hex.EncodeToString(h.Sum(nil))
+		if got == want {
+			if _, err := io.Copy(c.file, io.NewSectionReader(partial, offset, counter.n)); err != nil {
+				return err
+			}
+			c.state.Verified = append(c.state.Verified, got)
+			return c.saveState()
+		}
+		if attempt == chunkAttempts {
+			return fmt.Errorf("pod %s/%s: chunk %d of %s failed verification %d times (sha256 %s, remote %s); run again to resume from it",
+				c.src.PodNamespace, c.src.PodName, i, c.src.File, chunkAttempts, got, want)
+		}
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(c.o.IOStreams.ErrOut, "Warning: chunk %d of %s failed verification (sha256 %s, remote %s), fetching it again\n", i, c.src.File, got, want)
+	}
+}
+
+// run runs command in the container and returns its stdout.
+func (c *chunkedCopy) run(ctx context.Context, command []string) (*bytes.Buffer, error) {
+	var stdout, stderr bytes.Buffer
+	err := c.runTo(ctx, command, &stdout, &stderr)
+	return &stdout, err
+}
+
+// runTo runs command in the container, with failures explained like those of
+// the tar of a plain copy, or as a missing tool.
+func (c *chunkedCopy) runTo(ctx context.Context, command []string, stdout io.Writer, stderr *bytes.Buffer) error {
+	command, err := c.o.remoteCommand(ctx, c.pod, c.container, command)
+	if err != nil {
+		return err
+	}
+	execErr := c.o.execute(ctx, c.pod, c.container, command, stdout, stderr)
+	var cancelled copyCancelledError
+	if errors.As(execErr, &cancelled) {
+		return execErr
+	}
+	if execErr == nil {
+		return nil
+	}
+	if kind := classifyRemoteStderr(stderr.String()); kind != remoteErrNotFound && kind != remoteErrPermission && binaryMissing(execErr, stderr.String()) {
+		return fmt.Errorf("pod %s/%s: --chunked needs sh, stat or wc, dd or tail and head, and sha256sum in container %s: %s",
+			c.src.PodNamespace, c.src.PodName, c.container, strings.TrimSpace(stderr.String()))
+	}
+	return c.o.handleExecError(execErr, stderr.String(), c.src, c.container)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseChunkSize parses a --chunk-size quantity such as 64Mi.
+func parseChunkSize(value string) (int64, error) {
+	q, err := resource.ParseQuantity(value)
+	if err != nil || q.Value() <= 0 {
+		return 0, fmt.Errorf("invalid --chunk-size %q, want a positive size such as 64Mi", value)
+	}
+	return q.Value(), nil
+}
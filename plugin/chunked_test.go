@@ -0,0 +1,271 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	restclient "k8s.io/client-go/rest"
+)
+
+// chunkPod serves a file to --chunked copies like a container with sh, stat,
+// dd and sha256sum. corrupt flips a byte of that many fetches of a chunk,
+// failAt breaks the stream in the middle of the fetch of a chunk once.
+type chunkPod struct {
+	content []byte
+	corrupt map[int64]int
+	failAt  int64
+	fetched []int64
+}
+
+func newChunkPod(content string) *chunkPod {
+	return &chunkPod{content: []byte(content), corrupt: map[int64]int{}, failAt: -1}
+}
+
+func (p *chunkPod) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, stderr io.Writer) error {
+	if command[len(command)-1] == "true" {
+		return nil
+	}
+	i := slices.Index(command, "-c")
+	script, args := command[i+1], command[i+3:]
+	if script == remoteSizer {
+		_, err := fmt.Fprintf(stdout, "%d\n", len(p.content))
+		return err
+	}
+	size, _ := strconv.ParseInt(args[1], 10, 64)
+	n, _ := strconv.ParseInt(args[2], 10, 64)
+	end := int64(len(p.content))
+	chunk := p.content[min(n*size, end):min((n+1)*size, end)]
+	if script == chunkReader+" | sha256sum" {
+		_, err := fmt.Fprintf(stdout, "%x  -\n", sha256.Sum256(chunk))
+		return err
+	}
+
+	p.fetched = append(p.fetched, n)
+	if n == p.failAt {
+		p.failAt = -1
+		//nolint:errcheck
+		_, _ = stdout.Write(chunk[:len(chunk)/2])
+		//nolint:errcheck
+		_, _ = io.WriteString(stderr, "error: connection reset by peer")
+		return errors.New("stream error")
+	}
+	chunk = append([]byte(nil), chunk...)
+	if p.corrupt[n] > 0 {
+		p.corrupt[n]--
+		chunk[0] ^= 0xff
+	}
+	_, err := stdout.Write(chunk)
+	return err
+}
+
+func newChunkedCopyOptions(pod *chunkPod) (*CopyOptions, *bytes.Buffer, *bytes.Buffer) {
+	o := newFakePodCopyOptions(pod)
+	o.Chunked, o.ChunkSize = true, "4"
+	var out, errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+	return o, &out, &errOut
+}
+
+func readChunkState(t *testing.T, dest string) chunkState {
+	t.Helper()
+	data, err := os.ReadFile(dest + ".rexec-chunks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state chunkState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s = %q, want %q", path, got, want)
+	}
+}
+
+func TestChunkedCopy(t *testing.T) {
+	pod := newChunkPod("0123456789")
+	o, out, _ := newChunkedCopyOptions(pod)
+	dir := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dir); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "db.snapshot")
+	assertFileContent(t, dest, "0123456789")
+	assertFileDoesNotExist(t, dest+".rexec-partial")
+	assertFileDoesNotExist(t, dest+".rexec-chunks.json")
+	assertContains(t, out.String(), "(3 chunks verified, 0 resumed)")
+	if !reflect.DeepEqual(pod.fetched, []int64{0, 1, 2}) {
+		t.Fatalf("fetched chunks %v, want 0 1 2", pod.fetched)
+	}
+}
+
+func TestChunkedCopyEmptyFile(t *testing.T) {
+	o, _, _ := newChunkedCopyOptions(newChunkPod(""))
+	dest := filepath.Join(mustTempDir(t), "empty")
+	if err := o.RunWithArgs(context.Background(), "pod:/empty", dest); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, dest, "")
+}
+
+func TestChunkedCopyRefetchesCorruptChunk(t *testing.T) {
+	pod := newChunkPod("0123456789")
+	pod.corrupt[1] = 1
+	o, _, errOut := newChunkedCopyOptions(pod)
+	dest := filepath.Join(mustTempDir(t), "db.snapshot")
+
+	if err := o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, dest, "0123456789")
+	assertContains(t, errOut.String(), "chunk 1 of /backup/db.snapshot failed verification")
+	if !reflect.DeepEqual(pod.fetched, []int64{0, 1, 1, 2}) {
+		t.Fatalf("fetched chunks %v, want chunk 1 fetched again", pod.fetched)
+	}
+}
+
+func TestChunkedCopyGivesUpOnCorruptChunk(t *testing.T) {
+	pod := newChunkPod("0123456789")
+	pod.corrupt[1] = chunkAttempts
+	o, _, _ := newChunkedCopyOptions(pod)
+	dest := filepath.Join(mustTempDir(t), "db.snapshot")
+
+	err := o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest)
+	if err == nil || !strings.Contains(err.Error(), "chunk 1 of /backup/db.snapshot failed verification 3 times") {
+		t.Fatalf("want chunk 1 failing verification, got %v", err)
+	}
+	assertFileDoesNotExist(t, dest)
+	if state := readChunkState(t, dest); len(state.Verified) != 1 {
+		t.Fatalf("want chunk 0 recorded as verified, got %+v", state)
+	}
+}
+
+func TestChunkedCopyResumesInterruptedRun(t *testing.T) {
+	pod := newChunkPod("0123456789")
+	pod.failAt = 2
+	o, _, _ := newChunkedCopyOptions(pod)
+	dest := filepath.Join(mustTempDir(t), "db.snapshot")
+
+	if err := o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("want the interrupted fetch reported, got %v", err)
+	}
+	assertFileDoesNotExist(t, dest)
+	if state := readChunkState(t, dest); len(state.Verified) != 2 || state.Size != 10 || state.ChunkSize != 4 {
+		t.Fatalf("unexpected state after the interrupted run %+v", state)
+	}
+
+	pod.fetched = nil
+	o, out, _ := newChunkedCopyOptions(pod)
+	if err := o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, dest, "0123456789")
+	assertContains(t, out.String(), "(1 chunks verified, 2 resumed)")
+	if !reflect.DeepEqual(pod.fetched, []int64{2}) {
+		t.Fatalf("fetched chunks %v, want only chunk 2", pod.fetched)
+	}
+}
+
+func TestChunkedCopyResumeRechecksPartialFile(t *testing.T) {
+	pod := newChunkPod("0123456789")
+	pod.failAt = 2
+	o, _, _ := newChunkedCopyOptions(pod)
+	dest := filepath.Join(mustTempDir(t), "db.snapshot")
+	//nolint:errcheck
+	_ = o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest)
+
+	// chunk 1 of the partial file is damaged between the runs
+	partial, err := os.OpenFile(dest+".rexec-partial", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partial.WriteAt([]byte("X"), 5); err != nil {
+		t.Fatal(err)
+	}
+	//nolint:errcheck
+	_ = partial.Close()
+
+	pod.fetched = nil
+	o, _, errOut := newChunkedCopyOptions(pod)
+	if err := o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, dest, "0123456789")
+	assertContains(t, errOut.String(), "chunk 1 of")
+	if !reflect.DeepEqual(pod.fetched, []int64{1, 2}) {
+		t.Fatalf("fetched chunks %v, want 1 and 2", pod.fetched)
+	}
+}
+
+func TestChunkedCopyStartsOverWhenSourceChanged(t *testing.T) {
+	pod := newChunkPod("0123456789")
+	pod.failAt = 2
+	o, _, _ := newChunkedCopyOptions(pod)
+	dest := filepath.Join(mustTempDir(t), "db.snapshot")
+	//nolint:errcheck
+	_ = o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest)
+
+	pod.content, pod.fetched = []byte("0123456789abc"), nil
+	o, _, errOut := newChunkedCopyOptions(pod)
+	if err := o.RunWithArgs(context.Background(), "pod:/backup/db.snapshot", dest); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, dest, "0123456789abc")
+	assertContains(t, errOut.String(), "starting over")
+	if !reflect.DeepEqual(pod.fetched, []int64{0, 1, 2, 3}) {
+		t.Fatalf("fetched chunks %v, want all of them", pod.fetched)
+	}
+}
+
+func TestValidateChunked(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*CopyOptions)
+		wantErr string
+	}{
+		{"valid", func(o *CopyOptions) {}, ""},
+		{"dry run", func(o *CopyOptions) { o.DryRun = true }, "can't be used with --dry-run"},
+		{"entries from", func(o *CopyOptions) { o.EntriesFrom = "plan.json" }, "can't be used with --dry-run or --entries-from"},
+		{"zero size", func(o *CopyOptions) { o.ChunkSize = "0" }, "invalid --chunk-size"},
+		{"bad size", func(o *CopyOptions) { o.ChunkSize = "lots" }, "invalid --chunk-size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, _, _ := newChunkedCopyOptions(newChunkPod(""))
+			o.ClientConfig = &restclient.Config{}
+			tt.modify(o)
+			err := o.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
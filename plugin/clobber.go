@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// unchanged reports whether SkipExisting leaves targetAbs, where the regular
+// file of header is extracted, as it is: a regular file of its size and
+// modification time, as an earlier run of the copy left it.
+func (o *CopyOptions) unchanged(header *tar.Header, targetAbs string) bool {
+	if !o.SkipExisting {
+		return false
+	}
+	info, err := os.Lstat(targetAbs)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	// tar keeps whole seconds unless it writes PAX times
+	return info.Size() == header.Size && info.ModTime().Truncate(time.Second).Equal(header.ModTime.Truncate(time.Second))
+}
+
+// keepExisting reports whether the entry extracted to targetAbs is skipped
+// because it would overwrite an existing file: always with NoClobber, and
+// when the answer to the confirmation asked on a terminal stdout is no.
+// Existing directories are never in the way, their entries are merged.
+func (o *CopyOptions) keepExisting(targetAbs string) bool {
+	info, err := os.Lstat(targetAbs)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	switch {
+	case o.NoClobber:
+	case o.Overwrite || o.overwriteAll || !info.Mode().IsRegular():
+		return false
+	case !o.confirmOverwrite(targetAbs):
+	default:
+		return false
+	}
+	o.keptExisting++
+	return true
+}
+
+// confirmOverwrite asks whether the existing file path is overwritten when
+// stdout is a terminal, and answers yes otherwise. All answers yes for the
+// files after it too, no answer, like the end of stdin, is a no.
+func (o *CopyOptions) confirmOverwrite(path string) bool {
+	if _, tty := terminalFd(o.IOStreams.Out); !tty || o.IOStreams.In == nil {
+		return true
+	}
+	if o.answers == nil {
+		o.answers = bufio.NewReader(o.IOStreams.In)
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.Out, "Overwrite %s? [y/N/a(ll)] ", path)
+	answer, _ := o.answers.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	case "a", "all":
+		o.overwriteAll = true
+		return true
+	}
+	return false
+}
+
+// keptSummary is the part of the summary of a copy about the existing files
+// it left as they are.
+func (o *CopyOptions) keptSummary() string {
+	if o.keptExisting == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %d existing files kept", o.keptExisting)
+}
+
+// unchangedSummary is the part of the summary of a copy about the files
+// SkipExisting found unchanged.
+func (o *CopyOptions) unchangedSummary() string {
+	if o.Result.Unchanged == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %d unchanged files skipped", o.Result.Unchanged)
+}
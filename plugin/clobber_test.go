@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+// clobberTar is a directory db of the files a.log and b.log.
+func clobberTar(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "db/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "db/a.log", Typeflag: tar.TypeReg, Mode: 0o644, Size: 6},
+		{Name: "db/b.log", Typeflag: tar.TypeReg, Mode: 0o644, Size: 6},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if h.Size > 0 {
+			if _, err := tw.Write([]byte("remote")); err != nil {
+				t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return &buf
+}
+
+// existingDB is a destination where db/a.log and db/b.log exist.
+func existingDB(t *testing.T) string {
+	t.Helper()
+	dest := mustTempDir(t)
+	if err := os.Mkdir(filepath.Join(dest, "db"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.log", "b.log"} {
+		if err := os.WriteFile(filepath.Join(dest, "db", name), []byte("local"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dest
+}
+
+func withTerminalStdout(t *testing.T) {
+	t.Helper()
+	old := terminalFd
+	t.Cleanup(func() { terminalFd = old })
+	terminalFd = func(io.Writer) (int, bool) { return -1, true }
+}
+
+func TestExtractNoClobber(t *testing.T) {
+	withTerminalStdout(t)
+	var out bytes.Buffer
+	o := newDefaultCopyOptions()
+	o.IOStreams.Out = &out
+	o.NoClobber = true
+	dest := existingDB(t)
+	if err := os.Remove(filepath.Join(dest, "db", "b.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.extractTar(context.Background(), clobberTar(t), dest, "db"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	assertFileContent(t, filepath.Join(dest, "db", "a.log"), "local")
+	assertFileContent(t, filepath.Join(dest, "db", "b.log"), "remote")
+	if o.keptSummary() != ", 1 existing files kept" {
+		t.Errorf("keptSummary() = %q", o.keptSummary())
+	}
+	if out.Len() != 0 {
+		t.Errorf("--no-clobber asked %q", out.String())
+	}
+}
+
+func TestExtractConfirmOverwrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		answers   string
+		overwrite bool
+		want      [2]string
+		prompts   int
+	}{
+		{"no then yes", "n\ny\n", false, [2]string{"local", "remote"}, 2},
+		{"end of input", "", false, [2]string{"local", "local"}, 2},
+		{"all", "a\n", false, [2]string{"remote", "remote"}, 1},
+		{"overwrite", "", true, [2]string{"remote", "remote"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTerminalStdout(t)
+			var out bytes.Buffer
+			o := newDefaultCopyOptions()
+			o.IOStreams.In, o.IOStreams.Out = strings.NewReader(tt.answers), &out
+			o.Overwrite = tt.overwrite
+			dest := existingDB(t)
+
+			if _, err := o.extractTar(context.Background(), clobberTar(t), dest, "db"); err != nil {
+				t.Fatalf(errExtractTar, err)
+			}
+			assertFileContent(t, filepath.Join(dest, "db", "a.log"), tt.want[0])
+			assertFileContent(t, filepath.Join(dest, "db", "b.log"), tt.want[1])
+			// the existing directory db is not asked about
+			if got := strings.Count(out.String(), "Overwrite "); got != tt.prompts {
+				t.Errorf("asked %d times, want %d: %q", got, tt.prompts, out.String())
+			}
+		})
+	}
+}
+
+func TestExtractOverwritesWithoutTerminal(t *testing.T) {
+	o := newDefaultCopyOptions()
+	dest := existingDB(t)
+
+	if _, err := o.extractTar(context.Background(), clobberTar(t), dest, "db"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	assertFileContent(t, filepath.Join(dest, "db", "a.log"), "remote")
+}
+
+func TestCopyNoClobberSummary(t *testing.T) {
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: clobberTar(t).Bytes()})
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	o.NoClobber = true
+
+	if err := o.RunWithArgs(context.Background(), "pod:/db", existingDB(t)); err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, out.String(), ", 2 existing files kept\n")
+}
+
+func TestExtractForceStillConfirmsOverwrite(t *testing.T) {
+	withTerminalStdout(t)
+	var out bytes.Buffer
+	o := newDefaultCopyOptions()
+	o.IOStreams.In, o.IOStreams.Out = strings.NewReader("n\nn\n"), &out
+	o.Force = true
+	dest := existingDB(t)
+
+	if _, err := o.extractTar(context.Background(), clobberTar(t), dest, "db"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	// --force is about the node and the space, not the local files
+	assertFileContent(t, filepath.Join(dest, "db", "a.log"), "local")
+	if got := strings.Count(out.String(), "Overwrite "); got != 2 {
+		t.Errorf("asked %d times, want 2: %q", got, out.String())
+	}
+}
+
+func TestCopyValidateOverwrite(t *testing.T) {
+	o := newRunOptions()
+	o.ClientConfig = &restclient.Config{}
+	o.Overwrite, o.NoClobber = true, true
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "--overwrite can't be used with --no-clobber") {
+		t.Fatalf("Validate() = %v, want --overwrite and --no-clobber refused", err)
+	}
+}
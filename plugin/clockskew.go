@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+// clockSkewThreshold is how far the local clock must be off before a
+// certificate validity error is blamed on it.
+const clockSkewThreshold = 2 * time.Minute
+
+// certValidityTimes matches the times Go puts in a certificate validity error:
+// "current time 2024-01-01T10:00:00Z is before 2024-01-01T12:00:00Z".
+var certValidityTimes = regexp.MustCompile(`current time (\S+) is (before|after) (\S+)`)
+
+// clockSkewError replaces a certificate validity error caused by a wrong local
+// clock. The original error stays reachable with errors.Unwrap.
+type clockSkewError struct {
+	skew time.Duration
+	err  error
+}
+
+func (e *clockSkewError) Error() string {
+	direction := "ahead"
+	if e.skew < 0 {
+		direction = "behind"
+	}
+	minutes := int(math.Round(math.Abs(e.skew.Minutes())))
+	return fmt.Sprintf("your local clock appears to be off by ~%d minutes (%s); fix system time and retry", minutes, direction)
+}
+
+func (e *clockSkewError) Unwrap() error { return e.err }
+
+// explainClockSkew turns a certificate validity error into a clockSkewError
+// when the local clock is off, going by the Date of the API server. Any other
+// error, including other certificate errors, is returned as is.
+func explainClockSkew(ctx context.Context, err error, config *restclient.Config) error {
+	if err == nil || config == nil || !isCertValidityError(err) {
+		return err
+	}
+	date, dateErr := apiServerDate(ctx, config.Host)
+	return withClockSkew(err, time.Now(), date, dateErr == nil)
+}
+
+// withClockSkew decides whether err was caused by the local clock. With the
+// server's time the skew is measured; without it only a certificate that is
+// not valid yet is blamed on the clock, since an expired one may really be.
+func withClockSkew(err error, now, serverTime time.Time, haveServerTime bool) error {
+	if !isCertValidityError(err) {
+		return err
+	}
+	if haveServerTime {
+		if skew := now.Sub(serverTime); skew.Abs() >= clockSkewThreshold {
+			return &clockSkewError{skew: skew, err: err}
+		}
+		return err
+	}
+	m := certValidityTimes.FindStringSubmatch(err.Error())
+	if m == nil || m[2] != "before" {
+		return err
+	}
+	current, perr := time.Parse(time.RFC3339, m[1])
+	if perr != nil {
+		return err
+	}
+	notBefore, perr := time.Parse(time.RFC3339, m[3])
+	if perr != nil {
+		return err
+	}
+	if skew := current.Sub(notBefore); skew.Abs() >= clockSkewThreshold {
+		return &clockSkewError{skew: skew, err: err}
+	}
+	return err
+}
+
+// isCertValidityError reports whether err is an expired or not yet valid
+// certificate, and not an unknown authority or a hostname mismatch.
+func isCertValidityError(err error) bool {
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) {
+		return invalid.Reason == x509.Expired
+	}
+	return strings.Contains(err.Error(), "certificate has expired or is not yet valid")
+}
+
+// apiServerDate reads the Date header of an unauthenticated request to host.
+// The certificate is not verified, since that is what failed; nothing but the
+// header is used and no credentials are sent.
+func apiServerDate(ctx context.Context, host string) (time.Time, error) {
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, strings.TrimSuffix(host, "/")+"/version", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		//nolint:gosec // only the Date header is read
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Proxy:           http.ProxyFromEnvironment,
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	//nolint:errcheck
+	_ = resp.Body.Close()
+	return http.ParseTime(resp.Header.Get("Date"))
+}
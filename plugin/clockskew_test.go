@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+const (
+	notYetValidMsg = "tls: failed to verify certificate: x509: certificate has expired or is not yet valid: current time 2024-03-01T10:00:00Z is before 2024-03-01T10:47:00Z"
+	expiredMsg     = "tls: failed to verify certificate: x509: certificate has expired or is not yet valid: current time 2024-03-01T10:00:00Z is after 2024-02-01T00:00:00Z"
+)
+
+func TestWithClockSkew(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	wrapped := func(msg string) error {
+		return &url.Error{Op: "Get", URL: "https://api.example:6443/api", Err: errors.New(msg)}
+	}
+	tests := []struct {
+		name       string
+		err        error
+		serverTime time.Time
+		want       string
+	}{
+		{"not yet valid from the error", wrapped(notYetValidMsg), time.Time{}, "your local clock appears to be off by ~47 minutes (behind); fix system time and retry"},
+		{"expired without the server time", wrapped(expiredMsg), time.Time{}, ""},
+		{"server Date ahead of us", wrapped(expiredMsg), now.Add(-90 * time.Minute), "your local clock appears to be off by ~90 minutes (ahead); fix system time and retry"},
+		{"server Date agrees", wrapped(expiredMsg), now.Add(30 * time.Second), ""},
+		{"server Date overrides the error times", wrapped(notYetValidMsg), now, ""},
+		{"typed validity error", x509.CertificateInvalidError{Reason: x509.Expired}, now.Add(10 * time.Minute), "your local clock appears to be off by ~10 minutes (behind); fix system time and retry"},
+		{"unknown authority", x509.UnknownAuthorityError{}, now.Add(time.Hour), ""},
+		{"hostname mismatch", x509.HostnameError{Certificate: &x509.Certificate{}, Host: "api.example"}, now.Add(time.Hour), ""},
+		{"other invalid certificate", x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign}, now.Add(time.Hour), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withClockSkew(tt.err, now, tt.serverTime, !tt.serverTime.IsZero())
+			if tt.want == "" {
+				if got != tt.err {
+					t.Fatalf("withClockSkew() = %v, want the original error", got)
+				}
+				return
+			}
+			if got.Error() != tt.want {
+				t.Fatalf("withClockSkew() = %q, want %q", got, tt.want)
+			}
+			if !errors.Is(got, tt.err) {
+				t.Fatal("the original error must stay reachable")
+			}
+		})
+	}
+}
+
+func TestAPIServerDate(t *testing.T) {
+	date := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("credentials sent to read the Date header")
+		}
+		w.Header().Set("Date", date.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	got, err := apiServerDate(context.Background(), srv.URL)
+	if err != nil || !got.Equal(date) {
+		t.Fatalf("apiServerDate() = %v, %v, want %v", got, err, date)
+	}
+
+	err = explainClockSkew(context.Background(), fmt.Errorf("dial: %w", errors.New(expiredMsg)), &restclient.Config{Host: srv.URL})
+	var skew *clockSkewError
+	if !errors.As(err, &skew) || skew.skew >= 0 {
+		t.Fatalf("explainClockSkew() = %v, want the clock to be behind the server", err)
+	}
+}
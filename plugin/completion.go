@@ -0,0 +1,324 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	"k8s.io/client-go/kubernetes"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+const (
+	// kubectlCompleteShimName is the executable kubectl 1.26+ runs to complete
+	// the arguments of `kubectl rexec`.
+	kubectlCompleteShimName = "kubectl_complete-rexec"
+
+	// outputFormatsAnnotation lists, comma separated, the values a command's
+	// --output flag accepts, so they can be completed.
+	outputFormatsAnnotation = "rexec/output-formats"
+
+	// completionTimeout bounds the requests made while completing, a shell
+	// waiting on an unreachable cluster is worse than no suggestions.
+	completionTimeout = 5 * time.Second
+)
+
+// kubectlCompleteShim is installed on PATH as kubectl_complete-rexec.
+const kubectlCompleteShim = `#!/usr/bin/env sh
+# Completion for 'kubectl rexec', called by kubectl 1.26 and newer.
+exec kubectl-rexec __complete "$@"
+`
+
+// NewCmdCompletion creates the 'completion' command printing shell completion
+// scripts and the kubectl completion shim.
+func NewCmdCompletion(ioStreams genericiooptions.IOStreams) *cobra.Command {
+	return &cobra.Command{
+		Use:   "completion bash|zsh|fish|powershell|kubectl-plugin",
+		Short: i18n.T("Output shell completion code"),
+		Long: templates.LongDesc(`
+			Output shell completion code for kubectl-rexec.
+
+			The bash, zsh, fish and powershell scripts complete the kubectl-rexec
+			binary when it is called directly. To complete 'kubectl rexec', save
+			the kubectl-plugin output as an executable named kubectl_complete-rexec
+			on your PATH, kubectl 1.26 and newer picks it up.`),
+		Example: templates.Examples(`
+			# Load completion for kubectl-rexec into the current bash shell
+			source <(kubectl rexec completion bash)
+
+			# Enable completion for 'kubectl rexec'
+			kubectl rexec completion kubectl-plugin > ~/.local/bin/kubectl_complete-rexec
+			chmod +x ~/.local/bin/kubectl_complete-rexec`),
+		ValidArgs:             []string{"bash", "zsh", "fish", "powershell", "kubectl-plugin"},
+		Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		DisableFlagsInUseLine: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(runCompletion(ioStreams.Out, cmd.Root(), args[0]))
+		},
+	}
+}
+
+func runCompletion(out io.Writer, root *cobra.Command, shell string) error {
+	if shell == "kubectl-plugin" {
+		_, err := io.WriteString(out, kubectlCompleteShim)
+		return err
+	}
+
+	// the scripts are keyed on the root command name, which is rexec for
+	// kubectl's sake while the binary is kubectl-rexec
+	use := root.Use
+	root.Use = "kubectl-rexec"
+	defer func() { root.Use = use }()
+
+	switch shell {
+	case "bash":
+		return root.GenBashCompletionV2(out, true)
+	case "zsh":
+		return root.GenZshCompletion(out)
+	case "fish":
+		return root.GenFishCompletion(out, true)
+	case "powershell":
+		return root.GenPowerShellCompletionWithDesc(out)
+	}
+	return fmt.Errorf("unsupported shell %q", shell)
+}
+
+// clientsetFunc returns the client completions query the cluster with.
+type clientsetFunc func() (kubernetes.Interface, error)
+
+// completionClientsetFunc builds a client from the factory's config with
+// completionTimeout as request timeout.
+func completionClientsetFunc(f cmdutil.Factory) clientsetFunc {
+	return func() (kubernetes.Interface, error) {
+		config, err := f.ToRESTConfig()
+		if err != nil {
+			return nil, err
+		}
+		config.Timeout = completionTimeout
+		return kubernetes.NewForConfig(config)
+	}
+}
+
+// registerFlagCompletions adds value completion to the flags of root and its
+// subcommands. Every completion ends up with no suggestions rather than an
+// error when the cluster cannot be reached.
+func registerFlagCompletions(root *cobra.Command, clients clientsetFunc, namespace func() string) {
+	cmdutil.CheckErr(root.RegisterFlagCompletionFunc("namespace", namespaceCompletionFunc(clients)))
+	cmdutil.CheckErr(root.RegisterFlagCompletionFunc("rexec-api-version", apiVersionCompletionFunc(clients)))
+
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		if formats := cmd.Annotations[outputFormatsAnnotation]; formats != "" && cmd.Flags().Lookup("output") != nil {
+			cmdutil.CheckErr(cmd.RegisterFlagCompletionFunc("output", cobra.FixedCompletions(strings.Split(formats, ","), cobra.ShellCompDirectiveNoFileComp)))
+		}
+		for _, sub := range cmd.Commands() {
+			walk(sub)
+		}
+	}
+	walk(root)
+
+	if cp, _, err := root.Find([]string{"cp"}); err == nil && cp.Name() == "cp" {
+		cmdutil.CheckErr(cp.RegisterFlagCompletionFunc("container", cpContainerCompletionFunc(clients, namespace)))
+	}
+}
+
+func namespaceCompletionFunc(clients clientsetFunc) cobra.CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		clientset, err := clients()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+		defer cancel()
+		namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var names []string
+		for _, ns := range namespaces.Items {
+			if strings.HasPrefix(ns.Name, toComplete) {
+				names = append(names, ns.Name)
+			}
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// cpContainerCompletionFunc completes --container of cp with the containers of
+// the pod named in the source argument.
+func cpContainerCompletionFunc(clients clientsetFunc, namespace func() string) cobra.CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		src, err := parseFileSpec(args[0], namespace())
+		if err != nil || src.PodName == "" {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		clientset, err := clients()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+		defer cancel()
+		pod, err := clientset.CoreV1().Pods(src.PodNamespace).Get(ctx, src.PodName, metav1.GetOptions{})
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var names []string
+		for _, c := range pod.Spec.Containers {
+			names = appendPrefixed(names, c.Name, toComplete)
+		}
+		for _, c := range pod.Spec.InitContainers {
+			names = appendPrefixed(names, c.Name, toComplete)
+		}
+		for _, c := range pod.Spec.EphemeralContainers {
+			names = appendPrefixed(names, c.Name, toComplete)
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// appendPrefixed appends name to names when it starts with prefix.
+func appendPrefixed(names []string, name, prefix string) []string {
+	if strings.HasPrefix(name, prefix) {
+		return append(names, name)
+	}
+	return names
+}
+
+// copyOptionsFunc returns the options the argument completions of cp query
+// the cluster and run commands in its pods with.
+type copyOptionsFunc func() (*CopyOptions, error)
+
+// completionCopyOptionsFunc builds the options of a completion from the
+// factory's config, with completionTimeout as request timeout and the notes
+// a copy prints discarded.
+func completionCopyOptionsFunc(f cmdutil.Factory) copyOptionsFunc {
+	return func() (*CopyOptions, error) {
+		config, err := f.ToRESTConfig()
+		if err != nil {
+			return nil, err
+		}
+		config.Timeout = completionTimeout
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return &CopyOptions{IOStreams: genericiooptions.IOStreams{Out: io.Discard, ErrOut: io.Discard}, ClientConfig: config, Clientset: clientset}, nil
+	}
+}
+
+// remotePathScript lists the paths starting with $1, a line each, the
+// directories with a trailing /, and nothing when there are none.
+const remotePathScript = `ls -dp -- "$1"* 2>/dev/null || true`
+
+// registerCpArgCompletions completes the arguments of cp: the pods of a
+// namespace before the colon, and the paths of the pod after it.
+func registerCpArgCompletions(root *cobra.Command, options copyOptionsFunc, namespace func() string) {
+	if cp, _, err := root.Find([]string{"cp"}); err == nil && cp.Name() == "cp" {
+		cp.ValidArgsFunction = cpArgsCompletionFunc(options, namespace)
+	}
+}
+
+// cpArgsCompletionFunc completes pod, ns/pod and pod:path. A local path, one
+// starting with ., / or ~, is left to the shell.
+func cpArgsCompletionFunc(options copyOptionsFunc, namespace func() string) cobra.CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if strings.HasPrefix(toComplete, ".") || strings.HasPrefix(toComplete, "/") || strings.HasPrefix(toComplete, "~") || windowsLocalPath(toComplete) {
+			return nil, cobra.ShellCompDirectiveDefault
+		}
+		o, err := options()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+		defer cancel()
+		podSpec, _, remote := strings.Cut(toComplete, ":")
+		if !remote {
+			return podCompletions(ctx, o, toComplete, namespace()), cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+		}
+		o.Container, _ = cmd.Flags().GetString("container")
+		return remotePathCompletions(ctx, o, podSpec, toComplete, namespace()), cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// podCompletions returns pod: for the pods of namespace starting with
+// toComplete, or ns/pod: for those of ns when toComplete is ns/ and a prefix.
+func podCompletions(ctx context.Context, o *CopyOptions, toComplete, namespace string) []string {
+	var qualifier string
+	prefix := toComplete
+	if i := strings.LastIndex(toComplete, "/"); i >= 0 {
+		namespace, qualifier, prefix = toComplete[:i], toComplete[:i+1], toComplete[i+1:]
+	}
+	pods, err := o.Clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		if strings.HasPrefix(pod.Name, prefix) {
+			names = append(names, qualifier+pod.Name+":")
+		}
+	}
+	return names
+}
+
+// remotePathCompletions returns podSpec: and the paths of the pod starting
+// with the path of spec, listed by remotePathScript in an audited exec.
+func remotePathCompletions(ctx context.Context, o *CopyOptions, podSpec, spec, namespace string) []string {
+	src, err := parseFileSpec(spec, namespace)
+	if err != nil || src.PodName == "" {
+		return nil
+	}
+	pod, container, err := o.validateAndGetPodContainer(ctx, src)
+	if err != nil {
+		return nil
+	}
+	var stdout, stderr bytes.Buffer
+	if err := o.execute(ctx, pod, container, []string{"sh", "-c", remotePathScript, "sh", src.File}, &stdout, &stderr); err != nil {
+		return nil
+	}
+	var paths []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line != "" {
+			paths = append(paths, podSpec+":"+line)
+		}
+	}
+	return paths
+}
+
+// apiVersionCompletionFunc completes --rexec-api-version with the versions of
+// rexecAPIGroup the cluster serves.
+func apiVersionCompletionFunc(clients clientsetFunc) cobra.CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		clientset, err := clients()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		groups, err := clientset.Discovery().ServerGroups()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var versions []string
+		for _, group := range groups.Groups {
+			if group.Name != rexecAPIGroup {
+				continue
+			}
+			for _, v := range group.Versions {
+				if strings.HasPrefix(v.Version, toComplete) {
+					versions = append(versions, v.Version)
+				}
+			}
+		}
+		return versions, cobra.ShellCompDirectiveNoFileComp
+	}
+}
@@ -0,0 +1,240 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCompletionCommandScripts(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  string
+	}{
+		{"bash", "__start_kubectl-rexec"},
+		{"zsh", "#compdef kubectl-rexec"},
+		{"fish", "complete -c kubectl-rexec"},
+		{"powershell", "Register-ArgumentCompleter"},
+		{"kubectl-plugin", `exec kubectl-rexec __complete "$@"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			streams, _, out, _ := genericiooptions.NewTestIOStreams()
+			root := NewCmdRexec(streams)
+			root.SetArgs([]string{"completion", tt.shell})
+			if err := root.Execute(); err != nil {
+				t.Fatalf("completion %s: %v", tt.shell, err)
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Fatalf("completion %s output lacks %q", tt.shell, tt.want)
+			}
+			if root.Use != "rexec" {
+				t.Fatalf("root command name changed to %q", root.Use)
+			}
+		})
+	}
+}
+
+// newCompletionRoot mirrors the flags of the rexec root command the value
+// completions are registered on, backed by clientset.
+func newCompletionRoot(clientset kubernetes.Interface, clientsErr error) *cobra.Command {
+	root := &cobra.Command{Use: "rexec"}
+	root.PersistentFlags().StringP("namespace", "n", "", "")
+	root.PersistentFlags().String("rexec-api-version", RexecAPIVersion, "")
+	streams, _, _, _ := genericiooptions.NewTestIOStreams()
+	root.AddCommand(NewCmdCp(nil, streams))
+
+	withOutput := &cobra.Command{Use: "report", Annotations: map[string]string{outputFormatsAnnotation: "json,yaml"}, Run: func(*cobra.Command, []string) {}}
+	withOutput.Flags().StringP("output", "o", "", "")
+	root.AddCommand(withOutput)
+
+	registerFlagCompletions(root, func() (kubernetes.Interface, error) {
+		return clientset, clientsErr
+	}, func() string { return "default" })
+	return root
+}
+
+// complete runs the hidden __complete command and returns the sorted
+// suggestions and whatever was written to stderr besides cobra's own
+// directive note.
+func complete(t *testing.T, root *cobra.Command, args ...string) ([]string, string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	root.SetOut(&out)
+	root.SetErr(&errOut)
+	root.SetArgs(append([]string{cobra.ShellCompRequestCmd}, args...))
+	if err := root.Execute(); err != nil {
+		t.Fatalf("__complete %v: %v", args, err)
+	}
+	var suggestions []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line != "" && !strings.HasPrefix(line, ":") {
+			suggestions = append(suggestions, strings.SplitN(line, "\t", 2)[0])
+		}
+	}
+	sort.Strings(suggestions)
+	var stderr []string
+	for _, line := range strings.Split(strings.TrimSpace(errOut.String()), "\n") {
+		if line != "" && !strings.HasPrefix(line, "Completion ended with directive") {
+			stderr = append(stderr, line)
+		}
+	}
+	return suggestions, strings.Join(stderr, "\n")
+}
+
+func completionClientset() *fake.Clientset {
+	cs := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "platform"}},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "payments"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "envoy"}}},
+		},
+	)
+	cs.Fake.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "audit.adyen.internal/v1beta1"},
+		{GroupVersion: "audit.adyen.internal/v1"},
+		{GroupVersion: "apps/v1"},
+	}
+	return cs
+}
+
+func TestFlagValueCompletion(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"namespace", []string{"cp", "-n", "p"}, []string{"payments", "platform"}},
+		{"container", []string{"cp", "payments/api:/tmp", "./out", "--container", ""}, []string{"app", "envoy"}},
+		{"container without pod", []string{"cp", "--container", ""}, nil},
+		{"container of missing pod", []string{"cp", "api:/tmp", "./out", "-c", ""}, nil},
+		{"output formats", []string{"report", "-o", ""}, []string{"json", "yaml"}},
+		{"api version", []string{"cp", "--rexec-api-version", "v1"}, []string{"v1", "v1beta1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errOut := complete(t, newCompletionRoot(completionClientset(), nil), tt.args...)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("suggestions = %v, want %v", got, tt.want)
+			}
+			if errOut != "" {
+				t.Fatalf("unexpected stderr: %q", errOut)
+			}
+		})
+	}
+}
+
+func TestFlagValueCompletionUnreachableCluster(t *testing.T) {
+	unreachable := fake.NewSimpleClientset()
+	unreachable.PrependReactor("*", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("dial tcp 10.0.0.1:443: connect: connection refused")
+	})
+
+	for name, root := range map[string]func() *cobra.Command{
+		"request fails": func() *cobra.Command { return newCompletionRoot(unreachable, nil) },
+		"no client":     func() *cobra.Command { return newCompletionRoot(nil, errors.New("no configuration")) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, args := range [][]string{
+				{"cp", "-n", ""},
+				{"cp", "api:/tmp", "./out", "-c", ""},
+				{"cp", "--rexec-api-version", ""},
+			} {
+				got, errOut := complete(t, root(), args...)
+				if len(got) != 0 || errOut != "" {
+					t.Fatalf("%v: suggestions %v stderr %q, want neither", args, got, errOut)
+				}
+			}
+		})
+	}
+}
+
+func TestCpArgCompletion(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		executor *fakeExecutor
+		want     []string
+		command  []string
+	}{
+		{name: "pods of the namespace", args: []string{"cp", "w"}, want: []string{"web-0:", "web-1:"}},
+		{name: "pods of ns/", args: []string{"cp", "payments/"}, want: []string{"payments/api:"}},
+		{name: "no pods", args: []string{"cp", "x"}},
+		{
+			name:     "remote paths",
+			args:     []string{"cp", "payments/api:/var/l"},
+			executor: &fakeExecutor{stdout: []byte("/var/lib/\n/var/local/\n/var/log/\n")},
+			want:     []string{"payments/api:/var/lib/", "payments/api:/var/local/", "payments/api:/var/log/"},
+			command:  []string{"sh", "-c", remotePathScript, "sh", "/var/l"},
+		},
+		{
+			name:     "remote paths of the container",
+			args:     []string{"cp", "-c", "envoy", "payments/api:/etc/envoy/e"},
+			executor: &fakeExecutor{stdout: []byte("/etc/envoy/envoy.yaml\n")},
+			want:     []string{"payments/api:/etc/envoy/envoy.yaml"},
+			command:  []string{"sh", "-c", remotePathScript, "sh", "/etc/envoy/e"},
+		},
+		{name: "exec fails", args: []string{"cp", "payments/api:/var/l"}, executor: &fakeExecutor{err: errors.New("command terminated with exit code 126")}},
+		{name: "missing pod", args: []string{"cp", "api:/var/l"}, executor: &fakeExecutor{stdout: []byte("/var/log/\n")}},
+		{name: "local destination", args: []string{"cp", "payments/api:/var/log", "./o"}, executor: &fakeExecutor{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := completionClientset()
+			for _, name := range []string{"web-0", "web-1"} {
+				if _, err := clientset.CoreV1().Pods("default").Create(context.Background(), &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				}, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			executor := tt.executor
+			if executor == nil {
+				executor = &fakeExecutor{}
+			}
+			root := newCompletionRoot(clientset, nil)
+			registerCpArgCompletions(root, func() (*CopyOptions, error) {
+				o := newRunOptions()
+				o.Clientset, o.executor = clientset, executor
+				return o, nil
+			}, func() string { return "default" })
+
+			got, errOut := complete(t, root, tt.args...)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || errOut != "" {
+				t.Fatalf("suggestions = %v, stderr %q, want %v", got, errOut, tt.want)
+			}
+			if tt.command != nil && (len(executor.commands) != 1 || strings.Join(executor.commands[0], " ") != strings.Join(tt.command, " ")) {
+				t.Errorf("commands = %q, want %q", executor.commands, tt.command)
+			}
+			if tt.executor == nil && len(executor.commands) != 0 {
+				t.Errorf("exec was run: %q", executor.commands)
+			}
+		})
+	}
+}
+
+func TestCpArgCompletionUnreachableCluster(t *testing.T) {
+	root := newCompletionRoot(nil, nil)
+	registerCpArgCompletions(root, func() (*CopyOptions, error) {
+		return nil, errors.New("no configuration")
+	}, func() string { return "default" })
+	for _, args := range [][]string{{"cp", "web"}, {"cp", "web-0:/var/l"}} {
+		if got, errOut := complete(t, root, args...); len(got) != 0 || errOut != "" {
+			t.Fatalf("%v: suggestions %v stderr %q, want neither", args, got, errOut)
+		}
+	}
+}
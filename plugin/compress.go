@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// compressUnsupportedMarkers are what a tar says that can't write gzip: a
+// busybox tar built without it, or one that finds no gzip to run.
+var compressUnsupportedMarkers = []string{
+	"invalid option",
+	"unrecognized option",
+	"gzip: Cannot exec",
+	"gzip: not found",
+}
+
+// compressing reports whether the archive of a copy is written with tar z.
+func (o *CopyOptions) compressing() bool {
+	return o.Compress && !o.compressFallback
+}
+
+// fallBackFromCompression returns command, the tar of a copy that failed
+// with stderr, without z when its tar can't compress, and ok. From then on
+// copies are not compressed.
+func (o *CopyOptions) fallBackFromCompression(command []string, container, stderr string) ([]string, bool) {
+	if !o.compressing() || !containsAny(stderr, compressUnsupportedMarkers) {
+		return nil, false
+	}
+	compressed := o.tarCreateFlags()
+	o.compressFallback = true
+	uncompressed := slices.Clone(command)
+	if i := slices.Index(uncompressed, compressed); i >= 0 {
+		uncompressed[i] = o.tarCreateFlags()
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: tar in container %s can't compress the copy, copying it uncompressed\n", container)
+	return uncompressed, true
+}
+
+// archiveReader reads the tar of a copy from the archive the container wrote,
+// which is gzipped when the copy was compressed.
+func (o *CopyOptions) archiveReader(archive io.Reader) (io.Reader, error) {
+	if !o.compressing() {
+		return archive, nil
+	}
+	r, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("compressed archive can't be read: %v", err)
+	}
+	return r, nil
+}
+
+// uncompressedArchive returns the tar in received, the archive of a copy,
+// received itself unless the copy was compressed.
+func (o *CopyOptions) uncompressedArchive(received *bytes.Buffer) (*bytes.Buffer, error) {
+	if !o.compressing() {
+		return received, nil
+	}
+	r, err := o.archiveReader(received)
+	if err != nil {
+		return nil, err
+	}
+	var archive bytes.Buffer
+	if _, err := archive.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("compressed archive can't be read: %v", err)
+	}
+	return &archive, nil
+}
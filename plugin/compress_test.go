@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readTree returns the regular files under dir by relative path.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		rel, _ := filepath.Rel(dir, p)
+		files[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestExtractCompressedArchive(t *testing.T) {
+	archive := createTestTar(t, map[string]string{
+		"log/app.log":  strings.Repeat("GET /healthz 200\n", 1000),
+		"log/gc/0.log": "gc\n",
+	}).Bytes()
+
+	plain := newFakePodCopyOptions(nil)
+	plainDest := mustTempDir(t)
+	if _, err := plain.extractTar(context.Background(), bytes.NewReader(archive), plainDest, "log"); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := newFakePodCopyOptions(nil)
+	compressed.Compress = true
+	compressedDest := mustTempDir(t)
+	r, err := compressed.archiveReader(bytes.NewReader(gzipped(t, archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compressed.extractTar(context.Background(), r, compressedDest, "log"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := readTree(t, plainDest)
+	if got := readTree(t, compressedDest); len(want) != 2 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("compressed copy extracted %v, uncompressed %v", got, want)
+	}
+}
+
+func TestArchiveReaderRejectsPlainTar(t *testing.T) {
+	o := newFakePodCopyOptions(nil)
+	o.Compress = true
+	_, err := o.archiveReader(bytes.NewReader(createTestTar(t, map[string]string{"a": "a"}).Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "compressed archive can't be read") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCopyCompressed(t *testing.T) {
+	executor := &fakeExecutor{stdout: gzipped(t, createTestTar(t, map[string]string{"app.log": "app\n"}).Bytes())}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	o.Compress = true
+	o.IOStreams.Out = io.Discard
+	dest := filepath.Join(mustTempDir(t), "app.log")
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", dest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"env", "LC_ALL=C", "LANG=C", "tar", "czf", "-", "-C", "/var/log", "--", "app.log"}
+	if got := executor.commands[len(executor.commands)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+	assertFileContent(t, dest, "app\n")
+}
+
+// fakeTarWithoutGzip is a busybox tar built without gzip support.
+type fakeTarWithoutGzip struct {
+	fakeExecutor
+}
+
+func (f *fakeTarWithoutGzip) Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	if slices.ContainsFunc(command, func(arg string) bool { return arg == "czf" || arg == "chzf" }) {
+		f.commands = append(f.commands, command)
+		_, _ = io.WriteString(stderr, "tar: invalid option -- 'z'\nBusyBox v1.36.1 multi-call binary.\n")
+		return exitCodeError(1)
+	}
+	return f.fakeExecutor.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func TestCopyCompressFallsBack(t *testing.T) {
+	executor := &fakeTarWithoutGzip{fakeExecutor{stdout: createTestTar(t, map[string]string{"app/current.log": "app\n"}).Bytes()}}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	o.Compress = true
+	o.FollowSymlinks = true
+	var errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = io.Discard, &errOut
+	dest := filepath.Join(mustTempDir(t), "app")
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log/app", dest); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errOut.String(), "Warning: tar in container app can't compress the copy, copying it uncompressed\n") {
+		t.Errorf("stderr = %q, want the warning", errOut.String())
+	}
+	var flags []string
+	for _, c := range executor.commands[1:] {
+		if isDiskUsage(c) {
+			continue
+		}
+		flags = append(flags, c[4])
+	}
+	if !reflect.DeepEqual(flags, []string{"chzf", "chf"}) {
+		t.Errorf("tar flags = %q, want the compressed attempt and then the uncompressed one", flags)
+	}
+	assertFileContent(t, filepath.Join(dest, "current.log"), "app\n")
+	if o.compressing() {
+		t.Error("later copies would still be compressed")
+	}
+}
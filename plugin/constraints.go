@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// constraintsHeader is set by the rexec server, on the response establishing a
+// session, to the JSON of the constraints the session runs under.
+const constraintsHeader = "X-Rexec-Constraints"
+
+// sessionConstraints is the value of constraintsHeader. A zero limit is not
+// enforced.
+type sessionConstraints struct {
+	Recorded           bool  `json:"recorded"`
+	MaxDurationSeconds int64 `json:"max_duration_seconds"`
+	IdleTimeoutSeconds int64 `json:"idle_timeout_seconds"`
+	OutputCapBytes     int64 `json:"output_cap_bytes"`
+}
+
+func parseConstraints(value string) (*sessionConstraints, error) {
+	var c sessionConstraints
+	if err := json.Unmarshal([]byte(value), &c); err != nil {
+		return nil, err
+	}
+	if c.MaxDurationSeconds < 0 || c.IdleTimeoutSeconds < 0 || c.OutputCapBytes < 0 {
+		return nil, fmt.Errorf("negative limit in %s", value)
+	}
+	return &c, nil
+}
+
+// notice is the line telling the user about c, empty when there is nothing to
+// tell.
+func (c *sessionConstraints) notice() string {
+	var parts []string
+	if c.Recorded {
+		parts = append(parts, "this session is recorded")
+	}
+	if c.MaxDurationSeconds > 0 {
+		parts = append(parts, "max duration "+shortDuration(time.Duration(c.MaxDurationSeconds)*time.Second))
+	}
+	if c.IdleTimeoutSeconds > 0 {
+		parts = append(parts, "idle timeout "+shortDuration(time.Duration(c.IdleTimeoutSeconds)*time.Second))
+	}
+	if c.OutputCapBytes > 0 {
+		parts = append(parts, "output capped at "+binarySize(c.OutputCapBytes))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "note: " + strings.Join(parts, "; ")
+}
+
+// shortDuration is d without the zero minutes and seconds, 30m rather than
+// 30m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// binarySize formats n bytes as a quantity like --chunk-size takes, 5Gi.
+func binarySize(n int64) string {
+	return resource.NewQuantity(n, resource.BinarySI).String()
+}
+
+// announce takes the value of constraintsHeader of a session. A malformed
+// value is warned about once and leaves the constraints of the session
+// unknown, as without the header.
+func (n *sessionNotices) announce(value string) {
+	c, err := parseConstraints(value)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latest = c
+	if err != nil {
+		n.malformedLocked(constraintsHeader, err)
+		return
+	}
+	if notice := c.notice(); notice != "" {
+		n.printOnceLocked(notice)
+	}
+}
+
+// current returns the constraints of the last session, nil when unknown.
+func (n *sessionNotices) current() *sessionConstraints {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latest
+}
+
+// warnOverOutputCap warns before a copy starts when size, what du estimated
+// remotePath at, is larger than the output cap the server announced, instead
+// of the copy being cut off part way.
+func (o *CopyOptions) warnOverOutputCap(remotePath string, size int64) {
+	c := notices.current()
+	if c == nil || c.OutputCapBytes <= 0 || size <= c.OutputCapBytes {
+		return
+	}
+	newOutput(o.IOStreams.ErrOut).printf("Warning: %s is about %s, over the output cap of %s of the session, the copy will be cut off: copy less of it at a time or ask for a higher cap\n",
+		remotePath, binarySize(size), binarySize(c.OutputCapBytes))
+}
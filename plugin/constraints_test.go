@@ -0,0 +1,186 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	restclient "k8s.io/client-go/rest"
+)
+
+// captureSessionNotices makes the test collect what the server announces
+// apart, printing the notices to the returned buffer.
+func captureSessionNotices(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	old := notices
+	t.Cleanup(func() { notices = old })
+	var out bytes.Buffer
+	notices = newSessionNotices(&out)
+	return &out
+}
+
+func TestConstraintsNotice(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`{"recorded": false}`, ""},
+		{`{"recorded": true}`, "note: this session is recorded"},
+		{`{"recorded": true, "max_duration_seconds": 1800, "idle_timeout_seconds": 900, "output_cap_bytes": 5368709120}`,
+			"note: this session is recorded; max duration 30m; idle timeout 15m; output capped at 5Gi"},
+		{`{"max_duration_seconds": 7200, "idle_timeout_seconds": 90}`, "note: max duration 2h; idle timeout 1m30s"},
+		{`{"recorded": true, "future_limit": 3}`, "note: this session is recorded"},
+	}
+	for _, tt := range tests {
+		c, err := parseConstraints(tt.value)
+		if err != nil {
+			t.Fatalf("parseConstraints(%s): %v", tt.value, err)
+		}
+		if got := c.notice(); got != tt.want {
+			t.Errorf("notice of %s = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+	for _, value := range []string{`recorded`, `{"recorded": "yes"}`, `{"output_cap_bytes": -1}`} {
+		if _, err := parseConstraints(value); err == nil {
+			t.Errorf("parseConstraints(%s) accepted a malformed value", value)
+		}
+	}
+}
+
+func TestConstraintsNoticePrintedOnce(t *testing.T) {
+	out := captureSessionNotices(t)
+	notices.announce(`{"recorded": true}`)
+	notices.announce(`{"recorded": true}`)
+	notices.announce(`{"recorded": false}`)
+	if got := strings.Count(out.String(), "this session is recorded"); got != 1 {
+		t.Fatalf("notice printed %d times, want once: %q", got, out.String())
+	}
+	if c := notices.current(); c == nil || c.Recorded {
+		t.Fatalf("current = %+v, want the last session, not recorded", c)
+	}
+
+	out.Reset()
+	notices.announce(`{"recorded": `)
+	notices.announce(`{"recorded": `)
+	if got := strings.Count(out.String(), "Warning: ignoring the malformed "+constraintsHeader); got != 1 {
+		t.Fatalf("malformed header warned %d times, want once: %q", got, out.String())
+	}
+	if c := notices.current(); c != nil {
+		t.Fatalf("current = %+v after a malformed header, want unknown", c)
+	}
+}
+
+func TestWithConstraintsNoticeReadsHeader(t *testing.T) {
+	out := captureSessionNotices(t)
+	value := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value != "" {
+			w.Header().Set(constraintsHeader, value)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := restclient.HTTPClientFor(withSessionNotices(&restclient.Config{Host: srv.URL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	// an older server does not send the header, nothing is said
+	get()
+	if out.Len() != 0 || notices.current() != nil {
+		t.Fatalf("without the header: notice %q, constraints %+v", out.String(), notices.current())
+	}
+	value = `{"recorded": true, "output_cap_bytes": 1048576}`
+	get()
+	if want := "note: this session is recorded; output capped at 1Mi\n"; out.String() != want {
+		t.Fatalf("notice = %q, want %q", out.String(), want)
+	}
+}
+
+// cappedPod answers du with a size and tar with a small archive, announcing
+// its constraints on the first session like the server does.
+type cappedPod struct {
+	constraints string
+	duOutput    string
+	tar         []byte
+	commands    [][]string
+}
+
+func (p *cappedPod) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, _ io.Writer) error {
+	if len(p.commands) == 0 {
+		notices.announce(p.constraints)
+	}
+	p.commands = append(p.commands, command)
+	switch {
+	case command[len(command)-1] == "true":
+		return nil
+	case strings.Contains(strings.Join(command, " "), "du -s -k"):
+		_, err := io.WriteString(stdout, p.duOutput)
+		return err
+	}
+	_, err := stdout.Write(p.tar)
+	return err
+}
+
+func TestCopyWarnsOverOutputCap(t *testing.T) {
+	tests := []struct {
+		name        string
+		constraints string
+		duOutput    string
+		wantDu      bool
+		wantWarning bool
+	}{
+		{"over the cap", `{"recorded": true, "output_cap_bytes": 1048576}`, "3072\t/var/log/app.log\n", true, true},
+		{"under the cap", `{"recorded": true, "output_cap_bytes": 1048576}`, "12\t/var/log/app.log\n", true, false},
+		{"du fails", `{"recorded": true, "output_cap_bytes": 1048576}`, "", true, false},
+		{"no cap", `{"recorded": true}`, "12\t/var/log/app.log\n", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureSessionNotices(t)
+			pod := &cappedPod{
+				constraints: tt.constraints, duOutput: tt.duOutput,
+				tar: createTestTar(t, map[string]string{"app.log": contentStr}).Bytes(),
+			}
+			o := newFakePodCopyOptions(pod)
+			var stderr bytes.Buffer
+			o.IOStreams.ErrOut = &stderr
+			if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t)); err != nil {
+				t.Fatal(err)
+			}
+			ranDu := false
+			for _, command := range pod.commands {
+				ranDu = ranDu || strings.Contains(strings.Join(command, " "), "du -s -k -- /var/log/app.log")
+			}
+			if ranDu != tt.wantDu {
+				t.Errorf("ran du = %v, want %v: %v", ranDu, tt.wantDu, pod.commands)
+			}
+			warned := strings.Contains(stderr.String(), "/var/log/app.log is about 3Mi, over the output cap of 1Mi")
+			if warned != tt.wantWarning {
+				t.Errorf("warned = %v, want %v: %q", warned, tt.wantWarning, stderr.String())
+			}
+		})
+	}
+}
+
+func TestChunkedCopyWarnsOverOutputCap(t *testing.T) {
+	captureSessionNotices(t)
+	notices.announce(`{"output_cap_bytes": 2}`)
+	o, _, errOut := newChunkedCopyOptions(newChunkPod("0123456789"))
+	if err := o.RunWithArgs(context.Background(), "pod:/data/file.bin", mustTempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, errOut.String(), "chunks of 4 are over the output cap of 2 of the session")
+}
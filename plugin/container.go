@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// checkContainerState fails fast when container of pod is not running, which
+// exec would otherwise fail for with a low-level error of the upgrade. A
+// container without a status yet is left to exec.
+func checkContainerState(pod *corev1.Pod, container string) error {
+	problem := containerProblem(pod, container)
+	if problem == "" {
+		return nil
+	}
+	return fmt.Errorf("pod %s/%s: %s", pod.Namespace, pod.Name, problem)
+}
+
+// containerProblem describes why container of pod can't be exec'd into, or
+// returns an empty string when it is running or has no status.
+func containerProblem(pod *corev1.Pod, container string) string {
+	status, init := containerStatus(pod, container)
+	if status == nil {
+		return ""
+	}
+	state := status.State
+	var problem string
+	switch {
+	case state.Running != nil:
+		return ""
+	case init && state.Terminated != nil && state.Terminated.ExitCode == 0:
+		return fmt.Sprintf("init container %s completed, it has exited and exec into it is not possible", container)
+	case state.Waiting != nil:
+		problem = fmt.Sprintf("container %s is waiting (%s)", container, stateReason(state.Waiting.Reason, state.Waiting.Message))
+	case state.Terminated != nil:
+		reason := stateReason(state.Terminated.Reason, state.Terminated.Message)
+		problem = fmt.Sprintf("container %s terminated (%s, exit code %d)", container, reason, state.Terminated.ExitCode)
+	default:
+		return ""
+	}
+	if status.RestartCount > 0 {
+		problem += fmt.Sprintf(", restart count %d", status.RestartCount)
+	}
+	return problem
+}
+
+// containerStatus returns the status of container of pod, and whether it is
+// an init container, nil when the pod has none for it.
+func containerStatus(pod *corev1.Pod, container string) (*corev1.ContainerStatus, bool) {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for i := range statuses {
+			if statuses[i].Name == container {
+				return &statuses[i], false
+			}
+		}
+	}
+	for i := range pod.Status.InitContainerStatuses {
+		if pod.Status.InitContainerStatuses[i].Name == container {
+			return &pod.Status.InitContainerStatuses[i], true
+		}
+	}
+	return nil, false
+}
+
+// stateReason is the reason of a container state with its message, such as
+// CrashLoopBackOff: back-off 5m0s restarting failed container.
+func stateReason(reason, message string) string {
+	if reason == "" {
+		reason = "unknown reason"
+	}
+	if message = strings.TrimSpace(message); message != "" {
+		return reason + ": " + message
+	}
+	return reason
+}
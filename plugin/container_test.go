@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestContainerProblem(t *testing.T) {
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   string
+	}{
+		{"no status", corev1.PodStatus{}, ""},
+		{
+			name: "running",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app", RestartCount: 2, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			}}},
+		},
+		{
+			name: "crash loop",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app", RestartCount: 12, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason: "CrashLoopBackOff", Message: "back-off 5m0s restarting failed container=app pod=pod_default(uid)",
+				}},
+			}}},
+			want: "container app is waiting (CrashLoopBackOff: back-off 5m0s restarting failed container=app pod=pod_default(uid)), restart count 12",
+		},
+		{
+			name: "creating",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+			}}},
+			want: "container app is waiting (ContainerCreating)",
+		},
+		{
+			name: "oom killed",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app", RestartCount: 1, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137}},
+			}}},
+			want: "container app terminated (OOMKilled, exit code 137), restart count 1",
+		},
+		{
+			name: "completed init container",
+			status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}},
+			}}},
+			want: "init container app completed, it has exited and exec into it is not possible",
+		},
+		{
+			name: "failed init container",
+			status: corev1.PodStatus{InitContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+			}}},
+			want: "container app terminated (Error, exit code 1)",
+		},
+		{
+			name: "ephemeral container exited",
+			status: corev1.PodStatus{EphemeralContainerStatuses: []corev1.ContainerStatus{{
+				Name: "app", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}},
+			}}},
+			want: "container app terminated (unknown reason, exit code 0)",
+		},
+		{
+			name: "other container",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "sidecar", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Status: tt.status}
+			if got := containerProblem(pod, "app"); got != tt.want {
+				t.Errorf("containerProblem() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyFromCrashLoopingContainer(t *testing.T) {
+	executor := &fakeExecutor{}
+	o := newRunOptions()
+	o.Clientset = fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, ContainerStatuses: []corev1.ContainerStatus{{
+			Name: "app", RestartCount: 3, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off 40s"}},
+		}}},
+	})
+	o.executor = executor
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/log", mustTempDir(t))
+	want := "pod default/pod: container app is waiting (CrashLoopBackOff: back-off 40s), restart count 3"
+	if err == nil || err.Error() != want {
+		t.Fatalf("err = %v, want %q", err, want)
+	}
+	if len(executor.commands) != 0 {
+		t.Errorf("exec was run: %q", executor.commands)
+	}
+}
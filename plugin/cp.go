@@ -2,14 +2,23 @@ package plugin
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
@@ -17,10 +26,9 @@ import (
 	"k8s.io/cli-runtime/pkg/genericiooptions"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog/v2"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 	"k8s.io/kubectl/pkg/cmd/util/podcmd"
-	"k8s.io/kubectl/pkg/scheme"
 	"k8s.io/kubectl/pkg/util/i18n"
 	"k8s.io/kubectl/pkg/util/templates"
 )
@@ -32,12 +40,222 @@ type CopyOptions struct {
 	ClientConfig *restclient.Config
 	Clientset    kubernetes.Interface
 	IOStreams    genericiooptions.IOStreams
+
+	// Open launches the platform opener on the destination after a successful copy.
+	Open bool
+	// OpenWith launches this program instead of the platform opener.
+	OpenWith string
+	// Force copies even when the pod's node is NotReady or unreachable, or
+	// the destination looks short of space.
+	Force bool
+	// SourcesManifest is where to write the JSON record of what was read.
+	SourcesManifest string
+	// ShowAllWarnings prints every extraction warning instead of a few
+	// examples per category.
+	ShowAllWarnings bool
+	// NoVerifyReadable skips checking that the extracted files can be read.
+	NoVerifyReadable bool
+	// DryRun lists what would be copied instead of copying it.
+	DryRun bool
+	// Output is empty or json, for the plan of DryRun or the report of a
+	// copy.
+	Output string
+	// EntriesFrom is a copy plan printed by DryRun; only its entries are
+	// copied.
+	EntriesFrom string
+	// Chunked copies a single file in ChunkSize ranges, each verified and
+	// resumable, instead of as one tar stream.
+	Chunked   bool
+	ChunkSize string
+	// Retries is how often a copy interrupted by a broken stream is resumed,
+	// -1 for no limit.
+	Retries int
+	// Progress reports the bytes received while a copy runs: always, never,
+	// or, when auto or empty, if stderr is a terminal.
+	Progress string
+	// Selector copies from every Running pod matching it, each into a
+	// subdirectory of the destination named after NameBy.
+	Selector string
+	NameBy   string
+	// MaxConcurrent is how many pods of a Selector copy are copied at once.
+	MaxConcurrent int
+	// Merge adds the pods without a subdirectory yet to an existing
+	// destination of a Selector copy.
+	Merge bool
+	// TransliterateBackslashes extracts the backslashes of tar entry names as
+	// directory separators instead of refusing the entry, where a backslash
+	// is not a separator.
+	TransliterateBackslashes bool
+	// OutputOwner is the user[:group] given the created files and
+	// directories, when the plugin runs as root on a shared host.
+	OutputOwner string
+	// FollowSymlinks archives what the symlinks of the copied path point to,
+	// instead of links the extraction skips.
+	FollowSymlinks bool
+	// AllowSymlinks extracts the symlinks of the archive whose targets are
+	// relative and stay within the destination, instead of skipping them.
+	AllowSymlinks bool
+	// Chmod is the octal mode given the extracted files and directories
+	// instead of those of the archive, or D and F modes for either, such as
+	// D755,F644.
+	Chmod string
+	// StripComponents removes this many leading elements from the names of
+	// the archive entries, which are then extracted into the destination as
+	// a directory, as tar --strip-components does. Entries with no elements
+	// left are skipped.
+	StripComponents int
+	// OnCaseCollision is what a copy onto a case-insensitive filesystem does
+	// with an entry whose name differs only in case from one it extracted:
+	// rename it with a __N suffix, or fail. Empty is rename.
+	OnCaseCollision string
+	// SpecialFiles is what a copy does with the devices and FIFOs of the
+	// archive: skip them with a single warning, ignore them without one, or
+	// create them, which needs root. Empty is skip.
+	SpecialFiles string
+	// Preserve restores the modes, modification times and, with root or
+	// CAP_CHOWN, the numeric owners of the archive.
+	Preserve bool
+	// NoPreserveTimes gives the extracted files and directories the time of
+	// the copy instead of the modification times of the archive.
+	NoPreserveTimes bool
+	// AllowUpload enables copying a local file or directory into a
+	// container, which is refused by default.
+	AllowUpload bool
+	// Checksum verifies every copied regular file against a digest computed
+	// in the container once the copy is extracted.
+	Checksum bool
+	// Compress has the container gzip the archive of a copy, tar czf.
+	Compress bool
+	// Sparse has the container archive the holes of sparse files as holes,
+	// tar cSf, which the extraction leaves as holes too.
+	Sparse bool
+	// Xattrs has the container archive the extended attributes and POSIX
+	// ACLs of the entries, tar --xattrs --acls, which the extraction sets.
+	Xattrs bool
+	// KeepPartial leaves what a failed or cancelled copy extracted in place
+	// instead of removing it.
+	KeepPartial bool
+	// Exclude are tar patterns of the entries to leave out of a copy.
+	Exclude []string
+	// MaxSize bounds the bytes of the files a copy writes, 0 for no limit.
+	MaxSize string
+	// MaxFiles bounds the entries a copy extracts, 0 for no limit.
+	MaxFiles int
+	// Timeout bounds the whole copy, 0 for no limit.
+	Timeout time.Duration
+	// NoClobber skips the entries that would overwrite an existing file,
+	// which are otherwise confirmed on a terminal unless Overwrite.
+	NoClobber bool
+	// Overwrite overwrites existing files without asking.
+	Overwrite bool
+	// SkipExisting leaves the existing files of the size and modification
+	// time of their entries as they are, to fill in the gaps of a failed
+	// copy run again.
+	SkipExisting bool
+	// Quiet leaves out the summary and the warnings of a copy, printing its
+	// errors only.
+	Quiet bool
+
+	// Result is what the last copy from a pod extracted.
+	Result CopyResult
+
+	// kubeContext is the kubeconfig context in use, of --context or else the
+	// current one, for the sources manifest.
+	kubeContext string
+	// namespaceFlag is set when Namespace was given with -n, the namespaces
+	// of the ns/pod:path arguments, specs, must then agree with it.
+	namespaceFlag bool
+	specs         []string
+	manifest      *sourcesManifest
+	warnings      *copyWarnings
+	// report is what Output json prints, nil without it.
+	report *copyReport
+	// extracted lists the regular files created, for verifyReadable.
+	extracted []string
+	// linkable holds the regular files created, which the hard links of the
+	// archive may link to.
+	linkable map[string]bool
+	// checksummed lists the regular files created, for Checksum.
+	checksummed []checksummedFile
+	// progress counts the bytes received by the transfer running, or the
+	// last one, for the error of Timeout.
+	progress *transferProgress
+	// estimatedSize is what du estimated the copy running at, 0 when it
+	// could not tell, for the progress to show a total and an ETA.
+	estimatedSize int64
+	// copiedBytes counts the bytes of the regular files extracted.
+	copiedBytes int64
+	// keptExisting counts the entries skipped by keepExisting.
+	keptExisting int
+	// skippedSpecial counts the devices and FIFOs SpecialFiles skipped.
+	skippedSpecial int
+	// strippedEntries counts the entries StripComponents left no name.
+	strippedEntries int
+	// answers reads the answers of confirmOverwrite, overwriteAll is set
+	// once it was answered all.
+	answers      *bufio.Reader
+	overwriteAll bool
+	// excludedEntries counts the entries matching Exclude that the tar of
+	// the container did not leave out.
+	excludedEntries int
+	// contents is set for a remote path ending in /, whose contents are
+	// copied into the destination rather than the directory itself.
+	contents bool
+	// selected holds the entry paths of EntriesFrom, nil to copy everything.
+	selected map[string]bool
+	// members maps the tar members of a copy of several sources to the base
+	// names they are extracted under, nil for a single source.
+	members map[string]string
+	// chmod is os.Chmod unless replaced by tests.
+	chmod func(name string, mode os.FileMode) error
+	// owner is OutputOwner resolved, nil without it.
+	owner *fileOwner
+	// owned lists what the copy created, for the owner.
+	owned []string
+	// cases tracks the extracted paths on a case-insensitive destination,
+	// nil elsewhere.
+	cases *caseCollisions
+	// created lists what the extraction created, outermost first, which a
+	// failed one removes unless KeepPartial.
+	created []string
+	// preservedDirs lists the directories extracted, unless NoPreserveTimes
+	// and their mode is set as they are created, for restoreDirs.
+	// chownPreserved is set when their owners are restored.
+	preservedDirs  []preservedDir
+	chownPreserved bool
+	// lchown is os.Lchown unless replaced by tests.
+	lchown func(name string, uid, gid int) error
+
+	// errOut is the stderr of the errors once silence discarded ErrOut.
+	errOut io.Writer
+
+	// compressFallback is set once a container's tar could not compress, the
+	// copies after it are not compressed either.
+	compressFallback bool
+
+	// localeEnvProbed caches, per namespace/pod/container, whether the
+	// container has an env binary to force the C locale with.
+	localeEnvProbed map[string]bool
+	executor        remoteExecutor
+	startCommand    commandStarter
 }
 
 type fileSpec struct {
 	PodName      string
 	PodNamespace string
 	File         string
+	// Workload is the kind/name given instead of a pod, as deployment/app;
+	// PodName is its name until resolveWorkload chose one of its pods.
+	Workload string
+}
+
+// remote names the remote path of spec in a summary, with the workload its
+// pod was chosen from.
+func (s *fileSpec) remote() string {
+	if s.Workload != "" {
+		return fmt.Sprintf("%s:%s (%s)", s.PodName, s.File, s.Workload)
+	}
+	return s.PodName + ":" + s.File
 }
 
 const errPathTraversal = "illegal file path in tar: %s (path traversal attempt)"
@@ -48,13 +266,14 @@ func NewCmdCp(f cmdutil.Factory, ioStreams genericiooptions.IOStreams) *cobra.Co
 	o := &CopyOptions{IOStreams: ioStreams}
 
 	cmd := &cobra.Command{
-		Use:   "cp <pod-src> <local-dest>",
+		Use:   "cp <pod-src>... <local-dest|->",
 		Short: i18n.T("Copy files and directories from containers (with audit)"),
 		Long: templates.LongDesc(`
 			Copy files and directories from containers to local filesystem.
 			This command uses rexec for audited file transfers.
 
-			Note: Only copying FROM pods is supported (for security reasons).
+			Note: Only copying FROM pods is supported by default (for security reasons),
+			--allow-upload enables copying a local file or directory TO a pod.
 			Note: Requires 'tar' to be installed in the container.`),
 		Example: templates.Examples(`
 			# Copy /tmp/foo from a remote pod to /tmp/bar locally
@@ -65,14 +284,61 @@ func NewCmdCp(f cmdutil.Factory, ioStreams genericiooptions.IOStreams) *cobra.Co
 
 			# Copy from a pod in a specific namespace
 			kubectl rexec cp my-namespace/my-pod:/var/log/app.log ./app.log
+			kubectl rexec cp -n my-namespace my-pod:/var/log/app.log ./app.log
+
+			# Copy from a ready pod of a deployment, statefulset, daemonset, replicaset or job
+			kubectl rexec cp deploy.apps/payments:/var/log/app.log ./app.log
 
 			# Copy a directory from a remote pod
-			kubectl rexec cp my-pod:/var/log /tmp/logs`),
+			kubectl rexec cp my-pod:/var/log /tmp/logs
+
+			# Copy the contents of a directory into ./out, ./out/app.log instead of ./out/log/app.log
+			kubectl rexec cp my-pod:/var/log/ ./out
+
+			# Copy several paths of a pod into an existing directory in one session
+			kubectl rexec cp my-pod:/etc/app/config.yaml my-pod:/var/log/app.log ./triage
+
+			# Copy the files of a pod matching a pattern into an existing directory
+			kubectl rexec cp 'my-pod:/var/log/*.log' ./logs
+
+			# Copy a selected part of a directory
+			kubectl rexec cp my-pod:/var/log /tmp/logs --dry-run -o json > plan.json
+			jq '.entries |= map(select(.path | endswith(".gz") | not))' plan.json > subset.json
+			kubectl rexec cp my-pod:/var/log /tmp/logs --entries-from subset.json
+
+			# Copy a large file in verified 256Mi chunks, run again to resume it
+			kubectl rexec cp my-pod:/backup/db.snapshot ./db.snapshot --chunked --chunk-size 256Mi
+
+			# Copy /var/log from every pod labelled app=web into ./logs/<node>
+			kubectl rexec cp -l app=web :/var/log ./logs --name-by node
+
+			# Copy the live logs of a directory without the rotated archives
+			kubectl rexec cp my-pod:/var/log /tmp/logs --exclude '*.gz'
+
+			# Copy large text logs over a slow link gzipped
+			kubectl rexec cp my-pod:/var/log /tmp/logs --compress
+
+			# List the archive of a directory without extracting it
+			kubectl rexec cp my-pod:/var/log/app - | tar tvf -
+
+			# Copy a directory and verify every file against a sha256 computed in the pod
+			kubectl rexec cp my-pod:/var/log/audit ./evidence --checksum
+
+			# Upload a debug script into /tmp of a pod
+			kubectl rexec cp ./debug.sh my-pod:/tmp/ --allow-upload`),
+		Annotations: map[string]string{outputFormatsAnnotation: "json"},
 		Run: func(cmd *cobra.Command, args []string) {
 			cmdutil.CheckErr(o.Complete(f, cmd, args))
 			cmdutil.CheckErr(o.Validate())
-			if len(args) == 2 {
-				cmdutil.CheckErr(o.RunWithArgs(cmd.Context(), args[0], args[1]))
+			// Ctrl-C cancels the copy instead of killing the plugin, so the
+			// exec stream is closed and the remote tar stopped
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if len(args) >= 2 {
+				err := o.RunWithSources(ctx, args[:len(args)-1], args[len(args)-1])
+				// ErrOut is discarded when Quiet
+				printAuditSessions(o.IOStreams.ErrOut)
+				cmdutil.CheckErr(explainClockSkew(ctx, err, o.ClientConfig))
 			} else {
 				cmdutil.CheckErr(fmt.Errorf("source and destination are required"))
 			}
@@ -80,12 +346,56 @@ func NewCmdCp(f cmdutil.Factory, ioStreams genericiooptions.IOStreams) *cobra.Co
 	}
 
 	cmd.Flags().StringVarP(&o.Container, "container", "c", "", "Container name. If omitted, use the first container")
+	cmd.Flags().BoolVar(&o.Open, "open", false, "Open the copied file or directory with the platform opener after a successful copy")
+	cmd.Flags().StringVar(&o.OpenWith, "open-with", "", "Open the copied file or directory with this program after a successful copy")
+	cmd.Flags().BoolVar(&o.Force, "force", false, "Copy even if the pod's node is NotReady or unreachable, or the destination looks short of space")
+	cmd.Flags().BoolVar(&o.NoClobber, "no-clobber", false, "Skip the entries that would overwrite an existing local file")
+	cmd.Flags().BoolVarP(&o.Overwrite, "overwrite", "y", false, "Overwrite existing local files without asking")
+	cmd.Flags().BoolVar(&o.SkipExisting, "skip-existing", false, "Skip the files that exist locally with the size and modification time they have in the container, to resume a failed copy")
+	cmd.Flags().StringVar(&o.SourcesManifest, "sources-manifest", "", "Write a JSON record of every remote path read, with sizes and sha256 of the extracted files, to this file")
+	cmd.Flags().StringVar(&o.SourcesManifest, "manifest", "", "Same as --sources-manifest, such as --manifest ./evidence/sources.json")
+	cmd.Flags().BoolVar(&o.ShowAllWarnings, "show-all-warnings", false, "Print every skipped entry instead of a few examples per kind of warning")
+	cmd.Flags().BoolVar(&o.NoVerifyReadable, "no-verify-readable", false, "Don't check that the copied files can be read, or add the owner read permission where they can't")
+	cmd.Flags().BoolVar(&o.DryRun, "dry-run", false, "List the entries that would be copied without copying them")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output format, json for a report of the copy, or with --dry-run a plan that --entries-from accepts")
+	cmd.Flags().StringVar(&o.EntriesFrom, "entries-from", "", "Copy only the entries listed in this JSON plan printed by --dry-run -o json")
+	cmd.Flags().BoolVar(&o.Chunked, "chunked", false, "Copy a single file in ranges, each through its own exec and verified against a sha256 computed in the container, resuming from the last verified range when run again")
+	cmd.Flags().StringVar(&o.ChunkSize, "chunk-size", defaultChunkSize, "Size of the ranges of --chunked")
+	cmd.Flags().StringVar(&o.Progress, "progress", progressAuto, "Report the bytes received while copying: auto on a terminal, always or never")
+	cmd.Flags().Lookup("progress").NoOptDefVal = progressAlways
+	cmd.Flags().IntVar(&o.Retries, "retries", 0, "Resume a copy interrupted by a broken stream up to this many times, -1 for no limit")
+	cmd.Flags().StringVarP(&o.Selector, "selector", "l", "", "Copy from every Running pod matching this label selector, the source is then :<path>")
+	cmd.Flags().StringVar(&o.NameBy, "name-by", nameByPod, "Name the subdirectory of each pod of a --selector copy by pod, pod-uid, node or index")
+	cmd.Flags().IntVar(&o.MaxConcurrent, "max-concurrent", 4, "Copy from at most this many pods of a --selector copy at once")
+	cmd.Flags().BoolVar(&o.Merge, "merge", false, "Add the pods not copied yet to the existing destination of a --selector copy, leaving the existing subdirectories untouched")
+	cmd.Flags().BoolVar(&o.TransliterateBackslashes, "transliterate-backslashes", false, "Extract backslashes in the names of the copied entries, as written by Windows containers, as directory separators instead of skipping those entries")
+	cmd.Flags().StringVar(&o.OutputOwner, "output-owner", "", "Give the copied files and the directories created for them to this user[:group], by name or numeric id; needs root or CAP_CHOWN")
+	cmd.Flags().StringVar(&o.OutputOwner, "owner", "", "Same as --output-owner, such as --owner 1000:1000")
+	cmd.Flags().BoolVar(&o.FollowSymlinks, "follow-symlinks", false, "Copy what the symlinks of the remote path, itself included, point to instead of skipping them (tar -h)")
+	cmd.Flags().BoolVar(&o.AllowSymlinks, "allow-symlinks", false, "Extract the symlinks of the copy whose targets are relative and stay within the destination, such as current -> releases/123, instead of skipping them")
+	cmd.Flags().IntVar(&o.StripComponents, "strip-components", 0, "Remove this many leading path elements from the names of the copied entries, extracting them into the destination directory, like tar --strip-components")
+	cmd.Flags().StringVar(&o.SpecialFiles, "special-files", specialFilesSkip, "What to do with the devices and FIFOs of the copy: skip them with a single warning, ignore them without one, or create them, which needs root")
+	cmd.Flags().BoolVar(&o.NoPreserveTimes, "no-preserve-times", false, "Give the copied files and directories the time of the copy instead of their modification times in the container")
+	cmd.Flags().StringVar(&o.Chmod, "chmod", "", "Give the copied files and directories this octal mode instead of theirs, or D and F modes for either, such as D755,F644")
+	cmd.Flags().BoolVar(&o.Preserve, "preserve", false, "Keep the modes and modification times of the copied files and directories, and their numeric owners when run as root")
+	cmd.Flags().BoolVarP(&o.Quiet, "quiet", "q", false, "Print only the errors of the copy, without its summary or warnings")
+	cmd.Flags().DurationVar(&o.Timeout, "timeout", 0, "Give up on the copy after this long, such as 5m (0 waits forever)")
+	cmd.Flags().StringVar(&o.MaxSize, "max-size", "0", "Abort the copy before the files written would exceed this size, such as 500Mi, per pod with --selector; 0 for no limit")
+	cmd.Flags().IntVar(&o.MaxFiles, "max-files", defaultMaxFiles, "Abort the copy before it would extract more than this many files, directories and links, per pod with --selector; 0 for no limit")
+	cmd.Flags().StringVar(&o.OnCaseCollision, "on-case-collision", caseCollisionRename, "On a case-insensitive destination, what to do with an entry whose name differs only in case from one already extracted, such as README and ReadMe: rename it with a __N suffix, or error")
+	cmd.Flags().BoolVar(&o.KeepPartial, "keep-partial", false, "Keep the files a failed or cancelled copy extracted instead of removing them")
+	cmd.Flags().StringArrayVar(&o.Exclude, "exclude", nil, "Leave the entries matching this tar pattern out of the copy, like *.gz (repeatable)")
+	cmd.Flags().BoolVar(&o.Sparse, "sparse", false, "Have the container archive sparse files with their holes (GNU tar -S), extracted as sparse files instead of their full size in zeros")
+	cmd.Flags().BoolVar(&o.Xattrs, "xattrs", false, "Have the container archive extended attributes and POSIX ACLs (tar --xattrs --acls), such as file capabilities, and set them on the extracted files; Linux only")
+	cmd.Flags().BoolVar(&o.Compress, "compress", false, "Have the container gzip the archive of the copy (tar czf), falling back to an uncompressed copy where its tar can't")
+	cmd.Flags().BoolVar(&o.Checksum, "checksum", false, "Verify every copied file against a sha256, or md5 where there is no sha256sum, computed in the container, and print the digests")
+	cmd.Flags().BoolVar(&o.AllowUpload, "allow-upload", false, "Allow copying a local file or directory into a container, audited with the name and size of every uploaded entry")
 	return cmd
 }
 
 // Complete sets up the options for the copy command by initializing Kubernetes clients and configuration.
 func (o *CopyOptions) Complete(f cmdutil.Factory, cmd *cobra.Command, args []string) error {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return fmt.Errorf("source and destination are required")
 	}
 
@@ -94,58 +404,199 @@ func (o *CopyOptions) Complete(f cmdutil.Factory, cmd *cobra.Command, args []str
 	if err != nil {
 		return err
 	}
+	o.namespaceFlag = cmd.Flags().Changed("namespace")
+	o.specs = args
 
 	o.ClientConfig, err = f.ToRESTConfig()
 	if err != nil {
 		return err
 	}
 
+	o.kubeContext = logTarget(f, cmd, o.ClientConfig)
+
 	o.Clientset, err = f.KubernetesClientSet()
 	return err
 }
 
 // Validate ensures that the required configuration for the copy command is present.
 func (o *CopyOptions) Validate() error {
-	if o.ClientConfig == nil {
+	switch {
+	case o.ClientConfig == nil:
 		return fmt.Errorf("client config is required")
+	case o.Output != "" && o.Output != "json":
+		return fmt.Errorf("unsupported output format %q, only json is supported", o.Output)
+	case o.Output != "" && (o.Selector != "" || o.Chunked):
+		return fmt.Errorf("-o can't be used with --selector or --chunked")
+	case o.DryRun && (o.SourcesManifest != "" || o.Open || o.OpenWith != ""):
+		return fmt.Errorf("--dry-run can't be used with --sources-manifest, --open or --open-with")
+	case o.Chunked && (o.DryRun || o.EntriesFrom != ""):
+		return fmt.Errorf("--chunked copies a single file, it can't be used with --dry-run or --entries-from")
+	case o.Progress != "" && o.Progress != progressAuto && o.Progress != progressAlways && o.Progress != progressNever:
+		return fmt.Errorf("unsupported --progress %q, use auto, always or never", o.Progress)
+	case o.SpecialFiles != "" && o.SpecialFiles != specialFilesSkip && o.SpecialFiles != specialFilesIgnore && o.SpecialFiles != specialFilesCreate:
+		return fmt.Errorf("unsupported --special-files %q, use skip, ignore or create", o.SpecialFiles)
+	case o.SpecialFiles == specialFilesCreate && !canMknod():
+		return fmt.Errorf("--special-files=create needs to run as root to create devices")
+	case o.OnCaseCollision != "" && o.OnCaseCollision != caseCollisionRename && o.OnCaseCollision != caseCollisionError:
+		return fmt.Errorf("unsupported --on-case-collision %q, use rename or error", o.OnCaseCollision)
+	case o.MaxFiles < 0:
+		return fmt.Errorf("invalid --max-files %d, use 0 for no limit", o.MaxFiles)
+	case o.StripComponents < 0:
+		return fmt.Errorf("invalid --strip-components %d, use 0 to keep the names as they are", o.StripComponents)
+	case o.StripComponents > 0 && o.Chunked:
+		return fmt.Errorf("--strip-components can't be used with --chunked, which copies a single file")
+	case o.Retries < -1:
+		return fmt.Errorf("invalid --retries %d, use 0 to never retry or -1 to retry without limit", o.Retries)
+	case o.Chunked && o.Retries != 0:
+		return fmt.Errorf("--chunked resumes from the last verified range when run again, it can't be used with --retries")
+	case o.Selector != "" && (o.DryRun || o.EntriesFrom != "" || o.Chunked || o.SourcesManifest != "" || o.Open || o.OpenWith != ""):
+		return fmt.Errorf("--selector can't be used with --dry-run, --entries-from, --chunked, --sources-manifest, --open or --open-with")
+	case o.Selector == "" && o.Merge:
+		return fmt.Errorf("--merge is only supported with --selector")
+	case o.OutputOwner != "" && o.DryRun:
+		return fmt.Errorf("--dry-run can't be used with --output-owner")
+	case o.Preserve && (o.DryRun || o.Chunked || o.OutputOwner != ""):
+		return fmt.Errorf("--preserve can't be used with --dry-run, --chunked or --output-owner")
+	case o.Preserve && o.NoPreserveTimes:
+		return fmt.Errorf("--preserve keeps the modification times, it can't be used with --no-preserve-times")
+	case len(o.Exclude) > 0 && o.Chunked:
+		return fmt.Errorf("--exclude can't be used with --chunked, which copies a single file")
+	case o.Sparse && o.Chunked:
+		return fmt.Errorf("--sparse can't be used with --chunked, which reads the file as it is")
+	case o.Xattrs && !xattrsSupported:
+		return fmt.Errorf("--xattrs is only supported on linux, extended attributes can't be set on %s", runtime.GOOS)
+	case o.Xattrs && o.Chunked:
+		return fmt.Errorf("--xattrs can't be used with --chunked, which reads the file as it is")
+	case o.KeepPartial && o.Chunked:
+		return fmt.Errorf("--keep-partial can't be used with --chunked, which always keeps what it copied to resume it")
+	case o.Compress && o.Chunked:
+		return fmt.Errorf("--compress can't be used with --chunked, which reads the file as it is")
+	case o.Overwrite && o.NoClobber:
+		return fmt.Errorf("--overwrite can't be used with --no-clobber, which keeps every existing file")
+	case o.NoClobber && o.Chunked:
+		return fmt.Errorf("--no-clobber can't be used with --chunked, which resumes the file at its destination")
+	case o.SkipExisting && o.Chunked:
+		return fmt.Errorf("--skip-existing can't be used with --chunked, which resumes the file at its destination")
+	case o.SkipExisting && o.NoPreserveTimes:
+		return fmt.Errorf("--skip-existing compares the modification times, it can't be used with --no-preserve-times")
+	case o.Chmod != "" && (o.Preserve || o.Chunked):
+		return fmt.Errorf("--chmod can't be used with --preserve, which keeps the modes of the archive, or --chunked")
+	case o.Timeout < 0:
+		return fmt.Errorf("invalid --timeout %s, use 0 to wait forever", o.Timeout)
+	case o.Checksum && (o.DryRun || o.Chunked):
+		return fmt.Errorf("--checksum can't be used with --dry-run, or --chunked which verifies every range already")
 	}
-	return nil
+	if o.namespaceFlag {
+		if err := validateSpecNamespaces(o.specs, o.Namespace); err != nil {
+			return err
+		}
+	}
+	if err := o.resolveOutputOwner(); err != nil {
+		return err
+	}
+	if o.Selector != "" {
+		switch o.NameBy {
+		case nameByPod, nameByPodUID, nameByNode, nameByIndex:
+		default:
+			return fmt.Errorf("unsupported --name-by %q, use pod, pod-uid, node or index", o.NameBy)
+		}
+		if o.MaxConcurrent < 1 {
+			return fmt.Errorf("invalid --max-concurrent %d, copy from at least 1 pod at once", o.MaxConcurrent)
+		}
+	}
+	if o.Chunked {
+		if _, err := parseChunkSize(o.ChunkSize); err != nil {
+			return err
+		}
+	}
+	if _, err := parseMaxSize(o.MaxSize); err != nil {
+		return err
+	}
+	if _, err := parseChmod(o.Chmod); err != nil {
+		return err
+	}
+	return validateExcludes(o.Exclude)
 }
 
 // RunWithArgs parses the source and destination specifications and initiates the copy operation from the pod.
-func (o *CopyOptions) RunWithArgs(ctx context.Context, src, dest string) error {
+func (o *CopyOptions) RunWithArgs(ctx context.Context, src, dest string) (err error) {
+	o.silence()
+	if dest == stdoutDest {
+		srcSpec, err := parseFileSpec(src, o.Namespace)
+		if err != nil {
+			return err
+		}
+		return o.copyToStdout(ctx, srcSpec)
+	}
+	if o.Output == "json" && !o.DryRun {
+		o.report = &copyReport{Source: src, Destination: dest}
+		defer func() { err = o.printReport(err) }()
+	}
+	if o.SourcesManifest != "" {
+		o.manifest = newSourcesManifest(o.kubeContext, src, dest, o.SourcesManifest)
+		defer func() { err = o.writeSourcesManifest(err) }()
+	}
+
 	srcSpec, err := parseFileSpec(src, o.Namespace)
 	if err != nil {
 		return err
 	}
+	o.contents = strings.HasSuffix(srcSpec.File, "/")
 
 	destSpec, err := parseFileSpec(dest, o.Namespace)
 	if err != nil {
 		return err
 	}
 
-	if err := validateCopySpecs(srcSpec, destSpec); err != nil {
+	if o.Selector != "" {
+		if !strings.HasPrefix(src, ":") || srcSpec.File == "" || destSpec.PodName != "" {
+			return fmt.Errorf("with --selector the source is :<path> and the destination a local directory")
+		}
+		return o.copyFromSelectedPods(ctx, srcSpec.File, filepath.Clean(destSpec.File))
+	}
+
+	if err := validateCopySpecs(srcSpec, destSpec, o.AllowUpload); err != nil {
 		return err
 	}
+	if destSpec.PodName != "" {
+		return o.copyToPod(ctx, srcSpec, destSpec)
+	}
+	// a remote path is a POSIX one whatever the local platform, and an
+	// existing local directory, . and ./ included, gets the base name of
+	// the remote path in it, or its contents when it ends in /
+	srcSpec.File = path.Clean(srcSpec.File)
+	destSpec.File = filepath.Clean(destSpec.File)
+
+	if o.EntriesFrom != "" {
+		if o.contents {
+			return fmt.Errorf("--entries-from selects entries under the base name of the remote path, it can't be used with a remote path ending in /")
+		}
+		if o.selected, err = loadCopyPlan(o.EntriesFrom, srcSpec.File); err != nil {
+			return err
+		}
+	}
 
 	if err := validateLocalDestination(destSpec.File); err != nil {
 		return err
 	}
 
+	if o.Chunked {
+		return o.copyChunked(ctx, srcSpec, destSpec)
+	}
 	return o.copyFromPod(ctx, srcSpec, destSpec)
 }
 
-func validateCopySpecs(src, dest *fileSpec) error {
+func validateCopySpecs(src, dest *fileSpec, allowUpload bool) error {
 	if src.PodName == "" && dest.PodName == "" {
 		return fmt.Errorf("source must be a pod file spec (pod:path); only pod to local copy is supported")
 	}
-	if src.PodName == "" && dest.PodName != "" {
-		return fmt.Errorf("copying to pods is not supported for security reasons; only pod to local copy is allowed")
+	if src.PodName == "" && dest.PodName != "" && !allowUpload {
+		return fmt.Errorf("copying to pods is not supported for security reasons without --allow-upload; only pod to local copy is allowed by default")
 	}
 	if src.PodName != "" && dest.PodName != "" {
 		return fmt.Errorf("destination must be a local path, not a pod path; only pod to local copy is supported")
 	}
-	if src.PodName != "" && src.File == "" {
+	if src.PodName != "" && src.File == "" || dest.PodName != "" && dest.File == "" {
 		return fmt.Errorf("remote path cannot be empty")
 	}
 	return nil
@@ -170,61 +621,197 @@ func validateLocalDestination(destPath string) error {
 	return nil
 }
 
+// tarCreateFlags are the flags of the tar writing the archive of a copy, with
+// h to archive what symlinks point to rather than the links, S to archive the
+// holes of sparse files as such, and z to gzip it.
+func (o *CopyOptions) tarCreateFlags() string {
+	flags := "c"
+	if o.FollowSymlinks {
+		flags += "h"
+	}
+	if o.Sparse {
+		flags += "S"
+	}
+	if o.compressing() {
+		flags += "z"
+	}
+	return flags + "f"
+}
+
 func (o *CopyOptions) copyFromPod(ctx context.Context, src, dest *fileSpec) error {
-	pod, err := o.Clientset.CoreV1().Pods(src.PodNamespace).Get(ctx, src.PodName, metav1.GetOptions{})
+	if o.report != nil {
+		o.report.Namespace, o.report.Pod, o.report.Path = src.PodNamespace, src.PodName, src.File
+	}
+	pod, containerName, err := o.validateAndGetPodContainer(ctx, src)
 	if err != nil {
-		return fmt.Errorf("pod %s/%s not found", src.PodNamespace, src.PodName)
+		return err
 	}
-
-	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
-		return fmt.Errorf("pod %s/%s is not running (phase: %s)", src.PodNamespace, src.PodName, pod.Status.Phase)
+	if o.report != nil {
+		o.report.Pod, o.report.Container = pod.Name, containerName
 	}
 
-	containerName, err := o.resolveContainer(pod)
+	srcDir, srcBase := o.archivedPath(src)
+	if o.manifest != nil {
+		o.manifest.Namespace = pod.Namespace
+		o.manifest.Pod = pod.Name
+		o.manifest.PodUID = string(pod.UID)
+		o.manifest.Container = containerName
+		o.manifest.RequestedPath = src.File
+		o.manifest.RemoteDir = srcDir
+	}
+	command, err := o.remoteCommand(ctx, pod, containerName, o.tarCreateCommand(srcDir, []string{srcBase}))
 	if err != nil {
 		return err
 	}
+	if !o.DryRun {
+		if err := o.preflight(ctx, pod, containerName, dest.File, src.File); err != nil {
+			return err
+		}
+	}
 
-	srcDir := filepath.Dir(src.File)
-	srcBase := filepath.Base(src.File)
-	command := []string{"tar", "cf", "-", "-C", srcDir, "--", srcBase}
-
-	var stdout, stderr bytes.Buffer
-	execErr := o.executeRemote(ctx, pod, containerName, command, &stdout, &stderr)
-
-	if execErr != nil {
-		return o.handleExecError(execErr, stderr.String(), src)
+	var stdout bytes.Buffer
+	progress := o.startProgress()
+	defer progress.stop()
+	err = o.executeResuming(ctx, pod, containerName, command, src, srcDir, []string{srcBase}, &stdout, progress)
+	progress.stop()
+	if o.catCopyable(err) {
+		return o.copyWithCat(ctx, pod, containerName, src, dest, err)
+	}
+	if err != nil {
+		return err
 	}
 
 	if stdout.Len() == 0 {
 		return fmt.Errorf("no data received from pod")
 	}
+	archive, err := o.uncompressedArchive(&stdout)
+	if err != nil {
+		return err
+	}
+
+	if o.selected != nil {
+		missing, err := missingEntries(archive.Bytes(), o.selected)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%d entries of %s no longer exist in pod %s/%s: %s", len(missing), o.EntriesFrom, pod.Namespace, pod.Name, strings.Join(missing, ", "))
+		}
+	}
+
+	if o.DryRun {
+		return o.printCopyPlan(archive.Bytes(), copyPlan{
+			Namespace: pod.Namespace, Pod: pod.Name, Container: containerName, RemoteDir: srcDir, RequestedPath: src.File,
+		})
+	}
 
-	if err := o.extractTar(&stdout, dest.File, srcBase); err != nil {
+	// resolved before extracting, which may create dest as a directory
+	openPath := copiedPath(dest.File, srcBase)
+	if o.StripComponents > 0 {
+		openPath = dest.File
+	}
+	result, err := o.extractTar(ctx, archive, dest.File, srcBase)
+	if err != nil {
 		return err
 	}
+	result.Duration = progress.elapsed()
+	o.Result = result
+	return o.finishCopy(ctx, pod, containerName, src, dest, openPath)
+}
+
+// finishCopy verifies the checksums of the files a copy extracted, prints its
+// summary from Result naming openPath, what it copied, and opens it as asked.
+func (o *CopyOptions) finishCopy(ctx context.Context, pod *corev1.Pod, container string, src, dest *fileSpec, openPath string) error {
+	var alg checksumAlgorithm
+	var digests []fileDigest
+	if o.Checksum {
+		var err error
+		dir, _ := o.archivedPath(src)
+		if alg, digests, err = o.verifyChecksums(ctx, pod, container, src, dir); err != nil {
+			return err
+		}
+	}
 
-	if _, err := fmt.Fprintf(o.IOStreams.Out, "Copied %s:%s to %s\n", src.PodName, src.File, dest.File); err != nil {
+	if _, err := fmt.Fprintf(o.summaryOut(), "%s%s\n", o.Result.summary(src.remote(), openPath), o.excludedSummary()+o.keptSummary()+o.unchangedSummary()+o.specialSummary()+o.strippedSummary()+o.caseSummary()); err != nil {
 		return fmt.Errorf("failed to write output: %v", err)
 	}
+	if o.report != nil {
+		o.reportFinished(openPath, alg, digests)
+	} else {
+		o.printDigests(alg, digests)
+	}
+
+	if o.Open || o.OpenWith != "" {
+		o.openDestination(openPath)
+	}
 	return nil
 }
 
-func (o *CopyOptions) handleExecError(execErr error, stderrStr string, src *fileSpec) error {
-	podRef := fmt.Sprintf("%s/%s", src.PodNamespace, src.PodName)
+// validateAndGetPodContainer is the preflight of a copy: it fetches the pod,
+// chosen first when src names a workload, checks that it and its node can
+// serve an exec, and resolves the container, which must be running.
+func (o *CopyOptions) validateAndGetPodContainer(ctx context.Context, src *fileSpec) (*corev1.Pod, string, error) {
+	if src.Workload != "" {
+		if err := o.resolveWorkload(ctx, src); err != nil {
+			return nil, "", err
+		}
+	}
+	start := time.Now()
+	pod, err := o.Clientset.CoreV1().Pods(src.PodNamespace).Get(ctx, src.PodName, metav1.GetOptions{})
+	logPodGet(src.PodNamespace, src.PodName, start)
+	if err != nil {
+		return nil, "", fmt.Errorf("pod %s/%s not found", src.PodNamespace, src.PodName)
+	}
+
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil, "", fmt.Errorf("pod %s/%s is not running (phase: %s)", src.PodNamespace, src.PodName, pod.Status.Phase)
+	}
+
+	if err := o.checkPodNode(ctx, pod); err != nil {
+		return nil, "", err
+	}
+
+	containerName, err := o.resolveContainer(pod)
+	if err != nil {
+		return nil, "", err
+	}
+	klog.V(2).Infof("resolved container %s of pod %s/%s", containerName, pod.Namespace, pod.Name)
+	if err := checkContainerState(pod, containerName); err != nil {
+		return nil, "", err
+	}
+	return pod, containerName, nil
+}
 
-	if strings.Contains(stderrStr, "tar: not found") ||
-		strings.Contains(stderrStr, "executable file not found") ||
-		strings.Contains(stderrStr, "sh: tar") {
-		return fmt.Errorf("pod %s: tar binary not found in container", podRef)
+// archivedPath returns the directory the tar of a copy of src runs in and the
+// member it archives: the parent and base name of src, or src and . to copy
+// the contents of a remote path ending in /.
+func (o *CopyOptions) archivedPath(src *fileSpec) (dir, member string) {
+	file := path.Clean(src.File)
+	if o.contents {
+		return file, "."
 	}
+	return path.Dir(file), path.Base(file)
+}
 
-	if strings.Contains(stderrStr, "No such file or directory") {
-		return fmt.Errorf("pod %s: file not found: %s", podRef, src.File)
+// copiedPath returns where the copied file or directory landed: inside dest
+// when it is an existing directory, dest itself otherwise.
+func copiedPath(dest, srcBase string) string {
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		return filepath.Join(dest, srcBase)
 	}
+	return dest
+}
+
+func (o *CopyOptions) handleExecError(execErr error, stderrStr string, src *fileSpec, container string) error {
+	podRef := fmt.Sprintf("%s/%s", src.PodNamespace, src.PodName)
 
-	if strings.Contains(stderrStr, "Permission denied") || strings.Contains(stderrStr, "cannot open") {
-		return fmt.Errorf("pod %s: permission denied: %s", podRef, src.File)
+	switch classifyRemoteStderr(stderrStr) {
+	case remoteErrTarMissing:
+		return tarMissingError{pod: podRef, container: container}
+	case remoteErrNotFound:
+		return remoteError{remoteErrNotFound, fmt.Errorf("pod %s: file not found: %s", podRef, failedPath(src, stderrStr))}
+	case remoteErrPermission:
+		return remoteError{remoteErrPermission, fmt.Errorf("pod %s: permission denied: %s", podRef, failedPath(src, stderrStr))}
 	}
 
 	if stderrStr != "" {
@@ -234,19 +821,25 @@ func (o *CopyOptions) handleExecError(execErr error, stderrStr string, src *file
 	return fmt.Errorf("pod %s: command failed: %v", podRef, execErr)
 }
 
+// resolveContainer returns the container named with -c, which may be an init
+// or an ephemeral container such as one kubectl debug added, or else the
+// default container of pod.
 func (o *CopyOptions) resolveContainer(pod *corev1.Pod) (string, error) {
 	if o.Container != "" {
+		var available []string
 		for _, c := range pod.Spec.Containers {
-			if c.Name == o.Container {
-				return o.Container, nil
-			}
+			available = append(available, c.Name)
 		}
 		for _, c := range pod.Spec.InitContainers {
-			if c.Name == o.Container {
-				return o.Container, nil
-			}
+			available = append(available, c.Name)
+		}
+		for _, c := range pod.Spec.EphemeralContainers {
+			available = append(available, c.Name)
+		}
+		if slices.Contains(available, o.Container) {
+			return o.Container, nil
 		}
-		return "", fmt.Errorf("container %q not found in pod %s/%s", o.Container, pod.Namespace, pod.Name)
+		return "", fmt.Errorf("container %q not found in pod %s/%s, available: %s", o.Container, pod.Namespace, pod.Name, strings.Join(available, ", "))
 	}
 
 	container, err := podcmd.FindOrDefaultContainerByName(pod, "", false, o.IOStreams.ErrOut)
@@ -256,37 +849,15 @@ func (o *CopyOptions) resolveContainer(pod *corev1.Pod) (string, error) {
 	return container.Name, nil
 }
 
-func (o *CopyOptions) executeRemote(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr *bytes.Buffer) error {
-	restClient, err := restclient.RESTClientFor(o.ClientConfig)
-	if err != nil {
-		return err
-	}
-
-	req := restClient.Post().
-		RequestURI(fmt.Sprintf("/apis/audit.adyen.internal/v1beta1/namespaces/%s/pods/%s/exec", pod.Namespace, pod.Name))
-
-	req.VersionedParams(&corev1.PodExecOptions{
-		Container: container,
-		Command:   command,
-		Stdin:     false,
-		Stdout:    true,
-		Stderr:    true,
-		TTY:       false,
-	}, scheme.ParameterCodec)
-
-	exec, err := remotecommand.NewSPDYExecutor(o.ClientConfig, "POST", req.URL())
-	if err != nil {
-		return err
-	}
-
-	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
-		Stdout: stdout,
-		Stderr: stderr,
-	})
-}
-
-func (o *CopyOptions) extractTar(reader io.Reader, destPath, srcBase string) error {
+// extractTar extracts the archive of a copy to destPath, and returns what it
+// wrote.
+func (o *CopyOptions) extractTar(ctx context.Context, reader io.Reader, destPath, srcBase string) (result CopyResult, err error) {
 	destPath = filepath.Clean(destPath)
+	if o.StripComponents > 0 {
+		if err := o.stripDestination(destPath); err != nil {
+			return result, err
+		}
+	}
 	destInfo, statErr := os.Stat(destPath)
 	destIsDir := statErr == nil && destInfo.IsDir()
 
@@ -298,80 +869,386 @@ func (o *CopyOptions) extractTar(reader io.Reader, destPath, srcBase string) err
 	}
 	baseAbs, err := filepath.Abs(baseDir)
 	if err != nil {
-		return fmt.Errorf("invalid base path: %v", err)
+		return result, fmt.Errorf("invalid base path: %v", err)
+	}
+
+	o.warnings = newCopyWarnings(o.IOStreams.ErrOut, o.ShowAllWarnings)
+	o.warnings.keep = o.manifest != nil || o.report != nil
+	o.cases = nil
+	if caseInsensitive(baseAbs) {
+		o.cases = &caseCollisions{written: map[string]caseWritten{}, renamed: map[string]string{}}
+	}
+	o.extracted = nil
+	o.checksummed = nil
+	o.linkable = map[string]bool{}
+	o.excludedEntries = 0
+	o.keptExisting = 0
+	o.skippedSpecial = 0
+	o.strippedEntries = 0
+	o.preservedDirs = nil
+	o.created = nil
+	if o.Preserve {
+		o.startPreserving()
 	}
+	defer func() {
+		result.Created = o.created
+		failed := err != nil
+		if failed && !o.KeepPartial {
+			// removed below, there is nothing to restore, check or give away
+			o.preservedDirs, o.extracted, o.owned = nil, nil, nil
+		}
+		o.restoreDirs()
+		if !o.NoVerifyReadable {
+			o.verifyReadable(o.extracted)
+		}
+		if ownErr := o.applyOwner(); ownErr != nil && err == nil {
+			err = ownErr
+		}
+		o.warnings.summary()
+		if o.manifest != nil {
+			o.manifest.Warnings = o.warnings.byKey()
+			o.manifest.WarningList = o.warnings.all
+		}
+		if failed {
+			err = o.failedExtraction(ctx, err, result.Created)
+		}
+	}()
 
-	tarReader := tar.NewReader(reader)
+	counter := &countingReader{r: ctxReader{ctx: ctx, r: reader}}
+	tarReader := tar.NewReader(counter)
+	var header *tar.Header
 	for {
-		header, err := tarReader.Next()
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if header != nil {
+			if err := drainEntry(tarReader, header); err != nil {
+				return result, err
+			}
+		}
+		entryEnd := counter.n
+		header, err = tarReader.Next()
 		if err == io.EOF {
+			if !archiveEnded(counter, entryEnd) {
+				return result, truncatedError{fmt.Sprintf("the archive ends after %d bytes without the end of archive marker, entries after it may be missing", counter.n)}
+			}
 			break
 		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return result, truncatedError{fmt.Sprintf("the archive ends within a header after %d bytes", counter.n)}
+		}
 		if err != nil {
-			return fmt.Errorf("tar read error: %v", err)
+			return result, fmt.Errorf("tar read error: %v", err)
+		}
+		if metadataEntry(header) {
+			continue
+		}
+
+		if o.selected != nil && !o.selected[path.Clean(header.Name)] {
+			continue
+		}
+		if o.excluded(header.Name) {
+			o.excludedEntries++
+			continue
 		}
 
 		// Security: validate and compute safe target path
-		targetAbs, err := computeSafeTarget(header.Name, destPath, baseAbs, srcBase, destIsDir)
+		name, ok, err := o.entryName(header.Name)
 		if err != nil {
-			return err
+			return result, err
+		}
+		if !ok {
+			result.Skipped++
+			if o.manifest != nil {
+				o.manifest.addEntry(header, nil, true)
+			}
+			continue
+		}
+		if o.members != nil {
+			if name, err = o.memberName(name); err != nil {
+				return result, err
+			}
+		}
+		// contained below like any other name, once stripped
+		if name, ok = o.stripComponents(name); !ok {
+			o.strippedEntries++
+			result.Skipped++
+			if o.manifest != nil {
+				o.manifest.addEntry(header, nil, true)
+			}
+			continue
+		}
+		targetAbs, err := computeSafeTarget(name, destPath, baseAbs, srcBase, destIsDir)
+		if err != nil {
+			return result, err
+		}
+		if targetAbs, err = o.checkCaseCollision(header, targetAbs); err != nil {
+			return result, err
+		}
+		if err := o.checkManifestPath(targetAbs); err != nil {
+			return result, err
+		}
+
+		if regularEntry(header) && o.unchanged(header, targetAbs) {
+			result.Unchanged++
+			o.linkable[targetAbs] = true
+			if o.manifest != nil {
+				o.manifest.addEntry(header, nil, true)
+			}
+			continue
+		}
+
+		if (regularEntry(header) || header.Typeflag == tar.TypeLink) && o.keepExisting(targetAbs) {
+			if o.manifest != nil {
+				o.manifest.addEntry(header, nil, true)
+			}
+			continue
+		}
+
+		if err := o.checkLimits(header, result); err != nil {
+			return result, err
+		}
+		if header.Typeflag != tar.TypeDir {
+			o.creating(targetAbs)
+		}
+
+		if header.Typeflag == tar.TypeSymlink && o.AllowSymlinks {
+			created, err := o.extractSymlink(header, targetAbs, baseAbs)
+			if err != nil {
+				return result, err
+			}
+			if created {
+				result.Symlinks++
+				continue
+			}
+		}
+
+		if header.Typeflag == tar.TypeLink {
+			linkTarget, err := o.hardLinkTarget(header, destPath, baseAbs, srcBase, destIsDir)
+			if err != nil {
+				return result, err
+			}
+			linkTarget = o.caseRenamed(linkTarget)
+			if o.linkable[linkTarget] {
+				result.Files++
+			} else {
+				result.Skipped++
+			}
+			if err := o.extractHardLink(header, targetAbs, linkTarget); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		if specialEntry(header) {
+			created, err := o.extractSpecial(header, targetAbs)
+			if err != nil {
+				return result, err
+			}
+			if created {
+				result.Special++
+			} else {
+				result.Skipped++
+			}
+			continue
 		}
 
 		// Delegated the actual file creation to reduce cognitive complexity
 		if err := o.processTarEntry(header, tarReader, targetAbs); err != nil {
-			return err
+			return result, err
+		}
+		result.add(header)
+		if regularEntry(header) {
+			o.linkable[targetAbs] = true
 		}
 	}
-	return nil
+	return result, nil
+}
+
+// metadataEntry reports whether header is a pseudo-entry describing others,
+// not a file. archive/tar merges the PAX and GNU long name headers into the
+// entries they describe, with their long names and times, but returns PAX
+// global headers, such as those git archive writes, as entries of their own.
+func metadataEntry(header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+		return true
+	}
+	return false
 }
 
 // processTarEntry handles the creation of directories, files, or skipping symlinks based on the tar header type.
 func (o *CopyOptions) processTarEntry(header *tar.Header, tarReader *tar.Reader, targetAbs string) error {
+	if o.warnings == nil {
+		o.warnings = newCopyWarnings(o.IOStreams.ErrOut, o.ShowAllWarnings)
+	}
+	o.warnings.entry(header, time.Now())
+	modes, err := parseChmod(o.Chmod)
+	if err != nil {
+		return err
+	}
+	mode := modes.entryMode(header.Typeflag == tar.TypeDir, os.FileMode(header.Mode&0o777))
 	switch header.Typeflag {
 	case tar.TypeDir:
-		if err := os.MkdirAll(targetAbs, os.FileMode(header.Mode)); err != nil {
+		if o.Preserve {
+			if err := o.preserveDir(targetAbs, header, mode); err != nil {
+				return fmt.Errorf("mkdir failed: %v", err)
+			}
+			o.applyXattrs(targetAbs, header)
+			break
+		}
+		// given its mode by restoreDirs once its entries are written: that of
+		// --chmod, or a mode that would keep its owner from writing them, which
+		// a directory the copy creates gets less the umask, like GNU tar does
+		restoreMode := modes.setDir
+		existing, statErr := os.Lstat(targetAbs)
+		if !restoreMode && mode&0o700 != 0o700 {
+			restoreMode = os.IsNotExist(statErr)
+		}
+		if statErr == nil && existing.IsDir() && existing.Mode().Perm()&0o700 != 0o700 {
+			// left so by an earlier copy, opened up for its entries and given
+			// back the mode it has once they are written
+			if err := os.Chmod(targetAbs, existing.Mode().Perm()|0o700); err != nil {
+				return fmt.Errorf("mkdir failed: %v", err)
+			}
+			if !restoreMode {
+				restoreMode, mode = true, existing.Mode().Perm()
+			}
+		}
+		createMode := mode
+		if restoreMode {
+			createMode |= 0o700
+		}
+		if err := o.mkdirAll(targetAbs, createMode); err != nil {
 			return fmt.Errorf("mkdir failed: %v", err)
 		}
-	case tar.TypeReg:
-		if err := os.MkdirAll(filepath.Dir(targetAbs), 0755); err != nil {
+		if restoreMode && !modes.setDir {
+			if info, err := os.Lstat(targetAbs); err == nil {
+				mode = info.Mode().Perm() &^ (0o700 &^ mode)
+			}
+		}
+		o.applyXattrs(targetAbs, header)
+		if !o.NoPreserveTimes || restoreMode {
+			// its time, and its mode, are set once its entries are written
+			o.preservedDirs = append(o.preservedDirs, preservedDir{path: targetAbs, header: header, mode: mode, restoreMode: restoreMode})
+		}
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if err := o.mkdirAll(filepath.Dir(targetAbs), 0755); err != nil {
 			return fmt.Errorf("mkdir failed: %v", err)
 		}
-		f, err := os.OpenFile(targetAbs, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+		if err := removeReadOnly(targetAbs); err != nil {
+			return fmt.Errorf("create file failed: %v", err)
+		}
+		createMode := mode
+		if o.Preserve {
+			// written first, given its mode by preserveFile after
+			createMode = 0o600
+		}
+		f, err := os.OpenFile(targetAbs, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, createMode)
 		if err != nil {
 			return fmt.Errorf("create file failed: %v", err)
 		}
-		_, copyErr := io.Copy(f, tarReader)
+		o.own(targetAbs)
+		// hash inline for the sources manifest instead of reading the file back
+		var w io.Writer = f
+		var holes *holeWriter
+		if sparseEntry(header) {
+			holes = &holeWriter{f: f}
+			w = holes
+		}
+		var h hash.Hash
+		if o.manifest != nil {
+			h = sha256.New()
+			w = io.MultiWriter(w, h)
+		}
+		n, copyErr := io.Copy(w, tarReader)
+		if holes != nil && copyErr == nil {
+			copyErr = holes.finish()
+		}
+		o.copiedBytes += n
 		if closeErr := f.Close(); closeErr != nil && copyErr == nil {
 			return fmt.Errorf("close file failed: %v", closeErr)
 		}
+		if errors.Is(copyErr, io.ErrUnexpectedEOF) || copyErr == nil && n != header.Size {
+			return removeTruncated(targetAbs, header, n)
+		}
 		if copyErr != nil {
 			return fmt.Errorf("write failed: %v", copyErr)
 		}
-	case tar.TypeSymlink:
-		//nolint:errcheck
-		_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: skipping symlink %s -> %s (symlinks not supported for security)\n", header.Name, header.Linkname)
-	case tar.TypeLink:
-		//nolint:errcheck
-		_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: skipping hard link %s -> %s (hard links not supported for security)\n", header.Name, header.Linkname)
-	default:
-		//nolint:errcheck
-		_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: skipping unsupported tar entry %s (type %d)\n", header.Name, header.Typeflag)
+		if o.Preserve {
+			o.preserveFile(targetAbs, header, mode)
+		} else {
+			o.applyXattrs(targetAbs, header)
+			if !o.NoPreserveTimes {
+				o.preserveTime(targetAbs, header)
+			}
+		}
+		if modes.setFile {
+			if err := os.Chmod(targetAbs, mode); err != nil {
+				return fmt.Errorf("chmod failed: %v", err)
+			}
+		}
+		o.extracted = append(o.extracted, targetAbs)
+		if o.Checksum {
+			o.checksummed = append(o.checksummed, checksummedFile{remote: header.Name, local: targetAbs})
+		}
+		if o.manifest != nil {
+			o.manifest.addEntry(header, h.Sum(nil), false)
+		}
+		return nil
+	}
+	if o.manifest != nil {
+		o.manifest.addEntry(header, nil, header.Typeflag != tar.TypeDir)
 	}
 	return nil
 }
 
+// removeReadOnly removes the regular file at path when its owner can't write
+// it, as a copy run again over the read-only files of an earlier one finds, so
+// it can be created anew.
+func removeReadOnly(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o200 != 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// writeSourcesManifest finishes and writes the sources manifest, whether the
+// copy succeeded or not, and prints its sha256. It returns the copy error, or
+// the write error when the copy itself succeeded.
+func (o *CopyOptions) writeSourcesManifest(copyErr error) error {
+	o.manifest.finish(copyErr)
+	sum, err := o.manifest.write()
+	if err != nil {
+		if copyErr != nil {
+			//nolint:errcheck
+			_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: failed to write sources manifest: %v\n", err)
+			return copyErr
+		}
+		return fmt.Errorf("failed to write sources manifest: %v", err)
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Sources manifest %s sha256 %x\n", o.SourcesManifest, sum)
+	return copyErr
+}
+
 // computeSafeTarget validates the tar entry name and computes a safe absolute target path.
 func computeSafeTarget(name, destPath, baseAbs, srcBase string, destIsDir bool) (string, error) {
-	cleanName := path.Clean(name)
-
-	if cleanName == ".." || strings.HasPrefix(cleanName, "../") || path.IsAbs(cleanName) {
-		return "", fmt.Errorf(errPathTraversal, name)
+	cleanName, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
 	}
 
 	var target string
 	if destIsDir {
 		target = filepath.Join(destPath, cleanName)
 	} else {
+		// compared by whole names, a srcBase of app.log is not a prefix of
+		// app.log.1 or app.log\n.1
+		if srcBase != "" && srcBase != "." && cleanName != srcBase && !strings.HasPrefix(cleanName, srcBase+"/") {
+			return "", fmt.Errorf(errPathTraversal, name)
+		}
 		rel, err := filepath.Rel(srcBase, cleanName)
 		if err != nil {
 			return "", fmt.Errorf("failed to calculate relative path: %v", err)
@@ -384,20 +1261,50 @@ func computeSafeTarget(name, destPath, baseAbs, srcBase string, destIsDir bool)
 		return "", fmt.Errorf("invalid target path: %v", err)
 	}
 
-	rel, err := filepath.Rel(baseAbs, targetAbs)
-	if err != nil {
+	if !withinBase(baseAbs, targetAbs) {
 		return "", fmt.Errorf(errPathTraversal, name)
 	}
 
-	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
-		return "", fmt.Errorf(errPathTraversal, name)
+	return targetAbs, nil
+}
+
+// withinBase reports whether targetAbs is baseAbs or below it.
+func withinBase(baseAbs, targetAbs string) bool {
+	rel, err := filepath.Rel(baseAbs, targetAbs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// validateSpecNamespaces fails when a pod:path of specs is prefixed with
+// another namespace than namespace, given with -n, rather than picking one.
+func validateSpecNamespaces(specs []string, namespace string) error {
+	for _, spec := range specs {
+		s, err := parseFileSpec(spec, namespace)
+		if err != nil {
+			return err
+		}
+		if s.PodName != "" && s.PodNamespace != namespace {
+			return fmt.Errorf("%s is in namespace %s but -n is %s, give the namespace once", spec, s.PodNamespace, namespace)
+		}
 	}
+	return nil
+}
 
-	return targetAbs, nil
+// windowsLocalPath reports whether spec is a Windows path, C:\temp or C:/temp
+// with a drive letter or a \\server\share UNC path, rather than a pod:path of
+// a pod with a one letter name, which ns/c:/temp still copies from.
+func windowsLocalPath(spec string) bool {
+	if strings.HasPrefix(spec, `\\`) {
+		return true
+	}
+	if len(spec) < 3 || spec[1] != ':' || spec[2] != '\\' && spec[2] != '/' {
+		return false
+	}
+	c := spec[0]
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
 }
 
 func parseFileSpec(spec, defaultNamespace string) (*fileSpec, error) {
-	if !strings.Contains(spec, ":") {
+	if !strings.Contains(spec, ":") || windowsLocalPath(spec) {
 		return &fileSpec{File: spec}, nil
 	}
 
@@ -407,16 +1314,30 @@ func parseFileSpec(spec, defaultNamespace string) (*fileSpec, error) {
 
 	namespace := defaultNamespace
 	podName := podSpec
-
-	if strings.Contains(podSpec, "/") {
-		nsParts := strings.SplitN(podSpec, "/", 2)
-		namespace = nsParts[0]
-		podName = nsParts[1]
+	var workload string
+
+	// a pod, ns/pod, kind.group/name or ns/kind/name of a workload
+	refParts := strings.Split(podSpec, "/")
+	switch kind, ok := qualifiedWorkloadKind(refParts[0]); {
+	case len(refParts) == 2 && ok:
+		podName, workload = refParts[1], kind+"/"+refParts[1]
+	case len(refParts) == 3:
+		kind, ok = workloadKinds[refParts[1]]
+		if !ok {
+			return nil, fmt.Errorf("invalid source %s, want ns/pod:path or ns/kind/name:path of a deployment, statefulset, daemonset, replicaset or job", spec)
+		}
+		namespace, podName, workload = refParts[0], refParts[2], kind+"/"+refParts[2]
+	case len(refParts) > 1:
+		namespace, podName = refParts[0], strings.Join(refParts[1:], "/")
+	}
+	if workload != "" && podName == "" {
+		return nil, fmt.Errorf("invalid source %s, the %s has no name", spec, strings.TrimSuffix(workload, "/"))
 	}
 
 	return &fileSpec{
 		PodName:      podName,
 		PodNamespace: namespace,
 		File:         filePath,
+		Workload:     workload,
 	}, nil
 }
@@ -4,13 +4,20 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/cli-runtime/pkg/genericiooptions"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	utilexec "k8s.io/client-go/util/exec"
 )
 
 const (
@@ -95,6 +102,13 @@ func TestParseFileSpec(t *testing.T) {
 		{"pod file", "my-pod:" + tmpFooPath, "default", &fileSpec{PodName: "my-pod", PodNamespace: "default", File: tmpFooPath}},
 		{"pod with namespace", "kube-system/my-pod:" + tmpFooPath, "default", &fileSpec{PodName: "my-pod", PodNamespace: "kube-system", File: tmpFooPath}},
 		{"path with colon", "pod:path:extra", "default", &fileSpec{PodName: "pod", PodNamespace: "default", File: "path:extra"}},
+		{"namespace flag", "my-pod:" + tmpFooPath, "forensics", &fileSpec{PodName: "my-pod", PodNamespace: "forensics", File: tmpFooPath}},
+		{"windows drive", `C:\temp\foo`, "default", &fileSpec{File: `C:\temp\foo`}},
+		{"windows drive slash", "d:/temp/foo", "default", &fileSpec{File: "d:/temp/foo"}},
+		{"windows unc", `\\server\share\foo`, "default", &fileSpec{File: `\\server\share\foo`}},
+		{"one letter pod", "c:tmp/foo", "default", &fileSpec{PodName: "c", PodNamespace: "default", File: "tmp/foo"}},
+		{"one letter pod with namespace", "default/c:/tmp/foo", "default", &fileSpec{PodName: "c", PodNamespace: "default", File: tmpFooPath}},
+		{"prefix over namespace flag", "kube-system/my-pod:" + tmpFooPath, "forensics", &fileSpec{PodName: "my-pod", PodNamespace: "kube-system", File: tmpFooPath}},
 	}
 
 	for _, tt := range tests {
@@ -110,6 +124,111 @@ func TestParseFileSpec(t *testing.T) {
 	}
 }
 
+func TestValidateNamespaceFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    bool
+		specs   []string
+		wantErr string
+	}{
+		{"agrees", true, []string{"forensics/pod:/var/log", "pod:/etc/app", "./out"}, ""},
+		{"disagrees", true, []string{"pod:/etc/app", "kube-system/pod:/var/log", "./out"}, "kube-system/pod:/var/log is in namespace kube-system but -n is forensics, give the namespace once"},
+		{"kubeconfig default", false, []string{"kube-system/pod:/var/log", "./out"}, ""},
+		{"selector", true, []string{":/var/log", "./out"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.ClientConfig = &restclient.Config{}
+			o.Namespace, o.namespaceFlag, o.specs = "forensics", tt.flag, tt.specs
+			err := o.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyDirectoryDestination(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		dest string
+		want string
+	}{
+		{"dot", "pod:/var/log/app.log", ".", "app.log"},
+		{"dot slash", "pod:/var/log/app.log", "./", "app.log"},
+		{"directory", "pod:/var/log/app.log", "dir", filepath.Join("dir", "app.log")},
+		{"directory slash", "pod:/var/log/app.log", "dir/", filepath.Join("dir", "app.log")},
+		{"new file in directory", "pod:/var/log/app.log", "dir/renamed.log", filepath.Join("dir", "renamed.log")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(mustTempDir(t))
+			if err := os.Mkdir("dir", 0o755); err != nil {
+				t.Fatal(err)
+			}
+			executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": contentStr}).Bytes()}
+			o := newFakePodCopyOptions(executor)
+			var out bytes.Buffer
+			o.IOStreams.Out = &out
+
+			if err := o.RunWithArgs(context.Background(), tt.src, tt.dest); err != nil {
+				t.Fatalf("RunWithArgs() error = %v", err)
+			}
+			assertFileContent(t, tt.want, contentStr)
+			assertContains(t, out.String(), "Copied 1 file (8 B) from pod:/var/log/app.log to "+tt.want+" in ")
+			if got := executor.commands[len(executor.commands)-1]; !slices.Equal(got[len(got)-4:], []string{"-C", "/var/log", "--", "app.log"}) {
+				t.Errorf("command = %q", got)
+			}
+		})
+	}
+}
+
+func TestCopyDirectoryContents(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		dest    string
+		archive map[string]string
+		members []string
+		want    []string
+	}{
+		{
+			"directory", "pod:/var/log", "dir", map[string]string{"log/app.log": contentStr, "log/nginx/access.log": contentStr},
+			[]string{"-C", "/var", "--", "log"}, []string{"dir/log/app.log", "dir/log/nginx/access.log"},
+		},
+		{
+			"contents", "pod:/var/log/", "dir", map[string]string{"./app.log": contentStr, "./nginx/access.log": contentStr},
+			[]string{"-C", "/var/log", "--", "."}, []string{"dir/app.log", "dir/nginx/access.log"},
+		},
+		{
+			"contents to new directory", "pod:/var/log/", "dir/out", map[string]string{"./app.log": contentStr},
+			[]string{"-C", "/var/log", "--", "."}, []string{"dir/out/app.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(mustTempDir(t))
+			if err := os.Mkdir("dir", 0o755); err != nil {
+				t.Fatal(err)
+			}
+			executor := &fakeExecutor{stdout: createTestTar(t, tt.archive).Bytes()}
+			o := newFakePodCopyOptions(executor)
+
+			if err := o.RunWithArgs(context.Background(), tt.src, tt.dest); err != nil {
+				t.Fatalf("RunWithArgs() error = %v", err)
+			}
+			for _, file := range tt.want {
+				assertFileContent(t, filepath.FromSlash(file), contentStr)
+			}
+			if got := executor.commands[len(executor.commands)-1]; !slices.Equal(got[len(got)-4:], tt.members) {
+				t.Errorf("command = %q, want it to end with %q", got, tt.members)
+			}
+		})
+	}
+}
+
 func TestValidateLocalDestination(t *testing.T) {
 	tmpDir := mustTempDir(t)
 
@@ -159,7 +278,7 @@ func runExtractTarScenarioCase(t *testing.T, tt extractTarScenario) {
 		destPath = filepath.Join(tmpDir, tt.renameDest)
 	}
 
-	if err := opts.extractTar(tarBuf, destPath, tt.srcBase); err != nil {
+	if _, err := opts.extractTar(context.Background(), tarBuf, destPath, tt.srcBase); err != nil {
 		t.Fatalf(errExtractTar, err)
 	}
 
@@ -277,7 +396,7 @@ func runExtractTarLinkTypesSkippedCase(t *testing.T, tt linkTestCase) {
 	opts := newCopyOptions(&stderr)
 	tarBuf := createLinkTar(t, tt.linkName, tt.typeflag, targetTxtFile)
 
-	if err := opts.extractTar(tarBuf, tmpDir, targetTxtFile); err != nil {
+	if _, err := opts.extractTar(context.Background(), tarBuf, tmpDir, targetTxtFile); err != nil {
 		t.Fatalf(errExtractTar, err)
 	}
 
@@ -289,7 +408,6 @@ func runExtractTarLinkTypesSkippedCase(t *testing.T, tt linkTestCase) {
 func TestExtractTarLinkTypesSkipped(t *testing.T) {
 	tests := []linkTestCase{
 		{"symlink", "link.txt", tar.TypeSymlink, "skipping symlink"},
-		{"hardlink", "hardlink.txt", tar.TypeLink, "skipping hard link"},
 	}
 
 	for _, tt := range tests {
@@ -304,7 +422,7 @@ func TestExtractTarPathTraversal(t *testing.T) {
 	opts := newDefaultCopyOptions()
 	tarBuf := createTestTar(t, map[string]string{"../../../etc/malicious.txt": "bad\n"})
 
-	err := opts.extractTar(tarBuf, tmpDir, "malicious.txt")
+	_, err := opts.extractTar(context.Background(), tarBuf, tmpDir, "malicious.txt")
 	if err == nil {
 		t.Fatal("extractTar() should have failed with path traversal attempt")
 	}
@@ -328,7 +446,7 @@ func TestExtractTarValidDoubleDotFileName(t *testing.T) {
 	tarBuf := createTestTar(t, map[string]string{
 		fileDotTxt: content1Str,
 	})
-	if err := opts.extractTar(tarBuf, tmpDir, fileDotTxt); err != nil {
+	if _, err := opts.extractTar(context.Background(), tarBuf, tmpDir, fileDotTxt); err != nil {
 		t.Fatalf("extractTar() should allow valid filenames with '..': %v", err)
 	}
 	if _, err := os.Stat(filepath.Join(tmpDir, fileDotTxt)); err != nil {
@@ -343,7 +461,7 @@ func TestExtractTarValidDoubleDotDirectoryName(t *testing.T) {
 	tarBuf := createTestTar(t, map[string]string{
 		"dir/..hidden/file": content2Str,
 	})
-	if err := opts.extractTar(tarBuf, tmpDir, ""); err != nil {
+	if _, err := opts.extractTar(context.Background(), tarBuf, tmpDir, ""); err != nil {
 		t.Fatalf("extractTar() should allow valid directory names with '..': %v", err)
 	}
 	if _, err := os.Stat(filepath.Join(tmpDir, "dir/..hidden/file")); err != nil {
@@ -374,20 +492,24 @@ func TestRunWithArgsValidation(t *testing.T) {
 
 func TestValidateCopySpecs(t *testing.T) {
 	tests := []struct {
-		name    string
-		src     *fileSpec
-		dest    *fileSpec
-		wantErr bool
+		name        string
+		src         *fileSpec
+		dest        *fileSpec
+		allowUpload bool
+		wantErr     bool
 	}{
-		{"valid", &fileSpec{PodName: "pod", PodNamespace: "ns", File: "/tmp/f"}, &fileSpec{File: localPath}, false},
-		{"upload", &fileSpec{File: localPath}, &fileSpec{PodName: "pod", PodNamespace: "ns", File: "/tmp/f"}, true},
-		{"pod to pod", &fileSpec{PodName: "p1", PodNamespace: "ns", File: "/f"}, &fileSpec{PodName: "p2", PodNamespace: "ns", File: "/f"}, true},
-		{"empty path", &fileSpec{PodName: "pod", PodNamespace: "ns", File: ""}, &fileSpec{File: localPath}, true},
+		{"valid", &fileSpec{PodName: "pod", PodNamespace: "ns", File: "/tmp/f"}, &fileSpec{File: localPath}, false, false},
+		{"upload", &fileSpec{File: localPath}, &fileSpec{PodName: "pod", PodNamespace: "ns", File: "/tmp/f"}, false, true},
+		{"upload allowed", &fileSpec{File: localPath}, &fileSpec{PodName: "pod", PodNamespace: "ns", File: "/tmp/f"}, true, false},
+		{"upload to an empty path", &fileSpec{File: localPath}, &fileSpec{PodName: "pod", PodNamespace: "ns", File: ""}, true, true},
+		{"pod to pod", &fileSpec{PodName: "p1", PodNamespace: "ns", File: "/f"}, &fileSpec{PodName: "p2", PodNamespace: "ns", File: "/f"}, false, true},
+		{"pod to pod with upload allowed", &fileSpec{PodName: "p1", PodNamespace: "ns", File: "/f"}, &fileSpec{PodName: "p2", PodNamespace: "ns", File: "/f"}, true, true},
+		{"empty path", &fileSpec{PodName: "pod", PodNamespace: "ns", File: ""}, &fileSpec{File: localPath}, false, true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := validateCopySpecs(tt.src, tt.dest)
+			err := validateCopySpecs(tt.src, tt.dest, tt.allowUpload)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("err = %v, wantErr = %v", err, tt.wantErr)
 			}
@@ -395,6 +517,16 @@ func TestValidateCopySpecs(t *testing.T) {
 	}
 }
 
+func TestValidateCopySpecsWindowsDestination(t *testing.T) {
+	for _, dest := range []string{`C:\temp\foo`, "C:/temp/foo", `\\server\share\foo`} {
+		src, _ := parseFileSpec("my-pod:/tmp/foo", "default")
+		destSpec, _ := parseFileSpec(dest, "default")
+		if err := validateCopySpecs(src, destSpec, false); err != nil {
+			t.Errorf("validateCopySpecs(%s) = %v, want a download", dest, err)
+		}
+	}
+}
+
 // createTestTar creates a tar archive for testing
 func createTestTar(t *testing.T, files map[string]string) *bytes.Buffer {
 	t.Helper()
@@ -423,6 +555,9 @@ func TestComputeSafeTarget(t *testing.T) {
 		{"bad path", maliciousPath1, tmpDir, "", true, true, traversalErrorMsg},
 		{"absolute path", maliciousPath2, tmpDir, "", true, true, traversalErrorMsg},
 		{"double dot", maliciousPath3, tmpDir, "", true, true, traversalErrorMsg},
+		{"outside the source", "app.log.1", filepath.Join(tmpDir, "renamed.log"), "app.log", false, true, traversalErrorMsg},
+		{"newline outside the source", "app.log\n/x", filepath.Join(tmpDir, "renamed.log"), "app.log", false, true, traversalErrorMsg},
+		{"newline in the source", "app.log/a\nb.log", filepath.Join(tmpDir, "renamed"), "app.log", false, false, ""},
 	}
 
 	for _, tt := range tests {
@@ -537,8 +672,9 @@ func TestProcessTarEntryUnsupportedTypes(t *testing.T) {
 				t.Errorf("processTarEntry() should not error for unsupported type, got: %v", err)
 			}
 
-			if !strings.Contains(stderr.String(), "skipping unsupported tar entry") {
-				t.Errorf("Expected warning for unsupported tar entry, got: %s", stderr.String())
+			// summarized in a single warning once the extraction is done
+			if stderr.Len() != 0 || o.warnings.counts[warnSpecial] != 1 {
+				t.Errorf("Expected a skipped special file counted without a warning, got %d: %s", o.warnings.counts[warnSpecial], stderr.String())
 			}
 
 			if _, err := os.Stat(targetPath); err == nil {
@@ -570,3 +706,210 @@ func validateTarResult(t *testing.T, header *tar.Header, targetPath string, want
 		}
 	}
 }
+
+func TestOpenerCommand(t *testing.T) {
+	tests := []struct {
+		goos, openWith, wantName string
+		wantArgs                 []string
+	}{
+		{"linux", "", "xdg-open", []string{"/tmp/out"}},
+		{"darwin", "", "open", []string{"/tmp/out"}},
+		{"windows", "", "cmd", []string{"/c", "start", "", "/tmp/out"}},
+		{"linux", "code", "code", []string{"/tmp/out"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.goos+"/"+tt.openWith, func(t *testing.T) {
+			name, args := openerCommand(tt.goos, tt.openWith, "/tmp/out")
+			if name != tt.wantName || strings.Join(args, "|") != strings.Join(tt.wantArgs, "|") {
+				t.Errorf("openerCommand() = %s %q, want %s %q", name, args, tt.wantName, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestOpenDestinationLaunchFailureIsWarning(t *testing.T) {
+	var stderr bytes.Buffer
+	o := newCopyOptions(&stderr)
+	o.OpenWith = "viewer"
+	var launched []string
+	o.startCommand = func(name string, args ...string) error {
+		launched = append(append(launched, name), args...)
+		return io.ErrUnexpectedEOF
+	}
+
+	o.openDestination("/tmp/out/app.log")
+
+	if strings.Join(launched, " ") != "viewer /tmp/out/app.log" {
+		t.Errorf("launched %q, want viewer /tmp/out/app.log", launched)
+	}
+	assertContains(t, stderr.String(), "Warning: failed to open /tmp/out/app.log with viewer")
+}
+
+func TestCopiedPath(t *testing.T) {
+	tmpDir := mustTempDir(t)
+	if got := copiedPath(tmpDir, "app.log"); got != filepath.Join(tmpDir, "app.log") {
+		t.Errorf("copiedPath(dir) = %s", got)
+	}
+	file := filepath.Join(tmpDir, "renamed.log")
+	if got := copiedPath(file, "app.log"); got != file {
+		t.Errorf("copiedPath(file) = %s", got)
+	}
+}
+
+// fakeExecutor serves canned output for the tar command and answers the env
+// probe successfully. Every command it runs is recorded, and what an upload
+// streams as stdin.
+type fakeExecutor struct {
+	stdout   []byte
+	stderr   string
+	err      error
+	commands [][]string
+	stdin    []byte
+}
+
+func (f *fakeExecutor) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, stderr io.Writer) error {
+	f.commands = append(f.commands, command)
+	if command[len(command)-1] == "true" {
+		return nil
+	}
+	if _, err := stdout.Write(f.stdout); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(stderr, f.stderr); err != nil {
+		return err
+	}
+	return f.err
+}
+
+// ExecuteWithStdin reads all of stdin before it answers, unless it fails.
+func (f *fakeExecutor) ExecuteWithStdin(ctx context.Context, pod *corev1.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if f.err == nil {
+		var err error
+		if f.stdin, err = io.ReadAll(stdin); err != nil {
+			return err
+		}
+	}
+	return f.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func TestOpenOnlyAfterSuccessfulCopy(t *testing.T) {
+	tests := []struct {
+		name       string
+		executor   *fakeExecutor
+		wantLaunch bool
+	}{
+		{"success", &fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": contentStr}).Bytes()}, true},
+		{"failure", &fakeExecutor{stderr: "tar: app.log: Cannot stat: No such file or directory\n", err: io.ErrUnexpectedEOF}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newFakePodCopyOptions(tt.executor)
+			o.Open = true
+			launched := false
+			o.startCommand = func(string, ...string) error {
+				launched = true
+				return nil
+			}
+
+			_ = o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t))
+			if launched != tt.wantLaunch {
+				t.Errorf("launched = %v, want %v", launched, tt.wantLaunch)
+			}
+		})
+	}
+}
+
+func TestCopyFollowSymlinks(t *testing.T) {
+	archive := createTestTar(t, map[string]string{"app/current.log": contentStr}).Bytes()
+	exit := func(code int) error {
+		return utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code %d", code), Code: code}
+	}
+	changed := "tar: app/current.log: file changed as we read it\n"
+
+	tests := []struct {
+		name     string
+		follow   bool
+		executor *fakeExecutor
+		flags    string
+		warnings string
+		err      string
+	}{
+		{"links skipped", false, &fakeExecutor{stdout: archive}, "cf", "", ""},
+		{"links followed", true, &fakeExecutor{stdout: archive}, "chf", "", ""},
+		{
+			"file changed while read", true, &fakeExecutor{stdout: archive, stderr: changed, err: exit(1)}, "chf",
+			"Warning: tar: app/current.log: file changed as we read it; its copy may be inconsistent\n", "",
+		},
+		{
+			"file changed without following links", false, &fakeExecutor{stdout: archive, stderr: changed, err: exit(1)}, "cf",
+			"Warning: tar: app/current.log: file changed as we read it; its copy may be inconsistent\n", "",
+		},
+		{
+			"file changed and tar failed", true, &fakeExecutor{stdout: archive, stderr: changed + "tar: Exiting with failure status due to previous errors\n", err: exit(2)}, "chf",
+			"", "pod default/pod: tar: app/current.log: file changed as we read it\ntar: Exiting with failure status due to previous errors",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newFakePodCopyOptions(tt.executor)
+			var errOut bytes.Buffer
+			o.IOStreams.ErrOut = &errOut
+			o.Container, o.FollowSymlinks = "app", tt.follow
+			dest := mustTempDir(t)
+			err := o.RunWithArgs(context.Background(), "pod:/var/log/app", dest)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("RunWithArgs() = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"env", "LC_ALL=C", "LANG=C", "tar", tt.flags, "-", "-C", "/var/log", "--", "app"}
+			if got := tt.executor.commands[len(tt.executor.commands)-1]; !slices.Equal(got, want) {
+				t.Errorf("command = %q, want %q", got, want)
+			}
+			if errOut.String() != tt.warnings {
+				t.Errorf("warnings = %q, want %q", errOut.String(), tt.warnings)
+			}
+			assertFileContent(t, filepath.Join(dest, "app", "current.log"), contentStr)
+		})
+	}
+}
+
+func TestResolveContainer(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers:          []corev1.Container{{Name: "app"}, {Name: "sidecar"}},
+			InitContainers:      []corev1.Container{{Name: "migrate"}},
+			EphemeralContainers: []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}}},
+		},
+	}
+	for _, name := range []string{"sidecar", "migrate", "debugger"} {
+		o := &CopyOptions{Container: name}
+		if got, err := o.resolveContainer(pod); err != nil || got != name {
+			t.Errorf("resolveContainer(%s) = %q, %v", name, got, err)
+		}
+	}
+	o := &CopyOptions{Container: "debuger"}
+	_, err := o.resolveContainer(pod)
+	if err == nil || err.Error() != `container "debuger" not found in pod default/pod, available: app, sidecar, migrate, debugger` {
+		t.Errorf("err = %v, want the available containers", err)
+	}
+}
+
+func TestCopyFromEphemeralContainerWithoutTar(t *testing.T) {
+	executor := &fakeExecutor{stderr: `exec: "tar": executable file not found in $PATH`, err: io.ErrUnexpectedEOF}
+	o := newFakePodCopyOptions(executor)
+	pod, _ := o.Clientset.CoreV1().Pods("default").Get(context.Background(), "pod", metav1.GetOptions{})
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}}}
+	o.Clientset = fake.NewSimpleClientset(pod)
+	o.Container = "debugger"
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t))
+	if err == nil || err.Error() != "pod default/pod: tar binary not found in container debugger" {
+		t.Fatalf("err = %v, want tar missing in the ephemeral container", err)
+	}
+}
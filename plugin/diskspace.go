@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// freeSpace returns the bytes available to the process on the filesystem of
+// path, and false where that can't be told. Swapped in tests.
+var freeSpace = availableBytes
+
+// diskHeadroom is the share of the estimated size of a copy the destination
+// needs free on top of it, for the filesystem overhead of its files and the
+// error of the estimate.
+const diskHeadroom = 0.05
+
+// preflight estimates with du the size of remotePaths in container of pod
+// before a copy of them starts, the total of its progress, and warns when it
+// is over the output cap of the session. Extracted into dest, unless that is empty, the copy is refused,
+// or only warned about with --force, when the filesystem of dest lacks the
+// space for it, rather than failing part way with ENOSPC. Without du in the
+// container nothing is checked.
+func (o *CopyOptions) preflight(ctx context.Context, pod *corev1.Pod, container, dest string, remotePaths ...string) error {
+	o.estimatedSize = 0
+	c := notices.current()
+	capped := c != nil && c.OutputCapBytes > 0
+	if dest == "" && !capped && !o.reportingProgress() {
+		return nil
+	}
+	remotePath := strings.Join(remotePaths, ", ")
+	size, ok := o.remoteDiskUsage(ctx, pod, container, remotePaths)
+	if !ok {
+		return nil
+	}
+	o.estimatedSize = size
+	o.warnOverOutputCap(remotePath, size)
+	if dest == "" {
+		return nil
+	}
+	dir := existingAncestor(dest)
+	available, ok := freeSpace(dir)
+	if !ok {
+		return nil
+	}
+	needed := size + int64(float64(size)*diskHeadroom)
+	if needed <= available {
+		return nil
+	}
+	if o.Force {
+		newOutput(o.IOStreams.ErrOut).printf("Warning: %s is about %s, more than the %s available on %s, the copy may run out of space\n",
+			remotePath, formatBytes(size), formatBytes(available), dir)
+		return nil
+	}
+	return fmt.Errorf("not enough space for the copy: %s is about %s, %s has %s available; free some space, copy less of it, or pass --force to copy anyway",
+		remotePath, formatBytes(size), dir, formatBytes(available))
+}
+
+// remoteDiskUsage is the size du gives remotePaths in container of pod,
+// summed, and false when it could not be told, such as without du.
+func (o *CopyOptions) remoteDiskUsage(ctx context.Context, pod *corev1.Pod, container string, remotePaths []string) (int64, bool) {
+	du := []string{"du", "-s", "-k", "--"}
+	if o.FollowSymlinks {
+		du = []string{"du", "-s", "-k", "-L", "--"}
+	}
+	remotePath := strings.Join(remotePaths, ", ")
+	command, err := o.remoteCommand(ctx, pod, container, append(du, remotePaths...))
+	if err != nil {
+		return 0, false
+	}
+	var stdout, stderr bytes.Buffer
+	if err := o.execute(ctx, pod, container, command, &stdout, &stderr); err != nil {
+		klog.V(2).Infof("estimating the size of %s failed: %v: %s", remotePath, err, stderr.String())
+		return 0, false
+	}
+	// a line per path
+	var kib int64
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			klog.V(2).Infof("unexpected du output for %s: %q", remotePath, stdout.String())
+			return 0, false
+		}
+		kib += n
+	}
+	return kib * 1024, true
+}
+
+// existingAncestor returns path, or its closest parent that exists, which the
+// copy creates it in.
+func existingAncestor(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package plugin
+
+// availableBytes can't tell the space available here, the copy is not
+// checked.
+func availableBytes(string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errNoDu is how a container without du answers it.
+var errNoDu = errors.New("command terminated with exit code 127")
+
+// isDiskUsage reports whether command is the du of the preflight.
+func isDiskUsage(command []string) bool {
+	return len(command) > 3 && command[3] == "du"
+}
+
+// duContainer answers du with duOutput, or fails it without one, and serves
+// tar otherwise.
+type duContainer struct {
+	fakeExecutor
+	duOutput string
+}
+
+func (d *duContainer) Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	if isDiskUsage(command) {
+		d.commands = append(d.commands, command)
+		if d.duOutput == "" {
+			_, _ = io.WriteString(stderr, "sh: du: not found\n")
+			return errNoDu
+		}
+		_, err := io.WriteString(stdout, d.duOutput)
+		return err
+	}
+	return d.fakeExecutor.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func TestCopyChecksDiskSpace(t *testing.T) {
+	tests := []struct {
+		name      string
+		duOutput  string
+		available int64
+		known     bool
+		force     bool
+		wantErr   string
+		wantWarn  string
+	}{
+		{name: "enough space", duOutput: "2048\t/var/log/app\n", available: 4 << 20, known: true},
+		{
+			name: "not enough space", duOutput: "2048\t/var/log/app\n", available: 2 << 20, known: true,
+			wantErr: "not enough space for the copy: /var/log/app is about 2.0 MiB, ",
+		},
+		{
+			name: "forced", duOutput: "2048\t/var/log/app\n", available: 1 << 20, known: true, force: true,
+			wantWarn: "Warning: /var/log/app is about 2.0 MiB, more than the 1.0 MiB available on ",
+		},
+		{name: "without du", available: 1 << 20, known: true},
+		{name: "unknown space", duOutput: "2048\t/var/log/app\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked := ""
+			saved := freeSpace
+			freeSpace = func(path string) (int64, bool) {
+				checked = path
+				return tt.available, tt.known
+			}
+			t.Cleanup(func() { freeSpace = saved })
+			pod := &duContainer{
+				fakeExecutor: fakeExecutor{stdout: createTestTar(t, map[string]string{"app/current.log": "app\n"}).Bytes()},
+				duOutput:     tt.duOutput,
+			}
+			o := newFakePodCopyOptions(pod)
+			o.Container = "app"
+			o.Force = tt.force
+			var stderr bytes.Buffer
+			o.IOStreams.Out, o.IOStreams.ErrOut = io.Discard, &stderr
+			root := mustTempDir(t)
+			dest := filepath.Join(root, "app")
+
+			err := o.RunWithArgs(context.Background(), "pod:/var/log/app", dest)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Fatalf("RunWithArgs() error = %v, want %q", err, tt.wantErr)
+			}
+			if checked != "" && checked != root {
+				t.Errorf("checked the space of %s, want %s, the closest directory that exists", checked, root)
+			}
+			if tt.wantWarn != "" && !strings.Contains(stderr.String(), tt.wantWarn) {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.wantWarn)
+			}
+			if tt.wantErr != "" {
+				if _, err := os.Stat(dest); !os.IsNotExist(err) {
+					t.Errorf("the refused copy created %s", dest)
+				}
+				return
+			}
+			assertFileContent(t, filepath.Join(dest, "current.log"), "app\n")
+		})
+	}
+}
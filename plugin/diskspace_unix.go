@@ -0,0 +1,15 @@
+//go:build unix
+
+package plugin
+
+import "golang.org/x/sys/unix"
+
+// availableBytes returns the bytes available to the process on the
+// filesystem of path, from statfs.
+func availableBytes(path string) (int64, bool) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
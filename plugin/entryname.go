@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// hostBackslashSeparator is set where filepath treats a backslash as a
+// separator, swapped in tests to check both path semantics.
+var hostBackslashSeparator = filepath.Separator == '\\'
+
+const (
+	errWindowsAbsPath = "illegal file path in tar: %s (drive letter or UNC prefix)"
+)
+
+// cleanEntryName cleans the name of a tar entry with backslashes taken as
+// separators, whatever the host, and rejects names that are absolute or
+// climb out of the destination under either convention: ..\evil and a/..\..\b
+// as much as ../evil, C:\x, C:x and \\server\share as much as /x. The name
+// returned uses forward slashes only.
+func cleanEntryName(name string) (string, error) {
+	slashed := strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(slashed, "//") || hasDriveLetter(slashed) {
+		return "", fmt.Errorf(errWindowsAbsPath, name)
+	}
+	cleanName := path.Clean(slashed)
+	if cleanName == ".." || strings.HasPrefix(cleanName, "../") || path.IsAbs(cleanName) {
+		return "", fmt.Errorf(errPathTraversal, name)
+	}
+	return cleanName, nil
+}
+
+// hasDriveLetter reports whether name starts with a Windows drive, such as C:
+// or c:/.
+func hasDriveLetter(name string) bool {
+	if len(name) < 2 || name[1] != ':' {
+		return false
+	}
+	c := name[0]
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// entryName returns the cleaned name a tar entry is extracted as, and false
+// for an entry to skip. Where a backslash is not a separator, an entry whose
+// name contains one is skipped with a warning, as systemd unit names like
+// dev-disk-by\x2dlabel.device are, unless TransliterateBackslashes is set,
+// which extracts the backslashes as separators with a warning instead.
+func (o *CopyOptions) entryName(name string) (string, bool, error) {
+	cleanName, err := cleanEntryName(name)
+	if err != nil {
+		return "", false, err
+	}
+	if !hostBackslashSeparator && strings.Contains(name, `\`) {
+		if !o.TransliterateBackslashes {
+			o.warnings.warn(warnBackslash, "skipping %s, its name contains backslashes; pass --transliterate-backslashes to extract them as directory separators", name)
+			return "", false, nil
+		}
+		o.warnings.warn(warnBackslash, "extracting %s as %s, its backslashes taken as separators", name, cleanName)
+	}
+	return cleanName, true, nil
+}
@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withBackslashSeparator makes the test run with the path semantics of a host
+// where a backslash is a separator, or is not.
+func withBackslashSeparator(t *testing.T, separator bool) {
+	t.Helper()
+	old := hostBackslashSeparator
+	t.Cleanup(func() { hostBackslashSeparator = old })
+	hostBackslashSeparator = separator
+}
+
+func TestEntryNameMixedSeparators(t *testing.T) {
+	tests := []struct {
+		name string
+		// want is the cleaned name, empty when the entry is refused with an
+		// error containing wantErr.
+		want    string
+		wantErr string
+	}{
+		{name: "log/app.log", want: "log/app.log"},
+		{name: `..\..\evil.txt`, wantErr: "path traversal"},
+		{name: `log\..\..\evil.txt`, wantErr: "path traversal"},
+		{name: `log/..\../evil.txt`, wantErr: "path traversal"},
+		{name: `log\../..\evil.txt`, wantErr: "path traversal"},
+		{name: `..\`, wantErr: "path traversal"},
+		{name: `\evil.txt`, wantErr: "path traversal"},
+		{name: `C:\Windows\evil.dll`, wantErr: "drive letter"},
+		{name: `c:/Windows/evil.dll`, wantErr: "drive letter"},
+		{name: `C:evil.txt`, wantErr: "drive letter"},
+		{name: `\\server\share\evil.txt`, wantErr: "UNC"},
+		{name: `\\?\C:\evil.txt`, wantErr: "UNC"},
+		{name: `/\server\share`, wantErr: "UNC"},
+		{name: `log\app.log`, want: "log/app.log"},
+		{name: `log\.\nested\..\app.log`, want: "log/app.log"},
+	}
+	for _, semantics := range []struct {
+		name      string
+		separator bool
+	}{{"linux", false}, {"windows", true}} {
+		t.Run(semantics.name, func(t *testing.T) {
+			withBackslashSeparator(t, semantics.separator)
+			for _, tt := range tests {
+				var stderr bytes.Buffer
+				o := newCopyOptions(&stderr)
+				o.warnings = newCopyWarnings(&stderr, false)
+				o.TransliterateBackslashes = true
+				got, ok, err := o.entryName(tt.name)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("entryName(%q) = %q, %v, want an error containing %q", tt.name, got, err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil || !ok || got != tt.want {
+					t.Errorf("entryName(%q) = %q, %v, %v, want %q", tt.name, got, ok, err, tt.want)
+				}
+				// only a host without backslash separators renames the entry
+				warned := strings.Contains(stderr.String(), "taken as separators")
+				if wantWarning := !semantics.separator && strings.Contains(tt.name, `\`); warned != wantWarning {
+					t.Errorf("entryName(%q) warned %v, want %v: %s", tt.name, warned, wantWarning, stderr.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEntryNameSkipsBackslashesWithoutTransliterate(t *testing.T) {
+	withBackslashSeparator(t, false)
+	var stderr bytes.Buffer
+	o := newCopyOptions(&stderr)
+	o.warnings = newCopyWarnings(&stderr, false)
+	if got, ok, err := o.entryName(`log\app.log`); err != nil || ok {
+		t.Fatalf("entryName = %q, %v, %v, want the entry skipped", got, ok, err)
+	}
+	assertContains(t, stderr.String(), `skipping log\app.log, its name contains backslashes; pass --transliterate-backslashes`)
+	// traversal is still an error rather than a skipped entry
+	if _, _, err := o.entryName(`..\evil.txt`); err == nil || !strings.Contains(err.Error(), "path traversal") {
+		t.Fatalf("error = %v, want a path traversal error", err)
+	}
+
+	withBackslashSeparator(t, true)
+	if got, ok, err := o.entryName(`log\app.log`); err != nil || !ok || got != "log/app.log" {
+		t.Fatalf("entryName = %q, %v, %v, want log/app.log where backslashes are separators", got, ok, err)
+	}
+}
+
+func TestExtractTarBackslashNames(t *testing.T) {
+	withBackslashSeparator(t, false)
+
+	t.Run("traversal", func(t *testing.T) {
+		tmpDir := mustTempDir(t)
+		dest := filepath.Join(tmpDir, "dest")
+		if err := os.Mkdir(dest, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		opts := newDefaultCopyOptions()
+		opts.TransliterateBackslashes = true
+		_, err := opts.extractTar(context.Background(), createTestTar(t, map[string]string{`..\..\evil.txt`: "bad\n"}), dest, "")
+		if err == nil || !strings.Contains(err.Error(), traversalErrorMsg) {
+			t.Fatalf("error = %v, want a path traversal error", err)
+		}
+		assertFileDoesNotExist(t, filepath.Join(tmpDir, "evil.txt"))
+		assertFileDoesNotExist(t, filepath.Join(dest, `..\..\evil.txt`))
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		dest := mustTempDir(t)
+		var stderr bytes.Buffer
+		opts := newCopyOptions(&stderr)
+		archive := createTestTar(t, map[string]string{
+			`system/dev-disk-by\x2dlabel-data.device`: "[Unit]\n",
+			"system/app.service":                      "[Service]\n",
+		})
+		if _, err := opts.extractTar(context.Background(), archive, dest, ""); err != nil {
+			t.Fatal(err)
+		}
+		assertFileContent(t, filepath.Join(dest, "system", "app.service"), "[Service]\n")
+		assertFileDoesNotExist(t, filepath.Join(dest, "system", `dev-disk-by\x2dlabel-data.device`))
+		assertContains(t, stderr.String(), `skipping system/dev-disk-by\x2dlabel-data.device`)
+		assertContains(t, stderr.String(), "Warnings: 1 names with backslashes")
+	})
+
+	t.Run("transliterated", func(t *testing.T) {
+		dest := mustTempDir(t)
+		var stderr bytes.Buffer
+		opts := newCopyOptions(&stderr)
+		opts.TransliterateBackslashes = true
+		if _, err := opts.extractTar(context.Background(), createTestTar(t, map[string]string{`logs\app\current.log`: "ok\n"}), dest, ""); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dest, "logs", "app", "current.log"))
+		if err != nil || string(data) != "ok\n" {
+			t.Fatalf("logs/app/current.log = %q, %v", data, err)
+		}
+		assertContains(t, stderr.String(), `extracting logs\app\current.log as logs/app/current.log`)
+	})
+}
+
+// FuzzCleanEntryName checks that no name cleanEntryName accepts can leave the
+// destination under either path convention.
+func FuzzCleanEntryName(f *testing.F) {
+	for _, seed := range []string{
+		"a", "a/b", `a\b`, "..", `..\`, "../a", `..\a`, `a\..\..\b`, `a/..\..\b`, "/a", `\a`,
+		`C:\a`, "c:a", `\\srv\share`, `//srv/share`, `\\?\C:\a`, `.\..\a`, "a/./../b", `a\\..\\..\\b`, "",
+	} {
+		f.Add(seed)
+	}
+	base := f.TempDir()
+	f.Fuzz(func(t *testing.T, name string) {
+		cleanName, err := cleanEntryName(name)
+		if err != nil {
+			return
+		}
+		if strings.Contains(cleanName, `\`) || path.IsAbs(cleanName) || hasDriveLetter(cleanName) ||
+			cleanName == ".." || strings.HasPrefix(cleanName, "../") || strings.Contains(cleanName, "/../") {
+			t.Fatalf("cleanEntryName(%q) accepted %q", name, cleanName)
+		}
+		target, err := computeSafeTarget(name, base, base, "", true)
+		if err != nil {
+			t.Fatalf("computeSafeTarget(%q) refused what cleanEntryName accepted: %v", name, err)
+		}
+		if rel, err := filepath.Rel(base, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("computeSafeTarget(%q) = %s, outside %s", name, target, base)
+		}
+	})
+}
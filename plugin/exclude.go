@@ -0,0 +1,73 @@
+package plugin
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// validateExcludes checks the patterns of --exclude: they must be valid and
+// can't reach out of the copied path.
+func validateExcludes(patterns []string) error {
+	for _, p := range patterns {
+		if p == "" {
+			return fmt.Errorf("--exclude pattern can't be empty")
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid --exclude pattern %q: %v", p, err)
+		}
+		for _, part := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+			if part == ".." {
+				return fmt.Errorf("--exclude pattern %q contains a path traversal", p)
+			}
+		}
+	}
+	return nil
+}
+
+// tarExcludeArgs are the options of the tar of a copy leaving the entries
+// matching --exclude out.
+func (o *CopyOptions) tarExcludeArgs() []string {
+	args := make([]string, len(o.Exclude))
+	for i, p := range o.Exclude {
+		args[i] = "--exclude=" + p
+	}
+	return args
+}
+
+// tarCreateCommand is the tar writing the archive of the members of dir.
+func (o *CopyOptions) tarCreateCommand(dir string, members []string) []string {
+	command := append([]string{"tar", o.tarCreateFlags(), "-", "-C", dir}, o.tarXattrArgs()...)
+	command = append(command, o.tarExcludeArgs()...)
+	return append(append(command, "--"), members...)
+}
+
+// excluded reports whether the entry called name matches --exclude, for tars
+// that ignored the option. Like GNU tar, a pattern matches any run of whole
+// components of the name, so an excluded directory excludes all it holds.
+func (o *CopyOptions) excluded(name string) bool {
+	if len(o.Exclude) == 0 {
+		return false
+	}
+	parts := strings.Split(path.Clean(name), "/")
+	for i := range parts {
+		for j := i + 1; j <= len(parts); j++ {
+			run := strings.Join(parts[i:j], "/")
+			for _, p := range o.Exclude {
+				if ok, _ := path.Match(p, run); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// excludedSummary is what the summary of a copy says of the entries its
+// filter left out, after the transfer.
+func (o *CopyOptions) excludedSummary() string {
+	if o.excludedEntries == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %d entries matching --exclude left out", o.excludedEntries)
+}
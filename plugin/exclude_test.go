@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateExcludes(t *testing.T) {
+	for _, tt := range []struct {
+		patterns []string
+		wantErr  string
+	}{
+		{[]string{"*.gz", "old", "app/*.log.[0-9]"}, ""},
+		{[]string{"..data"}, ""},
+		{[]string{""}, "can't be empty"},
+		{[]string{"../etc/*"}, `--exclude pattern "../etc/*" contains a path traversal`},
+		{[]string{"log/../../x"}, "contains a path traversal"},
+		{[]string{`..\x`}, "contains a path traversal"},
+		{[]string{"[a-"}, "invalid --exclude pattern"},
+	} {
+		err := validateExcludes(tt.patterns)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("validateExcludes(%q) = %v, want %q", tt.patterns, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	o := &CopyOptions{Exclude: []string{"*.gz", "old", "app/tmp"}}
+	for name, want := range map[string]bool{
+		"log/app.log":           false,
+		"log/app.log.1.gz":      true,
+		"log/old":               true,
+		"log/old/app.log":       true,
+		"log/older/app.log":     false,
+		"log/app/tmp/x":         true,
+		"log/app/tmpfile":       false,
+		"./log/nested/a.gz":     true,
+		"log/gz":                false,
+		"log/archive.gz/inside": true,
+	} {
+		if got := o.excluded(name); got != want {
+			t.Errorf("excluded(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if (&CopyOptions{}).excluded("log/a.gz") {
+		t.Error("nothing is excluded without --exclude")
+	}
+}
+
+func TestCopyExclude(t *testing.T) {
+	// the tar of the container ignored --exclude, like one without it
+	executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{
+		"log/app.log":        "app\n",
+		"log/app.log.1.gz":   "rotated",
+		"log/old/gc.log":     "gc\n",
+		"log/nginx/error.gz": "rotated",
+	}).Bytes()}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	o.Exclude = []string{"*.gz", "old"}
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	dest := filepath.Join(mustTempDir(t), "log")
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log", dest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"env", "LC_ALL=C", "LANG=C", "tar", "cf", "-", "-C", "/var", "--exclude=*.gz", "--exclude=old", "--", "log"}
+	if got := executor.commands[len(executor.commands)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+	assertFileContent(t, filepath.Join(dest, "app.log"), "app\n")
+	for _, gone := range []string{"app.log.1.gz", "old", "nginx/error.gz"} {
+		if _, err := os.Stat(filepath.Join(dest, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s extracted: %v", gone, err)
+		}
+	}
+	if !strings.Contains(out.String(), ", 3 entries matching --exclude left out\n") {
+		t.Errorf("summary = %q, want the excluded entries counted", out.String())
+	}
+}
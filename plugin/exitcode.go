@@ -0,0 +1,35 @@
+package plugin
+
+import (
+	"errors"
+
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// runtimeExecFailures mark the error of a command the container runtime could
+// not start, as opposed to the plain "command terminated with exit code 127" of
+// a command that ran.
+var runtimeExecFailures = []string{"OCI runtime exec failed", "executable file not found", "no such file or directory", "permission denied"}
+
+// remoteExitCode returns the code rexec exec exits with when err is the
+// non-zero exit of the remote command, like kubectl exec does, so scripts can
+// branch on it. A command terminated by a signal exits with 128 plus the
+// signal, as a shell reports it, which is how container runtimes report the
+// exec. message is set for 126 and 127, not executable and not found, when
+// the runtime rather than the command reported them, which then printed
+// nothing itself.
+func remoteExitCode(err error) (code int, message string, ok bool) {
+	var exitErr utilexec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, "", false
+	}
+	code = exitErr.ExitStatus()
+	if code <= 0 {
+		// not an exit status, left to the generic error handling
+		return 0, "", false
+	}
+	if (code == 126 || code == 127) && containsAny(err.Error(), runtimeExecFailures) {
+		message = err.Error()
+	}
+	return code, message, true
+}
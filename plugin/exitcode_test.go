@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestRemoteExitCode(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    int
+		wantMessage string
+		wantOK      bool
+	}{
+		{name: "no error"},
+		{name: "not an exit", err: errors.New("error dialing backend: EOF")},
+		{
+			name:     "non-zero exit",
+			err:      utilexec.CodeExitError{Err: errors.New("command terminated with exit code 1"), Code: 1},
+			wantCode: 1, wantOK: true,
+		},
+		{
+			name:     "exit code of the command",
+			err:      utilexec.CodeExitError{Err: errors.New("command terminated with exit code 42"), Code: 42},
+			wantCode: 42, wantOK: true,
+		},
+		{
+			name:     "wrapped",
+			err:      fmt.Errorf("exec failed: %w", utilexec.CodeExitError{Err: errors.New("command terminated with exit code 3"), Code: 3}),
+			wantCode: 3, wantOK: true,
+		},
+		{
+			name:     "killed, as the runtime reports it",
+			err:      utilexec.CodeExitError{Err: errors.New("command terminated with exit code 137"), Code: 137},
+			wantCode: 137, wantOK: true,
+		},
+		{
+			name:     "terminated by SIGTERM",
+			err:      utilexec.CodeExitError{Err: errors.New("command terminated with exit code 143"), Code: 143},
+			wantCode: 143, wantOK: true,
+		},
+		{
+			name:     "not found by the shell",
+			err:      utilexec.CodeExitError{Err: errors.New("command terminated with exit code 127"), Code: 127},
+			wantCode: 127, wantOK: true,
+		},
+		{
+			name: "not found by the runtime",
+			err: utilexec.CodeExitError{
+				Err:  errors.New(`OCI runtime exec failed: exec failed: unable to start container process: exec: "nope": executable file not found in $PATH: unknown`),
+				Code: 127,
+			},
+			wantCode: 127, wantOK: true,
+			wantMessage: `OCI runtime exec failed: exec failed: unable to start container process: exec: "nope": executable file not found in $PATH: unknown`,
+		},
+		{
+			name: "not executable",
+			err: utilexec.CodeExitError{
+				Err:  errors.New(`OCI runtime exec failed: exec failed: unable to start container process: exec: "/data/run.sh": permission denied: unknown`),
+				Code: 126,
+			},
+			wantCode: 126, wantOK: true,
+			wantMessage: `OCI runtime exec failed: exec failed: unable to start container process: exec: "/data/run.sh": permission denied: unknown`,
+		},
+		{
+			name: "no exit status",
+			err:  utilexec.CodeExitError{Err: errors.New("command terminated"), Code: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, message, ok := remoteExitCode(tt.err)
+			if code != tt.wantCode || message != tt.wantMessage || ok != tt.wantOK {
+				t.Errorf("remoteExitCode() = %d, %q, %v, want %d, %q, %v", code, message, ok, tt.wantCode, tt.wantMessage, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// unusualNames are names a shell or a line based parser would get wrong.
+var unusualNames = []string{"my file (1).log", `a"b.txt`, "new\nline.log", "it's $HOME.txt"}
+
+func TestCopyUnusualNames(t *testing.T) {
+	files := map[string]string{}
+	for _, name := range unusualNames {
+		files["logs/"+name] = name
+	}
+	executor := &fakeExecutor{stdout: createTestTar(t, files).Bytes()}
+	o := newFakePodCopyOptions(executor)
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/logs", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	for _, name := range unusualNames {
+		assertFileContent(t, filepath.Join(dest, "logs", name), name)
+	}
+}
+
+func TestCopyUnusualNameToNewName(t *testing.T) {
+	for _, name := range unusualNames {
+		t.Run(name, func(t *testing.T) {
+			executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{name: contentStr, name + ".1": "rotated"}).Bytes()}
+			o := newFakePodCopyOptions(executor)
+			dest := filepath.Join(mustTempDir(t), "renamed.log")
+
+			err := o.RunWithArgs(context.Background(), "pod:/var/log/"+name, dest)
+			if err == nil {
+				t.Fatal("an entry outside the copied file was extracted")
+			}
+			assertContains(t, err.Error(), traversalErrorMsg)
+
+			executor.stdout = createTestTar(t, map[string]string{name: contentStr}).Bytes()
+			if err := o.RunWithArgs(context.Background(), "pod:/var/log/"+name, dest); err != nil {
+				t.Fatalf("RunWithArgs() error = %v", err)
+			}
+			assertFileContent(t, dest, contentStr)
+			command := executor.commands[len(executor.commands)-1]
+			if !slices.Equal(command[len(command)-2:], []string{"--", name}) {
+				t.Errorf("command = %q, want the name as a single argument", command)
+			}
+		})
+	}
+}
+
+func TestDigestLine(t *testing.T) {
+	tests := []struct {
+		local string
+		want  string
+	}{
+		{"logs/my file (1).log", "abc  logs/my file (1).log"},
+		{`logs/a"b.txt`, `abc  logs/a"b.txt`},
+		{"logs/new\nline.log", `\abc  logs/new\nline.log`},
+		{`logs/back\slash`, `\abc  logs/back\\slash`},
+	}
+	for _, tt := range tests {
+		if got := digestLine(fileDigest{local: tt.local, digest: "abc"}); got != tt.want {
+			t.Errorf("digestLine(%q) = %q, want %q", tt.local, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// remoteGlobScript prints the paths of the container matching the pattern $1,
+// each followed by a NUL, and nothing when none does. With IFS empty $1 is
+// only expanded as a pattern, never split or run, so it needs no quoting.
+const remoteGlobScript = `IFS=; for f in $1; do if [ -e "$f" ] || [ -L "$f" ]; then printf '%s\0' "$f"; fi; done`
+
+// isRemoteGlob reports whether the remote path p is a pattern to expand.
+func isRemoteGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// expandRemoteGlobs replaces the sources whose path is a pattern by a source
+// per path of the pod it matches. Local sources, and those of --selector, are
+// left as they are.
+func (o *CopyOptions) expandRemoteGlobs(ctx context.Context, srcs []string) ([]string, error) {
+	expanded := make([]string, 0, len(srcs))
+	for _, src := range srcs {
+		spec, err := parseFileSpec(src, o.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if spec.PodName == "" || !isRemoteGlob(spec.File) {
+			expanded = append(expanded, src)
+			continue
+		}
+		matches, err := o.remoteGlob(ctx, spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			expanded = append(expanded, spec.PodNamespace+"/"+spec.PodName+":"+m)
+		}
+	}
+	return expanded, nil
+}
+
+// remoteGlob expands the pattern of src with the shell of its container, in
+// an audited exec of its own. A container without sh gets the pattern back as
+// a literal path, with a warning.
+func (o *CopyOptions) remoteGlob(ctx context.Context, src *fileSpec) ([]string, error) {
+	pod, containerName, err := o.validateAndGetPodContainer(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	command, err := o.remoteCommand(ctx, pod, containerName, []string{"sh", "-c", remoteGlobScript, "sh", src.File})
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	if err := o.execute(ctx, pod, containerName, command, &stdout, &stderr); err != nil {
+		var cancelled copyCancelledError
+		if errors.As(err, &cancelled) {
+			return nil, err
+		}
+		if !shellMissing(err, stderr.String()) {
+			return nil, o.handleExecError(err, stderr.String(), src, containerName)
+		}
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: pod %s/%s has no /bin/sh to expand %s, copying it as a literal path\n", pod.Namespace, pod.Name, src.File)
+		return []string{src.File}, nil
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("pod %s/%s: no files match %s", pod.Namespace, pod.Name, src.File)
+	}
+	return strings.Split(strings.TrimSuffix(stdout.String(), "\x00"), "\x00"), nil
+}
+
+// shellMissing reports whether the exec of sh failed because there is none.
+// The script only runs builtins, so its exit status 127, command not found,
+// is sh itself missing too, as env reports it.
+func shellMissing(execErr error, stderr string) bool {
+	var exitErr utilexec.ExitError
+	return binaryMissing(execErr, stderr) || errors.As(execErr, &exitErr) && exitErr.ExitStatus() == 127
+}
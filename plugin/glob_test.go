@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// fakeGlobContainer answers the glob script with matches, NUL separated, and
+// any other command like tar. With shErr set, the script fails with it and
+// writes shStderr.
+type fakeGlobContainer struct {
+	fakeExecutor
+	matches  []string
+	shErr    error
+	shStderr string
+}
+
+func (f *fakeGlobContainer) Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	for i, arg := range command {
+		if arg != "sh" || i+2 >= len(command) || command[i+2] != remoteGlobScript {
+			continue
+		}
+		f.commands = append(f.commands, command)
+		if f.shErr != nil {
+			_, _ = io.WriteString(stderr, f.shStderr)
+			return f.shErr
+		}
+		for _, m := range f.matches {
+			_, _ = io.WriteString(stdout, m+"\x00")
+		}
+		return nil
+	}
+	return f.fakeExecutor.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func TestCopyRemoteGlob(t *testing.T) {
+	executor := &fakeGlobContainer{
+		fakeExecutor: fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": "app\n", "gc 1.log": "gc\n"}).Bytes()},
+		matches:      []string{"/var/log/app.log", "/var/log/gc 1.log"},
+	}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	dest := mustTempDir(t)
+
+	if err := o.RunWithSources(context.Background(), []string{"pod:/var/log/*.log"}, dest); err != nil {
+		t.Fatal(err)
+	}
+	glob := []string{"env", "LC_ALL=C", "LANG=C", "sh", "-c", remoteGlobScript, "sh", "/var/log/*.log"}
+	du := []string{"env", "LC_ALL=C", "LANG=C", "du", "-s", "-k", "--", "/var/log/app.log", "/var/log/gc 1.log"}
+	tar := []string{"env", "LC_ALL=C", "LANG=C", "tar", "cf", "-", "-C", "/var/log", "--", "app.log", "gc 1.log"}
+	if got := executor.commands[1:]; !reflect.DeepEqual(got, [][]string{glob, du, tar}) {
+		t.Fatalf("commands = %q, want the glob, the size of its matches and then their tar", got)
+	}
+	assertFileContent(t, filepath.Join(dest, "app.log"), "app\n")
+	assertFileContent(t, filepath.Join(dest, "gc 1.log"), "gc\n")
+}
+
+func TestCopyRemoteGlobSingleMatch(t *testing.T) {
+	executor := &fakeGlobContainer{
+		fakeExecutor: fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": "app\n"}).Bytes()},
+		matches:      []string{"/var/log/app.log"},
+	}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	o.IOStreams.Out = io.Discard
+	dest := filepath.Join(mustTempDir(t), "renamed.log")
+
+	if err := o.RunWithSources(context.Background(), []string{"pod:/var/log/app.[l]og"}, dest); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, dest, "app\n")
+}
+
+func TestCopyRemoteGlobNoMatch(t *testing.T) {
+	executor := &fakeGlobContainer{}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+
+	err := o.RunWithSources(context.Background(), []string{"pod:/var/log/*.gz"}, mustTempDir(t))
+	if err == nil || err.Error() != "pod default/pod: no files match /var/log/*.gz" {
+		t.Fatalf("err = %v, want no files match", err)
+	}
+	if len(executor.commands) != 2 {
+		t.Fatalf("ran %q, want no tar", executor.commands)
+	}
+}
+
+func TestCopyRemoteGlobWithoutShell(t *testing.T) {
+	executor := &fakeGlobContainer{
+		fakeExecutor: fakeExecutor{stdout: createTestTar(t, map[string]string{"[weird].log": "literal\n"}).Bytes()},
+		// as env reports it
+		shErr:    exitCodeError(127),
+		shStderr: "env: 'sh': No such file or directory\n",
+	}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	var errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = io.Discard, &errOut
+	dest := mustTempDir(t)
+
+	if err := o.RunWithSources(context.Background(), []string{"pod:/var/log/[weird].log"}, dest); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(errOut.String(), "Warning: pod default/pod has no /bin/sh to expand /var/log/[weird].log, copying it as a literal path") {
+		t.Errorf("stderr = %q, want the warning", errOut.String())
+	}
+	if got := executor.commands[len(executor.commands)-1]; got[len(got)-1] != "[weird].log" {
+		t.Errorf("tar = %q, want the literal path", got)
+	}
+	assertFileContent(t, filepath.Join(dest, "[weird].log"), "literal\n")
+}
+
+func TestCopyRemoteGlobFailure(t *testing.T) {
+	executor := &fakeGlobContainer{shErr: exitCodeError(2), shStderr: "sh: 1: Syntax error: end of file unexpected\n"}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+
+	err := o.RunWithSources(context.Background(), []string{"pod:/var/log/*.log"}, mustTempDir(t))
+	if err == nil || err.Error() != "pod default/pod: sh: 1: Syntax error: end of file unexpected" {
+		t.Fatalf("err = %v, want the failure of sh", err)
+	}
+}
+
+func exitCodeError(code int) error {
+	return utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code %d", code), Code: code}
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// hardLinkTarget returns where the target of the hard link header is
+// extracted, checked like the names of the entries are: it must stay within
+// the destination.
+func (o *CopyOptions) hardLinkTarget(header *tar.Header, destPath, baseAbs, srcBase string, destIsDir bool) (string, error) {
+	name, err := cleanEntryName(header.Linkname)
+	if err != nil {
+		return "", fmt.Errorf("illegal hard link %s -> %s: %v", header.Name, header.Linkname, err)
+	}
+	if o.members != nil {
+		if name, err = o.memberName(name); err != nil {
+			return "", err
+		}
+	}
+	name, ok := o.stripComponents(name)
+	if !ok {
+		// not extracted, so not linkable
+		return "", nil
+	}
+	target, err := computeSafeTarget(name, destPath, baseAbs, srcBase, destIsDir)
+	if err != nil {
+		return "", fmt.Errorf("illegal hard link %s -> %s: %v", header.Name, header.Linkname, err)
+	}
+	return target, nil
+}
+
+// extractHardLink links targetAbs, the hard link of header, to linkTarget, a
+// regular file this copy extracted, or copies it where the filesystem can't
+// link. A link to anything else, such as a file left out of the copy or
+// extracted by an earlier one, is skipped with a warning.
+func (o *CopyOptions) extractHardLink(header *tar.Header, targetAbs, linkTarget string) error {
+	if !o.linkable[linkTarget] {
+		o.warnings.hardLinkSkipped(header)
+		if o.manifest != nil {
+			o.manifest.addEntry(header, nil, true)
+		}
+		return nil
+	}
+	if err := o.mkdirAll(filepath.Dir(targetAbs), 0755); err != nil {
+		return fmt.Errorf("mkdir failed: %v", err)
+	}
+	if info, err := os.Lstat(targetAbs); err == nil && !info.IsDir() {
+		if err := os.Remove(targetAbs); err != nil {
+			return fmt.Errorf("create hard link failed: %v", err)
+		}
+	}
+	if err := os.Link(linkTarget, targetAbs); err != nil {
+		if err := copyLocalFile(linkTarget, targetAbs); err != nil {
+			return fmt.Errorf("create hard link failed: %v", err)
+		}
+	}
+	o.own(targetAbs)
+	o.linkable[targetAbs] = true
+	if o.manifest != nil {
+		o.manifest.addEntry(header, nil, false)
+	}
+	return nil
+}
+
+// copyLocalFile copies the regular file src to dst, with its mode.
+func copyLocalFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		//nolint:errcheck
+		_ = in.Close()
+	}()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hardLinkTar is a directory of /var/lib with a file and a hard link to it,
+// and the links given.
+func hardLinkTar(t *testing.T, links ...*tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range append([]*tar.Header{
+		{Name: "db/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "db/data", Typeflag: tar.TypeReg, Mode: 0o640, Size: 4},
+		{Name: "db/data.bak", Typeflag: tar.TypeLink, Linkname: "db/data"},
+	}, links...) {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if h.Size > 0 {
+			if _, err := tw.Write([]byte("rows")); err != nil {
+				t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return &buf
+}
+
+func TestExtractHardLink(t *testing.T) {
+	var errOut bytes.Buffer
+	o := newCopyOptions(&errOut)
+	dest := mustTempDir(t)
+
+	if _, err := o.extractTar(context.Background(), hardLinkTar(t), dest, "db"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	assertFileContent(t, filepath.Join(dest, "db", "data.bak"), "rows")
+	data, err := os.Stat(filepath.Join(dest, "db", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Stat(filepath.Join(dest, "db", "data.bak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(data, link) {
+		t.Error("db/data.bak is a copy, want a hard link to db/data")
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("unexpected warnings: %q", errOut.String())
+	}
+}
+
+func TestExtractHardLinkSkipped(t *testing.T) {
+	var errOut bytes.Buffer
+	o := newCopyOptions(&errOut)
+	dest := mustTempDir(t)
+	// a local file of that name was not extracted by the copy
+	if err := os.WriteFile(filepath.Join(dest, "passwd"), []byte("root"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tarball := hardLinkTar(t,
+		&tar.Header{Name: "db/early", Typeflag: tar.TypeLink, Linkname: "db/later"},
+		&tar.Header{Name: "db/passwd", Typeflag: tar.TypeLink, Linkname: "passwd"},
+	)
+	if _, err := o.extractTar(context.Background(), tarball, dest, "db"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	for _, name := range []string{"early", "passwd"} {
+		assertFileDoesNotExist(t, filepath.Join(dest, "db", name))
+	}
+	assertContains(t, errOut.String(), "Warning: skipping hard link db/early -> db/later, its target is not part of the copy\n")
+	assertContains(t, errOut.String(), "Warning: skipping hard link db/passwd -> passwd, its target is not part of the copy\n")
+}
+
+func TestExtractHardLinkTraversal(t *testing.T) {
+	o := newCopyOptions(&bytes.Buffer{})
+	dest := mustTempDir(t)
+
+	_, err := o.extractTar(context.Background(), hardLinkTar(t, &tar.Header{Name: "db/shadow", Typeflag: tar.TypeLink, Linkname: "../../etc/shadow"}), dest, "db")
+	if err == nil || !strings.Contains(err.Error(), "illegal hard link db/shadow -> ../../etc/shadow") {
+		t.Fatalf("err = %v, want the link refused", err)
+	}
+	assertFileDoesNotExist(t, filepath.Join(dest, "db", "shadow"))
+}
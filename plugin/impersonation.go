@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// identityHeader is set by the rexec server, on the response establishing a
+// session, to the JSON of the identity the session is audited under.
+const identityHeader = "X-Rexec-Identity"
+
+// sessionIdentity is the part of the value of identityHeader the plugin checks,
+// the server sends the UID and groups as well.
+type sessionIdentity struct {
+	User string `json:"user"`
+	// Impersonator is who the server records as acting as User, when the
+	// apiserver passed it on.
+	Impersonator string `json:"impersonator"`
+}
+
+// impersonation is the user the sessions are opened as with --as, and the
+// config to look up the real identity behind it with.
+type impersonation struct {
+	user   string
+	config *restclient.Config
+
+	once     sync.Once
+	realUser string
+}
+
+// whoAmITimeout bounds the lookup of the real identity.
+const whoAmITimeout = 5 * time.Second
+
+// whoAmI returns the username config authenticates as, swapped in tests.
+var whoAmI = func(config *restclient.Config) (string, error) {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), whoAmITimeout)
+	defer cancel()
+	review, err := client.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return review.Status.UserInfo.Username, nil
+}
+
+// real looks up the identity behind the impersonation, once. It is empty when
+// it can't be looked up.
+func (i *impersonation) real() string {
+	i.once.Do(func() {
+		user, err := whoAmI(i.config)
+		if err != nil {
+			klog.V(2).Infof("looking up the identity impersonating %s failed: %v", i.user, err)
+			return
+		}
+		i.realUser = user
+	})
+	return i.realUser
+}
+
+// impersonating records the impersonation of config, from --as, for the
+// sessions opened with it.
+func (n *sessionNotices) impersonating(config *restclient.Config) {
+	if config.Impersonate.UserName == "" {
+		return
+	}
+	real := restclient.CopyConfig(config)
+	real.Impersonate = restclient.ImpersonationConfig{}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.impersonation = &impersonation{user: config.Impersonate.UserName, config: real}
+}
+
+// checkIdentity tells the user, once a session is established through
+// impersonation, who it acts as, and whether value, the identityHeader of the
+// session, shows the server records both identities. Only a header naming the
+// impersonator confirms the real identity is recorded. Without impersonation
+// there is nothing to tell.
+func (n *sessionNotices) checkIdentity(value string) {
+	n.mu.Lock()
+	imp := n.impersonation
+	n.mu.Unlock()
+	if imp == nil {
+		return
+	}
+	// a request of its own, made without holding the lock
+	real := imp.real()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	who := "your real identity"
+	if real != "" {
+		who += " " + real
+	}
+	if value == "" {
+		// an older server, which does not say
+		n.printOnceLocked(fmt.Sprintf("note: acting as %s via impersonation; the rexec server does not say whether it also records %s", imp.user, who))
+		return
+	}
+	var id sessionIdentity
+	err := json.Unmarshal([]byte(value), &id)
+	if err == nil && id.User == "" {
+		err = errors.New("no user")
+	}
+	if err != nil {
+		n.malformedLocked(identityHeader, err)
+		return
+	}
+	switch {
+	case id.User != imp.user:
+		n.printOnceLocked(fmt.Sprintf("Warning: the rexec server sees this session as %s, not as %s: the impersonation was not applied to the session", id.User, imp.user))
+	case id.Impersonator == "":
+		n.printOnceLocked(fmt.Sprintf("Warning: the rexec server sees this session as %s only, its audit log does not record %s: only the apiserver audit log ties the session to you", imp.user, who))
+	case real != "" && id.Impersonator != real:
+		n.printOnceLocked(fmt.Sprintf("Warning: the rexec server records %s as acting as %s, not %s", id.Impersonator, imp.user, who))
+	default:
+		n.printOnceLocked(fmt.Sprintf("note: acting as %s via impersonation; your real identity %s will also be recorded", imp.user, id.Impersonator))
+	}
+}
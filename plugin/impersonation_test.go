@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	restclient "k8s.io/client-go/rest"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// withWhoAmI makes the lookup of the real identity return user, or fail when
+// it is empty.
+func withWhoAmI(t *testing.T, user string) {
+	t.Helper()
+	old := whoAmI
+	t.Cleanup(func() { whoAmI = old })
+	whoAmI = func(*restclient.Config) (string, error) {
+		if user == "" {
+			return "", errors.New("selfsubjectreviews is forbidden")
+		}
+		return user, nil
+	}
+}
+
+// kubeconfigFor writes a kubeconfig pointing at host and returns its path.
+func kubeconfigFor(t *testing.T, host string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters: [{name: test, cluster: {server: %q}}]
+users: [{name: alice, user: {token: alice-token}}]
+contexts: [{name: test, context: {cluster: test, user: alice}}]
+current-context: test
+`, host)
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImpersonationReachesRexecEndpoint(t *testing.T) {
+	out := captureSessionNotices(t)
+	withWhoAmI(t, "alice")
+	var mu sync.Mutex
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = r.Header.Clone()
+		mu.Unlock()
+		// an exec the apiserver refuses still shows what the plugin sent
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	flags := newConfigFlags(genericiooptions.NewTestIOStreamsDiscard())
+	*flags.KubeConfig = kubeconfigFor(t, srv.URL)
+	*flags.Impersonate = "bob"
+	*flags.ImpersonateGroup = []string{"break-glass"}
+	config, err := cmdutil.NewFactory(cmdutil.NewMatchVersionFlags(flags)).ToRESTConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"}}
+	if err := (rexecExecutor{config: config}).Execute(context.Background(), pod, "app", []string{"ls"}, nil, nil); err == nil {
+		t.Fatal("exec refused by the server succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got.Get("Impersonate-User") != "bob" || strings.Join(got.Values("Impersonate-Group"), ",") != "break-glass" {
+		t.Fatalf("impersonation headers sent = %v, want bob in break-glass", got)
+	}
+	// a refused exec is no session, nothing is said about it
+	if out.Len() != 0 {
+		t.Fatalf("notices for a refused exec: %q", out.String())
+	}
+}
+
+func TestImpersonationNotices(t *testing.T) {
+	const (
+		notice            = "note: acting as bob via impersonation; your real identity alice will also be recorded"
+		olderServer       = "note: acting as bob via impersonation; the rexec server does not say whether it also records your real identity alice"
+		anonymousServer   = "note: acting as bob via impersonation; the rexec server does not say whether it also records your real identity"
+		onlyImpersonated  = "Warning: the rexec server sees this session as bob only, its audit log does not record your real identity alice"
+		notApplied        = "Warning: the rexec server sees this session as alice, not as bob"
+		otherImpersonator = "Warning: the rexec server records carol as acting as bob, not your real identity alice"
+		malformed         = "Warning: ignoring the malformed " + identityHeader + " header"
+	)
+	tests := []struct {
+		name string
+		// impersonate is the --as user, none when empty.
+		impersonate string
+		// realUser is the answer of the lookup of the real identity, which
+		// fails when empty.
+		realUser string
+		header   string
+		want     []string
+	}{
+		{"no impersonation", "", "alice", `{"user":"alice"}`, nil},
+		{"server records both", "bob", "alice", `{"user":"bob","groups":["break-glass"],"impersonator":"alice"}`, []string{notice}},
+		{"server records both, real identity unknown", "bob", "", `{"user":"bob","impersonator":"alice"}`, []string{notice}},
+		{"older server", "bob", "alice", "", []string{olderServer}},
+		{"older server, real identity unknown", "bob", "", "", []string{anonymousServer}},
+		{"server sees only the impersonated user", "bob", "alice", `{"user":"bob","groups":["break-glass"]}`, []string{onlyImpersonated}},
+		{"server records someone else", "bob", "alice", `{"user":"bob","impersonator":"carol"}`, []string{otherImpersonator}},
+		{"impersonation not applied", "bob", "alice", `{"user":"alice"}`, []string{notApplied}},
+		{"malformed header", "bob", "alice", `{"user":`, []string{malformed}},
+		{"header without user", "bob", "alice", `{"groups":["break-glass"]}`, []string{malformed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureSessionNotices(t)
+			withWhoAmI(t, tt.realUser)
+			config := &restclient.Config{Host: "https://apiserver"}
+			config.Impersonate.UserName = tt.impersonate
+			notices.impersonating(config)
+
+			// a second session says nothing new
+			for range 2 {
+				notices.checkIdentity(tt.header)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if out.Len() == 0 {
+				lines = nil
+			}
+			if len(lines) != len(tt.want) {
+				t.Fatalf("notices = %q, want %q", lines, tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Fatalf("notice %d = %q, want %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionNoticesOnlyForEstablishedSessions(t *testing.T) {
+	out := captureSessionNotices(t)
+	withWhoAmI(t, "alice")
+	config := &restclient.Config{Host: "https://apiserver"}
+	config.Impersonate.UserName = "bob"
+	notices.impersonating(config)
+
+	exec := httptest.NewRequest(http.MethodPost, rexecExecPath("default", "web-0"), nil)
+	pods := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods/web-0", nil)
+	for _, tt := range []struct {
+		req  *http.Request
+		code int
+	}{{pods, http.StatusOK}, {exec, http.StatusForbidden}} {
+		notices.session(tt.req, &http.Response{StatusCode: tt.code, Header: http.Header{}})
+	}
+	if out.Len() != 0 {
+		t.Fatalf("notices before a session was established: %q", out.String())
+	}
+	notices.session(exec, &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{identityHeader: {`{"user":"bob","impersonator":"alice"}`}}})
+	assertContains(t, out.String(), "acting as bob via impersonation")
+}
@@ -0,0 +1,34 @@
+package plugin
+
+import (
+	"github.com/spf13/cobra"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// kubeContextName returns the kubeconfig context a command targets: that of
+// --context, or else the current context of the kubeconfig.
+func kubeContextName(f cmdutil.Factory, cmd *cobra.Command) string {
+	if name, _ := cmd.Flags().GetString("context"); name != "" {
+		return name
+	}
+	if rawConfig, err := f.ToRawKubeConfigLoader().RawConfig(); err == nil {
+		return rawConfig.CurrentContext
+	}
+	return ""
+}
+
+// logTarget logs with -v=2 the context, cluster and server a command sends
+// its requests to, as they were resolved from the kubeconfig and the flags.
+func logTarget(f cmdutil.Factory, cmd *cobra.Command, config *restclient.Config) string {
+	name := kubeContextName(f, cmd)
+	cluster, _ := cmd.Flags().GetString("cluster")
+	if cluster == "" {
+		if rawConfig, err := f.ToRawKubeConfigLoader().RawConfig(); err == nil && rawConfig.Contexts[name] != nil {
+			cluster = rawConfig.Contexts[name].Cluster
+		}
+	}
+	klog.V(2).Infof("using context %q, cluster %q at %s", name, cluster, config.Host)
+	return name
+}
@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+func TestCopyCompleteContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		flags       map[string]string
+		wantContext string
+		wantHost    string
+		wantNs      string
+	}{
+		{"current context", nil, "prod", "https://prod.example.com:6443", "payments"},
+		{"context flag", map[string]string{"context": "staging"}, "staging", "https://staging.example.com:6443", "payments-staging"},
+		{"cluster flag", map[string]string{"context": "prod", "cluster": "staging"}, "prod", "https://staging.example.com:6443", "payments"},
+		{"namespace flag", map[string]string{"context": "staging", "namespace": "forensics"}, "staging", "https://staging.example.com:6443", "forensics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFlags := newConfigFlags(genericiooptions.NewTestIOStreamsDiscard())
+			*configFlags.KubeConfig = filepath.Join("testdata", "kubeconfig", "multi-context.yaml")
+			cmd := &cobra.Command{}
+			configFlags.AddFlags(cmd.Flags())
+			for name, value := range tt.flags {
+				if err := cmd.Flags().Set(name, value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			o := newRunOptions()
+
+			f := cmdutil.NewFactory(cmdutil.NewMatchVersionFlags(configFlags))
+			if err := o.Complete(f, cmd, []string{"pod:/var/log", "./log"}); err != nil {
+				t.Fatalf("Complete() error = %v", err)
+			}
+			if o.kubeContext != tt.wantContext || o.ClientConfig.Host != tt.wantHost || o.Namespace != tt.wantNs {
+				t.Errorf("Complete() targets context %q, host %q, namespace %q, want %q, %q, %q",
+					o.kubeContext, o.ClientConfig.Host, o.Namespace, tt.wantContext, tt.wantHost, tt.wantNs)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// longNameTar is the directory app with a file at a 150 character nested
+// path, its name and modification time in a PAX header, after a PAX global
+// header, and another file with a GNU long name.
+func longNameTar(t *testing.T, deep, gnu string, mtime time.Time) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "rexec"}, Format: tar.FormatPAX},
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: deep, Typeflag: tar.TypeReg, Mode: 0o644, Size: 4, ModTime: mtime, Format: tar.FormatPAX},
+		{Name: gnu, Typeflag: tar.TypeReg, Mode: 0o644, Size: 4, ModTime: mtime, Format: tar.FormatGNU},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if h.Size > 0 {
+			if _, err := tw.Write([]byte("deep")); err != nil {
+				t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return &buf
+}
+
+func TestExtractLongNames(t *testing.T) {
+	nested := strings.Repeat("nested-directory/", 8) + "a-file-name-over-the-limit.log"
+	deep := "app/" + nested
+	gnu := "app/" + strings.Repeat("g", 120) + ".log"
+	if len(deep) < 150 {
+		t.Fatalf("the path has %d characters", len(deep))
+	}
+	mtime := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		dest    func(dir string) string
+		extract func(dest string) string
+	}{
+		{"into directory", func(dir string) string { return dir }, func(dest string) string { return filepath.Join(dest, "app") }},
+		{"to new path", func(dir string) string { return filepath.Join(dir, "renamed") }, func(dest string) string { return dest }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errOut bytes.Buffer
+			o := newCopyOptions(&errOut)
+			dest := tt.dest(mustTempDir(t))
+
+			if _, err := o.extractTar(context.Background(), longNameTar(t, deep, gnu, mtime), dest, "app"); err != nil {
+				t.Fatalf(errExtractTar, err)
+			}
+			root := tt.extract(dest)
+			file := filepath.Join(root, filepath.FromSlash(nested))
+			assertFileContent(t, file, "deep")
+			assertFileContent(t, filepath.Join(root, strings.TrimPrefix(gnu, "app/")), "deep")
+			if info, err := os.Stat(file); err != nil || !info.ModTime().Equal(mtime) {
+				t.Errorf("modification time = %v, %v, want %v", info.ModTime(), err, mtime)
+			}
+			if errOut.Len() != 0 {
+				t.Errorf("unexpected warnings: %q", errOut.String())
+			}
+		})
+	}
+}
+
+func TestDryRunSkipsMetadataEntries(t *testing.T) {
+	var out bytes.Buffer
+	o := newDefaultCopyOptions()
+	o.IOStreams.Out = &out
+	deep := "app/" + strings.Repeat("nested-directory/", 8) + "a.log"
+
+	if err := o.printCopyPlan(longNameTar(t, deep, "app/gnu.log", time.Now()).Bytes(), copyPlan{}); err != nil {
+		t.Fatalf("printCopyPlan() error = %v", err)
+	}
+	assertContains(t, out.String(), deep)
+	assertContains(t, out.String(), "Total: 3 entries")
+	if strings.Contains(out.String(), "pax_global_header") {
+		t.Errorf("the plan lists the global header: %q", out.String())
+	}
+}
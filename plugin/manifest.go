@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sourcesManifestVersion is bumped whenever a field of sourcesManifest changes
+// meaning, so evidence tooling can tell documents apart.
+const sourcesManifestVersion = 1
+
+// sourcesManifest is the --sources-manifest document: what a single cp
+// invocation read from which pod, for attaching to an evidence record.
+type sourcesManifest struct {
+	Version   int    `json:"version"`
+	RequestID string `json:"request_id"`
+	// Status is complete, partial (some entries were extracted before the
+	// failure) or failed.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	Context     string `json:"context,omitempty"`
+	Namespace   string `json:"namespace"`
+	Pod         string `json:"pod"`
+	PodUID      string `json:"pod_uid,omitempty"`
+	Container   string `json:"container,omitempty"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// RemoteDir is the directory tar ran in; entry paths are relative to it.
+	RemoteDir     string `json:"remote_dir,omitempty"`
+	RequestedPath string `json:"requested_path"`
+	// ResolvedPath is the real path of RequestedPath when a readlink preflight
+	// resolved it.
+	ResolvedPath string `json:"resolved_path,omitempty"`
+
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// Warnings counts the extraction warnings by kind, the skipped entries
+	// themselves are in Entries.
+	Warnings map[string]int `json:"warnings,omitempty"`
+	// WarningList is every extraction warning, including those the console
+	// left out.
+	WarningList []copyWarning `json:"warning_list,omitempty"`
+
+	Entries []sourceEntry `json:"entries"`
+
+	// path is the absolute path the manifest is written to.
+	path string
+}
+
+// sourceEntry is one tar entry read from the pod. SHA256 is computed while the
+// file is written, so it is the hash of what was extracted. Mode and ModTime
+// are those the entry has in the container, left out where the copy did not
+// read them, as with cat or --chunked.
+type sourceEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode,omitempty"`
+	ModTime time.Time `json:"mtime,omitzero"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Skipped bool      `json:"skipped,omitempty"`
+}
+
+func newSourcesManifest(context, src, dest, path string) *sourcesManifest {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return &sourcesManifest{
+		Version:     sourcesManifestVersion,
+		RequestID:   uuid.New().String(),
+		Context:     context,
+		Source:      src,
+		Destination: dest,
+		StartedAt:   time.Now().UTC(),
+		Entries:     []sourceEntry{},
+		path:        path,
+	}
+}
+
+// addEntry records a tar entry. sum is nil for entries without content.
+func (m *sourcesManifest) addEntry(header *tar.Header, sum []byte, skipped bool) {
+	entry := sourceEntry{
+		Path: header.Name, Type: tarTypeName(header.Typeflag), Size: header.Size,
+		Mode: fmt.Sprintf("%04o", header.Mode&0o7777), ModTime: header.ModTime.UTC(), Skipped: skipped,
+	}
+	if sum != nil {
+		entry.SHA256 = fmt.Sprintf("%x", sum)
+	}
+	m.Entries = append(m.Entries, entry)
+}
+
+// finish sets the outcome of the copy.
+func (m *sourcesManifest) finish(copyErr error) {
+	m.FinishedAt = time.Now().UTC()
+	switch {
+	case copyErr == nil:
+		m.Status = "complete"
+	case len(m.Entries) > 0:
+		m.Status = "partial"
+	default:
+		m.Status = "failed"
+	}
+	if copyErr != nil {
+		m.Error = copyErr.Error()
+	}
+}
+
+// write stores the manifest through a temporary file renamed to its path, so
+// it is never half written, and returns the sha256 of the bytes written, so
+// the manifest itself can be recorded independently.
+func (m *sourcesManifest) write() ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		//nolint:errcheck
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// checkManifestPath refuses to extract a file to targetAbs when it is where
+// the sources manifest is written. The manifest replaces whatever is there
+// once the copy ends, without asking or --no-clobber keeping it, so the file
+// would be lost, and the record of a copy can't be a file of that copy.
+func (o *CopyOptions) checkManifestPath(targetAbs string) error {
+	if o.manifest == nil || (targetAbs != o.manifest.path && targetAbs != o.manifest.path+".tmp") {
+		return nil
+	}
+	return fmt.Errorf("%s is where the sources manifest is written, copy to another destination or move the manifest", targetAbs)
+}
+
+func tarTypeName(flag byte) string {
+	switch flag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return fmt.Sprintf("type-%d", flag)
+	}
+}
@@ -0,0 +1,227 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+)
+
+// evidenceModTime is the modification time of every entry of evidenceTar.
+var evidenceModTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// evidenceTar is a small tree with a directory, two files and a symlink, as tar
+// would produce it for /var/logs.
+func evidenceTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		header  tar.Header
+		content string
+	}{
+		{tar.Header{Name: "logs/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "logs/app.log", Typeflag: tar.TypeReg, Mode: 0644}, "line one\nline two\n"},
+		{tar.Header{Name: "logs/current", Typeflag: tar.TypeSymlink, Linkname: "app.log", Mode: 0777}, ""},
+		{tar.Header{Name: "logs/err.log", Typeflag: tar.TypeReg, Mode: 0644}, "boom\n"},
+	}
+	for _, e := range entries {
+		e.header.Size = int64(len(e.content))
+		e.header.ModTime = evidenceModTime
+		if err := tw.WriteHeader(&e.header); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, e.header.Name, err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf(errWriteTarContentForFmt, e.header.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return buf.Bytes()
+}
+
+func readManifest(t *testing.T, path string) (*sourcesManifest, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("manifest not written: %v", err)
+	}
+	var m sourcesManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("manifest is not valid JSON: %v\n%s", err, data)
+	}
+	return &m, data
+}
+
+func sha256Hex(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+func TestSourcesManifestComplete(t *testing.T) {
+	manifestPath := filepath.Join(mustTempDir(t), "sources.json")
+	errOut := &bytes.Buffer{}
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: evidenceTar(t)})
+	o.IOStreams.ErrOut = errOut
+	o.SourcesManifest = manifestPath
+	o.kubeContext = "prod-eu"
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/logs", mustTempDir(t)); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+
+	m, data := readManifest(t, manifestPath)
+	if m.Version != sourcesManifestVersion || m.Status != "complete" || m.Error != "" || m.RequestID == "" {
+		t.Fatalf("unexpected header: %+v", m)
+	}
+	if m.Context != "prod-eu" || m.Namespace != "default" || m.Pod != "pod" || m.PodUID != "0f1e2d3c-uid" || m.Container != "app" {
+		t.Fatalf("unexpected invocation parameters: %+v", m)
+	}
+	if m.RequestedPath != "/var/logs" || m.RemoteDir != "/var" || m.Source != "pod:/var/logs" {
+		t.Fatalf("unexpected paths: %+v", m)
+	}
+	if m.StartedAt.IsZero() || m.FinishedAt.Before(m.StartedAt) {
+		t.Fatalf("unexpected timestamps: %v - %v", m.StartedAt, m.FinishedAt)
+	}
+
+	want := []sourceEntry{
+		{Path: "logs/", Type: "dir", Mode: "0755"},
+		{Path: "logs/app.log", Type: "file", Size: 18, Mode: "0644", SHA256: sha256Hex("line one\nline two\n")},
+		{Path: "logs/current", Type: "symlink", Mode: "0777", Skipped: true},
+		{Path: "logs/err.log", Type: "file", Size: 5, Mode: "0644", SHA256: sha256Hex("boom\n")},
+	}
+	if len(m.Entries) != len(want) {
+		t.Fatalf("entries = %+v, want %+v", m.Entries, want)
+	}
+	for i := range want {
+		if !m.Entries[i].ModTime.Equal(evidenceModTime) {
+			t.Errorf("entry %d mtime = %v, want %v", i, m.Entries[i].ModTime, evidenceModTime)
+		}
+		m.Entries[i].ModTime = time.Time{}
+		if m.Entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, m.Entries[i], want[i])
+		}
+	}
+
+	// the schema uses snake_case keys consumers rely on
+	for _, key := range []string{`"request_id"`, `"pod_uid"`, `"requested_path"`, `"started_at"`, `"finished_at"`, `"mode"`, `"mtime"`, `"sha256"`} {
+		if !bytes.Contains(data, []byte(key)) {
+			t.Errorf("manifest lacks key %s", key)
+		}
+	}
+	if !strings.Contains(errOut.String(), fmt.Sprintf("sha256 %x", sha256.Sum256(data))) {
+		t.Fatalf("expected the manifest sha256 on ErrOut, got %q", errOut.String())
+	}
+}
+
+func TestSourcesManifestPartial(t *testing.T) {
+	full := evidenceTar(t)
+	// cut into the content of the last file
+	truncated := full[:bytes.Index(full, []byte("boom"))+2]
+	manifestPath := filepath.Join(mustTempDir(t), "sources.json")
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: truncated})
+	o.SourcesManifest = manifestPath
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/logs", mustTempDir(t)); err == nil {
+		t.Fatal("expected the truncated copy to fail")
+	}
+	m, _ := readManifest(t, manifestPath)
+	if m.Status != "partial" || m.Error == "" {
+		t.Fatalf("status = %q error = %q, want partial with an error", m.Status, m.Error)
+	}
+	if len(m.Entries) != 3 || m.Entries[1].SHA256 != sha256Hex("line one\nline two\n") {
+		t.Fatalf("expected the entries read before the failure, got %+v", m.Entries)
+	}
+}
+
+func TestSourcesManifestFailed(t *testing.T) {
+	manifestPath := filepath.Join(mustTempDir(t), "sources.json")
+	o := newFakePodCopyOptions(&fakeExecutor{
+		stderr: "tar: logs: Cannot stat: No such file or directory\n",
+		err:    errors.New("command terminated with exit code 2"),
+	})
+	o.SourcesManifest = manifestPath
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/logs", mustTempDir(t))
+	if err == nil || !strings.Contains(err.Error(), "file not found") {
+		t.Fatalf("RunWithArgs() error = %v, want file not found", err)
+	}
+	m, _ := readManifest(t, manifestPath)
+	if m.Status != "failed" || !strings.Contains(m.Error, "file not found") || len(m.Entries) != 0 {
+		t.Fatalf("unexpected manifest for a failed copy: %+v", m)
+	}
+	if m.Pod != "pod" || m.PodUID == "" {
+		t.Fatalf("invocation parameters missing from a failed copy: %+v", m)
+	}
+}
+
+func TestSourcesManifestReplacedAtomically(t *testing.T) {
+	dir := mustTempDir(t)
+	manifestPath := filepath.Join(dir, "sources.json")
+	if err := os.WriteFile(manifestPath, []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: evidenceTar(t)})
+	o.SourcesManifest = manifestPath
+	o.NoClobber = true
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/logs", mustTempDir(t)); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	if m, _ := readManifest(t, manifestPath); m.Status != "complete" {
+		t.Fatalf("the previous manifest was not replaced: %+v", m)
+	}
+	if _, err := os.Stat(manifestPath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary manifest left behind: %v", err)
+	}
+}
+
+func TestSourcesManifestNotOverwrittenByCopy(t *testing.T) {
+	dest := mustTempDir(t)
+	manifestPath := filepath.Join(dest, "logs", "app.log")
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: evidenceTar(t)})
+	o.SourcesManifest = manifestPath
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/logs", dest)
+	if err == nil || !strings.Contains(err.Error(), "is where the sources manifest is written") {
+		t.Fatalf("RunWithArgs() error = %v, want the manifest path refused", err)
+	}
+	if m, _ := readManifest(t, manifestPath); m.Status != "partial" {
+		t.Fatalf("status = %q, want partial", m.Status)
+	}
+}
+
+func TestSourcesManifestWriteFailureFailsCopy(t *testing.T) {
+	manifestPath := filepath.Join(mustTempDir(t), "missing", "sources.json")
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: evidenceTar(t)})
+	o.SourcesManifest = manifestPath
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/logs", mustTempDir(t))
+	if err == nil || !strings.Contains(err.Error(), "failed to write sources manifest") {
+		t.Fatalf("RunWithArgs() error = %v, want the manifest write failure", err)
+	}
+}
+
+func TestManifestFlag(t *testing.T) {
+	cmd := NewCmdCp(nil, genericiooptions.IOStreams{Out: io.Discard, ErrOut: io.Discard})
+	if err := cmd.Flags().Parse([]string{"--manifest", "./evidence/sources.json"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cmd.Flags().Lookup("sources-manifest").Value.String(); got != "./evidence/sources.json" {
+		t.Errorf("--sources-manifest = %q, want --manifest to set it", got)
+	}
+}
@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// parseMaxSize parses --max-size, 0 or empty for no limit.
+func parseMaxSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil || q.Sign() < 0 {
+		return 0, fmt.Errorf("invalid --max-size %q, want a size such as 500Mi, or 0 for no limit", value)
+	}
+	return q.Value(), nil
+}
+
+// defaultMaxFiles is the --max-files of a copy, enough for any tree worth
+// copying whole, not for an archive of millions of empty files.
+const defaultMaxFiles = 100000
+
+// checkLimits fails the copy before header is extracted when it would take
+// what result says was written over --max-files or --max-size, so no partial
+// copy of it is left behind. What was written before it stays.
+func (o *CopyOptions) checkLimits(header *tar.Header, result CopyResult) error {
+	if o.MaxFiles > 0 && o.writesEntry(header) && result.written() >= o.MaxFiles {
+		return fmt.Errorf("copy aborted, %s would exceed --max-files %d: %s", header.Name, o.MaxFiles, result.writtenSummary())
+	}
+	if !regularEntry(header) {
+		return nil
+	}
+	limit, err := parseMaxSize(o.MaxSize)
+	if err != nil || limit == 0 || o.copiedBytes+header.Size <= limit {
+		return err
+	}
+	return fmt.Errorf("copy aborted, %s (%d bytes) would exceed --max-size %s: %s",
+		header.Name, header.Size, o.MaxSize, result.writtenSummary())
+}
+
+// writesEntry reports whether extracting header creates something locally,
+// rather than skipping it.
+func (o *CopyOptions) writesEntry(header *tar.Header) bool {
+	switch {
+	case header.Typeflag == tar.TypeSymlink:
+		return o.AllowSymlinks
+	case specialEntry(header):
+		return o.SpecialFiles == specialFilesCreate
+	}
+	return header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeLink || regularEntry(header)
+}
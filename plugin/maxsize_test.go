@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseMaxSize(t *testing.T) {
+	for value, want := range map[string]int64{"": 0, "0": 0, "500Mi": 500 << 20, "1G": 1e9, "1024": 1024} {
+		if got, err := parseMaxSize(value); err != nil || got != want {
+			t.Errorf("parseMaxSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"-1", "lots", "5 MB"} {
+		if _, err := parseMaxSize(value); err == nil || !strings.Contains(err.Error(), "invalid --max-size") {
+			t.Errorf("parseMaxSize(%q) = %v, want an error", value, err)
+		}
+	}
+}
+
+func TestCopyMaxSize(t *testing.T) {
+	// entries in this order, unlike createTestTar
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, f := range []struct{ name, content string }{{"dump/a", "123456"}, {"dump/b", "1234"}, {"dump/c", "1"}} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		maxSize string
+		wantErr string
+		want    []string
+	}{
+		{"0", "", []string{"a", "b", "c"}},
+		{"10", "copy aborted, dump/c (1 bytes) would exceed --max-size 10: 2 entries (10 bytes) were written before it; 2 partial files were kept (--keep-partial)", []string{"a", "b"}},
+		{"8", "copy aborted, dump/b (4 bytes) would exceed --max-size 8: 1 entries (6 bytes) were written before it; 1 partial file was kept (--keep-partial)", []string{"a"}},
+	} {
+		t.Run(tt.maxSize, func(t *testing.T) {
+			o := newFakePodCopyOptions(&fakeExecutor{stdout: archive.Bytes()})
+			o.Container = "app"
+			o.MaxSize = tt.maxSize
+			o.KeepPartial = true
+			var out bytes.Buffer
+			o.IOStreams.Out = &out
+			dest := filepath.Join(mustTempDir(t), "dump")
+
+			err := o.RunWithArgs(context.Background(), "pod:/var/dump", dest)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			entries, _ := os.ReadDir(dest)
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("extracted %q, want %q and nothing of the file over the limit", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyMaxFiles(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	headers := []*tar.Header{
+		{Name: "spool/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "spool/a", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+		{Name: "spool/skipped", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		{Name: "spool/b", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+		{Name: "spool/c", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+	}
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(make([]byte, h.Size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		maxFiles int
+		wantErr  string
+		want     []string
+	}{
+		{0, "", []string{"a", "b", "c"}},
+		{4, "", []string{"a", "b", "c"}},
+		// the skipped symlink doesn't count
+		{3, "copy aborted, spool/c would exceed --max-files 3: 3 entries (2 bytes) were written before it; 2 partial files were kept (--keep-partial)", []string{"a", "b"}},
+		{1, "copy aborted, spool/a would exceed --max-files 1: 1 entries (0 bytes) were written before it", nil},
+	} {
+		t.Run(strconv.Itoa(tt.maxFiles), func(t *testing.T) {
+			o := newFakePodCopyOptions(&fakeExecutor{stdout: archive.Bytes()})
+			o.Container = "app"
+			o.MaxFiles = tt.maxFiles
+			o.KeepPartial = true
+			dest := mustTempDir(t)
+
+			err := o.RunWithArgs(context.Background(), "pod:/var/spool", dest)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			entries, _ := os.ReadDir(filepath.Join(dest, "spool"))
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("extracted %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podsManifestName is the file in the destination of a selector copy that
+// maps its subdirectories to the pods they were copied from.
+const podsManifestName = "manifest.json"
+
+// podsManifestVersion is bumped whenever a field of podsManifest changes
+// meaning.
+const podsManifestVersion = 1
+
+// Values of --name-by.
+const (
+	nameByPod    = "pod"
+	nameByPodUID = "pod-uid"
+	nameByNode   = "node"
+	nameByIndex  = "index"
+)
+
+// Results of a podCopyRecord.
+const (
+	podCopySucceeded = "succeeded"
+	podCopyFailed    = "failed"
+	podCopySkipped   = "skipped"
+)
+
+// podsManifest is the manifest.json of a selector copy.
+type podsManifest struct {
+	Version    int       `json:"version"`
+	Namespace  string    `json:"namespace"`
+	Selector   string    `json:"selector"`
+	RemotePath string    `json:"remote_path"`
+	NameBy     string    `json:"name_by"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// Pods is sorted by Dir.
+	Pods []podCopyRecord `json:"pods"`
+}
+
+// podCopyRecord is one subdirectory of the destination and the pod it was
+// copied from. Labels is a snapshot taken when the pods were listed.
+type podCopyRecord struct {
+	Dir        string            `json:"dir"`
+	Namespace  string            `json:"namespace"`
+	Pod        string            `json:"pod"`
+	UID        string            `json:"uid"`
+	Node       string            `json:"node"`
+	Labels     map[string]string `json:"labels"`
+	Result     string            `json:"result"`
+	Error      string            `json:"error,omitempty"`
+	Files      int               `json:"files"`
+	Bytes      int64             `json:"bytes"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+}
+
+// copyFromSelectedPods copies remotePath from every Running pod matching
+// Selector, at most MaxConcurrent at once, into a subdirectory of dest per
+// pod, and records the mapping in dest/manifest.json. A pod that fails does
+// not stop the others, the failures are reported with the summary at the end.
+func (o *CopyOptions) copyFromSelectedPods(ctx context.Context, remotePath, dest string) (err error) {
+	pods, err := o.selectCopyPods(ctx)
+	if err != nil {
+		return err
+	}
+	dirs, err := podDirNames(pods, o.NameBy)
+	if err != nil {
+		return err
+	}
+	previous, err := o.prepareSelectorDestination(dest)
+	if err != nil {
+		return err
+	}
+
+	manifest := &podsManifest{
+		Version:    podsManifestVersion,
+		Namespace:  o.Namespace,
+		Selector:   o.Selector,
+		RemotePath: remotePath,
+		NameBy:     o.NameBy,
+	}
+	records := make([]podCopyRecord, len(pods))
+	defer func() {
+		manifest.Pods = mergePodRecords(previous, records)
+		manifest.UpdatedAt = time.Now().UTC()
+		manifestPath := filepath.Join(dest, podsManifestName)
+		if writeErr := manifest.write(manifestPath); writeErr != nil {
+			if err != nil {
+				newOutput(o.IOStreams.ErrOut).printf("Warning: failed to write %s: %v\n", manifestPath, writeErr)
+				return
+			}
+			err = fmt.Errorf("failed to write %s: %v", manifestPath, writeErr)
+			return
+		}
+		o.own(manifestPath)
+		if ownErr := o.applyOwner(); ownErr != nil && err == nil {
+			err = ownErr
+		}
+	}()
+
+	concurrency := max(o.MaxConcurrent, 1)
+	var mu sync.Mutex
+	out, errOut := &lockedWriter{w: o.IOStreams.Out, mu: &mu}, &lockedWriter{w: o.IOStreams.ErrOut, mu: &mu}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var cancelErr error
+	for i := range pods {
+		pod := &pods[i]
+		records[i] = podCopyRecord{
+			Dir:       dirs[i],
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			UID:       string(pod.UID),
+			Node:      pod.Spec.NodeName,
+			Labels:    pod.Labels,
+		}
+		podDest := filepath.Join(dest, dirs[i])
+		if _, statErr := os.Lstat(podDest); statErr == nil {
+			newOutput(errOut).printf("Skipping pod %s/%s: %s already exists\n", pod.Namespace, pod.Name, podDest)
+			records[i].Result = podCopySkipped
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			records[i].Result = podCopyFailed
+			records[i].Error = fmt.Sprintf("pod %s/%s: not started: %v", pod.Namespace, pod.Name, ctx.Err())
+			continue
+		}
+		mu.Lock()
+		c := o.podCopyOptions(out, errOut, concurrency)
+		mu.Unlock()
+		wg.Add(1)
+		go func(record *podCopyRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			record.StartedAt = time.Now().UTC()
+			copyErr := c.copyPodInto(ctx, pod, remotePath, podDest)
+			record.FinishedAt = time.Now().UTC()
+			record.Files = len(c.extracted)
+			record.Bytes = c.copiedBytes
+			record.Result = podCopySucceeded
+			if copyErr != nil {
+				record.Result = podCopyFailed
+				record.Error = copyErr.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			o.compressFallback = o.compressFallback || c.compressFallback
+			var cancelled copyCancelledError
+			if errors.As(copyErr, &cancelled) && cancelErr == nil {
+				cancelErr = copyErr
+			}
+		}(&records[i])
+	}
+	wg.Wait()
+
+	o.printPodCopySummary(records)
+	var failed []string
+	for _, r := range records {
+		if r.Result == podCopyFailed {
+			failed = append(failed, r.Pod)
+		}
+	}
+	switch {
+	case cancelErr != nil:
+		return cancelErr
+	case ctx.Err() != nil && len(failed) > 0:
+		// cancelled before the copies still waiting were started
+		return copyCancelledError{terminated: true}
+	case len(failed) > 0:
+		return fmt.Errorf("copy failed in %d of %d pods: %s", len(failed), len(pods), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// podCopyOptions returns the options of the copy of one pod of a selector
+// copy: o with state of its own, writing to out and errOut. Copies running
+// side by side don't report progress, their lines would overwrite each other.
+func (o *CopyOptions) podCopyOptions(out, errOut io.Writer, concurrency int) *CopyOptions {
+	c := *o
+	c.IOStreams.Out, c.IOStreams.ErrOut = out, errOut
+	if concurrency > 1 {
+		c.Progress = progressNever
+	}
+	c.warnings = nil
+	c.extracted = nil
+	c.checksummed = nil
+	c.copiedBytes = 0
+	c.excludedEntries = 0
+	c.owned = nil
+	c.preservedDirs = nil
+	c.progress = nil
+	c.localeEnvProbed = map[string]bool{}
+	return &c
+}
+
+// printPodCopySummary prints the result of every pod of a selector copy, and
+// then the errors of those that failed.
+func (o *CopyOptions) printPodCopySummary(records []podCopyRecord) {
+	rows := make([][]string, len(records))
+	for i, r := range records {
+		rows[i] = []string{r.Pod, r.Dir, r.Result, strconv.Itoa(r.Files), formatBytes(r.Bytes)}
+	}
+	cols := []column{{Header: "POD"}, {Header: "DIR"}, {Header: "RESULT"}, {Header: "FILES", Right: true}, {Header: "SIZE", Right: true}}
+	//nolint:errcheck
+	_ = newOutput(o.summaryOut()).table(cols, rows)
+	errOut := newOutput(o.errorOut())
+	for _, r := range records {
+		if r.Result == podCopyFailed {
+			errOut.printf("error: %s\n", r.Error)
+		}
+	}
+}
+
+// lockedWriter serializes the writes of the copies of a selector copy running
+// side by side to the same stream.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// copyPodInto copies remotePath of one pod into podDest, which it creates. A
+// failed copy removes podDest again, so a later --merge copies the pod anew.
+func (o *CopyOptions) copyPodInto(ctx context.Context, pod *corev1.Pod, remotePath, podDest string) error {
+	o.extracted = nil
+	o.copiedBytes = 0
+	if err := os.Mkdir(podDest, 0o755); err != nil {
+		return err
+	}
+	o.own(podDest)
+	src := &fileSpec{PodName: pod.Name, PodNamespace: pod.Namespace, File: remotePath}
+	if err := o.copyFromPod(ctx, src, &fileSpec{File: podDest}); err != nil {
+		//nolint:errcheck
+		_ = os.RemoveAll(podDest)
+		o.owned = nil
+		return err
+	}
+	return nil
+}
+
+// selectCopyPods returns the Running pods matching Selector, sorted by name.
+func (o *CopyOptions) selectCopyPods(ctx context.Context) ([]corev1.Pod, error) {
+	list, err := o.Clientset.CoreV1().Pods(o.Namespace).List(ctx, metav1.ListOptions{LabelSelector: o.Selector})
+	if err != nil {
+		return nil, err
+	}
+	var pods []corev1.Pod
+	for _, pod := range list.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no Running pods in namespace %s match %q", o.Namespace, o.Selector)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+// podDirNames returns the subdirectory name of each pod for nameBy. Index
+// names are zero-padded so they sort like the pods do.
+func podDirNames(pods []corev1.Pod, nameBy string) ([]string, error) {
+	dirs := make([]string, len(pods))
+	owners := map[string]string{}
+	width := len(strconv.Itoa(len(pods) - 1))
+	for i, pod := range pods {
+		switch nameBy {
+		case nameByPod:
+			dirs[i] = pod.Name
+		case nameByPodUID:
+			dirs[i] = string(pod.UID)
+		case nameByNode:
+			dirs[i] = pod.Spec.NodeName
+		case nameByIndex:
+			dirs[i] = fmt.Sprintf("%0*d", width, i)
+		default:
+			return nil, fmt.Errorf("unsupported --name-by %q, use pod, pod-uid, node or index", nameBy)
+		}
+		if dirs[i] == "" {
+			return nil, fmt.Errorf("pod %s/%s has no %s to name its directory by", pod.Namespace, pod.Name, nameBy)
+		}
+		if other, ok := owners[dirs[i]]; ok {
+			return nil, fmt.Errorf("pods %s and %s would both be copied to %s, --name-by %s needs one pod per %s", other, pod.Name, dirs[i], nameBy, nameBy)
+		}
+		owners[dirs[i]] = pod.Name
+	}
+	return dirs, nil
+}
+
+// prepareSelectorDestination creates dest, or refuses an existing non-empty
+// dest unless Merge is set. With Merge it returns the records of the manifest
+// already in dest.
+func (o *CopyOptions) prepareSelectorDestination(dest string) ([]podCopyRecord, error) {
+	info, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		if err := validateLocalDestination(dest); err != nil {
+			return nil, err
+		}
+		if err := os.Mkdir(dest, 0o755); err != nil {
+			return nil, err
+		}
+		o.own(dest)
+		if err := o.applyOwner(); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("destination %s is not a directory", dest)
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if !o.Merge {
+		return nil, fmt.Errorf("destination %s is not empty, pass --merge to add the pods not copied to it yet", dest)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dest, podsManifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var previous podsManifest
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return nil, fmt.Errorf("invalid %s in %s: %v", podsManifestName, dest, err)
+	}
+	return previous.Pods, nil
+}
+
+// mergePodRecords adds the records of this run to those of a previous one. A
+// skipped pod keeps its previous record, if it has one.
+func mergePodRecords(previous, current []podCopyRecord) []podCopyRecord {
+	byDir := map[string]podCopyRecord{}
+	for _, r := range previous {
+		byDir[r.Dir] = r
+	}
+	for _, r := range current {
+		if _, ok := byDir[r.Dir]; ok && r.Result == podCopySkipped {
+			continue
+		}
+		byDir[r.Dir] = r
+	}
+	records := make([]podCopyRecord, 0, len(byDir))
+	for _, r := range byDir {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Dir < records[j].Dir })
+	return records
+}
+
+// write stores the manifest at path through a temporary file, so an
+// interrupted write leaves the previous manifest in place.
+func (m *podsManifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
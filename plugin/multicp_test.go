@@ -0,0 +1,307 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+)
+
+// podTarExecutor serves a tar of app.log holding the pod name, and fails in
+// the pods listed in fail. The pods are recorded in the order they ran, and
+// how many ran at once at most. Each takes pause.
+type podTarExecutor struct {
+	t     *testing.T
+	fail  map[string]bool
+	pause time.Duration
+
+	mu      sync.Mutex
+	pods    []string
+	running int
+	most    int
+}
+
+func (e *podTarExecutor) Execute(_ context.Context, pod *corev1.Pod, _ string, command []string, stdout, stderr io.Writer) error {
+	if command[len(command)-1] == "true" {
+		return nil
+	}
+	if isDiskUsage(command) {
+		return errNoDu
+	}
+	e.mu.Lock()
+	e.pods = append(e.pods, pod.Name)
+	e.running++
+	e.most = max(e.most, e.running)
+	e.mu.Unlock()
+	time.Sleep(e.pause)
+	e.mu.Lock()
+	e.running--
+	e.mu.Unlock()
+	if e.fail[pod.Name] {
+		_, _ = io.WriteString(stderr, "tar: log: Cannot stat: No such file or directory\n")
+		return errors.New("command terminated with exit code 2")
+	}
+	_, err := stdout.Write(createTestTar(e.t, map[string]string{"log/app.log": "from " + pod.Name}).Bytes())
+	return err
+}
+
+func selectorPod(name, uid, node string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(uid), Labels: map[string]string{"app": "web", "rev": uid}},
+		Spec:       corev1.PodSpec{NodeName: node, Containers: []corev1.Container{{Name: "app"}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func newSelectorCopyOptions(t *testing.T, executor *podTarExecutor, pods ...*corev1.Pod) (*CopyOptions, *bytes.Buffer) {
+	objects := make([]runtime.Object, len(pods))
+	for i, pod := range pods {
+		objects[i] = pod
+	}
+	errOut := &bytes.Buffer{}
+	executor.t = t
+	return &CopyOptions{
+		Namespace:       "default",
+		Clientset:       fake.NewSimpleClientset(objects...),
+		IOStreams:       genericiooptions.IOStreams{Out: &bytes.Buffer{}, ErrOut: errOut},
+		Selector:        "app=web",
+		NameBy:          nameByPod,
+		localeEnvProbed: map[string]bool{},
+		executor:        executor,
+	}, errOut
+}
+
+// webPods are listed out of name order on purpose.
+func webPods() []*corev1.Pod {
+	return []*corev1.Pod{
+		selectorPod("web-c", "uid-3", "node-a"),
+		selectorPod("web-a", "uid-1", "node-c"),
+		selectorPod("web-b", "uid-2", "node-b"),
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func readPodsManifest(t *testing.T, dest string) podsManifest {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dest, podsManifestName))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	var m podsManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("parse manifest: %v", err)
+	}
+	return m
+}
+
+func TestSelectorCopyRunsInPodNameOrder(t *testing.T) {
+	executor := &podTarExecutor{}
+	o, _ := newSelectorCopyOptions(t, executor, webPods()...)
+	o.MaxConcurrent = 1
+	dest := filepath.Join(mustTempDir(t), "out")
+
+	if err := o.RunWithArgs(context.Background(), ":/var/log", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	if want := []string{"web-a", "web-b", "web-c"}; !reflect.DeepEqual(executor.pods, want) {
+		t.Errorf("copied pods in order %v, want %v", executor.pods, want)
+	}
+}
+
+func TestSelectorCopyBoundsConcurrency(t *testing.T) {
+	pods := webPods()
+	pods = append(pods, selectorPod("web-d", "uid-4", "node-d"), selectorPod("web-e", "uid-5", "node-e"))
+	executor := &podTarExecutor{pause: 20 * time.Millisecond, fail: map[string]bool{"web-d": true}}
+	o, errOut := newSelectorCopyOptions(t, executor, pods...)
+	o.MaxConcurrent = 2
+	dest := filepath.Join(mustTempDir(t), "out")
+
+	err := o.RunWithArgs(context.Background(), ":/var/log", dest)
+	assertContains(t, errString(err), "copy failed in 1 of 5 pods: web-d")
+	if executor.most != 2 {
+		t.Errorf("copied from %d pods at once, want 2", executor.most)
+	}
+	for _, pod := range []string{"web-a", "web-b", "web-c", "web-e"} {
+		assertFileContent(t, filepath.Join(dest, pod, "log", "app.log"), "from "+pod)
+	}
+
+	// the summary lists every pod, the errors follow it
+	out := o.IOStreams.Out.(*bytes.Buffer).String()
+	summary := out[strings.Index(out, "POD"):]
+	for _, row := range []string{"web-a  web-a  succeeded      1  10 B", "web-d  web-d  failed         0   0 B"} {
+		assertContains(t, summary, row)
+	}
+	assertContains(t, errOut.String(), "error: pod default/web-d: file not found: /var/log\n")
+}
+
+func TestSelectorCopyNameBy(t *testing.T) {
+	tests := []struct {
+		nameBy string
+		want   map[string]string
+	}{
+		{nameByPod, map[string]string{"web-a": "web-a", "web-b": "web-b", "web-c": "web-c"}},
+		{nameByPodUID, map[string]string{"uid-1": "web-a", "uid-2": "web-b", "uid-3": "web-c"}},
+		{nameByNode, map[string]string{"node-c": "web-a", "node-b": "web-b", "node-a": "web-c"}},
+		{nameByIndex, map[string]string{"0": "web-a", "1": "web-b", "2": "web-c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.nameBy, func(t *testing.T) {
+			o, _ := newSelectorCopyOptions(t, &podTarExecutor{}, webPods()...)
+			o.NameBy = tt.nameBy
+			dest := filepath.Join(mustTempDir(t), "out")
+
+			if err := o.RunWithArgs(context.Background(), ":/var/log", dest); err != nil {
+				t.Fatalf("RunWithArgs() error = %v", err)
+			}
+			for dir, pod := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dest, dir, "log", "app.log"))
+				if err != nil {
+					t.Fatalf("read %s: %v", dir, err)
+				}
+				if string(got) != "from "+pod {
+					t.Errorf("%s holds %q, want the copy of %s", dir, got, pod)
+				}
+			}
+		})
+	}
+}
+
+func TestPodDirNames(t *testing.T) {
+	var pods []corev1.Pod
+	for i := 0; i < 11; i++ {
+		pods = append(pods, *selectorPod("web", "uid", "node"))
+	}
+	dirs, err := podDirNames(pods, nameByIndex)
+	if err != nil {
+		t.Fatalf("podDirNames() error = %v", err)
+	}
+	if dirs[0] != "00" || dirs[10] != "10" {
+		t.Errorf("index names = %v, want zero-padded to 2 digits", dirs)
+	}
+
+	shared := []corev1.Pod{*selectorPod("web-a", "uid-1", "node-a"), *selectorPod("web-b", "uid-2", "node-a")}
+	_, err = podDirNames(shared, nameByNode)
+	assertContains(t, errString(err), "pods web-a and web-b would both be copied to node-a")
+}
+
+func TestSelectorCopyManifest(t *testing.T) {
+	executor := &podTarExecutor{fail: map[string]bool{"web-b": true}}
+	o, errOut := newSelectorCopyOptions(t, executor, webPods()...)
+	dest := filepath.Join(mustTempDir(t), "out")
+
+	err := o.RunWithArgs(context.Background(), ":/var/log", dest)
+	assertContains(t, errString(err), "copy failed in 1 of 3 pods: web-b")
+	assertContains(t, errOut.String(), "pod default/web-b: file not found: /var/log")
+	assertFileDoesNotExist(t, filepath.Join(dest, "web-b"))
+
+	m := readPodsManifest(t, dest)
+	if m.Version != podsManifestVersion || m.Namespace != "default" || m.Selector != "app=web" || m.RemotePath != "/var/log" || m.NameBy != nameByPod || m.UpdatedAt.IsZero() {
+		t.Errorf("manifest header = %+v", m)
+	}
+	if len(m.Pods) != 3 {
+		t.Fatalf("manifest has %d pods, want 3", len(m.Pods))
+	}
+	a, b := m.Pods[0], m.Pods[1]
+	if a.Dir != "web-a" || a.Pod != "web-a" || a.UID != "uid-1" || a.Node != "node-c" || a.Namespace != "default" {
+		t.Errorf("record of web-a = %+v", a)
+	}
+	if !reflect.DeepEqual(a.Labels, map[string]string{"app": "web", "rev": "uid-1"}) {
+		t.Errorf("labels of web-a = %v", a.Labels)
+	}
+	if a.Result != podCopySucceeded || a.Files != 1 || a.Bytes != int64(len("from web-a")) || a.StartedAt.IsZero() || a.FinishedAt.Before(a.StartedAt) {
+		t.Errorf("copy of web-a recorded as %+v", a)
+	}
+	if b.Result != podCopyFailed || b.Files != 0 || b.Bytes != 0 {
+		t.Errorf("copy of web-b recorded as %+v", b)
+	}
+	assertContains(t, b.Error, "file not found")
+}
+
+func TestSelectorCopyRefusesExistingDestination(t *testing.T) {
+	o, _ := newSelectorCopyOptions(t, &podTarExecutor{}, webPods()...)
+	dest := filepath.Join(mustTempDir(t), "out")
+	if err := o.RunWithArgs(context.Background(), ":/var/log", dest); err != nil {
+		t.Fatalf("first copy error = %v", err)
+	}
+
+	executor := &podTarExecutor{}
+	o, _ = newSelectorCopyOptions(t, executor, webPods()...)
+	err := o.RunWithArgs(context.Background(), ":/var/log", dest)
+	assertContains(t, errString(err), "pass --merge")
+	if len(executor.pods) != 0 {
+		t.Errorf("copied from %v into an existing destination", executor.pods)
+	}
+}
+
+func TestSelectorCopyMergeAddsNewPods(t *testing.T) {
+	executor := &podTarExecutor{fail: map[string]bool{"web-b": true}}
+	o, _ := newSelectorCopyOptions(t, executor, webPods()[1:]...)
+	dest := filepath.Join(mustTempDir(t), "out")
+	_ = o.RunWithArgs(context.Background(), ":/var/log", dest)
+	first := readPodsManifest(t, dest).Pods[0]
+
+	// web-a was rolled: a new pod must not overwrite its directory
+	rolled := webPods()
+	rolled[1].Labels["rev"] = "new"
+	executor = &podTarExecutor{}
+	o, errOut := newSelectorCopyOptions(t, executor, rolled...)
+	o.Merge = true
+	if err := o.RunWithArgs(context.Background(), ":/var/log", dest); err != nil {
+		t.Fatalf("merge error = %v", err)
+	}
+
+	if want := []string{"web-b", "web-c"}; !reflect.DeepEqual(executor.pods, want) {
+		t.Errorf("merge copied from %v, want %v", executor.pods, want)
+	}
+	assertContains(t, errOut.String(), "Skipping pod default/web-a")
+	m := readPodsManifest(t, dest)
+	if len(m.Pods) != 3 {
+		t.Fatalf("manifest has %d pods, want 3", len(m.Pods))
+	}
+	if !reflect.DeepEqual(m.Pods[0], first) {
+		t.Errorf("record of web-a changed by the merge: %+v, was %+v", m.Pods[0], first)
+	}
+	if m.Pods[1].Result != podCopySucceeded || m.Pods[2].Result != podCopySucceeded {
+		t.Errorf("merged records = %+v", m.Pods[1:])
+	}
+}
+
+func TestSelectorCopyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    CopyOptions
+		wantErr string
+	}{
+		{"unknown name-by", CopyOptions{Selector: "app=web", NameBy: "zone"}, `unsupported --name-by "zone"`},
+		{"merge without selector", CopyOptions{Merge: true}, "--merge is only supported with --selector"},
+		{"selector with chunked", CopyOptions{Selector: "app=web", NameBy: nameByPod, Chunked: true}, "--selector can't be used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ClientConfig = &restclient.Config{}
+			assertContains(t, errString(tt.opts.Validate()), tt.wantErr)
+		})
+	}
+}
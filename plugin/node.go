@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/klog/v2"
+)
+
+// checkPodNode fails fast when the pod's node is NotReady or tainted
+// unreachable, since the kubelet backed exec would only hang until a TCP
+// timeout. A cordoned but Ready node is fine. Not being allowed to read nodes
+// is not an error, the check is skipped.
+func (o *CopyOptions) checkPodNode(ctx context.Context, pod *corev1.Pod) error {
+	if pod.Spec.NodeName == "" {
+		return nil
+	}
+	node, err := o.Clientset.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsForbidden(err) {
+			klog.V(2).Infof("not allowed to read node %s, skipping node readiness check", pod.Spec.NodeName)
+		} else {
+			klog.V(2).Infof("could not read node %s, skipping node readiness check: %v", pod.Spec.NodeName, err)
+		}
+		return nil
+	}
+
+	problem := nodeProblem(node, time.Now())
+	if problem == "" {
+		return nil
+	}
+	if o.Force {
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: %s, continuing because of --force\n", problem)
+		return nil
+	}
+	return fmt.Errorf("pod %s/%s: %s, exec through the kubelet will very likely fail (use --force to try anyway)", pod.Namespace, pod.Name, problem)
+}
+
+// nodeProblem describes why exec on node is unlikely to work, or returns an
+// empty string when the node looks healthy.
+func nodeProblem(node *corev1.Node, now time.Time) string {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == corev1.TaintNodeUnreachable {
+			since := ""
+			if taint.TimeAdded != nil {
+				since = " for " + duration.HumanDuration(now.Sub(taint.TimeAdded.Time))
+			}
+			return fmt.Sprintf("node %s is unreachable (taint %s)%s", node.Name, taint.Key, since)
+		}
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type != corev1.NodeReady || cond.Status == corev1.ConditionTrue {
+			continue
+		}
+		msg := fmt.Sprintf("node %s is NotReady (Ready=%s", node.Name, cond.Status)
+		if cond.Reason != "" {
+			msg += ", " + cond.Reason
+		}
+		msg += ")"
+		if !cond.LastTransitionTime.IsZero() {
+			msg += " for " + duration.HumanDuration(now.Sub(cond.LastTransitionTime.Time))
+		}
+		return msg
+	}
+	return ""
+}
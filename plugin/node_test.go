@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newNode(name string, ready corev1.ConditionStatus, since time.Duration, taints ...corev1.Taint) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{Taints: taints},
+		Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{{
+			Type:               corev1.NodeReady,
+			Status:             ready,
+			Reason:             "KubeletNotReady",
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-since)),
+		}}},
+	}
+}
+
+func newNodeCopyOptions(node *corev1.Node) (*CopyOptions, *bytes.Buffer) {
+	objects := []runtime.Object{&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"},
+		Spec:       corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Name: "app"}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}}
+	if node != nil {
+		objects = append(objects, node)
+	}
+	errOut := &bytes.Buffer{}
+	o := newCopyOptions(errOut)
+	o.Namespace = "default"
+	o.Clientset = fake.NewSimpleClientset(objects...)
+	return o, errOut
+}
+
+func TestValidateAndGetPodContainerNodeChecks(t *testing.T) {
+	src := &fileSpec{PodName: "pod", PodNamespace: "default", File: "/tmp/foo"}
+	unreachable := corev1.Taint{
+		Key:       corev1.TaintNodeUnreachable,
+		Effect:    corev1.TaintEffectNoExecute,
+		TimeAdded: &metav1.Time{Time: time.Now().Add(-3 * time.Minute)},
+	}
+
+	tests := []struct {
+		name    string
+		node    *corev1.Node
+		force   bool
+		wantErr []string
+		warning bool
+	}{
+		{name: "ready", node: newNode("node-1", corev1.ConditionTrue, time.Hour)},
+		{name: "cordoned but ready", node: func() *corev1.Node {
+			n := newNode("node-1", corev1.ConditionTrue, time.Hour)
+			n.Spec.Unschedulable = true
+			return n
+		}()},
+		{name: "not ready", node: newNode("node-1", corev1.ConditionFalse, 5*time.Minute),
+			wantErr: []string{"node node-1 is NotReady", "Ready=False", "KubeletNotReady", "for 5m", "--force"}},
+		{name: "unknown", node: newNode("node-1", corev1.ConditionUnknown, 2*time.Minute),
+			wantErr: []string{"node node-1 is NotReady", "Ready=Unknown"}},
+		{name: "unreachable taint", node: newNode("node-1", corev1.ConditionTrue, time.Hour, unreachable),
+			wantErr: []string{"node node-1 is unreachable", corev1.TaintNodeUnreachable, "for 3m"}},
+		{name: "not ready with force", node: newNode("node-1", corev1.ConditionFalse, 5*time.Minute), force: true, warning: true},
+		{name: "node missing", node: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, errOut := newNodeCopyOptions(tt.node)
+			o.Force = tt.force
+
+			pod, container, err := o.validateAndGetPodContainer(context.Background(), src)
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("expected the preflight to fail")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateAndGetPodContainer() error = %v", err)
+			}
+			if pod.Name != "pod" || container != "app" {
+				t.Fatalf("got pod %q container %q", pod.Name, container)
+			}
+			if gotWarning := strings.Contains(errOut.String(), "Warning: node node-1"); gotWarning != tt.warning {
+				t.Fatalf("warning printed = %v, want %v: %q", gotWarning, tt.warning, errOut.String())
+			}
+		})
+	}
+}
+
+func TestValidateAndGetPodContainerNodeForbidden(t *testing.T) {
+	o, _ := newNodeCopyOptions(newNode("node-1", corev1.ConditionFalse, time.Minute))
+	o.Clientset.(*fake.Clientset).PrependReactor("get", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "nodes"}, "node-1", errors.New("user cannot get nodes"))
+	})
+
+	src := &fileSpec{PodName: "pod", PodNamespace: "default", File: "/tmp/foo"}
+	if _, _, err := o.validateAndGetPodContainer(context.Background(), src); err != nil {
+		t.Fatalf("a forbidden node read must skip the check, got %v", err)
+	}
+}
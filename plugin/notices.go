@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+// sessionNotices prints what the server announces about the sessions it
+// establishes, each distinct notice once. It keeps the last constraints
+// announced for the copy to plan with.
+type sessionNotices struct {
+	mu      sync.Mutex
+	out     io.Writer
+	printed map[string]bool
+	latest  *sessionConstraints
+	// malformed holds the headers a malformed value was warned about for.
+	malformed map[string]bool
+	// impersonation is set when the sessions are opened through
+	// impersonation.
+	impersonation *impersonation
+	// sessions holds the ids of the sessions established, in order.
+	sessions []string
+}
+
+// sessionIDHeader is set by the rexec server, on the response establishing a
+// session, to the id its audit events are logged under.
+const sessionIDHeader = "X-Rexec-Session-Id"
+
+func newSessionNotices(out io.Writer) *sessionNotices {
+	return &sessionNotices{out: out, printed: map[string]bool{}, malformed: map[string]bool{}}
+}
+
+// notices collects the announcements of the sessions of the plugin.
+var notices = newSessionNotices(os.Stderr)
+
+// printOnceLocked prints line unless it was printed before.
+func (n *sessionNotices) printOnceLocked(line string) {
+	if n.printed[line] {
+		return
+	}
+	n.printed[line] = true
+	// the notice may come while the terminal is raw for an interactive
+	// session, which does not return the carriage on a newline
+	eol := "\n"
+	if _, tty := terminalFd(n.out); tty {
+		eol = "\r\n"
+	}
+	newOutput(n.out).printf("%s%s", line, eol)
+}
+
+// malformedLocked warns, once per header, that the server sent a value of
+// header that can't be parsed.
+func (n *sessionNotices) malformedLocked(header string, err error) {
+	if n.malformed[header] {
+		return
+	}
+	n.malformed[header] = true
+	n.printOnceLocked("Warning: ignoring the malformed " + header + " header of the rexec server: " + err.Error())
+}
+
+// session takes the response of req. Constraints are taken from any response
+// carrying them, the identity only from a session established at a rexec
+// endpoint.
+func (n *sessionNotices) session(req *http.Request, resp *http.Response) {
+	if value := resp.Header.Get(constraintsHeader); value != "" {
+		n.announce(value)
+	}
+	established := resp.StatusCode == http.StatusSwitchingProtocols || resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !established || !strings.HasPrefix(req.URL.Path, "/apis/"+rexecAPIGroup+"/") {
+		return
+	}
+	n.recordSession(resp.Header.Get(sessionIDHeader))
+	n.checkIdentity(resp.Header.Get(identityHeader))
+}
+
+// recordSession remembers the id of an established session, none from a
+// server too old to send it.
+func (n *sessionNotices) recordSession(id string) {
+	if id == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !slices.Contains(n.sessions, id) {
+		n.sessions = append(n.sessions, id)
+	}
+}
+
+// sessionIDs returns the ids of the sessions established so far.
+func (n *sessionNotices) sessionIDs() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Clone(n.sessions)
+}
+
+// printAuditSessions prints the id of every session the command established,
+// to find it in the audit log of the server, at its end.
+func printAuditSessions(out io.Writer) {
+	for _, id := range notices.sessionIDs() {
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(out, "audit session: %s\n", id)
+	}
+}
+
+// withSessionNotices makes the clients built from config hand what the server
+// announces about the sessions they establish to notices, and tells notices
+// about the impersonation of config.
+func withSessionNotices(config *restclient.Config) *restclient.Config {
+	notices.impersonating(config)
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &sessionRoundTripper{delegate: rt}
+	})
+	return config
+}
+
+// sessionRoundTripper hands every response to notices.
+type sessionRoundTripper struct {
+	delegate http.RoundTripper
+}
+
+func (rt *sessionRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.delegate.RoundTrip(req)
+	if err == nil {
+		notices.session(req, resp)
+	}
+	return resp, err
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAuditSessions(t *testing.T) {
+	captureSessionNotices(t)
+	exec := httptest.NewRequest(http.MethodPost, rexecExecPath("default", "web-0"), nil)
+	pods := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods/web-0", nil)
+	for _, tt := range []struct {
+		req  *http.Request
+		code int
+		id   string
+	}{
+		{pods, http.StatusOK, "not-a-session"},
+		{exec, http.StatusForbidden, "refused"},
+		{exec, http.StatusSwitchingProtocols, "0f1e2d3c"},
+		{exec, http.StatusSwitchingProtocols, ""},
+		{exec, http.StatusSwitchingProtocols, "0f1e2d3c"},
+		{exec, http.StatusSwitchingProtocols, "4b5a6978"},
+	} {
+		header := http.Header{}
+		if tt.id != "" {
+			header.Set(sessionIDHeader, tt.id)
+		}
+		notices.session(tt.req, &http.Response{StatusCode: tt.code, Header: header})
+	}
+
+	if got, want := notices.sessionIDs(), []string{"0f1e2d3c", "4b5a6978"}; !slices.Equal(got, want) {
+		t.Fatalf("sessionIDs() = %q, want %q", got, want)
+	}
+	var out bytes.Buffer
+	printAuditSessions(&out)
+	if got, want := out.String(), "audit session: 0f1e2d3c\naudit session: 4b5a6978\n"; got != want {
+		t.Errorf("printAuditSessions() = %q, want %q", got, want)
+	}
+}
+
+func TestNoAuditSessionFromOlderServer(t *testing.T) {
+	captureSessionNotices(t)
+	exec := httptest.NewRequest(http.MethodPost, rexecExecPath("default", "web-0"), nil)
+	notices.session(exec, &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{}})
+
+	var out bytes.Buffer
+	printAuditSessions(&out)
+	if out.Len() != 0 {
+		t.Errorf("printAuditSessions() = %q, want nothing", out.String())
+	}
+}
+
+func TestCopyReportAuditSessions(t *testing.T) {
+	captureSessionNotices(t)
+	notices.recordSession("0f1e2d3c")
+	executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": contentStr}).Bytes()}
+	o := newFakePodCopyOptions(executor)
+	o.Output = "json"
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t)); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	var report copyReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.AuditSessions, []string{"0f1e2d3c"}) {
+		t.Errorf("audit_sessions = %q", report.AuditSessions)
+	}
+}
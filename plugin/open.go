@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+
+	"k8s.io/klog/v2"
+)
+
+// commandStarter starts a program without waiting for it to finish. It is a
+// seam so tests can check what would be launched without spawning GUI apps.
+type commandStarter func(name string, args ...string) error
+
+// startDetached starts the program and reaps it in the background, so the copy
+// command returns while the opened program keeps running.
+func startDetached(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
+
+// openerCommand returns the program and arguments that open path, either with
+// the explicitly requested program or the platform default opener.
+func openerCommand(goos, openWith, path string) (string, []string) {
+	if openWith != "" {
+		return openWith, []string{path}
+	}
+	switch goos {
+	case "darwin":
+		return "open", []string{path}
+	case "windows":
+		// the empty argument is the window title start expects before the path
+		return "cmd", []string{"/c", "start", "", path}
+	default:
+		return "xdg-open", []string{path}
+	}
+}
+
+// openDestination launches the opener on the copied path. Failing to launch is
+// only a warning, the copy itself already succeeded.
+func (o *CopyOptions) openDestination(path string) {
+	start := o.startCommand
+	if start == nil {
+		start = startDetached
+	}
+	name, args := openerCommand(runtime.GOOS, o.OpenWith, path)
+	if err := start(name, args...); err != nil {
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: failed to open %s with %s: %v\n", path, name, err)
+		return
+	}
+	klog.V(2).Infof("launched %s %v", name, args)
+}
@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// fileOwner is the ownership --output-owner gives the created files. A gid of
+// -1 leaves the group as it is, like chown does for a user without a group.
+type fileOwner struct {
+	spec     string
+	uid, gid int
+}
+
+// lookupUser and lookupGroup read the local user database, swapped in tests.
+var (
+	lookupUser  = user.Lookup
+	lookupGroup = user.LookupGroup
+)
+
+// canChown reports whether the process may give files away, swapped in tests.
+var canChown = hasChownCapability
+
+// chownSupported is unset where files have no numeric owners to give, swapped
+// in tests.
+var chownSupported = runtime.GOOS != "windows"
+
+// capChown is the bit of CAP_CHOWN in the capability sets of the kernel.
+const capChown = 0
+
+// hasChownCapability reports whether CAP_CHOWN is in the effective set of the
+// process where the kernel tells, and whether it runs as root elsewhere.
+func hasChownCapability() bool {
+	if status, err := os.ReadFile("/proc/self/status"); err == nil {
+		if eff, ok := effectiveCapabilities(status); ok {
+			return eff&(1<<capChown) != 0
+		}
+	}
+	return os.Geteuid() == 0
+}
+
+// effectiveCapabilities returns the CapEff line of a /proc/<pid>/status.
+func effectiveCapabilities(status []byte) (uint64, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		eff, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		return eff, err == nil
+	}
+	return 0, false
+}
+
+// parseOwner resolves the user[:group] of --output-owner, by name in the local
+// user database or else as a numeric id.
+func parseOwner(spec string) (*fileOwner, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	if name == "" || hasGroup && group == "" {
+		return nil, fmt.Errorf("invalid --output-owner %q, use user or user:group", spec)
+	}
+	owner := &fileOwner{spec: spec, gid: -1}
+	var err error
+	if owner.uid, err = resolveID(name, "user", func(name string) (string, error) {
+		u, err := lookupUser(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	}); err != nil {
+		return nil, err
+	}
+	if hasGroup {
+		if owner.gid, err = resolveID(group, "group", func(name string) (string, error) {
+			g, err := lookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return owner, nil
+}
+
+// resolveID returns the id of the user or group name, looked up with lookup,
+// or name itself when it is a number the database does not know as a name.
+func resolveID(name, kind string, lookup func(string) (string, error)) (int, error) {
+	id, err := lookup(name)
+	if err != nil {
+		if n, numErr := strconv.Atoi(name); numErr == nil && n >= 0 {
+			return n, nil
+		}
+		return 0, fmt.Errorf("--output-owner: unknown %s %q: %v", kind, name, err)
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, fmt.Errorf("--output-owner: %s %s has no numeric id (%s), ownership can't be set on this platform", kind, name, id)
+	}
+	return n, nil
+}
+
+// resolveOutputOwner checks OutputOwner up front, so a copy as root does not
+// run to the end only to leave the tree owned by root.
+func (o *CopyOptions) resolveOutputOwner() error {
+	if o.OutputOwner == "" {
+		return nil
+	}
+	if !chownSupported {
+		return fmt.Errorf("--output-owner is not supported on %s, whose files have no numeric owners", runtime.GOOS)
+	}
+	owner, err := parseOwner(o.OutputOwner)
+	if err != nil {
+		return err
+	}
+	if !canChown() {
+		return fmt.Errorf("--output-owner needs root or CAP_CHOWN to give the copied files away, run without it or with the privilege")
+	}
+	o.owner = owner
+	return nil
+}
+
+// own records path, created by the copy, to be given to the --output-owner.
+func (o *CopyOptions) own(path string) {
+	if o.owner != nil {
+		o.owned = append(o.owned, path)
+	}
+}
+
+// mkdirAll is os.MkdirAll, recording the directories it creates, parents
+// included, for the --output-owner and to be removed when the copy fails.
+func (o *CopyOptions) mkdirAll(path string, perm os.FileMode) error {
+	var missing []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	if err := os.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	// the outermost first, in the order they were created
+	for i := len(missing) - 1; i >= 0; i-- {
+		o.created = append(o.created, missing[i])
+		if o.owner != nil {
+			o.owned = append(o.owned, missing[i])
+		}
+	}
+	return nil
+}
+
+// applyOwner gives what the copy recorded as created to the --output-owner.
+// Symlinks are never followed. Not being permitted to fails on the first
+// path, as the privilege is missing for all of them, any other path that
+// can't be given away is warned about and left as it is.
+func (o *CopyOptions) applyOwner() error {
+	if o.owner == nil {
+		return nil
+	}
+	if o.warnings == nil {
+		o.warnings = newCopyWarnings(o.IOStreams.ErrOut, o.ShowAllWarnings)
+	}
+	lchown := o.lchown
+	if lchown == nil {
+		lchown = os.Lchown
+	}
+	owned := o.owned
+	o.owned = nil
+	for _, p := range owned {
+		err := lchown(p, o.owner.uid, o.owner.gid)
+		switch {
+		case errors.Is(err, fs.ErrPermission):
+			return fmt.Errorf("could not give %s to %s: operation not permitted (are you root?)", p, o.owner.spec)
+		case err != nil:
+			o.warnings.warn(warnOwner, "could not give %s to %s: %v", p, o.owner.spec, err)
+		}
+	}
+	return nil
+}
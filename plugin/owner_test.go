@@ -0,0 +1,259 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	restclient "k8s.io/client-go/rest"
+)
+
+// withUserDatabase makes the lookups of users and groups answer from users and
+// groups, by name.
+func withUserDatabase(t *testing.T, users, groups map[string]string) {
+	t.Helper()
+	oldUser, oldGroup := lookupUser, lookupGroup
+	t.Cleanup(func() { lookupUser, lookupGroup = oldUser, oldGroup })
+	lookupUser = func(name string) (*user.User, error) {
+		if uid, ok := users[name]; ok {
+			return &user.User{Username: name, Uid: uid}, nil
+		}
+		return nil, user.UnknownUserError(name)
+	}
+	lookupGroup = func(name string) (*user.Group, error) {
+		if gid, ok := groups[name]; ok {
+			return &user.Group{Name: name, Gid: gid}, nil
+		}
+		return nil, user.UnknownGroupError(name)
+	}
+}
+
+func withChownPrivilege(t *testing.T, privileged bool) {
+	t.Helper()
+	old := canChown
+	t.Cleanup(func() { canChown = old })
+	canChown = func() bool { return privileged }
+}
+
+func TestParseOwner(t *testing.T) {
+	withUserDatabase(t, map[string]string{"analyst": "1500", "1600": "1700"}, map[string]string{"forensics": "2500"})
+	tests := []struct {
+		spec     string
+		uid, gid int
+		err      string
+	}{
+		{spec: "analyst", uid: 1500, gid: -1},
+		{spec: "analyst:forensics", uid: 1500, gid: 2500},
+		{spec: "1501:2501", uid: 1501, gid: 2501},
+		{spec: "analyst:2501", uid: 1500, gid: 2501},
+		// a name that looks like a number is still a name
+		{spec: "1600", uid: 1700, gid: -1},
+		{spec: "nobody-here", err: `unknown user "nobody-here"`},
+		{spec: "analyst:nogroup", err: `unknown group "nogroup"`},
+		{spec: "-1", err: `unknown user "-1"`},
+		{spec: "", err: "invalid --output-owner"},
+		{spec: ":forensics", err: "invalid --output-owner"},
+		{spec: "analyst:", err: "invalid --output-owner"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			owner, err := parseOwner(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseOwner(%q) error = %v, want %q", tt.spec, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if owner.uid != tt.uid || owner.gid != tt.gid {
+				t.Fatalf("parseOwner(%q) = %d:%d, want %d:%d", tt.spec, owner.uid, owner.gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
+
+func TestEffectiveCapabilities(t *testing.T) {
+	status := "Name:\tkubectl-rexec\nCapInh:\t0000000000000000\nCapPrm:\t0000000000000001\nCapEff:\t%s\nCapBnd:\t000001ffffffffff\n"
+	for _, tt := range []struct {
+		eff  string
+		want bool
+	}{
+		{"000001ffffffffff", true},
+		{"0000000000000001", true},
+		{"0000000000000000", false},
+		{"0000000000000008", false},
+	} {
+		eff, ok := effectiveCapabilities([]byte(fmt.Sprintf(status, tt.eff)))
+		if !ok || (eff&(1<<capChown) != 0) != tt.want {
+			t.Fatalf("CapEff %s: %x, %v, want CAP_CHOWN %v", tt.eff, eff, ok, tt.want)
+		}
+	}
+	if _, ok := effectiveCapabilities([]byte("Name:\tkubectl-rexec\n")); ok {
+		t.Fatal("a status without CapEff has capabilities")
+	}
+}
+
+func TestOutputOwnerRefusedWithoutPrivilege(t *testing.T) {
+	withUserDatabase(t, map[string]string{"analyst": "1500"}, nil)
+	withChownPrivilege(t, false)
+	o := newFakePodCopyOptions(nil)
+	o.ClientConfig = &restclient.Config{}
+	o.OutputOwner = "analyst"
+	err := o.Validate()
+	if err == nil || !strings.Contains(err.Error(), "needs root or CAP_CHOWN") {
+		t.Fatalf("Validate() = %v, want the missing privilege", err)
+	}
+
+	// an unknown user is refused before the privilege is looked at
+	o.OutputOwner = "nobody-here"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "unknown user") {
+		t.Fatalf("Validate() = %v, want the unknown user", err)
+	}
+}
+
+// extractOwned extracts a tree under dest/deep/er, which don't exist yet,
+// giving it to analyst through lchown.
+func extractOwned(t *testing.T, lchown func(string, int, int) error) (string, string) {
+	t.Helper()
+	withUserDatabase(t, map[string]string{"analyst": "1500"}, map[string]string{"forensics": "2500"})
+	withChownPrivilege(t, true)
+	errOut := &bytes.Buffer{}
+	o := newFakePodCopyOptions(nil)
+	o.ClientConfig = &restclient.Config{}
+	o.IOStreams.ErrOut = errOut
+	o.OutputOwner = "analyst:forensics"
+	o.lchown = lchown
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	dest := mustTempDir(t)
+	tarball := createTestTar(t, map[string]string{"out/a.txt": "a", "out/sub/b.txt": "b"})
+	if _, err := o.extractTar(context.Background(), tarball, filepath.Join(dest, "deep", "er"), "out"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	return dest, errOut.String()
+}
+
+func TestExtractOutputOwner(t *testing.T) {
+	owned := map[string]string{}
+	dest, errOut := extractOwned(t, func(name string, uid, gid int) error {
+		owned[name] = fmt.Sprintf("%d:%d", uid, gid)
+		return nil
+	})
+
+	for _, p := range []string{"deep", "deep/er", "deep/er/a.txt", "deep/er/sub", "deep/er/sub/b.txt"} {
+		if got := owned[filepath.Join(dest, p)]; got != "1500:2500" {
+			t.Fatalf("%s given to %q, want 1500:2500 (given: %v)", p, got, owned)
+		}
+	}
+	// the destination existed before the copy and is left alone
+	if _, ok := owned[dest]; ok || len(owned) != 5 {
+		t.Fatalf("given away %v, want only what the copy created", owned)
+	}
+	if errOut != "" {
+		t.Fatalf("unexpected warnings: %q", errOut)
+	}
+}
+
+func TestExtractOutputOwnerFailuresAreWarnings(t *testing.T) {
+	_, errOut := extractOwned(t, func(name string, _, _ int) error {
+		if strings.HasSuffix(name, ".txt") {
+			return &os.PathError{Op: "lchown", Path: name, Err: errors.New("read-only file system")}
+		}
+		return nil
+	})
+	assertContains(t, errOut, "Warning: could not give ")
+	assertContains(t, errOut, "Warnings: 2 paths not given to the --output-owner")
+}
+
+func TestExtractOutputOwnerChown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("giving files away needs root")
+	}
+	errOut := &bytes.Buffer{}
+	o := newFakePodCopyOptions(nil)
+	o.ClientConfig = &restclient.Config{}
+	o.IOStreams.ErrOut = errOut
+	o.OutputOwner = "65534:65534"
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	dest := mustTempDir(t)
+	tarball := createTestTar(t, map[string]string{"out/sub/b.txt": "b"})
+	if _, err := o.extractTar(context.Background(), tarball, filepath.Join(dest, "deep"), "out"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	if errOut.Len() != 0 {
+		t.Fatalf("unexpected warnings: %q", errOut.String())
+	}
+	for _, p := range []string{"deep", "deep/sub", "deep/sub/b.txt"} {
+		info, err := os.Lstat(filepath.Join(dest, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Uid != 65534 || st.Gid != 65534 {
+			t.Fatalf("%s is owned by %d:%d, want 65534:65534", p, st.Uid, st.Gid)
+		}
+	}
+}
+
+func TestExtractOutputOwnerNotPermitted(t *testing.T) {
+	var calls int
+	o := newFakePodCopyOptions(nil)
+	o.ClientConfig = &restclient.Config{}
+	o.OutputOwner = "1500:2500"
+	o.lchown = func(name string, _, _ int) error {
+		calls++
+		return &os.PathError{Op: "lchown", Path: name, Err: syscall.EPERM}
+	}
+	withChownPrivilege(t, true)
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	dest := mustTempDir(t)
+	tarball := createTestTar(t, map[string]string{"out/a.txt": "a", "out/b.txt": "b"})
+
+	_, err := o.extractTar(context.Background(), tarball, filepath.Join(dest, "deep"), "out")
+	if err == nil || !strings.HasSuffix(err.Error(), "to 1500:2500: operation not permitted (are you root?)") {
+		t.Fatalf("extractTar() error = %v, want operation not permitted", err)
+	}
+	if calls != 1 {
+		t.Errorf("lchown called %d times, want it to stop at the first path", calls)
+	}
+}
+
+func TestOutputOwnerUnsupported(t *testing.T) {
+	old := chownSupported
+	t.Cleanup(func() { chownSupported = old })
+	chownSupported = false
+	withChownPrivilege(t, true)
+
+	o := newRunOptions()
+	o.ClientConfig = &restclient.Config{}
+	o.OutputOwner = "1500"
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "--output-owner is not supported on ") {
+		t.Fatalf("Validate() = %v, want --output-owner rejected", err)
+	}
+}
+
+func TestOwnerFlag(t *testing.T) {
+	cmd := NewCmdCp(nil, genericiooptions.IOStreams{Out: io.Discard, ErrOut: io.Discard})
+	if err := cmd.Flags().Parse([]string{"--owner", "1000:1000"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cmd.Flags().Lookup("output-owner").Value.String(); got != "1000:1000" {
+		t.Errorf("--output-owner = %q, want --owner to set it", got)
+	}
+}
@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ctxReader fails the reads of r once ctx is done, so an extraction stops
+// within the file it is writing when the copy is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// partialError is the failure of an extraction, with what became of the
+// files it created before failing, which would otherwise pass for a complete
+// copy.
+type partialError struct {
+	err  error
+	n    int
+	kept bool
+}
+
+func (e partialError) Error() string {
+	files := "files were"
+	if e.n == 1 {
+		files = "file was"
+	}
+	if e.kept {
+		return fmt.Sprintf("%v; %d partial %s kept (--keep-partial)", e.err, e.n, files)
+	}
+	return fmt.Sprintf("%v; %d partial %s removed", e.err, e.n, files)
+}
+
+func (e partialError) Unwrap() error {
+	return e.err
+}
+
+// creating records targetAbs, about to be extracted, when there is nothing
+// there yet, as created by the copy. Directories are recorded by mkdirAll.
+func (o *CopyOptions) creating(targetAbs string) {
+	if _, err := os.Lstat(targetAbs); os.IsNotExist(err) {
+		o.created = append(o.created, targetAbs)
+	}
+}
+
+// removePartial removes created, what a failed extraction created, and
+// returns how many files it removed. The directories are made writable so
+// what they hold can be removed, and are removed last, the innermost first,
+// once empty.
+func removePartial(created []string) int {
+	var dirs, files []string
+	for _, p := range created {
+		if info, err := os.Lstat(p); err == nil && info.IsDir() {
+			//nolint:errcheck
+			_ = os.Chmod(p, 0o700)
+			dirs = append(dirs, p)
+		} else if err == nil {
+			files = append(files, p)
+		}
+	}
+	removed := 0
+	for _, p := range files {
+		if os.Remove(p) == nil {
+			removed++
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		//nolint:errcheck
+		_ = os.Remove(dirs[i])
+	}
+	return removed
+}
+
+// countPartial returns how many of created, what a failed extraction
+// created, are files that --keep-partial leaves in place.
+func countPartial(created []string) int {
+	n := 0
+	for _, p := range created {
+		if info, err := os.Lstat(p); err == nil && !info.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+// failedExtraction is the error err an extraction failed with, cancelled
+// when ctx is done, which removes the files it created unless KeepPartial,
+// saying how many.
+func (o *CopyOptions) failedExtraction(ctx context.Context, err error, created []string) error {
+	if ctx.Err() != nil {
+		err = copyCancelledError{terminated: true}
+	}
+	if o.KeepPartial {
+		if n := countPartial(created); n > 0 {
+			return partialError{err: err, n: n, kept: true}
+		}
+		return err
+	}
+	if n := removePartial(created); n > 0 {
+		return partialError{err: err, n: n}
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// slowReader serves r a hundred bytes at a time, and cancels the copy once
+// cancelAt bytes were read.
+type slowReader struct {
+	r        io.Reader
+	n        int
+	cancelAt int
+	cancel   context.CancelFunc
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p[:min(len(p), 100)])
+	s.n += n
+	if s.n >= s.cancelAt {
+		s.cancel()
+	}
+	return n, err
+}
+
+func TestExtractCancelledRemovesPartialFiles(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"logs/a.log", "logs/b.log", "logs/c.log"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: 2048}); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, name, err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte("x"), 2048)); err != nil {
+			t.Fatalf(errWriteTarContentForFmt, name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	tests := []struct {
+		name      string
+		keep      bool
+		wantErr   string
+		wantFiles []string
+	}{
+		{
+			name:    "removed",
+			wantErr: "copy cancelled; remote process terminated; 2 partial files were removed",
+		},
+		{
+			name:      "kept",
+			keep:      true,
+			wantErr:   "copy cancelled; remote process terminated; 2 partial files were kept (--keep-partial)",
+			wantFiles: []string{"logs/a.log", "logs/b.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := mustTempDir(t)
+			notes := filepath.Join(dest, "notes.txt")
+			if err := os.WriteFile(notes, []byte("mine\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			o := newRunOptions()
+			o.KeepPartial = tt.keep
+
+			// a.log is written in full, b.log in part
+			_, err := o.extractTar(ctx, &slowReader{r: bytes.NewReader(archive.Bytes()), cancelAt: 3500, cancel: cancel}, dest, "logs")
+			var cancelled copyCancelledError
+			if err == nil || err.Error() != tt.wantErr || !errors.As(err, &cancelled) {
+				t.Fatalf("extractTar() error = %v, want %q", err, tt.wantErr)
+			}
+			var got []string
+			//nolint:errcheck
+			_ = filepath.WalkDir(dest, func(p string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() && p != notes {
+					rel, _ := filepath.Rel(dest, p)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if len(got) != len(tt.wantFiles) || len(got) > 0 && got[0] != tt.wantFiles[0] || len(got) > 1 && got[1] != tt.wantFiles[1] {
+				t.Errorf("left %q, want %q", got, tt.wantFiles)
+			}
+			if _, err := os.Stat(filepath.Join(dest, "logs")); !tt.keep && !os.IsNotExist(err) {
+				t.Errorf("the directory the copy created was left: %v", err)
+			}
+			assertFileContent(t, notes, "mine\n")
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyPlanVersion is bumped whenever a field of copyPlan changes meaning.
+// --entries-from refuses a plan of another version rather than guess.
+const copyPlanVersion = 1
+
+// copyPlan is what `cp --dry-run -o json` prints, and what --entries-from reads
+// back, usually after entries were pruned from it.
+type copyPlan struct {
+	Version   int    `json:"version"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	// RemoteDir is the directory tar runs in; entry paths are relative to it.
+	RemoteDir     string      `json:"remote_dir"`
+	RequestedPath string      `json:"requested_path"`
+	Entries       []planEntry `json:"entries"`
+	// Warnings is what the copy would warn about extracting the entries.
+	Warnings []copyWarning `json:"warnings,omitempty"`
+}
+
+// planEntry is one tar entry a copy would read.
+type planEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Mode int64  `json:"mode"`
+}
+
+// loadCopyPlan reads the plan at file for a copy of remotePath and returns the
+// set of entry paths to copy. Every entry must lie under remotePath.
+func loadCopyPlan(file, remotePath string) (map[string]bool, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --entries-from: %v", err)
+	}
+	var plan copyPlan
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		return nil, fmt.Errorf("invalid --entries-from %s: %v", file, err)
+	}
+	if plan.Version != copyPlanVersion {
+		return nil, fmt.Errorf("--entries-from %s has version %d, only version %d is supported", file, plan.Version, copyPlanVersion)
+	}
+	if path.Clean(plan.RequestedPath) != path.Clean(remotePath) {
+		return nil, fmt.Errorf("--entries-from %s lists entries of %s, not %s", file, plan.RequestedPath, remotePath)
+	}
+	if len(plan.Entries) == 0 {
+		return nil, fmt.Errorf("--entries-from %s lists no entries", file)
+	}
+	root := path.Base(path.Clean(remotePath))
+	selected := make(map[string]bool, len(plan.Entries))
+	for _, e := range plan.Entries {
+		name := path.Clean(e.Path)
+		if path.IsAbs(name) || (name != root && !strings.HasPrefix(name, root+"/")) {
+			return nil, fmt.Errorf("--entries-from %s: entry %q is not under %s", file, e.Path, remotePath)
+		}
+		selected[name] = true
+	}
+	return selected, nil
+}
+
+// missingEntries returns the selected paths the tar in data lacks, sorted.
+func missingEntries(data []byte, selected map[string]bool) ([]string, error) {
+	seen := make(map[string]bool, len(selected))
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tar read error: %v", err)
+		}
+		seen[path.Clean(header.Name)] = true
+	}
+	var missing []string
+	for name := range selected {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// printCopyPlan lists what the tar in data would copy, filtered to the
+// selected entries if there are any, without writing anything locally. The
+// entries a copy would refuse as a path traversal are listed too, and fail the
+// dry run once printed.
+func (o *CopyOptions) printCopyPlan(data []byte, plan copyPlan) error {
+	plan.Version = copyPlanVersion
+	plan.Entries = []planEntry{}
+	warnings := newCopyWarnings(io.Discard, false)
+	warnings.keep = true
+	now := time.Now()
+	var size int64
+	var illegal []string
+	files := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar read error: %v", err)
+		}
+		if metadataEntry(header) {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if o.selected != nil && !o.selected[name] || o.excluded(name) {
+			continue
+		}
+		plan.Entries = append(plan.Entries, planEntry{Path: name, Type: tarTypeName(header.Typeflag), Size: header.Size, Mode: header.Mode & 0o7777})
+		warnings.entry(header, now)
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			files[name] = true
+		case tar.TypeLink:
+			if !files[path.Clean(header.Linkname)] {
+				warnings.hardLinkSkipped(header)
+			}
+		}
+		if _, err := cleanEntryName(header.Name); err != nil {
+			warnings.warn(warnIllegalPath, "%v", err)
+			illegal = append(illegal, header.Name)
+		}
+		if regularEntry(header) {
+			size += header.Size
+		}
+	}
+	plan.Warnings = warnings.all
+	if err := o.writeCopyPlan(plan, size); err != nil {
+		return err
+	}
+	if len(illegal) > 0 {
+		return fmt.Errorf("the copy would be refused, %d entries have illegal paths: %s", len(illegal), strings.Join(illegal, ", "))
+	}
+	return nil
+}
+
+// writeCopyPlan prints plan as JSON with -o json, or else as a table of its
+// entries followed by their count and the size of its files.
+func (o *CopyOptions) writeCopyPlan(plan copyPlan, size int64) error {
+	if o.Output == "json" {
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(o.IOStreams.Out, "%s\n", data)
+		return err
+	}
+	rows := make([][]string, len(plan.Entries))
+	for i, e := range plan.Entries {
+		rows[i] = []string{e.Type, fmt.Sprintf("%04o", e.Mode), strconv.FormatInt(e.Size, 10), e.Path}
+	}
+	cols := []column{{Header: "TYPE"}, {Header: "MODE"}, {Header: "SIZE", Right: true}, {Header: "PATH", TrimLeft: true}}
+	if err := newOutput(o.IOStreams.Out).table(cols, rows); err != nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	if _, err := fmt.Fprintf(o.IOStreams.Out, "Total: %s entries, %s (%d bytes)\n", formatCount(len(plan.Entries)), formatBytes(size), size); err != nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+func writePlan(t *testing.T, plan copyPlan) string {
+	t.Helper()
+	data, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(mustTempDir(t), "plan.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDryRunThenCopySelectedEntries(t *testing.T) {
+	executor := &fakeExecutor{stdout: evidenceTar(t)}
+	o := newFakePodCopyOptions(executor)
+	out := &bytes.Buffer{}
+	o.IOStreams.Out = out
+	o.DryRun, o.Output = true, "json"
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/logs", dest); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+		t.Fatalf("a dry run must not write anything, found %v", entries)
+	}
+	var plan copyPlan
+	if err := json.Unmarshal(out.Bytes(), &plan); err != nil {
+		t.Fatalf("dry run output is not a plan: %v\n%s", err, out)
+	}
+	if plan.Version != copyPlanVersion || plan.Pod != "pod" || plan.Container != "app" || plan.RemoteDir != "/var" || plan.RequestedPath != "/var/logs" || len(plan.Entries) != 4 {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	if e := plan.Entries[1]; e != (planEntry{Path: "logs/app.log", Type: "file", Size: 18, Mode: 0o644}) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	// keep the directory and err.log only
+	var kept []planEntry
+	for _, e := range plan.Entries {
+		if e.Path == "logs" || e.Path == "logs/err.log" {
+			kept = append(kept, e)
+		}
+	}
+	plan.Entries = kept
+
+	o = newFakePodCopyOptions(executor)
+	o.EntriesFrom = writePlan(t, plan)
+	if err := o.RunWithArgs(context.Background(), "pod:/var/logs", dest); err != nil {
+		t.Fatalf("copy of the selected entries: %v", err)
+	}
+	assertFileExists(t, filepath.Join(dest, "logs", "err.log"))
+	assertFileDoesNotExist(t, filepath.Join(dest, "logs", "app.log"))
+}
+
+func TestDryRunTotals(t *testing.T) {
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: createTestTar(t, map[string]string{
+		"log/app.log": "GET / 200\n",
+		"log/gc.log":  strings.Repeat("gc\n", 700),
+	}).Bytes()})
+	out := &bytes.Buffer{}
+	o.IOStreams.Out = out
+	o.DryRun = true
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log", mustTempDir(t)); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	assertContains(t, out.String(), "log/gc.log")
+	if !strings.HasSuffix(out.String(), "Total: 2 entries, 2.1 KiB (2110 bytes)\n") {
+		t.Fatalf("dry run output lacks the totals:\n%s", out)
+	}
+}
+
+func TestDryRunFlagsPathTraversal(t *testing.T) {
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: createTestTar(t, map[string]string{
+		"log/app.log":         "app\n",
+		"log/../../etc/cron":  "* * * * * root sh /tmp/x\n",
+		"../../root/.profile": "sh /tmp/x\n",
+	}).Bytes()})
+	out := &bytes.Buffer{}
+	o.IOStreams.Out = out
+	o.DryRun, o.Output = true, "json"
+	dest := mustTempDir(t)
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/log", dest)
+	if err == nil {
+		t.Fatal("expected the dry run to fail on the illegal paths")
+	}
+	assertContains(t, err.Error(), "the copy would be refused, 2 entries have illegal paths")
+	if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+		t.Fatalf("a dry run must not write anything, found %v", entries)
+	}
+	var plan copyPlan
+	if err := json.Unmarshal(out.Bytes(), &plan); err != nil {
+		t.Fatalf("dry run output is not a plan: %v\n%s", err, out)
+	}
+	if len(plan.Entries) != 3 {
+		t.Fatalf("every entry must be listed, got %+v", plan.Entries)
+	}
+	var flagged int
+	for _, w := range plan.Warnings {
+		if w.Kind == "illegal_path" && strings.Contains(w.Message, "path traversal attempt") {
+			flagged++
+		}
+	}
+	if flagged != 2 {
+		t.Fatalf("warnings = %+v, want both illegal paths flagged", plan.Warnings)
+	}
+}
+
+func TestEntriesFromRemoteChanged(t *testing.T) {
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: evidenceTar(t)})
+	o.EntriesFrom = writePlan(t, copyPlan{Version: copyPlanVersion, RequestedPath: "/var/logs", Entries: []planEntry{
+		{Path: "logs/app.log"}, {Path: "logs/rotated.log.1"}, {Path: "logs/old"},
+	}})
+	dest := mustTempDir(t)
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/logs", dest)
+	if err == nil {
+		t.Fatal("expected an error for entries gone from the pod")
+	}
+	assertContains(t, err.Error(), "2 entries of "+o.EntriesFrom+" no longer exist in pod default/pod: logs/old, logs/rotated.log.1")
+	if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+		t.Fatalf("nothing may be copied when entries are missing, found %v", entries)
+	}
+}
+
+func TestLoadCopyPlanRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		plan    copyPlan
+		wantErr string
+	}{
+		{"other version", copyPlan{Version: 2, RequestedPath: "/var/logs", Entries: []planEntry{{Path: "logs"}}}, "version 2"},
+		{"other root", copyPlan{Version: 1, RequestedPath: "/etc", Entries: []planEntry{{Path: "etc/passwd"}}}, "lists entries of /etc, not /var/logs"},
+		{"no entries", copyPlan{Version: 1, RequestedPath: "/var/logs"}, "lists no entries"},
+		{"outside the root", copyPlan{Version: 1, RequestedPath: "/var/logs", Entries: []planEntry{{Path: "logs/../lib/secret"}}}, "is not under /var/logs"},
+		{"sibling with the same prefix", copyPlan{Version: 1, RequestedPath: "/var/logs", Entries: []planEntry{{Path: "logs-old/app.log"}}}, "is not under /var/logs"},
+		{"absolute", copyPlan{Version: 1, RequestedPath: "/var/logs", Entries: []planEntry{{Path: "/var/logs/app.log"}}}, "is not under /var/logs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadCopyPlan(writePlan(t, tt.plan), "/var/logs")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadCopyPlan() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyValidateDryRunFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(o *CopyOptions)
+		wantErr string
+	}{
+		{"output with chunked", func(o *CopyOptions) { o.Output = "json"; o.Chunked = true }, "-o can't be used with --selector or --chunked"},
+		{"unknown output", func(o *CopyOptions) { o.DryRun, o.Output = true, "yaml" }, "unsupported output format"},
+		{"dry run with manifest", func(o *CopyOptions) { o.DryRun, o.SourcesManifest = true, "m.json" }, "--dry-run can't be used"},
+		{"dry run", func(o *CopyOptions) { o.DryRun, o.Output = true, "json" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.ClientConfig = &restclient.Config{}
+			tt.modify(o)
+			err := o.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
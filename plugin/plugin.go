@@ -2,20 +2,26 @@ package plugin
 
 import (
 	"context"
+	goflag "flag"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/cli-runtime/pkg/genericiooptions"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
 	cliflag "k8s.io/component-base/cli/flag"
+	"k8s.io/klog/v2"
 	"k8s.io/kubectl/pkg/cmd"
 	cmdexec "k8s.io/kubectl/pkg/cmd/exec"
 	"k8s.io/kubectl/pkg/cmd/plugin"
@@ -35,17 +41,112 @@ var MatchVersionKubeConfigFlags *cmdutil.MatchVersionFlags
 
 const (
 	defaultPodExecTimeout = 60 * time.Second
+
+	// rexecAPIGroup is the aggregated API group the rexec server serves.
+	rexecAPIGroup = "audit.adyen.internal"
 )
 
+// RexecAPIVersion is the version of rexecAPIGroup requests are sent to.
+var RexecAPIVersion = "v1beta1"
+
+// changeIDHeader carries ChangeID to the rexec server.
+const changeIDHeader = "X-Rexec-Change-Id"
+
+// ChangeID is the change ticket the sessions are opened for, sent with every
+// request when set.
+var ChangeID string
+
+// withChangeID makes the clients built from config send ChangeID.
+func withChangeID(config *restclient.Config) *restclient.Config {
+	if ChangeID == "" {
+		return config
+	}
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &headerRoundTripper{header: changeIDHeader, value: ChangeID, delegate: rt}
+	})
+	return config
+}
+
+// reasonHeader carries Reason to the rexec server.
+const reasonHeader = "X-Rexec-Reason"
+
+// Reason is why the sessions are opened, sent with every request when set.
+var Reason string
+
+// withReason makes the clients built from config send Reason.
+func withReason(config *restclient.Config) *restclient.Config {
+	if Reason == "" {
+		return config
+	}
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &headerRoundTripper{header: reasonHeader, value: Reason, delegate: rt}
+	})
+	return config
+}
+
+// wrapConfig wraps the clients built from config to send ChangeID and Reason
+// and to hand what the server announces about the sessions to notices.
+func wrapConfig(config *restclient.Config) *restclient.Config {
+	return withSessionNotices(withReason(withChangeID(config)))
+}
+
+// headerRoundTripper sets a header on every request.
+type headerRoundTripper struct {
+	header, value string
+	delegate      http.RoundTripper
+}
+
+func (rt *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = utilnet.CloneRequest(req)
+	req.Header.Set(rt.header, rt.value)
+	return rt.delegate.RoundTrip(req)
+}
+
+// rexecExecPath is the exec subresource of pod in the rexec API.
+func rexecExecPath(namespace, pod string) string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/pods/%s/exec", rexecAPIGroup, RexecAPIVersion, namespace, pod)
+}
+
 func Rexec() {
 	ioStreams := genericiooptions.IOStreams{In: os.Stdin, Out: os.Stdout, ErrOut: os.Stderr}
+	cmds := NewCmdRexec(ioStreams)
+
+	// kubectl 1.26+ completes plugin arguments by running kubectl_complete-rexec,
+	// which may be a link to this binary
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == kubectlCompleteShimName {
+		cmds.SetArgs(append([]string{cobra.ShellCompRequestCmd}, os.Args[1:]...))
+	}
+
+	// errors and their hints are wrapped to the terminal like the rest of
+	// the output
+	cmdutil.BehaviorOnFatal(func(msg string, code int) {
+		if msg != "" {
+			newOutput(os.Stderr).printf("%s\n", strings.TrimSuffix(msg, "\n"))
+		}
+		os.Exit(code)
+	})
+
+	if err := cmds.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// newConfigFlags are the kubectl flags of the plugin, --as among them, whose
+// configs are wrapped with wrapConfig.
+func newConfigFlags(ioStreams genericiooptions.IOStreams) *genericclioptions.ConfigFlags {
+	return genericclioptions.NewConfigFlags(true).WithDeprecatedPasswordFlag().WithDiscoveryBurst(300).WithDiscoveryQPS(50.0).WithWarningPrinter(ioStreams).WithWrapConfigFn(wrapConfig)
+}
+
+// NewCmdRexec builds the rexec root command with all subcommands.
+func NewCmdRexec(ioStreams genericiooptions.IOStreams) *cobra.Command {
 	warningsAsErrors := false
+	notices = newSessionNotices(ioStreams.ErrOut)
 
 	kubectlOptions := cmd.KubectlOptions{
 
 		PluginHandler: cmd.NewDefaultPluginHandler(plugin.ValidPluginFilenamePrefixes),
 		Arguments:     os.Args,
-		ConfigFlags:   genericclioptions.NewConfigFlags(true).WithDeprecatedPasswordFlag().WithDiscoveryBurst(300).WithDiscoveryQPS(50.0).WithWarningPrinter(ioStreams),
+		ConfigFlags:   newConfigFlags(ioStreams),
 		IOStreams:     ioStreams,
 	}
 
@@ -53,17 +154,33 @@ func Rexec() {
 		Use:   "rexec",
 		Short: i18n.T("rexec plugin for kubectl exec"),
 		Long: templates.LongDesc(`
-      provides audited way to perform kubectl exec and cp.`),
+      provides audited way to perform kubectl exec, cp and run.`),
 	}
 
 	cmds.SetGlobalNormalizationFunc(cliflag.WarnWordSepNormalizeFunc)
 
+	// the config file fills in the flags the command line left out
+	cmds.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		cmdutil.CheckErr(applyUserConfig(cmd))
+	}
+
 	flags := cmds.PersistentFlags()
 
 	flags.BoolVar(&warningsAsErrors, "warnings-as-errors", warningsAsErrors, "Treat warnings received from the server as errors and exit with a non-zero exit code")
+	flags.StringVar(&RexecAPIVersion, "rexec-api-version", RexecAPIVersion, "Version of the "+rexecAPIGroup+" API to send requests to")
+	flags.IntVar(&OutputWidth, "width", 0, "Width tables are truncated and messages wrapped to (default the width of the terminal, or $COLUMNS)")
+	flags.StringVar(&ChangeID, "change-id", "", "Change ticket the session is opened for, required by the rexec server in some namespaces")
+	flags.StringVar(&Reason, "reason", "", "Why the session is opened, passed on to the authorization webhook of the rexec server")
 
 	kubectlOptions.ConfigFlags.AddFlags(flags)
 
+	// expose klog verbosity as -v like kubectl does, verbose plugin output
+	// is logged through klog.V
+	if goflag.CommandLine.Lookup("v") == nil {
+		klog.InitFlags(nil)
+	}
+	flags.AddGoFlag(goflag.CommandLine.Lookup("v"))
+
 	MatchVersionKubeConfigFlags = cmdutil.NewMatchVersionFlags(kubectlOptions.ConfigFlags)
 	MatchVersionKubeConfigFlags.AddFlags(flags)
 
@@ -94,8 +211,19 @@ func Rexec() {
 		Run: func(cmd *cobra.Command, args []string) {
 			argsLenAtDash := cmd.ArgsLenAtDash()
 			cmdutil.CheckErr(roptions.ExecOptions.Complete(f, cmd, args, argsLenAtDash))
+			logTarget(f, cmd, roptions.ExecOptions.Config)
 			cmdutil.CheckErr(roptions.ExecOptions.Validate())
-			cmdutil.CheckErr(roptions.rexecRun(cmd.Context()))
+			err := roptions.rexecRun(cmd.Context())
+			if !roptions.ExecOptions.Quiet {
+				printAuditSessions(kubectlOptions.IOStreams.ErrOut)
+			}
+			if code, message, ok := remoteExitCode(err); ok {
+				if message != "" {
+					newOutput(kubectlOptions.IOStreams.ErrOut).printf("error: %s\n", message)
+				}
+				os.Exit(code)
+			}
+			cmdutil.CheckErr(explainClockSkew(cmd.Context(), err, roptions.ExecOptions.Config))
 		},
 	}
 
@@ -112,10 +240,20 @@ func Rexec() {
 	// Add both commands
 	cmds.AddCommand(newExec)
 	cmds.AddCommand(NewCmdCp(f, kubectlOptions.IOStreams))
-
-	if err := cmds.Execute(); err != nil {
-		os.Exit(1)
+	cmds.AddCommand(NewCmdRun(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(NewCmdCheckpointCp(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(NewCmdCompletion(kubectlOptions.IOStreams))
+	cmds.AddCommand(NewCmdConfig(kubectlOptions.IOStreams))
+	cmds.CompletionOptions.DisableDefaultCmd = true
+
+	namespace := func() string {
+		namespace, _, _ := f.ToRawKubeConfigLoader().Namespace()
+		return namespace
 	}
+	registerFlagCompletions(cmds, completionClientsetFunc(f), namespace)
+	registerCpArgCompletions(cmds, completionCopyOptionsFunc(f), namespace)
+
+	return cmds
 }
 
 type RexecOptoins struct {
@@ -150,7 +288,9 @@ func NewRexecOptions(e *cmdexec.ExecOptions) *RexecOptoins {
 func (r *RexecOptoins) rexecRun(ctx context.Context) error {
 	var err error
 	if len(r.PodName) != 0 {
+		start := time.Now()
 		r.Pod, err = r.PodClient.Pods(r.ExecOptions.Namespace).Get(ctx, r.ExecOptions.PodName, metav1.GetOptions{})
+		logPodGet(r.ExecOptions.Namespace, r.ExecOptions.PodName, start)
 		if err != nil {
 			return err
 		}
@@ -192,12 +332,17 @@ func (r *RexecOptoins) rexecRun(ctx context.Context) error {
 		}
 		containerName = container.Name
 	}
+	klog.V(2).Infof("resolved container %s of pod %s/%s", containerName, pod.Namespace, pod.Name)
 
 	t := r.ExecOptions.SetupTTY()
 
 	var sizeQueue remotecommand.TerminalSizeQueue
 	if t.Raw {
-		sizeQueue = &terminalSizeQueueAdapter{delegate: t.MonitorSize(t.GetSize())}
+		// sends the initial size, then one per SIGWINCH, which only a TTY
+		// session watches for; nil when stdout is no terminal to size
+		if monitor := t.MonitorSize(t.GetSize()); monitor != nil {
+			sizeQueue = &terminalSizeQueueAdapter{delegate: monitor}
+		}
 
 		r.ExecOptions.ErrOut = nil
 	}
@@ -208,7 +353,7 @@ func (r *RexecOptoins) rexecRun(ctx context.Context) error {
 			return err
 		}
 
-		req := restClient.Post().RequestURI(fmt.Sprintf("apis/audit.adyen.internal/v1beta1/namespaces/%s/pods/%s/exec", pod.Namespace, pod.Name))
+		req := restClient.Post().RequestURI(rexecExecPath(pod.Namespace, pod.Name))
 		req.VersionedParams(&corev1.PodExecOptions{
 			Container: containerName,
 			Command:   r.ExecOptions.Command,
@@ -218,7 +363,10 @@ func (r *RexecOptoins) rexecRun(ctx context.Context) error {
 			TTY:       t.Raw,
 		}, scheme.ParameterCodec)
 
-		return r.ExecOptions.Executor.Execute(req.URL(), r.ExecOptions.Config, r.ExecOptions.In, r.ExecOptions.Out, r.ExecOptions.ErrOut, t.Raw, sizeQueue)
+		done := logExec("POST", req.URL().String(), pod, containerName, r.ExecOptions.Command)
+		err = r.ExecOptions.Executor.Execute(req.URL(), r.ExecOptions.Config, r.ExecOptions.In, r.ExecOptions.Out, r.ExecOptions.ErrOut, t.Raw, sizeQueue)
+		done(err)
+		return err
 	}
 
 	if err := t.Safe(fn); err != nil {
@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/kubectl/pkg/util/term"
+)
+
+func TestWithChangeIDSetsHeader(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(changeIDHeader))
+	}))
+	defer srv.Close()
+
+	old := ChangeID
+	defer func() { ChangeID = old }()
+	for _, changeID := range []string{"", "CHG1234567"} {
+		ChangeID = changeID
+		client, err := restclient.HTTPClientFor(withChangeID(&restclient.Config{Host: srv.URL}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	if len(got) != 2 || got[0] != "" || got[1] != "CHG1234567" {
+		t.Fatalf("change ID headers sent = %q, want none then CHG1234567", got)
+	}
+}
+
+func TestWithReasonSetsHeader(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(reasonHeader))
+	}))
+	defer srv.Close()
+
+	old := Reason
+	defer func() { Reason = old }()
+	for _, reason := range []string{"", "INC-42 payments stuck"} {
+		Reason = reason
+		client, err := restclient.HTTPClientFor(withReason(&restclient.Config{Host: srv.URL}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	if len(got) != 2 || got[0] != "" || got[1] != "INC-42 payments stuck" {
+		t.Fatalf("reason headers sent = %q, want none then INC-42 payments stuck", got)
+	}
+}
+
+// sizeQueue is a term.TerminalSizeQueue answering sizes, then nil once the
+// terminal is gone.
+type sizeQueue struct {
+	sizes []term.TerminalSize
+}
+
+func (q *sizeQueue) Next() *term.TerminalSize {
+	if len(q.sizes) == 0 {
+		return nil
+	}
+	next := q.sizes[0]
+	q.sizes = q.sizes[1:]
+	return &next
+}
+
+func TestTerminalSizeQueueAdapter(t *testing.T) {
+	a := &terminalSizeQueueAdapter{delegate: &sizeQueue{sizes: []term.TerminalSize{{Width: 80, Height: 24}, {Width: 132, Height: 43}}}}
+	for _, want := range []remotecommand.TerminalSize{{Width: 80, Height: 24}, {Width: 132, Height: 43}} {
+		if got := a.Next(); got == nil || *got != want {
+			t.Fatalf("Next() = %v, want %v", got, want)
+		}
+	}
+	if got := a.Next(); got != nil {
+		t.Fatalf("Next() = %v once the terminal is gone, want nil", got)
+	}
+}
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// podGoneTimeout bounds the lookup of the pod after a copy from it failed.
+const podGoneTimeout = 10 * time.Second
+
+// podGoneError is the failure of a copy from a pod that was deleted, evicted
+// or stopped while the copy streamed from it, which the stream error err
+// shows only as the command terminating.
+type podGoneError struct {
+	pod      string
+	what     string
+	received int64
+	err      error
+}
+
+func (e podGoneError) Error() string {
+	return fmt.Sprintf("pod %s %s during the copy, after %s were received: the copy is incomplete", e.pod, e.what, formatBytes(e.received))
+}
+
+func (e podGoneError) Unwrap() error {
+	return e.err
+}
+
+// podGone looks up pod again after the copy from it failed with execErr,
+// having received received bytes, and returns a podGoneError when it no
+// longer runs: it was deleted, replaced by a pod of the same name, evicted,
+// is being deleted or has stopped. It returns nil when the pod still runs or
+// can't be looked up, leaving execErr to explain the failure.
+func (o *CopyOptions) podGone(ctx context.Context, pod *corev1.Pod, received int64, execErr error) error {
+	klog.V(2).Infof("copy from pod %s/%s failed after %d bytes: %v", pod.Namespace, pod.Name, received, execErr)
+	ctx, cancel := context.WithTimeout(ctx, podGoneTimeout)
+	defer cancel()
+	current, err := o.Clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	var what string
+	switch {
+	case apierrors.IsNotFound(err):
+		what = "was deleted"
+	case err != nil:
+		klog.V(2).Infof("looking up pod %s/%s after the failed copy failed: %v", pod.Namespace, pod.Name, err)
+		return nil
+	case pod.UID != "" && current.UID != pod.UID:
+		what = "was deleted and replaced"
+	case current.Status.Reason == "Evicted":
+		what = "was evicted"
+		if current.Status.Message != "" {
+			what += fmt.Sprintf(" (%s)", current.Status.Message)
+		}
+	case current.DeletionTimestamp != nil:
+		what = "was deleted"
+	case current.Status.Phase != corev1.PodRunning:
+		what = fmt.Sprintf("stopped running (%s)", current.Status.Phase)
+	default:
+		return nil
+	}
+	return podGoneError{pod: pod.Namespace + "/" + pod.Name, what: what, received: received, err: execErr}
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podChangingExecutor changes the pod it copies from once while the copy
+// runs, before failing as fakeExecutor does.
+type podChangingExecutor struct {
+	fakeExecutor
+	change  func() error
+	changed bool
+}
+
+func (e *podChangingExecutor) Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	if !e.changed {
+		e.changed = true
+		if err := e.change(); err != nil {
+			return err
+		}
+	}
+	return e.fakeExecutor.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func TestCopyFromPodGone(t *testing.T) {
+	streamErr := errors.New("error stream: command terminated with exit code 137")
+	updatePod := func(clientset kubernetes.Interface, update func(*corev1.Pod)) error {
+		pods := clientset.CoreV1().Pods("default")
+		pod, err := pods.Get(context.Background(), "pod", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		update(pod)
+		_, err = pods.Update(context.Background(), pod, metav1.UpdateOptions{})
+		return err
+	}
+	tests := []struct {
+		name   string
+		change func(kubernetes.Interface) error
+		want   string
+	}{
+		{
+			name: "deleted",
+			change: func(clientset kubernetes.Interface) error {
+				return clientset.CoreV1().Pods("default").Delete(context.Background(), "pod", metav1.DeleteOptions{})
+			},
+			want: "pod default/pod was deleted during the copy, after 2.0 KiB were received: the copy is incomplete",
+		},
+		{
+			name: "replaced",
+			change: func(clientset kubernetes.Interface) error {
+				return updatePod(clientset, func(pod *corev1.Pod) { pod.UID = "4b5a6978-uid" })
+			},
+			want: "pod default/pod was deleted and replaced during the copy",
+		},
+		{
+			name: "evicted",
+			change: func(clientset kubernetes.Interface) error {
+				return updatePod(clientset, func(pod *corev1.Pod) {
+					pod.Status = corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted", Message: "The node was low on resource: memory."}
+				})
+			},
+			want: "pod default/pod was evicted (The node was low on resource: memory.) during the copy",
+		},
+		{
+			name: "terminating",
+			change: func(clientset kubernetes.Interface) error {
+				return updatePod(clientset, func(pod *corev1.Pod) { pod.DeletionTimestamp = &metav1.Time{} })
+			},
+			want: "pod default/pod was deleted during the copy",
+		},
+		{
+			name: "stopped",
+			change: func(clientset kubernetes.Interface) error {
+				return updatePod(clientset, func(pod *corev1.Pod) { pod.Status.Phase = corev1.PodFailed })
+			},
+			want: "pod default/pod stopped running (Failed) during the copy",
+		},
+		{
+			name:   "still running",
+			change: func(kubernetes.Interface) error { return nil },
+			want:   "pod default/pod: command failed: error stream: command terminated with exit code 137",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executor := &podChangingExecutor{fakeExecutor: fakeExecutor{stdout: make([]byte, 2048), err: streamErr}}
+			o := newFakePodCopyOptions(executor)
+			executor.change = func() error { return tt.change(o.Clientset) }
+
+			err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t))
+			if err == nil {
+				t.Fatal("RunWithArgs() succeeded")
+			}
+			assertContains(t, err.Error(), tt.want)
+			if !errors.Is(err, streamErr) && tt.name != "still running" {
+				t.Errorf("RunWithArgs() error = %v, doesn't wrap the stream error", err)
+			}
+		})
+	}
+}
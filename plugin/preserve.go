@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+)
+
+// preservedDir is a directory of the archive whose modification time, and
+// mode when restoreMode is set, are restored once every entry is extracted:
+// until then it stays writable, and writing its entries changes its time.
+type preservedDir struct {
+	path        string
+	header      *tar.Header
+	mode        os.FileMode
+	restoreMode bool
+}
+
+// startPreserving prepares an extraction with --preserve. The owners of the
+// archive are only restored with root or CAP_CHOWN, a warning says so once
+// otherwise.
+func (o *CopyOptions) startPreserving() {
+	o.preservedDirs = nil
+	o.chownPreserved = canChown()
+	if !o.chownPreserved {
+		//nolint:errcheck
+		_, _ = fmt.Fprintln(o.IOStreams.ErrOut, "Warning: --preserve keeps modes and times only, restoring the owners of the copied files needs root or CAP_CHOWN")
+	}
+}
+
+// preserveDir creates the directory of header, writable by its owner until
+// restoreDirs gives it its mode.
+func (o *CopyOptions) preserveDir(targetAbs string, header *tar.Header, mode os.FileMode) error {
+	if err := o.mkdirAll(targetAbs, mode|0o700); err != nil {
+		return err
+	}
+	if err := os.Chmod(targetAbs, mode|0o700); err != nil {
+		return err
+	}
+	o.preserveOwner(targetAbs, header)
+	o.preservedDirs = append(o.preservedDirs, preservedDir{path: targetAbs, header: header, mode: mode, restoreMode: true})
+	return nil
+}
+
+// preserveFile gives the extracted file of header its owner, its mode
+// regardless of the umask, and its modification time.
+func (o *CopyOptions) preserveFile(targetAbs string, header *tar.Header, mode os.FileMode) {
+	// chown before chmod, which it may reset, and before setting the
+	// attributes, as it clears the file capabilities
+	o.preserveOwner(targetAbs, header)
+	o.applyXattrs(targetAbs, header)
+	if err := os.Chmod(targetAbs, mode); err != nil {
+		o.warnings.warn(warnPreserve, "could not set the mode of %s to %04o: %v", targetAbs, mode, err)
+	}
+	o.preserveTime(targetAbs, header)
+}
+
+// restoreDirs gives the extracted directories their times, and the modes
+// they were created without, the innermost first so restoring one does not
+// change the time of another or lock the way to it.
+func (o *CopyOptions) restoreDirs() {
+	for i := len(o.preservedDirs) - 1; i >= 0; i-- {
+		d := o.preservedDirs[i]
+		if !o.NoPreserveTimes {
+			o.preserveTime(d.path, d.header)
+		}
+		if !d.restoreMode {
+			continue
+		}
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			o.warnings.warn(warnPreserve, "could not set the mode of %s to %04o: %v", d.path, d.mode, err)
+		}
+	}
+	o.preservedDirs = nil
+}
+
+func (o *CopyOptions) preserveTime(targetAbs string, header *tar.Header) {
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	if err := os.Chtimes(targetAbs, atime, header.ModTime); err != nil {
+		o.warnings.warn(warnPreserve, "could not set the time of %s: %v", targetAbs, err)
+	}
+}
+
+// preserveOwner gives targetAbs the numeric owner of header, names being
+// meaningless outside the container.
+func (o *CopyOptions) preserveOwner(targetAbs string, header *tar.Header) {
+	if !o.chownPreserved {
+		return
+	}
+	lchown := o.lchown
+	if lchown == nil {
+		lchown = os.Lchown
+	}
+	if err := lchown(targetAbs, header.Uid, header.Gid); err != nil {
+		o.warnings.warn(warnPreserve, "could not give %s to %d:%d: %v", targetAbs, header.Uid, header.Gid, err)
+	}
+}
@@ -0,0 +1,332 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+// preservedTree is an archive of read-only directories and files, owned by
+// 1000:2000, with the times of its entries.
+func preservedTree(t *testing.T) (*bytes.Buffer, map[string]time.Time) {
+	t.Helper()
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	entries := []struct {
+		name    string
+		mode    int64
+		content string
+	}{
+		{"out/", 0o555, ""},
+		{"out/key", 0o400, "secret"},
+		{"out/ro/", 0o555, ""},
+		{"out/ro/data", 0o644, "data"},
+	}
+	times := map[string]time.Time{}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: e.mode, Size: int64(len(e.content)), Uid: 1000, Gid: 2000, ModTime: base.Add(time.Duration(i) * time.Hour)}
+		h.Typeflag = tar.TypeReg
+		if strings.HasSuffix(e.name, "/") {
+			h.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+		times[strings.TrimSuffix(e.name, "/")] = h.ModTime
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf, times
+}
+
+// mustWritableTempDir is a temporary directory whose directories get their
+// owner write bit back before it is removed, which read-only directories
+// would outlive otherwise.
+func mustWritableTempDir(t *testing.T) string {
+	t.Helper()
+	dest := mustTempDir(t)
+	t.Cleanup(func() {
+		_ = filepath.WalkDir(dest, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				_ = os.Chmod(p, 0o755)
+			}
+			return nil
+		})
+	})
+	return dest
+}
+
+// extractPreserved extracts preservedTree into a new directory, recording
+// what lchown is asked.
+func extractPreserved(t *testing.T, privileged bool, modify func(*CopyOptions)) (string, map[string]string, map[string]time.Time, string) {
+	t.Helper()
+	withChownPrivilege(t, privileged)
+	dest := mustWritableTempDir(t)
+	owned := map[string]string{}
+	var errOut bytes.Buffer
+	o := newFakePodCopyOptions(nil)
+	o.IOStreams.ErrOut = &errOut
+	modify(o)
+	o.lchown = func(name string, uid, gid int) error {
+		rel, _ := filepath.Rel(dest, name)
+		owned[rel] = fmt.Sprintf("%d:%d", uid, gid)
+		return nil
+	}
+	tarball, times := preservedTree(t)
+	if _, err := o.extractTar(context.Background(), tarball, dest, "out"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	return dest, owned, times, errOut.String()
+}
+
+func TestExtractPreserve(t *testing.T) {
+	dest, owned, times, errOut := extractPreserved(t, true, func(o *CopyOptions) { o.Preserve = true })
+
+	modes := map[string]os.FileMode{"out": 0o555, "out/key": 0o400, "out/ro": 0o555, "out/ro/data": 0o644}
+	for p, mode := range modes {
+		info, err := os.Stat(filepath.Join(dest, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("mode of %s = %04o, want %04o", p, info.Mode().Perm(), mode)
+		}
+		if !info.ModTime().Equal(times[p]) {
+			t.Errorf("time of %s = %s, want %s", p, info.ModTime(), times[p])
+		}
+	}
+	want := map[string]string{"out": "1000:2000", "out/key": "1000:2000", "out/ro": "1000:2000", "out/ro/data": "1000:2000"}
+	if !reflect.DeepEqual(owned, want) {
+		t.Errorf("owners = %v, want %v", owned, want)
+	}
+	if errOut != "" {
+		t.Errorf("unexpected warnings: %q", errOut)
+	}
+}
+
+func TestExtractPreserveAgain(t *testing.T) {
+	withChownPrivilege(t, false)
+	dest := mustTempDir(t)
+	t.Cleanup(func() {
+		_ = filepath.WalkDir(dest, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				_ = os.Chmod(p, 0o755)
+			}
+			return nil
+		})
+	})
+	extract := func() {
+		t.Helper()
+		o := newFakePodCopyOptions(nil)
+		o.Preserve = true
+		tarball, _ := preservedTree(t)
+		if _, err := o.extractTar(context.Background(), tarball, dest, "out"); err != nil {
+			t.Fatalf(errExtractTar, err)
+		}
+	}
+
+	// the second time over the 0400 key in its 0555 directory
+	extract()
+	extract()
+	key := filepath.Join(dest, "out", "key")
+	if info, err := os.Stat(key); err != nil || info.Mode().Perm() != 0o400 {
+		t.Errorf("out/key = %v, %v, want mode 0400", info, err)
+	}
+	assertFileContent(t, key, "secret")
+	if info, err := os.Stat(filepath.Join(dest, "out")); err != nil || info.Mode().Perm() != 0o555 {
+		t.Errorf("out = %v, %v, want mode 0555", info, err)
+	}
+}
+
+func TestRemoveReadOnly(t *testing.T) {
+	dir := mustTempDir(t)
+	for name, mode := range map[string]os.FileMode{"key": 0o400, "locked": 0, "log": 0o644} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := removeReadOnly(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertFileDoesNotExist(t, filepath.Join(dir, "key"))
+	assertFileDoesNotExist(t, filepath.Join(dir, "locked"))
+	// a writable file is truncated in place
+	assertFileExists(t, filepath.Join(dir, "log"))
+	if err := removeReadOnly(filepath.Join(dir, "missing")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractPreserveWithoutPrivilege(t *testing.T) {
+	dest, owned, times, errOut := extractPreserved(t, false, func(o *CopyOptions) { o.Preserve = true })
+	if len(owned) != 0 {
+		t.Errorf("owners given without the privilege: %v", owned)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "out", "ro")); err != nil || info.Mode().Perm() != 0o555 || !info.ModTime().Equal(times["out/ro"]) {
+		t.Errorf("out/ro = %v, %v, want mode 0555 and time %s", info, err, times["out/ro"])
+	}
+	want := "Warning: --preserve keeps modes and times only, restoring the owners of the copied files needs root or CAP_CHOWN\n"
+	if errOut != want {
+		t.Errorf("warnings = %q, want %q", errOut, want)
+	}
+}
+
+func TestExtractWithoutPreserve(t *testing.T) {
+	dest, owned, times, _ := extractPreserved(t, true, func(*CopyOptions) {})
+	if len(owned) != 0 {
+		t.Errorf("owners given without --preserve: %v", owned)
+	}
+	// the times are kept all the same, to the second
+	for p, want := range times {
+		info, err := os.Stat(filepath.Join(dest, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.ModTime().Truncate(time.Second); !got.Equal(want) {
+			t.Errorf("time of %s = %s, want %s", p, got, want)
+		}
+	}
+}
+
+func TestExtractReadOnlyDirectories(t *testing.T) {
+	for name, modify := range map[string]func(*CopyOptions){
+		"times":             func(*CopyOptions) {},
+		"no-preserve-times": func(o *CopyOptions) { o.NoPreserveTimes = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// created writable, the files in the 0555 directories can be
+			// written, which only a non-root run of the test can tell
+			dest, _, _, errOut := extractPreserved(t, false, modify)
+			assertFileContent(t, filepath.Join(dest, "out", "key"), "secret")
+			assertFileContent(t, filepath.Join(dest, "out", "ro", "data"), "data")
+			for _, p := range []string{"out", "out/ro"} {
+				info, err := os.Stat(filepath.Join(dest, p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != 0o555 {
+					t.Errorf("mode of %s = %04o, want 0555", p, info.Mode().Perm())
+				}
+			}
+			if errOut != "" {
+				t.Errorf("unexpected warnings: %q", errOut)
+			}
+		})
+	}
+}
+
+// removeFromReadOnly removes path from its read-only directory.
+func removeFromReadOnly(t *testing.T, path string) {
+	t.Helper()
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, info.Mode().Perm()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractReadOnlyDirectoriesTwice(t *testing.T) {
+	for name, modify := range map[string]func(*CopyOptions){
+		"overwrite":     func(*CopyOptions) {},
+		"skip-existing": func(o *CopyOptions) { o.SkipExisting = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the 0555 directories left by the first run are opened up for
+			// the second, which only a non-root run of the test can tell
+			dest := mustWritableTempDir(t)
+			for run := 1; run <= 2; run++ {
+				o := newFakePodCopyOptions(nil)
+				modify(o)
+				tarball, _ := preservedTree(t)
+				if _, err := o.extractTar(context.Background(), tarball, dest, "out"); err != nil {
+					t.Fatalf("run %d: extractTar error: %v", run, err)
+				}
+				if run == 1 {
+					// as a first run failing before it wrote out/ro/data
+					removeFromReadOnly(t, filepath.Join(dest, "out", "ro", "data"))
+				}
+			}
+			assertFileContent(t, filepath.Join(dest, "out", "ro", "data"), "data")
+			for _, p := range []string{"out", "out/ro"} {
+				info, err := os.Stat(filepath.Join(dest, p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != 0o555 {
+					t.Errorf("mode of %s = %04o, want 0555", p, info.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func TestExtractNoPreserveTimes(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	dest, _, _, _ := extractPreserved(t, true, func(o *CopyOptions) { o.NoPreserveTimes = true })
+	for _, p := range []string{"out", "out/ro", "out/ro/data"} {
+		info, err := os.Stat(filepath.Join(dest, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ModTime().Before(start) {
+			t.Errorf("time of %s = %s, want the time of the copy with --no-preserve-times", p, info.ModTime())
+		}
+	}
+}
+
+func TestValidatePreserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*CopyOptions)
+		wantErr string
+	}{
+		{"alone", func(o *CopyOptions) {}, ""},
+		{"dry run", func(o *CopyOptions) { o.DryRun = true }, "--preserve can't be used"},
+		{"chunked", func(o *CopyOptions) { o.Chunked = true }, "--preserve can't be used"},
+		{"output owner", func(o *CopyOptions) { o.OutputOwner = "analyst" }, "--preserve can't be used"},
+		{"no preserve times", func(o *CopyOptions) { o.NoPreserveTimes = true }, "can't be used with --no-preserve-times"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newFakePodCopyOptions(nil)
+			o.ClientConfig = &restclient.Config{}
+			o.ChunkSize = defaultChunkSize
+			o.Preserve = true
+			tt.modify(o)
+			err := o.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progressAuto   = "auto"
+	progressAlways = "always"
+	progressNever  = "never"
+)
+
+// progressNow is time.Now unless replaced by tests.
+var progressNow = time.Now
+
+// progressInterval is how often the progress line is redrawn on a terminal,
+// progressLineInterval how often a line is printed elsewhere, where every
+// report stays in the output.
+var (
+	progressInterval     = time.Second
+	progressLineInterval = 10 * time.Second
+)
+
+// progressRateWindow is how far back the rate of the progress is averaged
+// over, so it does not jump with every burst of the stream.
+const progressRateWindow = 10 * time.Second
+
+// transferProgress counts the bytes a copy receives and, when reporting,
+// prints how many came in how long to w until stop is called. With the total
+// the copy is expected to be, it prints how far along it is and an ETA.
+type transferProgress struct {
+	w     io.Writer
+	tty   bool
+	start time.Time
+	n     atomic.Int64
+	total int64
+
+	// samples are the counts reported over the last progressRateWindow, the
+	// oldest at least that old once the copy ran that long.
+	samples []progressSample
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+	done     chan struct{}
+}
+
+// progressSample is the count of a transfer at a time.
+type progressSample struct {
+	at time.Time
+	n  int64
+}
+
+// reportingProgress reports whether the progress of a copy is printed, as
+// --progress asks: always, never, or on a terminal only.
+func (o *CopyOptions) reportingProgress() bool {
+	_, tty := terminalFd(o.IOStreams.ErrOut)
+	return o.Progress == progressAlways || o.Progress != progressNever && tty
+}
+
+// startProgress starts counting the bytes of a copy, reported as --progress
+// asks, out of the size du estimated when it is known. A compressed archive
+// is smaller by an unknown share, its progress has no total.
+func (o *CopyOptions) startProgress() *transferProgress {
+	_, tty := terminalFd(o.IOStreams.ErrOut)
+	p := &transferProgress{w: o.IOStreams.ErrOut, tty: tty, start: progressNow(), stopped: make(chan struct{}), done: make(chan struct{})}
+	if !o.compressing() {
+		p.total = o.estimatedSize
+	}
+	o.progress = p
+	if !o.reportingProgress() {
+		close(p.done)
+		return p
+	}
+	interval := progressLineInterval
+	if tty {
+		interval = progressInterval
+	}
+	go p.run(interval)
+	return p
+}
+
+func (p *transferProgress) run(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopped:
+			if p.tty {
+				// the line is replaced by the summary of the copy
+				//nolint:errcheck
+				_, _ = io.WriteString(p.w, "\r\x1b[K")
+			}
+			return
+		case <-ticker.C:
+			p.report()
+		}
+	}
+}
+
+// report prints the progress so far, over the previous report on a terminal.
+func (p *transferProgress) report() {
+	line := "Received " + p.line()
+	if p.tty {
+		//nolint:errcheck
+		_, _ = fmt.Fprintf(p.w, "\r\x1b[K%s", line)
+		return
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintln(p.w, line)
+}
+
+// summary is the bytes received so far, in how long and at what rate.
+func (p *transferProgress) summary() string {
+	n, elapsed := p.n.Load(), p.elapsed()
+	s := fmt.Sprintf("%s in %s", formatBytes(n), elapsed.Round(100*time.Millisecond))
+	if elapsed > 0 {
+		s += fmt.Sprintf(", %s/s", formatBytes(int64(float64(n)/elapsed.Seconds())))
+	}
+	return s
+}
+
+// line is the progress so far: the bytes received out of the total, how far
+// along that is, the rate over the last progressRateWindow and when the copy
+// should be done, as 1.2 GiB / 4.0 GiB (30%), 28.0 MiB/s, ETA 1m42s. Without a
+// total, or once it is past the estimate, it is the bytes received so far, in
+// how long and at what rate.
+func (p *transferProgress) line() string {
+	n, now := p.n.Load(), progressNow()
+	if len(p.samples) == 0 {
+		p.samples = []progressSample{{at: p.start}}
+	}
+	p.samples = append(p.samples, progressSample{at: now, n: n})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= progressRateWindow {
+		p.samples = p.samples[1:]
+	}
+	var rate float64
+	if oldest := p.samples[0]; now.After(oldest.at) {
+		rate = float64(n-oldest.n) / now.Sub(oldest.at).Seconds()
+	}
+	if p.total <= 0 || n > p.total {
+		s := fmt.Sprintf("%s in %s", formatBytes(n), now.Sub(p.start).Round(100*time.Millisecond))
+		if now.After(p.start) {
+			s += fmt.Sprintf(", %s/s", formatBytes(int64(rate)))
+		}
+		return s
+	}
+	s := fmt.Sprintf("%s / %s (%d%%), %s/s", formatBytes(n), formatBytes(p.total), n*100/p.total, formatBytes(int64(rate)))
+	if rate > 0 {
+		eta := time.Duration(float64(p.total-n) / rate * float64(time.Second))
+		s += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return s
+}
+
+// elapsed is how long ago the transfer started.
+func (p *transferProgress) elapsed() time.Duration {
+	return progressNow().Sub(p.start)
+}
+
+// stop ends the reports, clearing the progress line on a terminal.
+func (p *transferProgress) stop() {
+	p.stopOnce.Do(func() { close(p.stopped) })
+	<-p.done
+}
+
+// counting returns w counting what is written through it.
+func (p *transferProgress) counting(w io.Writer) io.Writer {
+	return &progressWriter{w: w, n: &p.n}
+}
+
+// progressWriter counts the bytes written through it, safe to read while
+// being written.
+type progressWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *progressWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// formatBytes formats n bytes for people, 512 B or 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
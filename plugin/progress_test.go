@@ -0,0 +1,239 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// withProgressClock stops progressNow at a fixed time, moved on by storing
+// the time elapsed since in the returned value.
+func withProgressClock(t *testing.T) *atomic.Int64 {
+	var elapsed atomic.Int64
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	old := progressNow
+	t.Cleanup(func() { progressNow = old })
+	progressNow = func() time.Time { return start.Add(time.Duration(elapsed.Load())) }
+	return &elapsed
+}
+
+func TestProgressWriter(t *testing.T) {
+	p := &transferProgress{}
+	var buf bytes.Buffer
+	w := p.counting(&buf)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// read while being written, for the race detector
+		for range 100 {
+			_ = p.n.Load()
+		}
+	}()
+	for range 100 {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if p.n.Load() != 1000 || buf.Len() != 1000 {
+		t.Errorf("counted %d bytes, wrote %d, want 1000", p.n.Load(), buf.Len())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+		{3<<40 + 1<<39, "3.5 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestProgressReport(t *testing.T) {
+	elapsed := withProgressClock(t)
+	for _, tty := range []bool{false, true} {
+		var out bytes.Buffer
+		p := &transferProgress{w: &out, tty: tty, start: progressNow()}
+		p.report()
+		p.n.Store(3 << 20)
+		elapsed.Store(int64(2 * time.Second))
+		p.report()
+		want := "Received 0 B in 0s\nReceived 3.0 MiB in 2s, 1.5 MiB/s\n"
+		if tty {
+			want = "\r\x1b[KReceived 0 B in 0s\r\x1b[KReceived 3.0 MiB in 2s, 1.5 MiB/s"
+		}
+		if out.String() != want {
+			t.Errorf("tty %v: output = %q, want %q", tty, out.String(), want)
+		}
+		elapsed.Store(0)
+	}
+}
+
+func TestProgressReportWithTotal(t *testing.T) {
+	elapsed := withProgressClock(t)
+	var out bytes.Buffer
+	p := &transferProgress{w: &out, start: progressNow(), total: 4 << 30}
+	for _, r := range []struct {
+		at time.Duration
+		n  int64
+	}{{0, 0}, {10 * time.Second, 1 << 30}, {20 * time.Second, 3 << 29}, {30 * time.Second, 5 << 30}} {
+		elapsed.Store(int64(r.at))
+		p.n.Store(r.n)
+		p.report()
+	}
+	want := []string{
+		"Received 0 B / 4.0 GiB (0%), 0 B/s",
+		"Received 1.0 GiB / 4.0 GiB (25%), 102.4 MiB/s, ETA 30s",
+		// averaged over the last 10s only
+		"Received 1.5 GiB / 4.0 GiB (37%), 51.2 MiB/s, ETA 50s",
+		// past the estimate
+		"Received 5.0 GiB in 30s, 358.4 MiB/s",
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+// slowExecutor writes the archive to tar in two halves, pausing between them.
+type slowExecutor struct {
+	archive []byte
+	pause   time.Duration
+}
+
+func (e *slowExecutor) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, _ io.Writer) error {
+	if command[len(command)-1] == "true" {
+		return nil
+	}
+	if _, err := stdout.Write(e.archive[:len(e.archive)/2]); err != nil {
+		return err
+	}
+	time.Sleep(e.pause)
+	_, err := stdout.Write(e.archive[len(e.archive)/2:])
+	return err
+}
+
+// slowDuExecutor is slowExecutor answering du with duOutput.
+type slowDuExecutor struct {
+	slowExecutor
+	duOutput string
+}
+
+func (e *slowDuExecutor) Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	if isDiskUsage(command) {
+		_, err := io.WriteString(stdout, e.duOutput)
+		return err
+	}
+	return e.slowExecutor.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func TestCopyProgressOfEstimatedTotal(t *testing.T) {
+	archive := createTestTar(t, map[string]string{"app.log": strings.Repeat("a", 4000)}).Bytes()
+	old, oldLine := progressInterval, progressLineInterval
+	t.Cleanup(func() { progressInterval, progressLineInterval = old, oldLine })
+	progressInterval, progressLineInterval = time.Millisecond, time.Millisecond
+
+	o := newFakePodCopyOptions(&slowDuExecutor{slowExecutor{archive: archive, pause: 50 * time.Millisecond}, "8\t/var/log/app.log\n"})
+	var errOut bytes.Buffer
+	o.IOStreams.ErrOut = &errOut
+	o.Container, o.Progress = "app", progressAlways
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, errOut.String(), "Received 2.8 KiB / 8.0 KiB (34%), ")
+}
+
+func TestCopyProgress(t *testing.T) {
+	archive := createTestTar(t, map[string]string{"app.log": strings.Repeat("a", 4000)}).Bytes()
+	old, oldLine := progressInterval, progressLineInterval
+	t.Cleanup(func() { progressInterval, progressLineInterval = old, oldLine })
+	progressInterval, progressLineInterval = time.Millisecond, time.Millisecond
+
+	tests := []struct {
+		name     string
+		progress string
+		tty      bool
+		reported bool
+	}{
+		{"auto without a terminal", progressAuto, false, false},
+		{"auto on a terminal", progressAuto, true, true},
+		{"always", progressAlways, false, true},
+		{"never on a terminal", progressNever, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldFd := terminalFd
+			t.Cleanup(func() { terminalFd = oldFd })
+			terminalFd = func(io.Writer) (int, bool) { return -1, tt.tty }
+
+			o := newFakePodCopyOptions(&slowExecutor{archive: archive, pause: 50 * time.Millisecond})
+			var out, errOut bytes.Buffer
+			o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+			o.Container, o.Progress = "app", tt.progress
+			dest := mustTempDir(t)
+			if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", dest); err != nil {
+				t.Fatal(err)
+			}
+			if reported := strings.Contains(errOut.String(), "Received "); reported != tt.reported {
+				t.Errorf("reported = %v, want %v: %q", reported, tt.reported, errOut.String())
+			}
+			if tt.reported && tt.tty && !strings.HasSuffix(errOut.String(), "\r\x1b[K") {
+				t.Errorf("the progress line is not cleared: %q", errOut.String())
+			}
+			if prefix := "Copied 1 file (3.9 KiB) from pod:/var/log/app.log to " + filepath.Join(dest, "app.log") + " in "; !strings.HasPrefix(out.String(), prefix) {
+				t.Errorf("output = %q, want it to start with %q", out.String(), prefix)
+			}
+		})
+	}
+}
+
+// clockExecutor serves the archive to tar, taking took on the progress clock.
+type clockExecutor struct {
+	archive []byte
+	elapsed *atomic.Int64
+	took    time.Duration
+}
+
+func (e *clockExecutor) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, _ io.Writer) error {
+	if command[len(command)-1] == "true" {
+		return nil
+	}
+	e.elapsed.Add(int64(e.took))
+	_, err := stdout.Write(e.archive)
+	return err
+}
+
+func TestCopiedSummary(t *testing.T) {
+	elapsed := withProgressClock(t)
+	archive := createTestTar(t, map[string]string{"app.log": strings.Repeat("a", 4000)}).Bytes()
+	o := newFakePodCopyOptions(&clockExecutor{archive: archive, elapsed: elapsed, took: 1500 * time.Millisecond})
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	o.Container = "app"
+	dest := mustTempDir(t)
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", dest); err != nil {
+		t.Fatal(err)
+	}
+	want := "Copied 1 file (3.9 KiB) from pod:/var/log/app.log to " + filepath.Join(dest, "app.log") + " in 1.5s (2.6 KiB/s)\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
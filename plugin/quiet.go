@@ -0,0 +1,30 @@
+package plugin
+
+import "io"
+
+// silence discards the warnings, progress and notes a copy writes to stderr
+// when Quiet, keeping stderr for the errors it reports itself, errorOut.
+func (o *CopyOptions) silence() {
+	if o.Quiet && o.errOut == nil {
+		o.errOut = o.IOStreams.ErrOut
+		o.IOStreams.ErrOut = io.Discard
+	}
+}
+
+// errorOut returns where a copy prints the errors it reports besides the
+// one it returns, stderr even when Quiet.
+func (o *CopyOptions) errorOut() io.Writer {
+	if o.errOut != nil {
+		return o.errOut
+	}
+	return o.IOStreams.ErrOut
+}
+
+// summaryOut returns where a copy prints its summary, nowhere when Quiet or
+// when stdout is the report of Output json.
+func (o *CopyOptions) summaryOut() io.Writer {
+	if o.Quiet || o.report != nil {
+		return io.Discard
+	}
+	return o.IOStreams.Out
+}
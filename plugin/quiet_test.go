@@ -0,0 +1,42 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyQuiet(t *testing.T) {
+	executor := &fakeExecutor{stdout: createLinkTar(t, "link.txt", tar.TypeSymlink, targetTxtFile).Bytes()}
+	o := newFakePodCopyOptions(executor)
+	var out, errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+	o.Quiet = true
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/"+targetTxtFile, dest); err != nil {
+		t.Fatal(err)
+	}
+	assertFileExists(t, filepath.Join(dest, targetTxtFile))
+	if out.Len() != 0 || errOut.Len() != 0 {
+		t.Errorf("quiet copy printed %q and %q", out.String(), errOut.String())
+	}
+}
+
+func TestSelectorCopyQuietPrintsErrors(t *testing.T) {
+	executor := &podTarExecutor{fail: map[string]bool{"web-b": true}}
+	o, errOut := newSelectorCopyOptions(t, executor, webPods()...)
+	o.Quiet = true
+	dest := filepath.Join(mustTempDir(t), "out")
+
+	err := o.RunWithArgs(context.Background(), ":/var/log", dest)
+	assertContains(t, errString(err), "copy failed in 1 of 3 pods: web-b")
+	if out := o.IOStreams.Out.(*bytes.Buffer).String(); out != "" {
+		t.Errorf("quiet copy printed the summary %q", out)
+	}
+	if want := "error: pod default/web-b: file not found: /var/log\n"; errOut.String() != want {
+		t.Errorf("stderr = %q, want only %q", errOut.String(), want)
+	}
+}
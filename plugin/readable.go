@@ -0,0 +1,50 @@
+package plugin
+
+import "os"
+
+// verifyReadable checks that the regular files created by an extraction can be
+// read back. Restrictive umasks, default ACLs on the destination or a mode of
+// 0000 in the tar leave files the user can't open; the owner read bit is
+// added where that is allowed, unless --preserve keeps the modes of the tar,
+// and what stays unreadable is warned about. Symlinks are never followed.
+func (o *CopyOptions) verifyReadable(paths []string) {
+	chmod := o.chmod
+	if chmod == nil {
+		chmod = os.Chmod
+	}
+	for _, p := range paths {
+		info, err := os.Lstat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		perm := info.Mode().Perm()
+		if perm&0o400 != 0 && canRead(p) {
+			continue
+		}
+		// chmod only succeeds for the owner of the file
+		if o.Preserve {
+			if !canRead(p) {
+				o.warnings.warn(warnUnreadable, "%s is not readable (mode %04o, kept by --preserve)", p, perm)
+			}
+			continue
+		}
+		if err := chmod(p, perm|0o400); err == nil && canRead(p) {
+			o.warnings.warn(warnReadFixed, "added owner read permission to %s (mode was %04o)", p, perm)
+			continue
+		}
+		if after, err := os.Lstat(p); err == nil {
+			perm = after.Mode().Perm()
+		}
+		o.warnings.warn(warnUnreadable, "%s is not readable (mode %04o)", p, perm)
+	}
+}
+
+func canRead(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	//nolint:errcheck
+	_ = f.Close()
+	return true
+}
@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// lockedTar has a readable file and two the tar gives mode 0000.
+func lockedTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "out/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "out/ok.txt", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "out/locked.txt", Typeflag: tar.TypeReg, Mode: 0},
+		{Name: "out/locked2.txt", Typeflag: tar.TypeReg, Mode: 0o200},
+	} {
+		content := h.Name
+		if h.Typeflag == tar.TypeDir {
+			content = ""
+		}
+		h.Size = int64(len(content))
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return buf.Bytes()
+}
+
+func extractLocked(t *testing.T, o *CopyOptions) (string, string) {
+	t.Helper()
+	errOut := &bytes.Buffer{}
+	o.IOStreams.ErrOut = errOut
+	dest := mustTempDir(t)
+	if _, err := o.extractTar(context.Background(), bytes.NewReader(lockedTar(t)), dest, "out"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	return filepath.Join(dest, "out"), errOut.String()
+}
+
+func perm(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestExtractAddsOwnerRead(t *testing.T) {
+	o := newRunOptions()
+	o.manifest = newSourcesManifest("", "pod:/out", "./out", filepath.Join(mustTempDir(t), "sources.json"))
+	dir, out := extractLocked(t, o)
+
+	if got := perm(t, filepath.Join(dir, "locked.txt")); got != 0o400 {
+		t.Fatalf("locked.txt mode = %04o, want 0400", got)
+	}
+	if got := perm(t, filepath.Join(dir, "locked2.txt")); got != 0o600 {
+		t.Fatalf("locked2.txt mode = %04o, want 0600", got)
+	}
+	if got := perm(t, filepath.Join(dir, "ok.txt")); got != 0o644 {
+		t.Fatalf("ok.txt mode = %04o, want it untouched", got)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("added owner read permission to %s (mode was 0000)", filepath.Join(dir, "locked.txt")),
+		"Warnings: 2 files made owner-readable",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if got := o.manifest.Warnings["read_fixed"]; got != 2 {
+		t.Fatalf("manifest read_fixed = %d, want 2", got)
+	}
+}
+
+func TestExtractReportsUnreadable(t *testing.T) {
+	o := newRunOptions()
+	// as for a file owned by someone else
+	o.chmod = func(string, os.FileMode) error { return syscall.EPERM }
+	dir, out := extractLocked(t, o)
+
+	for _, want := range []string{
+		fmt.Sprintf("Warning: %s is not readable (mode 0000)", filepath.Join(dir, "locked.txt")),
+		fmt.Sprintf("Warning: %s is not readable (mode 0200)", filepath.Join(dir, "locked2.txt")),
+		"Warnings: 2 unreadable files",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "ok.txt") {
+		t.Fatalf("a readable file was reported:\n%s", out)
+	}
+}
+
+func TestExtractPreserveKeepsUnreadableModes(t *testing.T) {
+	withChownPrivilege(t, true)
+	o := newRunOptions()
+	o.Preserve = true
+	o.lchown = func(string, int, int) error { return nil }
+	o.chmod = func(string, os.FileMode) error {
+		t.Error("owner read permission added with --preserve")
+		return nil
+	}
+	dir, out := extractLocked(t, o)
+
+	if got := perm(t, filepath.Join(dir, "locked.txt")); got != 0 {
+		t.Fatalf("locked.txt mode = %04o, want the 0000 of the tar", got)
+	}
+	if got := perm(t, filepath.Join(dir, "locked2.txt")); got != 0o200 {
+		t.Fatalf("locked2.txt mode = %04o, want the 0200 of the tar", got)
+	}
+	if strings.Contains(out, "added owner read permission") {
+		t.Fatalf("owner read permission added with --preserve:\n%s", out)
+	}
+}
+
+func TestExtractNoVerifyReadable(t *testing.T) {
+	o := newRunOptions()
+	o.NoVerifyReadable = true
+	dir, out := extractLocked(t, o)
+
+	if got := perm(t, filepath.Join(dir, "locked.txt")); got != 0 {
+		t.Fatalf("locked.txt mode = %04o, want it left at 0000", got)
+	}
+	if out != "" {
+		t.Fatalf("expected no warnings, got:\n%s", out)
+	}
+}
+
+func TestVerifyReadableSkipsSymlinks(t *testing.T) {
+	dir := mustTempDir(t)
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks not available: %v", err)
+	}
+	o := newRunOptions()
+	o.warnings = newCopyWarnings(o.IOStreams.ErrOut, false)
+	o.verifyReadable([]string{link})
+
+	if got := perm(t, target); got != 0 {
+		t.Fatalf("the symlink was followed, target mode = %04o", got)
+	}
+	if o.warnings.counts != [numWarningCategories]int{} {
+		t.Fatalf("unexpected warnings %v", o.warnings.byKey())
+	}
+}
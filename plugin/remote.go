@@ -0,0 +1,408 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+	"k8s.io/kubectl/pkg/scheme"
+)
+
+// remoteExecutor runs a command in a container through the audited rexec
+// endpoint. It is a seam so the copy logic can be exercised without a cluster.
+type remoteExecutor interface {
+	Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error
+}
+
+// remoteStdinExecutor is a remoteExecutor that can also stream stdin to the
+// command, which uploads need.
+type remoteStdinExecutor interface {
+	ExecuteWithStdin(ctx context.Context, pod *corev1.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// remoteErrorKind is the classification of a failed remote helper or tar
+// invocation derived from its stderr.
+type remoteErrorKind int
+
+const (
+	remoteErrUnknown remoteErrorKind = iota
+	remoteErrTarMissing
+	remoteErrNotFound
+	remoteErrPermission
+	// remoteErrFileChanged is GNU tar noting that a file changed while it was
+	// archived, which it exits 1 for with the archive complete.
+	remoteErrFileChanged
+)
+
+// localeEnv is prepended to every helper and tar command when the container
+// has an env binary, so stderr comes out in the C locale and can be matched.
+var localeEnv = []string{"env", "LC_ALL=C", "LANG=C"}
+
+// Errno style markers do not depend on the locale, so they are checked before
+// the phrases. They only match as whole tokens, so errno=22 is not errno=2 and a
+// file named ENOENT-notes.txt is not an ENOENT.
+var (
+	notFoundErrno   = regexp.MustCompile(`(^|[\s(:])(ENOENT|errno[ =]2)([\s),:]|$)`)
+	permissionErrno = regexp.MustCompile(`(^|[\s(:])(EACCES|EPERM|errno[ =](1|13))([\s),:]|$)`)
+)
+
+// The path a failing tar names: GNU tar prints tar: <path>: Cannot open: ...,
+// busybox tar quotes it, tar: can't open '<path>': ...
+var (
+	gnuTarPath     = regexp.MustCompile(`^tar: (.+?): Cannot [a-z]+: `)
+	busyboxTarPath = regexp.MustCompile(`^tar: can't [a-z]+ '(.+)': `)
+)
+
+// Phrases are checked after the errno markers: the C locale phrases first, then
+// the localized ones for containers where we could not force LC_ALL=C.
+var (
+	tarMissingMarkers = []string{
+		"tar: not found",
+		"executable file not found",
+		"sh: tar",
+		"can't execute 'tar'",
+		"tar: command not found",
+		"tar: Kommando nicht gefunden",
+		"tar: commande introuvable",
+		"tar: orden no encontrada",
+		"tar: comando non trovato",
+	}
+	notFoundMarkers = []string{
+		"No such file or directory",
+		"Datei oder Verzeichnis nicht gefunden",
+		"Aucun fichier ou dossier de ce type",
+		"No existe el archivo o el directorio",
+		"No existe el fichero o el directorio",
+		"File o directory non esistente",
+		"Arquivo ou diretório inexistente",
+		"Ficheiro ou pasta inexistente",
+		"Bestand of map bestaat niet",
+		"Nie ma takiego pliku ani katalogu",
+		"Нет такого файла или каталога",
+		"そのようなファイルやディレクトリはありません",
+		"没有那个文件或目录",
+	}
+	permissionMarkers = []string{
+		"Permission denied",
+		"cannot open",
+		"Keine Berechtigung",
+		"Permission non accordée",
+		"Permiso denegado",
+		"Permesso negato",
+		"Permissão negada",
+		"Toegang geweigerd",
+		"Brak dostępu",
+		"Отказано в доступе",
+		"許可がありません",
+		"权限不够",
+	}
+	fileChangedMarkers = []string{
+		"file changed as we read it",
+		"File shrank by",
+		"File removed before we read it",
+	}
+)
+
+// classifyRemoteStderr maps the stderr of a remote command to a remoteErrorKind.
+func classifyRemoteStderr(stderr string) remoteErrorKind {
+	switch {
+	case containsAny(stderr, tarMissingMarkers):
+		return remoteErrTarMissing
+	case notFoundErrno.MatchString(stderr):
+		return remoteErrNotFound
+	case permissionErrno.MatchString(stderr):
+		return remoteErrPermission
+	case containsAny(stderr, notFoundMarkers):
+		return remoteErrNotFound
+	case containsAny(stderr, permissionMarkers):
+		return remoteErrPermission
+	case containsAny(stderr, fileChangedMarkers):
+		return remoteErrFileChanged
+	}
+	return remoteErrUnknown
+}
+
+// extractRemotePath returns the path of the first line of stderr on which tar
+// failed to read a path, as GNU tar and busybox tar print it, or "". Busybox
+// prints a name with a newline as it is, over two lines no path is read from.
+func extractRemotePath(stderr string) string {
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		if m := busyboxTarPath.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+		if m := gnuTarPath.FindStringSubmatch(line); m != nil {
+			return unescapeTarPath(m[1])
+		}
+	}
+	return ""
+}
+
+// unescapeTarPath undoes the escaping of the names GNU tar prints, whose
+// backslashes, colons, newlines and other unprintable bytes are escaped as in
+// C strings, \\, \:, \n or \302.
+func unescapeTarPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; {
+		case c == 'n':
+			b.WriteByte('\n')
+		case c == 't':
+			b.WriteByte('\t')
+		case c == 'r':
+			b.WriteByte('\r')
+		case '0' <= c && c <= '7' && i+2 < len(s):
+			if n, err := strconv.ParseUint(s[i:i+3], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				break
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// failedPath returns the remote path tar failed on in stderr, the path
+// within src it names, or src itself when it names none.
+func failedPath(src *fileSpec, stderr string) string {
+	p := extractRemotePath(stderr)
+	if p == "" {
+		return src.File
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(path.Dir(src.File), p)
+	}
+	if p != src.File && !strings.HasPrefix(p, strings.TrimSuffix(src.File, "/")+"/") {
+		return src.File
+	}
+	return p
+}
+
+func containsAny(s string, markers []string) bool {
+	for _, m := range markers {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// withLocaleEnv prefixes command with localeEnv when useEnv is set.
+func withLocaleEnv(command []string, useEnv bool) []string {
+	if !useEnv {
+		return command
+	}
+	return append(append([]string{}, localeEnv...), command...)
+}
+
+// binaryMissing reports whether a failed exec failed because the executable
+// itself could not be found, as opposed to an auth, network or context error.
+func binaryMissing(execErr error, stderr string) bool {
+	msg := stderr + "\n" + execErr.Error()
+	return strings.Contains(msg, "executable file not found") ||
+		strings.Contains(msg, "no such file or directory") ||
+		strings.Contains(msg, ": not found") ||
+		strings.Contains(msg, "command not found")
+}
+
+// fileChangedOnly reports whether a tar failed only because files changed
+// while it read them: it exited 1, GNU tar's "some files differ", and every
+// line it said is about such a file. Live log directories, and symlinks
+// followed into /proc, do that all the time, the archive is complete then.
+func fileChangedOnly(execErr error, stderr string) bool {
+	var exitErr utilexec.ExitError
+	if !errors.As(execErr, &exitErr) || exitErr.ExitStatus() != 1 || strings.TrimSpace(stderr) == "" {
+		return false
+	}
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		if !containsAny(line, fileChangedMarkers) {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteCommand returns command prefixed with localeEnv if the target container
+// has an env binary. The probe is one extra short audited exec, run once per
+// container for the lifetime of the CopyOptions (a single cp invocation). A
+// probe that fails for any other reason than env missing is returned as is.
+func (o *CopyOptions) remoteCommand(ctx context.Context, pod *corev1.Pod, container string, command []string) ([]string, error) {
+	key := pod.Namespace + "/" + pod.Name + "/" + container
+	useEnv, ok := o.localeEnvProbed[key]
+	if !ok {
+		var stdout, stderr bytes.Buffer
+		err := o.execute(ctx, pod, container, withLocaleEnv([]string{"true"}, true), &stdout, &stderr)
+		var cancelled copyCancelledError
+		if errors.As(err, &cancelled) {
+			return nil, err
+		}
+		if err != nil && !binaryMissing(err, stderr.String()) {
+			return nil, fmt.Errorf("pod %s/%s: probing container %s failed: %w", pod.Namespace, pod.Name, container, err)
+		}
+		useEnv = err == nil
+		if o.localeEnvProbed == nil {
+			o.localeEnvProbed = map[string]bool{}
+		}
+		o.localeEnvProbed[key] = useEnv
+	}
+	return withLocaleEnv(command, useEnv), nil
+}
+
+// cancelTeardownTimeout bounds the wait for the exec stream to be torn down
+// once a copy is cancelled.
+var cancelTeardownTimeout = 5 * time.Second
+
+// copyCancelledError is returned when the context of a copy is cancelled while
+// a remote command runs. terminated is set when the stream was torn down
+// within cancelTeardownTimeout: the exec connection is closed then, which makes
+// the kubelet stop the remote process.
+type copyCancelledError struct {
+	terminated bool
+}
+
+func (e copyCancelledError) Error() string {
+	if e.terminated {
+		return "copy cancelled; remote process terminated"
+	}
+	return fmt.Sprintf("copy cancelled; warning: remote termination could not be confirmed within %s, the remote command may still be reading the filesystem", cancelTeardownTimeout)
+}
+
+// execute runs command through the configured executor, falling back to the
+// SPDY connection to the rexec endpoint. When ctx is cancelled it waits, up to
+// cancelTeardownTimeout, for the executor to return, which it only does once
+// the stream is closed.
+func (o *CopyOptions) execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	var executor remoteExecutor = rexecExecutor{config: o.ClientConfig}
+	if o.executor != nil {
+		executor = o.executor
+	}
+	done := logExec("POST", execEndpoint(o.ClientConfig, pod, container, command, false), pod, container, command)
+	err := awaitRemote(ctx, func() error {
+		return executor.Execute(ctx, pod, container, command, stdout, stderr)
+	})
+	done(err)
+	return err
+}
+
+// executeWithStdin is execute streaming stdin to command.
+func (o *CopyOptions) executeWithStdin(ctx context.Context, pod *corev1.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var executor remoteStdinExecutor = rexecExecutor{config: o.ClientConfig}
+	if o.executor != nil {
+		e, ok := o.executor.(remoteStdinExecutor)
+		if !ok {
+			return fmt.Errorf("the remote executor can't stream stdin")
+		}
+		executor = e
+	}
+	done := logExec("GET", execEndpoint(o.ClientConfig, pod, container, command, true), pod, container, command)
+	err := awaitRemote(ctx, func() error {
+		return executor.ExecuteWithStdin(ctx, pod, container, command, stdin, stdout, stderr)
+	})
+	done(err)
+	return err
+}
+
+// awaitRemote runs execute, the exec of a remote command, and waits for it as
+// described for execute.
+func awaitRemote(ctx context.Context, execute func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- execute()
+	}()
+	select {
+	case err := <-done:
+		if ctx.Err() != nil {
+			return copyCancelledError{terminated: true}
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	timer := time.NewTimer(cancelTeardownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return copyCancelledError{terminated: true}
+	case <-timer.C:
+		return copyCancelledError{}
+	}
+}
+
+// rexecExecutor is the remoteExecutor of the plugin: a non-interactive SPDY
+// exec through the rexec endpoint, audited as a session of its own.
+type rexecExecutor struct {
+	config *restclient.Config
+}
+
+func (e rexecExecutor) Execute(ctx context.Context, pod *corev1.Pod, container string, command []string, stdout, stderr io.Writer) error {
+	req, err := e.request(pod, container, command, false)
+	if err != nil {
+		return err
+	}
+
+	exec, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+
+	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+// ExecuteWithStdin streams over a websocket, the proxy audits what an upload
+// streams as stdin from its frames.
+func (e rexecExecutor) ExecuteWithStdin(ctx context.Context, pod *corev1.Pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	req, err := e.request(pod, container, command, true)
+	if err != nil {
+		return err
+	}
+
+	exec, err := remotecommand.NewWebSocketExecutor(e.config, "GET", req.URL().String())
+	if err != nil {
+		return err
+	}
+
+	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+// request is the exec request of command through the rexec endpoint.
+func (e rexecExecutor) request(pod *corev1.Pod, container string, command []string, stdin bool) (*restclient.Request, error) {
+	restClient, err := restclient.RESTClientFor(e.config)
+	if err != nil {
+		return nil, err
+	}
+
+	req := restClient.Post().
+		RequestURI(rexecExecPath(pod.Namespace, pod.Name))
+
+	req.VersionedParams(execOptions(container, command, stdin), scheme.ParameterCodec)
+	return req, nil
+}
@@ -0,0 +1,476 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func TestClassifyRemoteStderr(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   remoteErrorKind
+	}{
+		{"empty", "", remoteErrUnknown},
+		{"generic failure", "tar: something odd happened", remoteErrUnknown},
+		{"tar missing", "sh: tar: not found", remoteErrTarMissing},
+		{"tar missing runtime", `exec: "tar": executable file not found in $PATH`, remoteErrTarMissing},
+		{"tar missing de", "sh: 1: tar: Kommando nicht gefunden", remoteErrTarMissing},
+		{"not found C locale", "tar: app.log: Cannot stat: No such file or directory", remoteErrNotFound},
+		{"not found de", "tar: app.log: Funktion stat fehlgeschlagen: Datei oder Verzeichnis nicht gefunden", remoteErrNotFound},
+		{"not found fr", "tar: app.log : stat impossible: Aucun fichier ou dossier de ce type", remoteErrNotFound},
+		{"not found es", "tar: app.log: No se puede efectuar stat: No existe el archivo o el directorio", remoteErrNotFound},
+		{"not found ru", "tar: app.log: Функция stat завершилась с ошибкой: Нет такого файла или каталога", remoteErrNotFound},
+		{"not found errno", "readlink: app.log: ENOENT", remoteErrNotFound},
+		{"permission C locale", "tar: secret: Cannot open: Permission denied", remoteErrPermission},
+		{"permission de", "tar: secret: Funktion open fehlgeschlagen: Keine Berechtigung", remoteErrPermission},
+		{"permission it", "tar: secret: impossibile aprire: Permesso negato", remoteErrPermission},
+		{"permission errno", "du: cannot read directory 'x' (errno 13)", remoteErrPermission},
+		{"errno 22 is not errno 2", "tar: write error (errno=22)", remoteErrUnknown},
+		{"errno 28 is not errno 2", "tar: write error: errno=28", remoteErrUnknown},
+		{"errno 2 token", "tar: open failed: errno=2", remoteErrNotFound},
+		{"file name containing ENOENT", "tar: my-ENOENT-notes.txt: file changed as we read it", remoteErrFileChanged},
+		{"file name containing EPERM", "tar: EPERMISSIONS.md: file changed as we read it", remoteErrFileChanged},
+		{"file shrank", "tar: log/app.log: File shrank by 1024 bytes; padding with zeros", remoteErrFileChanged},
+		{"file removed", "tar: log/app.log.1: File removed before we read it", remoteErrFileChanged},
+		{"busybox tar missing", "sh: tar: not found", remoteErrTarMissing},
+		{"busybox env tar missing", "env: can't execute 'tar': No such file or directory", remoteErrTarMissing},
+		{"busybox not found", "tar: can't stat 'log/app.log': No such file or directory", remoteErrNotFound},
+		{"busybox permission", "tar: can't open 'log/secret': Permission denied", remoteErrPermission},
+		{"file changed and permission denied", "tar: log/app.log: file changed as we read it\ntar: log/secret: Cannot open: Permission denied", remoteErrPermission},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyRemoteStderr(tt.stderr); got != tt.want {
+				t.Errorf("classifyRemoteStderr(%q) = %v, want %v", tt.stderr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractRemotePath(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   string
+	}{
+		{"gnu not found", "tar: log/app.log: Cannot stat: No such file or directory\n", "log/app.log"},
+		{"gnu permission", "tar: log/secret: Cannot open: Permission denied\ntar: Exiting with failure status due to previous errors\n", "log/secret"},
+		{"gnu name with colon", "tar: log/a: b.log: Cannot open: Permission denied\n", "log/a: b.log"},
+		{"gnu escaped colon", `tar: log/a\: b.log: Cannot open: Permission denied` + "\n", "log/a: b.log"},
+		{"gnu escaped newline", `tar: log/new\nline.log: Cannot open: Permission denied` + "\n", "log/new\nline.log"},
+		{"gnu escaped backslash and octal", `tar: log/a\\b\303\251.log: Cannot stat: No such file or directory` + "\n", "log/a\\bé.log"},
+		{"busybox not found", "tar: can't stat 'log/app.log': No such file or directory\n", "log/app.log"},
+		{"busybox permission", "tar: can't open 'log/my secret': Permission denied\n", "log/my secret"},
+		{"first failure", "tar: Removing leading `/' from member names\ntar: can't open 'log/a': Permission denied\ntar: can't open 'log/b': Permission denied\n", "log/a"},
+		{"no path", "sh: tar: not found\n", ""},
+		{"localized", "tar: app.log: Funktion open fehlgeschlagen: Keine Berechtigung\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractRemotePath(tt.stderr); got != tt.want {
+				t.Errorf("extractRemotePath(%q) = %q, want %q", tt.stderr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleExecErrorNamesFailedPath(t *testing.T) {
+	o := newDefaultCopyOptions()
+	tests := []struct {
+		name   string
+		src    string
+		stderr string
+		want   string
+	}{
+		{"gnu file in directory", "/var/log", "tar: log/secret: Cannot open: Permission denied\n", "pod ns/pod: permission denied: /var/log/secret"},
+		{"busybox file in directory", "/var/log", "tar: can't open 'log/secret': Permission denied\n", "pod ns/pod: permission denied: /var/log/secret"},
+		{"busybox missing file", "/var/log/app.log", "tar: can't stat 'app.log': No such file or directory\n", "pod ns/pod: file not found: /var/log/app.log"},
+		{"busybox missing tar", "/var/log", "sh: tar: not found\n", "pod ns/pod: tar binary not found in container app"},
+		{"outside the source", "/var/log", "tar: etc/passwd: Cannot open: Permission denied\n", "pod ns/pod: permission denied: /var/log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fileSpec{PodName: "pod", PodNamespace: "ns", File: tt.src}
+			err := o.handleExecError(errors.New("command terminated with exit code 1"), tt.stderr, src, "app")
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("handleExecError() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileChangedOnly(t *testing.T) {
+	exit := func(code int) error {
+		return utilexec.CodeExitError{Err: fmt.Errorf("command terminated with exit code %d", code), Code: code}
+	}
+	changed := "tar: log/app.log: file changed as we read it\n"
+	tests := []struct {
+		name   string
+		err    error
+		stderr string
+		want   bool
+	}{
+		{"file changed", exit(1), changed, true},
+		{"files changed and removed", exit(1), changed + "tar: log/app.log.1: File removed before we read it\ntar: log/db: File shrank by 512 bytes; padding with zeros\n", true},
+		{"exit code 2", exit(2), changed + "tar: Exiting with failure status due to previous errors\n", false},
+		{"another warning", exit(1), changed + "tar: log/secret: Cannot open: Permission denied\n", false},
+		{"unknown line", exit(1), changed + "tar: something odd happened\n", false},
+		{"nothing said", exit(1), "", false},
+		{"stream broke", io.ErrUnexpectedEOF, changed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fileChangedOnly(tt.err, tt.stderr); got != tt.want {
+				t.Errorf("fileChangedOnly(%v, %q) = %v, want %v", tt.err, tt.stderr, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAnalyzeRemoteErrorLocale feeds the same failure once as it comes out with
+// the env prefix applied (C locale) and once as a German container without env
+// would print it, and expects the same error both times.
+func TestAnalyzeRemoteErrorLocale(t *testing.T) {
+	src := &fileSpec{PodName: "pod", PodNamespace: "ns", File: "/var/log/app.log"}
+	o := newDefaultCopyOptions()
+
+	tests := []struct {
+		name       string
+		withEnv    string
+		withoutEnv string
+		want       string
+	}{
+		{
+			"not found",
+			"tar: app.log: Cannot stat: No such file or directory\n",
+			"tar: app.log: Funktion stat fehlgeschlagen: Datei oder Verzeichnis nicht gefunden\n",
+			"file not found: /var/log/app.log",
+		},
+		{
+			"permission denied",
+			"tar: app.log: Cannot open: Permission denied\n",
+			"tar: app.log: Funktion open fehlgeschlagen: Keine Berechtigung\n",
+			"permission denied: /var/log/app.log",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stderr := range []string{tt.withEnv, tt.withoutEnv} {
+				err := o.handleExecError(errors.New("command terminated with exit code 2"), stderr, src, "app")
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("handleExecError(%q) = %v, want containing %q", stderr, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithLocaleEnv(t *testing.T) {
+	command := []string{"tar", "cf", "-", "-C", "/var", "--", "log"}
+
+	if got := withLocaleEnv(command, false); !reflect.DeepEqual(got, command) {
+		t.Errorf("withLocaleEnv(false) = %v, want %v", got, command)
+	}
+
+	want := append([]string{"env", "LC_ALL=C", "LANG=C"}, command...)
+	if got := withLocaleEnv(command, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("withLocaleEnv(true) = %v, want %v", got, want)
+	}
+	if command[0] != "tar" {
+		t.Errorf("withLocaleEnv modified its input: %v", command)
+	}
+}
+
+// fakeLocaleContainer behaves like a container with a German default locale. It
+// records every command it is asked to run. When hasEnv is false, env fails the
+// way a missing binary does; probeErr makes every command fail with that error.
+type fakeLocaleContainer struct {
+	hasEnv   bool
+	probeErr error
+	commands [][]string
+}
+
+func (f *fakeLocaleContainer) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, _, stderr io.Writer) error {
+	f.commands = append(f.commands, command)
+	if f.probeErr != nil {
+		return f.probeErr
+	}
+	if command[0] == "env" {
+		if !f.hasEnv {
+			return errors.New(`exec: "env": executable file not found in $PATH`)
+		}
+		if command[len(command)-1] == "true" {
+			return nil
+		}
+		_, _ = fmt.Fprint(stderr, "tar: app.log: Cannot stat: No such file or directory\n")
+		return errors.New("command terminated with exit code 2")
+	}
+	_, _ = fmt.Fprint(stderr, "tar: app.log: Funktion stat fehlgeschlagen: Datei oder Verzeichnis nicht gefunden\n")
+	return errors.New("command terminated with exit code 2")
+}
+
+func newFakePodCopyOptions(executor remoteExecutor) *CopyOptions {
+	o := newRunOptions()
+	o.Clientset = fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", UID: "0f1e2d3c-uid"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "sidecar"}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	})
+	o.executor = executor
+	return o
+}
+
+func TestRemoteCommandProbesOncePerContainer(t *testing.T) {
+	fc := &fakeLocaleContainer{hasEnv: true}
+	o := newFakePodCopyOptions(fc)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"}}
+
+	for _, container := range []string{"app", "app", "sidecar", "app"} {
+		got, err := o.remoteCommand(context.Background(), pod, container, []string{"tar", "cf", "-"})
+		if err != nil {
+			t.Fatalf("remoteCommand() error = %v", err)
+		}
+		want := []string{"env", "LC_ALL=C", "LANG=C", "tar", "cf", "-"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("remoteCommand() = %v, want %v", got, want)
+		}
+	}
+	if len(fc.commands) != 2 {
+		t.Fatalf("expected one probe per container (2), got %d: %v", len(fc.commands), fc.commands)
+	}
+}
+
+func TestRemoteCommandWithoutEnv(t *testing.T) {
+	fc := &fakeLocaleContainer{hasEnv: false}
+	o := newFakePodCopyOptions(fc)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"}}
+
+	got, err := o.remoteCommand(context.Background(), pod, "app", []string{"tar", "cf", "-"})
+	if err != nil {
+		t.Fatalf("remoteCommand() error = %v", err)
+	}
+	if want := []string{"tar", "cf", "-"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("remoteCommand() = %v, want %v", got, want)
+	}
+}
+
+func TestRemoteCommandProbeErrorIsReturned(t *testing.T) {
+	probeErr := errors.New("error dialing backend: connection refused")
+	fc := &fakeLocaleContainer{probeErr: probeErr}
+	o := newFakePodCopyOptions(fc)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"}}
+
+	_, err := o.remoteCommand(context.Background(), pod, "app", []string{"tar"})
+	if !errors.Is(err, probeErr) {
+		t.Fatalf("remoteCommand() error = %v, want wrapping %v", err, probeErr)
+	}
+	if _, cached := o.localeEnvProbed["default/pod/app"]; cached {
+		t.Fatal("a failed probe must not be cached as env missing")
+	}
+}
+
+// TestCopyClassifiesWithAndWithoutEnvPrefix runs a failing copy end to end
+// through the fake container, once where env exists (C locale stderr) and once
+// where it does not (German stderr), and expects the same classification.
+func TestCopyClassifiesWithAndWithoutEnvPrefix(t *testing.T) {
+	for _, hasEnv := range []bool{true, false} {
+		t.Run(fmt.Sprintf("env=%v", hasEnv), func(t *testing.T) {
+			fc := &fakeLocaleContainer{hasEnv: hasEnv}
+			o := newFakePodCopyOptions(fc)
+
+			err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t))
+			if err == nil || !strings.Contains(err.Error(), "file not found: /var/log/app.log") {
+				t.Fatalf("RunWithArgs() error = %v, want file not found", err)
+			}
+
+			tarCmd := fc.commands[len(fc.commands)-1]
+			if prefixed := tarCmd[0] == "env"; prefixed != hasEnv {
+				t.Fatalf("tar command %v: env prefix = %v, want %v", tarCmd, prefixed, hasEnv)
+			}
+		})
+	}
+}
+
+// TestRunWithArgsThroughExecutor runs copies end to end against the fake
+// clientset and executor, from the lookup of the pod to the summary, through
+// each way the remote tar can fail.
+func TestRunWithArgsThroughExecutor(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		executor *fakeExecutor
+		wantErr  string
+	}{
+		{
+			name:     "copied",
+			src:      "pod:/var/log/app.log",
+			executor: &fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": contentStr}).Bytes()},
+		},
+		{
+			name:     "file not found",
+			src:      "pod:/var/log/app.log",
+			executor: &fakeExecutor{stderr: "tar: app.log: Cannot stat: No such file or directory\n", err: exitCodeError(2)},
+			wantErr:  "pod default/pod: file not found: /var/log/app.log",
+		},
+		{
+			name:     "permission denied",
+			src:      "pod:/var/log/app.log",
+			executor: &fakeExecutor{stderr: "tar: app.log: Cannot open: Permission denied\n", err: exitCodeError(2)},
+			wantErr:  "pod default/pod: permission denied: /var/log/app.log",
+		},
+		{
+			name:     "other tar failure",
+			src:      "pod:/var/log/app.log",
+			executor: &fakeExecutor{stderr: "tar: write error\n", err: exitCodeError(2)},
+			wantErr:  "pod default/pod: tar: write error",
+		},
+		{
+			name:     "nothing received",
+			src:      "pod:/var/log/app.log",
+			executor: &fakeExecutor{},
+			wantErr:  "no data received from pod",
+		},
+		{
+			name:     "no such pod",
+			src:      "gone:/var/log/app.log",
+			executor: &fakeExecutor{},
+			wantErr:  "pod default/gone not found",
+		},
+		{
+			name:     "pod completed",
+			src:      "done:/var/log/app.log",
+			executor: &fakeExecutor{},
+			wantErr:  "pod default/done is not running (phase: Succeeded)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newFakePodCopyOptions(tt.executor)
+			o.Container = "app"
+			done := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "done", Namespace: "default"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+				Status:     corev1.PodStatus{Phase: corev1.PodSucceeded},
+			}
+			if _, err := o.Clientset.CoreV1().Pods("default").Create(context.Background(), done, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			o.IOStreams.Out = &out
+			dest := mustTempDir(t)
+
+			err := o.RunWithArgs(context.Background(), tt.src, dest)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("RunWithArgs() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RunWithArgs() error = %v", err)
+			}
+			assertFileContent(t, filepath.Join(dest, "app.log"), contentStr)
+			if !strings.HasPrefix(out.String(), "Copied 1 file ") {
+				t.Errorf("output = %q, want the summary", out.String())
+			}
+		})
+	}
+}
+
+// teardownExecutor streams until its context is cancelled, then takes
+// teardown, or until release is closed when teardown is negative, to return,
+// like an exec connection that is slow to close.
+type teardownExecutor struct {
+	teardown time.Duration
+	release  chan struct{}
+	started  chan struct{}
+	returned chan struct{}
+}
+
+func newTeardownExecutor(teardown time.Duration) *teardownExecutor {
+	return &teardownExecutor{teardown: teardown, release: make(chan struct{}), started: make(chan struct{}), returned: make(chan struct{})}
+}
+
+func (e *teardownExecutor) Execute(ctx context.Context, _ *corev1.Pod, _ string, command []string, stdout, _ io.Writer) error {
+	if command[len(command)-1] == "true" {
+		return nil
+	}
+	if isDiskUsage(command) {
+		return errNoDu
+	}
+	defer close(e.returned)
+	close(e.started)
+	if _, err := io.WriteString(stdout, "partial tar stream"); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	if e.teardown < 0 {
+		<-e.release
+	} else {
+		time.Sleep(e.teardown)
+	}
+	return ctx.Err()
+}
+
+func runCancelledCopy(t *testing.T, executor *teardownExecutor) (dest string, err error) {
+	t.Helper()
+	o := newFakePodCopyOptions(executor)
+	dest = filepath.Join(mustTempDir(t), "out")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- o.RunWithArgs(ctx, "pod:/var/log", dest) }()
+	<-executor.started
+	cancel()
+	return dest, <-errc
+}
+
+func TestCancelledCopyWaitsForTeardown(t *testing.T) {
+	old := cancelTeardownTimeout
+	t.Cleanup(func() { cancelTeardownTimeout = old })
+	cancelTeardownTimeout = 5 * time.Second
+
+	executor := newTeardownExecutor(50 * time.Millisecond)
+	dest, err := runCancelledCopy(t, executor)
+	select {
+	case <-executor.returned:
+	default:
+		t.Fatal("the cancellation was reported before the stream was torn down")
+	}
+	var cancelled copyCancelledError
+	if !errors.As(err, &cancelled) || err.Error() != "copy cancelled; remote process terminated" {
+		t.Fatalf("err = %v, want the remote process reported terminated", err)
+	}
+	assertFileDoesNotExist(t, dest)
+}
+
+func TestCancelledCopyWarnsWhenTeardownHangs(t *testing.T) {
+	old := cancelTeardownTimeout
+	t.Cleanup(func() { cancelTeardownTimeout = old })
+	cancelTeardownTimeout = 20 * time.Millisecond
+
+	executor := newTeardownExecutor(-1)
+	t.Cleanup(func() { close(executor.release) })
+	dest, err := runCancelledCopy(t, executor)
+	var cancelled copyCancelledError
+	if !errors.As(err, &cancelled) || cancelled.terminated {
+		t.Fatalf("err = %v, want an unconfirmed termination", err)
+	}
+	assertContains(t, err.Error(), "could not be confirmed within 20ms")
+	assertFileDoesNotExist(t, dest)
+}
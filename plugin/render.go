@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// OutputWidth overrides the detected width of the human output when positive.
+var OutputWidth int
+
+// tableGap separates the columns of a table.
+const tableGap = "  "
+
+// minColumnWidth is as far as a column is truncated to fit a table into the
+// width, a narrower terminal gets longer lines instead.
+const minColumnWidth = 4
+
+const (
+	styleBold  = "\x1b[1m"
+	styleReset = "\x1b[0m"
+)
+
+// terminalFd returns the file descriptor of w when it is a terminal, swapped
+// in tests.
+var terminalFd = func(w io.Writer) (int, bool) {
+	f, ok := w.(*os.File)
+	if !ok || !term.IsTerminal(int(f.Fd())) {
+		return 0, false
+	}
+	return int(f.Fd()), true
+}
+
+// output renders the human output of the subcommands for where it goes:
+// tables are truncated and text is wrapped to the width, and styling is only
+// used on a terminal and without NO_COLOR. Output that is not a terminal has
+// no width unless COLUMNS or --width gives it one.
+type output struct {
+	w io.Writer
+	// width is 0 when unlimited.
+	width  int
+	styled bool
+}
+
+func newOutput(w io.Writer) *output {
+	o := &output{w: w, width: OutputWidth}
+	fd, tty := terminalFd(w)
+	if o.width <= 0 && tty {
+		if cols, _, err := term.GetSize(fd); err == nil && cols > 0 {
+			o.width = cols
+		}
+	}
+	if o.width <= 0 {
+		if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+			o.width = cols
+		}
+	}
+	o.styled = tty && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+	return o
+}
+
+// column is a column of a table. Right aligns it, for numbers, which are never
+// truncated. TrimLeft truncates it at the start, for paths whose end tells
+// them apart.
+type column struct {
+	Header   string
+	Right    bool
+	TrimLeft bool
+}
+
+// table writes rows under a header line. When the table is wider than the
+// output, the widest columns are truncated with an ellipsis until it fits.
+func (o *output) table(cols []column, rows [][]string) error {
+	widths := make([]int, len(cols))
+	for i, c := range cols {
+		widths[i] = textWidth(c.Header)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], textWidth(cell))
+		}
+	}
+	o.fitColumns(cols, widths)
+
+	header := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = c.Header
+	}
+	if err := o.tableRow(cols, widths, header, true); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := o.tableRow(cols, widths, row, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fitColumns narrows the widest column, one character at a time, until the
+// columns fit the width or none can be narrowed further.
+func (o *output) fitColumns(cols []column, widths []int) {
+	if o.width <= 0 {
+		return
+	}
+	total := textWidth(tableGap) * (len(widths) - 1)
+	for _, w := range widths {
+		total += w
+	}
+	for total > o.width {
+		widest := -1
+		for i, w := range widths {
+			if !cols[i].Right && w > minColumnWidth && (widest < 0 || w >= widths[widest]) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			return
+		}
+		widths[widest]--
+		total--
+	}
+}
+
+func (o *output) tableRow(cols []column, widths []int, cells []string, header bool) error {
+	var b strings.Builder
+	for i, c := range cols {
+		cell := truncate(cells[i], widths[i], c.TrimLeft)
+		pad := strings.Repeat(" ", widths[i]-textWidth(cell))
+		if i > 0 {
+			b.WriteString(tableGap)
+		}
+		switch {
+		case c.Right:
+			b.WriteString(pad + cell)
+		case i == len(cols)-1:
+			b.WriteString(cell)
+		default:
+			b.WriteString(cell + pad)
+		}
+	}
+	line := b.String()
+	if header {
+		line = o.bold(line)
+	}
+	_, err := fmt.Fprintln(o.w, line)
+	return err
+}
+
+// bold styles s when the output is styled.
+func (o *output) bold(s string) string {
+	if !o.styled {
+		return s
+	}
+	return styleBold + s + styleReset
+}
+
+// printf writes the formatted text wrapped to the width.
+func (o *output) printf(format string, args ...any) {
+	//nolint:errcheck
+	_, _ = io.WriteString(o.w, o.wrap(fmt.Sprintf(format, args...)))
+}
+
+// wrap breaks the lines of text longer than the width between words. The
+// continuation lines keep the indentation of the line they break, words
+// longer than the width are left whole.
+func (o *output) wrap(text string) string {
+	if o.width <= 0 {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = wrapLine(line, o.width)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func wrapLine(line string, width int) string {
+	if textWidth(line) <= width {
+		return line
+	}
+	indent := line[:len(line)-len(strings.TrimLeftFunc(line, unicode.IsSpace))]
+	var b strings.Builder
+	col := 0
+	for _, word := range strings.Fields(line) {
+		switch {
+		case col == 0:
+			b.WriteString(indent + word)
+			col = textWidth(indent) + textWidth(word)
+		case col+1+textWidth(word) > width:
+			b.WriteString("\n" + indent + word)
+			col = textWidth(indent) + textWidth(word)
+		default:
+			b.WriteString(" " + word)
+			col += 1 + textWidth(word)
+		}
+	}
+	return b.String()
+}
+
+// truncate shortens s to width, marking the cut with an ellipsis.
+func truncate(s string, width int, trimLeft bool) string {
+	if textWidth(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	if trimLeft {
+		return "…" + string(runes[len(runes)-width+1:])
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+func textWidth(s string) int {
+	return utf8.RuneCountInString(s)
+}
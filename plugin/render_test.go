@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the render and config view tests")
+
+// assertGolden compares got with testdata/render/<name>.golden.
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	assertGoldenFile(t, filepath.Join("testdata", "render", name+".golden"), got)
+}
+
+// assertGoldenFile compares got with file, or writes it there with -update.
+func assertGoldenFile(t *testing.T, file, got string) {
+	t.Helper()
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v, run the tests with -update to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs:\n--- got\n%s--- want\n%s", file, got, want)
+	}
+}
+
+// withTerminal makes every writer look like a terminal for the test.
+func withTerminal(t *testing.T) {
+	t.Helper()
+	old := terminalFd
+	t.Cleanup(func() { terminalFd = old })
+	terminalFd = func(io.Writer) (int, bool) { return -1, true }
+}
+
+func planTable(o *output) error {
+	cols := []column{{Header: "TYPE"}, {Header: "MODE"}, {Header: "SIZE", Right: true}, {Header: "PATH", TrimLeft: true}}
+	return o.table(cols, [][]string{
+		{"dir", "0755", "0", "log"},
+		{"file", "0644", "1048576", "log/payments/2024-06-01/app-payments-7d9f8c6b5-x2x4q.log"},
+		{"symlink", "0777", "0", "log/current"},
+	})
+}
+
+func TestRenderTable(t *testing.T) {
+	for _, width := range []int{0, 80, 50, 30, 10} {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := planTable(&output{w: &buf, width: width}); err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, fmt.Sprintf("table-%d", width), buf.String())
+			// below 30 the columns can't be narrowed enough
+			if width < 30 {
+				return
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+				if width > 0 && textWidth(line) > width {
+					t.Errorf("line wider than %d: %q", width, line)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderWrap(t *testing.T) {
+	const text = "error: pod default/web-0: permission denied: /var/lib/postgresql/data/pg_wal\n" +
+		"  hint: the container runs as uid 999, copy a directory it can read or ask the owner of the namespace\n" +
+		"https://example.com/a/very/long/url/that/is/never/broken/because/it/has/no/spaces\n"
+	for _, width := range []int{0, 80, 40} {
+		t.Run(fmt.Sprint(width), func(t *testing.T) {
+			assertGolden(t, fmt.Sprintf("wrap-%d", width), (&output{width: width}).wrap(text))
+		})
+	}
+}
+
+func TestRenderStyling(t *testing.T) {
+	t.Setenv("COLUMNS", "")
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+	oldWidth := OutputWidth
+	t.Cleanup(func() { OutputWidth = oldWidth })
+	OutputWidth = 50
+
+	var notty bytes.Buffer
+	if err := planTable(newOutput(&notty)); err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "table-notty", notty.String())
+	if strings.Contains(notty.String(), "\x1b") {
+		t.Fatalf("escape sequences in output that is not a terminal: %q", notty.String())
+	}
+
+	withTerminal(t)
+	var tty bytes.Buffer
+	if err := planTable(newOutput(&tty)); err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "table-tty", tty.String())
+
+	t.Setenv("NO_COLOR", "1")
+	if newOutput(&tty).styled {
+		t.Fatal("styled with NO_COLOR set")
+	}
+}
+
+func TestOutputWidth(t *testing.T) {
+	oldWidth := OutputWidth
+	t.Cleanup(func() { OutputWidth = oldWidth })
+
+	t.Setenv("COLUMNS", "")
+	OutputWidth = 0
+	if o := newOutput(&bytes.Buffer{}); o.width != 0 || o.styled {
+		t.Fatalf("output that is not a terminal got width %d, styled %v", o.width, o.styled)
+	}
+	t.Setenv("COLUMNS", "72")
+	if o := newOutput(&bytes.Buffer{}); o.width != 72 {
+		t.Fatalf("width = %d, want COLUMNS 72", o.width)
+	}
+	OutputWidth = 100
+	if o := newOutput(&bytes.Buffer{}); o.width != 100 {
+		t.Fatalf("width = %d, want --width 100", o.width)
+	}
+}
@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// copyReport is what `cp -o json` prints once a copy ran, for scripts that
+// would otherwise scrape its summary: what was copied, or why it failed.
+type copyReport struct {
+	// Source is the source as given, Namespace to Path what it resolved to.
+	Source    string `json:"source"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	Path      string `json:"path,omitempty"`
+	// Destination is the local path of the copy, resolved once it ran.
+	Destination     string        `json:"destination"`
+	Files           []reportFile  `json:"files,omitempty"`
+	Dirs            int           `json:"dirs"`
+	Symlinks        int           `json:"symlinks"`
+	SkippedSymlinks int           `json:"skipped_symlinks"`
+	Skipped         int           `json:"skipped"`
+	Bytes           int64         `json:"bytes"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Warnings        []copyWarning `json:"warnings,omitempty"`
+	// AuditSessions are the ids of the sessions of the copy on the rexec
+	// server, none from a server too old to send them.
+	AuditSessions []string     `json:"audit_sessions,omitempty"`
+	Error         *reportError `json:"error,omitempty"`
+}
+
+// reportFile is a regular file a copy wrote, with the digest --checksum
+// verified.
+type reportFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	SHA256 string `json:"sha256,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// reportError is the failure of a copy, with its kind, such as tar_missing,
+// path_not_found, permission_denied or pod_gone.
+type reportError struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// remoteError is a failure of a remote command classified from its stderr.
+type remoteError struct {
+	kind remoteErrorKind
+	err  error
+}
+
+func (e remoteError) Error() string {
+	return e.err.Error()
+}
+
+func (e remoteError) Unwrap() error {
+	return e.err
+}
+
+// reportKinds name the kinds of remoteError in a report.
+var reportKinds = map[remoteErrorKind]string{
+	remoteErrNotFound:   "path_not_found",
+	remoteErrPermission: "permission_denied",
+}
+
+// errorKind is the kind of err in a report, error for one not classified.
+func errorKind(err error) string {
+	var tarMissing tarMissingError
+	var remote remoteError
+	var cancelled copyCancelledError
+	var gone podGoneError
+	switch {
+	case errors.As(err, &tarMissing):
+		return "tar_missing"
+	case errors.As(err, &gone):
+		return "pod_gone"
+	case errors.As(err, &remote) && reportKinds[remote.kind] != "":
+		return reportKinds[remote.kind]
+	case errors.As(err, &cancelled):
+		return "cancelled"
+	}
+	return "error"
+}
+
+// reportFinished records in the report of a copy what it wrote to dest: the
+// files extracted, with the digests verified, and its result.
+func (o *CopyOptions) reportFinished(dest string, alg checksumAlgorithm, digests []fileDigest) {
+	r := o.report
+	r.Destination = dest
+	verified := make(map[string]string, len(digests))
+	for _, d := range digests {
+		verified[d.local] = d.digest
+	}
+	r.Files = make([]reportFile, 0, len(o.extracted))
+	for _, p := range o.extracted {
+		f := reportFile{Path: p}
+		if info, err := os.Stat(p); err == nil {
+			f.Size, f.Mode = info.Size(), fmt.Sprintf("%04o", info.Mode().Perm())
+		}
+		switch alg.name {
+		case "sha256":
+			f.SHA256 = verified[p]
+		case "md5":
+			f.MD5 = verified[p]
+		}
+		r.Files = append(r.Files, f)
+	}
+	r.Dirs, r.Symlinks, r.Skipped = o.Result.Dirs, o.Result.Symlinks, o.Result.Skipped
+	r.Bytes, r.DurationSeconds = o.Result.Bytes, o.Result.Duration.Seconds()
+	if o.warnings != nil {
+		r.SkippedSymlinks = o.warnings.counts[warnSymlink]
+		r.Warnings = o.warnings.all
+	}
+}
+
+// printReport prints the report of a copy that returned copyErr, with the
+// error when it failed, and returns copyErr.
+func (o *CopyOptions) printReport(copyErr error) error {
+	o.report.AuditSessions = notices.sessionIDs()
+	if copyErr != nil {
+		o.report.Error = &reportError{Kind: errorKind(copyErr), Message: copyErr.Error()}
+	}
+	data, err := json.MarshalIndent(o.report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(o.IOStreams.Out, "%s\n", data); err != nil && copyErr == nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	return copyErr
+}
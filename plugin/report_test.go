@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyReport(t *testing.T) {
+	executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{"logs/app.log": contentStr, "logs/old/gc.log": "gc"}).Bytes()}
+	o := newFakePodCopyOptions(executor)
+	o.Output = "json"
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/logs", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	var report copyReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("stdout is not a JSON report: %v\n%s", err, out.String())
+	}
+	if report.Source != "pod:/var/logs" || report.Namespace != "default" || report.Pod != "pod" || report.Container != "app" || report.Path != "/var/logs" {
+		t.Errorf("report source = %+v", report)
+	}
+	if report.Destination != filepath.Join(dest, "logs") || report.Error != nil {
+		t.Errorf("report destination = %q, error = %v", report.Destination, report.Error)
+	}
+	if len(report.Files) != 2 || report.Bytes != int64(len(contentStr)+2) {
+		t.Fatalf("report files = %+v, bytes = %d", report.Files, report.Bytes)
+	}
+	for _, f := range report.Files {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			t.Fatalf("report lists %s: %v", f.Path, err)
+		}
+		if f.Size != info.Size() || f.Mode != fmt.Sprintf("%04o", info.Mode().Perm()) || f.SHA256 != "" {
+			t.Errorf("report file = %+v, want size %d mode %04o", f, info.Size(), info.Mode().Perm())
+		}
+	}
+}
+
+func TestCopyReportError(t *testing.T) {
+	executor := &fakeExecutor{stderr: "tar: logs: Cannot stat: No such file or directory\n", err: errors.New("command terminated with exit code 2")}
+	o := newFakePodCopyOptions(executor)
+	o.Output = "json"
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+
+	err := o.RunWithArgs(context.Background(), "pod:/var/logs", mustTempDir(t))
+	if err == nil {
+		t.Fatal("RunWithArgs() succeeded")
+	}
+	var report copyReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("stdout is not a JSON report: %v\n%s", err, out.String())
+	}
+	if report.Error == nil || report.Error.Kind != "path_not_found" || report.Error.Message != err.Error() {
+		t.Errorf("report error = %+v, want path_not_found %q", report.Error, err)
+	}
+	if report.Pod != "pod" || len(report.Files) != 0 {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{tarMissingError{pod: "default/pod", container: "app"}, "tar_missing"},
+		{fmt.Errorf("copy: %w", remoteError{remoteErrNotFound, errors.New("file not found")}), "path_not_found"},
+		{remoteError{remoteErrPermission, errors.New("permission denied")}, "permission_denied"},
+		{copyCancelledError{}, "cancelled"},
+		{podGoneError{pod: "default/pod", what: "was evicted", err: errors.New("error stream")}, "pod_gone"},
+		{errors.New("pod default/pod not found"), "error"},
+	}
+	for _, tt := range tests {
+		if got := errorKind(tt.err); got != tt.want {
+			t.Errorf("errorKind(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+	"time"
+)
+
+// CopyResult is what a copy from a pod extracted, for its summary and for
+// whatever reports on the copy once it ran.
+type CopyResult struct {
+	// Files counts the regular files and hard links written.
+	Files int
+	// Dirs counts the directories created.
+	Dirs int
+	// Symlinks counts the symlinks created with AllowSymlinks.
+	Symlinks int
+	// Special counts the devices and FIFOs created with SpecialFiles create.
+	Special int
+	// Unchanged counts the existing files SkipExisting left as they are.
+	Unchanged int
+	// Skipped counts the entries not extracted, such as symlinks, special
+	// files and hard links to files the copy left out.
+	Skipped int
+	// Bytes is the size of the files written.
+	Bytes int64
+	// Created lists the files and directories the extraction created,
+	// outermost first, which a failed copy removes unless KeepPartial.
+	Created []string
+	// Duration is how long the copy took, from the start of the transfer to
+	// the end of the extraction.
+	Duration time.Duration
+}
+
+// add counts header, an entry processTarEntry handled.
+func (r *CopyResult) add(header *tar.Header) {
+	switch {
+	case header.Typeflag == tar.TypeDir:
+		r.Dirs++
+	case regularEntry(header):
+		r.Files++
+		r.Bytes += header.Size
+	default:
+		r.Skipped++
+	}
+}
+
+// written counts the entries extracted, for --max-files.
+func (r CopyResult) written() int {
+	return r.Files + r.Dirs + r.Symlinks + r.Special
+}
+
+// writtenSummary is what was written before a copy stopped at a limit.
+func (r CopyResult) writtenSummary() string {
+	return fmt.Sprintf("%d entries (%d bytes) were written before it", r.written(), r.Bytes)
+}
+
+// summary is the line printed once src was copied to dest: the files and
+// bytes written, in how long and at what rate.
+func (r CopyResult) summary(src, dest string) string {
+	files := "files"
+	if r.Files == 1 {
+		files = "file"
+	}
+	s := fmt.Sprintf("Copied %d %s (%s) from %s to %s in %s", r.Files, files, formatBytes(r.Bytes), src, dest, r.Duration.Round(100*time.Millisecond))
+	if r.Duration > 0 {
+		s += fmt.Sprintf(" (%s/s)", formatBytes(int64(float64(r.Bytes)/r.Duration.Seconds())))
+	}
+	return s
+}
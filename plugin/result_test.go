@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"archive/tar"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtractTarResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		typeflag byte
+		want     CopyResult
+	}{
+		{"symlink skipped", tar.TypeSymlink, CopyResult{Files: 1, Skipped: 1, Bytes: 7}},
+		{"hard link written", tar.TypeLink, CopyResult{Files: 2, Bytes: 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newDefaultCopyOptions()
+			got, err := o.extractTar(context.Background(), createLinkTar(t, "link.txt", tt.typeflag, targetTxtFile), mustTempDir(t), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got.Created = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractTar() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyResultSummary(t *testing.T) {
+	tests := []struct {
+		name   string
+		result CopyResult
+		want   string
+	}{
+		{"files", CopyResult{Files: 214, Bytes: 1395864371, Duration: 42 * time.Second}, "Copied 214 files (1.3 GiB) from payments-0:/var/log to logs in 42s (31.7 MiB/s)"},
+		{"one file", CopyResult{Files: 1, Bytes: 10, Duration: 2 * time.Second}, "Copied 1 file (10 B) from payments-0:/var/log to logs in 2s (5 B/s)"},
+		{"no duration", CopyResult{Bytes: 10}, "Copied 0 files (10 B) from payments-0:/var/log to logs in 0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.summary("payments-0:/var/log", "logs"); got != tt.want {
+				t.Errorf("summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// copyRetryDelay is the wait before the first retry of --retries, doubled for
+// every retry after it up to maxCopyRetryDelay.
+var copyRetryDelay = time.Second
+
+const maxCopyRetryDelay = 30 * time.Second
+
+// connectRetries is how often a copy without --retries is retried when it
+// fails transiently before receiving anything, which can't leave a partial
+// archive behind.
+const connectRetries = 3
+
+// archiveChanged is what resumeScript says when the archive is no longer the
+// one an interrupted attempt received the start of.
+const archiveChanged = "rexec: archive changed since the interrupted attempt"
+
+// resumeScript writes the archive of the members following $4 in the
+// directory $2, made with the tar flags $1 and the options before the -- of
+// the members, again from byte $3 on, the bytes
+// before it having been received by an interrupted attempt. It first checks
+// that they still have the sha256 $4, and fails with archiveChanged when they
+// don't, as splicing the rest of another archive onto them would corrupt it.
+const resumeScript = `f=$1 d=$2 n=$3 sum=$4; shift 4; ` +
+	`s=$(tar "$f" - -C "$d" "$@" | head -c $((n - 1)) | sha256sum) || exit; ` +
+	`[ "${s%% *}" = "$sum" ] || { echo "` + archiveChanged + `" >&2; exit 3; }; ` +
+	`tar "$f" - -C "$d" "$@" | tail -c +"$n"`
+
+// transientMarkers are the errors of a stream that broke, as opposed to a
+// request or remote command that failed.
+var transientMarkers = []string{
+	"connection reset by peer",
+	"broken pipe",
+	"unexpected EOF",
+	"use of closed network connection",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"connection refused",
+	"http2: client connection lost",
+	"error dialing backend",
+}
+
+// transientExecError reports whether a failed exec is worth retrying: the
+// stream or the connection broke, or the apiserver was briefly unavailable.
+// A remote command that ran and failed, such as tar not finding the path, is
+// not.
+func transientExecError(execErr error, stderr string) bool {
+	var cancelled copyCancelledError
+	var exitErr utilexec.ExitError
+	var status apierrors.APIStatus
+	switch {
+	case errors.As(execErr, &cancelled), errors.As(execErr, &exitErr), classifyRemoteStderr(stderr) != remoteErrUnknown:
+		return false
+	case errors.As(execErr, &status):
+		code := status.Status().Code
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(execErr, &netErr) ||
+		errors.Is(execErr, io.ErrUnexpectedEOF) ||
+		errors.Is(execErr, syscall.ECONNRESET) ||
+		errors.Is(execErr, syscall.EPIPE) ||
+		containsAny(execErr.Error(), transientMarkers)
+}
+
+// executeResuming runs command, the tar of the members of dir a copy of src
+// reads, into stdout, counted by progress, and explains its failure. With
+// --retries an attempt that fails transiently is followed by another, after a
+// growing delay, which skips the bytes stdout already has so they are not
+// received twice. Without --retries, an attempt failing transiently before
+// it received anything is retried up to connectRetries times, from scratch.
+// When those bytes are no longer the start of the archive,
+// because what it holds changed in between, the copy starts over instead. A
+// copy failing because the pod went away says so.
+func (o *CopyOptions) executeResuming(ctx context.Context, pod *corev1.Pod, container string, command []string, src *fileSpec, dir string, members []string, stdout *bytes.Buffer, progress *transferProgress) error {
+	delay := copyRetryDelay
+	first := command
+	var stderr stderrCapture
+	for retry := 1; ; retry++ {
+		stderrOut, waitStderr := stderr.drain()
+		execErr := o.execute(ctx, pod, container, command, progress.counting(stdout), stderrOut)
+		waitStderr()
+		var cancelled copyCancelledError
+		if errors.As(execErr, &cancelled) {
+			// an exec whose teardown was not confirmed may still write stdout
+			return execErr
+		}
+		if execErr != nil && stdout.Len() == 0 {
+			if uncompressed, ok := o.fallBackFromCompression(first, container, stderr.String()); ok {
+				stderr.Reset()
+				command, first = uncompressed, uncompressed
+				continue
+			}
+		}
+		switch {
+		case execErr == nil:
+			return nil
+		case strings.Contains(stderr.String(), archiveChanged):
+			if o.Retries > 0 && retry > o.Retries {
+				return fmt.Errorf("pod %s/%s: %s changed since the copy was interrupted and no retries are left to copy it again", src.PodNamespace, src.PodName, src.File)
+			}
+			//nolint:errcheck
+			_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: %s changed since the copy was interrupted; copying it again from the start (retry %d%s)\n",
+				src.File, retry, retriesOf(o.Retries))
+			stdout.Reset()
+			stderr.Reset()
+			command = first
+			continue
+		case fileChangedOnly(execErr, stderr.String()) && stdout.Len() > 0:
+			// the archive is complete, with what tar read of the files that
+			// changed
+			for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+				//nolint:errcheck
+				_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: %s; its copy may be inconsistent\n", strings.TrimSpace(line))
+			}
+			return nil
+		case o.Retries == 0 && (stdout.Len() > 0 || retry > connectRetries), o.Retries > 0 && retry > o.Retries, !transientExecError(execErr, stderr.String()):
+			if retry > 1 && classifyRemoteStderr(stderr.String()) == remoteErrUnknown && binaryMissing(execErr, stderr.String()) {
+				return fmt.Errorf("pod %s/%s: resuming a copy needs sh, head, sha256sum and tail in container %s: %s",
+					src.PodNamespace, src.PodName, container, strings.TrimSpace(stderr.String()))
+			}
+			if classifyRemoteStderr(stderr.String()) == remoteErrUnknown {
+				if err := o.podGone(ctx, pod, int64(stdout.Len()), execErr); err != nil {
+					return err
+				}
+			}
+			return o.handleExecError(execErr, stderr.String(), src, container)
+		}
+
+		if o.Retries == 0 {
+			//nolint:errcheck
+			_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: copy failed before receiving anything: %v; retrying in %s (retry %d of %d)\n",
+				execErr, delay, retry, connectRetries)
+		} else {
+			//nolint:errcheck
+			_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Warning: copy interrupted after %d bytes: %v; resuming in %s (retry %d%s)\n",
+				stdout.Len(), execErr, delay, retry, retriesOf(o.Retries))
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return copyCancelledError{terminated: true}
+		case <-timer.C:
+		}
+		delay = min(delay*2, maxCopyRetryDelay)
+
+		stderr.Reset()
+		if stdout.Len() > 0 {
+			received := sha256.Sum256(stdout.Bytes())
+			script := []string{"sh", "-c", resumeScript, "sh", o.tarCreateFlags(), dir, strconv.Itoa(stdout.Len() + 1), hex.EncodeToString(received[:])}
+			script = append(append(append(script, o.tarXattrArgs()...), o.tarExcludeArgs()...), "--")
+			resumed, err := o.remoteCommand(ctx, pod, container, append(script, members...))
+			if err != nil {
+				return err
+			}
+			command = resumed
+		}
+	}
+}
+
+// retriesOf is the " of N" of a retry under a limit of --retries.
+func retriesOf(retries int) string {
+	if retries > 0 {
+		return fmt.Sprintf(" of %d", retries)
+	}
+	return ""
+}
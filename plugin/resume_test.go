@@ -0,0 +1,333 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	restclient "k8s.io/client-go/rest"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// flakyStream serves archive to the tar of a copy and to resumeScript, over a
+// stream that breaks after cuts[i] bytes of the i-th attempt with err, or
+// resumeErr when set and the attempt is a resumed one. With changed set, the
+// archive is changed to it after the first attempt.
+type flakyStream struct {
+	archive   []byte
+	changed   []byte
+	cuts      []int
+	err       error
+	resumeErr error
+	stderr    string
+	commands  [][]string
+}
+
+func (f *flakyStream) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, stderr io.Writer) error {
+	if command[len(command)-1] == "true" || isDiskUsage(command) {
+		return nil
+	}
+	f.commands = append(f.commands, command)
+	if len(f.commands) > 1 && f.changed != nil {
+		f.archive = f.changed
+	}
+	from, err := 0, f.err
+	if i := slices.Index(command, resumeScript); i >= 0 {
+		n, _ := strconv.Atoi(command[i+4])
+		from = n - 1
+		if sum := sha256.Sum256(f.archive[:from]); hex.EncodeToString(sum[:]) != command[i+5] {
+			//nolint:errcheck
+			_, _ = fmt.Fprintln(stderr, archiveChanged)
+			return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 3"), Code: 3}
+		}
+		if f.resumeErr != nil {
+			err = f.resumeErr
+		}
+	}
+	data := f.archive[from:]
+	if attempt := len(f.commands) - 1; attempt < len(f.cuts) {
+		//nolint:errcheck
+		_, _ = stdout.Write(data[:f.cuts[attempt]])
+		//nolint:errcheck
+		_, _ = io.WriteString(stderr, f.stderr)
+		return err
+	}
+	_, err = stdout.Write(data)
+	return err
+}
+
+// receivedSum is the sha256 a resume from byte from sends of the bytes of
+// archive before it.
+func receivedSum(archive []byte, from int) string {
+	sum := sha256.Sum256(archive[:from-1])
+	return hex.EncodeToString(sum[:])
+}
+
+func withoutRetryDelay(t *testing.T) {
+	old := copyRetryDelay
+	t.Cleanup(func() { copyRetryDelay = old })
+	copyRetryDelay = 0
+}
+
+func TestCopyRetriesResume(t *testing.T) {
+	withoutRetryDelay(t)
+	archive := createTestTar(t, map[string]string{"log/a.log": strings.Repeat("a", 3000), "log/b.log": strings.Repeat("b", 2000)}).Bytes()
+	resumed := func(from int) []string {
+		return []string{"env", "LC_ALL=C", "LANG=C", "sh", "-c", resumeScript, "sh", "cf", "/var", strconv.Itoa(from), receivedSum(archive, from), "--", "log"}
+	}
+	tar := []string{"env", "LC_ALL=C", "LANG=C", "tar", "cf", "-", "-C", "/var", "--", "log"}
+
+	tests := []struct {
+		name     string
+		retries  int
+		cuts     []int
+		commands [][]string
+		warnings string
+	}{
+		{"uninterrupted", 2, nil, [][]string{tar}, ""},
+		{
+			"resumed twice", 2, []int{1000, 2500},
+			[][]string{tar, resumed(1001), resumed(3501)},
+			"Warning: copy interrupted after 1000 bytes: unexpected EOF; resuming in 0s (retry 1 of 2)\n" +
+				"Warning: copy interrupted after 3500 bytes: unexpected EOF; resuming in 0s (retry 2 of 2)\n",
+		},
+		{
+			"broken before the first byte", 1, []int{0},
+			[][]string{tar, tar},
+			"Warning: copy interrupted after 0 bytes: unexpected EOF; resuming in 0s (retry 1 of 1)\n",
+		},
+		{
+			"without limit", -1, []int{512, 512, 512, 512},
+			[][]string{tar, resumed(513), resumed(1025), resumed(1537), resumed(2049)},
+			"Warning: copy interrupted after 512 bytes: unexpected EOF; resuming in 0s (retry 1)\n" +
+				"Warning: copy interrupted after 1024 bytes: unexpected EOF; resuming in 0s (retry 2)\n" +
+				"Warning: copy interrupted after 1536 bytes: unexpected EOF; resuming in 0s (retry 3)\n" +
+				"Warning: copy interrupted after 2048 bytes: unexpected EOF; resuming in 0s (retry 4)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &flakyStream{archive: archive, cuts: tt.cuts, err: io.ErrUnexpectedEOF}
+			o := newFakePodCopyOptions(stream)
+			var errOut bytes.Buffer
+			o.IOStreams.ErrOut = &errOut
+			o.Container, o.Retries = "app", tt.retries
+			dest := mustTempDir(t)
+			if err := o.RunWithArgs(context.Background(), "pod:/var/log", dest); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stream.commands, tt.commands) {
+				t.Errorf("commands = %q, want %q", stream.commands, tt.commands)
+			}
+			if errOut.String() != tt.warnings {
+				t.Errorf("warnings = %q, want %q", errOut.String(), tt.warnings)
+			}
+			assertFileContent(t, filepath.Join(dest, "log", "a.log"), strings.Repeat("a", 3000))
+			assertFileContent(t, filepath.Join(dest, "log", "b.log"), strings.Repeat("b", 2000))
+		})
+	}
+}
+
+func TestCopyRetriesRestartWhenChanged(t *testing.T) {
+	withoutRetryDelay(t)
+	before := createTestTar(t, map[string]string{"log/app.log": strings.Repeat("a", 3000)}).Bytes()
+	// the log grew while the stream was down, its header no longer matches
+	after := createTestTar(t, map[string]string{"log/app.log": strings.Repeat("a", 3000) + strings.Repeat("b", 500)}).Bytes()
+	tar := []string{"env", "LC_ALL=C", "LANG=C", "tar", "cf", "-", "-C", "/var", "--", "log"}
+	resumed := []string{"env", "LC_ALL=C", "LANG=C", "sh", "-c", resumeScript, "sh", "cf", "/var", "1001", receivedSum(before, 1001), "--", "log"}
+
+	t.Run("copied again", func(t *testing.T) {
+		stream := &flakyStream{archive: before, changed: after, cuts: []int{1000}, err: io.ErrUnexpectedEOF}
+		o := newFakePodCopyOptions(stream)
+		var errOut bytes.Buffer
+		o.IOStreams.ErrOut = &errOut
+		o.Container, o.Retries = "app", 2
+		dest := mustTempDir(t)
+		if err := o.RunWithArgs(context.Background(), "pod:/var/log", dest); err != nil {
+			t.Fatal(err)
+		}
+		if want := [][]string{tar, resumed, tar}; !reflect.DeepEqual(stream.commands, want) {
+			t.Errorf("commands = %q, want %q", stream.commands, want)
+		}
+		assertContains(t, errOut.String(), "Warning: /var/log changed since the copy was interrupted; copying it again from the start (retry 2 of 2)")
+		// the new archive whole, not its tail spliced onto the old one
+		assertFileContent(t, filepath.Join(dest, "log", "app.log"), strings.Repeat("a", 3000)+strings.Repeat("b", 500))
+	})
+
+	t.Run("out of retries", func(t *testing.T) {
+		stream := &flakyStream{archive: before, changed: after, cuts: []int{1000}, err: io.ErrUnexpectedEOF}
+		o := newFakePodCopyOptions(stream)
+		o.Container, o.Retries = "app", 1
+		dest := mustTempDir(t)
+		err := o.RunWithArgs(context.Background(), "pod:/var/log", dest)
+		if want := "pod default/pod: /var/log changed since the copy was interrupted and no retries are left to copy it again"; err == nil || err.Error() != want {
+			t.Fatalf("RunWithArgs() = %v, want %s", err, want)
+		}
+		assertFileDoesNotExist(t, filepath.Join(dest, "log"))
+	})
+}
+
+func TestCopyRetriesFailedConnection(t *testing.T) {
+	withoutRetryDelay(t)
+	archive := createTestTar(t, map[string]string{"app.log": "GET / 200\n"}).Bytes()
+	stream := &flakyStream{archive: archive, cuts: []int{0, 0}, err: errors.New("error dialing backend: EOF")}
+	o := newFakePodCopyOptions(stream)
+	var errOut bytes.Buffer
+	o.Container, o.IOStreams.ErrOut = "app", &errOut
+	dir := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", dir); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	assertFileContent(t, filepath.Join(dir, "app.log"), "GET / 200\n")
+	// every attempt archives the path from scratch
+	for _, command := range stream.commands {
+		if !reflect.DeepEqual(command, stream.commands[0]) {
+			t.Errorf("retried with %q, want %q", command, stream.commands[0])
+		}
+	}
+	assertContains(t, errOut.String(), "Warning: copy failed before receiving anything: error dialing backend: EOF; retrying in 0s (retry 2 of 3)\n")
+}
+
+func TestCopyRetriesGiveUp(t *testing.T) {
+	withoutRetryDelay(t)
+	archive := createTestTar(t, map[string]string{"app.log": strings.Repeat("a", 3000)}).Bytes()
+
+	tests := []struct {
+		name     string
+		retries  int
+		stream   *flakyStream
+		attempts int
+		want     string
+	}{
+		{"no retries", 0, &flakyStream{cuts: []int{100}, err: io.ErrUnexpectedEOF}, 1, "pod default/pod: command failed: unexpected EOF"},
+		{
+			"no retries failing to connect", 0,
+			&flakyStream{cuts: []int{0, 0, 0, 0}, err: errors.New("error dialing backend: EOF")}, 4,
+			"pod default/pod: command failed: error dialing backend: EOF",
+		},
+		{"out of retries", 2, &flakyStream{cuts: []int{100, 100, 100}, err: io.ErrUnexpectedEOF}, 3, "pod default/pod: command failed: unexpected EOF"},
+		{
+			"permission denied", 2,
+			&flakyStream{cuts: []int{0}, stderr: "tar: app.log: Cannot open: Permission denied\n", err: io.ErrUnexpectedEOF}, 1,
+			"pod default/pod: permission denied: /var/log/app.log",
+		},
+		{
+			"remote command failed", 2,
+			&flakyStream{cuts: []int{100}, err: utilexec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}}, 1,
+			"pod default/pod: command failed: command terminated with exit code 2",
+		},
+		{
+			"resume without tail", 2,
+			&flakyStream{cuts: []int{100, 0}, stderr: "sh: tail: not found\n", err: io.ErrUnexpectedEOF, resumeErr: utilexec.CodeExitError{Err: errors.New("command terminated with exit code 127"), Code: 127}}, 2,
+			"pod default/pod: resuming a copy needs sh, head, sha256sum and tail in container app: sh: tail: not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.stream.archive = archive
+			o := newFakePodCopyOptions(tt.stream)
+			o.Container, o.Retries = "app", tt.retries
+			err := o.RunWithArgs(context.Background(), "pod:/var/log/app.log", mustTempDir(t))
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("RunWithArgs() = %v, want %s", err, tt.want)
+			}
+			if len(tt.stream.commands) != tt.attempts {
+				t.Errorf("attempts = %d, want %d: %q", len(tt.stream.commands), tt.attempts, tt.stream.commands)
+			}
+		})
+	}
+}
+
+func TestCopyRetriesCancelled(t *testing.T) {
+	old := copyRetryDelay
+	t.Cleanup(func() { copyRetryDelay = old })
+	copyRetryDelay = time.Hour
+
+	stream := &flakyStream{archive: make([]byte, 1024), cuts: []int{100}, err: io.ErrUnexpectedEOF}
+	o := newFakePodCopyOptions(stream)
+	o.Container, o.Retries = "app", -1
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := o.RunWithArgs(ctx, "pod:/var/log/app.log", mustTempDir(t))
+	if !errors.As(err, new(copyCancelledError)) {
+		t.Fatalf("RunWithArgs() = %v, want the copy cancelled", err)
+	}
+}
+
+func TestTransientExecError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		stderr string
+		want   bool
+	}{
+		{"unexpected EOF", fmt.Errorf("error reading from stream: %w", io.ErrUnexpectedEOF), "", true},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, "", true},
+		{"broken pipe", errors.New("write tcp 10.0.0.1:443: write: broken pipe"), "", true},
+		{"dialing backend", errors.New("error dialing backend: EOF"), "", true},
+		{"apiserver unavailable", apierrors.NewServiceUnavailable("etcd"), "", true},
+		{"throttled", apierrors.NewTooManyRequests("slow down", 1), "", true},
+		{"forbidden", apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "pod", errors.New("no")), "", false},
+		{"exit code", utilexec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}, "", false},
+		{"path not found", io.ErrUnexpectedEOF, "tar: app.log: Cannot stat: No such file or directory\n", false},
+		{"cancelled", copyCancelledError{terminated: true}, "", false},
+		{"other", errors.New("unable to upgrade connection: pod does not exist"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transientExecError(tt.err, tt.stderr); got != tt.want {
+				t.Errorf("transientExecError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*CopyOptions)
+		wantErr string
+	}{
+		{"without limit", func(o *CopyOptions) { o.Retries = -1 }, ""},
+		{"negative", func(o *CopyOptions) { o.Retries = -2 }, "invalid --retries -2"},
+		{"chunked", func(o *CopyOptions) { o.Retries, o.Chunked = 3, true }, "can't be used with --retries"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newFakePodCopyOptions(&fakeExecutor{})
+			o.ClientConfig = &restclient.Config{}
+			o.ChunkSize = defaultChunkSize
+			tt.modify(o)
+			err := o.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
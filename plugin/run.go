@@ -0,0 +1,427 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	utilexec "k8s.io/client-go/util/exec"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/cmd/util/podcmd"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+const defaultRunConcurrency = 5
+
+// RunOptions contains the options for running one command in many pods.
+type RunOptions struct {
+	Namespace    string
+	ClientConfig *restclient.Config
+	Clientset    kubernetes.Interface
+	IOStreams    genericiooptions.IOStreams
+
+	// PodName is the single pod to run in, when no selector is given.
+	PodName  string
+	Selector string
+	// AllMatching must be set to run in more than one pod.
+	AllMatching bool
+	Container   string
+	Command     []string
+	// Concurrency bounds the pods running the command at once.
+	Concurrency int
+	// PodTimeout bounds the command in each pod, Timeout the whole run. Zero
+	// leaves them unbounded.
+	PodTimeout time.Duration
+	Timeout    time.Duration
+	// Collect prints the output of each pod in one block at the end instead of
+	// streaming it prefixed line by line.
+	Collect bool
+	// Output is empty or json.
+	Output string
+	// IgnoreErrors exits zero even when the command failed in some pods.
+	IgnoreErrors bool
+
+	executor remoteExecutor
+}
+
+// podRunResult is what the command did in one pod, and an element of the -o
+// json array.
+type podRunResult struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container,omitempty"`
+	// ExitCode is -1 when the command did not run to an exit status, Error
+	// says why.
+	ExitCode        int     `json:"exit_code"`
+	Error           string  `json:"error,omitempty"`
+	Stdout          string  `json:"stdout"`
+	Stderr          string  `json:"stderr"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// NewCmdRun creates the 'run' command, which runs a non-interactive command in
+// every pod matching a selector.
+func NewCmdRun(f cmdutil.Factory, ioStreams genericiooptions.IOStreams) *cobra.Command {
+	o := &RunOptions{IOStreams: ioStreams, Concurrency: defaultRunConcurrency}
+
+	cmd := &cobra.Command{
+		Use:                   "run (POD | -l SELECTOR --all-matching) -- COMMAND [args...]",
+		DisableFlagsInUseLine: true,
+		Short:                 i18n.T("Run a command in one or many pods (with audit)"),
+		Long: templates.LongDesc(`
+			Run a non-interactive command in a pod, or in every Running pod matching
+			a label selector. Every pod is its own audited rexec session, opened with
+			the --change-id and --reason of the run.
+
+			By default the output of all pods is streamed as it comes, every line
+			prefixed with [pod-name]. With --collect the output of each pod is
+			printed in one block once all pods are done, and -o json prints an
+			array of per-pod results. The exit code is non-zero if the command
+			failed in any pod, unless --ignore-errors is set.`),
+		Example: templates.Examples(`
+			# Show the last errors of every replica of a workload
+			kubectl rexec run -l app=payments --all-matching -- sh -c 'grep ERROR /var/log/app.log | tail -5'
+
+			# Collect per-pod reports, at most 10 pods at a time
+			kubectl rexec run -l app=payments --all-matching --collect --concurrency 10 -- df -h
+
+			# Machine-readable results
+			kubectl rexec run -l app=payments --all-matching -o json -- cat /etc/os-release`),
+		Annotations: map[string]string{outputFormatsAnnotation: "json"},
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f, cmd, args))
+			cmdutil.CheckErr(o.Validate())
+			cmdutil.CheckErr(explainClockSkew(cmd.Context(), o.Run(cmd.Context()), o.ClientConfig))
+		},
+	}
+
+	cmd.Flags().StringVarP(&o.Selector, "selector", "l", "", "Selector (label query) of the pods to run the command in")
+	cmd.Flags().BoolVar(&o.AllMatching, "all-matching", false, "Run in every Running pod matching the selector, required when more than one matches")
+	cmd.Flags().StringVarP(&o.Container, "container", "c", "", "Container name. If omitted, use the default container of each pod")
+	cmd.Flags().IntVar(&o.Concurrency, "concurrency", o.Concurrency, "Number of pods to run the command in at once")
+	cmd.Flags().DurationVar(&o.PodTimeout, "pod-timeout", 0, "Give up on a pod after this long (0 waits forever)")
+	cmd.Flags().DurationVar(&o.Timeout, "timeout", 0, "Give up on all pods still running after this long (0 waits forever)")
+	cmd.Flags().BoolVar(&o.Collect, "collect", false, "Print the output of each pod in one block when all pods are done")
+	cmd.Flags().StringVarP(&o.Output, "output", "o", "", "Output format, json for an array of per-pod results")
+	cmd.Flags().BoolVar(&o.IgnoreErrors, "ignore-errors", false, "Exit zero even if the command failed in some pods")
+	return cmd
+}
+
+// Complete takes the pod and the command from args and sets up the clients.
+func (o *RunOptions) Complete(f cmdutil.Factory, cmd *cobra.Command, args []string) error {
+	dash := cmd.ArgsLenAtDash()
+	if dash < 0 {
+		return fmt.Errorf("the command must follow --, e.g. kubectl rexec run -l app=web --all-matching -- date")
+	}
+	if dash > 1 {
+		return fmt.Errorf("expected at most one pod before --, got %d arguments", dash)
+	}
+	if dash == 1 {
+		o.PodName = args[0]
+	}
+	o.Command = args[dash:]
+
+	var err error
+	o.Namespace, _, err = f.ToRawKubeConfigLoader().Namespace()
+	if err != nil {
+		return err
+	}
+	o.ClientConfig, err = f.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	logTarget(f, cmd, o.ClientConfig)
+	o.Clientset, err = f.KubernetesClientSet()
+	return err
+}
+
+// Validate checks the pod selection, the command and the flags.
+func (o *RunOptions) Validate() error {
+	switch {
+	case len(o.Command) == 0:
+		return fmt.Errorf("a command is required after --")
+	case o.PodName == "" && o.Selector == "":
+		return fmt.Errorf("a pod or a selector (-l) is required")
+	case o.PodName != "" && o.Selector != "":
+		return fmt.Errorf("a pod and a selector (-l) can't be used together")
+	case o.Concurrency < 1:
+		return fmt.Errorf("--concurrency must be at least 1")
+	case o.Output != "" && o.Output != "json":
+		return fmt.Errorf("unsupported output format %q, only json is supported", o.Output)
+	case o.Output == "json" && o.Collect:
+		return fmt.Errorf("--collect and -o json can't be used together")
+	}
+	return nil
+}
+
+// Run runs the command in every selected pod and reports the results.
+func (o *RunOptions) Run(ctx context.Context) error {
+	pods, err := o.selectPods(ctx)
+	if err != nil {
+		return err
+	}
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
+	// streamed lines of different pods may interleave, but never within a line
+	var outMu sync.Mutex
+	results := make([]podRunResult, len(pods))
+	sem := make(chan struct{}, o.Concurrency)
+	var wg sync.WaitGroup
+	for i := range pods {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = podRunResult{Namespace: pods[i].Namespace, Pod: pods[i].Name, ExitCode: -1, Error: "not started: " + ctx.Err().Error()}
+				return
+			}
+			results[i] = o.runInPod(ctx, &pods[i], &outMu)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r.ExitCode != 0 {
+			failed++
+		}
+	}
+	if err := o.report(results, failed); err != nil {
+		return err
+	}
+	if failed > 0 && !o.IgnoreErrors {
+		return fmt.Errorf("the command failed in %d of %d pods", failed, len(results))
+	}
+	return nil
+}
+
+// selectPods returns the Running pods to run in, sorted by name.
+func (o *RunOptions) selectPods(ctx context.Context) ([]corev1.Pod, error) {
+	if o.PodName != "" {
+		start := time.Now()
+		pod, err := o.Clientset.CoreV1().Pods(o.Namespace).Get(ctx, o.PodName, metav1.GetOptions{})
+		logPodGet(o.Namespace, o.PodName, start)
+		if err != nil {
+			return nil, err
+		}
+		if pod.Status.Phase != corev1.PodRunning {
+			return nil, fmt.Errorf("pod %s/%s is not running (phase: %s)", pod.Namespace, pod.Name, pod.Status.Phase)
+		}
+		return []corev1.Pod{*pod}, nil
+	}
+
+	list, err := o.Clientset.CoreV1().Pods(o.Namespace).List(ctx, metav1.ListOptions{LabelSelector: o.Selector})
+	if err != nil {
+		return nil, err
+	}
+	var pods []corev1.Pod
+	for _, pod := range list.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no Running pods in namespace %s match %q", o.Namespace, o.Selector)
+	}
+	if len(pods) > 1 && !o.AllMatching {
+		return nil, fmt.Errorf("%d Running pods match %q, pass --all-matching to run in all of them", len(pods), o.Selector)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+// runInPod runs the command in one pod as a session of its own.
+func (o *RunOptions) runInPod(ctx context.Context, pod *corev1.Pod, outMu *sync.Mutex) podRunResult {
+	result := podRunResult{Namespace: pod.Namespace, Pod: pod.Name, ExitCode: -1}
+	start := time.Now()
+	defer func() { result.DurationSeconds = time.Since(start).Seconds() }()
+
+	container, err := podcmd.FindOrDefaultContainerByName(pod, o.Container, true, io.Discard)
+	if err != nil {
+		result.Error = err.Error()
+		o.streamError(pod.Name, result.Error, outMu)
+		return result
+	}
+	result.Container = container.Name
+
+	if o.PodTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.PodTimeout)
+		defer cancel()
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	var stdout, stderr io.Writer = &stdoutBuf, &stderrBuf
+	var streams []*prefixWriter
+	if o.streaming() {
+		prefix := "[" + pod.Name + "] "
+		streams = []*prefixWriter{
+			{out: o.IOStreams.Out, prefix: prefix, mu: outMu},
+			{out: o.IOStreams.ErrOut, prefix: prefix, mu: outMu},
+		}
+		stdout, stderr = streams[0], streams[1]
+	}
+
+	execErr := o.execute(ctx, pod, container.Name, stdout, stderr)
+	for _, w := range streams {
+		w.flush()
+	}
+	result.Stdout, result.Stderr = stdoutBuf.String(), stderrBuf.String()
+
+	var exitErr utilexec.ExitError
+	switch {
+	case execErr == nil:
+		result.ExitCode = 0
+	case errors.As(execErr, &exitErr) && exitErr.Exited():
+		result.ExitCode = exitErr.ExitStatus()
+	case ctx.Err() != nil:
+		result.Error = "timed out: " + execErr.Error()
+	default:
+		result.Error = execErr.Error()
+	}
+	if result.Error != "" {
+		o.streamError(pod.Name, result.Error, outMu)
+	}
+	return result
+}
+
+func (o *RunOptions) execute(ctx context.Context, pod *corev1.Pod, container string, stdout, stderr io.Writer) error {
+	var executor remoteExecutor = rexecExecutor{config: o.ClientConfig}
+	if o.executor != nil {
+		executor = o.executor
+	}
+	done := logExec("POST", execEndpoint(o.ClientConfig, pod, container, o.Command, false), pod, container, o.Command)
+	err := executor.Execute(ctx, pod, container, o.Command, stdout, stderr)
+	done(err)
+	return err
+}
+
+func (o *RunOptions) streaming() bool {
+	return !o.Collect && o.Output == ""
+}
+
+// streamError prints why a pod failed as part of the stream; collected and
+// json output carry it in the result.
+func (o *RunOptions) streamError(pod, message string, outMu *sync.Mutex) {
+	if !o.streaming() {
+		return
+	}
+	outMu.Lock()
+	defer outMu.Unlock()
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "[%s] error: %s\n", pod, message)
+}
+
+// report prints the results in the selected output mode.
+func (o *RunOptions) report(results []podRunResult, failed int) error {
+	out, errOut := o.IOStreams.Out, newOutput(o.IOStreams.ErrOut)
+	switch {
+	case o.Output == "json":
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	case o.Collect:
+		styled := newOutput(out)
+		for _, r := range results {
+			if _, err := fmt.Fprintln(out, styled.bold(styled.wrap(fmt.Sprintf("=== %s (%s)", r.Pod, runStatus(r))))); err != nil {
+				return fmt.Errorf("failed to write output: %v", err)
+			}
+			//nolint:errcheck
+			_, _ = io.WriteString(out, withTrailingNewline(r.Stdout))
+			if r.Stderr != "" {
+				//nolint:errcheck
+				_, _ = fmt.Fprintf(out, "--- stderr\n%s", withTrailingNewline(r.Stderr))
+			}
+		}
+	}
+	if failed > 0 {
+		errOut.printf("Failed in %d of %d pods:\n", failed, len(results))
+		for _, r := range results {
+			if r.ExitCode != 0 {
+				errOut.printf("  %s: %s\n", r.Pod, runStatus(r))
+			}
+		}
+	}
+	return nil
+}
+
+func runStatus(r podRunResult) string {
+	if r.Error != "" {
+		return r.Error
+	}
+	return fmt.Sprintf("exit code %d", r.ExitCode)
+}
+
+func withTrailingNewline(s string) string {
+	if s == "" || s[len(s)-1] == '\n' {
+		return s
+	}
+	return s + "\n"
+}
+
+// prefixWriter writes complete lines to out, each prefixed, under mu. A partial
+// line is held until its end arrives or flush is called.
+type prefixWriter struct {
+	out     io.Writer
+	prefix  string
+	mu      *sync.Mutex
+	partial []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	end := bytes.LastIndexByte(w.partial, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	lines := w.partial[:end+1]
+	var buf bytes.Buffer
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		buf.WriteString(w.prefix)
+		buf.Write(lines[:i+1])
+		lines = lines[i+1:]
+	}
+	w.partial = append(w.partial[:0], w.partial[end+1:]...)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes a last line that had no newline.
+func (w *prefixWriter) flush() {
+	if len(w.partial) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.partial)
+	w.partial = nil
+}
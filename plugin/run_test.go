@@ -0,0 +1,303 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	restclient "k8s.io/client-go/rest"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func runPod(name string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "payments"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+// fleetExecutor answers per pod and records how many pods ran at once.
+type fleetExecutor struct {
+	run     func(ctx context.Context, pod string, stdout, stderr io.Writer) error
+	delay   time.Duration
+	active  atomic.Int32
+	maxSeen atomic.Int32
+	mu      sync.Mutex
+	pods    []string
+}
+
+func (f *fleetExecutor) Execute(ctx context.Context, pod *corev1.Pod, _ string, _ []string, stdout, stderr io.Writer) error {
+	n := f.active.Add(1)
+	defer f.active.Add(-1)
+	for {
+		m := f.maxSeen.Load()
+		if n <= m || f.maxSeen.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	f.mu.Lock()
+	f.pods = append(f.pods, pod.Name)
+	f.mu.Unlock()
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.run(ctx, pod.Name, stdout, stderr)
+}
+
+// grepErrors prints two lines from every pod, pod-1 fails with exit code 2 and
+// pod-2 can't be reached.
+func grepErrors(_ context.Context, pod string, stdout, stderr io.Writer) error {
+	switch pod {
+	case "pod-1":
+		//nolint:errcheck
+		_, _ = io.WriteString(stderr, "grep: /var/log/app.log: No such file or directory\n")
+		return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}
+	case "pod-2":
+		return errors.New("error dialing backend: connection refused")
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(stdout, "ERROR one on %s\nERROR two", pod)
+	return nil
+}
+
+func newRunTestOptions(executor remoteExecutor, pods ...*corev1.Pod) (*RunOptions, *bytes.Buffer, *bytes.Buffer) {
+	var objects []runtime.Object
+	for _, p := range pods {
+		objects = append(objects, p)
+	}
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	return &RunOptions{
+		Namespace:   "default",
+		Clientset:   fake.NewSimpleClientset(objects...),
+		IOStreams:   genericiooptions.IOStreams{Out: out, ErrOut: errOut},
+		Selector:    "app=payments",
+		AllMatching: true,
+		Command:     []string{"sh", "-c", "grep ERROR /var/log/app.log | tail -5"},
+		Concurrency: defaultRunConcurrency,
+		executor:    executor,
+	}, out, errOut
+}
+
+func fleet() []*corev1.Pod {
+	return []*corev1.Pod{
+		runPod("pod-0", corev1.PodRunning),
+		runPod("pod-1", corev1.PodRunning),
+		runPod("pod-2", corev1.PodRunning),
+		runPod("pod-3", corev1.PodRunning),
+		runPod("pod-done", corev1.PodSucceeded),
+	}
+}
+
+func TestRunStreamsPrefixedLines(t *testing.T) {
+	o, out, errOut := newRunTestOptions(&fleetExecutor{run: grepErrors}, fleet()...)
+
+	err := o.Run(context.Background())
+	if err == nil || err.Error() != "the command failed in 2 of 4 pods" {
+		t.Fatalf("Run() = %v, want a partial failure", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected two lines of each successful pod, got:\n%s", out)
+	}
+	for _, want := range []string{"[pod-0] ERROR one on pod-0", "[pod-0] ERROR two", "[pod-3] ERROR one on pod-3", "[pod-3] ERROR two"} {
+		assertContains(t, out.String(), want+"\n")
+	}
+	for _, want := range []string{
+		"[pod-1] grep: /var/log/app.log: No such file or directory",
+		"[pod-2] error: error dialing backend: connection refused",
+		"Failed in 2 of 4 pods:",
+		"  pod-1: exit code 2",
+	} {
+		assertContains(t, errOut.String(), want)
+	}
+	if strings.Contains(out.String()+errOut.String(), "pod-done") {
+		t.Fatal("a completed pod must not be run in")
+	}
+}
+
+func TestRunCollect(t *testing.T) {
+	o, out, _ := newRunTestOptions(&fleetExecutor{run: grepErrors}, fleet()...)
+	o.Collect = true
+	o.IgnoreErrors = true
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatalf("Run() = %v, want nil with --ignore-errors", err)
+	}
+	want := "=== pod-0 (exit code 0)\nERROR one on pod-0\nERROR two\n" +
+		"=== pod-1 (exit code 2)\n--- stderr\ngrep: /var/log/app.log: No such file or directory\n" +
+		"=== pod-2 (error dialing backend: connection refused)\n" +
+		"=== pod-3 (exit code 0)\nERROR one on pod-3\nERROR two\n"
+	if out.String() != want {
+		t.Fatalf("collected output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRunJSON(t *testing.T) {
+	o, out, _ := newRunTestOptions(&fleetExecutor{run: grepErrors}, fleet()...)
+	o.Output = "json"
+
+	if err := o.Run(context.Background()); err == nil {
+		t.Fatal("expected an error for the failed pods")
+	}
+	var results []podRunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("output is not a json array: %v\n%s", err, out)
+	}
+	if len(results) != 4 {
+		t.Fatalf("got %d results, want 4", len(results))
+	}
+	if r := results[0]; r.Pod != "pod-0" || r.Container != "app" || r.ExitCode != 0 || r.Stdout != "ERROR one on pod-0\nERROR two" {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if r := results[1]; r.ExitCode != 2 || r.Error != "" || !strings.Contains(r.Stderr, "No such file") {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if r := results[2]; r.ExitCode != -1 || r.Error != "error dialing backend: connection refused" {
+		t.Fatalf("unexpected result %+v", r)
+	}
+}
+
+func TestRunLimitsConcurrency(t *testing.T) {
+	var pods []*corev1.Pod
+	for i := 0; i < 12; i++ {
+		pods = append(pods, runPod(fmt.Sprintf("pod-%02d", i), corev1.PodRunning))
+	}
+	executor := &fleetExecutor{run: grepErrors, delay: 20 * time.Millisecond}
+	o, _, _ := newRunTestOptions(executor, pods...)
+	o.Concurrency = 3
+
+	if err := o.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(executor.pods) != 12 {
+		t.Fatalf("ran in %d pods, want 12", len(executor.pods))
+	}
+	if most := executor.maxSeen.Load(); most > 3 {
+		t.Fatalf("%d pods ran at once, want at most 3", most)
+	}
+}
+
+func TestRunTimeouts(t *testing.T) {
+	hang := func(ctx context.Context, _ string, _, _ io.Writer) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	t.Run("per pod", func(t *testing.T) {
+		o, out, _ := newRunTestOptions(&fleetExecutor{run: hang}, fleet()...)
+		o.Output = "json"
+		o.PodTimeout = 10 * time.Millisecond
+		if err := o.Run(context.Background()); err == nil {
+			t.Fatal("expected the run to fail")
+		}
+		var results []podRunResult
+		if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range results {
+			if r.ExitCode != -1 || r.Error != "timed out: context deadline exceeded" {
+				t.Fatalf("unexpected result %+v", r)
+			}
+		}
+	})
+
+	t.Run("overall", func(t *testing.T) {
+		o, out, _ := newRunTestOptions(&fleetExecutor{run: hang}, fleet()...)
+		o.Output = "json"
+		o.Concurrency = 1
+		o.Timeout = 20 * time.Millisecond
+		if err := o.Run(context.Background()); err == nil {
+			t.Fatal("expected the run to fail")
+		}
+		var results []podRunResult
+		if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range results {
+			if r.ExitCode != -1 || !(strings.HasPrefix(r.Error, "timed out") || strings.HasPrefix(r.Error, "not started")) {
+				t.Fatalf("unexpected result %+v", r)
+			}
+		}
+	})
+}
+
+func TestRunPodSelection(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(o *RunOptions)
+		pods    []*corev1.Pod
+		wantErr string
+	}{
+		{"several without --all-matching", func(o *RunOptions) { o.AllMatching = false }, fleet(), "4 Running pods match \"app=payments\", pass --all-matching"},
+		{"none running", nil, []*corev1.Pod{runPod("pod-done", corev1.PodSucceeded)}, "no Running pods in namespace default match"},
+		{"single pod by name", func(o *RunOptions) { o.Selector, o.PodName = "", "pod-done" }, fleet(), "pod default/pod-done is not running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, _, _ := newRunTestOptions(&fleetExecutor{run: grepErrors}, tt.pods...)
+			if tt.modify != nil {
+				tt.modify(o)
+			}
+			err := o.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Run() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunSendsReasonWithEveryPod(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got[r.URL.Path] = r.Header.Get(reasonHeader)
+		mu.Unlock()
+		// a refused exec still shows what the plugin sent
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	old := Reason
+	t.Cleanup(func() { Reason = old })
+	Reason = "INC-42 payments stuck"
+
+	o, _, _ := newRunTestOptions(nil, fleet()...)
+	o.ClientConfig = wrapConfig(&restclient.Config{Host: srv.URL, ContentConfig: restclient.ContentConfig{
+		GroupVersion: &corev1.SchemeGroupVersion, NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+	}})
+	if err := o.Run(context.Background()); err == nil {
+		t.Fatal("Run() succeeded with every exec refused")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, pod := range []string{"pod-0", "pod-1", "pod-2", "pod-3"} {
+		if reason := got[rexecExecPath("default", pod)]; reason != Reason {
+			t.Errorf("exec in %s sent reason %q, want %q", pod, reason, Reason)
+		}
+	}
+	if len(got) != 4 {
+		t.Errorf("execs sent = %q, want one per Running pod", got)
+	}
+}
@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+// logsModTime is the modification time of the files of logsTar.
+var logsModTime = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// logsTar is logs/ with a file per name, of its content and of logsModTime.
+func logsTar(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "logs/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: logsModTime}); err != nil {
+		t.Fatalf(errWriteTarHeaderForFmt, "logs/", err)
+	}
+	for name, content := range files {
+		h := &tar.Header{Name: "logs/" + name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content)), ModTime: logsModTime}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return &buf
+}
+
+func TestExtractSkipExisting(t *testing.T) {
+	files := map[string]string{"a.log": "aaaa", "b.log": "bbbb", "c.log": "cccc"}
+	dest := mustTempDir(t)
+	if _, err := newDefaultCopyOptions().extractTar(context.Background(), logsTar(t, files), dest, ""); err != nil {
+		t.Fatal(err)
+	}
+	// b.log was cut short by the failed copy, c.log never arrived
+	if err := os.WriteFile(filepath.Join(dest, "logs", "b.log"), []byte("bb"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dest, "logs", "c.log")); err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(dest, "logs", "a.log")
+	if err := os.Chmod(a, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	o := newDefaultCopyOptions()
+	o.SkipExisting = true
+	o.MaxSize = "8"
+	result, err := o.extractTar(context.Background(), logsTar(t, files), dest, "")
+	if err != nil {
+		t.Fatalf("extractTar() error = %v, the unchanged file counted toward --max-size", err)
+	}
+	if result.Unchanged != 1 || result.Files != 2 {
+		t.Errorf("result = %+v, want a.log unchanged and 2 files written", result)
+	}
+	if info, err := os.Stat(a); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("a.log = %v, %v, want it left as it was", info, err)
+	}
+	for name, content := range files {
+		assertFileContent(t, filepath.Join(dest, "logs", name), content)
+	}
+}
+
+func TestExtractSkipExistingModified(t *testing.T) {
+	dest := mustTempDir(t)
+	if _, err := newDefaultCopyOptions().extractTar(context.Background(), logsTar(t, map[string]string{"a.log": "aaaa"}), dest, ""); err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(dest, "logs", "a.log")
+	if err := os.WriteFile(a, []byte("AAAA"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	o := newDefaultCopyOptions()
+	o.SkipExisting = true
+	result, err := o.extractTar(context.Background(), logsTar(t, map[string]string{"a.log": "aaaa"}), dest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Unchanged != 0 {
+		t.Errorf("result = %+v, the file of another modification time was skipped", result)
+	}
+	assertFileContent(t, a, "aaaa")
+}
+
+func TestCopySkipExistingSummary(t *testing.T) {
+	archive := logsTar(t, map[string]string{"a.log": "aaaa", "b.log": "bbbb"}).Bytes()
+	dest := mustTempDir(t)
+	copyLogs := func() string {
+		o := newFakePodCopyOptions(&fakeExecutor{stdout: archive})
+		var out bytes.Buffer
+		o.IOStreams.Out = &out
+		o.SkipExisting = true
+		if err := o.RunWithArgs(context.Background(), "pod:/var/logs", dest); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	assertContains(t, copyLogs(), "Copied 2 files (8 B) from pod:/var/logs")
+	again := copyLogs()
+	assertContains(t, again, "Copied 0 files (0 B) from pod:/var/logs")
+	assertContains(t, again, ", 2 unchanged files skipped\n")
+}
+
+func TestCopyValidateSkipExisting(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(o *CopyOptions)
+		wantErr string
+	}{
+		{"chunked", func(o *CopyOptions) { o.Chunked = true }, "--skip-existing can't be used with --chunked"},
+		{"no preserve times", func(o *CopyOptions) { o.NoPreserveTimes = true }, "--skip-existing compares the modification times"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.ClientConfig = &restclient.Config{}
+			o.SkipExisting = true
+			tt.set(o)
+			if err := o.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// RunWithSources copies several paths of one pod into the existing local
+// directory dest through a single exec, each under its base name. With one
+// source it is RunWithArgs. A remote path with *, ? or [ is a pattern, the
+// paths of the pod it matches are the sources.
+func (o *CopyOptions) RunWithSources(ctx context.Context, srcs []string, dest string) (err error) {
+	o.silence()
+	ctx, cancel := o.withTimeout(ctx)
+	defer cancel()
+	defer func() { err = o.timedOut(ctx, err) }()
+	srcs, err = o.expandRemoteGlobs(ctx, srcs)
+	if err != nil {
+		return err
+	}
+	if len(srcs) == 1 {
+		return o.RunWithArgs(ctx, srcs[0], dest)
+	}
+	if dest == stdoutDest {
+		return fmt.Errorf("a destination of - writes the archive of a single source to stdout")
+	}
+	if o.Selector != "" || o.DryRun || o.EntriesFrom != "" || o.Chunked || o.SourcesManifest != "" || o.Open || o.OpenWith != "" || o.Output != "" {
+		return fmt.Errorf("several sources can't be used with --selector, --dry-run, --entries-from, --chunked, --sources-manifest, --open, --open-with or -o")
+	}
+
+	destSpec, err := parseFileSpec(dest, o.Namespace)
+	if err != nil {
+		return err
+	}
+	specs := make([]*fileSpec, len(srcs))
+	for i, src := range srcs {
+		if specs[i], err = parseFileSpec(src, o.Namespace); err != nil {
+			return err
+		}
+		if err := validateCopySpecs(specs[i], destSpec, false); err != nil {
+			return err
+		}
+	}
+	if info, err := os.Stat(destSpec.File); err != nil || !info.IsDir() {
+		return fmt.Errorf("with several sources the destination must be an existing directory: %s", destSpec.File)
+	}
+	dir, members, err := copySources(specs)
+	if err != nil {
+		return err
+	}
+	return o.copyManyFromPod(ctx, specs, dir, members, destSpec)
+}
+
+// copySources returns the directory the tar of a copy of the paths srcs runs
+// in, the deepest one containing them all, and the members it archives there,
+// the paths relative to it. The paths must be of one pod, all absolute or all
+// relative, with distinct base names and none inside another.
+func copySources(srcs []*fileSpec) (string, []string, error) {
+	paths := make([]string, len(srcs))
+	bases := map[string]string{}
+	for i, src := range srcs {
+		if src.PodName != srcs[0].PodName || src.PodNamespace != srcs[0].PodNamespace {
+			return "", nil, fmt.Errorf("all sources must be of one pod, %s/%s and %s/%s are not", srcs[0].PodNamespace, srcs[0].PodName, src.PodNamespace, src.PodName)
+		}
+		p := path.Clean(src.File)
+		if path.IsAbs(p) != path.IsAbs(path.Clean(srcs[0].File)) {
+			return "", nil, fmt.Errorf("sources must be all absolute or all relative paths, %s and %s are not", srcs[0].File, src.File)
+		}
+		base := path.Base(p)
+		if base == "/" || base == "." || base == ".." {
+			return "", nil, fmt.Errorf("%s can't be copied with other sources, it has no name to copy it under", src.File)
+		}
+		if other, ok := bases[base]; ok {
+			return "", nil, fmt.Errorf("sources %s and %s would both be copied to %s", other, src.File, base)
+		}
+		bases[base] = src.File
+		paths[i] = p
+	}
+	for i, p := range paths {
+		for j, q := range paths {
+			if i != j && strings.HasPrefix(q, p+"/") {
+				return "", nil, fmt.Errorf("source %s is inside source %s", srcs[j].File, srcs[i].File)
+			}
+		}
+	}
+
+	dir := path.Dir(paths[0])
+	for _, p := range paths[1:] {
+		for dir != "/" && dir != "." && !strings.HasPrefix(p, dir+"/") {
+			dir = path.Dir(dir)
+		}
+	}
+	members := make([]string, len(paths))
+	for i, p := range paths {
+		members[i] = strings.TrimPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+		if dir == "." {
+			members[i] = p
+		}
+	}
+	return dir, members, nil
+}
+
+// copyManyFromPod copies the members of dir in the pod of srcs into the
+// local directory dest, each under its base name.
+func (o *CopyOptions) copyManyFromPod(ctx context.Context, srcs []*fileSpec, dir string, members []string, dest *fileSpec) error {
+	pod, containerName, err := o.validateAndGetPodContainer(ctx, srcs[0])
+	if err != nil {
+		return err
+	}
+	command, err := o.remoteCommand(ctx, pod, containerName, o.tarCreateCommand(dir, members))
+	if err != nil {
+		return err
+	}
+	paths := make([]string, len(srcs))
+	for i, src := range srcs {
+		paths[i] = src.File
+	}
+	if err := o.preflight(ctx, pod, containerName, dest.File, paths...); err != nil {
+		return err
+	}
+
+	// failures name every source, tar's stderr tells which one it was
+	all := &fileSpec{PodName: srcs[0].PodName, PodNamespace: srcs[0].PodNamespace, File: strings.Join(paths, ", "), Workload: srcs[0].Workload}
+	var stdout bytes.Buffer
+	progress := o.startProgress()
+	defer progress.stop()
+	err = o.executeResuming(ctx, pod, containerName, command, all, dir, members, &stdout, progress)
+	progress.stop()
+	if err != nil {
+		return err
+	}
+	if stdout.Len() == 0 {
+		return fmt.Errorf("no data received from pod")
+	}
+	archive, err := o.uncompressedArchive(&stdout)
+	if err != nil {
+		return err
+	}
+
+	o.members = map[string]string{}
+	for _, m := range members {
+		o.members[m] = path.Base(m)
+	}
+	defer func() { o.members = nil }()
+	result, err := o.extractTar(ctx, archive, dest.File, "")
+	if err != nil {
+		return err
+	}
+	result.Duration = progress.elapsed()
+	o.Result = result
+	var alg checksumAlgorithm
+	var digests []fileDigest
+	if o.Checksum {
+		if alg, digests, err = o.verifyChecksums(ctx, pod, containerName, all, dir); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(o.summaryOut(), "%s%s\n", o.Result.summary(all.remote(), dest.File), o.excludedSummary()+o.keptSummary()+o.unchangedSummary()+o.specialSummary()+o.strippedSummary()+o.caseSummary()); err != nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	o.printDigests(alg, digests)
+	return nil
+}
+
+// memberName is the name the entry name of a copy of several sources is
+// extracted as: under the base name of the member it belongs to.
+func (o *CopyOptions) memberName(name string) (string, error) {
+	for member, base := range o.members {
+		if rest, ok := strings.CutPrefix(name, member); ok && (rest == "" || rest[0] == '/') {
+			return base + rest, nil
+		}
+	}
+	return "", fmt.Errorf("unexpected tar entry %s, not under any of the copied paths", name)
+}
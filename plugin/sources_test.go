@@ -0,0 +1,188 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCopySources(t *testing.T) {
+	tests := []struct {
+		name        string
+		srcs        []string
+		wantDir     string
+		wantMembers []string
+		wantErr     string
+	}{
+		{"different directories", []string{"pod:/etc/app/config.yaml", "pod:/var/log/app.log", "pod:/tmp/heap.hprof"}, "/", []string{"etc/app/config.yaml", "var/log/app.log", "tmp/heap.hprof"}, ""},
+		{"one directory", []string{"pod:/var/log/app.log", "pod:/var/log/gc.log"}, "/var/log", []string{"app.log", "gc.log"}, ""},
+		{"common parent", []string{"pod:/var/log/app", "pod:/var/lib/app/state.json"}, "/var", []string{"log/app", "lib/app/state.json"}, ""},
+		{"relative", []string{"pod:logs/app.log", "pod:conf/app.yaml"}, ".", []string{"logs/app.log", "conf/app.yaml"}, ""},
+		{"trailing slash", []string{"pod:/var/log/", "pod:/etc/app.yaml"}, "/", []string{"var/log", "etc/app.yaml"}, ""},
+		{"other pod", []string{"pod:/var/log/app.log", "other:/var/log/gc.log"}, "", nil, "all sources must be of one pod, default/pod and default/other are not"},
+		{"other namespace", []string{"pod:/var/log/app.log", "prod/pod:/var/log/gc.log"}, "", nil, "all sources must be of one pod, default/pod and prod/pod are not"},
+		{"same base name", []string{"pod:/var/log/app.log", "pod:/tmp/app.log"}, "", nil, "sources /var/log/app.log and /tmp/app.log would both be copied to app.log"},
+		{"nested", []string{"pod:/var/log", "pod:/var/log/app/gc.log"}, "", nil, "source /var/log/app/gc.log is inside source /var/log"},
+		{"root", []string{"pod:/", "pod:/var/log/app.log"}, "", nil, "/ can't be copied with other sources"},
+		{"mixed", []string{"pod:/var/log/app.log", "pod:conf/app.yaml"}, "", nil, "sources must be all absolute or all relative paths"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs := make([]*fileSpec, len(tt.srcs))
+			for i, src := range tt.srcs {
+				specs[i], _ = parseFileSpec(src, "default")
+			}
+			dir, members, err := copySources(specs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dir != tt.wantDir || !reflect.DeepEqual(members, tt.wantMembers) {
+				t.Errorf("copySources() = %s %q, want %s %q", dir, members, tt.wantDir, tt.wantMembers)
+			}
+		})
+	}
+}
+
+func TestCopyManySources(t *testing.T) {
+	executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{
+		"etc/app/config.yaml":  "port: 8080\n",
+		"var/log/app/a.log":    "a\n",
+		"var/log/app/gc/0.log": "gc\n",
+	}).Bytes()}
+	o := newFakePodCopyOptions(executor)
+	o.Container = "app"
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	dest := mustTempDir(t)
+
+	if err := o.RunWithSources(context.Background(), []string{"pod:/etc/app/config.yaml", "pod:/var/log/app"}, dest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"env", "LC_ALL=C", "LANG=C", "tar", "cf", "-", "-C", "/", "--", "etc/app/config.yaml", "var/log/app"}
+	if got := executor.commands[len(executor.commands)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+	if len(executor.commands) != 3 {
+		t.Errorf("ran %d commands, want the probe, du and a single tar: %q", len(executor.commands), executor.commands)
+	}
+	assertFileContent(t, filepath.Join(dest, "config.yaml"), "port: 8080\n")
+	assertFileContent(t, filepath.Join(dest, "app", "a.log"), "a\n")
+	assertFileContent(t, filepath.Join(dest, "app", "gc", "0.log"), "gc\n")
+	assertContains(t, out.String(), "Copied 3 files (16 B) from pod:/etc/app/config.yaml, /var/log/app to "+dest)
+}
+
+func TestCopyManySourcesRefused(t *testing.T) {
+	dest := mustTempDir(t)
+	tests := []struct {
+		name    string
+		srcs    []string
+		dest    string
+		setup   func(o *CopyOptions)
+		wantErr string
+	}{
+		{"missing destination", []string{"pod:/a", "pod:/b"}, filepath.Join(dest, "missing"), nil, "with several sources the destination must be an existing directory"},
+		{"file destination", []string{"pod:/a", "pod:/b"}, filepath.Join(dest, "file"), nil, "with several sources the destination must be an existing directory"},
+		{"local source", []string{"pod:/a", "./b"}, dest, nil, "source must be a pod file spec"},
+		{"other pod", []string{"pod:/a", "other:/b"}, dest, nil, "all sources must be of one pod"},
+		{"dry run", []string{"pod:/a", "pod:/b"}, dest, func(o *CopyOptions) { o.DryRun = true }, "several sources can't be used with --selector, --dry-run"},
+	}
+	if err := os.WriteFile(filepath.Join(dest, "file"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executor := &fakeExecutor{}
+			o := newFakePodCopyOptions(executor)
+			if tt.setup != nil {
+				tt.setup(o)
+			}
+			err := o.RunWithSources(context.Background(), tt.srcs, tt.dest)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if len(executor.commands) != 0 {
+				t.Errorf("ran %q before refusing", executor.commands)
+			}
+		})
+	}
+}
+
+func TestMemberName(t *testing.T) {
+	o := newDefaultCopyOptions()
+	o.members = map[string]string{"etc/app/config.yaml": "config.yaml", "var/log/app": "app"}
+	for name, want := range map[string]string{
+		"etc/app/config.yaml":  "config.yaml",
+		"var/log/app":          "app",
+		"var/log/app/gc/0.log": "app/gc/0.log",
+	} {
+		if got, err := o.memberName(name); err != nil || got != want {
+			t.Errorf("memberName(%s) = %s, %v, want %s", name, got, err, want)
+		}
+	}
+	// a prefix of a member name is not in it
+	for _, name := range []string{"var/log/app.old/a.log", "etc/passwd", "var/log"} {
+		if got, err := o.memberName(name); err == nil {
+			t.Errorf("memberName(%s) = %s, want an error", name, got)
+		}
+	}
+}
+
+func TestCopyManySourcesResumes(t *testing.T) {
+	withoutRetryDelay(t)
+	archive := createTestTar(t, map[string]string{"etc/app.yaml": strings.Repeat("c", 3000), "var/log/app.log": strings.Repeat("l", 2000)}).Bytes()
+	stream := &flakyStream{archive: archive, cuts: []int{1000}, err: io.ErrUnexpectedEOF}
+	o := newFakePodCopyOptions(stream)
+	o.IOStreams.ErrOut = io.Discard
+	o.Container, o.Retries = "app", 1
+	dest := mustTempDir(t)
+
+	if err := o.RunWithSources(context.Background(), []string{"pod:/etc/app.yaml", "pod:/var/log/app.log"}, dest); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"env", "LC_ALL=C", "LANG=C", "tar", "cf", "-", "-C", "/", "--", "etc/app.yaml", "var/log/app.log"},
+		{"env", "LC_ALL=C", "LANG=C", "sh", "-c", resumeScript, "sh", "cf", "/", strconv.Itoa(1001), receivedSum(archive, 1001), "--", "etc/app.yaml", "var/log/app.log"},
+	}
+	if !reflect.DeepEqual(stream.commands, want) {
+		t.Errorf("commands = %q, want %q", stream.commands, want)
+	}
+	assertFileContent(t, filepath.Join(dest, "app.yaml"), strings.Repeat("c", 3000))
+	assertFileContent(t, filepath.Join(dest, "app.log"), strings.Repeat("l", 2000))
+}
+
+func TestCopyManySourcesWarnsOverOutputCap(t *testing.T) {
+	captureSessionNotices(t)
+	pod := &cappedPod{
+		constraints: `{"output_cap_bytes": 1048576}`,
+		// under the cap each, over it together
+		duOutput: "700\t/etc/app\n700\t/var/log/app.log\n",
+		tar:      createTestTar(t, map[string]string{"etc/app/a.yaml": contentStr, "var/log/app.log": contentStr}).Bytes(),
+	}
+	o := newFakePodCopyOptions(pod)
+	var stderr bytes.Buffer
+	o.IOStreams.ErrOut = &stderr
+
+	if err := o.RunWithSources(context.Background(), []string{"pod:/etc/app", "pod:/var/log/app.log"}, mustTempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	ranDu := false
+	for _, command := range pod.commands {
+		ranDu = ranDu || strings.Contains(strings.Join(command, " "), "du -s -k -- /etc/app /var/log/app.log")
+	}
+	if !ranDu {
+		t.Errorf("du of both sources not run: %q", pod.commands)
+	}
+	assertContains(t, stderr.String(), "/etc/app, /var/log/app.log is about 1400Ki, over the output cap of 1Mi")
+}
@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// sparseBlock is the size of the runs of zeros holeWriter seeks over.
+const sparseBlock = 4096
+
+var zeroBlock = make([]byte, sparseBlock)
+
+// regularEntry reports whether header is of a regular file: archive/tar reads
+// the old GNU sparse entries tar -S writes as the logical content of one.
+func regularEntry(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeGNUSparse
+}
+
+// sparseEntry reports whether header is of a sparse file, in the old GNU
+// format or in the PAX one, whose holes archive/tar reads as zeros.
+func sparseEntry(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range header.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// holeWriter writes a file seeking over its blocks of zeros instead of
+// writing them, which leaves holes where the filesystem supports them and
+// zeros where it doesn't. finish gives the file its size, which seeking over
+// a trailing hole does not.
+type holeWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *holeWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		block := p[:min(len(p), sparseBlock)]
+		if bytes.Equal(block, zeroBlock[:len(block)]) {
+			if _, err := w.f.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+				return n, err
+			}
+		} else if _, err := w.f.Write(block); err != nil {
+			return n, err
+		}
+		w.off += int64(len(block))
+		n += len(block)
+		p = p[len(block):]
+	}
+	return n, nil
+}
+
+func (w *holeWriter) finish() error {
+	return w.f.Truncate(w.off)
+}
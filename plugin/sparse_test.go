@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sparseFragment is data at offset of a sparse file.
+type sparseFragment struct {
+	offset int64
+	data   string
+}
+
+// gnuSparseTar is an archive of the sparse file name of size realSize, holes
+// but for fragments, in the old GNU format GNU tar -S writes and
+// archive/tar can't.
+func gnuSparseTar(t *testing.T, name string, realSize int64, fragments ...sparseFragment) *bytes.Buffer {
+	t.Helper()
+	if len(fragments) > 4 {
+		t.Fatal("only the 4 fragments of the header are supported")
+	}
+	octal := func(b []byte, n int64) {
+		copy(b, fmt.Sprintf("%0*o\x00", len(b)-1, n))
+	}
+	var data bytes.Buffer
+	block := make([]byte, 512)
+	copy(block[0:100], name)
+	octal(block[100:108], 0o644)
+	octal(block[108:116], 0)
+	octal(block[116:124], 0)
+	octal(block[136:148], 1700000000)
+	block[156] = 'S'
+	copy(block[257:265], "ustar  \x00")
+	for i, f := range fragments {
+		entry := block[386+24*i:]
+		octal(entry[0:12], f.offset)
+		octal(entry[12:24], int64(len(f.data)))
+		data.WriteString(f.data)
+	}
+	octal(block[483:495], realSize)
+	octal(block[124:136], int64(data.Len()))
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, c := range block {
+		sum += int(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	var buf bytes.Buffer
+	buf.Write(block)
+	buf.Write(data.Bytes())
+	buf.Write(make([]byte, (512-data.Len()%512)%512+1024))
+	return &buf
+}
+
+func TestExtractSparseFile(t *testing.T) {
+	const size = 1 << 20
+	tests := []struct {
+		name      string
+		fragments []sparseFragment
+	}{
+		{"holes between data", []sparseFragment{{0, "head"}, {size / 2, "middle"}, {size - 4, "tail"}}},
+		{"trailing hole", []sparseFragment{{0, "head"}}},
+		{"all hole", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errOut bytes.Buffer
+			o := newCopyOptions(&errOut)
+			dest := mustTempDir(t)
+
+			if _, err := o.extractTar(context.Background(), gnuSparseTar(t, "db.img", size, tt.fragments...), dest, "db.img"); err != nil {
+				t.Fatalf(errExtractTar, err)
+			}
+			want := make([]byte, size)
+			for _, f := range tt.fragments {
+				copy(want[f.offset:], f.data)
+			}
+			got, err := os.ReadFile(filepath.Join(dest, "db.img"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("extracted %d bytes, want %d with the data of the fragments", len(got), len(want))
+			}
+			if errOut.Len() != 0 {
+				t.Errorf("unexpected warnings: %q", errOut.String())
+			}
+		})
+	}
+}
+
+func TestHoleWriter(t *testing.T) {
+	f, err := os.Create(filepath.Join(mustTempDir(t), "db.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	w := &holeWriter{f: f}
+	content := "data" + strings.Repeat("\x00", 3*sparseBlock+10) + "more" + strings.Repeat("\x00", 2*sparseBlock)
+	for _, chunk := range []string{content[:5], content[5 : sparseBlock+7], content[sparseBlock+7:]} {
+		if n, err := w.Write([]byte(chunk)); err != nil || n != len(chunk) {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("wrote %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestSparseTarFlags(t *testing.T) {
+	o := &CopyOptions{Sparse: true, FollowSymlinks: true, Compress: true}
+	if got := o.tarCreateFlags(); got != "chSzf" {
+		t.Errorf("tarCreateFlags() = %q, want chSzf", got)
+	}
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The values of --special-files, what a copy does with the devices and FIFOs
+// of the archive.
+const (
+	specialFilesSkip   = "skip"
+	specialFilesIgnore = "ignore"
+	specialFilesCreate = "create"
+)
+
+// canMknod reports whether the process may create devices, swapped in tests.
+var canMknod = func() bool { return os.Geteuid() == 0 }
+
+// specialEntry reports whether header is a character or block device or a
+// FIFO.
+func specialEntry(header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// specialTypeName describes the special file of header in warnings.
+func specialTypeName(header *tar.Header) string {
+	switch header.Typeflag {
+	case tar.TypeChar:
+		return fmt.Sprintf("character device %d,%d", header.Devmajor, header.Devminor)
+	case tar.TypeBlock:
+		return fmt.Sprintf("block device %d,%d", header.Devmajor, header.Devminor)
+	}
+	return "fifo"
+}
+
+// extractSpecial handles header, a special file, as --special-files asks:
+// skipped and counted for a single warning, skipped silently, or created at
+// targetAbs, which computeSafeTarget contained in the destination. It
+// reports whether the file was created.
+func (o *CopyOptions) extractSpecial(header *tar.Header, targetAbs string) (bool, error) {
+	if o.SpecialFiles != specialFilesCreate {
+		if o.SpecialFiles != specialFilesIgnore {
+			o.warnings.special(header)
+		}
+		o.skippedSpecial++
+		if o.manifest != nil {
+			o.manifest.addEntry(header, nil, true)
+		}
+		return false, nil
+	}
+	if err := o.mkdirAll(filepath.Dir(targetAbs), 0755); err != nil {
+		return false, fmt.Errorf("mkdir failed: %v", err)
+	}
+	if info, err := os.Lstat(targetAbs); err == nil {
+		if info.IsDir() {
+			return false, fmt.Errorf("create %s failed: %s is a directory", specialTypeName(header), targetAbs)
+		}
+		if err := os.Remove(targetAbs); err != nil {
+			return false, fmt.Errorf("create %s failed: %v", specialTypeName(header), err)
+		}
+	}
+	mode := os.FileMode(header.Mode & 0o777)
+	if err := makeSpecial(targetAbs, header, mode); err != nil {
+		return false, fmt.Errorf("create %s failed: %v", specialTypeName(header), err)
+	}
+	// mknod and mkfifo apply the umask
+	if err := os.Chmod(targetAbs, mode); err != nil {
+		return false, fmt.Errorf("chmod failed: %v", err)
+	}
+	o.own(targetAbs)
+	if !o.NoPreserveTimes {
+		o.preserveTime(targetAbs, header)
+	}
+	if o.manifest != nil {
+		o.manifest.addEntry(header, nil, false)
+	}
+	return true, nil
+}
+
+// specialSummary is the part of the summary of a copy about the special
+// files it skipped or created.
+func (o *CopyOptions) specialSummary() string {
+	switch {
+	case o.Result.Special > 0:
+		return fmt.Sprintf(", %d special files created", o.Result.Special)
+	case o.skippedSpecial > 0:
+		return fmt.Sprintf(", %d special files skipped", o.skippedSpecial)
+	}
+	return ""
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package plugin
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+)
+
+// makeSpecial fails, devices and FIFOs having no equivalent here.
+func makeSpecial(string, *tar.Header, os.FileMode) error {
+	return errors.New("special files are not supported on this platform")
+}
@@ -0,0 +1,195 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+func withMknodPrivilege(t *testing.T, privileged bool) {
+	t.Helper()
+	old := canMknod
+	t.Cleanup(func() { canMknod = old })
+	canMknod = func() bool { return privileged }
+}
+
+// devTar looks like /dev of a container: a directory of devices, a FIFO and
+// a regular file.
+func devTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	headers := []*tar.Header{
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "dev/initctl", Typeflag: tar.TypeFifo, Mode: 0o600},
+		{Name: "dev/termination-log", Typeflag: tar.TypeReg, Mode: 0o644},
+	}
+	for i := 0; i < 20; i++ {
+		headers = append(headers, &tar.Header{Name: fmt.Sprintf("dev/tty%d", i), Typeflag: tar.TypeChar, Mode: 0o620, Devmajor: 4, Devminor: int64(i)})
+	}
+	headers = append(headers, &tar.Header{Name: "dev/loop0", Typeflag: tar.TypeBlock, Mode: 0o660, Devmajor: 7})
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return buf.Bytes()
+}
+
+func TestCopySpecialFiles(t *testing.T) {
+	tests := []struct {
+		specialFiles string
+		wantErrOut   []string
+		wantSummary  string
+	}{
+		{
+			specialFiles: specialFilesSkip,
+			wantErrOut: []string{
+				"Warning: skipped 22 special files (devices and FIFOs); use --special-files=create to create them, or --special-files=ignore to skip them silently\n",
+				"Warnings: 22 skipped special files\n",
+			},
+			wantSummary: ", 22 special files skipped\n",
+		},
+		{specialFiles: specialFilesIgnore, wantSummary: ", 22 special files skipped\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.specialFiles, func(t *testing.T) {
+			o := newFakePodCopyOptions(&fakeExecutor{stdout: devTar(t)})
+			o.Container = "app"
+			o.SpecialFiles = tt.specialFiles
+			var out, errOut bytes.Buffer
+			o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+			dest := mustTempDir(t)
+
+			if err := o.RunWithArgs(context.Background(), "pod:/dev", dest); err != nil {
+				t.Fatalf("RunWithArgs() error = %v", err)
+			}
+			if got := errOut.String(); got != strings.Join(tt.wantErrOut, "") {
+				t.Errorf("stderr = %q, want %q", got, strings.Join(tt.wantErrOut, ""))
+			}
+			if !strings.HasSuffix(out.String(), tt.wantSummary) {
+				t.Errorf("summary = %q, want ending in %q", out.String(), tt.wantSummary)
+			}
+			if o.Result.Skipped != 22 || o.Result.Files != 1 {
+				t.Errorf("Result = %+v, want 22 skipped and 1 file", o.Result)
+			}
+			entries, err := os.ReadDir(filepath.Join(dest, "dev"))
+			if err != nil || len(entries) != 1 {
+				t.Errorf("dev has %v, %v, want the termination-log only", entries, err)
+			}
+		})
+	}
+}
+
+func TestCopySpecialFilesShowAll(t *testing.T) {
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: devTar(t)})
+	o.Container = "app"
+	o.ShowAllWarnings = true
+	var errOut bytes.Buffer
+	o.IOStreams.ErrOut = &errOut
+
+	if err := o.RunWithArgs(context.Background(), "pod:/dev", mustTempDir(t)); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	for _, want := range []string{
+		"Warning: skipping fifo dev/initctl; use --special-files=create to create it\n",
+		"Warning: skipping character device 4,19 dev/tty19; use --special-files=create to create it\n",
+		"Warning: skipping block device 7,0 dev/loop0; use --special-files=create to create it\n",
+	} {
+		assertContains(t, errOut.String(), want)
+	}
+	if strings.Contains(errOut.String(), "skipped 22 special files") {
+		t.Errorf("stderr summarizes the special files listed:\n%s", errOut.String())
+	}
+}
+
+func TestCopySpecialFilesCreate(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating devices needs root")
+	}
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: devTar(t)})
+	o.Container = "app"
+	o.SpecialFiles = specialFilesCreate
+	var out, errOut bytes.Buffer
+	o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "pod:/dev", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	if errOut.Len() != 0 || !strings.HasSuffix(out.String(), ", 22 special files created\n") {
+		t.Errorf("stdout %q, stderr %q", out.String(), errOut.String())
+	}
+	for name, want := range map[string]os.FileMode{
+		"initctl": os.ModeNamedPipe | 0o600,
+		"tty3":    os.ModeDevice | os.ModeCharDevice | 0o620,
+		"loop0":   os.ModeDevice | 0o660,
+	} {
+		info, err := os.Lstat(filepath.Join(dest, "dev", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+}
+
+func TestCopySpecialFilesCreateContained(t *testing.T) {
+	withMknodPrivilege(t, true)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeFifo, Mode: 0o600}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	o := newRunOptions()
+	o.SpecialFiles = specialFilesCreate
+	parent := mustTempDir(t)
+	dest := filepath.Join(parent, "dest")
+
+	if _, err := o.extractTar(context.Background(), &buf, dest, "dest"); err == nil {
+		t.Fatal("extractTar() created a fifo outside the destination")
+	}
+	if _, err := os.Lstat(filepath.Join(parent, "escape")); err == nil {
+		t.Error("the fifo escaped the destination")
+	}
+}
+
+func TestValidateSpecialFiles(t *testing.T) {
+	tests := []struct {
+		specialFiles string
+		privileged   bool
+		wantErr      string
+	}{
+		{specialFiles: specialFilesSkip},
+		{specialFiles: specialFilesIgnore},
+		{specialFiles: specialFilesCreate, privileged: true},
+		{specialFiles: specialFilesCreate, wantErr: "--special-files=create needs to run as root"},
+		{specialFiles: "mknod", wantErr: `unsupported --special-files "mknod", use skip, ignore or create`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.specialFiles, func(t *testing.T) {
+			withMknodPrivilege(t, tt.privileged)
+			o := newRunOptions()
+			o.ClientConfig = &restclient.Config{}
+			o.SpecialFiles = tt.specialFiles
+			err := o.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package plugin
+
+import (
+	"archive/tar"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeSpecial creates the device or FIFO of header at path with mode.
+func makeSpecial(path string, header *tar.Header, mode os.FileMode) error {
+	if header.Typeflag == tar.TypeFifo {
+		return unix.Mkfifo(path, uint32(mode))
+	}
+	kind := uint32(unix.S_IFCHR)
+	if header.Typeflag == tar.TypeBlock {
+		kind = unix.S_IFBLK
+	}
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	return unix.Mknod(path, kind|uint32(mode), int(dev))
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// stderrHead and stderrTail are how much of the stderr of a tar stderrCapture
+// keeps: the start, where a missing binary or path is reported, and the end,
+// where tar reports what made it fail.
+const (
+	stderrHead = 32 << 10
+	stderrTail = 8 << 10
+)
+
+// stderrCapture collects the stderr of a remote tar, which for a tree of
+// unreadable files can run to megabytes of Permission denied lines, keeping
+// only its first stderrHead and last stderrTail bytes.
+type stderrCapture struct {
+	head []byte
+	// tail holds the bytes after head, of which the last stderrTail are
+	// kept; it is trimmed once it holds twice as many.
+	tail []byte
+	// total counts every byte written.
+	total int64
+}
+
+func (c *stderrCapture) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	rest := p
+	if n := min(stderrHead-len(c.head), len(rest)); n > 0 {
+		c.head = append(c.head, rest[:n]...)
+		rest = rest[n:]
+	}
+	c.tail = append(c.tail, rest...)
+	if len(c.tail) > 2*stderrTail {
+		c.tail = append([]byte(nil), c.tail[len(c.tail)-stderrTail:]...)
+	}
+	return len(p), nil
+}
+
+// drain returns the writer a remote command streams its stderr to, consumed
+// into c by a goroutine of its own, so a tar warning about every file it reads
+// is taken off the stream as fast as it comes, whatever holds up its stdout.
+// wait closes the writer once the command returned and waits for the rest to
+// reach c, which must not be read before. What the command still writes after
+// that, when its stream was not torn down in time, is dropped.
+func (c *stderrCapture) drain() (w io.Writer, wait func()) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		//nolint:errcheck
+		_, _ = io.Copy(c, pr)
+	}()
+	return pw, func() {
+		//nolint:errcheck
+		_ = pw.Close()
+		<-done
+	}
+}
+
+// Reset forgets everything written.
+func (c *stderrCapture) Reset() {
+	*c = stderrCapture{}
+}
+
+// String returns what was written, or when that was more than the head and
+// tail kept, both with a line noting how much was left out between them. The
+// tail then starts with the first complete line kept.
+func (c *stderrCapture) String() string {
+	if c.total <= stderrHead+stderrTail {
+		return string(c.head) + string(c.tail)
+	}
+	tail := c.tail[len(c.tail)-stderrTail:]
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	truncated := c.total - int64(len(c.head)) - int64(len(tail))
+	sep := "\n"
+	if bytes.HasSuffix(c.head, []byte("\n")) {
+		sep = ""
+	}
+	return fmt.Sprintf("%s%s... %d bytes of stderr truncated ...\n%s", c.head, sep, truncated, tail)
+}
@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestStderrCaptureShort(t *testing.T) {
+	var c stderrCapture
+	want := "tar: secret: Cannot open: Permission denied\n"
+	for _, part := range []string{want[:10], want[10:]} {
+		if _, err := c.Write([]byte(part)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if got := c.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	c.Reset()
+	if got := c.String(); got != "" {
+		t.Errorf("String() after Reset = %q", got)
+	}
+}
+
+// noisyStderr is the stderr of a tar that read a tree of unreadable files
+// before failing on path.
+func noisyStderr(path string) string {
+	noise := strings.Repeat("tar: ./cache/0123456789abcdef: Cannot open: Permission denied\n", 20000)
+	return noise + "tar: " + path + ": Cannot stat: No such file or directory\ntar: Exiting with failure status due to previous errors\n"
+}
+
+func TestStderrCaptureTruncates(t *testing.T) {
+	var c stderrCapture
+	stderr := noisyStderr("data/missing")
+	for i := 0; i < len(stderr); i += 4096 {
+		//nolint:errcheck
+		_, _ = c.Write([]byte(stderr[i:min(i+4096, len(stderr))]))
+	}
+
+	got := c.String()
+	if len(got) > stderrHead+stderrTail+100 {
+		t.Fatalf("String() kept %d of %d bytes", len(got), len(stderr))
+	}
+	if !strings.HasPrefix(got, stderr[:stderrHead]) {
+		t.Errorf("String() does not start with the head of stderr")
+	}
+	assertContains(t, got, "bytes of stderr truncated ...\ntar: ./cache/")
+	if !strings.HasSuffix(got, "tar: data/missing: Cannot stat: No such file or directory\ntar: Exiting with failure status due to previous errors\n") {
+		t.Errorf("String() does not end with the tail of stderr: %q", got[len(got)-200:])
+	}
+	if kind := classifyRemoteStderr(got); kind != remoteErrNotFound {
+		t.Errorf("classifyRemoteStderr() = %v, want remoteErrNotFound", kind)
+	}
+}
+
+func TestCopyClassifiesFailureInStderrTail(t *testing.T) {
+	executor := &fakeExecutor{stderr: noisyStderr("data/missing"), err: errors.New("command terminated with exit code 2")}
+	o := newFakePodCopyOptions(executor)
+
+	err := o.RunWithArgs(context.Background(), "pod:/data", mustTempDir(t))
+	if err == nil {
+		t.Fatal("RunWithArgs() succeeded")
+	}
+	assertContains(t, err.Error(), "pod default/pod: file not found: ")
+	if len(err.Error()) > stderrHead+stderrTail {
+		t.Errorf("error of %d bytes", len(err.Error()))
+	}
+}
+
+// interleavedContainer answers the tar of a copy like a stream multiplexed on
+// one connection: a frame of stdout is only delivered once the frame of stderr
+// before it was taken, so a stderr nobody reads stalls the stdout too.
+type interleavedContainer struct {
+	archive []byte
+	// stderrFrame is written before every 512 bytes of archive.
+	stderrFrame string
+}
+
+func (c *interleavedContainer) Execute(_ context.Context, _ *corev1.Pod, _ string, command []string, stdout, stderr io.Writer) error {
+	if command[len(command)-1] == "true" {
+		return nil
+	}
+	if isDiskUsage(command) {
+		return errNoDu
+	}
+	frames := make(chan []byte)
+	done := make(chan error, 1)
+	go func() {
+		for frame := range frames {
+			if _, err := stdout.Write(frame); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < len(c.archive); i += 512 {
+		if _, err := io.WriteString(stderr, c.stderrFrame); err != nil {
+			close(frames)
+			return err
+		}
+		frames <- c.archive[i:min(i+512, len(c.archive))]
+	}
+	close(frames)
+	return <-done
+}
+
+func TestCopyWithStderrFloodCompletes(t *testing.T) {
+	content := strings.Repeat("log line\n", 4096)
+	archive := createTestTar(t, map[string]string{"app.log": content}).Bytes()
+	frame := strings.Repeat("tar: Removing leading `/' from member names\n", 1000)
+	o := newFakePodCopyOptions(&interleavedContainer{archive: archive, stderrFrame: frame})
+	o.Container = "app"
+	dest := mustTempDir(t)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- o.RunWithArgs(context.Background(), "pod:/var/log/app.log", dest)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RunWithArgs() error = %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("copy with %d bytes of stderr did not complete", len(archive)/512*len(frame))
+	}
+	assertFileContent(t, filepath.Join(dest, "app.log"), content)
+}
@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// stdoutDest is the destination of a copy writing its tar archive to stdout
+// instead of extracting it.
+const stdoutDest = "-"
+
+// validateStdoutCopy checks that a copy to stdout uses none of the options
+// that only apply to files extracted locally, and that stdout is not a
+// terminal the archive would be dumped on.
+func (o *CopyOptions) validateStdoutCopy() error {
+	if limit, _ := parseMaxSize(o.MaxSize); limit > 0 || o.Selector != "" || o.DryRun || o.EntriesFrom != "" || o.Chunked ||
+		o.SourcesManifest != "" || o.Open || o.OpenWith != "" || o.OutputOwner != "" || o.Preserve || o.Checksum || o.StripComponents != 0 || o.KeepPartial || o.Output != "" {
+		return fmt.Errorf("a destination of - writes the archive to stdout, it can't be used with --selector, --dry-run, --entries-from, --chunked, --sources-manifest, --open, --open-with, --output-owner, --preserve, --checksum, --max-size, --strip-components, --keep-partial or -o")
+	}
+	if _, tty := terminalFd(o.IOStreams.Out); tty {
+		return fmt.Errorf("refusing to write a tar archive to a terminal, redirect stdout or pipe it into a program such as tar tvf -")
+	}
+	return nil
+}
+
+// copyToStdout writes the tar archive of the remote path src to stdout as it
+// is, uncompressed, once received in full, so a copy that fails writes
+// nothing. The summary goes to stderr, keeping stdout the archive only.
+func (o *CopyOptions) copyToStdout(ctx context.Context, src *fileSpec) error {
+	if err := o.validateStdoutCopy(); err != nil {
+		return err
+	}
+	if src.PodName == "" || src.File == "" {
+		return fmt.Errorf("with a destination of - the source must be a pod file spec (pod:path)")
+	}
+	pod, containerName, err := o.validateAndGetPodContainer(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	o.contents = strings.HasSuffix(src.File, "/")
+	srcDir, srcBase := o.archivedPath(src)
+	command, err := o.remoteCommand(ctx, pod, containerName, o.tarCreateCommand(srcDir, []string{srcBase}))
+	if err != nil {
+		return err
+	}
+	if err := o.preflight(ctx, pod, containerName, "", src.File); err != nil {
+		return err
+	}
+
+	var stdout bytes.Buffer
+	progress := o.startProgress()
+	defer progress.stop()
+	err = o.executeResuming(ctx, pod, containerName, command, src, srcDir, []string{srcBase}, &stdout, progress)
+	progress.stop()
+	if err != nil {
+		return err
+	}
+	if stdout.Len() == 0 {
+		return fmt.Errorf("no data received from pod")
+	}
+	archive, err := o.uncompressedArchive(&stdout)
+	if err != nil {
+		return err
+	}
+
+	if _, err := archive.WriteTo(o.IOStreams.Out); err != nil {
+		return fmt.Errorf("failed to write the archive to stdout: %v", err)
+	}
+	//nolint:errcheck
+	_, _ = fmt.Fprintf(o.IOStreams.ErrOut, "Copied %s to stdout (%s)\n", src.remote(), progress.summary())
+	return nil
+}
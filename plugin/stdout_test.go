@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCopyToStdout(t *testing.T) {
+	archive := createTestTar(t, map[string]string{"app/current.log": "app\n"}).Bytes()
+	for _, compress := range []bool{false, true} {
+		received := archive
+		if compress {
+			received = gzipped(t, archive)
+		}
+		executor := &fakeExecutor{stdout: received}
+		o := newFakePodCopyOptions(executor)
+		o.Container = "app"
+		o.Compress = compress
+		var out, errOut bytes.Buffer
+		o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+		dir := mustTempDir(t)
+		t.Chdir(dir)
+
+		if err := o.RunWithSources(context.Background(), []string{"pod:/var/log/app"}, "-"); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), archive) {
+			t.Errorf("compress %v: stdout is not the archive of the pod", compress)
+		}
+		if !strings.HasPrefix(errOut.String(), "Copied pod:/var/log/app to stdout (") {
+			t.Errorf("stderr = %q, want the summary", errOut.String())
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("nothing may be written locally, found %v", entries)
+		}
+		if got := executor.commands[len(executor.commands)-1]; !reflect.DeepEqual(got[3:], []string{"tar", o.tarCreateFlags(), "-", "-C", "/var/log", "--", "app"}) {
+			t.Errorf("command = %q", got)
+		}
+	}
+}
+
+func TestCopyToStdoutRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		srcs    []string
+		tty     bool
+		modify  func(o *CopyOptions)
+		wantErr string
+	}{
+		{"terminal", []string{"pod:/var/log"}, true, func(*CopyOptions) {}, "refusing to write a tar archive to a terminal"},
+		{"checksum", []string{"pod:/var/log"}, false, func(o *CopyOptions) { o.Checksum = true }, "it can't be used with --selector"},
+		{"max size", []string{"pod:/var/log"}, false, func(o *CopyOptions) { o.MaxSize = "1Gi" }, "it can't be used with --selector"},
+		{"several sources", []string{"pod:/var/log", "pod:/etc/app"}, false, func(*CopyOptions) {}, "archive of a single source"},
+		{"local source", []string{"./app"}, false, func(*CopyOptions) {}, "the source must be a pod file spec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldFd := terminalFd
+			t.Cleanup(func() { terminalFd = oldFd })
+			terminalFd = func(io.Writer) (int, bool) { return -1, tt.tty }
+			executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{"log/app.log": "app\n"}).Bytes()}
+			o := newFakePodCopyOptions(executor)
+			o.IOStreams.Out = io.Discard
+			tt.modify(o)
+
+			err := o.RunWithSources(context.Background(), tt.srcs, "-")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("RunWithSources() = %v, want %q", err, tt.wantErr)
+			}
+			if len(executor.commands) != 0 {
+				t.Fatalf("nothing may run in the pod, ran %q", executor.commands)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// stripComponents removes the first StripComponents elements of name, a
+// cleaned entry name, as tar --strip-components does. It returns false for a
+// name with no more elements than that, an entry the copy skips.
+func (o *CopyOptions) stripComponents(name string) (string, bool) {
+	if o.StripComponents == 0 {
+		return name, true
+	}
+	parts := strings.SplitN(name, "/", o.StripComponents+1)
+	if len(parts) <= o.StripComponents {
+		return "", false
+	}
+	return parts[o.StripComponents], true
+}
+
+// stripDestination creates destPath for a copy with StripComponents, whose
+// entries are extracted into it whatever the name of the copied path.
+func (o *CopyOptions) stripDestination(destPath string) error {
+	info, err := os.Stat(destPath)
+	switch {
+	case err == nil && !info.IsDir():
+		return fmt.Errorf("--strip-components extracts into a directory, %s is not one", destPath)
+	case err == nil:
+		return nil
+	}
+	if err := o.mkdirAll(destPath, 0755); err != nil {
+		return fmt.Errorf("mkdir failed: %v", err)
+	}
+	return nil
+}
+
+// strippedSummary is the part of the summary of a copy about the entries
+// StripComponents left no name.
+func (o *CopyOptions) strippedSummary() string {
+	if o.strippedEntries == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %d entries with %d or fewer path components skipped", o.strippedEntries, o.StripComponents)
+}
@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+// configTar is the archive of a copy of /opt/app/current/config: a nested
+// directory with a hard link.
+func configTar(t *testing.T, extra ...*tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range append([]*tar.Header{
+		{Name: "config/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "config/app.yaml", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(contentStr))},
+		{Name: "config/conf.d/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "config/conf.d/db.yaml", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(contentStr))},
+		{Name: "config/app.yaml.orig", Typeflag: tar.TypeLink, Linkname: "config/app.yaml"},
+	}, extra...) {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if h.Size > 0 {
+			if _, err := tw.Write([]byte(contentStr)); err != nil {
+				t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return &buf
+}
+
+func TestExtractStripComponents(t *testing.T) {
+	for _, existing := range []bool{true, false} {
+		dest := mustTempDir(t)
+		if !existing {
+			dest = filepath.Join(dest, "config-copy")
+		}
+		o := newRunOptions()
+		o.StripComponents = 1
+
+		result, err := o.extractTar(context.Background(), configTar(t), dest, "config")
+		if err != nil {
+			t.Fatalf(errExtractTar, err)
+		}
+		assertFileContent(t, filepath.Join(dest, "app.yaml"), contentStr)
+		assertFileContent(t, filepath.Join(dest, "app.yaml.orig"), contentStr)
+		assertFileContent(t, filepath.Join(dest, "conf.d", "db.yaml"), contentStr)
+		if _, err := os.Stat(filepath.Join(dest, "config")); err == nil {
+			t.Errorf("config/ was extracted into %s", dest)
+		}
+		// config/ itself has no name left
+		if result.Files != 3 || result.Dirs != 1 || result.Skipped != 1 || o.strippedEntries != 1 {
+			t.Errorf("result = %+v, %d stripped, want 3 files, 1 dir, 1 skipped", result, o.strippedEntries)
+		}
+	}
+}
+
+func TestExtractStripComponentsConsumed(t *testing.T) {
+	o := newRunOptions()
+	o.StripComponents = 1
+	dest := mustTempDir(t)
+
+	result, err := o.extractTar(context.Background(), createTestTar(t, map[string]string{"app.log": contentStr}), dest, "app.log")
+	if err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+		t.Errorf("extracted %v, want nothing", entries)
+	}
+	if result.Files != 0 || result.Skipped != 1 || o.strippedSummary() != ", 1 entries with 1 or fewer path components skipped" {
+		t.Errorf("result = %+v, summary %q", result, o.strippedSummary())
+	}
+}
+
+func TestExtractStripComponentsContained(t *testing.T) {
+	tests := []struct {
+		name   string
+		header *tar.Header
+	}{
+		{"traversal", &tar.Header{Name: "config/../../escape", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{"stripped traversal", &tar.Header{Name: "config/x/../../../escape", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{"hard link out", &tar.Header{Name: "config/passwd", Typeflag: tar.TypeLink, Linkname: "config/../../etc/passwd"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.StripComponents = 1
+			parent := mustTempDir(t)
+
+			_, err := o.extractTar(context.Background(), configTar(t, tt.header), filepath.Join(parent, "dest"), "config")
+			if err == nil || !strings.Contains(err.Error(), "path traversal") {
+				t.Fatalf("extractTar() error = %v, want a path traversal", err)
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escape")); err == nil {
+				t.Error("the entry escaped the destination")
+			}
+		})
+	}
+}
+
+func TestCopyStripComponents(t *testing.T) {
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: configTar(t).Bytes()})
+	o.Container = "app"
+	o.StripComponents = 1
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	dest := filepath.Join(mustTempDir(t), "config")
+
+	if err := o.RunWithArgs(context.Background(), "pod:/opt/app/current/config", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	assertFileContent(t, filepath.Join(dest, "conf.d", "db.yaml"), contentStr)
+	assertContains(t, out.String(), "to "+dest+" in ")
+	assertContains(t, out.String(), ", 1 entries with 1 or fewer path components skipped\n")
+}
+
+func TestValidateStripComponents(t *testing.T) {
+	o := newRunOptions()
+	o.ClientConfig = &restclient.Config{}
+	o.StripComponents = -1
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "invalid --strip-components -1") {
+		t.Fatalf("Validate() = %v, want the negative count refused", err)
+	}
+	o.StripComponents, o.Chunked = 1, true
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "--strip-components can't be used with --chunked") {
+		t.Fatalf("Validate() = %v, want --chunked refused", err)
+	}
+}
@@ -0,0 +1,53 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractSymlink creates targetAbs, the symlink of header, with AllowSymlinks,
+// when what it points to stays within baseAbs, and reports whether it did. A
+// link with an absolute target or one escaping baseAbs is left to
+// processTarEntry, which skips it with a warning.
+//
+// The target is resolved from the directory the link is created in, its
+// symlinks resolved, and is cleaned first so that it climbs with leading ..
+// only: a link can't leave the destination through a symlink that points back
+// into it, such as the dir/.. of a dir -> . link.
+func (o *CopyOptions) extractSymlink(header *tar.Header, targetAbs, baseAbs string) (bool, error) {
+	linkname := filepath.FromSlash(header.Linkname)
+	if header.Linkname == "" || filepath.IsAbs(linkname) || strings.HasPrefix(header.Linkname, "/") || filepath.VolumeName(linkname) != "" {
+		return false, nil
+	}
+	linkname = filepath.Clean(linkname)
+	if err := o.mkdirAll(filepath.Dir(targetAbs), 0755); err != nil {
+		return false, fmt.Errorf("mkdir failed: %v", err)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(targetAbs))
+	if err != nil {
+		return false, fmt.Errorf("create symlink failed: %v", err)
+	}
+	base, err := filepath.EvalSymlinks(baseAbs)
+	if err != nil {
+		return false, fmt.Errorf("create symlink failed: %v", err)
+	}
+	if !withinBase(base, filepath.Join(dir, linkname)) {
+		return false, nil
+	}
+
+	if info, err := os.Lstat(targetAbs); err == nil && !info.IsDir() {
+		if err := os.Remove(targetAbs); err != nil {
+			return false, fmt.Errorf("create symlink failed: %v", err)
+		}
+	}
+	if err := os.Symlink(linkname, targetAbs); err != nil {
+		return false, fmt.Errorf("create symlink failed: %v", err)
+	}
+	if o.manifest != nil {
+		o.manifest.addEntry(header, nil, false)
+	}
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// symlinkTar is app/releases/123/app.bin with the symlinks after it.
+func symlinkTar(t *testing.T, links ...tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	headers := append([]tar.Header{
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "app/releases/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "app/releases/123/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "app/releases/123/app.bin", Typeflag: tar.TypeReg, Mode: 0o755, Size: int64(len(contentStr))},
+	}, links...)
+	for i := range headers {
+		if err := tw.WriteHeader(&headers[i]); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, headers[i].Name, err)
+		}
+		if headers[i].Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(contentStr)); err != nil {
+				t.Fatalf(errWriteTarContentForFmt, headers[i].Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return &buf
+}
+
+func TestExtractSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		links   []tar.Header
+		created map[string]string
+		skipped []string
+	}{
+		{
+			name:    "relative link within the destination",
+			links:   []tar.Header{{Name: "app/current", Typeflag: tar.TypeSymlink, Linkname: "releases/123"}},
+			created: map[string]string{"app/current": "releases/123"},
+		},
+		{
+			name:    "absolute link",
+			links:   []tar.Header{{Name: "app/passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+			skipped: []string{"app/passwd"},
+		},
+		{
+			name:    "link escaping the destination",
+			links:   []tar.Header{{Name: "app/releases/escape", Typeflag: tar.TypeSymlink, Linkname: "../../../etc"}},
+			skipped: []string{"app/releases/escape"},
+		},
+		{
+			name: "link escaping through another link",
+			links: []tar.Header{
+				{Name: "app/self", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "app/self/up", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+			},
+			created: map[string]string{"app/self": "."},
+			skipped: []string{"app/up"},
+		},
+		{
+			name:    "link cleaned before it is resolved",
+			links:   []tar.Header{{Name: "app/current", Typeflag: tar.TypeSymlink, Linkname: "releases/../releases/123/"}},
+			created: map[string]string{"app/current": "releases/123"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var errOut bytes.Buffer
+			o := newCopyOptions(&errOut)
+			o.AllowSymlinks = true
+			dest := mustTempDir(t)
+
+			result, err := o.extractTar(context.Background(), symlinkTar(t, tt.links...), dest, "")
+			if err != nil {
+				t.Fatalf("extractTar() error = %v", err)
+			}
+			for name, want := range tt.created {
+				if got, err := os.Readlink(filepath.Join(dest, name)); err != nil || got != want {
+					t.Errorf("%s -> %q, %v, want -> %q", name, got, err, want)
+				}
+			}
+			for _, name := range tt.skipped {
+				assertFileDoesNotExist(t, filepath.Join(dest, name))
+				assertContains(t, errOut.String(), "Warning: skipping symlink ")
+			}
+			if result.Symlinks != len(tt.created) || result.Skipped != len(tt.skipped) {
+				t.Errorf("result = %+v, want %d symlinks and %d skipped", result, len(tt.created), len(tt.skipped))
+			}
+		})
+	}
+}
+
+func TestExtractSymlinkFollowed(t *testing.T) {
+	o := newDefaultCopyOptions()
+	o.AllowSymlinks = true
+	dest := mustTempDir(t)
+
+	tarball := symlinkTar(t, tar.Header{Name: "app/current", Typeflag: tar.TypeSymlink, Linkname: "releases/123"})
+	if _, err := o.extractTar(context.Background(), tarball, dest, ""); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, filepath.Join(dest, "app", "current", "app.bin"), contentStr)
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// withTimeout bounds ctx by --timeout, and returns it with its cancel
+// function, which does nothing without one.
+func (o *CopyOptions) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.Timeout)
+}
+
+// timedOut returns copyErr, the error of a copy run with ctx, reported as the
+// copy timing out when --timeout expired, with the bytes received by then.
+// The archive of a copy is received in full before it is extracted, so the
+// transfer cut off wrote nothing locally.
+func (o *CopyOptions) timedOut(ctx context.Context, copyErr error) error {
+	if copyErr == nil || o.Timeout <= 0 || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return copyErr
+	}
+	msg := fmt.Sprintf("copy timed out after %s", o.Timeout)
+	switch {
+	case o.Chunked:
+		msg += ", the verified ranges are kept: run it again to resume"
+	case o.progress != nil:
+		msg += fmt.Sprintf(" with %s received", formatBytes(o.progress.n.Load()))
+	}
+	var cancelled copyCancelledError
+	if errors.As(copyErr, &cancelled) && !cancelled.terminated {
+		msg += fmt.Sprintf("; remote termination could not be confirmed within %s, the remote command may still be reading the filesystem", cancelTeardownTimeout)
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+func TestCopyTimeout(t *testing.T) {
+	old := cancelTeardownTimeout
+	t.Cleanup(func() { cancelTeardownTimeout = old })
+	cancelTeardownTimeout = 5 * time.Second
+
+	executor := newTeardownExecutor(0)
+	o := newFakePodCopyOptions(executor)
+	o.Timeout = 50 * time.Millisecond
+	dest := filepath.Join(mustTempDir(t), "out")
+
+	err := o.RunWithSources(context.Background(), []string{"pod:/var/log"}, dest)
+	if err == nil || err.Error() != "copy timed out after 50ms with 18 B received" {
+		t.Fatalf("err = %v, want the timeout with the bytes received", err)
+	}
+	assertFileDoesNotExist(t, dest)
+}
+
+func TestCopyTimeoutNotExpired(t *testing.T) {
+	o := &CopyOptions{Timeout: time.Minute}
+	copyErr := errors.New("pod default/pod: file not found: /var/log")
+	if err := o.timedOut(context.Background(), copyErr); err != copyErr {
+		t.Fatalf("timedOut() = %v, want the error of the copy", err)
+	}
+}
+
+func TestCopyValidateTimeout(t *testing.T) {
+	o := newRunOptions()
+	o.ClientConfig = &restclient.Config{}
+	o.Timeout = -time.Second
+	if err := o.Validate(); err == nil || !strings.Contains(err.Error(), "invalid --timeout -1s") {
+		t.Fatalf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// tarBlockSize is the size of the blocks of a tar archive, which ends with
+// two blocks of zeros.
+const tarBlockSize = 512
+
+// truncatedError is the failure of a copy whose archive ended early, cut
+// while or between entries, where a stream that was closed early without an
+// error would otherwise pass for a complete copy.
+type truncatedError struct {
+	msg string
+}
+
+func (e truncatedError) Error() string {
+	return "transfer truncated: " + e.msg
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// archiveEnded reports whether the archive read through counter, at its end,
+// ended with the two blocks of zeros tar writes after the last entry. entryEnd
+// is where counter was once the entries before were read in full, so what
+// was read since is the padding of the last entry, under a block, and the
+// blocks ending the archive.
+func archiveEnded(counter *countingReader, entryEnd int64) bool {
+	return counter.n-entryEnd >= 2*tarBlockSize
+}
+
+// drainEntry reads what is left of the current entry of tr, such as the data
+// of an entry that was skipped, so a truncated one is noticed and the next
+// starts at a known offset.
+func drainEntry(tr *tar.Reader, header *tar.Header) error {
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return truncatedError{fmt.Sprintf("the archive ends within %s", header.Name)}
+		}
+		return fmt.Errorf("tar read error: %v", err)
+	}
+	return nil
+}
+
+// removeTruncated removes targetAbs, the file of header cut short after n
+// bytes, and explains it.
+func removeTruncated(targetAbs string, header *tar.Header, n int64) error {
+	msg := fmt.Sprintf("%s is %d bytes, only %d were received", header.Name, header.Size, n)
+	if err := os.Remove(targetAbs); err != nil {
+		msg += fmt.Sprintf(", and removing the partial file failed: %v", err)
+	} else {
+		msg += ", the partial file was removed"
+	}
+	return truncatedError{msg}
+}
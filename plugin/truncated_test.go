@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dumpTar is a directory with a small file followed by a 2 KiB one.
+func dumpTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		size int
+	}{{"dump/small", 10}, {"dump/big", 2048}} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(f.size)}); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, f.name, err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte("x"), f.size)); err != nil {
+			t.Fatalf(errWriteTarContentForFmt, f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTruncated(t *testing.T) {
+	archive := dumpTar(t)
+	// small: header and a padded block; big: header and 4 blocks; the end
+	const bigStart = 2 * tarBlockSize
+	tests := []struct {
+		name      string
+		data      []byte
+		exclude   []string
+		wantErr   string
+		wantFiles []string
+	}{
+		{
+			name:      "within a file",
+			data:      archive[:bigStart+tarBlockSize+1000],
+			wantErr:   "transfer truncated: dump/big is 2048 bytes, only 1000 were received, the partial file was removed",
+			wantFiles: []string{"small"},
+		},
+		{
+			name:      "within a skipped file",
+			data:      archive[:bigStart+tarBlockSize+1000],
+			exclude:   []string{"*/big"},
+			wantErr:   "transfer truncated: the archive ends within dump/big",
+			wantFiles: []string{"small"},
+		},
+		{
+			name:      "within a header",
+			data:      archive[:bigStart+100],
+			wantErr:   "transfer truncated: the archive ends within a header after 1124 bytes",
+			wantFiles: []string{"small"},
+		},
+		{
+			name:      "between entries",
+			data:      archive[:bigStart],
+			wantErr:   "transfer truncated: the archive ends after 1024 bytes without the end of archive marker",
+			wantFiles: []string{"small"},
+		},
+		{
+			name:      "after the entries",
+			data:      archive[:len(archive)-2*tarBlockSize],
+			wantErr:   "transfer truncated: the archive ends after 3584 bytes without the end of archive marker",
+			wantFiles: []string{"big", "small"},
+		},
+		{
+			name:      "a lone zero block",
+			data:      archive[:len(archive)-tarBlockSize],
+			wantErr:   "transfer truncated: the archive ends after 4096 bytes",
+			wantFiles: []string{"big", "small"},
+		},
+		{name: "complete", data: archive, wantFiles: []string{"big", "small"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.Exclude = tt.exclude
+			o.KeepPartial = true
+			dest := mustTempDir(t)
+
+			_, err := o.extractTar(context.Background(), bytes.NewReader(tt.data), dest, "dump")
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Fatalf("extractTar() error = %v, want %q", err, tt.wantErr)
+			}
+			entries, _ := os.ReadDir(filepath.Join(dest, "dump"))
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.wantFiles, " ") {
+				t.Errorf("extracted %q, want %q", got, tt.wantFiles)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errUploadStopped is what writing the archive of an upload fails with once
+// the remote command stopped reading it.
+var errUploadStopped = errors.New("the container stopped reading the upload")
+
+// copyToPod uploads the local file or directory src to dest in a container, as
+// a tar archive streamed to tar xf - -C <dir of dest>. The proxy audits every
+// entry of the archive with its size. dest is the path of the copy, or the
+// directory it is copied into when it ends in a slash.
+func (o *CopyOptions) copyToPod(ctx context.Context, src, dest *fileSpec) error {
+	if o.DryRun || o.EntriesFrom != "" || o.Chunked || o.Retries != 0 || o.FollowSymlinks || o.Preserve || o.SourcesManifest != "" || o.Open || o.OpenWith != "" || o.OutputOwner != "" || o.Checksum || o.Compress || o.Xattrs || o.KeepPartial || len(o.Exclude) > 0 || o.StripComponents != 0 || o.Output != "" {
+		return fmt.Errorf("--dry-run, --entries-from, --chunked, --retries, --follow-symlinks, --preserve, --sources-manifest, --open, --open-with, --output-owner, --checksum, --compress, --xattrs, --keep-partial, --exclude, --strip-components and -o only apply to copies from pods")
+	}
+	// the path named is uploaded even when it is a symlink, those below it
+	// are skipped
+	srcPath, err := filepath.EvalSymlinks(filepath.Clean(src.File))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("local file does not exist: %s", src.File)
+	}
+	if err != nil {
+		return fmt.Errorf("local file can't be read: %v", err)
+	}
+
+	destPath := dest.File
+	if strings.HasSuffix(destPath, "/") {
+		destPath += filepath.Base(srcPath)
+	}
+	destPath = path.Clean(destPath)
+	destDir, destBase := path.Dir(destPath), path.Base(destPath)
+	if destBase == "/" || destBase == "." || destBase == ".." {
+		return fmt.Errorf("remote path must name the copy or end in /: %s", dest.File)
+	}
+
+	pod, containerName, err := o.validateAndGetPodContainer(ctx, dest)
+	if err != nil {
+		return err
+	}
+	command, err := o.remoteCommand(ctx, pod, containerName, []string{"tar", "xf", "-", "-C", destDir})
+	if err != nil {
+		return err
+	}
+
+	o.warnings = newCopyWarnings(o.IOStreams.ErrOut, o.ShowAllWarnings)
+	stdin, archive := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := o.writeUploadTar(archive, srcPath, destBase)
+		archive.CloseWithError(err)
+		written <- err
+	}()
+	var stdout, stderr bytes.Buffer
+	execErr := o.executeWithStdin(ctx, pod, containerName, command, stdin, &stdout, &stderr)
+	// a remote tar that failed stops reading, the archive is not written on
+	stdin.CloseWithError(errUploadStopped)
+	writeErr := <-written
+	o.warnings.summary()
+
+	var cancelled copyCancelledError
+	if errors.As(execErr, &cancelled) {
+		return execErr
+	}
+	// a local error cuts the archive short, which is all the remote tar sees
+	if writeErr != nil && !errors.Is(writeErr, errUploadStopped) {
+		return writeErr
+	}
+	if execErr != nil {
+		return o.handleUploadError(execErr, stderr.String(), dest, containerName, destDir, destPath)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("pod %s/%s: %v", dest.PodNamespace, dest.PodName, writeErr)
+	}
+
+	if _, err := fmt.Fprintf(o.summaryOut(), "Copied %s to %s:%s\n", src.File, dest.PodName, destPath); err != nil {
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	return nil
+}
+
+// writeUploadTar writes the archive of srcPath, with its entries named after
+// destBase, to w. Like downloads it only carries directories and regular
+// files, without special mode bits or the local owner.
+func (o *CopyOptions) writeUploadTar(w io.Writer, srcPath, destBase string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(srcPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("local file can't be read: %v", err)
+		}
+		rel, err := filepath.Rel(srcPath, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(destBase, filepath.ToSlash(rel))
+		switch {
+		case d.IsDir():
+			name += "/"
+		case d.Type().IsRegular():
+		case d.Type()&fs.ModeSymlink != 0:
+			o.warnings.warn(warnSymlink, "skipping symlink %s (symlinks not supported for security)", p)
+			return nil
+		default:
+			o.warnings.warn(warnUnsupported, "skipping unsupported file %s (%s)", p, d.Type())
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("local file can't be read: %v", err)
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if special := header.Mode & 0o7000; special != 0 {
+			o.warnings.warn(warnModeClamped, "dropping special mode bits %04o of %s", special, p)
+		}
+		header.Mode &= 0o777
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return copyUploadFile(tw, p, header.Size)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// copyUploadFile writes the size bytes of the file p to tw.
+func copyUploadFile(tw *tar.Writer, p string, size int64) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("local file can't be read: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := io.CopyN(tw, f, size); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("local file %s shrank while it was uploaded", p)
+		}
+		return err
+	}
+	return nil
+}
+
+// handleUploadError explains a failed upload as handleExecError does a failed
+// download.
+func (o *CopyOptions) handleUploadError(execErr error, stderrStr string, dest *fileSpec, container, destDir, destPath string) error {
+	podRef := fmt.Sprintf("%s/%s", dest.PodNamespace, dest.PodName)
+
+	switch classifyRemoteStderr(stderrStr) {
+	case remoteErrTarMissing:
+		return fmt.Errorf("pod %s: tar binary not found in container %s", podRef, container)
+	case remoteErrNotFound:
+		return fmt.Errorf("pod %s: destination directory not found: %s", podRef, destDir)
+	case remoteErrPermission:
+		return fmt.Errorf("pod %s: permission denied: %s", podRef, destPath)
+	}
+
+	if stderrStr != "" {
+		return fmt.Errorf("pod %s: %s", podRef, strings.TrimSpace(stderrStr))
+	}
+
+	return fmt.Errorf("pod %s: command failed: %v", podRef, execErr)
+}
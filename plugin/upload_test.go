@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// uploadedEntries lists the entries of an uploaded archive as type, name,
+// mode and content.
+func uploadedEntries(t *testing.T, archive []byte) []string {
+	t.Helper()
+	var entries []string
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Uname != "" || header.Uid != 0 {
+			t.Errorf("%s carries the local owner %s (%d)", header.Name, header.Uname, header.Uid)
+		}
+		entries = append(entries, fmt.Sprintf("%c %s %04o %s", header.Typeflag, header.Name, header.Mode, content))
+	}
+}
+
+func TestCopyToPod(t *testing.T) {
+	dir := mustTempDir(t)
+	script := filepath.Join(dir, "debug.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "conf")
+	if err := os.MkdirAll(filepath.Join(conf, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(conf, "app.yaml"), []byte("a: 1\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(conf, "sub", "run"), []byte("x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(conf, "sub", "run"), 0o755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("app.yaml", filepath.Join(conf, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, src, dest string
+		command         []string
+		entries         []string
+		out, warnings   string
+	}{
+		{
+			"file into a directory", script, "pod:/tmp/",
+			[]string{"tar", "xf", "-", "-C", "/tmp"},
+			[]string{"0 debug.sh 0755 #!/bin/sh\n"},
+			"Copied " + script + " to pod:/tmp/debug.sh\n", "",
+		},
+		{
+			"file renamed", script, "pod:/tmp/check",
+			[]string{"tar", "xf", "-", "-C", "/tmp"},
+			[]string{"0 check 0755 #!/bin/sh\n"},
+			"Copied " + script + " to pod:/tmp/check\n", "",
+		},
+		{
+			"directory", conf, "pod:/etc/app",
+			[]string{"tar", "xf", "-", "-C", "/etc"},
+			[]string{"5 app/ 0750 ", "0 app/app.yaml 0640 a: 1\n", "5 app/sub/ 0750 ", "0 app/sub/run 0755 x"},
+			"Copied " + conf + " to pod:/etc/app\n",
+			"Warning: skipping symlink " + filepath.Join(conf, "current") + " (symlinks not supported for security)\n" +
+				"Warning: dropping special mode bits 4000 of " + filepath.Join(conf, "sub", "run") + "\n" +
+				"Warnings: 1 skipped symlinks, 1 clamped modes\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executor := &fakeExecutor{}
+			o := newFakePodCopyOptions(executor)
+			var out, errOut bytes.Buffer
+			o.IOStreams.Out, o.IOStreams.ErrOut = &out, &errOut
+			o.Container, o.AllowUpload = "app", true
+			if err := o.RunWithArgs(context.Background(), tt.src, tt.dest); err != nil {
+				t.Fatal(err)
+			}
+			want := append([]string{"env", "LC_ALL=C", "LANG=C"}, tt.command...)
+			if got := executor.commands[len(executor.commands)-1]; !reflect.DeepEqual(got, want) {
+				t.Errorf("command = %q, want %q", got, want)
+			}
+			if got := uploadedEntries(t, executor.stdin); !reflect.DeepEqual(got, tt.entries) {
+				t.Errorf("entries = %q, want %q", got, tt.entries)
+			}
+			if out.String() != tt.out {
+				t.Errorf("output = %q, want %q", out.String(), tt.out)
+			}
+			if errOut.String() != tt.warnings {
+				t.Errorf("warnings = %q, want %q", errOut.String(), tt.warnings)
+			}
+		})
+	}
+}
+
+func TestCopyToPodErrors(t *testing.T) {
+	dir := mustTempDir(t)
+	script := filepath.Join(dir, "debug.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	exitErr := errors.New("command terminated with exit code 2")
+
+	tests := []struct {
+		name, src, dest string
+		executor        *fakeExecutor
+		setup           func(o *CopyOptions)
+		want            string
+	}{
+		{"not allowed", script, "pod:/tmp/", &fakeExecutor{}, func(o *CopyOptions) { o.AllowUpload = false }, "copying to pods is not supported"},
+		{"missing source", filepath.Join(dir, "missing"), "pod:/tmp/", &fakeExecutor{}, nil, "local file does not exist: " + filepath.Join(dir, "missing")},
+		{"destination without a name", script, "pod:/tmp/..", &fakeExecutor{}, nil, "remote path must name the copy or end in /: /tmp/.."},
+		{"download flag", script, "pod:/tmp/", &fakeExecutor{}, func(o *CopyOptions) { o.DryRun = true }, "only apply to copies from pods"},
+		{
+			"destination directory missing", script, "pod:/nope/debug.sh",
+			&fakeExecutor{stderr: "tar: /nope: Cannot open: No such file or directory\n", err: exitErr}, nil,
+			"pod default/pod: destination directory not found: /nope",
+		},
+		{
+			"destination directory missing busybox", script, "pod:/nope/",
+			&fakeExecutor{stderr: "tar: can't change directory to '/nope': No such file or directory\n", err: exitErr}, nil,
+			"pod default/pod: destination directory not found: /nope",
+		},
+		{
+			"permission denied", script, "pod:/etc/",
+			&fakeExecutor{stderr: "tar: debug.sh: Cannot open: Permission denied\n", err: exitErr}, nil,
+			"pod default/pod: permission denied: /etc/debug.sh",
+		},
+		{
+			"tar missing", script, "pod:/tmp/",
+			&fakeExecutor{stderr: `exec: "tar": executable file not found in $PATH`, err: exitErr}, nil,
+			"pod default/pod: tar binary not found in container app",
+		},
+		{
+			"other failure", script, "pod:/tmp/",
+			&fakeExecutor{stderr: "tar: debug.sh: Cannot open: Read-only file system\n", err: exitErr}, nil,
+			"pod default/pod: tar: debug.sh: Cannot open: Read-only file system",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newFakePodCopyOptions(tt.executor)
+			o.AllowUpload = true
+			if tt.setup != nil {
+				tt.setup(o)
+			}
+			err := o.RunWithArgs(context.Background(), tt.src, tt.dest)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("RunWithArgs() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// stopReadingExecutor succeeds without reading stdin, like a remote command
+// that exits before the end of the upload.
+type stopReadingExecutor struct{ fakeExecutor }
+
+func (e *stopReadingExecutor) ExecuteWithStdin(ctx context.Context, pod *corev1.Pod, container string, command []string, _ io.Reader, stdout, stderr io.Writer) error {
+	return e.Execute(ctx, pod, container, command, stdout, stderr)
+}
+
+func TestCopyToPodStoppedReading(t *testing.T) {
+	dir := mustTempDir(t)
+	script := filepath.Join(dir, "debug.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	o := newFakePodCopyOptions(&stopReadingExecutor{})
+	o.AllowUpload = true
+	err := o.RunWithArgs(context.Background(), script, "pod:/tmp/")
+	if err == nil || !strings.Contains(err.Error(), "the container stopped reading the upload") {
+		t.Fatalf("RunWithArgs() = %v, want the upload cut short", err)
+	}
+}
@@ -0,0 +1,431 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.yaml.in/yaml/v3"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+// userConfigEnv points at a config file other than the default one.
+const userConfigEnv = "KUBECTL_REXEC_CONFIG"
+
+// unsafeConfigFlags can't be set from the config file: credentials belong in
+// the kubeconfig, acting as someone else is left to an explicit --as, and
+// uploads, copies from failing nodes and overwriting without asking are opted
+// into per invocation.
+var unsafeConfigFlags = map[string]bool{
+	"token":         true,
+	"password":      true,
+	"username":      true,
+	"as":            true,
+	"as-group":      true,
+	"as-uid":        true,
+	"as-user-extra": true,
+	"allow-upload":  true,
+	"force":         true,
+	"overwrite":     true,
+}
+
+// Sources of the value of a flag in config view.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceFlag    = "flag"
+)
+
+// configValue is a flag value of the config file and where it was written.
+type configValue struct {
+	values       []string
+	line, column int
+}
+
+// userConfig is a parsed config file: the flag values of each command, keyed
+// by its command path such as "rexec cp".
+type userConfig struct {
+	path     string
+	commands map[string]map[string]configValue
+}
+
+// userConfigPath returns the config file to read, and whether it was named
+// explicitly through userConfigEnv, in which case it has to exist.
+func userConfigPath() (string, bool, error) {
+	if path := os.Getenv(userConfigEnv); path != "" {
+		return path, true, nil
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false, err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "kubectl-rexec", "config.yaml"), false, nil
+}
+
+// loadUserConfig reads the config file and checks it against the flags and
+// subcommands of root. A missing default file is an empty config.
+func loadUserConfig(root *cobra.Command) (*userConfig, error) {
+	path, explicit, err := userConfigPath()
+	if err != nil {
+		return nil, fmt.Errorf("can't locate the config file, set %s: %v", userConfigEnv, err)
+	}
+	c := &userConfig{path: path, commands: map[string]map[string]configValue{}}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read the config file: %v", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return c, nil
+	}
+	if err := c.section(root, doc.Content[0]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// errorAt is an error in the config file at node.
+func (c *userConfig) errorAt(node *yaml.Node, format string, args ...any) error {
+	return fmt.Errorf("%s:%d:%d: %s", c.path, node.Line, node.Column, fmt.Sprintf(format, args...))
+}
+
+// section reads the mapping node of cmd: its flags, and the sections of its
+// subcommands.
+func (c *userConfig) section(cmd *cobra.Command, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return c.errorAt(node, "the section of %s must map flags and subcommands to values", cmd.CommandPath())
+	}
+	seen := map[string]bool{}
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := key.Value
+		if seen[name] {
+			return c.errorAt(key, "%s is set twice for %s", name, cmd.CommandPath())
+		}
+		seen[name] = true
+		if sub := configSubcommand(cmd, name); sub != nil {
+			if err := c.section(sub, value); err != nil {
+				return err
+			}
+			continue
+		}
+		flag := configFlag(cmd, name)
+		if flag == nil {
+			msg := fmt.Sprintf("unknown flag or subcommand %q of %s", name, cmd.CommandPath())
+			if s := configSuggestion(cmd, name); s != "" {
+				msg += ", did you mean " + s + "?"
+			}
+			return c.errorAt(key, "%s", msg)
+		}
+		if unsafeConfigFlags[flag.Name] {
+			return c.errorAt(key, "--%s can't be set in the config file, pass it on the command line", flag.Name)
+		}
+		values, err := c.flagValues(cmd, flag, value)
+		if err != nil {
+			return err
+		}
+		if c.commands[cmd.CommandPath()] == nil {
+			c.commands[cmd.CommandPath()] = map[string]configValue{}
+		}
+		c.commands[cmd.CommandPath()][flag.Name] = configValue{values: values, line: key.Line, column: key.Column}
+	}
+	return nil
+}
+
+// configSubcommand is the subcommand of cmd named name, nil if there is none.
+func configSubcommand(cmd *cobra.Command, name string) *cobra.Command {
+	for _, sub := range cmd.Commands() {
+		if sub.Name() == name && !sub.Hidden {
+			return sub
+		}
+	}
+	return nil
+}
+
+// configFlag is the flag of cmd named name, its own or inherited from a
+// parent, nil if there is none.
+func configFlag(cmd *cobra.Command, name string) *pflag.Flag {
+	if flag := cmd.Flags().Lookup(name); flag != nil {
+		return flag
+	}
+	return cmd.InheritedFlags().Lookup(name)
+}
+
+// configSuggestion is the flag or subcommand of cmd closest to a mistyped
+// name, empty when none is close.
+func configSuggestion(cmd *cobra.Command, name string) string {
+	best, bestDistance := "", 3
+	consider := func(candidate string) {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		if !sub.Hidden {
+			consider(sub.Name())
+		}
+	}
+	visit := func(flag *pflag.Flag) { consider(flag.Name) }
+	cmd.Flags().VisitAll(visit)
+	cmd.InheritedFlags().VisitAll(visit)
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// flagValues returns the values node sets flag to, checked against the type of
+// the flag. Only list flags take a sequence.
+func (c *userConfig) flagValues(cmd *cobra.Command, flag *pflag.Flag, node *yaml.Node) ([]string, error) {
+	_, list := flag.Value.(pflag.SliceValue)
+	var items []*yaml.Node
+	switch {
+	case node.Kind == yaml.ScalarNode && node.Tag != "!!null":
+		items = []*yaml.Node{node}
+	case node.Kind == yaml.SequenceNode && list:
+		items = node.Content
+	case node.Kind == yaml.SequenceNode:
+		return nil, c.errorAt(node, "--%s of %s takes a single value, not a list", flag.Name, cmd.CommandPath())
+	default:
+		return nil, c.errorAt(node, "--%s of %s needs a value", flag.Name, cmd.CommandPath())
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Kind != yaml.ScalarNode {
+			return nil, c.errorAt(item, "--%s of %s takes plain values", flag.Name, cmd.CommandPath())
+		}
+		if err := checkFlagValue(flag, item.Value); err != nil {
+			return nil, c.errorAt(item, "invalid value %q for --%s of %s: %v", item.Value, flag.Name, cmd.CommandPath(), err)
+		}
+		values = append(values, item.Value)
+	}
+	return values, nil
+}
+
+// checkFlagValue parses value as the type of flag. Types it does not know are
+// checked when the value is set.
+func checkFlagValue(flag *pflag.Flag, value string) error {
+	var err error
+	switch strings.TrimSuffix(strings.TrimSuffix(flag.Value.Type(), "Slice"), "Array") {
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "int", "int8", "int16", "int32", "int64":
+		_, err = strconv.ParseInt(value, 0, 64)
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		_, err = strconv.ParseUint(value, 0, 64)
+	case "float32", "float64":
+		_, err = strconv.ParseFloat(value, 64)
+	case "duration":
+		_, err = time.ParseDuration(value)
+	}
+	if numErr, ok := err.(*strconv.NumError); ok {
+		err = numErr.Err
+	}
+	return err
+}
+
+// effective returns the values of the file for the flags of cmd: those of its
+// section override those of its parents.
+func (c *userConfig) effective(cmd *cobra.Command) map[string]configValue {
+	var chain []*cobra.Command
+	for p := cmd; p != nil; p = p.Parent() {
+		chain = append([]*cobra.Command{p}, chain...)
+	}
+	effective := map[string]configValue{}
+	for _, p := range chain {
+		for name, v := range c.commands[p.CommandPath()] {
+			effective[name] = v
+		}
+	}
+	return effective
+}
+
+// apply sets the flags of cmd that were not given on the command line to the
+// values of the file, and returns the source of every flag of cmd.
+func (c *userConfig) apply(cmd *cobra.Command) (map[string]string, error) {
+	effective := c.effective(cmd)
+	sources := map[string]string{}
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		v, ok := effective[flag.Name]
+		switch {
+		case flag.Changed:
+			sources[flag.Name] = sourceFlag
+		case ok:
+			sources[flag.Name] = sourceFile
+			if setErr := setFlagValues(flag, v.values); setErr != nil && err == nil {
+				err = fmt.Errorf("%s:%d:%d: invalid value for --%s: %v", c.path, v.line, v.column, flag.Name, setErr)
+			}
+		default:
+			sources[flag.Name] = sourceDefault
+		}
+	})
+	return sources, err
+}
+
+// setFlagValues sets flag to values without marking it changed, so the
+// commands still tell a value given on the command line apart.
+func setFlagValues(flag *pflag.Flag, values []string) error {
+	if list, ok := flag.Value.(pflag.SliceValue); ok {
+		return list.Replace(values)
+	}
+	return flag.Value.Set(values[0])
+}
+
+// applyUserConfig loads the config file and applies it to cmd, the command
+// about to run.
+func applyUserConfig(cmd *cobra.Command) error {
+	c, err := loadUserConfig(cmd.Root())
+	if err != nil {
+		return err
+	}
+	_, err = c.apply(cmd)
+	return err
+}
+
+// NewCmdConfig creates the 'config' command inspecting the config file.
+func NewCmdConfig(ioStreams genericiooptions.IOStreams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: i18n.T("Inspect the kubectl-rexec config file"),
+		Long: templates.LongDesc(`
+			Inspect the config file kubectl-rexec reads the defaults of its flags
+			from, ~/.config/kubectl-rexec/config.yaml or the file $KUBECTL_REXEC_CONFIG
+			points at.`),
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "view",
+		Short: i18n.T("Print the value of every flag and where it comes from"),
+		Long: templates.LongDesc(`
+			Print the value of every flag of every command, merged from the
+			defaults, the config file and the command line, and where each value
+			comes from.`),
+		Example: templates.Examples(`
+			# Show which defaults the config file changes
+			kubectl rexec config view
+
+			# Show the flags as they are for another context
+			kubectl rexec config view --context staging`),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(runConfigView(ioStreams.Out, cmd))
+		},
+	})
+	return cmd
+}
+
+// runConfigView prints the flags of the root command as view, the command
+// running, sees them, then the own flags of every subcommand and the flags
+// their sections override.
+func runConfigView(out io.Writer, view *cobra.Command) error {
+	c, err := loadUserConfig(view.Root())
+	if err != nil {
+		return err
+	}
+	sources, err := c.apply(view)
+	if err != nil {
+		return err
+	}
+	root := view.Root()
+	var rows [][]string
+	for _, flag := range sortedFlags(root.PersistentFlags()) {
+		rows = append(rows, configViewRow(root, flag, sources[flag.Name], flag.Value.String()))
+	}
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		for _, sub := range cmd.Commands() {
+			if sub.Hidden || sub.Name() == "help" {
+				continue
+			}
+			own := c.commands[sub.CommandPath()]
+			effective := c.effective(sub)
+			for _, flag := range sortedFlags(sub.LocalNonPersistentFlags()) {
+				if v, ok := effective[flag.Name]; ok {
+					rows = append(rows, configViewRow(sub, flag, sourceFile, formatConfigValue(flag, v.values)))
+				} else {
+					rows = append(rows, configViewRow(sub, flag, sourceDefault, flag.DefValue))
+				}
+			}
+			for _, flag := range sortedFlags(sub.InheritedFlags()) {
+				if v, ok := own[flag.Name]; ok {
+					rows = append(rows, configViewRow(sub, flag, sourceFile, formatConfigValue(flag, v.values)))
+				}
+			}
+			walk(sub)
+		}
+	}
+	walk(root)
+
+	o := newOutput(out)
+	o.printf("Config file: %s\n", c.path)
+	return o.table([]column{{Header: "COMMAND"}, {Header: "FLAG"}, {Header: "VALUE", TrimLeft: true}, {Header: "SOURCE"}}, rows)
+}
+
+// configViewRow is the row of flag of cmd in config view, its value redacted
+// when it is a credential.
+func configViewRow(cmd *cobra.Command, flag *pflag.Flag, source, value string) []string {
+	if unsafeConfigFlags[flag.Name] && flag.Value.Type() != "bool" && value != "" && value != "[]" {
+		value = "<redacted>"
+	}
+	return []string{cmd.CommandPath(), "--" + flag.Name, value, source}
+}
+
+// formatConfigValue formats values of the file like flag formats its own.
+func formatConfigValue(flag *pflag.Flag, values []string) string {
+	if _, list := flag.Value.(pflag.SliceValue); list {
+		return "[" + strings.Join(values, ",") + "]"
+	}
+	return values[0]
+}
+
+// sortedFlags returns the flags of fs that config view shows, by name.
+func sortedFlags(fs *pflag.FlagSet) []*pflag.Flag {
+	var flags []*pflag.Flag
+	fs.VisitAll(func(flag *pflag.Flag) {
+		if flag.Name != "help" && !flag.Hidden && flag.Deprecated == "" {
+			flags = append(flags, flag)
+		}
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+)
+
+// withUserConfig makes config the content of the config file, read from the
+// test's working directory, with a home of /home/analyst for the defaults
+// derived from it. An empty config leaves no file behind the default path.
+func withUserConfig(t *testing.T, config string) {
+	t.Helper()
+	t.Chdir(mustTempDir(t))
+	t.Setenv("HOME", "/home/analyst")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("COLUMNS", "")
+	t.Setenv(userConfigEnv, "")
+	if config != "" {
+		if err := os.WriteFile("config.yaml", []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(userConfigEnv, "config.yaml")
+	}
+}
+
+// newConfigRoot builds the rexec command, restoring the globals its flags
+// are bound to afterwards.
+func newConfigRoot(t *testing.T) (*cobra.Command, *strings.Builder) {
+	t.Helper()
+	oldWidth, oldVersion, oldChangeID := OutputWidth, RexecAPIVersion, ChangeID
+	t.Cleanup(func() { OutputWidth, RexecAPIVersion, ChangeID = oldWidth, oldVersion, oldChangeID })
+	out := &strings.Builder{}
+	root := NewCmdRexec(genericiooptions.IOStreams{In: strings.NewReader(""), Out: out, ErrOut: out})
+	return root, out
+}
+
+// parseWithConfig parses args for the subcommand named by the first of them
+// and applies the config file to it, as running it would.
+func parseWithConfig(t *testing.T, args ...string) (*cobra.Command, map[string]string) {
+	t.Helper()
+	root, _ := newConfigRoot(t)
+	cmd, flags, err := root.Find(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.ParseFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadUserConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, err := c.apply(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd, sources
+}
+
+func TestUserConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		flag   string
+		value  string
+		source string
+	}{
+		{"default", "", []string{"cp"}, "namespace", "", sourceDefault},
+		{"root section", "namespace: tools\n", []string{"cp"}, "namespace", "tools", sourceFile},
+		{"subcommand section", "cp:\n  namespace: forensics\n", []string{"cp"}, "namespace", "forensics", sourceFile},
+		{"subcommand section over root section", "namespace: tools\ncp:\n  namespace: forensics\n", []string{"cp"}, "namespace", "forensics", sourceFile},
+		{"flag over both sections", "namespace: tools\ncp:\n  namespace: forensics\n", []string{"cp", "-n", "web"}, "namespace", "web", sourceFlag},
+		{"section of another subcommand", "run:\n  namespace: batch\n", []string{"cp"}, "namespace", "", sourceDefault},
+		{"bool", "cp:\n  chunked: true\n", []string{"cp"}, "chunked", "true", sourceFile},
+		{"bool flag over file", "cp:\n  chunked: true\n", []string{"cp", "--chunked=false"}, "chunked", "false", sourceFlag},
+		{"duration", "run:\n  timeout: 5m\n", []string{"run"}, "timeout", "5m0s", sourceFile},
+		{"list", "exec:\n  filename: [a.yaml, b.yaml]\n", []string{"exec"}, "filename", "[a.yaml,b.yaml]", sourceFile},
+		{"single value of a list", "exec:\n  filename: a.yaml\n", []string{"exec"}, "filename", "[a.yaml]", sourceFile},
+		{"list flag replaces file", "exec:\n  filename: [a.yaml, b.yaml]\n", []string{"exec", "-f", "c.yaml"}, "filename", "[c.yaml]", sourceFlag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withUserConfig(t, tt.config)
+			cmd, sources := parseWithConfig(t, tt.args...)
+			flag := cmd.Flags().Lookup(tt.flag)
+			if got := flag.Value.String(); got != tt.value {
+				t.Errorf("--%s = %q, want %q", tt.flag, got, tt.value)
+			}
+			if got := sources[tt.flag]; got != tt.source {
+				t.Errorf("--%s comes from %q, want %q", tt.flag, got, tt.source)
+			}
+			// the commands still tell the command line apart
+			if flag.Changed != (tt.source == sourceFlag) {
+				t.Errorf("--%s changed = %v with source %s", tt.flag, flag.Changed, tt.source)
+			}
+		})
+	}
+}
+
+func TestUserConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"misspelled flag", "cp:\n  chunk-sise: 1Mi\n", `config.yaml:2:3: unknown flag or subcommand "chunk-sise" of rexec cp, did you mean chunk-size?`},
+		{"unknown subcommand", "logs:\n  follow: true\n", `config.yaml:1:1: unknown flag or subcommand "logs" of rexec`},
+		{"flag of another subcommand", "run:\n  chunked: true\n", `config.yaml:2:3: unknown flag or subcommand "chunked" of rexec run`},
+		{"not an int", "width: wide\n", `config.yaml:1:8: invalid value "wide" for --width of rexec: invalid syntax`},
+		{"not a bool", "cp:\n  chunked: maybe\n", `config.yaml:2:12: invalid value "maybe" for --chunked of rexec cp`},
+		{"duration without unit", "run:\n  timeout: 5\n", `config.yaml:2:12: invalid value "5" for --timeout of rexec run: time: missing unit`},
+		{"list of a single value", "namespace: [a, b]\n", "config.yaml:1:12: --namespace of rexec takes a single value, not a list"},
+		{"nested list", "exec:\n  filename: [[a.yaml]]\n", "config.yaml:2:14: --filename of rexec exec takes plain values"},
+		{"no value", "namespace:\n", "config.yaml:1:11: --namespace of rexec needs a value"},
+		{"section not a mapping", "cp: yes\n", "config.yaml:1:5: the section of rexec cp must map flags and subcommands to values"},
+		{"file not a mapping", "- cp\n", "config.yaml:1:1: the section of rexec must map flags and subcommands to values"},
+		{"set twice", "width: 80\nwidth: 100\n", "config.yaml:2:1: width is set twice for rexec"},
+		{"token", "token: s3cr3t\n", "config.yaml:1:1: --token can't be set in the config file"},
+		{"impersonation in a section", "cp:\n  as: admin\n", "config.yaml:2:3: --as can't be set in the config file"},
+		{"upload", "cp:\n  allow-upload: true\n", "config.yaml:2:3: --allow-upload can't be set in the config file"},
+		{"force", "cp:\n  force: true\n", "config.yaml:2:3: --force can't be set in the config file"},
+		{"overwrite", "cp:\n  overwrite: true\n", "config.yaml:2:3: --overwrite can't be set in the config file"},
+		{"syntax", "cp: [\n", "config.yaml: yaml: line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withUserConfig(t, tt.config)
+			root, _ := newConfigRoot(t)
+			_, err := loadUserConfig(root)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("loadUserConfig() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUserConfigDoesNotOptIntoUploads(t *testing.T) {
+	withUserConfig(t, "cp:\n  allow-upload: true\n  force: true\n")
+	root, _ := newConfigRoot(t)
+	cmd, flags, err := root.Find([]string{"cp", "./debug.sh", "pod:/tmp/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.ParseFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyUserConfig(cmd); err == nil {
+		t.Fatal("applyUserConfig() accepted allow-upload from the config file")
+	}
+	for _, name := range []string{"allow-upload", "force"} {
+		if flag := cmd.Flags().Lookup(name); flag.Value.String() != "false" {
+			t.Errorf("--%s = %s from the config file, want the default", name, flag.Value)
+		}
+	}
+}
+
+func TestUserConfigPath(t *testing.T) {
+	withUserConfig(t, "")
+	root, _ := newConfigRoot(t)
+	// a missing default file is no config
+	c, err := loadUserConfig(root)
+	if err != nil || c.path != "/home/analyst/.config/kubectl-rexec/config.yaml" || len(c.commands) != 0 {
+		t.Fatalf("loadUserConfig() = %+v, %v, want the empty default", c, err)
+	}
+	t.Setenv("XDG_CONFIG_HOME", "/home/analyst/cfg")
+	if path, _, _ := userConfigPath(); path != "/home/analyst/cfg/kubectl-rexec/config.yaml" {
+		t.Fatalf("userConfigPath() = %s, want it under XDG_CONFIG_HOME", path)
+	}
+	// a file named explicitly has to exist
+	t.Setenv(userConfigEnv, "missing.yaml")
+	if _, err := loadUserConfig(root); err == nil || !strings.Contains(err.Error(), "can't read the config file") {
+		t.Fatalf("loadUserConfig() = %v, want the missing file", err)
+	}
+}
+
+func TestConfigView(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+	}{
+		{"defaults", "", nil},
+		{"merged", "namespace: tools\nwidth: 100\ncp:\n  chunk-size: 128Mi\n  namespace: forensics\nexec:\n  filename: [a.yaml, b.yaml]\n", []string{"--context", "staging", "--token", "s3cr3t"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the test runs in the directory of the config file
+			golden, err := filepath.Abs(filepath.Join("testdata", "config", tt.name+".golden"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			withUserConfig(t, tt.config)
+			root, out := newConfigRoot(t)
+			root.SetArgs(append([]string{"config", "view"}, tt.args...))
+			if err := root.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(out.String(), "s3cr3t") {
+				t.Fatal("config view printed the token")
+			}
+			assertGoldenFile(t, golden, out.String())
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"k8s.io/kubectl/pkg/scheme"
+)
+
+// execOptions are the exec parameters of a non-interactive command sent to
+// the rexec endpoint.
+func execOptions(container string, command []string, stdin bool) *corev1.PodExecOptions {
+	return &corev1.PodExecOptions{
+		Container: container,
+		Command:   command,
+		Stdin:     stdin,
+		Stdout:    true,
+		Stderr:    true,
+		TTY:       false,
+	}
+}
+
+// execEndpoint is the URL rexecExecutor sends the exec of command to, built
+// from the host of config alone.
+func execEndpoint(config *restclient.Config, pod *corev1.Pod, container string, command []string, stdin bool) string {
+	uri := rexecExecPath(pod.Namespace, pod.Name)
+	if params, err := scheme.ParameterCodec.EncodeParameters(execOptions(container, command, stdin), corev1.SchemeGroupVersion); err == nil {
+		uri += "?" + params.Encode()
+	}
+	if config == nil {
+		return uri
+	}
+	return strings.TrimSuffix(config.Host, "/") + uri
+}
+
+// logExec logs with -v=2 the exec of command in container of pod sent to
+// endpoint, and returns the func logging how long its stream took once it
+// returned. Only the host of the REST config is ever logged, never its
+// bearer token or other credentials: user info in endpoint is dropped.
+func logExec(method, endpoint string, pod *corev1.Pod, container string, command []string) func(err error) {
+	if !klog.V(2).Enabled() {
+		return func(error) {}
+	}
+	if u, err := url.Parse(endpoint); err == nil && u.User != nil {
+		u.User = nil
+		endpoint = u.String()
+	}
+	klog.InfofDepth(1, "exec %s %s", method, endpoint)
+	klog.InfofDepth(1, "exec in pod %s/%s, container %s: %q", pod.Namespace, pod.Name, container, command)
+	start := time.Now()
+	return func(err error) {
+		if err != nil {
+			klog.InfofDepth(1, "exec stream of pod %s/%s failed after %s: %v", pod.Namespace, pod.Name, time.Since(start).Round(time.Millisecond), err)
+			return
+		}
+		klog.InfofDepth(1, "exec stream of pod %s/%s finished in %s", pod.Namespace, pod.Name, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// logPodGet logs with -v=2 how long the GET of pod namespace/name took.
+func logPodGet(namespace, name string, start time.Time) {
+	klog.V(2).InfofDepth(1, "GET pod %s/%s took %s", namespace, name, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,192 @@
+package plugin
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// warningExamples is how many warnings of a category are printed before the
+// rest is only counted, unless --show-all-warnings is set.
+const warningExamples = 5
+
+// futureModTimeSlack is how far past the local clock a modification time may
+// be before it is warned about, allowing for the clocks of pod and machine to
+// differ a little.
+const futureModTimeSlack = time.Minute
+
+// warningCategory groups extraction warnings that repeat per entry.
+type warningCategory int
+
+const (
+	warnSymlink warningCategory = iota
+	warnHardLink
+	warnUnsupported
+	warnSpecial
+	warnModeClamped
+	warnReadFixed
+	warnUnreadable
+	warnBackslash
+	warnOwner
+	warnPreserve
+	warnXattr
+	warnCaseCollision
+	warnFutureModTime
+	warnIllegalPath
+	numWarningCategories
+)
+
+// warningCategories name each category in the summary and in the sources
+// manifest.
+var warningCategories = [numWarningCategories]struct{ summary, key string }{
+	warnSymlink:     {"skipped symlinks", "symlink"},
+	warnHardLink:    {"skipped hard links", "hardlink"},
+	warnUnsupported: {"skipped unsupported entries", "unsupported"},
+	// printed as a single warning, unless --show-all-warnings is set
+	warnSpecial:       {"skipped special files", "special"},
+	warnModeClamped:   {"clamped modes", "mode_clamped"},
+	warnReadFixed:     {"files made owner-readable", "read_fixed"},
+	warnUnreadable:    {"unreadable files", "unreadable"},
+	warnBackslash:     {"names with backslashes", "backslash"},
+	warnOwner:         {"paths not given to the --output-owner", "owner"},
+	warnPreserve:      {"modes, times or owners not preserved", "preserve"},
+	warnXattr:         {"extended attributes not set", "xattr"},
+	warnCaseCollision: {"entries renamed for case collisions", "case_collision"},
+	// a sign of a wrong clock in the pod, which --preserve carries over
+	warnFutureModTime: {"modification times in the future", "future_mtime"},
+	// only listed by --dry-run, a copy fails on the first
+	warnIllegalPath: {"illegal paths", "illegal_path"},
+}
+
+// copyWarning is one warning in the full list of a sources manifest or a copy
+// plan.
+type copyWarning struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// copyWarnings prints the warnings of one extraction. Per category it keeps a
+// count only, so a tree with millions of skipped entries costs no memory,
+// unless keep is set for a document that lists every warning.
+type copyWarnings struct {
+	out     *output
+	showAll bool
+	counts  [numWarningCategories]int
+	keep    bool
+	all     []copyWarning
+}
+
+func newCopyWarnings(out io.Writer, showAll bool) *copyWarnings {
+	return &copyWarnings{out: newOutput(out), showAll: showAll}
+}
+
+// examples is how many warnings of the category are printed before the rest
+// is only counted. Special files are summarized in a single warning.
+func (c warningCategory) examples() int {
+	if c == warnSpecial {
+		return 0
+	}
+	return warningExamples
+}
+
+// warn counts a warning and prints it while the category is below the example
+// limit.
+func (w *copyWarnings) warn(category warningCategory, format string, args ...any) {
+	w.counts[category]++
+	if w.keep {
+		w.all = append(w.all, copyWarning{Kind: warningCategories[category].key, Message: fmt.Sprintf(format, args...)})
+	}
+	if w.showAll || w.counts[category] <= category.examples() {
+		w.out.printf("Warning: "+format+"\n", args...)
+	}
+}
+
+// entry warns about what extracting header does not keep as it is in the
+// archive: the entry itself when it is not a directory, regular file or hard
+// link, its special mode bits, which are never applied locally, and a
+// modification time later than now. Hard links are warned about by
+// hardLinkSkipped, when their target is not copied.
+func (w *copyWarnings) entry(header *tar.Header, now time.Time) {
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeGNUSparse:
+	case tar.TypeLink:
+		return
+	case tar.TypeSymlink:
+		w.warn(warnSymlink, "skipping symlink %s -> %s (symlinks not supported for security)", header.Name, header.Linkname)
+		return
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		w.special(header)
+		return
+	default:
+		w.warn(warnUnsupported, "skipping unsupported tar entry %s (type %d)", header.Name, header.Typeflag)
+		return
+	}
+	if special := header.Mode & 0o7000; special != 0 {
+		w.warn(warnModeClamped, "dropping special mode bits %04o of %s", special, header.Name)
+	}
+	if header.ModTime.After(now.Add(futureModTimeSlack)) {
+		w.warn(warnFutureModTime, "%s was modified in the future, at %s", header.Name, header.ModTime.UTC().Format(time.RFC3339))
+	}
+}
+
+// hardLinkSkipped warns about the hard link of header skipped because its
+// target is not part of the copy.
+func (w *copyWarnings) hardLinkSkipped(header *tar.Header) {
+	w.warn(warnHardLink, "skipping hard link %s -> %s, its target is not part of the copy", header.Name, header.Linkname)
+}
+
+// special warns about the skipped special file of header, a device or FIFO,
+// which a tree such as /dev has many of.
+func (w *copyWarnings) special(header *tar.Header) {
+	w.warn(warnSpecial, "skipping %s %s; use --special-files=create to create it", specialTypeName(header), header.Name)
+}
+
+// summary prints how many warnings were not shown and the exact totals. It
+// prints nothing if there were no warnings.
+func (w *copyWarnings) summary() {
+	var totals []string
+	for category, n := range w.counts {
+		if n == 0 {
+			continue
+		}
+		name := warningCategories[category].summary
+		switch {
+		case w.showAll:
+		case warningCategory(category) == warnSpecial:
+			w.out.printf("Warning: skipped %s special files (devices and FIFOs); use --special-files=create to create them, or --special-files=ignore to skip them silently\n", formatCount(n))
+		case n > warningExamples:
+			w.out.printf("... and %s more %s; use --show-all-warnings for details\n", formatCount(n-warningExamples), name)
+		}
+		totals = append(totals, formatCount(n)+" "+name)
+	}
+	if len(totals) > 0 {
+		w.out.printf("Warnings: %s\n", strings.Join(totals, ", "))
+	}
+}
+
+// byKey returns the non-zero counts keyed by category.
+func (w *copyWarnings) byKey() map[string]int {
+	out := map[string]int{}
+	for category, n := range w.counts {
+		if n > 0 {
+			out[warningCategories[category].key] = n
+		}
+	}
+	return out
+}
+
+// formatCount writes n with thousands separators, 4312 as 4,312.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
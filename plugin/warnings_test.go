@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const skippedSymlinks = 5000
+
+// usrTar looks like /usr of a debug image: thousands of symlinks around a few
+// real files, a setuid binary, a file from a pod with a wrong clock, hard links
+// to a file left out of the archive and a fifo.
+func usrTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(h *tar.Header, content string) {
+		h.Size = int64(len(content))
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf(errWriteTarHeaderForFmt, h.Name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf(errWriteTarContentForFmt, h.Name, err)
+		}
+	}
+	write(&tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755}, "")
+	write(&tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755}, "")
+	write(&tar.Header{Name: "usr/bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755}, "#!busybox\n")
+	write(&tar.Header{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 0o4755}, "#!su\n")
+	write(&tar.Header{Name: "usr/bin/skewed", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)}, "skewed\n")
+	for i := 0; i < skippedSymlinks; i++ {
+		write(&tar.Header{Name: fmt.Sprintf("usr/bin/applet%d", i), Typeflag: tar.TypeSymlink, Linkname: "busybox"}, "")
+	}
+	for i := 0; i < 3; i++ {
+		write(&tar.Header{Name: fmt.Sprintf("usr/bin/link%d", i), Typeflag: tar.TypeLink, Linkname: "usr/lib/busybox"}, "")
+	}
+	write(&tar.Header{Name: "usr/run.fifo", Typeflag: tar.TypeFifo, Mode: 0o644}, "")
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	return buf.Bytes()
+}
+
+func extractUsr(t *testing.T, showAll bool) (string, *CopyOptions) {
+	t.Helper()
+	errOut := &bytes.Buffer{}
+	o := newRunOptions()
+	o.IOStreams.ErrOut = errOut
+	o.ShowAllWarnings = showAll
+	o.manifest = newSourcesManifest("", "pod:/usr", "./usr", filepath.Join(mustTempDir(t), "sources.json"))
+	dest := mustTempDir(t)
+	if _, err := o.extractTar(context.Background(), bytes.NewReader(usrTar(t)), dest, "usr"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	return errOut.String(), o
+}
+
+func TestExtractWarningsAreSummarized(t *testing.T) {
+	out, o := extractUsr(t, false)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	// 5 symlink examples, the 3 hard links, the setuid file, the future
+	// time, one "and more" line, the fifo in a single line and the totals
+	if len(lines) != warningExamples+3+1+1+1+2 {
+		t.Fatalf("expected a short summary, got %d lines:\n%s", len(lines), out)
+	}
+	if n := strings.Count(out, "skipping symlink"); n != warningExamples {
+		t.Fatalf("printed %d symlink warnings, want %d", n, warningExamples)
+	}
+	for _, want := range []string{
+		"... and 4,995 more skipped symlinks; use --show-all-warnings for details",
+		"Warnings: 5,000 skipped symlinks, 3 skipped hard links, 1 skipped special files, 1 clamped modes, 1 modification times in the future",
+		"dropping special mode bits 4000 of usr/bin/su",
+		"usr/bin/skewed was modified in the future, at 2100-01-01T00:00:00Z",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output lacks %q:\n%s", want, out)
+		}
+	}
+
+	want := map[string]int{"symlink": skippedSymlinks, "hardlink": 3, "special": 1, "mode_clamped": 1, "future_mtime": 1}
+	if fmt.Sprint(o.manifest.Warnings) != fmt.Sprint(want) {
+		t.Fatalf("manifest warnings = %v, want %v", o.manifest.Warnings, want)
+	}
+	assertWarningList(t, o.manifest.WarningList)
+	skipped := 0
+	for _, e := range o.manifest.Entries {
+		if e.Skipped {
+			skipped++
+		}
+	}
+	if skipped != skippedSymlinks+3+1 {
+		t.Fatalf("manifest lists %d skipped entries, want every one of them", skipped)
+	}
+}
+
+// assertWarningList checks list has every warning of usrTar, those the console
+// left out too.
+func assertWarningList(t *testing.T, list []copyWarning) {
+	t.Helper()
+	kinds := map[string]int{}
+	for _, w := range list {
+		kinds[w.Kind]++
+	}
+	want := map[string]int{"symlink": skippedSymlinks, "hardlink": 3, "special": 1, "mode_clamped": 1, "future_mtime": 1}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Fatalf("warning list has %v, want %v", kinds, want)
+	}
+	last := copyWarning{Kind: "symlink", Message: fmt.Sprintf("skipping symlink usr/bin/applet%d -> busybox (symlinks not supported for security)", skippedSymlinks-1)}
+	found := false
+	for _, w := range list {
+		found = found || w == last
+	}
+	if !found {
+		t.Fatalf("warning list lacks %+v", last)
+	}
+}
+
+func TestDryRunListsEveryWarning(t *testing.T) {
+	o := newFakePodCopyOptions(&fakeExecutor{stdout: usrTar(t)})
+	out := &bytes.Buffer{}
+	o.IOStreams.Out = out
+	o.DryRun, o.Output = true, "json"
+
+	if err := o.RunWithArgs(context.Background(), "pod:/usr", mustTempDir(t)); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	var plan copyPlan
+	if err := json.Unmarshal(out.Bytes(), &plan); err != nil {
+		t.Fatalf("dry run output is not a plan: %v\n%s", err, out)
+	}
+	assertWarningList(t, plan.Warnings)
+}
+
+func TestFutureModTime(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		modTime time.Time
+		warned  bool
+	}{
+		{now.Add(-time.Hour), false},
+		{now.Add(futureModTimeSlack), false},
+		{now.Add(futureModTimeSlack + time.Second), true},
+	} {
+		w := newCopyWarnings(io.Discard, false)
+		w.entry(&tar.Header{Name: "f", Typeflag: tar.TypeReg, ModTime: tt.modTime}, now)
+		if warned := w.counts[warnFutureModTime] > 0; warned != tt.warned {
+			t.Errorf("modified at %s: warned = %v, want %v", tt.modTime, warned, tt.warned)
+		}
+	}
+}
+
+func TestExtractShowAllWarnings(t *testing.T) {
+	out, _ := extractUsr(t, true)
+
+	if n := strings.Count(out, "skipping symlink"); n != skippedSymlinks {
+		t.Fatalf("printed %d symlink warnings, want all %d", n, skippedSymlinks)
+	}
+	if strings.Contains(out, "more skipped") {
+		t.Fatal("nothing may be left out with --show-all-warnings")
+	}
+	if !strings.Contains(out, "Warnings: 5,000 skipped symlinks") {
+		t.Fatalf("totals missing from the summary")
+	}
+}
+
+func TestExtractClampsSpecialModeBits(t *testing.T) {
+	dest := mustTempDir(t)
+	o := newRunOptions()
+	if _, err := o.extractTar(context.Background(), bytes.NewReader(usrTar(t)), dest, "usr"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	info, err := os.Stat(filepath.Join(dest, "usr", "bin", "su"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+		t.Fatalf("special mode bits were applied: %v", info.Mode())
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	for n, want := range map[int]string{0: "0", 999: "999", 1000: "1,000", 4312: "4,312", 1234567: "1,234,567"} {
+		if got := formatCount(n); got != want {
+			t.Errorf("formatCount(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
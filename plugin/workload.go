@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workloadKinds maps the kinds a copy source may name instead of a pod, as
+// in prod/deploy/payments:/var/log, by their names and short names, to the
+// kind.
+var workloadKinds = map[string]string{
+	"deploy": "deployment", "deployment": "deployment", "deployments": "deployment",
+	"sts": "statefulset", "statefulset": "statefulset", "statefulsets": "statefulset",
+	"ds": "daemonset", "daemonset": "daemonset", "daemonsets": "daemonset",
+	"rs": "replicaset", "replicaset": "replicaset", "replicasets": "replicaset",
+	"job": "job", "jobs": "job",
+}
+
+// workloadGroups are the API groups of the workload kinds.
+var workloadGroups = map[string]string{
+	"deployment": "apps", "statefulset": "apps", "daemonset": "apps", "replicaset": "apps",
+	"job": "batch",
+}
+
+// qualifiedWorkloadKind returns the kind of ref when it names it with its
+// group, as in deploy.apps. A namespace can't hold a dot, so unlike a bare
+// kind this is never the namespace of an ns/pod source.
+func qualifiedWorkloadKind(ref string) (string, bool) {
+	name, group, ok := strings.Cut(ref, ".")
+	if !ok {
+		return "", false
+	}
+	kind, ok := workloadKinds[name]
+	if !ok || workloadGroups[kind] != group {
+		return "", false
+	}
+	return kind, true
+}
+
+// workloadSelector returns the pod selector of the workload kind/name.
+func (o *CopyOptions) workloadSelector(ctx context.Context, namespace, kind, name string) (*metav1.LabelSelector, error) {
+	apps := o.Clientset.AppsV1()
+	var selector *metav1.LabelSelector
+	var err error
+	switch kind {
+	case "deployment":
+		w, getErr := apps.Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = getErr; err == nil {
+			selector = w.Spec.Selector
+		}
+	case "statefulset":
+		w, getErr := apps.StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = getErr; err == nil {
+			selector = w.Spec.Selector
+		}
+	case "daemonset":
+		w, getErr := apps.DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = getErr; err == nil {
+			selector = w.Spec.Selector
+		}
+	case "replicaset":
+		w, getErr := apps.ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = getErr; err == nil {
+			selector = w.Spec.Selector
+		}
+	case "job":
+		w, getErr := o.Clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err = getErr; err == nil {
+			selector = w.Spec.Selector
+		}
+	}
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("%s %s/%s not found", kind, namespace, name)
+	case selector == nil:
+		return nil, fmt.Errorf("%s %s/%s has no pod selector", kind, namespace, name)
+	}
+	return selector, nil
+}
+
+// resolveWorkload replaces the workload spec names with the pod the copy
+// reads from: a Running and Ready pod of it, the first by name. Without one
+// the error lists the pods it has, with their phases.
+func (o *CopyOptions) resolveWorkload(ctx context.Context, spec *fileSpec) error {
+	kind, name, _ := strings.Cut(spec.Workload, "/")
+	labelSelector, err := o.workloadSelector(ctx, spec.PodNamespace, kind, name)
+	if err != nil {
+		return err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return fmt.Errorf("%s %s/%s: %v", kind, spec.PodNamespace, name, err)
+	}
+	list, err := o.Clientset.CoreV1().Pods(spec.PodNamespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+	pods := list.Items
+	if len(pods) == 0 {
+		return fmt.Errorf("%s %s/%s has no pods", kind, spec.PodNamespace, name)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	var candidates []string
+	for _, pod := range pods {
+		if podReady(&pod) {
+			spec.PodName = pod.Name
+			return nil
+		}
+		phase := string(pod.Status.Phase)
+		if pod.Status.Phase == corev1.PodRunning {
+			phase += ", not ready"
+		}
+		if pod.DeletionTimestamp != nil {
+			phase += ", terminating"
+		}
+		candidates = append(candidates, fmt.Sprintf("%s (%s)", pod.Name, phase))
+	}
+	return fmt.Errorf("%s %s/%s has no Running and Ready pod to copy from: %s", kind, spec.PodNamespace, name, strings.Join(candidates, ", "))
+}
+
+// podReady reports whether pod is Running, Ready and not being deleted.
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseFileSpecWorkload(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    fileSpec
+		wantErr string
+	}{
+		{spec: "deploy.apps/payments:/var/log", want: fileSpec{PodName: "payments", PodNamespace: "default", File: "/var/log", Workload: "deployment/payments"}},
+		{spec: "sts.apps/db:/data", want: fileSpec{PodName: "db", PodNamespace: "default", File: "/data", Workload: "statefulset/db"}},
+		{spec: "jobs.batch/migrate:/tmp/out", want: fileSpec{PodName: "migrate", PodNamespace: "default", File: "/tmp/out", Workload: "job/migrate"}},
+		{spec: "job/mypod:/x", want: fileSpec{PodName: "mypod", PodNamespace: "job", File: "/x"}},
+		{spec: "deploy/payments:/var/log", want: fileSpec{PodName: "payments", PodNamespace: "deploy", File: "/var/log"}},
+		{spec: "job.apps/migrate:/tmp/out", want: fileSpec{PodName: "migrate", PodNamespace: "job.apps", File: "/tmp/out"}},
+		{spec: "prod/deployment/payments:/var/log", want: fileSpec{PodName: "payments", PodNamespace: "prod", File: "/var/log", Workload: "deployment/payments"}},
+		{spec: "prod/payments:/var/log", want: fileSpec{PodName: "payments", PodNamespace: "prod", File: "/var/log"}},
+		{spec: "prod/pods/payments:/var/log", wantErr: "invalid source prod/pods/payments:/var/log"},
+		{spec: "deploy.apps/:/var/log", wantErr: "the deployment has no name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseFileSpec(tt.spec, "default")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseFileSpec() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || *got != tt.want {
+				t.Fatalf("parseFileSpec() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// workloadPod is a pod of the payments deployment in phase, Ready or not.
+func workloadPod(name string, phase corev1.PodPhase, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "payments"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Status:     corev1.PodStatus{Phase: phase, Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}},
+	}
+}
+
+func paymentsDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "payments"}}},
+	}
+}
+
+func TestResolveWorkload(t *testing.T) {
+	other := workloadPod("a-other", corev1.PodRunning, true)
+	other.Labels = map[string]string{"app": "other"}
+	tests := []struct {
+		name     string
+		workload string
+		objects  []runtime.Object
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "ready pod",
+			workload: "deployment/payments",
+			objects: []runtime.Object{paymentsDeployment(), other,
+				workloadPod("payments-a", corev1.PodPending, false), workloadPod("payments-b", corev1.PodRunning, false),
+				workloadPod("payments-c", corev1.PodRunning, true), workloadPod("payments-d", corev1.PodRunning, true)},
+			want: "payments-c",
+		},
+		{
+			name:     "no ready pod",
+			workload: "deployment/payments",
+			objects: []runtime.Object{paymentsDeployment(),
+				workloadPod("payments-a", corev1.PodPending, false), workloadPod("payments-b", corev1.PodRunning, false)},
+			wantErr: "deployment default/payments has no Running and Ready pod to copy from: payments-a (Pending), payments-b (Running, not ready)",
+		},
+		{
+			name:     "no pods",
+			workload: "deployment/payments",
+			objects:  []runtime.Object{paymentsDeployment(), other},
+			wantErr:  "deployment default/payments has no pods",
+		},
+		{
+			name:     "job",
+			workload: "job/payments",
+			objects: []runtime.Object{&batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Name: "payments", Namespace: "default"},
+				Spec:       batchv1.JobSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "payments"}}},
+			}, workloadPod("payments-x", corev1.PodRunning, true)},
+			want: "payments-x",
+		},
+		{
+			name:     "not found",
+			workload: "statefulset/payments",
+			objects:  []runtime.Object{paymentsDeployment()},
+			wantErr:  "statefulset default/payments not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newRunOptions()
+			o.Clientset = fake.NewSimpleClientset(tt.objects...)
+			spec := &fileSpec{PodName: "payments", PodNamespace: "default", File: "/var/log", Workload: tt.workload}
+
+			err := o.resolveWorkload(context.Background(), spec)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("resolveWorkload() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || spec.PodName != tt.want {
+				t.Fatalf("resolveWorkload() = %q, %v, want %q", spec.PodName, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyFromWorkload(t *testing.T) {
+	executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": contentStr}).Bytes()}
+	o := newRunOptions()
+	o.Clientset = fake.NewSimpleClientset(paymentsDeployment(),
+		workloadPod("payments-a", corev1.PodRunning, false), workloadPod("payments-b", corev1.PodRunning, true))
+	o.executor = executor
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "deploy.apps/payments:/var/log/app.log", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	assertFileContent(t, filepath.Join(dest, "app.log"), contentStr)
+	assertContains(t, out.String(), "from payments-b:/var/log/app.log (deployment/payments) to ")
+}
+
+func TestCopyFromNamespaceNamedLikeKind(t *testing.T) {
+	executor := &fakeExecutor{stdout: createTestTar(t, map[string]string{"app.log": contentStr}).Bytes()}
+	o := newRunOptions()
+	pod := workloadPod("payments", corev1.PodRunning, true)
+	pod.Namespace = "deploy"
+	o.Clientset = fake.NewSimpleClientset(paymentsDeployment(), pod)
+	o.executor = executor
+	var out bytes.Buffer
+	o.IOStreams.Out = &out
+	dest := mustTempDir(t)
+
+	if err := o.RunWithArgs(context.Background(), "deploy/payments:/var/log/app.log", dest); err != nil {
+		t.Fatalf("RunWithArgs() error = %v", err)
+	}
+	assertFileContent(t, filepath.Join(dest, "app.log"), contentStr)
+	if strings.Contains(out.String(), "deployment/payments") {
+		t.Errorf("copied from the deployment instead of the pod deploy/payments: %s", out.String())
+	}
+}
@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"archive/tar"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// xattrsSupported is set where --xattrs can set the extended attributes of
+// the extracted files, swapped in tests.
+var xattrsSupported = runtime.GOOS == "linux"
+
+// The PAX records tar --xattrs --acls writes an extended attribute of an
+// entry to, and its access and default ACLs in their text form.
+const (
+	paxXattrPrefix = "SCHILY.xattr."
+	paxACLAccess   = "SCHILY.acl.access"
+	paxACLDefault  = "SCHILY.acl.default"
+)
+
+// aclXattrs are the extended attributes Linux keeps the ACLs of a file in.
+var aclXattrs = map[string]string{
+	paxACLAccess:  "system.posix_acl_access",
+	paxACLDefault: "system.posix_acl_default",
+}
+
+// tarXattrArgs are the options of the tar of a copy archiving the extended
+// attributes and ACLs of its entries with --xattrs.
+func (o *CopyOptions) tarXattrArgs() []string {
+	if !o.Xattrs {
+		return nil
+	}
+	return []string{"--xattrs", "--acls"}
+}
+
+// applyXattrs sets the extended attributes and ACLs of header on targetAbs,
+// warning about each one that can't be, such as the security.capability of a
+// copy that is not run as root, or a user attribute on a filesystem without
+// them.
+func (o *CopyOptions) applyXattrs(targetAbs string, header *tar.Header) {
+	if !o.Xattrs {
+		return
+	}
+	keys := make([]string, 0, len(header.PAXRecords))
+	for k := range header.PAXRecords {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		v := header.PAXRecords[k]
+		name, value := strings.TrimPrefix(k, paxXattrPrefix), []byte(v)
+		switch {
+		case strings.HasPrefix(k, paxXattrPrefix):
+		case aclXattrs[k] != "" && v != "":
+			acl, err := encodeACL(v)
+			if err != nil {
+				o.warnings.warn(warnXattr, "could not set the ACL of %s: %v", targetAbs, err)
+				continue
+			}
+			name, value = aclXattrs[k], acl
+		default:
+			continue
+		}
+		if err := setXattr(targetAbs, name, value); err != nil {
+			o.warnings.warn(warnXattr, "could not set %s on %s: %v", name, targetAbs, err)
+		}
+	}
+}
+
+// The tags of the entries of an ACL in its extended attribute, and the id of
+// those without a qualifier.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclUndefinedID  = 0xffffffff
+	aclXattrVersion = 2
+)
+
+// aclEntry is an entry of an ACL, as its extended attribute holds it.
+type aclEntry struct {
+	tag, perm uint16
+	id        uint32
+}
+
+// encodeACL turns the text of an ACL, as tar --acls archives it, such as
+// user::rw-,user:1000:r--,group::r--,mask::r--,other::r--, into the value of
+// its extended attribute. A named entry is given the numeric id that follows
+// its permissions, or its qualifier when that is a number: the names are
+// those of the container.
+func encodeACL(text string) ([]byte, error) {
+	var entries []aclEntry
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		field, _, _ = strings.Cut(field, "#")
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("malformed ACL entry %q", field)
+		}
+		e := aclEntry{id: aclUndefinedID}
+		named := parts[1] != ""
+		switch {
+		case parts[0] == "user" || parts[0] == "u":
+			e.tag = aclUserObj
+			if named {
+				e.tag = aclUser
+			}
+		case parts[0] == "group" || parts[0] == "g":
+			e.tag = aclGroupObj
+			if named {
+				e.tag = aclGroup
+			}
+		case (parts[0] == "mask" || parts[0] == "m") && !named:
+			e.tag = aclMask
+		case (parts[0] == "other" || parts[0] == "o") && !named:
+			e.tag = aclOther
+		default:
+			return nil, fmt.Errorf("malformed ACL entry %q", field)
+		}
+		for _, c := range parts[2] {
+			switch c {
+			case 'r':
+				e.perm |= 4
+			case 'w':
+				e.perm |= 2
+			case 'x':
+				e.perm |= 1
+			case '-':
+			default:
+				return nil, fmt.Errorf("malformed ACL entry %q", field)
+			}
+		}
+		if named {
+			id := parts[1]
+			if len(parts) == 4 {
+				id = parts[3]
+			}
+			n, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s of the ACL has no numeric id", parts[0], parts[1])
+			}
+			e.id = uint32(n)
+		}
+		entries = append(entries, e)
+	}
+	// the kernel wants them by tag and id
+	slices.SortFunc(entries, func(a, b aclEntry) int {
+		return cmp.Or(cmp.Compare(a.tag, b.tag), cmp.Compare(a.id, b.id))
+	})
+	value := binary.LittleEndian.AppendUint32(nil, aclXattrVersion)
+	for _, e := range entries {
+		value = binary.LittleEndian.AppendUint16(value, e.tag)
+		value = binary.LittleEndian.AppendUint16(value, e.perm)
+		value = binary.LittleEndian.AppendUint32(value, e.id)
+	}
+	return value, nil
+}
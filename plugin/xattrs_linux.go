@@ -0,0 +1,9 @@
+package plugin
+
+import "golang.org/x/sys/unix"
+
+// setXattr sets the extended attribute name of path, not following a
+// symlink.
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
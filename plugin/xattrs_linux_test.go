@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractXattrs(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := "ELF"
+	header := &tar.Header{
+		Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, Size: int64(len(content)), Format: tar.FormatPAX,
+		PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value", "SCHILY.xattr.bogus.test": "x"},
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		t.Fatalf(errWriteTarHeaderForFmt, header.Name, err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatalf(errWriteTarContentForFmt, header.Name, err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf(errCloseTarWriterFmt, err)
+	}
+	o := newRunOptions()
+	o.Xattrs = true
+	var stderr bytes.Buffer
+	o.IOStreams.ErrOut = &stderr
+	dest := mustTempDir(t)
+
+	if _, err := o.extractTar(context.Background(), &buf, dest, "bin"); err != nil {
+		t.Fatalf(errExtractTar, err)
+	}
+	path := filepath.Join(dest, "bin", "tool")
+	assertFileContent(t, path, content)
+	value := make([]byte, 64)
+	n, err := unix.Getxattr(path, "user.test", value)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("the filesystem of the temporary directory has no user attributes")
+	}
+	if err != nil || string(value[:n]) != "value" {
+		t.Errorf("user.test = %q, %v, want value", value[:n], err)
+	}
+	if want := "Warning: could not set bogus.test on " + path; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr = %q, want %q", stderr.String(), want)
+	}
+}
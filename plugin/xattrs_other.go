@@ -0,0 +1,10 @@
+//go:build !linux
+
+package plugin
+
+import "errors"
+
+// setXattr fails, --xattrs being refused on this platform.
+func setXattr(string, string, []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	restclient "k8s.io/client-go/rest"
+)
+
+func TestValidateXattrs(t *testing.T) {
+	tests := []struct {
+		name      string
+		supported bool
+		chunked   bool
+		wantErr   string
+	}{
+		{name: "linux", supported: true},
+		{name: "elsewhere", wantErr: "--xattrs is only supported on linux"},
+		{name: "chunked", supported: true, chunked: true, wantErr: "--xattrs can't be used with --chunked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := xattrsSupported
+			xattrsSupported = tt.supported
+			t.Cleanup(func() { xattrsSupported = saved })
+			o := newFakePodCopyOptions(nil)
+			o.ClientConfig = &restclient.Config{}
+			o.ChunkSize = defaultChunkSize
+			o.Xattrs, o.Chunked = true, tt.chunked
+			err := o.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestXattrsTarCommand(t *testing.T) {
+	o := &CopyOptions{Xattrs: true, Exclude: []string{"*.gz"}}
+	want := []string{"tar", "cf", "-", "-C", "/var", "--xattrs", "--acls", "--exclude=*.gz", "--", "log"}
+	if got := o.tarCreateCommand("/var", []string{"log"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("tarCreateCommand() = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeACL(t *testing.T) {
+	entry := func(tag, perm uint16, id uint32) []byte {
+		b := binary.LittleEndian.AppendUint16(nil, tag)
+		b = binary.LittleEndian.AppendUint16(b, perm)
+		return binary.LittleEndian.AppendUint32(b, id)
+	}
+	header := binary.LittleEndian.AppendUint32(nil, aclXattrVersion)
+	tests := []struct {
+		name    string
+		text    string
+		want    [][]byte
+		wantErr string
+	}{
+		{
+			name: "minimal",
+			text: "user::rw-,group::r--,other::r--",
+			want: [][]byte{entry(aclUserObj, 6, aclUndefinedID), entry(aclGroupObj, 4, aclUndefinedID), entry(aclOther, 4, aclUndefinedID)},
+		},
+		{
+			name: "named entries out of order",
+			text: "user::rwx,group::r-x,other::---,mask::r-x,user:1001:r--,user:app:rw-:1000\tgroup:0:r-x #effective:r-x",
+			want: [][]byte{
+				entry(aclUserObj, 7, aclUndefinedID), entry(aclUser, 6, 1000), entry(aclUser, 4, 1001),
+				entry(aclGroupObj, 5, aclUndefinedID), entry(aclGroup, 5, 0), entry(aclMask, 5, aclUndefinedID),
+				entry(aclOther, 0, aclUndefinedID),
+			},
+		},
+		{name: "named without an id", text: "user::rw-,user:app:r--", wantErr: "user app of the ACL has no numeric id"},
+		{name: "named mask", text: "mask:1000:r--", wantErr: `malformed ACL entry "mask:1000:r--"`},
+		{name: "bad permission", text: "other::rwz", wantErr: `malformed ACL entry "other::rwz"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeACL(strings.ReplaceAll(tt.text, "\t", "\n"))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("encodeACL() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := header
+			for _, e := range tt.want {
+				want = append(want, e...)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("encodeACL() = %x, want %x", got, want)
+			}
+		})
+	}
+}
@@ -25,13 +25,80 @@ func main() {
 	cmd.Flags().BoolVar(&server.AuditFullTraceLog, "audit-trace", false, "if set all keystrokes will be logged")
 	cmd.Flags().BoolVar(&server.SysDebugLog, "sys-debug", false, "if set more system logs will be produces")
 	cmd.Flags().StringArrayVar(&server.ByPassedUsers, "bypass-user", []string{}, "allow user to bypass webhook restriction")
+	cmd.Flags().StringArrayVar(&server.ByPassedUIDs, "bypass-uid", []string{}, "allow the user with this UID to bypass webhook restriction")
 	cmd.Flags().StringVar(&server.SecretSauce, "bypass-shared-key", "", "shared key between apiservice and validatingwebhook")
 	cmd.Flags().StringArrayVar(&deprByPassedUsers, "by-pass-user", nil, "allow user to bypass webhook restriction")
 	cmd.Flags().StringVar(&deprSecretSauce, "by-pass-shared-key", "", "shared key between apiservice and validatingwebhook")
 	_ = cmd.Flags().MarkDeprecated("by-pass-user", "use --bypass-user instead")
 	_ = cmd.Flags().MarkDeprecated("by-pass-shared-key", "use --bypass-shared-key instead")
+	cmd.Flags().StringVar(&server.KeyringFile, "keyring-file", "", "mounted secret with the keys the apiservice signs the shared key with, replaces --bypass-shared-key and is reloaded when it changes")
+	cmd.Flags().DurationVar(&server.KeyringReloadInterval, "keyring-reload-interval", server.KeyringReloadInterval, "how often the keyring file is checked for changes")
 	cmd.Flags().IntVar(&server.MaxStokesPerLine, "max-strokes-per-line", 0, "set how much keystores can be held in the async audit before flush")
+	cmd.Flags().IntVar(&server.MaxLinesPerSession, "max-lines-per-session", 0, "lines of a session audited in full, after it only every --sample-every-th line is (0 never samples)")
+	cmd.Flags().IntVar(&server.SampleEvery, "sample-every", server.DefaultSampleEvery, "sampling rate of the lines past --max-lines-per-session")
+	cmd.Flags().StringVar(&server.SessionLimitsFile, "session-limits-file", "", "file with per-namespace overrides of the keystroke limits, reloaded when it changes, a session keeps the limits it started with")
+	cmd.Flags().DurationVar(&server.SessionLimitsReloadInterval, "session-limits-reload-interval", server.SessionLimitsReloadInterval, "how often the session limits file is checked for changes")
+	cmd.Flags().IntVar(&server.MaxCommandArgs, "max-command-args", server.DefaultMaxCommandArgs, "maximum number of command elements accepted in an exec request")
+	cmd.Flags().IntVar(&server.MaxCommandBytes, "max-command-bytes", server.DefaultMaxCommandBytes, "maximum total size in bytes of the command of an exec request")
+	cmd.Flags().DurationVar(&server.SessionIdleTimeout, "session-idle-timeout", 0, "end a session after this long without traffic (0 disables)")
+	cmd.Flags().DurationVar(&server.SessionMaxDuration, "session-max-duration", 0, "end a session this long after it started (0 disables)")
+	cmd.Flags().DurationVar(&server.SessionHeartbeatInterval, "session-heartbeat-interval", 0, "emit a session_heartbeat audit event at this interval while a session is open (0 disables)")
+	cmd.Flags().DurationVar(&server.SessionStallThreshold, "session-stall-threshold", 0, "count a stall of a session each time no byte goes either way for this long while it streams (0 disables)")
+	cmd.Flags().IntVar(&server.AuditShards, "audit-shards", server.DefaultAuditShards, "number of workers the async audit pipeline spreads sessions over, events of one session are always kept in order")
+	cmd.Flags().IntVar(&server.AuditSessionBuffer, "audit-session-buffer", server.DefaultAuditSessionBuffer, "bytes of client data a session may hold for the audit workers, beyond that data is left out of the audit and an audit_gap event is written")
+	cmd.Flags().Int64Var(&server.WSMaxMessageSize, "ws-max-message-size", server.DefaultWSMaxMessageSize, "largest websocket message in bytes either side of a recorded session may send, a session going over it is closed with status 1009")
+	cmd.Flags().StringVar(&server.IdentityMapFile, "identity-map-file", "", "file on a persistent volume keeping the last UID of every username, an identity_uid_changed audit event is written when a username comes back with another UID")
+	cmd.Flags().StringVar(&server.ImpersonatorExtra, "impersonator-extra", server.ImpersonatorExtra, "user extra naming who impersonates the user, recorded with the session and announced in the X-Rexec-Identity header (empty turns it off)")
+	cmd.Flags().IntVar(&server.IdentityMapSize, "identity-map-size", server.DefaultIdentityMapSize, "number of usernames kept in the identity map, the least recently seen are evicted")
+	cmd.Flags().BoolVar(&server.AdminAuditFailOpen, "admin-audit-fail-open", false, "apply administrative actions such as reloads even when their admin audit event can't be queued, by default they are refused")
+	cmd.Flags().DurationVar(&server.AdminAuditTimeout, "admin-audit-timeout", server.AdminAuditTimeout, "how long an admin audit event waits for the audit pipeline before the action is refused")
+	cmd.Flags().StringArrayVar(&server.AuditSinkStaleness, "audit-sink-staleness", []string{}, "NAME=DURATION, mark the audit sink stale while its oldest undelivered event is older than DURATION")
+	cmd.Flags().StringArrayVar(&server.AuditCriticalSinks, "audit-critical-sink", []string{}, "fail /readyz while this audit sink is stale")
+	cmd.Flags().StringVar(&server.AuditFailClosed, "audit-fail-closed", "", "strict refuses new sessions with a 503 while the audit pipeline is unhealthy, strictest also terminates the running sessions once it stayed unhealthy for --audit-fail-closed-grace (default unset, sessions run regardless)")
+	cmd.Flags().IntVar(&server.AuditFailClosedQueue, "audit-fail-closed-queue", server.DefaultAuditFailClosedQueue, "captured items that may wait for the audit workers before --audit-fail-closed counts the audit pipeline as unhealthy")
+	cmd.Flags().DurationVar(&server.AuditFailClosedGrace, "audit-fail-closed-grace", server.AuditFailClosedGrace, "how long the audit pipeline may stay unhealthy before --audit-fail-closed strictest terminates the running sessions")
+	cmd.Flags().StringVar(&server.AuditFormat, "audit-format", server.AuditFormat, "legacy writes only the flat audit lines as they were before the v2 events, dual also writes the structured v2 event of every audit occurrence next to its legacy line")
+	cmd.Flags().StringVar(&server.AuditDualUntil, "audit-dual-until", "", "RFC 3339 time the dual audit format ends at, from then on only the v2 events are written (default unset, both are written)")
+	cmd.Flags().StringArrayVar(&server.AuditLegacyOff, "audit-legacy-off", []string{}, "write only the v2 events to this audit sink, once its consumers migrated off the legacy lines (needs --audit-format dual)")
+	cmd.Flags().DurationVar(&server.AuditLagCheckInterval, "audit-lag-check-interval", server.AuditLagCheckInterval, "how often the audit sinks are checked for staleness")
 	cmd.Flags().IntVar(&server.MetricsPort, "metrics-port", 9090, "port used to expose prometheus metrics endpoint")
+	cmd.Flags().StringVar(&server.ClusterName, "cluster-name", "", "name of the cluster, recorded in the proxy_start and proxy_config audit events")
+	cmd.Flags().StringArrayVar(&server.CheckpointGroups, "checkpoint-allow-group", []string{}, "allow members of this group to checkpoint containers through rexec, nobody may while unset")
+	cmd.Flags().StringVar(&server.DenialMessagesFile, "denial-messages-file", "", "file with the contact and message template of denials per rule, written into the terminal of a denied tty session")
+	cmd.Flags().StringVar(&server.AuditWebhookURL, "audit-webhook-url", "", "https URL the audit events of recorded sessions are POSTed to in batches, as a sink next to the audit log")
+	cmd.Flags().StringVar(&server.AuditWebhookCAFile, "audit-webhook-ca-file", "", "CA the certificate of the audit webhook is checked against (default system roots)")
+	cmd.Flags().StringVar(&server.AuditWebhookCertFile, "audit-webhook-cert-file", "", "client certificate presented to the audit webhook")
+	cmd.Flags().StringVar(&server.AuditWebhookKeyFile, "audit-webhook-key-file", "", "key of the client certificate presented to the audit webhook")
+	cmd.Flags().DurationVar(&server.AuditWebhookTimeout, "audit-webhook-timeout", server.AuditWebhookTimeout, "how long a request to the audit webhook may take")
+	cmd.Flags().StringVar(&server.AuditWebhookCompression, "audit-webhook-compression", server.AuditWebhookCompression, "Content-Encoding of the batches sent to the audit webhook: zstd, gzip or identity, falling back to what the webhook takes")
+	cmd.Flags().IntVar(&server.AuditCompressionLevel, "audit-compression-level", server.AuditCompressionLevel, "compression level of audit batches and spool segments, 1 (fastest) to 19 (smallest), at most 9 for gzip")
+	cmd.Flags().StringVar(&server.AuditSpoolDir, "audit-spool-dir", "", "directory the batches the audit webhook did not take are spooled to until it does (default unset, they are dropped after retries)")
+	cmd.Flags().StringVar(&server.AuditSpoolCompression, "audit-spool-compression", server.AuditSpoolCompression, "codec new audit spool segments are written with: zstd, gzip or identity")
+	cmd.Flags().Int64Var(&server.AuditSpoolMaxBytes, "audit-spool-max-bytes", server.AuditSpoolMaxBytes, "size the audit spool may grow to, batches beyond it are retried and dropped")
+	cmd.Flags().DurationVar(&server.AuditSpoolReplayInterval, "audit-spool-replay-interval", server.AuditSpoolReplayInterval, "how often the audit spool is replayed while no new batch does it")
+	cmd.Flags().StringVar(&server.AuthzWebhookURL, "authz-webhook-url", "", "https URL of an external policy decision point asked about every exec request, with the constraints it answers applied to the session")
+	cmd.Flags().StringVar(&server.AuthzWebhookCAFile, "authz-webhook-ca-file", "", "CA the certificate of the authorization webhook is checked against (default system roots)")
+	cmd.Flags().StringVar(&server.AuthzWebhookCertFile, "authz-webhook-cert-file", "", "client certificate presented to the authorization webhook")
+	cmd.Flags().StringVar(&server.AuthzWebhookKeyFile, "authz-webhook-key-file", "", "key of the client certificate presented to the authorization webhook")
+	cmd.Flags().DurationVar(&server.AuthzWebhookTimeout, "authz-webhook-timeout", server.AuthzWebhookTimeout, "how long the authorization webhook may take to decide")
+	cmd.Flags().BoolVar(&server.AuthzWebhookFailOpen, "authz-webhook-fail-open", false, "allow requests the authorization webhook did not decide, by default they are denied")
+	cmd.Flags().DurationVar(&server.AuthzWebhookCacheTTL, "authz-webhook-cache-ttl", server.AuthzWebhookCacheTTL, "how long a decision of the authorization webhook is reused for an identical request (0 disables)")
+	cmd.Flags().StringVar(&server.ChangeIDRulesFile, "change-id-rules-file", "", "file with the pattern of the change ID, sent in the X-Rexec-Change-Id header, required per namespace, and whether to verify it with the change ID webhook")
+	cmd.Flags().StringVar(&server.ChangeIDWebhookURL, "change-id-webhook-url", "", "https URL of the change management webhook asked whether a change ID is valid for the user")
+	cmd.Flags().StringVar(&server.ChangeIDWebhookCAFile, "change-id-webhook-ca-file", "", "CA the certificate of the change ID webhook is checked against (default system roots)")
+	cmd.Flags().StringVar(&server.ChangeIDWebhookCertFile, "change-id-webhook-cert-file", "", "client certificate presented to the change ID webhook")
+	cmd.Flags().StringVar(&server.ChangeIDWebhookKeyFile, "change-id-webhook-key-file", "", "key of the client certificate presented to the change ID webhook")
+	cmd.Flags().DurationVar(&server.ChangeIDWebhookTimeout, "change-id-webhook-timeout", server.ChangeIDWebhookTimeout, "how long the change ID webhook may take to answer")
+	cmd.Flags().BoolVar(&server.ChangeIDWebhookFailOpen, "change-id-webhook-fail-open", false, "accept change IDs the change ID webhook did not verify, by default their sessions are denied")
+	cmd.Flags().DurationVar(&server.ChangeIDWebhookCacheTTL, "change-id-webhook-cache-ttl", server.ChangeIDWebhookCacheTTL, "how long a verdict of the change ID webhook is reused for the same change ID and user (0 disables)")
+	cmd.Flags().StringVar(&server.RecordingsDir, "recordings-dir", "", "directory tty sessions over websocket are recorded into, as asciicast <namespace>/<session>.cast, and whose retention is enforced (default unset, nothing recorded)")
+	cmd.Flags().DurationVar(&server.RecordingsMaxAge, "recordings-max-age", 0, "delete recordings last written longer ago than this, overridden per namespace by recording_max_age_days of the session limits file (0 keeps them)")
+	cmd.Flags().Int64Var(&server.RecordingsMaxBytes, "recordings-max-bytes", 0, "delete the oldest recordings while all of them together are larger than this (0 keeps them)")
+	cmd.Flags().DurationVar(&server.RecordingsRetentionInterval, "recordings-retention-interval", server.RecordingsRetentionInterval, "how often the retention of the recordings is enforced")
+	cmd.Flags().BoolVar(&server.RecordingsSecureDelete, "recordings-secure-delete", false, "overwrite recordings with zeros before deleting them")
+	cmd.Flags().DurationVar(&server.StartupDeadline, "startup-deadline", server.StartupDeadline, "exit when the token, keyring, policy files and audit pipeline are not all loaded this long after startup (0 waits forever)")
+	cmd.Flags().DurationVar(&server.PreReadyQueueTimeout, "pre-ready-queue-timeout", 0, "hold exec requests arriving before the server is ready for up to this long instead of answering 503 right away")
+	cmd.Flags().IntVar(&server.PreReadyQueueSize, "pre-ready-queue-size", server.PreReadyQueueSize, "how many exec requests --pre-ready-queue-timeout holds at once")
 	cmd.Flags().StringVar(&server.ClusterDomain, "cluster-domain", "", "cluster DNS domain (default: detect or cluster.local)")
 	err := cmd.Execute()
 	if err != nil {
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// AdminAuditFailOpen lets an administrative action go ahead when its admin
+// audit event can't be queued. By default the action is refused.
+var AdminAuditFailOpen bool
+
+// AdminAuditTimeout is how long an admin event waits for the audit pipeline
+// before the pipeline is taken as wedged.
+var AdminAuditTimeout = 5 * time.Second
+
+const (
+	// adminSession is the session admin events are numbered under, so the
+	// admin actions of a replica form one sequence without gaps.
+	adminSession = "admin"
+	// adminActor performs the actions the server takes on its own, such as
+	// reloading a changed file.
+	adminActor = "system:rexec"
+)
+
+// adminAction is a change to the running configuration of the server. Before
+// and After identify the configuration on either side, as configHash values.
+type adminAction struct {
+	Action string
+	Actor  string
+	Target string
+	Before string
+	After  string
+	// Reason is why the action was taken, if it needs saying.
+	Reason string
+}
+
+// auditAdmin queues the admin event of an action, with failure the reason it
+// did not take effect. Every admin action goes through here exactly once,
+// after its outcome is known and before it is applied. It reports whether the
+// action may be applied: an event that can't be queued within
+// AdminAuditTimeout refuses the action unless AdminAuditFailOpen is set.
+func auditAdmin(a adminAction, failure error) bool {
+	ev := auditEvent{
+		Session:  adminSession,
+		Info:     sessionInfo{User: a.Actor},
+		Event:    "admin",
+		Action:   a.Action,
+		Target:   a.Target,
+		Before:   a.Before,
+		After:    a.After,
+		Outcome:  "success",
+		Reason:   a.Reason,
+		Captured: clk.Now(),
+	}
+	if failure != nil {
+		ev.Outcome, ev.Reason = "failure", failure.Error()
+	}
+	if queueAuditEvent(ev) {
+		adminActionsTotal.WithLabelValues(a.Action, ev.Outcome).Inc()
+		return true
+	}
+	recordError("admin_audit")
+	if AdminAuditFailOpen {
+		adminActionsTotal.WithLabelValues(a.Action, ev.Outcome).Inc()
+		SysLogger.Error().Str("action", a.Action).Str("target", a.Target).Msg("admin action could not be audited, applying it as fail-open is set")
+		return true
+	}
+	adminActionsTotal.WithLabelValues(a.Action, "refused").Inc()
+	SysLogger.Error().Str("action", a.Action).Str("target", a.Target).Msg("refusing admin action, the audit pipeline is not accepting events")
+	return false
+}
+
+// queueAuditEvent puts ev, of a session without a buffer, on the capture
+// channel. It gives up after AdminAuditTimeout and reports whether ev was
+// queued.
+func queueAuditEvent(ev auditEvent) bool {
+	timer := clk.NewTimer(AdminAuditTimeout)
+	defer timer.Stop()
+	select {
+	case asyncAuditChan <- asyncAudit{ctxid: ev.Session, info: ev.Info, event: &ev}:
+		return true
+	case <-timer.C():
+		return false
+	}
+}
+
+// configHash identifies a configuration by its content, empty for none.
+func configHash(raw []byte) string {
+	if raw == nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
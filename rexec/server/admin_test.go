@@ -0,0 +1,191 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// captureAdminEvents takes everything queued on the capture channel, without a
+// pipeline behind it, and returns a function that stops and returns the events.
+func captureAdminEvents(t *testing.T) (stop func() []auditEvent) {
+	t.Helper()
+	oldChan := asyncAuditChan
+	asyncAuditChan = make(chan asyncAudit)
+	var events []auditEvent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for audit := range asyncAuditChan {
+			events = append(events, *audit.event)
+		}
+	}()
+	var once sync.Once
+	stop = func() []auditEvent {
+		once.Do(func() {
+			close(asyncAuditChan)
+			<-done
+		})
+		return events
+	}
+	t.Cleanup(func() {
+		stop()
+		asyncAuditChan = oldChan
+	})
+	return stop
+}
+
+func TestAdminHandlersEmitOneEventPerAction(t *testing.T) {
+	const goodKeys = `{"keys": [{"id": "k2", "secret": "0123456789abcdef-k2"}]}`
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T)
+		change      func(t *testing.T)
+		reload      func()
+		action      string
+		wantOutcome string
+	}{
+		{"keyring success", loadedKeyring, func(t *testing.T) { writeFile(t, KeyringFile, goodKeys) }, reloadKeyring, "keyring_reload", "success"},
+		{"keyring invalid", loadedKeyring, func(t *testing.T) { writeFile(t, KeyringFile, "{not json") }, reloadKeyring, "keyring_reload", "failure"},
+		{"keyring unreadable", loadedKeyring, func(t *testing.T) { removeFile(t, KeyringFile) }, reloadKeyring, "keyring_reload", "failure"},
+		{"limits success", loadedLimits, func(t *testing.T) { writeLimitsFile(t, `{"default": {"max_lines": 20}}`) }, reloadLimits, "session_limits_reload", "success"},
+		{"limits invalid", loadedLimits, func(t *testing.T) { writeLimitsFile(t, `{"default": {"max_lines": -1}}`) }, reloadLimits, "session_limits_reload", "failure"},
+		{"limits unreadable", loadedLimits, func(t *testing.T) { removeFile(t, SessionLimitsFile) }, reloadLimits, "session_limits_reload", "failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFakeClock(t, 0, 0, 0)
+			tt.setup(t)
+			stop := captureAdminEvents(t)
+
+			// an unchanged file is not an action
+			tt.reload()
+			tt.change(t)
+			before := testutil.ToFloat64(adminActionsTotal.WithLabelValues(tt.action, tt.wantOutcome))
+			tt.reload()
+
+			var events, configs []auditEvent
+			for _, ev := range stop() {
+				if ev.Event == "proxy_config" {
+					configs = append(configs, ev)
+					continue
+				}
+				events = append(events, ev)
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d admin events, want exactly 1: %+v", len(events), events)
+			}
+			if wantConfigs := map[string]int{"success": 1, "failure": 0}[tt.wantOutcome]; len(configs) != wantConfigs {
+				t.Fatalf("got %d proxy_config events, want %d", len(configs), wantConfigs)
+			}
+			ev := events[0]
+			if ev.Event != "admin" || ev.Session != adminSession || ev.Info.User != adminActor || ev.Action != tt.action || ev.Outcome != tt.wantOutcome {
+				t.Fatalf("unexpected admin event %+v", ev)
+			}
+			if ev.Before == "" || ev.Before == ev.After {
+				t.Fatalf("the config hashes must show the change, before %q after %q", ev.Before, ev.After)
+			}
+			if (tt.wantOutcome == "failure") != (ev.Reason != "") {
+				t.Fatalf("reason %q for outcome %s", ev.Reason, ev.Outcome)
+			}
+			if got := testutil.ToFloat64(adminActionsTotal.WithLabelValues(tt.action, tt.wantOutcome)) - before; got != 1 {
+				t.Fatalf("admin actions counter delta = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestAdminActionRefusedWhenAuditWedged(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fail-open %v", failOpen), func(t *testing.T) {
+			testRefusedWhenWedged(t, failOpen)
+		})
+	}
+}
+
+func testRefusedWhenWedged(t *testing.T, failOpen bool) {
+	fc := withFakeClock(t, 0, 0, 0)
+	limitsFile(t, `{"default": {"max_lines": 10}}`)
+	oldChan, oldFailOpen := asyncAuditChan, AdminAuditFailOpen
+	t.Cleanup(func() { asyncAuditChan, AdminAuditFailOpen = oldChan, oldFailOpen })
+	// nobody reads the channel
+	asyncAuditChan = make(chan asyncAudit)
+	AdminAuditFailOpen = failOpen
+
+	writeLimitsFile(t, `{"default": {"max_lines": 20}}`)
+	refused := testutil.ToFloat64(adminActionsTotal.WithLabelValues("session_limits_reload", "refused"))
+	done := make(chan struct{})
+	go func() {
+		reloadLimits()
+		close(done)
+	}()
+	eventually(t, "admin audit timer", func() bool { return fc.Waiters() == 1 })
+	fc.Advance(AdminAuditTimeout)
+	if failOpen {
+		// the proxy_config of the applied reload can't be queued either
+		eventually(t, "provenance audit timer", func() bool { return fc.Waiters() == 1 })
+		fc.Advance(AdminAuditTimeout)
+	}
+	<-done
+
+	want, wantRefused := 10, 1.0
+	if failOpen {
+		want, wantRefused = 20, 0
+	}
+	if got := resolveSessionLimits("any").MaxLines; got != want {
+		t.Fatalf("max lines = %d, want %d", got, want)
+	}
+	if got := testutil.ToFloat64(adminActionsTotal.WithLabelValues("session_limits_reload", "refused")) - refused; got != wantRefused {
+		t.Fatalf("refused counter delta = %v, want %v", got, wantRefused)
+	}
+}
+
+func TestAdminEventsAreSequenced(t *testing.T) {
+	sink := &recordingSink{name: "admin"}
+	withAuditSinks(t, sink)
+	stop := runAuditPipeline(t)
+
+	for i := 0; i < 3; i++ {
+		auditAdmin(adminAction{Action: "test", Actor: "alice", Target: "x"}, nil)
+	}
+	stop()
+
+	events := sink.bySession()[adminSession]
+	if len(events) != 3 {
+		t.Fatalf("got %d admin events, want 3", len(events))
+	}
+	for i, ev := range events {
+		if ev.Index != uint64(i+1) {
+			t.Fatalf("admin event %d has index %d", i, ev.Index)
+		}
+	}
+}
+
+func loadedKeyring(t *testing.T) {
+	keyringFile(t, `{"id": "k1", "secret": "0123456789abcdef-k1"}`)
+	restoreKeyring(t)
+	if err := loadKeyring(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadedLimits(t *testing.T) {
+	limitsFile(t, `{"default": {"max_lines": 10}}`)
+}
+
+func writeFile(t *testing.T, path, raw string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func removeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
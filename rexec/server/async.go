@@ -1,23 +1,308 @@
 package server
 
-// asyncAuditor will try to make merged commads out of keystrokes
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// AuditShards is the number of workers the async audit pipeline fans out to.
+// A session always lands on the same shard, so its events stay in order. All
+// audit processing of recorded sessions runs on these workers, the streams
+// only hand their data over through a sessionBuffer.
+var AuditShards int
+
+// auditPool is the set of shards of the running pipeline, nil while there is
+// none.
+var auditPool atomic.Pointer[[]*auditShard]
+
+const (
+	// DefaultAuditShards is used when AuditShards is not set.
+	DefaultAuditShards = 4
+	// auditShardQueue bounds how far a shard may fall behind the capture channel.
+	auditShardQueue = 1024
+	// auditBatchSize bounds how many events a shard hands to its sinks at once.
+	auditBatchSize = 64
+)
+
+// asyncAuditor reads everything captured on asyncAuditChan and hands it to the
+// shard owning the session. The channel is read by this goroutine alone, so
+// each shard receives a session's items in the order they were captured. It
+// returns once the channel is closed and every shard has delivered its backlog.
 func asyncAuditor() {
 	SysLogger.Debug().Msg("starting asyncAuditor")
-	for {
-		audit, ok := <-asyncAuditChan
-		if !ok {
-			SysLogger.Debug().Msg("channel closed, stopping asyncAuditor")
-			break
+	n := AuditShards
+	if n <= 0 {
+		n = DefaultAuditShards
+	}
+	shards := make([]*auditShard, n)
+	var wg sync.WaitGroup
+	for i := range shards {
+		shards[i] = &auditShard{
+			queue: make(chan asyncAudit, auditShardQueue),
+			wake:  make(chan struct{}, 1),
+			index: map[string]uint64{},
+		}
+		wg.Add(1)
+		go shards[i].run(&wg)
+	}
+	auditPool.Store(&shards)
+	auditWorkers.Set(float64(n))
+	// the sinks start out healthy, nothing is undelivered yet
+	startup.markMet(startupAuditSink)
+
+	for audit := range asyncAuditChan {
+		shards[shardFor(audit.ctxid, n)].queue <- audit
+	}
+	SysLogger.Debug().Msg("channel closed, stopping asyncAuditor")
+	for _, s := range shards {
+		close(s.queue)
+	}
+	wg.Wait()
+	auditPool.Store(nil)
+}
+
+func shardFor(ctxid string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(ctxid))
+	return int(h.Sum32() % uint32(n))
+}
+
+// auditShard turns the captured items of its sessions into audit events,
+// numbers them and delivers them to the sinks. It is the only goroutine that
+// touches the sessions it owns, so index needs no locking. Items come from the
+// capture channel or from the buffers of recorded sessions put on the ready
+// list.
+type auditShard struct {
+	queue chan asyncAudit
+	index map[string]uint64
+	// lines and sampled count, per session with sampling, the lines seen and
+	// those left out.
+	lines, sampled map[string]uint64
+	// uploads follow the archives of the upload sessions.
+	uploads map[string]*uploadStream
+
+	// wake is signalled when a buffer is put on the ready list.
+	wake      chan struct{}
+	readyMu   sync.Mutex
+	readyList []*sessionBuffer
+}
+
+// ready puts b on the ready list, it is taken on the next pass of the shard.
+func (s *auditShard) ready(b *sessionBuffer) {
+	s.readyMu.Lock()
+	s.readyList = append(s.readyList, b)
+	s.readyMu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *auditShard) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	queue := s.queue
+	for queue != nil {
+		var batch []auditEvent
+		select {
+		case audit, ok := <-queue:
+			if !ok {
+				// deliver what the buffers still hold before stopping
+				queue = nil
+				break
+			}
+			s.busy(func() { batch = s.drainQueue(s.process(audit, nil)) })
+		case <-s.wake:
+		}
+		s.busy(func() {
+			batch = s.drainBuffers(batch)
+			deliverAudit(batch)
+		})
+	}
+}
+
+// busy accounts the time spent in fn to the worker pool utilisation.
+func (s *auditShard) busy(fn func()) {
+	auditWorkersBusy.Inc()
+	start := clk.Now()
+	fn()
+	auditWorkerBusySeconds.Add(clk.Since(start).Seconds())
+	auditWorkersBusy.Dec()
+}
+
+// drainQueue takes whatever else is already queued, without waiting for more.
+func (s *auditShard) drainQueue(batch []auditEvent) []auditEvent {
+	for len(batch) < auditBatchSize {
+		select {
+		case next, ok := <-s.queue:
+			if !ok {
+				return batch
+			}
+			batch = s.process(next, batch)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// drainBuffers processes the buffers on the ready list, delivering whenever a
+// full batch is reached, and returns the rest.
+func (s *auditShard) drainBuffers(batch []auditEvent) []auditEvent {
+	s.readyMu.Lock()
+	buffers := s.readyList
+	s.readyList = nil
+	s.readyMu.Unlock()
+	for _, b := range buffers {
+		for _, audit := range b.take() {
+			batch = s.process(audit, batch)
+			if len(batch) >= auditBatchSize {
+				deliverAudit(batch)
+				batch = nil
+			}
+		}
+	}
+	return batch
+}
+
+// process appends the events produced by one captured item to batch. Events are
+// numbered here, in queue order, which is the order they were captured in.
+func (s *auditShard) process(audit asyncAudit, batch []auditEvent) []auditEvent {
+	if audit.frames != nil {
+		if audit.info.Upload != "" {
+			return s.processUpload(audit, batch)
+		}
+		for _, payload := range clientKeystrokes(audit.ctxid, audit.info, audit.frames) {
+			batch = s.process(asyncAudit{ctxid: audit.ctxid, info: audit.info, ascii: payload}, batch)
+		}
+		return batch
+	}
+	if audit.event != nil {
+		ev := *audit.event
+		switch ev.Event {
+		case "":
+			auditCommandsTotal.Inc()
+		case "audit_gap":
+			// the line typed before the gap can't be completed, so it ends here
+			commandSync.Lock()
+			ev.Command = string(commandMap[audit.ctxid])
+			commandMap[audit.ctxid] = nil
+			commandSync.Unlock()
+		}
+		if ev.Event == "session_end" {
+			ev.SampledLines = s.sampled[audit.ctxid]
+			if u := s.uploads[audit.ctxid]; u != nil && u.pending() {
+				batch = s.uploadFailed(audit, u, "the session ended before the end of the archive", batch)
+			}
+		}
+		batch = append(batch, s.number(ev))
+		if ev.Event == "audit_gap" && audit.info.Upload != "" {
+			if u := s.upload(audit.ctxid); !u.failed {
+				batch = s.uploadFailed(audit, u, "client data was lost to an audit gap, the rest of the archive is not audited", batch)
+			}
+		}
+		if ev.Event == "session_end" {
+			delete(s.uploads, audit.ctxid)
+			delete(s.index, audit.ctxid)
+			delete(s.lines, audit.ctxid)
+			delete(s.sampled, audit.ctxid)
+			commandSync.Lock()
+			delete(commandMap, audit.ctxid)
+			commandSync.Unlock()
+		}
+		return batch
+	}
+	captured := clk.Now()
+	for _, command := range storeOrFlush(audit) {
+		if s.sampledOut(audit.ctxid, audit.info.Limits) {
+			continue
 		}
-		storeOrFlush(audit)
+		auditCommandsTotal.Inc()
+		batch = append(batch, s.number(auditEvent{Session: audit.ctxid, Info: audit.info, Command: command, Captured: captured}))
+	}
+	return batch
+}
+
+// processUpload appends the events of the entries of an upload whose header
+// came with the client data of audit.
+func (s *auditShard) processUpload(audit asyncAudit, batch []auditEvent) []auditEvent {
+	u := s.upload(audit.ctxid)
+	if u.failed {
+		return batch
+	}
+	entries, err := u.feed(audit.frames)
+	captured := clk.Now()
+	for _, entry := range entries {
+		batch = append(batch, s.number(auditEvent{Session: audit.ctxid, Info: audit.info, Event: "upload_file", Captured: captured, Upload: &entry}))
+	}
+	if err != nil {
+		recordError("upload_parse")
+		batch = s.uploadFailed(audit, u, err.Error(), batch)
+	}
+	return batch
+}
+
+// upload returns the archive of the upload session ctxid.
+func (s *auditShard) upload(ctxid string) *uploadStream {
+	if s.uploads == nil {
+		s.uploads = map[string]*uploadStream{}
+	}
+	u := s.uploads[ctxid]
+	if u == nil {
+		u = newUploadStream()
+		s.uploads[ctxid] = u
+	}
+	return u
+}
+
+// uploadFailed stops following the archive of an upload, appending the event
+// saying why the rest of it is not audited.
+func (s *auditShard) uploadFailed(audit asyncAudit, u *uploadStream, reason string, batch []auditEvent) []auditEvent {
+	u.failed = true
+	return append(batch, s.number(auditEvent{Session: audit.ctxid, Info: audit.info, Event: "upload_unparsed", Captured: clk.Now(), Reason: reason}))
+}
+
+// sampledOut counts a line of the session and reports whether sampling leaves
+// it out: past MaxLines only every SampleEvery-th line is audited.
+func (s *auditShard) sampledOut(ctxid string, limits sessionLimits) bool {
+	if limits.MaxLines <= 0 {
+		return false
+	}
+	if s.lines == nil {
+		s.lines, s.sampled = map[string]uint64{}, map[string]uint64{}
 	}
+	s.lines[ctxid]++
+	n, every := s.lines[ctxid], uint64(max(limits.SampleEvery, 1))
+	if n <= uint64(limits.MaxLines) || (n-uint64(limits.MaxLines))%every == 0 {
+		return false
+	}
+	s.sampled[ctxid]++
+	return true
+}
+
+func (s *auditShard) number(ev auditEvent) auditEvent {
+	s.index[ev.Session]++
+	ev.Index = s.index[ev.Session]
+	return ev
 }
 
 // storeOrFlush will push keystrokes into a byte slice and
-// flush it upen enter or a certain limit
-func storeOrFlush(audit asyncAudit) {
+// flush it upen enter or a certain limit, returning the flushed commands
+func storeOrFlush(audit asyncAudit) []string {
 	auditKeystrokesTotal.Add(float64(len(audit.ascii)))
 
+	maxStrokes := audit.info.Limits.MaxStrokesPerLine
+	if maxStrokes <= 0 {
+		maxStrokes = MaxStokesPerLine
+	}
+	var commands []string
 	for _, ascii := range audit.ascii {
 		switch ascii {
 		case 0:
@@ -30,15 +315,16 @@ func storeOrFlush(audit asyncAudit) {
 			commandSync.Unlock()
 		case 10, 13: // LF (non-tty line input) or CR (tty Enter)
 			commandSync.Lock()
-			logCommand(string(commandMap[audit.ctxid]), audit.info.User, audit.ctxid, audit.info.NameSpace, audit.info.Pod, audit.info.Container, audit.info.ClientIP)
+			commands = append(commands, string(commandMap[audit.ctxid]))
 			commandMap[audit.ctxid] = nil
 			commandSync.Unlock()
 		default:
 			commandSync.Lock()
 			// to prevent oom kills by shoving too much input into one line
-			// we flush after the amount of strokes set in MaxStokesPerLine
-			if len(commandMap[audit.ctxid]) > MaxStokesPerLine {
-				logCommand(string(commandMap[audit.ctxid]), audit.info.User, audit.ctxid, audit.info.NameSpace, audit.info.Pod, audit.info.Container, audit.info.ClientIP)
+			// we flush after the amount of strokes set in MaxStokesPerLine,
+			// or the limit of the session's namespace
+			if len(commandMap[audit.ctxid]) > maxStrokes {
+				commands = append(commands, string(commandMap[audit.ctxid]))
 				commandMap[audit.ctxid] = nil
 			}
 			commandMap[audit.ctxid] = append(commandMap[audit.ctxid], ascii)
@@ -46,10 +332,180 @@ func storeOrFlush(audit asyncAudit) {
 		}
 
 	}
+	return commands
+}
+
+// enqueueSessionEvent queues a session event (or, with command set, a command
+// that did not come from keystrokes) behind everything already captured for
+// the session.
+func enqueueSessionEvent(ctxid string, info sessionInfo, event, command string) {
+	enqueueEvent(sessionBufferFor(ctxid), auditEvent{
+		Session: ctxid, Info: info, Event: event, Command: command, Captured: clk.Now(),
+	})
+}
+
+// enqueueEvent puts ev into the session's buffer, or on the capture channel for
+// a session without one.
+func enqueueEvent(buffer *sessionBuffer, ev auditEvent) {
+	if buffer != nil {
+		buffer.pushEvent(ev)
+		return
+	}
+	asyncAuditChan <- asyncAudit{ctxid: ev.Session, info: ev.Info, event: &ev}
+}
+
+// clientKeystrokes parses what the client wrote to the apiserver into websocket
+// frames and returns the payloads carrying terminal input.
+func clientKeystrokes(ctxid string, info sessionInfo, frameBytes []byte) [][]byte {
+	var payloads [][]byte
+	// a single write operation may contain multiple combined frames. Continue
+	// parsing until the entire buffer has been processed to ensure no keystrokes
+	// are omitted from the audit log.
+	for len(frameBytes) > 0 {
+		parsed, consumed, err := parseWebSocketFrame(frameBytes)
+		if err != nil {
+			recordError("ws_parse")
+			SysLogger.Error().Err(err).Msg("failed to parse ws frame")
+			return payloads
+		}
+		frameBytes = frameBytes[consumed:]
+
+		// websocket opcodes we might see: 0x0 continuation 0x1 text 0x2 binary
+		// 0x8 close 0x9 ping 0xA pong
+		// kubectl exec sends terminal input as 0x2 binary only that goes to async audit
+		if parsed.Opcode != 0x2 {
+			continue
+		}
+		// the terminal sizes of the resize channel are passed on like any
+		// frame but are no keystrokes, trace audits them for session replays
+		if len(parsed.Payload) > 0 && parsed.Payload[0] == channelResize {
+			if auditLogger.GetLevel() == zerolog.TraceLevel {
+				logTraceResize(ctxid, info, parsed.Payload[1:])
+			}
+			continue
+		}
+
+		if auditLogger.GetLevel() == zerolog.TraceLevel {
+			logTraceStroke(ctxid, info, parsed.Payload)
+		}
+		payloads = append(payloads, parsed.Payload)
+	}
+	return payloads
+}
+
+func logTraceStroke(ctxid string, info sessionInfo, payload []byte) {
+	stroke, err := hex.DecodeString(fmt.Sprintf("%x", payload))
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to parse payload")
+		return
+	}
+	auditLogger.Trace().
+		Str("user", info.User).
+		Str("session", ctxid).
+		Str("namespace", info.NameSpace).
+		Str("pod", info.Pod).
+		Str("container", info.Container).
+		Str("client_ip", info.ClientIP).
+		// tty payload has nul bytes strip for trace log
+		Str("stroke", strings.ReplaceAll(string(stroke), "\u0000", "")).
+		Msg("")
+}
+
+func logTraceResize(ctxid string, info sessionInfo, payload []byte) {
+	var size terminalSize
+	if err := json.Unmarshal(payload, &size); err != nil {
+		SysLogger.Error().Err(err).Str("session", ctxid).Msg("failed to parse terminal size")
+		return
+	}
+	auditLogger.Trace().
+		Str("user", info.User).
+		Str("session", ctxid).
+		Str("namespace", info.NameSpace).
+		Str("pod", info.Pod).
+		Str("container", info.Container).
+		Str("client_ip", info.ClientIP).
+		Str("event", "resize").
+		Int("width", size.Width).
+		Int("height", size.Height).
+		Msg("")
 }
 
+// asyncAudit is one item on the capture channel or in a session buffer: the
+// keystrokes of a client frame, the raw frames the client wrote, or an already
+// formed event.
 type asyncAudit struct {
-	ctxid string
-	info  sessionInfo
-	ascii []byte
+	ctxid  string
+	info   sessionInfo
+	ascii  []byte
+	frames []byte
+	event  *auditEvent
+}
+
+// auditEvent is an audit record of a recorded session as handed to the sinks.
+// Index counts the events of the session from 1 without gaps, so consumers can
+// detect both reordering and loss.
+type auditEvent struct {
+	Session  string
+	Index    uint64
+	Info     sessionInfo
+	Event    string
+	Command  string
+	Captured time.Time
+	// LostBytes and Gap describe an audit_gap: the client data dropped from the
+	// audit and for how long the session's buffer was overrun. Command holds
+	// the line typed before the gap.
+	LostBytes int64
+	Gap       time.Duration
+	// Limit, LimitBytes, Direction and Size describe a session_limit_exceeded:
+	// the limit, its value, and the message that went over it.
+	Limit      string
+	LimitBytes int64
+	Direction  string
+	Size       uint64
+	// PreviousUID is the UID the user was last seen with, for an
+	// identity_uid_changed.
+	PreviousUID string
+	// SampledLines counts, on session_end, the lines sampling left out.
+	SampledLines uint64
+	// Action, Target, Before, After, Outcome and Reason describe an admin
+	// event: what was done to what, the config hashes on either side, and
+	// why it failed if it did. Info.User is who did it.
+	Action  string
+	Target  string
+	Before  string
+	After   string
+	Outcome string
+	Reason  string
+	// Provenance is the build and configuration of a proxy_start or
+	// proxy_config.
+	Provenance *provenance
+	// Node and Archives are, for a container_checkpoint, the node of the pod
+	// and the checkpoint archives the kubelet wrote on it.
+	Node     string
+	Archives []string
+	// ClientBytes and UpstreamBytes count, on session_end, what the client
+	// sent and was sent. Reason says why the session ended there.
+	ClientBytes   int64
+	UpstreamBytes int64
+	// Sink, Lag and Threshold describe an audit_sink_stale or
+	// audit_sink_recovered: the sink, the age of its oldest undelivered event
+	// and the staleness threshold it crossed.
+	Sink      string
+	Lag       time.Duration
+	Threshold time.Duration
+	// AuthzSource and Latency describe an authz_decision: where the decision
+	// came from and how long the webhook took. Outcome is the decision,
+	// Reason its reason and Info.Constraints the constraints it allowed.
+	AuthzSource string
+	Latency     time.Duration
+	// Timing is, on session_end, where the time of the session went.
+	Timing *sessionTiming
+	// Unheld counts, on an audit_pipeline_recovered, the refusals of the
+	// outage not held for the audit. Reason is why the pipeline was
+	// unavailable and Gap for how long.
+	Unheld int
+	// Upload is, for an upload_file, the entry of the archive. Reason says,
+	// for an upload_unparsed, why the rest of the archive is not audited.
+	// Info.Upload is the directory it is extracted into.
+	Upload *uploadEntry
 }
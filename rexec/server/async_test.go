@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps what it accepted. With failEvery set, every failEvery-th
+// call fails, so each failure is followed by a successful retry of the batch.
+type recordingSink struct {
+	name      string
+	failEvery int
+	alwaysErr bool
+
+	mu       sync.Mutex
+	calls    int
+	failures int
+	events   []auditEvent
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Write(events []auditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.alwaysErr || (s.failEvery > 0 && s.calls%s.failEvery == 0) {
+		s.failures++
+		return errors.New("injected sink failure")
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *recordingSink) bySession() map[string][]auditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string][]auditEvent{}
+	for _, ev := range s.events {
+		out[ev.Session] = append(out[ev.Session], ev)
+	}
+	return out
+}
+
+func withAuditSinks(t testing.TB, sinks ...auditSink) {
+	t.Helper()
+	oldSinks, oldBackoff, oldRetries, oldShards := auditSinks, auditRetryBackoff, auditSinkRetries, AuditShards
+	t.Cleanup(func() {
+		auditSinks, auditRetryBackoff, auditSinkRetries, AuditShards = oldSinks, oldBackoff, oldRetries, oldShards
+	})
+	auditSinks = sinks
+	auditRetryBackoff = 0
+}
+
+// TestAuditPipelineKeepsPerSessionOrder pumps interleaved keystrokes and
+// session events of many sessions through the sharded pipeline, with one sink
+// failing regularly, and checks that every sink saw each session in order.
+func TestAuditPipelineKeepsPerSessionOrder(t *testing.T) {
+	flaky := &recordingSink{name: "flaky", failEvery: 3}
+	steady := &recordingSink{name: "steady"}
+	withAuditSinks(t, flaky, steady)
+	withSessionMaps(t)
+	// shards run concurrently, so a retry may land on another failing call
+	auditSinkRetries = 100
+	AuditShards = 4
+	stop := runAuditPipeline(t)
+
+	const sessions, commands = 25, 40
+	var wg sync.WaitGroup
+	for s := 0; s < sessions; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			id := fmt.Sprintf("sess-%d", s)
+			info := sessionInfo{User: fmt.Sprintf("user-%d", s)}
+			enqueueSessionEvent(id, info, "session_start", "")
+			for c := 0; c < commands; c++ {
+				// split every command over two frames to interleave with other sessions
+				line := fmt.Sprintf("cmd-%d\r", c)
+				asyncAuditChan <- asyncAudit{ctxid: id, info: info, ascii: []byte(line[:3])}
+				asyncAuditChan <- asyncAudit{ctxid: id, info: info, ascii: []byte(line[3:])}
+				if c%10 == 9 {
+					enqueueSessionEvent(id, info, "session_heartbeat", "")
+				}
+			}
+			enqueueSessionEvent(id, info, "session_end", "")
+		}(s)
+	}
+	wg.Wait()
+	stop()
+
+	if flaky.failures == 0 {
+		t.Fatal("expected injected failures")
+	}
+	for _, sink := range []*recordingSink{flaky, steady} {
+		got := sink.bySession()
+		if len(got) != sessions {
+			t.Fatalf("%s: got events of %d sessions, want %d", sink.name, len(got), sessions)
+		}
+		for id, events := range got {
+			// start, the commands, a heartbeat every 10 commands, end
+			if want := 1 + commands + commands/10 + 1; len(events) != want {
+				t.Fatalf("%s/%s: got %d events, want %d", sink.name, id, len(events), want)
+			}
+			next := 0
+			for i, ev := range events {
+				if ev.Index != uint64(i+1) {
+					t.Fatalf("%s/%s: event %d has index %d", sink.name, id, i, ev.Index)
+				}
+				if ev.Event == "" {
+					if want := fmt.Sprintf("cmd-%d", next); ev.Command != want {
+						t.Fatalf("%s/%s: command %q at index %d, want %q", sink.name, id, ev.Command, ev.Index, want)
+					}
+					next++
+				}
+			}
+			if events[0].Event != "session_start" || events[len(events)-1].Event != "session_end" {
+				t.Fatalf("%s/%s: first %q last %q", sink.name, id, events[0].Event, events[len(events)-1].Event)
+			}
+		}
+	}
+}
+
+func TestAuditPipelineDropsOnlyForFailingSink(t *testing.T) {
+	broken := &recordingSink{name: "broken", alwaysErr: true}
+	steady := &recordingSink{name: "steady"}
+	withAuditSinks(t, broken, steady)
+	auditSinkRetries = 2
+	stop := runAuditPipeline(t)
+
+	enqueueSessionEvent("s1", sessionInfo{}, "session_start", "")
+	enqueueSessionEvent("s1", sessionInfo{}, "session_end", "")
+	stop()
+
+	if broken.calls < 3 || broken.calls%3 != 0 {
+		t.Fatalf("broken sink called %d times, want the first try plus 2 retries per batch", broken.calls)
+	}
+	if n := len(steady.bySession()["s1"]); n != 2 {
+		t.Fatalf("steady sink got %d events, want 2", n)
+	}
+}
+
+func TestAuditPipelineIndexIsPerSession(t *testing.T) {
+	steady := &recordingSink{name: "steady"}
+	withAuditSinks(t, steady)
+	stop := runAuditPipeline(t)
+
+	for _, id := range []string{"a", "b"} {
+		enqueueSessionEvent(id, sessionInfo{}, "session_start", "")
+		enqueueSessionEvent(id, sessionInfo{}, "", "sh")
+	}
+	enqueueSessionEvent("a", sessionInfo{}, "session_end", "")
+	stop()
+
+	for id, events := range steady.bySession() {
+		for i, ev := range events {
+			if ev.Index != uint64(i+1) {
+				t.Fatalf("session %s: event %d has index %d", id, i, ev.Index)
+			}
+		}
+	}
+}
+
+func TestLogSinkWritesIndex(t *testing.T) {
+	buf := captureAudit(t)
+	err := logSink{}.Write([]auditEvent{
+		{Session: "s1", Index: 1, Info: sessionInfo{User: "alice"}, Event: "session_start", Captured: time.Now()},
+		{Session: "s1", Index: 2, Info: sessionInfo{User: "alice"}, Command: "ls -la"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the legacy lines keep the fields they had before the index
+	lines := auditV2Lines(buf.String())
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 v2 events, got: %s", buf.String())
+	}
+	if !strings.Contains(lines[0], `"type":"session_start"`) || !strings.Contains(lines[0], `"index":1`) {
+		t.Fatalf("unexpected session event: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"command":"ls -la"`) || !strings.Contains(lines[1], `"index":2`) || !strings.Contains(lines[1], `"type":"command"`) {
+		t.Fatalf("unexpected command line: %s", lines[1])
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AuditFailClosed refuses new sessions while the audit pipeline is unhealthy
+// when it is strict, and with strictest also terminates the sessions running
+// once the pipeline stayed unhealthy for AuditFailClosedGrace. Unset, sessions
+// run whatever the state of the pipeline.
+var AuditFailClosed string
+
+const (
+	auditFailClosedStrict    = "strict"
+	auditFailClosedStrictest = "strictest"
+)
+
+// AuditFailClosedQueue is how many captured items may wait for the audit
+// workers before the pipeline counts as unhealthy.
+var AuditFailClosedQueue = DefaultAuditFailClosedQueue
+
+// DefaultAuditFailClosedQueue is a full shard queue.
+const DefaultAuditFailClosedQueue = auditShardQueue
+
+// AuditFailClosedGrace is how long the pipeline may stay unhealthy before
+// strictest terminates the running sessions.
+var AuditFailClosedGrace = 30 * time.Second
+
+// auditGateHeld bounds the events held while the pipeline is unhealthy, the
+// refusals beyond it are only counted.
+const auditGateHeld = 1024
+
+// auditGate tracks the health of the audit pipeline for AuditFailClosed. The
+// events of its transitions and refusals are held while the pipeline is
+// unhealthy, and queued once it recovered.
+type auditGate struct {
+	mu sync.Mutex
+	// down is when the pipeline became unhealthy, zero while it is healthy.
+	down    time.Time
+	reason  string
+	held    []auditEvent
+	dropped int
+	// watchdogs are those of the recorded sessions running.
+	watchdogs map[*sessionWatchdog]struct{}
+}
+
+var gate = &auditGate{watchdogs: map[*sessionWatchdog]struct{}{}}
+
+// validateAuditFailClosed checks that AuditFailClosed has a critical sink to
+// judge the health of the pipeline by.
+func validateAuditFailClosed() error {
+	switch AuditFailClosed {
+	case "":
+		return nil
+	case auditFailClosedStrict, auditFailClosedStrictest:
+	default:
+		return fmt.Errorf("unsupported audit fail-closed mode %q, use strict or strictest", AuditFailClosed)
+	}
+	if len(AuditCriticalSinks) == 0 {
+		return fmt.Errorf("audit fail-closed mode %s needs a critical audit sink", AuditFailClosed)
+	}
+	if AuditFailClosedQueue <= 0 {
+		return fmt.Errorf("audit fail-closed queue must be positive")
+	}
+	return nil
+}
+
+// auditPipelineProblem says why the pipeline is unhealthy, empty when it is
+// healthy: no workers running, every critical sink stale, or too much
+// captured waiting for the workers.
+func auditPipelineProblem() string {
+	pool := auditPool.Load()
+	if pool == nil {
+		return "the audit workers are not running"
+	}
+	healthy := false
+	for _, name := range AuditCriticalSinks {
+		if !lagFor(name).isStale() {
+			healthy = true
+			break
+		}
+	}
+	if !healthy {
+		return fmt.Sprintf("every critical audit sink is stale: %s", strings.Join(AuditCriticalSinks, ", "))
+	}
+	queued := len(asyncAuditChan)
+	for _, s := range *pool {
+		queued += len(s.queue)
+	}
+	if queued > AuditFailClosedQueue {
+		return fmt.Sprintf("%d captured items wait for the audit workers, over the limit of %d", queued, AuditFailClosedQueue)
+	}
+	return ""
+}
+
+// check updates the gate with the health of the pipeline and returns why it
+// is unhealthy, empty when it is healthy. With strictest it terminates the
+// running sessions once the pipeline was unhealthy for AuditFailClosedGrace.
+func (g *auditGate) check() string {
+	if AuditFailClosed == "" {
+		return ""
+	}
+	problem := auditPipelineProblem()
+	now := clk.Now()
+	g.mu.Lock()
+	var recovered []auditEvent
+	switch {
+	case problem != "" && g.down.IsZero():
+		g.down, g.reason = now, problem
+		auditPipelineAvailable.Set(0)
+		SysLogger.Error().Str("reason", problem).Str("mode", AuditFailClosed).Msg("audit pipeline unavailable, refusing new sessions")
+		g.holdLocked(auditEvent{Session: proxySession, Info: sessionInfo{User: adminActor}, Event: "audit_pipeline_unavailable", Reason: problem, Captured: now})
+	case problem == "" && !g.down.IsZero():
+		unavailable := now.Sub(g.down)
+		auditPipelineAvailable.Set(1)
+		SysLogger.Info().Dur("unavailable", unavailable).Int("refusals_not_held", g.dropped).Msg("audit pipeline recovered")
+		recovered = append(g.held, auditEvent{
+			Session: proxySession, Info: sessionInfo{User: adminActor}, Event: "audit_pipeline_recovered",
+			Reason: g.reason, Gap: unavailable, Unheld: g.dropped, Captured: now,
+		})
+		g.down, g.reason, g.held, g.dropped = time.Time{}, "", nil, 0
+	}
+	var terminate []*sessionWatchdog
+	if problem != "" && AuditFailClosed == auditFailClosedStrictest && now.Sub(g.down) >= AuditFailClosedGrace {
+		for w := range g.watchdogs {
+			terminate = append(terminate, w)
+		}
+	}
+	g.mu.Unlock()
+
+	// queued without holding the lock, a full channel may take a while
+	for _, ev := range recovered {
+		if !queueAuditEvent(ev) {
+			recordError("audit_gate")
+			SysLogger.Error().Str("event", ev.Event).Msg("failed to queue the audit pipeline health event")
+		}
+	}
+	for _, w := range terminate {
+		w.unaudited()
+	}
+	return problem
+}
+
+// holdLocked keeps ev until the pipeline recovered, or counts it once
+// auditGateHeld events are held.
+func (g *auditGate) holdLocked(ev auditEvent) {
+	if len(g.held) >= auditGateHeld {
+		g.dropped++
+		return
+	}
+	g.held = append(g.held, ev)
+}
+
+// admit reports whether a session of info may start. A session refused for
+// an unhealthy pipeline is answered with a 503 and its refusal held.
+func (g *auditGate) admit(w http.ResponseWriter, ctxid string, info sessionInfo, cmd string) bool {
+	problem := g.check()
+	if problem == "" {
+		return true
+	}
+	auditFailClosedTotal.WithLabelValues("refused").Inc()
+	SysLogger.Warn().Str("user", info.User).Str("namespace", info.NameSpace).Str("pod", info.Pod).Str("reason", problem).Msg("refusing session, the audit pipeline is unavailable")
+	g.mu.Lock()
+	g.holdLocked(auditEvent{Session: ctxid, Info: info, Event: "session_refused", Command: cmd, Reason: problem, Captured: clk.Now()})
+	g.mu.Unlock()
+	writeStatus(w, &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusServiceUnavailable,
+		Reason:  metav1.StatusReasonServiceUnavailable,
+		Message: "audit pipeline unavailable: " + problem,
+	})
+	return false
+}
+
+// track makes w one of the running sessions strictest terminates, until the
+// returned func is called.
+func (g *auditGate) track(w *sessionWatchdog) func() {
+	g.mu.Lock()
+	g.watchdogs[w] = struct{}{}
+	g.mu.Unlock()
+	return func() {
+		g.mu.Lock()
+		delete(g.watchdogs, w)
+		g.mu.Unlock()
+	}
+}
+
+// unaudited tells the watchdog to terminate its session, the audit pipeline
+// stayed unavailable for longer than AuditFailClosedGrace.
+func (w *sessionWatchdog) unaudited() {
+	select {
+	case w.auditLost <- struct{}{}:
+	default:
+	}
+}
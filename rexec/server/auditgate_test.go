@@ -0,0 +1,263 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	rexectest "github.com/adyen/kubectl-rexec/rexec/server/testutil"
+)
+
+// withAuditFailClosed sets the fail-closed mode on a fresh gate.
+func withAuditFailClosed(t *testing.T, mode string, grace time.Duration) {
+	t.Helper()
+	oldMode, oldQueue, oldGrace, oldGate := AuditFailClosed, AuditFailClosedQueue, AuditFailClosedGrace, gate
+	t.Cleanup(func() {
+		AuditFailClosed, AuditFailClosedQueue, AuditFailClosedGrace, gate = oldMode, oldQueue, oldGrace, oldGate
+	})
+	AuditFailClosed, AuditFailClosedQueue, AuditFailClosedGrace = mode, DefaultAuditFailClosedQueue, grace
+	gate = &auditGate{watchdogs: map[*sessionWatchdog]struct{}{}}
+}
+
+// auditOutage runs the pipeline with a critical sink that stopped answering
+// behind a healthy one, and returns them. The outage starts with stall.
+type auditOutage struct {
+	fc      *rexectest.FakeClock
+	healthy *recordingSink
+	stuck   *slowSink
+}
+
+func newAuditOutage(t *testing.T) *auditOutage {
+	t.Helper()
+	fc := withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	o := &auditOutage{fc: fc, healthy: &recordingSink{name: "log"}, stuck: newSlowSink("webhook")}
+	withAuditSinks(t, o.healthy, o.stuck)
+	withSinkHealth(t, map[string]time.Duration{"webhook": 30 * time.Second}, "webhook")
+	runAuditPipeline(t)
+	t.Cleanup(o.stuck.unblock)
+	return o
+}
+
+// stall makes the critical sink stale: an event stuck in it for longer than
+// its staleness threshold.
+func (o *auditOutage) stall(t *testing.T) {
+	t.Helper()
+	enqueueEvent(nil, auditEvent{Session: "s0", Event: "session_start", Captured: clk.Now()})
+	<-o.stuck.entered
+	o.fc.Advance(31 * time.Second)
+	checkAuditSinks()
+}
+
+// recover lets the critical sink catch up and checks the sinks again.
+func (o *auditOutage) recover(t *testing.T) {
+	t.Helper()
+	o.stuck.unblock()
+	eventually(t, "the sink catching up", func() bool { return lagFor("webhook").oldestAge(clk.Now()) == 0 })
+	checkAuditSinks()
+	gate.check()
+}
+
+func (o *auditOutage) events(session string) []auditEvent {
+	return o.healthy.bySession()[session]
+}
+
+// pipelineHealth returns the audit_pipeline_ events, without those of the
+// sinks.
+func (o *auditOutage) pipelineHealth() []auditEvent {
+	var health []auditEvent
+	for _, ev := range o.events(proxySession) {
+		if strings.HasPrefix(ev.Event, "audit_pipeline_") {
+			health = append(health, ev)
+		}
+	}
+	return health
+}
+
+func rexecExecRequest(query string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/apis/audit.adyen.internal/v1beta1/namespaces/default/pods/web-0/exec?"+query, nil)
+	req.Header.Set("X-Remote-User", "alice")
+	req = withFrontProxyCert(req, "front-proxy-client")
+	return mux.SetURLVars(req, map[string]string{"namespace": "default", "pod": "web-0"})
+}
+
+func TestAuditFailClosedAdmission(t *testing.T) {
+	oldNames := RequestHeaderAllowedNames
+	t.Cleanup(func() { RequestHeaderAllowedNames = oldNames })
+	RequestHeaderAllowedNames = nil
+
+	tests := []struct {
+		mode   string
+		outage bool
+		want   int
+	}{
+		{"", false, http.StatusOK},
+		{"", true, http.StatusOK},
+		{auditFailClosedStrict, false, http.StatusOK},
+		{auditFailClosedStrict, true, http.StatusServiceUnavailable},
+		{auditFailClosedStrictest, false, http.StatusOK},
+		{auditFailClosedStrictest, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		name := tt.mode
+		if name == "" {
+			name = "unset"
+		}
+		if tt.outage {
+			name += " during an outage"
+		}
+		t.Run(name, func(t *testing.T) {
+			o := newAuditOutage(t)
+			withAuditFailClosed(t, tt.mode, time.Minute)
+			api := &fakeAPIServer{execStatus: http.StatusOK}
+			withFakeAPIServer(t, api)
+			if tt.outage {
+				o.stall(t)
+			}
+			before := testutil.ToFloat64(auditFailClosedTotal.WithLabelValues("refused"))
+
+			rr := httptest.NewRecorder()
+			rexecHandler(rr, rexecExecRequest("command=ls&stdout=true"))
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			refused := testutil.ToFloat64(auditFailClosedTotal.WithLabelValues("refused")) - before
+			if tt.want == http.StatusServiceUnavailable {
+				if !strings.Contains(rr.Body.String(), "audit pipeline unavailable: every critical audit sink is stale: webhook") {
+					t.Fatalf("refusal does not say why: %s", rr.Body)
+				}
+				if len(api.paths) != 0 || refused != 1 {
+					t.Fatalf("refused session reached the apiserver %v, refusals counted %v", api.paths, refused)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditFailClosedQueueThreshold(t *testing.T) {
+	o := newAuditOutage(t)
+	withAuditFailClosed(t, auditFailClosedStrict, time.Minute)
+	AuditFailClosedQueue = 2
+	// the sink is stuck, but not stale yet: what piles up behind it counts
+	for i := 0; i < 4; i++ {
+		enqueueEvent(nil, auditEvent{Session: "s0", Event: "session_heartbeat", Captured: clk.Now()})
+		if i == 0 {
+			<-o.stuck.entered
+		}
+	}
+	eventually(t, "the backlog", func() bool { return gate.check() != "" })
+	if got := gate.check(); !strings.Contains(got, "captured items wait for the audit workers, over the limit of 2") {
+		t.Fatalf("problem = %q, want the backlog", got)
+	}
+}
+
+func TestAuditFailClosedSelfAuditsOnRecovery(t *testing.T) {
+	o := newAuditOutage(t)
+	withAuditFailClosed(t, auditFailClosedStrict, time.Minute)
+	o.stall(t)
+	info := sessionInfo{User: "alice", NameSpace: "default", Pod: "web-0"}
+	if gate.admit(httptest.NewRecorder(), "s1", info, "ls") {
+		t.Fatal("session admitted during the outage")
+	}
+	if got := testutil.ToFloat64(auditPipelineAvailable); got != 0 {
+		t.Fatalf("rexec_audit_pipeline_available = %v, want 0", got)
+	}
+	o.fc.Advance(time.Minute)
+	o.recover(t)
+
+	eventually(t, "the health events", func() bool { return len(o.pipelineHealth()) == 2 })
+	health := o.pipelineHealth()
+	if health[0].Event != "audit_pipeline_unavailable" || !strings.Contains(health[0].Reason, "webhook") {
+		t.Fatalf("first health event = %+v, want audit_pipeline_unavailable", health[0])
+	}
+	if health[1].Event != "audit_pipeline_recovered" || health[1].Gap != time.Minute {
+		t.Fatalf("second health event = %+v, want audit_pipeline_recovered after a minute", health[1])
+	}
+	refusal := o.events("s1")
+	if len(refusal) != 1 || refusal[0].Event != "session_refused" || refusal[0].Info.User != "alice" || refusal[0].Command != "ls" {
+		t.Fatalf("refusal = %+v, want the session_refused of alice", refusal)
+	}
+	if got := testutil.ToFloat64(auditPipelineAvailable); got != 1 {
+		t.Fatalf("rexec_audit_pipeline_available = %v, want 1", got)
+	}
+	if !gate.admit(httptest.NewRecorder(), "s2", info, "ls") {
+		t.Fatal("session refused once the pipeline recovered")
+	}
+}
+
+func TestAuditFailClosedTermination(t *testing.T) {
+	for _, tt := range []struct {
+		mode       string
+		terminated bool
+	}{
+		{auditFailClosedStrict, false},
+		{auditFailClosedStrictest, true},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			o := newAuditOutage(t)
+			withAuditFailClosed(t, tt.mode, time.Minute)
+			before := testutil.ToFloat64(auditFailClosedTotal.WithLabelValues("terminated"))
+			cancelledCh := make(chan struct{})
+			w := startSessionWatchdog("s1", sessionInfo{User: "alice"}, func() { close(cancelledCh) })
+			defer w.stop()
+			defer gate.track(w)()
+
+			o.stall(t)
+			gate.check()
+			// within the grace the session continues
+			o.fc.Advance(59 * time.Second)
+			gate.check()
+			if cancelled(cancelledCh) {
+				t.Fatal("session terminated within the grace period")
+			}
+			o.fc.Advance(time.Second)
+			gate.check()
+			if !tt.terminated {
+				if cancelled(cancelledCh) || w.endReason() != "client_cancelled" {
+					t.Fatalf("%s terminated the session", tt.mode)
+				}
+				return
+			}
+			eventually(t, "the termination", func() bool { return cancelled(cancelledCh) })
+			if got := w.endReason(); got != "session_audit_unavailable" {
+				t.Fatalf("end reason = %q, want session_audit_unavailable", got)
+			}
+			if got := testutil.ToFloat64(auditFailClosedTotal.WithLabelValues("terminated")) - before; got != 1 {
+				t.Fatalf("terminations counted %v, want 1", got)
+			}
+			// the termination is audited once the pipeline is back
+			o.recover(t)
+			eventually(t, "the termination event", func() bool {
+				events := o.events("s1")
+				return len(events) == 1 && events[0].Event == "session_audit_unavailable"
+			})
+		})
+	}
+}
+
+func TestValidateAuditFailClosed(t *testing.T) {
+	withSinkHealth(t, nil)
+	withAuditFailClosed(t, "", time.Minute)
+	for _, tt := range []struct {
+		mode     string
+		critical []string
+		err      string
+	}{
+		{"", nil, ""},
+		{auditFailClosedStrict, []string{"log"}, ""},
+		{auditFailClosedStrictest, []string{"log"}, ""},
+		{auditFailClosedStrict, nil, "needs a critical audit sink"},
+		{"paranoid", []string{"log"}, "unsupported audit fail-closed mode"},
+	} {
+		AuditFailClosed, AuditCriticalSinks = tt.mode, tt.critical
+		err := validateAuditFailClosed()
+		if (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("mode %q with critical sinks %v: error %v, want %q", tt.mode, tt.critical, err, tt.err)
+		}
+	}
+}
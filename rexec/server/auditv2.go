@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// AuditFormat is the format of the audit log. legacy writes only the flat
+// lines the existing tooling parses, as they were before the v2 events, dual
+// writes the v2 event of every audit occurrence next to its legacy line while
+// consumers migrate. What was recorded since, like the index of an event or
+// the uid and groups of the user, is only in the v2 events.
+var AuditFormat = auditFormatDual
+
+const (
+	auditFormatLegacy = "legacy"
+	auditFormatDual   = "dual"
+
+	// auditSchemaV2 tags the v2 events.
+	auditSchemaV2 = "rexec.audit/v2"
+)
+
+// AuditDualUntil ends the dual emission, as an RFC 3339 time: from then on
+// only the v2 events are written. Empty keeps writing both.
+var AuditDualUntil string
+
+// auditDualUntil is AuditDualUntil parsed, zero when unset.
+var auditDualUntil time.Time
+
+// AuditLegacyOff are the sinks whose consumers migrated, they only get the v2
+// events.
+var AuditLegacyOff []string
+
+// auditV2Types are the types of the v2 schema, one per category of audit
+// event. An event of another type is still written, but counted as a
+// mismatch: the schema has to learn it before consumers can rely on it.
+var auditV2Types = map[string]bool{
+	"command":                    true,
+	"session_start":              true,
+	"session_heartbeat":          true,
+	"session_end":                true,
+	"session_idle_timeout":       true,
+	"session_max_duration":       true,
+	"session_output_cap":         true,
+	"session_audit_unavailable":  true,
+	"session_limit_exceeded":     true,
+	"session_refused":            true,
+	"identity_uid_changed":       true,
+	"audit_gap":                  true,
+	"authz_decision":             true,
+	"container_checkpoint":       true,
+	"proxy_start":                true,
+	"proxy_config":               true,
+	"admin":                      true,
+	"audit_sink_stale":           true,
+	"audit_sink_recovered":       true,
+	"audit_pipeline_unavailable": true,
+	"audit_pipeline_recovered":   true,
+	"key_rotation":               true,
+	"request_rejected":           true,
+	"upload_file":                true,
+	"upload_unparsed":            true,
+}
+
+// validateAuditFormat checks the format and parses AuditDualUntil. Turning
+// the legacy lines off only makes sense while the v2 events are written.
+func validateAuditFormat() error {
+	auditDualUntil = time.Time{}
+	switch AuditFormat {
+	case auditFormatLegacy:
+		if AuditDualUntil != "" || len(AuditLegacyOff) > 0 {
+			return fmt.Errorf("the audit legacy lines can only be turned off with the dual audit format")
+		}
+		return nil
+	case auditFormatDual:
+	default:
+		return fmt.Errorf("unsupported audit format %q, use legacy or dual", AuditFormat)
+	}
+	if AuditDualUntil != "" {
+		until, err := time.Parse(time.RFC3339, AuditDualUntil)
+		if err != nil {
+			return fmt.Errorf("invalid end of the dual audit format: %w", err)
+		}
+		auditDualUntil = until
+	}
+	for _, name := range AuditLegacyOff {
+		if !slices.ContainsFunc(auditSinks, func(s auditSink) bool { return s.Name() == name }) {
+			return fmt.Errorf("unknown audit sink %q to turn the legacy lines off for", name)
+		}
+	}
+	return nil
+}
+
+// auditStreams reports which formats sink writes.
+func auditStreams(sink string) (legacy, v2 bool) {
+	if AuditFormat != auditFormatDual {
+		return true, false
+	}
+	if !auditDualUntil.IsZero() && !clk.Now().Before(auditDualUntil) {
+		return false, true
+	}
+	return !slices.Contains(AuditLegacyOff, sink), true
+}
+
+// auditFields adds the fields of one audit line to e.
+type auditFields func(e *zerolog.Event) *zerolog.Event
+
+// emitAudit writes an audit occurrence of type typ in the formats sink gets:
+// legacy builds its flat line, ev and data its v2 event. The event_id of the
+// v2 event is the digest of the legacy line, written or not, so the two
+// streams join on it. A v2 event that disagrees with its legacy line is
+// counted as a mismatch.
+func emitAudit(sink, typ string, level zerolog.Level, legacy auditFields, ev auditEvent, data auditFields) {
+	writeLegacy, writeV2 := auditStreams(sink)
+	if writeLegacy {
+		legacy(auditLogger.WithLevel(level)).Msg("")
+		auditEmittedTotal.WithLabelValues(auditFormatLegacy).Inc()
+	}
+	if !writeV2 {
+		return
+	}
+	line := renderAudit(level, legacy)
+	v2 := v2Fields(auditEventID(line), typ, ev, data)
+	v2(auditLogger.WithLevel(level)).Msg("")
+	auditEmittedTotal.WithLabelValues("v2").Inc()
+	if !auditV2Types[typ] || !auditFormatsAgree(line, renderAudit(level, v2)) {
+		auditFormatMismatchesTotal.Inc()
+	}
+}
+
+// renderAudit is the line fields writes without what the audit logger adds to
+// every line, its facility and time.
+func renderAudit(level zerolog.Level, fields auditFields) []byte {
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+	fields(logger.WithLevel(level)).Msg("")
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// auditEventID is the id of the v2 event of the legacy line: the hex of the
+// first 16 bytes of its sha256. Identical lines share it.
+func auditEventID(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:16])
+}
+
+// auditFormatsAgree reports whether every field of the legacy line is in the
+// v2 event with the same value, the event field as its type. Both are written
+// by the same encoder, so a value is the same bytes in both.
+func auditFormatsAgree(legacy, v2 []byte) bool {
+	typed := false
+	ok := flatFields(legacy, func(key string, value []byte) bool {
+		switch {
+		case key == "event":
+			typed = true
+			return bytes.Contains(v2, append([]byte(`"type":`), value...))
+		case string(value) == `""`:
+			// v2 leaves out the empty target of the proxy's own events
+			return true
+		}
+		field := append([]byte(`"`+key+`":`), value...)
+		return bytes.Contains(v2, append(field, ',')) || bytes.Contains(v2, append(field, '}'))
+	})
+	return ok && (typed || bytes.Contains(v2, []byte(`"type":"command"`)))
+}
+
+// flatFields calls fn with the key and the raw value of every field of line, a
+// JSON object of strings, numbers, booleans and arrays of them as the legacy
+// lines are. It stops at the first false fn returns, and returns false then or
+// when line is not such an object.
+func flatFields(line []byte, fn func(key string, value []byte) bool) bool {
+	if len(line) < 2 || line[0] != '{' || line[len(line)-1] != '}' {
+		return false
+	}
+	rest := line[1 : len(line)-1]
+	for len(rest) > 0 {
+		end := stringEnd(rest)
+		if end < 0 || end+1 >= len(rest) || rest[end+1] != ':' {
+			return false
+		}
+		key := string(rest[1:end])
+		rest = rest[end+2:]
+		n := valueEnd(rest)
+		if n <= 0 || !fn(key, rest[:n]) {
+			return false
+		}
+		rest = rest[n:]
+		if len(rest) > 0 {
+			if rest[0] != ',' {
+				return false
+			}
+			rest = rest[1:]
+		}
+	}
+	return true
+}
+
+// stringEnd is the index of the closing quote of the JSON string b starts
+// with, -1 if b doesn't start with one.
+func stringEnd(b []byte) int {
+	if len(b) == 0 || b[0] != '"' {
+		return -1
+	}
+	for i := 1; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// valueEnd is the length of the flat JSON value b starts with.
+func valueEnd(b []byte) int {
+	if len(b) == 0 {
+		return -1
+	}
+	switch b[0] {
+	case '"':
+		return stringEnd(b) + 1
+	case '[':
+		for i := 1; i < len(b); i++ {
+			switch b[i] {
+			case '"':
+				end := stringEnd(b[i:])
+				if end < 0 {
+					return -1
+				}
+				i += end
+			case ']':
+				return i + 1
+			}
+		}
+		return -1
+	}
+	// a number, true, false or null
+	i := 0
+	for i < len(b) && strings.IndexByte("+-.0123456789Eaeflnrstu", b[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+// auditType is the v2 type of ev, command for the lines typed.
+func auditType(ev auditEvent) string {
+	if ev.Event == "" {
+		return "command"
+	}
+	return ev.Event
+}
+
+// auditEventLevel is the level both formats write ev at.
+func auditEventLevel(event string) zerolog.Level {
+	switch event {
+	case "identity_uid_changed", "audit_sink_stale", "audit_pipeline_unavailable", "session_refused", "upload_unparsed":
+		return zerolog.WarnLevel
+	}
+	return zerolog.InfoLevel
+}
+
+// v2Fields builds the v2 event of an audit occurrence of type typ. The session
+// and the actor and target of ev are structured, data adds the fields of its
+// type, named as on the legacy line.
+func v2Fields(id, typ string, ev auditEvent, data auditFields) auditFields {
+	return func(e *zerolog.Event) *zerolog.Event {
+		e = e.Str("schema", auditSchemaV2).Str("event_id", id).Str("type", typ)
+		if ev.Session != "" {
+			e = e.Str("session", ev.Session)
+		}
+		if ev.Index > 0 {
+			e = e.Uint64("index", ev.Index)
+		}
+		if i := ev.Info; i.User != "" {
+			actor := zerolog.Dict().Str("user", i.User).Str("uid", i.UID).Strs("groups", i.Groups).Str("client_ip", i.ClientIP)
+			if i.Impersonator != "" {
+				actor = actor.Str("impersonator", i.Impersonator)
+			}
+			e = e.Dict("actor", actor)
+		}
+		if i := ev.Info; i.NameSpace != "" || i.Pod != "" {
+			e = e.Dict("target", zerolog.Dict().Str("namespace", i.NameSpace).Str("pod", i.Pod).Str("container", i.Container))
+		}
+		if ev.Info.ChangeID != "" {
+			e = e.Str("change_id", ev.Info.ChangeID)
+		}
+		if !ev.Captured.IsZero() {
+			e = e.Time("captured", ev.Captured)
+		}
+		return e.Dict("data", data(zerolog.Dict()))
+	}
+}
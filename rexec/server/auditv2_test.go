@@ -0,0 +1,407 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the audit format tests")
+
+// assertGolden compares got with testdata/audit/<name>.golden.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join("testdata", "audit", name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v, run the tests with -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs:\n--- got\n%s--- want\n%s", file, got, want)
+	}
+}
+
+// auditV2Lines are the v2 events of the audit log in buf.
+func auditV2Lines(buf string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(buf), "\n") {
+		if strings.Contains(line, `"schema":"`+auditSchemaV2+`"`) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// auditSamples has an event of every category the sinks get, with every field
+// the category logs set.
+func auditSamples() []auditEvent {
+	captured := time.Unix(1700000000, 0).UTC()
+	info := sessionInfo{
+		User: "alice", UID: "u-1", Groups: []string{"sre", "oncall"}, NameSpace: "default", Pod: "web-0", Container: "app", ClientIP: "10.0.0.7",
+		TTY: true, ChangeID: "CHG-1", Limits: sessionLimits{MaxStrokesPerLine: 100, MaxLines: 1000, SampleEvery: 10, SessionBuffer: 4096},
+		Constraints: authzConstraints{MaxDuration: time.Hour, OutputCap: 1 << 20, RequireRecording: true},
+	}
+	proxy := sessionInfo{User: adminActor}
+	upload := info
+	upload.TTY, upload.Upload = false, "/etc/app"
+	events := []auditEvent{
+		{Info: info, Command: "ls -la"},
+		{Info: info, Event: "session_start"},
+		{Info: info, Event: "session_heartbeat"},
+		{Info: info, Event: "identity_uid_changed", PreviousUID: "u-0"},
+		{Info: info, Event: "audit_gap", LostBytes: 512, Gap: 3 * time.Second, Command: "cat /etc/pass"},
+		{Info: info, Event: "session_limit_exceeded", Limit: "max_message_size", LimitBytes: 1024, Direction: "client", Size: 2048},
+		{Info: info, Event: "session_idle_timeout"},
+		{Info: info, Event: "session_max_duration"},
+		{Info: info, Event: "session_output_cap"},
+		{Info: info, Event: "session_audit_unavailable"},
+		{Info: info, Event: "session_end", Reason: "client_cancelled", ClientBytes: 10, UpstreamBytes: 20, SampledLines: 3, Timing: &sessionTiming{
+			Authn: time.Millisecond, Policy: 2 * time.Millisecond, Dial: 3 * time.Millisecond, FirstByte: 4 * time.Millisecond, Stream: time.Minute, Teardown: 5 * time.Millisecond, Stalls: 2,
+		}},
+		{Info: info, Event: "authz_decision", Command: "sh", Outcome: "allow", AuthzSource: "webhook", Latency: 15 * time.Millisecond, Reason: "on call"},
+		{Info: info, Event: "session_refused", Command: "sh", Reason: "every critical audit sink is stale: webhook"},
+		{Info: info, Event: "container_checkpoint", Node: "node-1", Archives: []string{"/var/lib/kubelet/checkpoints/a.tar"}, Outcome: "failure", Reason: "not supported"},
+		{Session: proxySession, Info: proxy, Event: "proxy_start", Provenance: &provenance{
+			Version: "v1.2.3", Commit: "abc", BuildDate: "2026-01-01", GoVersion: "go1.26", Features: []string{"recording"}, ConfigHash: "f00", Pod: "rexec-0", Cluster: "prod",
+		}},
+		{Session: proxySession, Info: proxy, Event: "proxy_config", Provenance: &provenance{Version: "v1.2.3", Features: []string{}, ConfigHash: "f01"}},
+		{Session: proxySession, Info: sessionInfo{User: "admin"}, Event: "admin", Action: "reload", Target: "limits", Before: "aa", After: "bb", Outcome: "failure", Reason: "invalid"},
+		{Session: proxySession, Info: proxy, Event: "audit_sink_stale", Sink: "webhook", Lag: 40 * time.Second, Threshold: 30 * time.Second},
+		{Session: proxySession, Info: proxy, Event: "audit_sink_recovered", Sink: "webhook", Threshold: 30 * time.Second},
+		{Session: proxySession, Info: proxy, Event: "audit_pipeline_unavailable", Reason: "every critical audit sink is stale: webhook"},
+		{Session: proxySession, Info: proxy, Event: "audit_pipeline_recovered", Reason: "every critical audit sink is stale: webhook", Gap: time.Minute, Unheld: 1},
+		{Info: upload, Event: "upload_file", Upload: &uploadEntry{Path: "conf/app.yaml", Type: "file", Size: 1234, Mode: 0o644}},
+		{Info: upload, Event: "upload_file", Upload: &uploadEntry{Path: "conf/current", Type: "symlink", Mode: 0o777, Link: "app.yaml"}},
+		{Info: upload, Event: "upload_unparsed", Reason: "invalid tar header checksum"},
+	}
+	for i := range events {
+		if events[i].Session == "" {
+			events[i].Session = "s1"
+		}
+		events[i].Index = uint64(i + 1)
+		events[i].Captured = captured
+	}
+	return events
+}
+
+// logDirectAudit writes the audit lines that don't go through the sinks.
+func logDirectAudit() {
+	info := sessionInfo{User: "alice", UID: "u-1", Groups: []string{"sre"}, NameSpace: "default", Pod: "web-0", Container: "app", ClientIP: "10.0.0.7", ChangeID: "CHG-1"}
+	logCommand("ls -la", "oneoff", info)
+	logKeyRotation(nil, "k1", "k2")
+	rejectExecParams(httptest.NewRecorder(), rexecRequest{user: "alice", namespace: "default", pod: "web-0"}, "10.0.0.7", &execParamError{field: "tty", value: "yes", message: "must be true or false"})
+}
+
+// TestLegacyAuditLines pins the audit lines of the categories written before
+// the v2 events to the bytes the tooling parsing them relies on.
+// testdata/audit/legacy.golden was written by the server before the v2
+// events, don't regenerate it.
+func TestLegacyAuditLines(t *testing.T) {
+	withAuditFormat(t, auditFormatLegacy, "")
+	buf := captureAudit(t)
+	samples := auditSamples()
+	// the samples carry what was recorded since, the lines must not show it
+	err := (logSink{}).Write([]auditEvent{
+		{Session: "s1", Index: 1, Info: samples[1].Info, Event: "session_start", Captured: samples[1].Captured},
+		samples[0],
+		samples[10],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := samples[0].Info
+	logCommand("ls -la", "oneoff", info)
+	want, err := os.ReadFile(filepath.Join("testdata", "audit", "legacy.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("legacy audit lines differ:\n--- got\n%s--- want\n%s", buf.Bytes(), want)
+	}
+}
+
+// withAuditFormat sets the audit format flags for the test.
+func withAuditFormat(t *testing.T, format, until string, legacyOff ...string) {
+	t.Helper()
+	oldFormat, oldUntil, oldOff := AuditFormat, AuditDualUntil, AuditLegacyOff
+	t.Cleanup(func() {
+		AuditFormat, AuditDualUntil, AuditLegacyOff = oldFormat, oldUntil, oldOff
+		auditDualUntil = time.Time{}
+	})
+	AuditFormat, AuditDualUntil, AuditLegacyOff = format, until, legacyOff
+	if err := validateAuditFormat(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDualAuditLines(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	withAuditFormat(t, auditFormatDual, "")
+	buf := captureAudit(t)
+	if err := (logSink{}).Write(auditSamples()); err != nil {
+		t.Fatal(err)
+	}
+	logDirectAudit()
+	assertGolden(t, "dual", buf.Bytes())
+}
+
+// flattenV2 lifts the actor, target and data of a v2 event to the top, names
+// its type as the legacy event, and drops what only v2 has.
+func flattenV2(v2 map[string]any) map[string]any {
+	flat := map[string]any{}
+	for k, v := range v2 {
+		switch k {
+		case "actor", "target", "data":
+			for nk, nv := range v.(map[string]any) {
+				flat[nk] = nv
+			}
+		case "type":
+			if v != "command" {
+				flat["event"] = v
+			}
+		case "schema", "event_id", "captured", "index":
+		default:
+			flat[k] = v
+		}
+	}
+	return flat
+}
+
+// TestAuditFormatsEquivalent checks, for every category of audit event, that
+// every field of the legacy line is in the v2 event written next to it with
+// the same value, and that the id of the v2 event is the digest of its legacy
+// line.
+func TestAuditFormatsEquivalent(t *testing.T) {
+	withAuditFormat(t, auditFormatDual, "")
+	buf := captureAudit(t)
+	if err := (logSink{}).Write(auditSamples()); err != nil {
+		t.Fatal(err)
+	}
+	logDirectAudit()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines)%2 != 0 {
+		t.Fatalf("%d lines, want a legacy and a v2 line per occurrence", len(lines))
+	}
+	seen := map[string]bool{}
+	for i := 0; i < len(lines); i += 2 {
+		var legacy, v2 map[string]any
+		if err := json.Unmarshal([]byte(lines[i]), &legacy); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(lines[i+1]), &v2); err != nil {
+			t.Fatal(err)
+		}
+		if v2["schema"] != auditSchemaV2 || legacy["schema"] != nil {
+			t.Fatalf("line %d and %d are not a legacy and a v2 line:\n%s\n%s", i, i+1, lines[i], lines[i+1])
+		}
+		typ := v2["type"].(string)
+		seen[typ] = true
+		if !auditV2Types[typ] {
+			t.Errorf("type %s is not in the v2 schema", typ)
+		}
+		flat := flattenV2(v2)
+		for k, want := range legacy {
+			got, ok := flat[k]
+			if !ok && want == "" {
+				// v2 leaves out the empty target of the proxy's own events
+				continue
+			}
+			if !ok || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: legacy %s = %v, v2 has %v", typ, k, want, got)
+			}
+		}
+		if want := auditEventID([]byte(lines[i])); v2["event_id"] != want {
+			t.Errorf("%s: event_id = %v, want %s", typ, v2["event_id"], want)
+		}
+	}
+	for typ := range auditV2Types {
+		if !seen[typ] {
+			t.Errorf("no sample of %s", typ)
+		}
+	}
+}
+
+func TestAuditStreams(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	tests := []struct {
+		name       string
+		format     string
+		until      string
+		legacyOff  []string
+		sink       string
+		legacy, v2 bool
+	}{
+		{"legacy", auditFormatLegacy, "", nil, "log", true, false},
+		{"dual", auditFormatDual, "", nil, "log", true, true},
+		{"legacy off for the sink", auditFormatDual, "", []string{"log"}, "log", false, true},
+		{"legacy off for another sink", auditFormatDual, "", []string{"log"}, "webhook", true, true},
+		{"before the end of dual", auditFormatDual, "2023-11-14T22:13:21Z", nil, "log", true, true},
+		{"at the end of dual", auditFormatDual, "2023-11-14T22:13:20Z", nil, "log", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAuditFormat(t, tt.format, tt.until, tt.legacyOff...)
+			if legacy, v2 := auditStreams(tt.sink); legacy != tt.legacy || v2 != tt.v2 {
+				t.Fatalf("auditStreams(%s) = %v, %v, want %v, %v", tt.sink, legacy, v2, tt.legacy, tt.v2)
+			}
+		})
+	}
+}
+
+func TestLegacyOffWritesOnlyV2(t *testing.T) {
+	withAuditFormat(t, auditFormatDual, "", "log")
+	buf := captureAudit(t)
+	legacyBefore, v2Before := testutil.ToFloat64(auditEmittedTotal.WithLabelValues("legacy")), testutil.ToFloat64(auditEmittedTotal.WithLabelValues("v2"))
+	if err := (logSink{}).Write(auditSamples()[:2]); err != nil {
+		t.Fatal(err)
+	}
+	logCommand("ls", "oneoff", sessionInfo{User: "alice"})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for _, line := range lines {
+		if !strings.Contains(line, `"schema":"rexec.audit/v2"`) {
+			t.Fatalf("legacy line written to the sink: %s", line)
+		}
+	}
+	if len(lines) != 3 {
+		t.Fatalf("%d lines, want the 3 v2 events", len(lines))
+	}
+	legacy := testutil.ToFloat64(auditEmittedTotal.WithLabelValues("legacy")) - legacyBefore
+	v2 := testutil.ToFloat64(auditEmittedTotal.WithLabelValues("v2")) - v2Before
+	if legacy != 0 || v2 != 3 {
+		t.Fatalf("counted %v legacy and %v v2, want 0 and 3", legacy, v2)
+	}
+}
+
+func TestAuditFormatMismatches(t *testing.T) {
+	withAuditFormat(t, auditFormatDual, "")
+	buf := captureAudit(t)
+	before := testutil.ToFloat64(auditFormatMismatchesTotal)
+	if err := (logSink{}).Write([]auditEvent{{Session: "s1", Index: 1, Event: "session_teleported"}, {Session: "s1", Index: 2, Event: "session_heartbeat"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(auditFormatMismatchesTotal) - before; got != 1 {
+		t.Fatalf("counted %v mismatches, want 1", got)
+	}
+	// the event is still written in both formats
+	if got := strings.Count(buf.String(), "session_teleported"); got != 2 {
+		t.Fatalf("session_teleported written %d times, want 2", got)
+	}
+
+	// a v2 event that says something else than its legacy line
+	before = testutil.ToFloat64(auditFormatMismatchesTotal)
+	ev := auditEvent{Session: "s1", Index: 3, Info: sessionInfo{User: "alice", NameSpace: "default", Pod: "web-0"}, Command: "rm -rf /data"}
+	emitAudit(logSink{}.Name(), "command", zerolog.InfoLevel, legacyEventFields(ev), ev, func(e *zerolog.Event) *zerolog.Event {
+		return e.Str("command", "ls")
+	})
+	ev.Info.User = "bob"
+	emitAudit(logSink{}.Name(), "command", zerolog.InfoLevel, legacyEventFields(auditEvent{Session: "s1", Info: sessionInfo{User: "alice"}, Command: "ls"}), ev, func(e *zerolog.Event) *zerolog.Event {
+		return e.Str("command", "ls")
+	})
+	if got := testutil.ToFloat64(auditFormatMismatchesTotal) - before; got != 2 {
+		t.Fatalf("counted %v mismatches, want 2", got)
+	}
+}
+
+func TestAuditFormatsAgree(t *testing.T) {
+	legacy := `{"level":"info","event":"audit_sink_stale","user":"system:rexec","session":"proxy","namespace":"","pod":"","sink":"webhook","oldest_undelivered":40000}`
+	for _, tt := range []struct {
+		v2   string
+		want bool
+	}{
+		{`{"level":"info","schema":"rexec.audit/v2","event_id":"x","type":"audit_sink_stale","session":"proxy","index":1,"actor":{"user":"system:rexec"},"data":{"sink":"webhook","oldest_undelivered":40000}}`, true},
+		{`{"level":"info","schema":"rexec.audit/v2","event_id":"x","type":"audit_sink_stale","session":"proxy","actor":{"user":"system:rexec"},"data":{"sink":"log","oldest_undelivered":40000}}`, false},
+		{`{"level":"info","schema":"rexec.audit/v2","event_id":"x","type":"audit_sink_recovered","session":"proxy","actor":{"user":"system:rexec"},"data":{"sink":"webhook","oldest_undelivered":40000}}`, false},
+		{`{"level":"info","schema":"rexec.audit/v2","event_id":"x","type":"audit_sink_stale","session":"proxy","actor":{"user":"system:rexec"},"data":{"sink":"webhook"}}`, false},
+		{`{"level":"warn","schema":"rexec.audit/v2","event_id":"x","type":"audit_sink_stale","session":"proxy","actor":{"user":"system:rexec"},"data":{"sink":"webhook","oldest_undelivered":40000}}`, false},
+		{`not json`, false},
+	} {
+		if got := auditFormatsAgree([]byte(legacy), []byte(tt.v2)); got != tt.want {
+			t.Errorf("auditFormatsAgree(%s) = %v, want %v", tt.v2, got, tt.want)
+		}
+	}
+}
+
+func TestFlatFields(t *testing.T) {
+	var got []string
+	ok := flatFields([]byte(`{"a":"x\"y,","b":["p","q,]"],"c":1.5,"d":true,"e":[]}`), func(key string, value []byte) bool {
+		got = append(got, key+"="+string(value))
+		return true
+	})
+	want := []string{`a="x\"y,"`, `b=["p","q,]"]`, `c=1.5`, `d=true`, `e=[]`}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("flatFields() = %v, %q, want %q", ok, got, want)
+	}
+	for _, line := range []string{``, `{"a"}`, `{"a":"x}`, `{"a":1 "b":2}`, `["a"]`} {
+		if flatFields([]byte(line), func(string, []byte) bool { return true }) {
+			t.Errorf("flatFields(%s) accepted it", line)
+		}
+	}
+}
+
+func TestValidateAuditFormat(t *testing.T) {
+	oldFormat := AuditFormat
+	t.Cleanup(func() {
+		AuditFormat, AuditDualUntil, AuditLegacyOff, auditDualUntil = oldFormat, "", nil, time.Time{}
+	})
+	for _, tt := range []struct {
+		format    string
+		until     string
+		legacyOff []string
+		err       string
+	}{
+		{auditFormatLegacy, "", nil, ""},
+		{auditFormatDual, "", nil, ""},
+		{auditFormatDual, "2027-01-01T00:00:00Z", []string{"log"}, ""},
+		{"v3", "", nil, "unsupported audit format"},
+		{auditFormatLegacy, "", []string{"log"}, "only be turned off with the dual audit format"},
+		{auditFormatLegacy, "2027-01-01T00:00:00Z", nil, "only be turned off with the dual audit format"},
+		{auditFormatDual, "next year", nil, "invalid end of the dual audit format"},
+		{auditFormatDual, "", []string{"webhook"}, `unknown audit sink "webhook"`},
+	} {
+		AuditFormat, AuditDualUntil, AuditLegacyOff = tt.format, tt.until, tt.legacyOff
+		err := validateAuditFormat()
+		if (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("format %q until %q legacy off %v: error %v, want %q", tt.format, tt.until, tt.legacyOff, err, tt.err)
+		}
+	}
+}
+
+// BenchmarkLogSink measures what writing the v2 events next to the legacy
+// lines costs the audit workers, for a batch of every category.
+func BenchmarkLogSink(b *testing.B) {
+	old, oldFormat := auditLogger, AuditFormat
+	b.Cleanup(func() { auditLogger, AuditFormat = old, oldFormat })
+	auditLogger = zerolog.New(io.Discard).With().Timestamp().Str("facility", "audit").Logger()
+	batch := auditSamples()
+	for _, format := range []string{auditFormatLegacy, auditFormatDual} {
+		b.Run(format, func(b *testing.B) {
+			AuditFormat = format
+			b.ReportAllocs()
+			for b.Loop() {
+				_ = logSink{}.Write(batch)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(batch)), "ns/event")
+		})
+	}
+}
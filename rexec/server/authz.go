@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AuthzWebhookURL is the external policy decision point asked about every exec
+// request before it is proxied. Unset, no webhook is asked.
+var AuthzWebhookURL string
+
+// AuthzWebhookCAFile is the CA the certificate of the webhook is checked
+// against, the system roots when unset. AuthzWebhookCertFile and
+// AuthzWebhookKeyFile are the client certificate the proxy presents to it.
+var AuthzWebhookCAFile, AuthzWebhookCertFile, AuthzWebhookKeyFile string
+
+// AuthzWebhookTimeout bounds a call of the webhook, the pod lookup for its
+// labels included.
+var AuthzWebhookTimeout = 2 * time.Second
+
+// AuthzWebhookFailOpen allows the requests the webhook did not decide, by
+// default they are denied.
+var AuthzWebhookFailOpen bool
+
+// AuthzWebhookCacheTTL is how long a decision of the webhook is reused for an
+// identical request. Zero disables the cache.
+var AuthzWebhookCacheTTL = 10 * time.Second
+
+// authzReasonHeader carries why the user asks for the session, it is passed on
+// to the webhook as is.
+const authzReasonHeader = "X-Rexec-Reason"
+
+// authzCacheSize bounds the number of cached decisions, past it expired ones
+// are swept and new ones are not cached until there is room.
+const authzCacheSize = 10000
+
+// authzClient is nil unless AuthzWebhookURL is configured.
+var authzClient *http.Client
+
+// authzPodLabels looks up the labels of the pod for the webhook, swapped in
+// tests.
+var authzPodLabels = podLabels
+
+// authzRequest is the document POSTed to the webhook.
+type authzRequest struct {
+	User   string   `json:"user"`
+	UID    string   `json:"uid"`
+	Groups []string `json:"groups"`
+	// Impersonator is who acts as User, if the apiserver passed it on.
+	Impersonator string            `json:"impersonator,omitempty"`
+	Namespace    string            `json:"namespace"`
+	Pod          string            `json:"pod"`
+	Labels       map[string]string `json:"labels"`
+	Container    string            `json:"container"`
+	Command      []string          `json:"command"`
+	TTY          bool              `json:"tty"`
+	Reason       string            `json:"reason"`
+	ChangeID     string            `json:"change_id"`
+	ClientIP     string            `json:"client_ip"`
+}
+
+// authzResponse is the answer of the webhook. Fields it does not know are
+// ignored, so the webhook can return more than the proxy applies.
+type authzResponse struct {
+	Allowed     bool   `json:"allowed"`
+	Reason      string `json:"reason"`
+	Constraints struct {
+		MaxDuration      string `json:"max_duration"`
+		OutputCap        int64  `json:"output_cap"`
+		RequireRecording bool   `json:"require_recording"`
+	} `json:"constraints"`
+}
+
+// authzConstraints narrow a session the webhook allowed. MaxDuration only
+// shortens SessionMaxDuration, OutputCap bounds the bytes sent to the client.
+type authzConstraints struct {
+	MaxDuration      time.Duration
+	OutputCap        int64
+	RequireRecording bool
+}
+
+// watched is whether the constraints need the watchdog of a recorded session.
+func (c authzConstraints) watched() bool {
+	return c.RequireRecording || c.MaxDuration > 0 || c.OutputCap > 0
+}
+
+// authzDecision is the answer of the webhook, or of the cache or the failure
+// policy standing in for it.
+type authzDecision struct {
+	Allowed     bool
+	Reason      string
+	Constraints authzConstraints
+	// Source is webhook, cache, fail_open or fail_closed.
+	Source  string
+	Latency time.Duration
+}
+
+type authzCacheEntry struct {
+	decision authzDecision
+	expires  time.Time
+}
+
+var authzCache = struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]authzCacheEntry
+}{entries: map[[sha256.Size]byte]authzCacheEntry{}}
+
+// loadAuthzWebhook builds the mTLS client of the webhook.
+func loadAuthzWebhook() error {
+	client, err := newWebhookClient("authorization webhook", "authz-webhook", AuthzWebhookURL, AuthzWebhookCAFile, AuthzWebhookCertFile, AuthzWebhookKeyFile, AuthzWebhookTimeout)
+	if err != nil {
+		return err
+	}
+	authzClient = client
+	return nil
+}
+
+// newWebhookClient builds the mTLS client of a webhook the proxy calls. name
+// is the webhook in errors, flag the prefix of its flags.
+func newWebhookClient(name, flag, rawURL, caFile, certFile, keyFile string, timeout time.Duration) (*http.Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("the %s must be an https URL, got %q", name, rawURL)
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("the %s needs a client certificate, set --%s-cert-file and --%s-key-file", name, flag, flag)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("--%s-timeout must be positive, got %s", flag, timeout)
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		raw, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the client certificate of the %s: %w", name, err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: cfg, MaxIdleConnsPerHost: 16},
+	}, nil
+}
+
+// authorize asks the webhook whether the session of req may start. A request
+// the webhook did not decide is allowed or denied as AuthzWebhookFailOpen says.
+// Every decision is audited under id, the cached ones too.
+func authorize(ctx context.Context, id string, req rexecRequest, execParams rexecExecParams, reason string) authzDecision {
+	doc := authzRequest{
+		User: req.user, UID: req.uid, Groups: req.groups, Impersonator: req.impersonator,
+		Namespace: req.namespace, Pod: req.pod, Labels: authzPodLabels(ctx, req), Container: execParams.container,
+		Command: execParams.command, TTY: execParams.tty, Reason: reason, ChangeID: execParams.changeID, ClientIP: execParams.clientIP,
+	}
+	// nothing in the document can fail to encode
+	//nolint:errcheck
+	body, _ := json.Marshal(doc)
+	key := sha256.Sum256(body)
+
+	decision, ok := cachedAuthzDecision(key)
+	if !ok {
+		var err error
+		decision, err = callAuthzWebhook(ctx, body)
+		if err != nil {
+			recordError("authz_webhook")
+			SysLogger.Error().Err(err).Str("user", req.user).Str("namespace", req.namespace).Str("pod", req.pod).Msg("authorization webhook failed")
+			decision = authzDecision{Allowed: AuthzWebhookFailOpen, Reason: err.Error(), Source: "fail_closed", Latency: decision.Latency}
+			if AuthzWebhookFailOpen {
+				decision.Source = "fail_open"
+			}
+		} else {
+			cacheAuthzDecision(key, decision)
+		}
+	}
+
+	outcome := "denied"
+	if decision.Allowed {
+		outcome = "allowed"
+	}
+	authzDecisionsTotal.WithLabelValues(outcome, decision.Source).Inc()
+	execParams.constraints = decision.Constraints
+	ev := auditEvent{
+		Session: id, Info: req.sessionInfo(execParams), Event: "authz_decision", Command: strings.Join(execParams.command, " "), Captured: clk.Now(),
+		Outcome: outcome, Reason: decision.Reason, AuthzSource: decision.Source, Latency: decision.Latency,
+	}
+	if !queueAuditEvent(ev) {
+		recordError("authz_audit")
+		SysLogger.Error().Str("user", req.user).Str("namespace", req.namespace).Str("pod", req.pod).Msg("failed to queue the authz_decision audit event")
+	}
+	return decision
+}
+
+// callAuthzWebhook POSTs body to the webhook. The returned decision carries the
+// latency of the call even when it failed.
+func callAuthzWebhook(ctx context.Context, body []byte) (authzDecision, error) {
+	start := clk.Now()
+	decision, err := postAuthzWebhook(ctx, body)
+	decision.Latency = clk.Since(start)
+	result := "success"
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		result = "timeout"
+	case err != nil:
+		result = "error"
+	}
+	authzWebhookDuration.WithLabelValues(result).Observe(decision.Latency.Seconds())
+	return decision, err
+}
+
+func postAuthzWebhook(ctx context.Context, body []byte) (authzDecision, error) {
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, AuthzWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return authzDecision{}, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	resp, err := authzClient.Do(hr)
+	if err != nil {
+		return authzDecision{}, err
+	}
+	defer func() {
+		//nolint:errcheck
+		_ = resp.Body.Close()
+	}()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return authzDecision{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return authzDecision{}, fmt.Errorf("the authorization webhook answered %s: %s", resp.Status, truncateValue(string(raw)))
+	}
+	var answer authzResponse
+	if err := json.Unmarshal(raw, &answer); err != nil {
+		return authzDecision{}, fmt.Errorf("invalid answer of the authorization webhook: %w", err)
+	}
+	decision := authzDecision{Allowed: answer.Allowed, Reason: answer.Reason, Source: "webhook"}
+	c := answer.Constraints
+	if c.MaxDuration != "" {
+		d, err := time.ParseDuration(c.MaxDuration)
+		if err != nil || d <= 0 {
+			return authzDecision{}, fmt.Errorf("invalid answer of the authorization webhook: max_duration must be a positive duration, got %q", c.MaxDuration)
+		}
+		decision.Constraints.MaxDuration = d
+	}
+	if c.OutputCap < 0 {
+		return authzDecision{}, fmt.Errorf("invalid answer of the authorization webhook: output_cap must not be negative, got %d", c.OutputCap)
+	}
+	decision.Constraints.OutputCap, decision.Constraints.RequireRecording = c.OutputCap, c.RequireRecording
+	return decision, nil
+}
+
+func cachedAuthzDecision(key [sha256.Size]byte) (authzDecision, bool) {
+	if AuthzWebhookCacheTTL <= 0 {
+		return authzDecision{}, false
+	}
+	authzCache.Lock()
+	defer authzCache.Unlock()
+	entry, ok := authzCache.entries[key]
+	if !ok || !clk.Now().Before(entry.expires) {
+		return authzDecision{}, false
+	}
+	decision := entry.decision
+	decision.Source, decision.Latency = "cache", 0
+	return decision, true
+}
+
+func cacheAuthzDecision(key [sha256.Size]byte, decision authzDecision) {
+	if AuthzWebhookCacheTTL <= 0 {
+		return
+	}
+	now := clk.Now()
+	authzCache.Lock()
+	defer authzCache.Unlock()
+	if len(authzCache.entries) >= authzCacheSize {
+		for k, entry := range authzCache.entries {
+			if !now.Before(entry.expires) {
+				delete(authzCache.entries, k)
+			}
+		}
+		if len(authzCache.entries) >= authzCacheSize {
+			return
+		}
+	}
+	authzCache.entries[key] = authzCacheEntry{decision: decision, expires: now.Add(AuthzWebhookCacheTTL)}
+}
+
+// denial is the decision as the denial of the session id, for a decision that
+// did not allow it.
+func (d authzDecision) denial(id string, info sessionInfo) denial {
+	if d.Source == "fail_closed" {
+		return newDenial("authz_webhook_unavailable", "the authorization webhook could not decide the request", id, info)
+	}
+	reason := d.Reason
+	if reason == "" {
+		reason = "the authorization webhook denied the request"
+	}
+	return newDenial("authz_webhook", reason, id, info)
+}
+
+// podLabels looks up the labels of the pod as the user. A pod that can't be
+// looked up is sent to the webhook without labels.
+func podLabels(ctx context.Context, req rexecRequest) map[string]string {
+	ctx, cancel := context.WithTimeout(ctx, AuthzWebhookTimeout)
+	defer cancel()
+	body, code, err := impersonatedAPIRequest(ctx, req, http.MethodGet,
+		fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(req.namespace), url.PathEscape(req.pod)))
+	if err != nil || code != http.StatusOK {
+		SysLogger.Debug().Err(err).Int("code", code).Str("namespace", req.namespace).Str("pod", req.pod).Msg("failed to look up the labels of the pod for the authorization webhook")
+		return nil
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(body, &pod); err != nil {
+		return nil
+	}
+	return pod.Labels
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakePDP is an authorization webhook answering every request with answer. It
+// records the documents it was sent and whether a client certificate came with
+// them. While hang is set it does not answer until the test ends.
+type fakePDP struct {
+	answer string
+	hang   bool
+
+	mu        sync.Mutex
+	requests  []authzRequest
+	noCert    bool
+	released  chan struct{}
+	releaseFn sync.Once
+}
+
+func (p *fakePDP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var doc authzRequest
+	//nolint:errcheck
+	_ = json.NewDecoder(r.Body).Decode(&doc)
+	p.mu.Lock()
+	p.requests = append(p.requests, doc)
+	p.noCert = p.noCert || len(r.TLS.PeerCertificates) == 0
+	hang := p.hang
+	p.mu.Unlock()
+	if hang {
+		select {
+		case <-p.released:
+		case <-r.Context().Done():
+		}
+		return
+	}
+	//nolint:errcheck
+	_, _ = w.Write([]byte(p.answer))
+}
+
+func (p *fakePDP) calls() []authzRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]authzRequest(nil), p.requests...)
+}
+
+// withAuthzWebhook serves pdp over mTLS and points the proxy at it, with the
+// certificate of the server as the client certificate and pod labels
+// app=web.
+func withAuthzWebhook(t *testing.T, pdp *fakePDP) {
+	t.Helper()
+	pdp.released = make(chan struct{})
+	srv := httptest.NewUnstartedServer(pdp)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { pdp.releaseFn.Do(func() { close(pdp.released) }) })
+
+	dir := t.TempDir()
+	cert := srv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"ca.crt":     {Type: "CERTIFICATE", Bytes: srv.Certificate().Raw},
+		"client.crt": {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		"client.key": {Type: "PRIVATE KEY", Bytes: key},
+	}
+	for name, block := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldURL, oldCA, oldCert, oldKey := AuthzWebhookURL, AuthzWebhookCAFile, AuthzWebhookCertFile, AuthzWebhookKeyFile
+	oldTimeout, oldFailOpen, oldTTL, oldClient, oldLabels := AuthzWebhookTimeout, AuthzWebhookFailOpen, AuthzWebhookCacheTTL, authzClient, authzPodLabels
+	t.Cleanup(func() {
+		AuthzWebhookURL, AuthzWebhookCAFile, AuthzWebhookCertFile, AuthzWebhookKeyFile = oldURL, oldCA, oldCert, oldKey
+		AuthzWebhookTimeout, AuthzWebhookFailOpen, AuthzWebhookCacheTTL, authzClient, authzPodLabels = oldTimeout, oldFailOpen, oldTTL, oldClient, oldLabels
+		authzCache.Lock()
+		authzCache.entries = map[[sha256.Size]byte]authzCacheEntry{}
+		authzCache.Unlock()
+	})
+	AuthzWebhookURL = srv.URL
+	AuthzWebhookCAFile, AuthzWebhookCertFile, AuthzWebhookKeyFile = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	AuthzWebhookTimeout, AuthzWebhookFailOpen, AuthzWebhookCacheTTL = 2*time.Second, false, 10*time.Second
+	authzPodLabels = func(context.Context, rexecRequest) map[string]string { return map[string]string{"app": "web"} }
+	if err := loadAuthzWebhook(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func authzTestRequest() (rexecRequest, rexecExecParams) {
+	return rexecRequest{namespace: "default", pod: "web-0", user: "alice", uid: "u-1", groups: []string{"sre"}},
+		rexecExecParams{command: []string{"sh"}, container: "app", clientIP: "10.0.0.1", tty: true, needsRecording: true}
+}
+
+func TestAuthzAllowWithConstraints(t *testing.T) {
+	withFakeClock(t, 0, time.Hour, 0)
+	pdp := &fakePDP{answer: `{"allowed":true,"reason":"on call for INC-1","constraints":{"max_duration":"30m","output_cap":1024,"require_recording":true},"ticket":"INC-1"}`}
+	withAuthzWebhook(t, pdp)
+	stop := captureAdminEvents(t)
+
+	req, params := authzTestRequest()
+	decision := authorize(context.Background(), "s1", req, params, "INC-1 debugging")
+	events := stop()
+
+	want := authzConstraints{MaxDuration: 30 * time.Minute, OutputCap: 1024, RequireRecording: true}
+	if !decision.Allowed || decision.Source != "webhook" || decision.Constraints != want {
+		t.Fatalf("unexpected decision %+v", decision)
+	}
+	calls := pdp.calls()
+	if len(calls) != 1 || pdp.noCert {
+		t.Fatalf("want one call with a client certificate, got %d (without certificate: %v)", len(calls), pdp.noCert)
+	}
+	doc := calls[0]
+	if doc.User != "alice" || doc.Namespace != "default" || doc.Pod != "web-0" || doc.Container != "app" || doc.Labels["app"] != "web" ||
+		!doc.TTY || doc.Reason != "INC-1 debugging" || doc.ClientIP != "10.0.0.1" || strings.Join(doc.Command, " ") != "sh" || strings.Join(doc.Groups, ",") != "sre" {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	if len(events) != 1 || events[0].Event != "authz_decision" || events[0].Session != "s1" || events[0].Outcome != "allowed" ||
+		events[0].AuthzSource != "webhook" || events[0].Info.Constraints != want {
+		t.Fatalf("unexpected audit events %+v", events)
+	}
+}
+
+func TestAuthzConstraintsApplyToSession(t *testing.T) {
+	fc := withFakeClock(t, 0, time.Hour, 0)
+	withSessionMaps(t)
+	captureAuditLocked(t)
+	runAuditPipeline(t)
+
+	done := make(chan struct{})
+	w := startSessionWatchdog("s1", sessionInfo{User: "alice", Constraints: authzConstraints{MaxDuration: 10 * time.Minute}}, func() { close(done) })
+	defer w.stop()
+	fc.Advance(10 * time.Minute)
+	<-done
+	if got := w.endReason(); got != "session_max_duration" {
+		t.Fatalf("end reason = %q, want session_max_duration", got)
+	}
+
+	done = make(chan struct{})
+	w = startSessionWatchdog("s2", sessionInfo{User: "alice", Constraints: authzConstraints{OutputCap: 10}}, func() { close(done) })
+	defer w.stop()
+	w.transferred(10, false)
+	w.transferred(100, true)
+	if cancelled(done) {
+		t.Fatal("the session was cancelled before it went over its output cap")
+	}
+	w.transferred(1, false)
+	<-done
+	if got := w.endReason(); got != "session_output_cap" {
+		t.Fatalf("end reason = %q, want session_output_cap", got)
+	}
+}
+
+func TestAuthzDenyIsStatus(t *testing.T) {
+	oldNames := RequestHeaderAllowedNames
+	t.Cleanup(func() { RequestHeaderAllowedNames = oldNames })
+	RequestHeaderAllowedNames = nil
+	withFakeAPIServer(t, &fakeAPIServer{})
+	pdp := &fakePDP{answer: `{"allowed":false,"reason":"no open ticket for default/web-0"}`}
+	withAuthzWebhook(t, pdp)
+	stop := captureAdminEvents(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/apis/audit.adyen.internal/v1beta1/namespaces/default/pods/web-0/exec?command=sh&tty=true&stdin=true&stdout=true", nil)
+	req.Header.Set("X-Remote-User", "alice")
+	req.Header.Set(authzReasonHeader, "curious")
+	req = withFrontProxyCert(req, "front-proxy-client")
+	req = mux.SetURLVars(req, map[string]string{"namespace": "default", "pod": "web-0"})
+	rr := httptest.NewRecorder()
+	rexecHandler(rr, req)
+	events := stop()
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403: %s", rr.Code, rr.Body)
+	}
+	var status metav1.Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(status.Message, "denied by rule authz_webhook: no open ticket for default/web-0") {
+		t.Fatalf("unexpected status message %q", status.Message)
+	}
+	if len(events) != 1 || events[0].Outcome != "denied" || events[0].Reason != "no open ticket for default/web-0" || !strings.Contains(status.Message, events[0].Session) {
+		t.Fatalf("want one denied authz_decision under the session of the Status, got %+v", events)
+	}
+	if calls := pdp.calls(); len(calls) != 1 || calls[0].Reason != "curious" {
+		t.Fatalf("unexpected webhook calls %+v", calls)
+	}
+}
+
+func TestAuthzTimeout(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		t.Run(map[bool]string{false: "closed", true: "open"}[failOpen], func(t *testing.T) {
+			withFakeClock(t, 0, 0, 0)
+			pdp := &fakePDP{hang: true}
+			withAuthzWebhook(t, pdp)
+			AuthzWebhookTimeout, AuthzWebhookFailOpen = 50*time.Millisecond, failOpen
+			if err := loadAuthzWebhook(); err != nil {
+				t.Fatal(err)
+			}
+			stop := captureAdminEvents(t)
+
+			req, params := authzTestRequest()
+			decision := authorize(context.Background(), "s1", req, params, "")
+			events := stop()
+
+			wantSource := map[bool]string{false: "fail_closed", true: "fail_open"}[failOpen]
+			if decision.Allowed != failOpen || decision.Source != wantSource {
+				t.Fatalf("unexpected decision %+v", decision)
+			}
+			if len(events) != 1 || events[0].AuthzSource != wantSource || events[0].Reason == "" {
+				t.Fatalf("unexpected audit events %+v", events)
+			}
+			if !failOpen {
+				if d := decision.denial("s1", sessionInfo{}); d.Rule != "authz_webhook_unavailable" {
+					t.Fatalf("denied by %s, want authz_webhook_unavailable", d.Rule)
+				}
+			}
+
+			// a failure is not cached, the webhook is asked again
+			stop = captureAdminEvents(t)
+			authorize(context.Background(), "s2", req, params, "")
+			stop()
+			if calls := pdp.calls(); len(calls) != 2 {
+				t.Fatalf("webhook called %d times, want 2", len(calls))
+			}
+		})
+	}
+}
+
+func TestAuthzCache(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	pdp := &fakePDP{answer: `{"allowed":true,"constraints":{"output_cap":4096}}`}
+	withAuthzWebhook(t, pdp)
+	stop := captureAdminEvents(t)
+
+	req, params := authzTestRequest()
+	first := authorize(context.Background(), "s1", req, params, "")
+	second := authorize(context.Background(), "s2", req, params, "")
+	if first.Source != "webhook" || second.Source != "cache" || second.Constraints != first.Constraints {
+		t.Fatalf("want the second decision from the cache, got %+v then %+v", first, second)
+	}
+	if calls := pdp.calls(); len(calls) != 1 {
+		t.Fatalf("webhook called %d times, want once", len(calls))
+	}
+
+	// another command is another request
+	params.command = []string{"cat", "/etc/passwd"}
+	if d := authorize(context.Background(), "s3", req, params, ""); d.Source != "webhook" {
+		t.Fatalf("another command was answered from the %s", d.Source)
+	}
+
+	fc.Advance(AuthzWebhookCacheTTL)
+	params.command = []string{"sh"}
+	if d := authorize(context.Background(), "s4", req, params, ""); d.Source != "webhook" {
+		t.Fatalf("an expired decision was answered from the %s", d.Source)
+	}
+	events := stop()
+	if len(events) != 4 || events[1].AuthzSource != "cache" || events[1].Session != "s2" {
+		t.Fatalf("want every decision audited, the cached one too, got %+v", events)
+	}
+	if calls := pdp.calls(); len(calls) != 3 {
+		t.Fatalf("webhook called %d times, want 3", len(calls))
+	}
+}
+
+func TestLoadAuthzWebhook(t *testing.T) {
+	withAuthzWebhook(t, &fakePDP{})
+	tests := []struct {
+		name    string
+		modify  func()
+		wantErr string
+	}{
+		{"plain http", func() { AuthzWebhookURL = "http://pdp.example.com" }, "must be an https URL"},
+		{"no client certificate", func() { AuthzWebhookKeyFile = "" }, "needs a client certificate"},
+		{"no timeout", func() { AuthzWebhookTimeout = 0 }, "must be positive"},
+		{"bad CA", func() { AuthzWebhookCAFile = AuthzWebhookKeyFile }, "no certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, ca, key, timeout := AuthzWebhookURL, AuthzWebhookCAFile, AuthzWebhookKeyFile, AuthzWebhookTimeout
+			defer func() {
+				AuthzWebhookURL, AuthzWebhookCAFile, AuthzWebhookKeyFile, AuthzWebhookTimeout = url, ca, key, timeout
+			}()
+			tt.modify()
+			if err := loadAuthzWebhook(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// AuditSessionBuffer bounds, in bytes, the client data a recorded session may
+// hold for the audit workers. When the workers fall behind by more than that,
+// further data is dropped from the audit and reported as an audit_gap event;
+// the stream itself is never held up.
+var AuditSessionBuffer int
+
+// DefaultAuditSessionBuffer is used when AuditSessionBuffer is not set.
+const DefaultAuditSessionBuffer = 1 << 20
+
+// sessionBuffers holds the buffer of every recorded session, guarded by mapSync.
+var sessionBuffers = map[string]*sessionBuffer{}
+
+// sessionBuffer is the handoff between the stream of a recorded session and
+// the audit shard owning it. The stream only copies what it wrote into the
+// buffer, frame parsing and everything after it happens on the shard. Session
+// events go through the same buffer, so they keep their place among the
+// keystrokes.
+type sessionBuffer struct {
+	ctxid    string
+	info     sessionInfo
+	capacity int
+
+	mu    sync.Mutex
+	items []asyncAudit
+	// size is the client data held in items.
+	size int
+	// scheduled is set while the buffer is on the ready list of its shard.
+	scheduled bool
+	// lost counts the bytes dropped since lostSince; while it is non-zero
+	// all client data is dropped, so the gap sits at one place in the session.
+	lost      int64
+	lostSince time.Time
+}
+
+func newSessionBuffer(ctxid string, info sessionInfo) *sessionBuffer {
+	capacity := info.Limits.SessionBuffer
+	if capacity <= 0 {
+		capacity = AuditSessionBuffer
+	}
+	if capacity <= 0 {
+		capacity = DefaultAuditSessionBuffer
+	}
+	return &sessionBuffer{ctxid: ctxid, info: info, capacity: capacity}
+}
+
+func sessionBufferFor(ctxid string) *sessionBuffer {
+	mapSync.Lock()
+	defer mapSync.Unlock()
+	return sessionBuffers[ctxid]
+}
+
+// pushFrames is called on the stream with what was written to the apiserver.
+// It copies p, or drops it when the buffer is full, and never blocks on the
+// audit workers.
+func (b *sessionBuffer) pushFrames(p []byte) {
+	pool := auditPool.Load()
+	b.mu.Lock()
+	if b.lost > 0 || b.size+len(p) > b.capacity {
+		if b.lost == 0 {
+			b.lostSince = clk.Now()
+		}
+		b.lost += int64(len(p))
+	} else {
+		b.items = append(b.items, asyncAudit{ctxid: b.ctxid, info: b.info, frames: append([]byte(nil), p...)})
+		b.size += len(p)
+	}
+	wake := b.markScheduled(pool)
+	b.mu.Unlock()
+	if wake {
+		b.schedule(pool)
+	}
+}
+
+// pushEvent queues a session event. Events are never dropped, a pending gap is
+// closed first so it is reported before the event.
+func (b *sessionBuffer) pushEvent(ev auditEvent) {
+	pool := auditPool.Load()
+	b.mu.Lock()
+	b.closeGap()
+	b.items = append(b.items, asyncAudit{ctxid: b.ctxid, info: b.info, event: &ev})
+	wake := b.markScheduled(pool)
+	b.mu.Unlock()
+	if wake {
+		b.schedule(pool)
+	}
+}
+
+// take hands everything queued to the shard and accepts client data again.
+func (b *sessionBuffer) take() []asyncAudit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeGap()
+	items := b.items
+	b.items, b.size, b.scheduled = nil, 0, false
+	return items
+}
+
+// closeGap turns the bytes dropped so far into an audit_gap event, lasting from
+// the first dropped byte until now. Callers hold b.mu.
+func (b *sessionBuffer) closeGap() {
+	if b.lost == 0 {
+		return
+	}
+	now := clk.Now()
+	b.items = append(b.items, asyncAudit{ctxid: b.ctxid, info: b.info, event: &auditEvent{
+		Session: b.ctxid, Info: b.info, Event: "audit_gap", Captured: now,
+		LostBytes: b.lost, Gap: now.Sub(b.lostSince),
+	}})
+	auditGapsTotal.Inc()
+	auditGapBytesTotal.Add(float64(b.lost))
+	b.lost = 0
+}
+
+// markScheduled reports whether the buffer has to be put on its shard's ready
+// list. Without a running pipeline the items wait for the next push after it
+// started. Callers hold b.mu.
+func (b *sessionBuffer) markScheduled(pool *[]*auditShard) bool {
+	if pool == nil || b.scheduled {
+		return false
+	}
+	b.scheduled = true
+	return true
+}
+
+func (b *sessionBuffer) schedule(pool *[]*auditShard) {
+	shards := *pool
+	shards[shardFor(b.ctxid, len(shards))].ready(b)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var frameKey = [4]byte{0x01, 0x02, 0x03, 0x04}
+
+func withSessionMaps(t testing.TB) {
+	t.Helper()
+	oldSessions, oldBuffers, oldCommands, oldMax := sessionMap, sessionBuffers, commandMap, MaxStokesPerLine
+	t.Cleanup(func() {
+		sessionMap, sessionBuffers, commandMap, MaxStokesPerLine = oldSessions, oldBuffers, oldCommands, oldMax
+	})
+	sessionMap = map[string]sessionInfo{}
+	sessionBuffers = map[string]*sessionBuffer{}
+	commandMap = map[string][]byte{}
+	MaxStokesPerLine = 2000
+}
+
+func withSessionBufferSize(t testing.TB, size int) {
+	t.Helper()
+	old := AuditSessionBuffer
+	t.Cleanup(func() { AuditSessionBuffer = old })
+	AuditSessionBuffer = size
+}
+
+func TestSessionBufferGapMarker(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	first := buildFrame(0x2, []byte("cat big"), true, frameKey)
+	// room for the first frame and a short one after it, not for a long one
+	withSessionBufferSize(t, len(first)+10)
+	gapsBefore := testutil.ToFloat64(auditGapsTotal)
+
+	b := newSessionBuffer("s1", sessionInfo{User: "alice"})
+	b.pushFrames(first)
+	// the buffer is full, everything up to the next drain is lost, even what
+	// would fit again
+	overrun := buildFrame(0x2, []byte("file\r"), true, frameKey)
+	b.pushFrames(overrun)
+	fc.Advance(3 * time.Second)
+	small := buildFrame(0x2, []byte("x"), true, frameKey)
+	b.pushFrames(small)
+	b.pushEvent(auditEvent{Session: "s1", Event: "session_heartbeat"})
+	// accepted again after the gap was closed
+	b.pushFrames(buildFrame(0x2, []byte("ls\r"), true, frameKey))
+
+	shard := &auditShard{index: map[string]uint64{}}
+	var events []auditEvent
+	for _, item := range b.take() {
+		events = shard.process(item, events)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected gap, heartbeat and a command, got %+v", events)
+	}
+	gap := events[0]
+	if gap.Event != "audit_gap" || gap.Index != 1 {
+		t.Fatalf("first event = %+v, want audit_gap with index 1", gap)
+	}
+	if want := int64(len(overrun) + len(small)); gap.LostBytes != want {
+		t.Fatalf("bytes lost = %d, want %d", gap.LostBytes, want)
+	}
+	if gap.Gap != 3*time.Second {
+		t.Fatalf("gap duration = %v, want 3s", gap.Gap)
+	}
+	if gap.Command != "cat big" {
+		t.Fatalf("partial command = %q, want the line cut by the gap", gap.Command)
+	}
+	if events[1].Event != "session_heartbeat" || events[2].Command != "ls" {
+		t.Fatalf("unexpected events after the gap: %+v", events[1:])
+	}
+	if got := testutil.ToFloat64(auditGapsTotal) - gapsBefore; got != 1 {
+		t.Fatalf("gap counter delta = %v, want 1", got)
+	}
+}
+
+// gatedSink holds every write until release is closed, as a sink that can't
+// keep up would.
+type gatedSink struct {
+	recordingSink
+	release chan struct{}
+}
+
+func (s *gatedSink) Write(events []auditEvent) error {
+	<-s.release
+	return s.recordingSink.Write(events)
+}
+
+// TestSessionBufferNeverBlocksStream stalls the audit workers and checks the
+// stream carries on, with the overrun recorded as a gap in the session.
+func TestSessionBufferNeverBlocksStream(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	withSessionBufferSize(t, 256)
+	sink := &gatedSink{recordingSink: recordingSink{name: "gated"}, release: make(chan struct{})}
+	withAuditSinks(t, sink)
+	stop := runAuditPipeline(t)
+
+	registerSession("s1", sessionInfo{User: "alice", NameSpace: "default", Pod: "shell", Container: "app", ClientIP: "192.0.2.1"})
+	conn := &stubConn{}
+	logger := &TCPLogger{Conn: conn, ctxid: "s1", buffer: sessionBufferFor("s1")}
+
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		for i := 0; i < 1000; i++ {
+			if _, err := logger.Write(buildFrame(0x2, []byte("echo\r"), true, frameKey)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-streamed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream blocked on stalled audit workers")
+	}
+	if len(conn.written) != 1000 {
+		t.Fatalf("forwarded %d writes, want 1000", len(conn.written))
+	}
+
+	close(sink.release)
+	endSession("s1", nil)
+	stop()
+
+	events := sink.bySession()["s1"]
+	if len(events) == 0 || events[0].Event != "session_start" || events[len(events)-1].Event != "session_end" {
+		t.Fatalf("unexpected session events: %+v", events)
+	}
+	var lost int64
+	for i, ev := range events {
+		if ev.Index != uint64(i+1) {
+			t.Fatalf("event %d has index %d", i, ev.Index)
+		}
+		lost += ev.LostBytes
+	}
+	frameLen := int64(len(buildFrame(0x2, []byte("echo\r"), true, frameKey)))
+	commands := int64(len(events)) - 2
+	for _, ev := range events {
+		if ev.Event == "audit_gap" {
+			commands--
+		}
+	}
+	if lost == 0 || commands*frameLen+lost != 1000*frameLen {
+		t.Fatalf("commands %d and %d bytes lost don't add up to the 1000 frames written", commands, lost)
+	}
+}
+
+// discardConn forwards nowhere, so the benchmarks measure the data path only.
+type discardConn struct{ stubConn }
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+type discardSink struct{}
+
+func (discardSink) Name() string             { return "discard" }
+func (discardSink) Write([]auditEvent) error { return nil }
+
+// BenchmarkStreamWrite compares the write path of a session with and without
+// auditing. The audited path only adds the copy into the session buffer, so
+// the two should stay within a few percent of each other.
+func BenchmarkStreamWrite(b *testing.B) {
+	frame := buildFrame(0x2, append(bytes.Repeat([]byte("a"), 4095), '\r'), true, frameKey)
+
+	b.Run("plain", func(b *testing.B) {
+		conn := &discardConn{}
+		b.SetBytes(int64(len(frame)))
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(frame); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("audited", func(b *testing.B) {
+		withSessionMaps(b)
+		withAuditSinks(b, discardSink{})
+		runAuditPipeline(b)
+		registerSession("bench", sessionInfo{User: "alice", NameSpace: "default", Pod: "shell", Container: "app", ClientIP: "192.0.2.1"})
+		logger := &TCPLogger{Conn: &discardConn{}, ctxid: "bench", buffer: sessionBufferFor("bench")}
+		b.SetBytes(int64(len(frame)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := logger.Write(frame); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		endSession("bench", nil)
+	})
+}
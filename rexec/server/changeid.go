@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ChangeIDRulesFile requires a change ID on the exec sessions of the
+// namespaces it names. Unset, no change ID is required.
+var ChangeIDRulesFile string
+
+// ChangeIDWebhookURL verifies the change IDs of the rules with verify set.
+var ChangeIDWebhookURL string
+
+// ChangeIDWebhookCAFile is the CA the certificate of the change ID webhook is
+// checked against, the system roots when unset. ChangeIDWebhookCertFile and
+// ChangeIDWebhookKeyFile are the client certificate the proxy presents to it.
+var ChangeIDWebhookCAFile, ChangeIDWebhookCertFile, ChangeIDWebhookKeyFile string
+
+// ChangeIDWebhookTimeout bounds a call of the change ID webhook.
+var ChangeIDWebhookTimeout = 2 * time.Second
+
+// ChangeIDWebhookFailOpen accepts the change IDs the webhook did not verify,
+// by default their sessions are denied.
+var ChangeIDWebhookFailOpen bool
+
+// ChangeIDWebhookCacheTTL is how long a verdict of the webhook is reused for
+// the same change ID and user. Zero disables the cache.
+var ChangeIDWebhookCacheTTL = 5 * time.Minute
+
+// changeIDHeader carries the change ID of a session, set by the --change-id
+// flag of the plugin.
+const changeIDHeader = "X-Rexec-Change-Id"
+
+// changeIDCacheSize bounds the number of cached verdicts, like authzCacheSize.
+const changeIDCacheSize = 10000
+
+// changeIDRule is the change ID required in a namespace. An empty Pattern
+// requires none. Verify asks the webhook about IDs matching Pattern.
+type changeIDRule struct {
+	Pattern string `json:"pattern"`
+	Verify  bool   `json:"verify"`
+
+	re *regexp.Regexp
+}
+
+// changeIDConfig is a parsed ChangeIDRulesFile. The rule of a namespace
+// replaces the default as a whole.
+type changeIDConfig struct {
+	Default    changeIDRule            `json:"default"`
+	Namespaces map[string]changeIDRule `json:"namespaces"`
+	// raw is the file content, for the config hash.
+	raw []byte
+}
+
+// changeIDRules is nil unless ChangeIDRulesFile is configured.
+var changeIDRules *changeIDConfig
+
+// changeIDClient is nil unless ChangeIDWebhookURL is configured.
+var changeIDClient *http.Client
+
+// changeIDVerifyRequest is the document POSTed to the webhook. The verdict
+// may depend on the user, not on the pod, so it is cached per change ID and
+// user.
+type changeIDVerifyRequest struct {
+	ChangeID string   `json:"change_id"`
+	User     string   `json:"user"`
+	UID      string   `json:"uid"`
+	Groups   []string `json:"groups"`
+}
+
+// changeIDVerdict is the answer of the webhook, or of the cache or the
+// failure policy standing in for it.
+type changeIDVerdict struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason"`
+	// Source is webhook, cache, fail_open or fail_closed.
+	Source string `json:"-"`
+}
+
+type changeIDCacheEntry struct {
+	verdict changeIDVerdict
+	expires time.Time
+}
+
+var changeIDCache = struct {
+	sync.Mutex
+	entries map[string]changeIDCacheEntry
+}{entries: map[string]changeIDCacheEntry{}}
+
+// parseChangeIDRules reads {"default":{...},"namespaces":{"<name>":{...}}}
+// and compiles the patterns.
+func parseChangeIDRules(raw []byte) (*changeIDConfig, error) {
+	cfg := &changeIDConfig{raw: raw}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid change ID rules: %w", err)
+	}
+	if err := cfg.Default.compile(); err != nil {
+		return nil, fmt.Errorf("invalid change ID rules: default: %w", err)
+	}
+	for ns, rule := range cfg.Namespaces {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid change ID rules: namespace %s: %w", ns, err)
+		}
+		cfg.Namespaces[ns] = rule
+	}
+	return cfg, nil
+}
+
+func (r *changeIDRule) compile() error {
+	if r.Pattern == "" {
+		if r.Verify {
+			return errors.New("verify needs a pattern")
+		}
+		return nil
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return err
+	}
+	if r.Verify && ChangeIDWebhookURL == "" {
+		return errors.New("verify needs --change-id-webhook-url")
+	}
+	r.re = re
+	return nil
+}
+
+// loadChangeIDRules loads ChangeIDRulesFile and builds the client of the
+// webhook when one is configured.
+func loadChangeIDRules() error {
+	if ChangeIDWebhookURL != "" {
+		client, err := newWebhookClient("change ID webhook", "change-id-webhook", ChangeIDWebhookURL, ChangeIDWebhookCAFile, ChangeIDWebhookCertFile, ChangeIDWebhookKeyFile, ChangeIDWebhookTimeout)
+		if err != nil {
+			return err
+		}
+		changeIDClient = client
+	}
+	raw, err := os.ReadFile(ChangeIDRulesFile)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseChangeIDRules(raw)
+	if err != nil {
+		return err
+	}
+	changeIDRules = cfg
+	return nil
+}
+
+// rule returns the rule of namespace.
+func (c *changeIDConfig) rule(namespace string) changeIDRule {
+	if rule, ok := c.Namespaces[namespace]; ok {
+		return rule
+	}
+	return c.Default
+}
+
+// checkChangeID checks the change ID of the session id against the rule of
+// its namespace. It returns the denial of a session that may not start.
+func checkChangeID(ctx context.Context, id string, req rexecRequest, execParams rexecExecParams) (denial, bool) {
+	rule := changeIDRules.rule(req.namespace)
+	if rule.re == nil {
+		return denial{}, true
+	}
+	info := req.sessionInfo(execParams)
+	changeID := execParams.changeID
+	result, d := "accepted", denial{}
+	switch {
+	case changeID == "":
+		result = "missing"
+		d = newDenial("change_id_missing", fmt.Sprintf("namespace %s requires a change ID matching %s in the %s header (kubectl rexec --change-id)", req.namespace, rule.Pattern, changeIDHeader), id, info)
+	case !rule.re.MatchString(changeID):
+		result = "invalid"
+		d = newDenial("change_id_invalid", fmt.Sprintf("change ID %q does not match %s", truncateValue(changeID), rule.Pattern), id, info)
+	case rule.Verify:
+		verdict := verifyChangeID(ctx, req, changeID)
+		switch {
+		case verdict.Source == "fail_closed":
+			result = "unavailable"
+			d = newDenial("change_id_unavailable", fmt.Sprintf("change ID %s could not be verified", changeID), id, info)
+		case !verdict.Valid:
+			result = "rejected"
+			reason := verdict.Reason
+			if reason == "" {
+				reason = fmt.Sprintf("change ID %s was rejected", changeID)
+			}
+			d = newDenial("change_id_rejected", reason, id, info)
+		case verdict.Source == "fail_open":
+			result = "accepted_fail_open"
+		}
+	}
+	changeIDChecksTotal.WithLabelValues(result).Inc()
+	if d.Rule != "" {
+		SysLogger.Warn().Str("session", id).Str("user", req.user).Str("namespace", req.namespace).Str("pod", req.pod).Str("change_id", truncateValue(changeID)).Str("rule", d.Rule).Msg("rejected exec request: " + d.Reason)
+		return d, false
+	}
+	return denial{}, true
+}
+
+// verifyChangeID asks the webhook whether changeID is valid for the user. A
+// change ID the webhook did not verify is accepted or not as
+// ChangeIDWebhookFailOpen says.
+func verifyChangeID(ctx context.Context, req rexecRequest, changeID string) changeIDVerdict {
+	key := changeID + "\x00" + req.user + "\x00" + req.uid
+	if verdict, ok := cachedChangeIDVerdict(key); ok {
+		return verdict
+	}
+	// nothing in the document can fail to encode
+	//nolint:errcheck
+	body, _ := json.Marshal(changeIDVerifyRequest{ChangeID: changeID, User: req.user, UID: req.uid, Groups: req.groups})
+	verdict, err := callChangeIDWebhook(ctx, body)
+	if err != nil {
+		recordError("change_id_webhook")
+		SysLogger.Error().Err(err).Str("user", req.user).Str("change_id", changeID).Msg("change ID webhook failed")
+		verdict = changeIDVerdict{Valid: ChangeIDWebhookFailOpen, Reason: err.Error(), Source: "fail_closed"}
+		if ChangeIDWebhookFailOpen {
+			verdict.Source = "fail_open"
+		}
+		return verdict
+	}
+	cacheChangeIDVerdict(key, verdict)
+	return verdict
+}
+
+func callChangeIDWebhook(ctx context.Context, body []byte) (changeIDVerdict, error) {
+	start := clk.Now()
+	verdict, err := postChangeIDWebhook(ctx, body)
+	result := "success"
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		result = "timeout"
+	case err != nil:
+		result = "error"
+	}
+	changeIDWebhookDuration.WithLabelValues(result).Observe(clk.Since(start).Seconds())
+	return verdict, err
+}
+
+func postChangeIDWebhook(ctx context.Context, body []byte) (changeIDVerdict, error) {
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, ChangeIDWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return changeIDVerdict{}, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	resp, err := changeIDClient.Do(hr)
+	if err != nil {
+		return changeIDVerdict{}, err
+	}
+	defer func() {
+		//nolint:errcheck
+		_ = resp.Body.Close()
+	}()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return changeIDVerdict{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return changeIDVerdict{}, fmt.Errorf("the change ID webhook answered %s: %s", resp.Status, truncateValue(string(raw)))
+	}
+	var verdict changeIDVerdict
+	if err := json.Unmarshal(raw, &verdict); err != nil {
+		return changeIDVerdict{}, fmt.Errorf("invalid answer of the change ID webhook: %w", err)
+	}
+	verdict.Source = "webhook"
+	return verdict, nil
+}
+
+func cachedChangeIDVerdict(key string) (changeIDVerdict, bool) {
+	if ChangeIDWebhookCacheTTL <= 0 {
+		return changeIDVerdict{}, false
+	}
+	changeIDCache.Lock()
+	defer changeIDCache.Unlock()
+	entry, ok := changeIDCache.entries[key]
+	if !ok || !clk.Now().Before(entry.expires) {
+		return changeIDVerdict{}, false
+	}
+	verdict := entry.verdict
+	verdict.Source = "cache"
+	return verdict, true
+}
+
+func cacheChangeIDVerdict(key string, verdict changeIDVerdict) {
+	if ChangeIDWebhookCacheTTL <= 0 {
+		return
+	}
+	now := clk.Now()
+	changeIDCache.Lock()
+	defer changeIDCache.Unlock()
+	if len(changeIDCache.entries) >= changeIDCacheSize {
+		for k, entry := range changeIDCache.entries {
+			if !now.Before(entry.expires) {
+				delete(changeIDCache.entries, k)
+			}
+		}
+		if len(changeIDCache.entries) >= changeIDCacheSize {
+			return
+		}
+	}
+	changeIDCache.entries[key] = changeIDCacheEntry{verdict: verdict, expires: now.Add(ChangeIDWebhookCacheTTL)}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// withChangeIDRules loads rules as the change ID rules file. With pdp set it
+// is served as the change ID webhook with the mTLS setup of withAuthzWebhook;
+// authzRequest has the change_id, user and uid fields fakePDP records.
+func withChangeIDRules(t *testing.T, rules string, pdp *fakePDP) {
+	t.Helper()
+	oldFile, oldURL, oldCA, oldCert, oldKey := ChangeIDRulesFile, ChangeIDWebhookURL, ChangeIDWebhookCAFile, ChangeIDWebhookCertFile, ChangeIDWebhookKeyFile
+	oldTimeout, oldFailOpen, oldTTL, oldRules, oldClient := ChangeIDWebhookTimeout, ChangeIDWebhookFailOpen, ChangeIDWebhookCacheTTL, changeIDRules, changeIDClient
+	t.Cleanup(func() {
+		ChangeIDRulesFile, ChangeIDWebhookURL, ChangeIDWebhookCAFile, ChangeIDWebhookCertFile, ChangeIDWebhookKeyFile = oldFile, oldURL, oldCA, oldCert, oldKey
+		ChangeIDWebhookTimeout, ChangeIDWebhookFailOpen, ChangeIDWebhookCacheTTL, changeIDRules, changeIDClient = oldTimeout, oldFailOpen, oldTTL, oldRules, oldClient
+		changeIDCache.Lock()
+		changeIDCache.entries = map[string]changeIDCacheEntry{}
+		changeIDCache.Unlock()
+	})
+	ChangeIDWebhookURL, ChangeIDWebhookTimeout, ChangeIDWebhookFailOpen, ChangeIDWebhookCacheTTL = "", 2*time.Second, false, 5*time.Minute
+	if pdp != nil {
+		withAuthzWebhook(t, pdp)
+		ChangeIDWebhookURL, ChangeIDWebhookCAFile, ChangeIDWebhookCertFile, ChangeIDWebhookKeyFile = AuthzWebhookURL, AuthzWebhookCAFile, AuthzWebhookCertFile, AuthzWebhookKeyFile
+		authzClient = nil
+	}
+	ChangeIDRulesFile = filepath.Join(t.TempDir(), "change-id-rules.json")
+	if err := os.WriteFile(ChangeIDRulesFile, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadChangeIDRules(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func changeIDTestRequest(namespace, changeID string) (rexecRequest, rexecExecParams) {
+	req, params := authzTestRequest()
+	req.namespace = namespace
+	params.changeID = changeID
+	return req, params
+}
+
+func TestParseChangeIDRules(t *testing.T) {
+	cfg, err := parseChangeIDRules([]byte(`{"default":{"pattern":"^CHG[0-9]{7}$"},"namespaces":{"dev":{}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.rule("prod").re == nil || cfg.rule("dev").re != nil {
+		t.Fatal("want the default rule in prod and no change ID in dev")
+	}
+
+	for raw, wantErr := range map[string]string{
+		`{"default":{"patern":"x"}}`:                            "unknown field",
+		`{"namespaces":{"prod":{"pattern":"CHG[0-9"}}}`:         "namespace prod",
+		`{"default":{"verify":true}}`:                           "verify needs a pattern",
+		`{"namespaces":{"prod":{"pattern":".","verify":true}}}`: "verify needs --change-id-webhook-url",
+	} {
+		if _, err := parseChangeIDRules([]byte(raw)); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("parse %s: err = %v, want %q", raw, err, wantErr)
+		}
+	}
+}
+
+func TestChangeIDRegexOnly(t *testing.T) {
+	withChangeIDRules(t, `{"namespaces":{"prod":{"pattern":"^CHG[0-9]{7}$"}}}`, nil)
+
+	tests := []struct {
+		namespace, changeID, wantRule string
+	}{
+		{"default", "", ""},
+		{"prod", "", "change_id_missing"},
+		{"prod", "CHG12", "change_id_invalid"},
+		{"prod", "CHG1234567 ", "change_id_invalid"},
+		{"prod", "CHG1234567", ""},
+	}
+	for _, tt := range tests {
+		req, params := changeIDTestRequest(tt.namespace, tt.changeID)
+		d, ok := checkChangeID(context.Background(), "s1", req, params)
+		if ok != (tt.wantRule == "") || d.Rule != tt.wantRule {
+			t.Errorf("%s %q: allowed %v by rule %q, want rule %q", tt.namespace, tt.changeID, ok, d.Rule, tt.wantRule)
+		}
+	}
+
+	req, params := changeIDTestRequest("prod", "")
+	d, _ := checkChangeID(context.Background(), "s1", req, params)
+	if !strings.Contains(d.Reason, "namespace prod requires a change ID matching ^CHG[0-9]{7}$ in the X-Rexec-Change-Id header") {
+		t.Fatalf("unexpected reason %q", d.Reason)
+	}
+}
+
+func TestChangeIDWebhookVerdicts(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	tests := []struct {
+		answer, wantRule, wantReason string
+	}{
+		{`{"valid":true}`, "", ""},
+		{`{"valid":false,"reason":"CHG1234567 is closed"}`, "change_id_rejected", "CHG1234567 is closed"},
+		{`{"valid":false}`, "change_id_rejected", "change ID CHG1234567 was rejected"},
+		{`not json`, "change_id_unavailable", "could not be verified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantRule+tt.wantReason, func(t *testing.T) {
+			pdp := &fakePDP{answer: tt.answer}
+			withChangeIDRules(t, `{"default":{"pattern":"^CHG[0-9]{7}$","verify":true}}`, pdp)
+
+			req, params := changeIDTestRequest("prod", "CHG1234567")
+			d, ok := checkChangeID(context.Background(), "s1", req, params)
+			if ok != (tt.wantRule == "") || d.Rule != tt.wantRule || !strings.Contains(d.Reason, tt.wantReason) {
+				t.Fatalf("allowed %v by %+v, want rule %q with reason %q", ok, d, tt.wantRule, tt.wantReason)
+			}
+			calls := pdp.calls()
+			if len(calls) != 1 || pdp.noCert || calls[0].ChangeID != "CHG1234567" || calls[0].User != "alice" || calls[0].UID != "u-1" {
+				t.Fatalf("unexpected webhook calls %+v", calls)
+			}
+		})
+	}
+}
+
+func TestChangeIDWebhookNotAskedAboutInvalidIDs(t *testing.T) {
+	pdp := &fakePDP{answer: `{"valid":true}`}
+	withChangeIDRules(t, `{"default":{"pattern":"^CHG[0-9]{7}$","verify":true}}`, pdp)
+
+	req, params := changeIDTestRequest("prod", "INC-1")
+	if d, ok := checkChangeID(context.Background(), "s1", req, params); ok || d.Rule != "change_id_invalid" {
+		t.Fatalf("want change_id_invalid, got %+v", d)
+	}
+	if calls := pdp.calls(); len(calls) != 0 {
+		t.Fatalf("webhook asked about an ID not matching the pattern: %+v", calls)
+	}
+}
+
+func TestChangeIDCache(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	pdp := &fakePDP{answer: `{"valid":false,"reason":"not assigned to alice"}`}
+	withChangeIDRules(t, `{"default":{"pattern":"^CHG[0-9]{7}$","verify":true}}`, pdp)
+
+	req, _ := changeIDTestRequest("prod", "")
+	if v := verifyChangeID(context.Background(), req, "CHG1234567"); v.Source != "webhook" || v.Valid {
+		t.Fatalf("unexpected first verdict %+v", v)
+	}
+	// the verdict is per change ID and user, not per pod
+	req.pod = "web-1"
+	if v := verifyChangeID(context.Background(), req, "CHG1234567"); v.Source != "cache" || v.Valid || v.Reason != "not assigned to alice" {
+		t.Fatalf("want the cached verdict, got %+v", v)
+	}
+	if calls := pdp.calls(); len(calls) != 1 {
+		t.Fatalf("webhook called %d times, want once", len(calls))
+	}
+
+	bob := req
+	bob.user, bob.uid = "bob", "u-2"
+	if v := verifyChangeID(context.Background(), bob, "CHG1234567"); v.Source != "webhook" {
+		t.Fatalf("another user was answered from the %s", v.Source)
+	}
+	if v := verifyChangeID(context.Background(), req, "CHG7654321"); v.Source != "webhook" {
+		t.Fatalf("another change ID was answered from the %s", v.Source)
+	}
+
+	fc.Advance(ChangeIDWebhookCacheTTL)
+	if v := verifyChangeID(context.Background(), req, "CHG1234567"); v.Source != "webhook" {
+		t.Fatalf("an expired verdict was answered from the %s", v.Source)
+	}
+	if calls := pdp.calls(); len(calls) != 4 {
+		t.Fatalf("webhook called %d times, want 4", len(calls))
+	}
+}
+
+func TestChangeIDWebhookTimeout(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		t.Run(map[bool]string{false: "closed", true: "open"}[failOpen], func(t *testing.T) {
+			withFakeClock(t, 0, 0, 0)
+			pdp := &fakePDP{hang: true}
+			withChangeIDRules(t, `{"default":{"pattern":"^CHG[0-9]{7}$","verify":true}}`, pdp)
+			ChangeIDWebhookTimeout, ChangeIDWebhookFailOpen = 50*time.Millisecond, failOpen
+			if err := loadChangeIDRules(); err != nil {
+				t.Fatal(err)
+			}
+
+			req, params := changeIDTestRequest("prod", "CHG1234567")
+			d, ok := checkChangeID(context.Background(), "s1", req, params)
+			if ok != failOpen {
+				t.Fatalf("allowed = %v, want %v", ok, failOpen)
+			}
+			if !failOpen && d.Rule != "change_id_unavailable" {
+				t.Fatalf("denied by %s, want change_id_unavailable", d.Rule)
+			}
+
+			// a failure is not cached, the webhook is asked again
+			checkChangeID(context.Background(), "s2", req, params)
+			if calls := pdp.calls(); len(calls) != 2 {
+				t.Fatalf("webhook called %d times, want 2", len(calls))
+			}
+		})
+	}
+}
+
+func TestChangeIDDenialIsStatus(t *testing.T) {
+	oldNames := RequestHeaderAllowedNames
+	t.Cleanup(func() { RequestHeaderAllowedNames = oldNames })
+	RequestHeaderAllowedNames = nil
+	withFakeAPIServer(t, &fakeAPIServer{})
+	withChangeIDRules(t, `{"default":{"pattern":"^CHG[0-9]{7}$"}}`, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/apis/audit.adyen.internal/v1beta1/namespaces/prod/pods/web-0/exec?command=sh&tty=true&stdin=true&stdout=true", nil)
+	req.Header.Set("X-Remote-User", "alice")
+	req.Header.Set(changeIDHeader, "CHG-1")
+	req = withFrontProxyCert(req, "front-proxy-client")
+	req = mux.SetURLVars(req, map[string]string{"namespace": "prod", "pod": "web-0"})
+	rr := httptest.NewRecorder()
+	rexecHandler(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403: %s", rr.Code, rr.Body)
+	}
+	var status metav1.Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(status.Message, `denied by rule change_id_invalid: change ID "CHG-1" does not match ^CHG[0-9]{7}$`) {
+		t.Fatalf("unexpected status message %q", status.Message)
+	}
+}
+
+func TestChangeIDIsAudited(t *testing.T) {
+	req, params := changeIDTestRequest("prod", "CHG1234567")
+	info := req.sessionInfo(params)
+	if info.ChangeID != "CHG1234567" {
+		t.Fatalf("session info has change ID %q", info.ChangeID)
+	}
+
+	buf := captureAudit(t)
+	if err := (logSink{}).Write([]auditEvent{{Session: "s1", Info: info, Event: "session_start", Captured: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	logCommand("sh", "oneoff", info)
+	lines := auditV2Lines(buf.String())
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 v2 events, got: %s", buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"change_id":"CHG1234567"`) {
+			t.Fatalf("change ID missing from %s", line)
+		}
+	}
+
+	buf.Reset()
+	logCommand("sh", "oneoff", sessionInfo{User: "alice"})
+	if strings.Contains(buf.String(), "change_id") {
+		t.Fatalf("change_id logged without one: %s", buf.String())
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CheckpointGroups are the groups allowed to checkpoint containers through the
+// proxy. A checkpoint holds the memory of the container, secrets included, so
+// checkpoints are refused for everyone while it is empty.
+var CheckpointGroups []string
+
+// checkpointTimeout bounds the pod lookup and the checkpoint by the kubelet.
+const checkpointTimeout = 2 * time.Minute
+
+// checkpointResult is the answer to a successful checkpoint: the node holding
+// the archives and their paths on it, as the kubelet reported them.
+type checkpointResult struct {
+	Node  string   `json:"node"`
+	Items []string `json:"items"`
+}
+
+// checkpointHandler checkpoints a container through the kubelet checkpoint API
+// on behalf of the user. The pod lookup and the checkpoint go through the
+// apiserver impersonating the user, so the user needs get on pods and create
+// on nodes/proxy in addition to being in CheckpointGroups. Every request is
+// audited once, with its outcome.
+func checkpointHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req, ok := validateRexecRequest(w, r)
+	if !ok {
+		return
+	}
+	info := sessionInfo{
+		User: req.user, UID: req.uid, Groups: req.groups,
+		NameSpace: req.namespace, Pod: req.pod, Container: r.URL.Query().Get("container"), ClientIP: getIP(r),
+	}
+	ev := auditEvent{Session: uuid.New().String(), Info: info, Event: "container_checkpoint", Captured: clk.Now()}
+
+	result, status := checkpoint(r.Context(), ev.Session, req, info)
+	ev.Node = result.Node
+	if status != nil {
+		ev.Outcome, ev.Reason = "failure", status.Message
+		if status.Reason == metav1.StatusReasonForbidden {
+			ev.Outcome = "denied"
+		}
+	} else {
+		ev.Outcome, ev.Archives = "success", result.Items
+	}
+	checkpointsTotal.WithLabelValues(ev.Outcome).Inc()
+	if !queueAuditEvent(ev) {
+		recordError("checkpoint_audit")
+		SysLogger.Error().Str("user", req.user).Str("namespace", req.namespace).Str("pod", req.pod).Msg("failed to queue the container_checkpoint audit event")
+	}
+
+	if status != nil {
+		writeStatus(w, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		SysLogger.Error().Err(err).Msg("failed to write checkpoint response")
+	}
+}
+
+// checkpoint finds the node of the pod and has its kubelet checkpoint the
+// container. A non-nil Status is the error to answer with, a denial names id
+// for the user to quote.
+func checkpoint(ctx context.Context, id string, req rexecRequest, info sessionInfo) (checkpointResult, *metav1.Status) {
+	container := info.Container
+	if container == "" {
+		return checkpointResult{}, checkpointStatus(http.StatusBadRequest, metav1.StatusReasonBadRequest, "the container query parameter is required")
+	}
+	if !inCheckpointGroups(req.groups) {
+		return checkpointResult{}, newDenial("checkpoint_allow_group",
+			fmt.Sprintf("user %s may not checkpoint containers through rexec", req.user), id, info).status()
+	}
+	if err := ensureValidToken(); err != nil {
+		recordError("token")
+		return checkpointResult{}, checkpointStatus(http.StatusInternalServerError, metav1.StatusReasonInternalError, "failed to check the service account token")
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkpointTimeout)
+	defer cancel()
+
+	body, code, err := impersonatedAPIRequest(ctx, req, http.MethodGet,
+		fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(req.namespace), url.PathEscape(req.pod)))
+	if err != nil {
+		return checkpointResult{}, checkpointStatus(http.StatusBadGateway, metav1.StatusReasonServiceUnavailable, fmt.Sprintf("failed to look up the pod: %v", err))
+	}
+	if code != http.StatusOK {
+		return checkpointResult{}, checkpointStatus(code, metav1.StatusReasonUnknown, fmt.Sprintf("failed to look up pod %s/%s: %s", req.namespace, req.pod, http.StatusText(code)))
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(body, &pod); err != nil || pod.Spec.NodeName == "" {
+		return checkpointResult{}, checkpointStatus(http.StatusConflict, metav1.StatusReasonConflict, fmt.Sprintf("pod %s/%s is not scheduled on a node", req.namespace, req.pod))
+	}
+	result := checkpointResult{Node: pod.Spec.NodeName}
+
+	body, code, err = impersonatedAPIRequest(ctx, req, http.MethodPost, fmt.Sprintf("/api/v1/nodes/%s/proxy/checkpoint/%s/%s/%s",
+		url.PathEscape(pod.Spec.NodeName), url.PathEscape(req.namespace), url.PathEscape(req.pod), url.PathEscape(container)))
+	switch {
+	case err != nil:
+		return result, checkpointStatus(http.StatusBadGateway, metav1.StatusReasonServiceUnavailable, fmt.Sprintf("failed to reach the kubelet: %v", err))
+	case code == http.StatusNotFound:
+		// the kubelet only serves /checkpoint with the ContainerCheckpoint
+		// feature gate on
+		return result, checkpointStatus(http.StatusNotImplemented, metav1.StatusReasonNotFound,
+			fmt.Sprintf("container checkpointing is not available on node %s: it needs the ContainerCheckpoint feature gate and a runtime that supports it", pod.Spec.NodeName))
+	case code != http.StatusOK:
+		return result, checkpointStatus(code, metav1.StatusReasonUnknown, fmt.Sprintf("the kubelet of node %s refused the checkpoint: %s", pod.Spec.NodeName, truncateValue(string(body))))
+	}
+	var items struct {
+		Items []string `json:"items"`
+	}
+	if err := json.Unmarshal(body, &items); err != nil {
+		return result, checkpointStatus(http.StatusBadGateway, metav1.StatusReasonInternalError, fmt.Sprintf("unexpected answer of the kubelet: %v", err))
+	}
+	result.Items = items.Items
+	return result, nil
+}
+
+func inCheckpointGroups(groups []string) bool {
+	for _, allowed := range CheckpointGroups {
+		for _, g := range groups {
+			if g == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkpointStatus(code int, reason metav1.StatusReason, message string) *metav1.Status {
+	return &metav1.Status{Status: metav1.StatusFailure, Code: int32(code), Reason: reason, Message: message}
+}
+
+// impersonatedAPIRequest sends a request without a body to the apiserver as
+// the user of req and returns the response body and status code.
+func impersonatedAPIRequest(ctx context.Context, req rexecRequest, method, path string) ([]byte, int, error) {
+	hr, err := http.NewRequestWithContext(ctx, method, "https://"+apiServerDial+path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	hr.Header.Set("Authorization", "Bearer "+token)
+	hr.Header.Set("Impersonate-User", req.user)
+	for _, group := range req.groups {
+		hr.Header.Add("Impersonate-Group", group)
+	}
+	resp, err := (&http.Client{Transport: apiServerTransport()}).Do(hr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		//nolint:errcheck
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return body, resp.StatusCode, err
+}
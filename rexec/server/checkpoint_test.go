@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeAPIServer serves the pod lookup and the kubelet checkpoint behind the
+// node proxy, answering the checkpoint with kubeletStatus and kubeletBody, and
+// an exec of web-0 with execStatus when it is set. It records the paths and
+// the impersonated users it was asked for.
+type fakeAPIServer struct {
+	nodeName      string
+	kubeletStatus int
+	kubeletBody   string
+	execStatus    int
+	paths         []string
+	impersonated  []string
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.paths = append(f.paths, r.Method+" "+r.URL.Path)
+	f.impersonated = append(f.impersonated, r.Header.Get("Impersonate-User"))
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/default/pods/web-0":
+		//nolint:errcheck
+		_, _ = w.Write([]byte(`{"kind":"Pod","spec":{"nodeName":"` + f.nodeName + `"}}`))
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/v1/nodes/"+f.nodeName+"/proxy/checkpoint/"):
+		w.WriteHeader(f.kubeletStatus)
+		//nolint:errcheck
+		_, _ = w.Write([]byte(f.kubeletBody))
+	case f.execStatus != 0 && r.URL.Path == "/api/v1/namespaces/default/pods/web-0/exec":
+		w.WriteHeader(f.execStatus)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// withFakeAPIServer points the proxy at a TLS server running api, with a
+// service account token that does not expire during the test.
+func withFakeAPIServer(t *testing.T, api *fakeAPIServer) {
+	t.Helper()
+	srv := httptest.NewTLSServer(api)
+	t.Cleanup(srv.Close)
+
+	oldPool, oldHost, oldDial, oldToken := CAPool, apiServerHost, apiServerDial, token
+	t.Cleanup(func() { CAPool, apiServerHost, apiServerDial, token = oldPool, oldHost, oldDial, oldToken })
+	CAPool = x509.NewCertPool()
+	CAPool.AddCert(srv.Certificate())
+	// the httptest certificate is issued for example.com
+	apiServerHost, apiServerDial = "example.com", srv.Listener.Addr().String()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = signed
+}
+
+func withCheckpointGroups(t *testing.T, groups ...string) {
+	t.Helper()
+	old := CheckpointGroups
+	t.Cleanup(func() { CheckpointGroups = old })
+	CheckpointGroups = groups
+}
+
+func checkpointRequest(method, container string, groups ...string) *http.Request {
+	req := httptest.NewRequest(method, "/apis/audit.adyen.internal/v1beta1/namespaces/default/pods/web-0/checkpoint?container="+container, nil)
+	req.Header.Set("X-Remote-User", "alice")
+	for _, g := range groups {
+		req.Header.Add("X-Remote-Group", g)
+	}
+	req = withFrontProxyCert(req, "front-proxy-client")
+	return mux.SetURLVars(req, map[string]string{"namespace": "default", "pod": "web-0"})
+}
+
+func TestCheckpointHandler(t *testing.T) {
+	oldNames := RequestHeaderAllowedNames
+	t.Cleanup(func() { RequestHeaderAllowedNames = oldNames })
+	RequestHeaderAllowedNames = nil
+
+	tests := []struct {
+		name          string
+		allowed       []string
+		groups        []string
+		container     string
+		kubeletStatus int
+		kubeletBody   string
+		wantCode      int
+		wantOutcome   string
+		wantMessage   string
+		wantKubelet   bool
+	}{
+		{
+			name: "checkpointed", allowed: []string{"sre"}, groups: []string{"sre"}, container: "app",
+			kubeletStatus: http.StatusOK, kubeletBody: `{"items":["/var/lib/kubelet/checkpoints/checkpoint-web-0_default-app-2026.tar"]}`,
+			wantCode: http.StatusOK, wantOutcome: "success", wantKubelet: true,
+		},
+		{
+			name: "disabled", groups: []string{"sre"}, container: "app",
+			wantCode: http.StatusForbidden, wantOutcome: "denied", wantMessage: "may not checkpoint",
+		},
+		{
+			name: "not in an allowed group", allowed: []string{"sre"}, groups: []string{"dev"}, container: "app",
+			wantCode: http.StatusForbidden, wantOutcome: "denied", wantMessage: "may not checkpoint",
+		},
+		{
+			name: "no container", allowed: []string{"sre"}, groups: []string{"sre"},
+			wantCode: http.StatusBadRequest, wantOutcome: "failure", wantMessage: "container query parameter",
+		},
+		{
+			name: "feature gate off", allowed: []string{"sre"}, groups: []string{"sre"}, container: "app",
+			kubeletStatus: http.StatusNotFound, kubeletBody: "404 page not found",
+			wantCode: http.StatusNotImplemented, wantOutcome: "failure", wantMessage: "ContainerCheckpoint feature gate", wantKubelet: true,
+		},
+		{
+			name: "runtime error", allowed: []string{"sre"}, groups: []string{"sre"}, container: "app",
+			kubeletStatus: http.StatusInternalServerError, kubeletBody: "checkpointing is not supported by the runtime",
+			wantCode: http.StatusInternalServerError, wantOutcome: "failure", wantMessage: "not supported by the runtime", wantKubelet: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIServer{nodeName: "node-1", kubeletStatus: tt.kubeletStatus, kubeletBody: tt.kubeletBody}
+			withFakeAPIServer(t, api)
+			withCheckpointGroups(t, tt.allowed...)
+			stop := captureAdminEvents(t)
+
+			rr := httptest.NewRecorder()
+			checkpointHandler(rr, checkpointRequest(http.MethodPost, tt.container, tt.groups...))
+			events := stop()
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantCode, rr.Body)
+			}
+			if len(events) != 1 || events[0].Event != "container_checkpoint" || events[0].Outcome != tt.wantOutcome {
+				t.Fatalf("want one container_checkpoint with outcome %s, got %+v", tt.wantOutcome, events)
+			}
+			if ev := events[0]; ev.Info.User != "alice" || ev.Info.Pod != "web-0" || ev.Info.Container != tt.container {
+				t.Fatalf("unexpected session info %+v", ev.Info)
+			}
+			if kubelet := len(api.paths) == 2; kubelet != tt.wantKubelet {
+				t.Fatalf("kubelet called = %v, want %v: %v", kubelet, tt.wantKubelet, api.paths)
+			}
+			for _, user := range api.impersonated {
+				if user != "alice" {
+					t.Fatalf("apiserver request impersonated %q, want alice", user)
+				}
+			}
+
+			if tt.wantCode != http.StatusOK {
+				var status metav1.Status
+				if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+					t.Fatalf("body is not a Status: %v\n%s", err, rr.Body)
+				}
+				if !strings.Contains(status.Message, tt.wantMessage) || events[0].Reason != status.Message {
+					t.Fatalf("message %q, reason %q, want %q in both", status.Message, events[0].Reason, tt.wantMessage)
+				}
+				return
+			}
+			var result checkpointResult
+			if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Node != "node-1" || len(result.Items) != 1 || events[0].Node != "node-1" || events[0].Archives[0] != result.Items[0] {
+				t.Fatalf("unexpected result %+v, event %+v", result, events[0])
+			}
+			if want := "POST /api/v1/nodes/node-1/proxy/checkpoint/default/web-0/app"; api.paths[1] != want {
+				t.Fatalf("kubelet path = %q, want %q", api.paths[1], want)
+			}
+		})
+	}
+}
+
+func TestCheckpointHandlerRejectsGet(t *testing.T) {
+	withCheckpointGroups(t, "sre")
+	rr := httptest.NewRecorder()
+	checkpointHandler(rr, checkpointRequest(http.MethodGet, "app", "sre"))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", rr.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// auditCodec compresses the batches of the webhook sink and the segments of
+// its spool. Its value is what a spool segment records, it must not change.
+type auditCodec byte
+
+const (
+	codecIdentity auditCodec = iota
+	codecGzip
+	codecZstd
+	numAuditCodecs
+)
+
+// auditCodecNames are the names of the codecs as flags and Content-Encoding
+// have them.
+var auditCodecNames = [numAuditCodecs]string{
+	codecIdentity: "identity",
+	codecGzip:     "gzip",
+	codecZstd:     "zstd",
+}
+
+// AuditCompressionLevel is the level batches and segments are compressed at,
+// counted as by the zstd command, 1 to 19. gzip takes it up to its own best,
+// 9.
+var AuditCompressionLevel = 3
+
+// maxAuditBatchBytes bounds what a batch may decompress to, so a corrupted
+// segment can't claim all memory.
+const maxAuditBatchBytes = 64 << 20
+
+func (c auditCodec) String() string {
+	if c >= numAuditCodecs {
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+	return auditCodecNames[c]
+}
+
+// parseAuditCodec returns the codec named name. flag is the flag it came
+// from, for the error.
+func parseAuditCodec(flag, name string) (auditCodec, error) {
+	for c, n := range auditCodecNames {
+		if strings.EqualFold(name, n) {
+			return auditCodec(c), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported --%s %q, use zstd, gzip or identity", flag, name)
+}
+
+func validateCompressionLevel() error {
+	if AuditCompressionLevel < 1 || AuditCompressionLevel > 19 {
+		return fmt.Errorf("--audit-compression-level must be from 1 to 19, got %d", AuditCompressionLevel)
+	}
+	return nil
+}
+
+// zstdEncoders keeps an encoder per level, they are safe for concurrent use
+// and costly to build.
+var zstdEncoders = struct {
+	sync.Mutex
+	byLevel map[int]*zstd.Encoder
+}{byLevel: map[int]*zstd.Encoder{}}
+
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdEncoders.Lock()
+	defer zstdEncoders.Unlock()
+	if enc, ok := zstdEncoders.byLevel[level]; ok {
+		return enc, nil
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, err
+	}
+	zstdEncoders.byLevel[level] = enc
+	return enc, nil
+}
+
+// zstdDecoder decodes any number of batches at once.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxAuditBatchBytes))
+})
+
+// encode compresses data at level.
+func (c auditCodec) encode(data []byte, level int) ([]byte, error) {
+	switch c {
+	case codecIdentity:
+		return data, nil
+	case codecGzip:
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, min(level, gzip.BestCompression))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case codecZstd:
+		enc, err := zstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown audit codec %s", c)
+}
+
+// decode reverses encode. It fails rather than return more than
+// maxAuditBatchBytes.
+func (c auditCodec) decode(data []byte) ([]byte, error) {
+	switch c {
+	case codecIdentity:
+		return data, nil
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(io.LimitReader(r, maxAuditBatchBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxAuditBatchBytes {
+			return nil, fmt.Errorf("gzip batch larger than %d bytes", maxAuditBatchBytes)
+		}
+		return out, nil
+	case codecZstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown audit codec %s", c)
+}
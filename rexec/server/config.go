@@ -42,11 +42,31 @@ var RequestHeaderCAPool *x509.CertPool
 var RequestHeaderAllowedNames []string
 
 type sessionInfo struct {
-	User      string
-	NameSpace string
-	Pod       string
-	Container string
-	ClientIP  string
+	User string
+	// UID and Groups are the authenticated identity behind User, as passed on
+	// by the front proxy. Usernames can be reused, the UID tells the people
+	// behind them apart.
+	UID    string
+	Groups []string
+	// Impersonator is who acts as User through impersonation, if known.
+	Impersonator string
+	NameSpace    string
+	Pod          string
+	Container    string
+	ClientIP     string
+	// TTY is set when the client asked for a terminal, denials are written
+	// into it.
+	TTY bool
+	// Constraints are those the authorization webhook allowed the session
+	// with.
+	Constraints authzConstraints
+	// ChangeID is the change the session was opened for, if any.
+	ChangeID string
+	// Limits are resolved for the namespace when the session is registered.
+	Limits sessionLimits
+	// Upload is the directory an upload extracts into, set when the stdin of
+	// the session is audited as the entries of an archive.
+	Upload string
 }
 
 var token string
@@ -62,6 +82,10 @@ var commandMap map[string][]byte
 var commandSync sync.Mutex
 var SecretSauce string
 var ByPassedUsers []string
+
+// ByPassedUIDs are user UIDs allowed to bypass the webhook, which unlike
+// usernames are never handed on to someone else.
+var ByPassedUIDs []string
 var MaxStokesPerLine int
 var MetricsPort int
 var tokenSync sync.Mutex
@@ -77,6 +101,7 @@ func Init() {
 	}
 	auditLogger = zerolog.New(os.Stdout).With().Timestamp().Str("facility", "audit").Logger().Level(auditLevel)
 	SysLogger = zerolog.New(os.Stdout).With().Timestamp().Str("facility", "sys").Logger().Level(sysLevel)
+	startup.begin(StartupDeadline)
 
 	initAPIServer()
 
@@ -94,6 +119,7 @@ func Init() {
 		exitFn(1)
 		return
 	}
+	startup.markMet(startupToken)
 	sessionMap = make(map[string]sessionInfo)
 	commandMap = make(map[string][]byte)
 	asyncAuditChan = make(chan asyncAudit)
@@ -109,9 +135,92 @@ func Init() {
 			return
 		}
 	}
+	if KeyringFile != "" {
+		if err = loadKeyring(); err != nil {
+			SysLogger.Error().Err(err).Str("file", KeyringFile).Msg("failed to load the keyring")
+			exitFn(1)
+			return
+		}
+		go watchKeyring(nil)
+	}
+	startup.markMet(startupKeyring)
+	if err = validateGlobalLimits(); err != nil {
+		SysLogger.Error().Err(err).Msg("invalid session limits")
+		exitFn(1)
+		return
+	}
 	if MaxStokesPerLine == 0 {
 		MaxStokesPerLine = 2000
 	}
+	if AuditShards <= 0 {
+		AuditShards = DefaultAuditShards
+	}
+	if AuditSessionBuffer <= 0 {
+		AuditSessionBuffer = DefaultAuditSessionBuffer
+	}
+	if SampleEvery <= 0 {
+		SampleEvery = DefaultSampleEvery
+	}
+	if SessionLimitsFile != "" {
+		if err = loadLimits(); err != nil {
+			SysLogger.Error().Err(err).Str("file", SessionLimitsFile).Msg("failed to load the session limits")
+			exitFn(1)
+			return
+		}
+		go watchLimits(nil)
+	}
+	if DenialMessagesFile != "" {
+		if err = loadDenialMessages(); err != nil {
+			SysLogger.Error().Err(err).Str("file", DenialMessagesFile).Msg("failed to load the denial messages")
+			exitFn(1)
+			return
+		}
+	}
+	if ChangeIDRulesFile != "" {
+		if err = loadChangeIDRules(); err != nil {
+			SysLogger.Error().Err(err).Str("file", ChangeIDRulesFile).Msg("failed to load the change ID rules")
+			exitFn(1)
+			return
+		}
+	}
+	if AuthzWebhookURL != "" {
+		if err = loadAuthzWebhook(); err != nil {
+			SysLogger.Error().Err(err).Str("url", AuthzWebhookURL).Msg("failed to set up the authorization webhook")
+			exitFn(1)
+			return
+		}
+	}
+	if AuditWebhookURL != "" {
+		if err = loadAuditWebhook(); err != nil {
+			SysLogger.Error().Err(err).Str("url", AuditWebhookURL).Msg("failed to set up the audit webhook")
+			exitFn(1)
+			return
+		}
+	}
+	if RecordingsDir != "" {
+		if err = validateRecordings(); err != nil {
+			SysLogger.Error().Err(err).Str("dir", RecordingsDir).Msg("invalid recordings retention")
+			exitFn(1)
+			return
+		}
+	}
+	if WSMaxMessageSize <= 0 {
+		WSMaxMessageSize = DefaultWSMaxMessageSize
+	}
+	if IdentityMapFile != "" {
+		if identities, err = loadIdentityMap(IdentityMapFile, IdentityMapSize); err != nil {
+			SysLogger.Error().Err(err).Str("file", IdentityMapFile).Msg("failed to load the identity map")
+			exitFn(1)
+			return
+		}
+	}
+	startup.markMet(startupPolicy)
+	if MaxCommandArgs <= 0 {
+		MaxCommandArgs = DefaultMaxCommandArgs
+	}
+	if MaxCommandBytes <= 0 {
+		MaxCommandBytes = DefaultMaxCommandBytes
+	}
 
 	// load the front-proxy CA so inbound exec requests can be authenticated as
 	// genuinely coming from the kube-apiserver aggregation layer before we trust
@@ -122,7 +231,34 @@ func Init() {
 		return
 	}
 
+	if auditStaleness, err = parseSinkStaleness(AuditSinkStaleness); err != nil {
+		SysLogger.Error().Err(err).Msg("invalid audit sink staleness")
+		exitFn(1)
+		return
+	}
+
+	if err = validateAuditFailClosed(); err != nil {
+		SysLogger.Error().Err(err).Msg("invalid audit fail-closed mode")
+		exitFn(1)
+		return
+	}
+	auditPipelineAvailable.Set(1)
+
+	if err = validateAuditFormat(); err != nil {
+		SysLogger.Error().Err(err).Msg("invalid audit format")
+		exitFn(1)
+		return
+	}
+
 	go asyncAuditor()
+	go watchAuditSinks(nil)
+	if auditWebhook != nil && auditWebhook.spool != nil {
+		go auditWebhook.watchSpool(nil)
+	}
+	if RecordingsDir != "" {
+		go watchRecordings(nil)
+	}
+	emitProvenance("proxy_start")
 }
 
 func parseToken() (jwt.MapClaims, error) {
@@ -185,13 +321,12 @@ func loadFrontProxyConfig() error {
 	return nil
 }
 
-func logCommand(command, user, ctxid, namespace, pod, container, clientIP string) {
+func logCommand(command, ctxid string, info sessionInfo) {
 	auditCommandsTotal.Inc()
-	auditLogger.Info().Str("user", user).Str("session", ctxid).Str("namespace", namespace).Str("pod", pod).Str("container", container).Str("client_ip", clientIP).Str("command", command).Msg("")
-}
-
-func logSessionEvent(event, user, ctxid, namespace, pod, container, clientIP string) {
-	auditLogger.Info().Str("event", event).Str("user", user).Str("session", ctxid).Str("namespace", namespace).Str("pod", pod).Str("container", container).Str("client_ip", clientIP).Msg("")
+	ev := auditEvent{Session: ctxid, Info: info, Command: command, Captured: clk.Now()}
+	emitAudit(logSink{}.Name(), "command", zerolog.InfoLevel, legacyEventFields(ev), ev, func(e *zerolog.Event) *zerolog.Event {
+		return auditEventFields(e, ev)
+	})
 }
 
 var httpSpec = `
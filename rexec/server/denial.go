@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DenialMessagesFile configures the contact and the message template of the
+// denials, per rule. Without it denials carry no contact and use
+// defaultDenialTemplate.
+var DenialMessagesFile string
+
+// denialGrace is how long a denied TTY session is given to hand the client
+// its message before the session is cancelled anyway.
+const denialGrace = 2 * time.Second
+
+// defaultDenialTemplate is written into the terminal of a denied TTY session.
+const defaultDenialTemplate = `
++------------------------------------------------------------------
+| rexec: denied by rule {{.Rule}}
+| {{.Reason}}
+{{- if .Contact}}
+| Contact: {{.Contact}}
+{{- end}}
+| Session: {{.Session}} (quote it when asking about this)
++------------------------------------------------------------------
+`
+
+var defaultDenialTmpl = template.Must(template.New("").Parse(defaultDenialTemplate))
+
+// denialRule is the message of one rule in DenialMessagesFile, unset fields
+// are inherited from the default of the file.
+type denialRule struct {
+	Contact  string `json:"contact"`
+	Template string `json:"template"`
+}
+
+// denialConfig is a parsed DenialMessagesFile.
+type denialConfig struct {
+	Default denialRule            `json:"default"`
+	Rules   map[string]denialRule `json:"rules"`
+
+	templates map[string]*template.Template
+}
+
+// denialMessages is nil unless DenialMessagesFile is configured.
+var denialMessages *denialConfig
+
+// denial is why a session or request was refused, and the variables of the
+// message templates.
+type denial struct {
+	Rule      string
+	Reason    string
+	Contact   string
+	Session   string
+	User      string
+	Namespace string
+	Pod       string
+	Container string
+}
+
+// parseDenialMessages reads {"default":{...},"rules":{"<rule>":{...}}} and
+// checks that every template parses and renders.
+func parseDenialMessages(raw []byte) (*denialConfig, error) {
+	cfg := &denialConfig{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid denial messages: %w", err)
+	}
+	cfg.templates = map[string]*template.Template{}
+	rules := map[string]denialRule{"": cfg.Default}
+	for name, rule := range cfg.Rules {
+		rules[name] = rule
+	}
+	for name, rule := range rules {
+		if rule.Template == "" {
+			continue
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(rule.Template)
+		if err == nil {
+			err = tmpl.Execute(&bytes.Buffer{}, denial{})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid denial messages: template of rule %q: %w", name, err)
+		}
+		cfg.templates[name] = tmpl
+	}
+	return cfg, nil
+}
+
+func loadDenialMessages() error {
+	raw, err := os.ReadFile(DenialMessagesFile)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseDenialMessages(raw)
+	if err != nil {
+		return err
+	}
+	denialMessages = cfg
+	return nil
+}
+
+// newDenial fills in the contact configured for rule.
+func newDenial(rule, reason, session string, info sessionInfo) denial {
+	d := denial{
+		Rule: rule, Reason: reason, Session: session,
+		User: info.User, Namespace: info.NameSpace, Pod: info.Pod, Container: info.Container,
+	}
+	if cfg := denialMessages; cfg != nil {
+		d.Contact = cfg.Default.Contact
+		if r, ok := cfg.Rules[rule]; ok && r.Contact != "" {
+			d.Contact = r.Contact
+		}
+	}
+	return d
+}
+
+// message renders the template of the rule for a terminal. A template that
+// fails to render falls back to the default one, the denial is never lost.
+func (d denial) message() string {
+	tmpl := defaultDenialTmpl
+	if cfg := denialMessages; cfg != nil {
+		if t, ok := cfg.templates[d.Rule]; ok {
+			tmpl = t
+		} else if t, ok := cfg.templates[""]; ok {
+			tmpl = t
+		}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		SysLogger.Error().Err(err).Str("rule", d.Rule).Msg("failed to render the denial message")
+		buf.Reset()
+		//nolint:errcheck
+		_ = defaultDenialTmpl.Execute(&buf, d)
+	}
+	// the terminal of the client is in raw mode, it does not turn \n into
+	// \r\n on its own
+	return strings.ReplaceAll(strings.ReplaceAll(buf.String(), "\r\n", "\n"), "\n", "\r\n")
+}
+
+// denialFrame carries the message of d on the stdout channel of the
+// channel.k8s.io protocols kubectl speaks, a TTY has no separate stderr.
+func denialFrame(d denial) []byte {
+	return wsFrame(0x2, append([]byte{1}, d.message()...))
+}
+
+// status is the denial as the Status of a request that has no stream to write
+// the message into. The message stays on one line for kubectl, the rule, the
+// contact and the session are also in the causes for tools.
+func (d denial) status() *metav1.Status {
+	msg := fmt.Sprintf("denied by rule %s: %s (session %s", d.Rule, d.Reason, d.Session)
+	causes := []metav1.StatusCause{
+		{Type: "Rule", Message: d.Rule},
+		{Type: "Session", Message: d.Session},
+	}
+	if d.Contact != "" {
+		msg += ", contact " + d.Contact
+		causes = append(causes, metav1.StatusCause{Type: "Contact", Message: d.Contact})
+	}
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: msg + ")",
+		Reason:  metav1.StatusReasonForbidden,
+		Details: &metav1.StatusDetails{Name: d.Pod, Kind: "pods", Causes: causes},
+		Code:    http.StatusForbidden,
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rexectest "github.com/adyen/kubectl-rexec/rexec/server/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// blockingConn hands out the reads sent on reads, then blocks like an idle
+// apiserver until it is closed.
+type blockingConn struct {
+	stubConn
+	reads  chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{reads: make(chan []byte, 1), closed: make(chan struct{})}
+}
+
+func (c *blockingConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.reads:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *blockingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func withDenialMessages(t *testing.T, raw string) {
+	t.Helper()
+	old := denialMessages
+	t.Cleanup(func() { denialMessages = old })
+	cfg, err := parseDenialMessages([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	denialMessages = cfg
+}
+
+// deniedSession is a recorded session with a maximum duration of an hour on a
+// websocket logger.
+type deniedSession struct {
+	fc     *rexectest.FakeClock
+	logger *TCPLogger
+	w      *sessionWatchdog
+	// done is closed when the session is cancelled.
+	done      chan struct{}
+	stopAudit func()
+}
+
+// startDeniedSession starts the session, upgraded when the apiserver already
+// switched protocols.
+func startDeniedSession(t *testing.T, tty, upgraded bool) *deniedSession {
+	t.Helper()
+	s := &deniedSession{fc: withFakeClock(t, 0, time.Hour, 0), done: make(chan struct{})}
+	withSessionMaps(t)
+	captureAuditLocked(t)
+	s.stopAudit = runAuditPipeline(t)
+
+	conn := newBlockingConn()
+	s.logger = newWSLogger(conn)
+	s.logger.info = sessionInfo{User: "mallory", NameSpace: "default", Pod: "shell", TTY: tty}
+	s.w = startSessionWatchdog("s1", s.logger.info, func() { close(s.done) })
+	t.Cleanup(s.w.stop)
+	s.logger.watchdog = s.w
+	s.w.attach(s.logger)
+
+	if upgraded {
+		output := append(wsHeader(true, 0x2, 5, false), "\x01$ id"...)
+		conn.reads <- append([]byte(switchResponse), output...)
+		if n, err := s.logger.Read(make([]byte, 4096)); err != nil || n != len(switchResponse)+len(output) {
+			t.Fatalf("switch response: n=%d err=%v", n, err)
+		}
+	}
+	return s
+}
+
+// stop ends the session as the proxy does once the stream ended.
+func (s *deniedSession) stop() {
+	s.w.stop()
+	s.stopAudit()
+}
+
+func TestDenialBeforeUpgradeIsStatus(t *testing.T) {
+	withDenialMessages(t, `{"default":{"contact":"#sre-oncall"},"rules":{"session_max_duration":{"contact":"#security"}}}`)
+	s := startDeniedSession(t, true, false)
+	s.fc.Advance(time.Hour)
+	<-s.done
+	s.stop()
+
+	rr := httptest.NewRecorder()
+	s.w.errorHandler(func(http.ResponseWriter, *http.Request, error) {
+		t.Fatal("a denied session must not be answered as a proxy error")
+	})(rr, httptest.NewRequest(http.MethodGet, "/", nil), context.Canceled)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rr.Code)
+	}
+	var status metav1.Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("body is not a Status: %v\n%s", err, rr.Body)
+	}
+	want := "denied by rule session_max_duration: the session reached its maximum duration of 1h0m0s (session s1, contact #security)"
+	if status.Message != want || status.Reason != metav1.StatusReasonForbidden {
+		t.Fatalf("status %q %s, want %q", status.Message, status.Reason, want)
+	}
+	if strings.Contains(status.Message, "\n") {
+		t.Fatal("the Status message must stay on one line")
+	}
+	causes := map[metav1.CauseType]string{}
+	for _, c := range status.Details.Causes {
+		causes[c.Type] = c.Message
+	}
+	if causes["Rule"] != "session_max_duration" || causes["Session"] != "s1" || causes["Contact"] != "#security" {
+		t.Fatalf("unexpected causes %+v", status.Details.Causes)
+	}
+}
+
+func TestDenialProxyErrorWithoutDenial(t *testing.T) {
+	s := startDeniedSession(t, true, false)
+	s.stop()
+
+	called := false
+	s.w.errorHandler(func(http.ResponseWriter, *http.Request, error) { called = true })(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), errors.New("dial failed"))
+	if !called {
+		t.Fatal("an error of a session that was not denied must go to the proxy error handler")
+	}
+}
+
+func TestDenialAfterUpgradeInTerminal(t *testing.T) {
+	withDenialMessages(t, `{"default":{"contact":"#sre-oncall"}}`)
+	s := startDeniedSession(t, true, true)
+	s.fc.Advance(time.Hour)
+
+	data, err := readAll(t, s.logger)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the stream to the client to end with EOF, got %v", err)
+	}
+	d := newDenial("session_max_duration", "the session reached its maximum duration of 1h0m0s", "s1", s.logger.info)
+	want := append(denialFrame(d), wsCloseFrame(wsClosePolicyViolation, "denied")...)
+	if got := bytes.Join(data, nil); !bytes.Equal(got, want) {
+		t.Fatalf("client got %q, want the denial message and a close frame %q", got, want)
+	}
+	msg := d.message()
+	for _, part := range []string{"denied by rule session_max_duration", "maximum duration of 1h0m0s", "Contact: #sre-oncall", "Session: s1", "\r\n"} {
+		if !strings.Contains(msg, part) {
+			t.Fatalf("message %q lacks %q", msg, part)
+		}
+	}
+
+	// the proxy ends the session once the stream ended, cancel is only the
+	// fallback after denialGrace
+	if cancelled(s.done) {
+		t.Fatal("the session was cancelled before the client was handed the message")
+	}
+	eventually(t, "the grace timer", func() bool { return s.fc.Waiters() == 1 })
+	s.fc.Advance(denialGrace)
+	<-s.done
+	s.stop()
+	if got := s.w.endReason(); got != "session_max_duration" {
+		t.Fatalf("end reason = %q, want session_max_duration", got)
+	}
+}
+
+func TestDenialAfterUpgradeWithoutTTY(t *testing.T) {
+	s := startDeniedSession(t, false, true)
+	s.fc.Advance(time.Hour)
+	<-s.done
+	s.stop()
+	if s.logger.closing.Load() != nil {
+		t.Fatal("nothing may be written into the stream of a session without a TTY")
+	}
+}
+
+func TestDenialLimitExceededInTerminal(t *testing.T) {
+	withWSMaxMessageSize(t, 1024)
+	withFakeClock(t, 0, 0, 0)
+	conn := &scriptConn{reads: [][]byte{[]byte(switchResponse)}}
+	logger := newWSLogger(conn)
+	logger.info.TTY = true
+	if _, err := logger.Write([]byte(upgradeRequest)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.Read(make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logger.Write(wsHeader(true, 0x2, 1<<20, true)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readAll(t, logger)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the stream to the client to end with EOF, got %v", err)
+	}
+	got := bytes.Join(data, nil)
+	if !bytes.HasSuffix(got, wsCloseFrame(wsCloseMessageTooBig, "message too big")) || !bytes.Contains(got, []byte("denied by rule ws_max_message_size")) {
+		t.Fatalf("client got %q, want the denial message before the close frame", got)
+	}
+}
+
+func TestParseDenialMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{name: "valid", raw: `{"default":{"contact":"#sre"},"rules":{"session_idle_timeout":{"template":"{{.Rule}} {{.User}}@{{.Namespace}}/{{.Pod}}"}}}`},
+		{name: "unknown field", raw: `{"default":{"contacts":"#sre"}}`, wantErr: "unknown field"},
+		{name: "bad template", raw: `{"default":{"template":"{{.Rule"}}`, wantErr: "template of rule"},
+		{name: "unknown variable", raw: `{"rules":{"x":{"template":"{{.Team}}"}}}`, wantErr: `rule "x"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDenialMessages([]byte(tt.raw))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDenialTemplatePerRule(t *testing.T) {
+	withDenialMessages(t, `{"default":{"contact":"#sre","template":"default {{.Rule}}\n"},
+		"rules":{"session_idle_timeout":{"template":"{{.User}} on {{.Namespace}}/{{.Pod}}/{{.Container}}: {{.Reason}}, ask {{.Contact}} quoting {{.Session}}\n"}}}`)
+	info := sessionInfo{User: "alice", NameSpace: "default", Pod: "web-0", Container: "app"}
+
+	if got := newDenial("session_idle_timeout", "idle", "s1", info).message(); got != "alice on default/web-0/app: idle, ask #sre quoting s1\r\n" {
+		t.Fatalf("rule template rendered %q", got)
+	}
+	if got := newDenial("session_max_duration", "too long", "s1", info).message(); got != "default session_max_duration\r\n" {
+		t.Fatalf("default template rendered %q", got)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// IdentityMapFile keeps the last UID seen for every username, so a username
+// handed on to someone else is noticed across restarts. It should be on a
+// persistent volume; when it is not set the check is off.
+var IdentityMapFile string
+
+// IdentityMapSize bounds the usernames kept in IdentityMapFile, the least
+// recently seen are evicted first.
+var IdentityMapSize int
+
+// DefaultIdentityMapSize is used when IdentityMapSize is not set.
+const DefaultIdentityMapSize = 10000
+
+// identities is nil unless IdentityMapFile is configured.
+var identities *identityMap
+
+// identityEntry is the last UID a username was seen with.
+type identityEntry struct {
+	User     string    `json:"user"`
+	UID      string    `json:"uid"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// identityMap is a size-bounded LRU of username to last seen UID, written back
+// to its file on every change.
+type identityMap struct {
+	mu   sync.Mutex
+	path string
+	size int
+	// order holds *identityEntry, most recently seen first.
+	order  *list.List
+	byUser map[string]*list.Element
+}
+
+// loadIdentityMap reads {"entries":[{"user","uid","last_seen"}]} from path, a
+// missing file is an empty map.
+func loadIdentityMap(path string, size int) (*identityMap, error) {
+	if size <= 0 {
+		size = DefaultIdentityMapSize
+	}
+	m := &identityMap{path: path, size: size, order: list.New(), byUser: map[string]*list.Element{}}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Entries []identityEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid identity map: %w", err)
+	}
+	for _, e := range doc.Entries {
+		if _, dup := m.byUser[e.User]; dup || e.User == "" {
+			continue
+		}
+		entry := e
+		m.byUser[e.User] = m.order.PushBack(&entry)
+	}
+	m.evict()
+	return m, nil
+}
+
+// observe records that user authenticated with uid. When user was last seen
+// with another UID, that UID is returned with changed set. Requests without a
+// UID are not recorded, the front proxy may not pass one on.
+func (m *identityMap) observe(user, uid string) (previous string, changed bool, err error) {
+	if user == "" || uid == "" {
+		return "", false, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := clk.Now()
+	if el, ok := m.byUser[user]; ok {
+		entry := el.Value.(*identityEntry)
+		previous, changed = entry.UID, entry.UID != uid
+		entry.UID, entry.LastSeen = uid, now
+		m.order.MoveToFront(el)
+	} else {
+		m.byUser[user] = m.order.PushFront(&identityEntry{User: user, UID: uid, LastSeen: now})
+		m.evict()
+	}
+	return previous, changed, m.save()
+}
+
+// evict drops the least recently seen entries over the size bound. Callers
+// hold m.mu or own m.
+func (m *identityMap) evict() {
+	for m.order.Len() > m.size {
+		el := m.order.Back()
+		delete(m.byUser, el.Value.(*identityEntry).User)
+		m.order.Remove(el)
+	}
+}
+
+// save writes the map through a temporary file, so a crash never leaves a
+// truncated one. Callers hold m.mu.
+func (m *identityMap) save() error {
+	doc := struct {
+		Entries []identityEntry `json:"entries"`
+	}{Entries: make([]identityEntry, 0, m.order.Len())}
+	for el := m.order.Front(); el != nil; el = el.Next() {
+		doc.Entries = append(doc.Entries, *el.Value.(*identityEntry))
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), ".identities-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		//nolint:errcheck
+		_ = tmp.Close()
+		//nolint:errcheck
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		//nolint:errcheck
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// checkIdentity emits an identity_uid_changed audit event when the user of a
+// session is known under another UID. The event follows session_start for a
+// recorded session.
+func checkIdentity(ctxid string, info sessionInfo) {
+	if identities == nil {
+		return
+	}
+	previous, changed, err := identities.observe(info.User, info.UID)
+	if err != nil {
+		recordError("identity_map")
+		SysLogger.Error().Err(err).Str("file", identities.path).Msg("failed to update the identity map")
+	}
+	if !changed {
+		return
+	}
+	identityUIDChangesTotal.Inc()
+	enqueueEvent(sessionBufferFor(ctxid), auditEvent{
+		Session: ctxid, Info: info, Event: "identity_uid_changed", Captured: clk.Now(), PreviousUID: previous,
+	})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestIdentityMap(t *testing.T, size int) (*identityMap, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "identities.json")
+	m, err := loadIdentityMap(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, path
+}
+
+func observe(t *testing.T, m *identityMap, user, uid string) (string, bool) {
+	t.Helper()
+	previous, changed, err := m.observe(user, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return previous, changed
+}
+
+func TestIdentityMapObserve(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	m, path := newTestIdentityMap(t, 10)
+
+	if previous, changed := observe(t, m, "alice", "uid-1"); changed || previous != "" {
+		t.Fatalf("first seen: previous %q changed %v", previous, changed)
+	}
+	if previous, changed := observe(t, m, "alice", "uid-1"); changed || previous != "uid-1" {
+		t.Fatalf("unchanged: previous %q changed %v", previous, changed)
+	}
+	if previous, changed := observe(t, m, "alice", "uid-2"); !changed || previous != "uid-1" {
+		t.Fatalf("changed: previous %q changed %v, want uid-1 and changed", previous, changed)
+	}
+	if _, changed := observe(t, m, "alice", ""); changed {
+		t.Fatal("a request without a UID must not count as a change")
+	}
+
+	// the new UID survives a restart
+	reloaded, err := loadIdentityMap(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous, changed := observe(t, reloaded, "alice", "uid-2"); changed || previous != "uid-2" {
+		t.Fatalf("after reload: previous %q changed %v, want uid-2 unchanged", previous, changed)
+	}
+}
+
+func TestIdentityMapEvictsLeastRecentlySeen(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	m, path := newTestIdentityMap(t, 2)
+
+	observe(t, m, "alice", "uid-a")
+	fc.Advance(time.Second)
+	observe(t, m, "bob", "uid-b")
+	fc.Advance(time.Second)
+	// seeing alice again makes bob the least recently seen
+	observe(t, m, "alice", "uid-a")
+	fc.Advance(time.Second)
+	observe(t, m, "carol", "uid-c")
+
+	reloaded, err := loadIdentityMap(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, known := reloaded.byUser["bob"]; known {
+		t.Fatal("bob should have been evicted")
+	}
+	if previous, changed := observe(t, reloaded, "bob", "uid-other"); changed || previous != "" {
+		t.Fatalf("an evicted user is first seen again, got previous %q changed %v", previous, changed)
+	}
+	if previous, changed := observe(t, reloaded, "carol", "uid-other"); !changed || previous != "uid-c" {
+		t.Fatalf("carol: previous %q changed %v", previous, changed)
+	}
+}
+
+func TestLoadIdentityMapInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identities.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadIdentityMap(path, 10); err == nil {
+		t.Fatal("expected an error for a corrupt identity map")
+	}
+}
+
+func TestCheckIdentityEmitsEventAfterSessionStart(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	m, _ := newTestIdentityMap(t, 10)
+	old := identities
+	t.Cleanup(func() { identities = old })
+	identities = m
+	before := testutil.ToFloat64(identityUIDChangesTotal)
+
+	observe(t, m, "alice", "uid-old")
+	info := sessionInfo{User: "alice", UID: "uid-new", Groups: []string{"sre"}}
+	registerSession("s1", info)
+	checkIdentity("s1", info)
+
+	items := sessionBufferFor("s1").take()
+	if len(items) != 2 || items[0].event.Event != "session_start" {
+		t.Fatalf("expected session_start and the identity event, got %+v", items)
+	}
+	ev := items[1].event
+	if ev.Event != "identity_uid_changed" || ev.PreviousUID != "uid-old" || ev.Info.UID != "uid-new" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if got := testutil.ToFloat64(identityUIDChangesTotal) - before; got != 1 {
+		t.Fatalf("counter delta = %v, want 1", got)
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// KeyringFile is a mounted secret holding the keys the shared secret between
+// the apiservice and the validating webhook is derived from. When it is not
+// set, SecretSauce is used as before.
+var KeyringFile string
+
+// KeyringReloadInterval is how often KeyringFile is checked for changes.
+var KeyringReloadInterval = 30 * time.Second
+
+// sauceTokenPrefix marks a keyring signed secret-sauce value, as opposed to
+// the plain SecretSauce.
+const sauceTokenPrefix = "v1."
+
+// keyringKey is one key of the keyring. A zero NotBefore or NotAfter leaves that
+// side of the validity window open.
+type keyringKey struct {
+	ID        string    `json:"id"`
+	Secret    string    `json:"secret"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+}
+
+func (k keyringKey) validAt(now time.Time) bool {
+	return (k.NotBefore.IsZero() || !now.Before(k.NotBefore)) && (k.NotAfter.IsZero() || now.Before(k.NotAfter))
+}
+
+// keyring is an immutable set of keys, replaced as a whole on reload.
+type keyring struct {
+	keys []keyringKey
+	// raw is the file content the keyring was parsed from, to skip reloads of
+	// an unchanged file.
+	raw []byte
+}
+
+// activeKeyring is nil unless KeyringFile is configured.
+var activeKeyring atomic.Pointer[keyring]
+
+// parseKeyring reads {"keys":[{"id","secret","not_before","not_after"}]}.
+func parseKeyring(raw []byte) (*keyring, error) {
+	var doc struct {
+		Keys []keyringKey `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid keyring: %w", err)
+	}
+	if len(doc.Keys) == 0 {
+		return nil, errors.New("invalid keyring: no keys")
+	}
+	seen := map[string]bool{}
+	for _, k := range doc.Keys {
+		switch {
+		case k.ID == "" || strings.ContainsAny(k.ID, ". "):
+			return nil, fmt.Errorf("invalid keyring: key id %q must be non-empty without dots or spaces", k.ID)
+		case seen[k.ID]:
+			return nil, fmt.Errorf("invalid keyring: duplicate key id %q", k.ID)
+		case len(k.Secret) < 16:
+			return nil, fmt.Errorf("invalid keyring: secret of key %q is shorter than 16 bytes", k.ID)
+		case !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotAfter.After(k.NotBefore):
+			return nil, fmt.Errorf("invalid keyring: key %q expires before it becomes valid", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return &keyring{keys: doc.Keys, raw: raw}, nil
+}
+
+// current returns the key new material is signed with: of the keys valid at
+// now, the one that became valid last.
+func (kr *keyring) current(now time.Time) (keyringKey, bool) {
+	var best keyringKey
+	found := false
+	for _, k := range kr.keys {
+		if !k.validAt(now) {
+			continue
+		}
+		if !found || k.NotBefore.After(best.NotBefore) {
+			best, found = k, true
+		}
+	}
+	return best, found
+}
+
+func (kr *keyring) lookup(id string, now time.Time) (keyringKey, bool) {
+	for _, k := range kr.keys {
+		if k.ID == id && k.validAt(now) {
+			return k, true
+		}
+	}
+	return keyringKey{}, false
+}
+
+// sign returns the MAC of msg under the current key and that key's ID.
+func (kr *keyring) sign(msg []byte, now time.Time) (keyID string, mac []byte, err error) {
+	k, ok := kr.current(now)
+	if !ok {
+		return "", nil, errors.New("keyring has no currently valid key")
+	}
+	return k.ID, keyMAC(k, msg), nil
+}
+
+// verify checks mac against the key keyID, which must be valid at now.
+func (kr *keyring) verify(keyID string, msg, mac []byte, now time.Time) bool {
+	k, ok := kr.lookup(keyID, now)
+	return ok && hmac.Equal(mac, keyMAC(k, msg))
+}
+
+func keyMAC(k keyringKey, msg []byte) []byte {
+	h := hmac.New(sha256.New, []byte(k.Secret))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// sauceMessage binds a secret-sauce token to the impersonated user, so a token
+// seen for one user cannot be replayed for another.
+func sauceMessage(user string) []byte {
+	return []byte("rexec-secret-sauce\x00" + user)
+}
+
+// secretSauceFor returns the value forwarded as the secret-sauce user extra:
+// v1.<key id>.<mac> with a keyring, the plain SecretSauce without one.
+func secretSauceFor(user string) (string, error) {
+	kr := activeKeyring.Load()
+	if kr == nil {
+		return SecretSauce, nil
+	}
+	keyID, mac, err := kr.sign(sauceMessage(user), clk.Now())
+	if err != nil {
+		return "", err
+	}
+	return sauceTokenPrefix + keyID + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// validSecretSauce reports whether sauce proves the request came through the
+// rexec endpoint for user. With a keyring the plain SecretSauce is no longer
+// accepted.
+func validSecretSauce(sauce, user string) bool {
+	kr := activeKeyring.Load()
+	if kr == nil {
+		return sauce == SecretSauce
+	}
+	rest, ok := strings.CutPrefix(sauce, sauceTokenPrefix)
+	if !ok {
+		return false
+	}
+	keyID, encoded, ok := strings.Cut(rest, ".")
+	if !ok {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	return kr.verify(keyID, sauceMessage(user), mac, clk.Now())
+}
+
+// loadKeyring reads KeyringFile and makes it the active keyring.
+func loadKeyring() error {
+	raw, err := os.ReadFile(KeyringFile)
+	if err != nil {
+		return err
+	}
+	kr, err := parseKeyring(raw)
+	if err != nil {
+		return err
+	}
+	if _, ok := kr.current(clk.Now()); !ok {
+		return errors.New("keyring has no currently valid key")
+	}
+	activeKeyring.Store(kr)
+	return nil
+}
+
+// reloadKeyring re-reads KeyringFile if its content changed. A file that cannot
+// be read or parsed keeps the existing keyring and is reported. Every reload
+// attempt is an admin action.
+func reloadKeyring() {
+	old := activeKeyring.Load()
+	raw, err := os.ReadFile(KeyringFile)
+	if err == nil && old != nil && bytes.Equal(raw, old.raw) {
+		return
+	}
+	var kr *keyring
+	if err == nil {
+		kr, err = parseKeyring(raw)
+	}
+	action := adminAction{Action: "keyring_reload", Actor: adminActor, Target: KeyringFile, After: configHash(raw)}
+	if old != nil {
+		action.Before = configHash(old.raw)
+	}
+	if !auditAdmin(action, err) {
+		return
+	}
+	if err != nil {
+		keyringReloadsTotal.WithLabelValues("failure").Inc()
+		recordError("keyring_reload")
+		SysLogger.Error().Err(err).Str("file", KeyringFile).Msg("failed to reload keyring, keeping the current keys")
+		return
+	}
+	activeKeyring.Store(kr)
+	keyringReloadsTotal.WithLabelValues("success").Inc()
+	SysLogger.Info().Int("keys", len(kr.keys)).Msg("reloaded keyring")
+	emitProvenance("proxy_config")
+}
+
+// watchKeyring reloads the keyring every KeyringReloadInterval and emits a
+// key_rotation event whenever the signing key changes, be it through a reload
+// or because a new key became valid.
+func watchKeyring(stop <-chan struct{}) {
+	ticker := clk.NewTicker(KeyringReloadInterval)
+	defer ticker.Stop()
+	signing := currentKeyID()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			previous := activeKeyring.Load()
+			reloadKeyring()
+			if next := currentKeyID(); next != signing {
+				logKeyRotation(previous, signing, next)
+				signing = next
+			}
+		}
+	}
+}
+
+func currentKeyID() string {
+	kr := activeKeyring.Load()
+	if kr == nil {
+		return ""
+	}
+	k, _ := kr.current(clk.Now())
+	return k.ID
+}
+
+// logKeyRotation emits the key_rotation audit event binding the old and the
+// new signing key: each MACs the transition, so the event can be verified with
+// either key and a forged rotation cannot be made without both.
+func logKeyRotation(previous *keyring, oldID, newID string) {
+	msg := []byte("key_rotation\x00" + oldID + "\x00" + newID)
+	var oldMAC, newMAC string
+	if previous != nil {
+		for _, k := range previous.keys {
+			if k.ID == oldID {
+				oldMAC = hex.EncodeToString(keyMAC(k, msg))
+			}
+		}
+	}
+	if kr := activeKeyring.Load(); kr != nil {
+		for _, k := range kr.keys {
+			if k.ID == newID {
+				newMAC = hex.EncodeToString(keyMAC(k, msg))
+			}
+		}
+	}
+	fields := func(e *zerolog.Event) *zerolog.Event {
+		e = e.Str("old_key_id", oldID).Str("new_key_id", newID)
+		if oldMAC != "" {
+			e = e.Str("old_key_mac", oldMAC)
+		}
+		if newMAC != "" {
+			e = e.Str("new_key_mac", newMAC)
+		}
+		return e
+	}
+	legacy := func(e *zerolog.Event) *zerolog.Event { return fields(e.Str("event", "key_rotation")) }
+	emitAudit(logSink{}.Name(), "key_rotation", zerolog.InfoLevel, legacy, auditEvent{Captured: clk.Now()}, fields)
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	keyOld = `{"id": "old", "secret": "0123456789abcdef-old", "not_after": "2024-01-11T00:00:00Z"}`
+	keyNew = `{"id": "new", "secret": "0123456789abcdef-new", "not_before": "2024-01-08T00:00:00Z"}`
+)
+
+var keyringEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// restoreKeyring puts the active keyring back after the test.
+func restoreKeyring(t *testing.T) {
+	t.Helper()
+	old := activeKeyring.Load()
+	t.Cleanup(func() { activeKeyring.Store(old) })
+}
+
+func withKeyring(t *testing.T, raw string) {
+	t.Helper()
+	restoreKeyring(t)
+	kr, err := parseKeyring([]byte(raw))
+	if err != nil {
+		t.Fatalf("parseKeyring: %v", err)
+	}
+	activeKeyring.Store(kr)
+}
+
+func keyringFile(t *testing.T, keys ...string) string {
+	t.Helper()
+	old := KeyringFile
+	t.Cleanup(func() { KeyringFile = old })
+	KeyringFile = filepath.Join(t.TempDir(), "keyring.json")
+	writeKeyringFile(t, keys...)
+	return KeyringFile
+}
+
+func writeKeyringFile(t *testing.T, keys ...string) {
+	t.Helper()
+	if err := os.WriteFile(KeyringFile, []byte(`{"keys": [`+strings.Join(keys, ",")+`]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyringVerifiesAcrossRotation(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	fc.Advance(keyringEpoch.Sub(fc.Now()) + 24*time.Hour) // Jan 2, only the old key
+	withKeyring(t, `{"keys": [`+keyOld+`,`+keyNew+`]}`)
+
+	before, err := secretSauceFor("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(before, "v1.old.") {
+		t.Fatalf("expected a token signed with the old key, got %q", before)
+	}
+
+	fc.Advance(7 * 24 * time.Hour) // Jan 9, both valid, the new key signs
+	after, err := secretSauceFor("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(after, "v1.new.") {
+		t.Fatalf("expected a token signed with the new key, got %q", after)
+	}
+	if !validSecretSauce(before, "alice") || !validSecretSauce(after, "alice") {
+		t.Fatal("both keys must verify during the overlap")
+	}
+
+	fc.Advance(3 * 24 * time.Hour) // Jan 12, the old key expired
+	if validSecretSauce(before, "alice") {
+		t.Fatal("a token signed with an expired key must be rejected")
+	}
+	if !validSecretSauce(after, "alice") {
+		t.Fatal("the new key must still verify")
+	}
+}
+
+func TestValidSecretSauceRejectsForgeries(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	withKeyring(t, `{"keys": [{"id": "k1", "secret": "0123456789abcdef-k1"}]}`)
+	oldSauce := SecretSauce
+	t.Cleanup(func() { SecretSauce = oldSauce })
+	SecretSauce = "the-right-sauce"
+
+	token, err := secretSauceFor("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a character in the middle of the mac, the last one carries padding bits
+	i := len(token) - 10
+	flipped := byte('A')
+	if token[i] == 'A' {
+		flipped = 'B'
+	}
+	tampered := token[:i] + string(flipped) + token[i+1:]
+
+	tests := []struct {
+		name  string
+		sauce string
+		user  string
+		want  bool
+	}{
+		{"valid", token, "alice", true},
+		{"other user", token, "mallory", false},
+		{"unknown key", strings.Replace(token, "v1.k1.", "v1.k2.", 1), "alice", false},
+		{"tampered mac", tampered, "alice", false},
+		{"plain secret sauce", "the-right-sauce", "alice", false},
+		{"no prefix", strings.TrimPrefix(token, "v1."), "alice", false},
+		{"garbage", "v1.k1.!!!", "alice", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validSecretSauce(tt.sauce, tt.user); got != tt.want {
+				t.Fatalf("validSecretSauce(%q, %q) = %v, want %v", tt.sauce, tt.user, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanPassKeyringToken(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	withKeyring(t, `{"keys": [{"id": "k1", "secret": "0123456789abcdef-k1"}]}`)
+	oldBypass := ByPassedUsers
+	t.Cleanup(func() { ByPassedUsers = oldBypass })
+	ByPassedUsers = nil
+
+	token, err := secretSauceFor("lauren")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !canPass(makeAdmissionReview("", "lauren", map[string][]string{"secret-sauce": {token}})) {
+		t.Fatal("expected canPass true for a keyring token")
+	}
+	if canPass(makeAdmissionReview("", "someone-else", map[string][]string{"secret-sauce": {token}})) {
+		t.Fatal("expected canPass false for a token of another user")
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{"valid", `{"keys": [` + keyOld + `,` + keyNew + `]}`, ""},
+		{"not json", `keys: []`, "invalid keyring"},
+		{"no keys", `{"keys": []}`, "no keys"},
+		{"empty id", `{"keys": [{"id": "", "secret": "0123456789abcdef"}]}`, "key id"},
+		{"dotted id", `{"keys": [{"id": "a.b", "secret": "0123456789abcdef"}]}`, "key id"},
+		{"duplicate", `{"keys": [{"id": "a", "secret": "0123456789abcdef"}, {"id": "a", "secret": "0123456789abcdef"}]}`, "duplicate"},
+		{"short secret", `{"keys": [{"id": "a", "secret": "short"}]}`, "shorter"},
+		{"inverted window", `{"keys": [{"id": "a", "secret": "0123456789abcdef", "not_before": "2024-02-01T00:00:00Z", "not_after": "2024-01-01T00:00:00Z"}]}`, "expires before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseKeyring([]byte(tt.raw))
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReloadKeyringKeepsKeysOnFailure(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	captureAdminEvents(t)
+	keyringFile(t, `{"id": "k1", "secret": "0123456789abcdef-k1"}`)
+	restoreKeyring(t)
+	if err := loadKeyring(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := activeKeyring.Load()
+
+	before := testutil.ToFloat64(keyringReloadsTotal.WithLabelValues("failure"))
+	if err := os.WriteFile(KeyringFile, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadKeyring()
+
+	if activeKeyring.Load() != loaded {
+		t.Fatal("a failed reload must keep the current keyring")
+	}
+	if got := testutil.ToFloat64(keyringReloadsTotal.WithLabelValues("failure")); got != before+1 {
+		t.Fatalf("failure counter delta = %v, want 1", got-before)
+	}
+
+	writeKeyringFile(t, `{"id": "k2", "secret": "0123456789abcdef-k2"}`)
+	reloadKeyring()
+	if id := currentKeyID(); id != "k2" {
+		t.Fatalf("current key after reload = %q, want k2", id)
+	}
+}
+
+func TestWatchKeyringEmitsKeyRotation(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	fc.Advance(keyringEpoch.Sub(fc.Now()) + 24*time.Hour)
+	buf := captureAuditLocked(t)
+	captureAdminEvents(t)
+	keyringFile(t, keyOld)
+	restoreKeyring(t)
+	if err := loadKeyring(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchKeyring(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	eventually(t, "reload ticker", func() bool { return fc.Waiters() == 1 })
+
+	// the new key is added to the mounted secret and becomes valid later
+	writeKeyringFile(t, keyOld, keyNew)
+	fc.Advance(KeyringReloadInterval)
+	eventually(t, "reload", func() bool { return len(activeKeyring.Load().keys) == 2 })
+	if buf.count("key_rotation") != 0 {
+		t.Fatalf("no rotation expected before the new key is valid: %s", buf.String())
+	}
+
+	fc.Advance(7 * 24 * time.Hour)
+	eventually(t, "key_rotation event", func() bool { return buf.count(`"event":"key_rotation"`) == 1 })
+	out := buf.String()
+	for _, want := range []string{`"old_key_id":"old"`, `"new_key_id":"new"`, `"old_key_mac":"`, `"new_key_mac":"`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("key_rotation event lacks %s: %s", want, out)
+		}
+	}
+}
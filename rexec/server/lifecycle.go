@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// StartupDeadline fails the process when it is not ready this long after Init
+// started. Zero waits forever.
+var StartupDeadline = 2 * time.Minute
+
+// PreReadyQueueTimeout holds an exec request arriving before the server is
+// ready for up to this long, instead of refusing it right away.
+var PreReadyQueueTimeout time.Duration
+
+// PreReadyQueueSize is how many requests PreReadyQueueTimeout holds at once,
+// the ones past it are refused right away.
+var PreReadyQueueSize = 32
+
+// startupRetryAfter is the Retry-After, in seconds, of a request refused
+// before the server is ready.
+const startupRetryAfter = 5
+
+// The conditions of the startup barrier.
+const (
+	startupToken     = "token"
+	startupKeyring   = "keyring"
+	startupPolicy    = "policy"
+	startupAuditSink = "audit_sink"
+)
+
+var startupConditions = []string{startupToken, startupKeyring, startupPolicy, startupAuditSink}
+
+// startupBarrier keeps the exec endpoints closed until everything a session
+// depends on is loaded: the service account token, the keyring, the policy
+// files and a running audit pipeline. It only ever opens once, what fails
+// later is reported by /readyz and the reloads.
+type startupBarrier struct {
+	mu      sync.Mutex
+	started time.Time
+	met     map[string]bool
+	queued  int
+	ready   chan struct{}
+}
+
+var startup = newStartupBarrier()
+
+func newStartupBarrier() *startupBarrier {
+	return &startupBarrier{started: clk.Now(), met: map[string]bool{}, ready: make(chan struct{})}
+}
+
+// begin restarts the clock of the barrier and fails the process through
+// exitFn when it is still closed after deadline.
+func (b *startupBarrier) begin(deadline time.Duration) {
+	b.mu.Lock()
+	b.started = clk.Now()
+	b.mu.Unlock()
+	if deadline > 0 {
+		go b.enforceDeadline(deadline)
+	}
+}
+
+func (b *startupBarrier) enforceDeadline(deadline time.Duration) {
+	timer := clk.NewTimer(deadline)
+	defer timer.Stop()
+	select {
+	case <-b.ready:
+	case <-timer.C():
+		SysLogger.Error().Strs("pending", b.pending()).Dur("deadline", deadline).Msg("rexec did not get ready before the startup deadline")
+		exitFn(1)
+	}
+}
+
+// markMet records that condition is met, and opens the barrier once all are.
+func (b *startupBarrier) markMet(condition string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.met[condition] {
+		return
+	}
+	b.met[condition] = true
+	pending := b.pendingLocked()
+	SysLogger.Info().Str("condition", condition).Strs("pending", pending).Msg("startup condition met")
+	if len(pending) == 0 {
+		close(b.ready)
+		startupReady.Set(1)
+		SysLogger.Info().Dur("startup_duration", clk.Since(b.started)).Msg("rexec is ready to serve sessions")
+	}
+}
+
+func (b *startupBarrier) isReady() bool {
+	select {
+	case <-b.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// pending returns the conditions not met yet, in the order they are met in a
+// normal startup.
+func (b *startupBarrier) pending() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pendingLocked()
+}
+
+func (b *startupBarrier) pendingLocked() []string {
+	pending := []string{}
+	for _, c := range startupConditions {
+		if !b.met[c] {
+			pending = append(pending, c)
+		}
+	}
+	return pending
+}
+
+// wait holds a request until the barrier opens, for at most timeout and while
+// fewer than PreReadyQueueSize requests are held. It returns the outcome:
+// admitted, queue_full, timed_out or cancelled.
+func (b *startupBarrier) wait(r *http.Request, timeout time.Duration) string {
+	b.mu.Lock()
+	if b.queued >= PreReadyQueueSize {
+		b.mu.Unlock()
+		return "queue_full"
+	}
+	b.queued++
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.queued--
+		b.mu.Unlock()
+	}()
+
+	timer := clk.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-b.ready:
+		return "admitted"
+	case <-timer.C():
+		return "timed_out"
+	case <-r.Context().Done():
+		return "cancelled"
+	}
+}
+
+// startupStatus is the startup barrier in the /readyz details.
+type startupStatus struct {
+	Ready          bool     `json:"ready"`
+	Pending        []string `json:"pending"`
+	ElapsedSeconds float64  `json:"elapsed_seconds"`
+}
+
+func (b *startupBarrier) status() startupStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return startupStatus{Ready: b.isReady(), Pending: b.pendingLocked(), ElapsedSeconds: clk.Since(b.started).Seconds()}
+}
+
+// requireReady answers the requests to next with a 503 and a Retry-After until
+// the startup barrier opens, after holding them for PreReadyQueueTimeout if it
+// is set.
+func requireReady(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := startup
+		if b.isReady() {
+			next(w, r)
+			return
+		}
+		outcome := "rejected"
+		if PreReadyQueueTimeout > 0 {
+			outcome = b.wait(r, PreReadyQueueTimeout)
+		}
+		startupRequestsTotal.WithLabelValues(outcome).Inc()
+		if outcome == "admitted" {
+			next(w, r)
+			return
+		}
+		pending := b.pending()
+		w.Header().Set("Retry-After", fmt.Sprint(startupRetryAfter))
+		writeStatus(w, &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusServiceUnavailable,
+			Reason:  metav1.StatusReasonServiceUnavailable,
+			Message: fmt.Sprintf("rexec is starting, waiting for %s", strings.Join(pending, ", ")),
+			Details: &metav1.StatusDetails{RetryAfterSeconds: startupRetryAfter},
+		})
+	}
+}
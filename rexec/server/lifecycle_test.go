@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// withStartupBarrier replaces the startup barrier with a new one that has
+// the given conditions met.
+func withStartupBarrier(t *testing.T, met ...string) *startupBarrier {
+	t.Helper()
+	oldBarrier, oldTimeout, oldSize := startup, PreReadyQueueTimeout, PreReadyQueueSize
+	t.Cleanup(func() { startup, PreReadyQueueTimeout, PreReadyQueueSize = oldBarrier, oldTimeout, oldSize })
+	startup = newStartupBarrier()
+	for _, c := range met {
+		startup.markMet(c)
+	}
+	return startup
+}
+
+// gatedHandler is requireReady in front of a handler that counts the requests
+// it was handed.
+func gatedHandler() (http.HandlerFunc, *atomic.Int32) {
+	var admitted atomic.Int32
+	return requireReady(func(w http.ResponseWriter, _ *http.Request) {
+		admitted.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}), &admitted
+}
+
+func assertStartingStatus(t *testing.T, rr *httptest.ResponseRecorder) {
+	t.Helper()
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "5" {
+		t.Fatalf("response = %d with Retry-After %q, want 503 with Retry-After 5", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	var status metav1.Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Reason != metav1.StatusReasonServiceUnavailable || status.Message != "rexec is starting, waiting for policy" {
+		t.Fatalf("status = %+v, want ServiceUnavailable waiting for policy", status)
+	}
+}
+
+func TestStartupBarrierRejectsUntilReady(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	b := withStartupBarrier(t, startupToken, startupKeyring, startupAuditSink)
+	handler, admitted := gatedHandler()
+	rejected := testutil.ToFloat64(startupRequestsTotal.WithLabelValues("rejected"))
+
+	// the policy is slow to load, every request in the meantime is refused
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodPost, "/exec", nil))
+		assertStartingStatus(t, rr)
+	}
+	if admitted.Load() != 0 {
+		t.Fatalf("%d requests admitted before the barrier opened", admitted.Load())
+	}
+	if got := testutil.ToFloat64(startupRequestsTotal.WithLabelValues("rejected")) - rejected; got != 3 {
+		t.Fatalf("rejected requests = %v, want 3", got)
+	}
+	if code, body := getReadyz(t); code != http.StatusServiceUnavailable || body.Ready {
+		t.Fatalf("readyz = %d %+v, want 503 before the barrier opened", code, body)
+	}
+
+	b.markMet(startupPolicy)
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodPost, "/exec", nil))
+	if rr.Code != http.StatusOK || admitted.Load() != 1 {
+		t.Fatalf("response = %d after the barrier opened, admitted %d", rr.Code, admitted.Load())
+	}
+	if code, body := getReadyz(t); code != http.StatusOK || !body.Ready {
+		t.Fatalf("readyz = %d %+v, want 200 once ready", code, body)
+	}
+}
+
+func TestStartupQueueAdmitsOnceReady(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	b := withStartupBarrier(t, startupToken, startupKeyring, startupAuditSink)
+	PreReadyQueueTimeout = time.Minute
+	handler, admitted := gatedHandler()
+
+	var wg sync.WaitGroup
+	codes := make([]int, 3)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest(http.MethodPost, "/exec", nil))
+			codes[i] = rr.Code
+		}()
+	}
+	eventually(t, "the requests to be queued", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.queued == 3
+	})
+	if admitted.Load() != 0 {
+		t.Fatalf("%d queued requests admitted before the barrier opened", admitted.Load())
+	}
+
+	b.markMet(startupPolicy)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("queued request %d = %d, want 200 once ready", i, code)
+		}
+	}
+}
+
+func TestStartupQueueTimesOut(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	b := withStartupBarrier(t, startupToken, startupKeyring, startupAuditSink)
+	PreReadyQueueTimeout, PreReadyQueueSize = 10*time.Second, 1
+	handler, admitted := gatedHandler()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodPost, "/exec", nil))
+		done <- rr
+	}()
+	eventually(t, "the request to be queued", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.queued == 1
+	})
+
+	// the queue is full, the next request is refused right away
+	full := testutil.ToFloat64(startupRequestsTotal.WithLabelValues("queue_full"))
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodPost, "/exec", nil))
+	assertStartingStatus(t, rr)
+	if got := testutil.ToFloat64(startupRequestsTotal.WithLabelValues("queue_full")) - full; got != 1 {
+		t.Fatalf("queue_full requests = %v, want 1", got)
+	}
+
+	fc.Advance(10 * time.Second)
+	assertStartingStatus(t, <-done)
+	if admitted.Load() != 0 {
+		t.Fatalf("%d requests admitted before the barrier opened", admitted.Load())
+	}
+}
+
+func TestStartupDeadlineExits(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	b := withStartupBarrier(t, startupToken)
+	oldExitFn := exitFn
+	t.Cleanup(func() { exitFn = oldExitFn })
+	var exited atomic.Bool
+	exitFn = func(int) { exited.Store(true) }
+
+	b.begin(time.Minute)
+	eventually(t, "the deadline timer", func() bool { return fc.Waiters() == 1 })
+	fc.Advance(59 * time.Second)
+	if exited.Load() {
+		t.Fatal("exited before the startup deadline")
+	}
+	fc.Advance(time.Second)
+	eventually(t, "the exit at the startup deadline", exited.Load)
+
+	// a barrier that opened in time is left alone
+	exited.Store(false)
+	b = withStartupBarrier(t, startupToken, startupKeyring, startupPolicy)
+	b.begin(time.Minute)
+	eventually(t, "the deadline timer", func() bool { return fc.Waiters() == 1 })
+	b.markMet(startupAuditSink)
+	eventually(t, "the deadline timer to stop", func() bool { return fc.Waiters() == 0 })
+	fc.Advance(time.Minute)
+	if exited.Load() {
+		t.Fatal("exited after the barrier opened")
+	}
+}
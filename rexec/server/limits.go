@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// SessionLimitsFile overrides the keystroke limits per namespace. It is checked
+// every SessionLimitsReloadInterval; a session keeps the limits it started
+// with.
+var SessionLimitsFile string
+
+// SessionLimitsReloadInterval is how often SessionLimitsFile is checked for
+// changes.
+var SessionLimitsReloadInterval = 30 * time.Second
+
+// MaxLinesPerSession is how many lines of a session are audited in full, after
+// it only every SampleEvery-th line is. Zero never samples.
+var MaxLinesPerSession int
+
+// SampleEvery is the sampling rate past MaxLinesPerSession.
+var SampleEvery int
+
+// DefaultSampleEvery is used when SampleEvery is not set.
+const DefaultSampleEvery = 10
+
+// sessionLimits are the keystroke limits of one session, resolved when it
+// starts and kept until it ends.
+type sessionLimits struct {
+	MaxStrokesPerLine int
+	MaxLines          int
+	SampleEvery       int
+	SessionBuffer     int
+}
+
+// limitsOverride is a set of limits of the file, unset fields are inherited.
+type limitsOverride struct {
+	MaxStrokesPerLine *int `json:"max_strokes_per_line"`
+	MaxLines          *int `json:"max_lines"`
+	SampleEvery       *int `json:"sample_every"`
+	SessionBuffer     *int `json:"session_buffer"`
+	// RecordingMaxAgeDays is not a limit of the session but how long its
+	// recording is kept, see recordingMaxAge.
+	RecordingMaxAgeDays *int `json:"recording_max_age_days"`
+}
+
+// limitsConfig is a parsed SessionLimitsFile, replaced as a whole on reload.
+type limitsConfig struct {
+	Default    limitsOverride            `json:"default"`
+	Namespaces map[string]limitsOverride `json:"namespaces"`
+	// raw is the file content the config was parsed from, to skip reloads of
+	// an unchanged file.
+	raw []byte
+}
+
+// activeLimits is nil unless SessionLimitsFile is configured.
+var activeLimits atomic.Pointer[limitsConfig]
+
+// parseLimits reads {"default":{...},"namespaces":{"<name>":{...}}}. Every
+// value given must be positive, except max_lines which may be 0 to never
+// sample and recording_max_age_days which may be 0 to keep recordings
+// forever.
+func parseLimits(raw []byte) (*limitsConfig, error) {
+	cfg := &limitsConfig{raw: raw}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("invalid session limits: %w", err)
+	}
+	if err := cfg.Default.validate(); err != nil {
+		return nil, fmt.Errorf("invalid session limits: default: %w", err)
+	}
+	for ns, o := range cfg.Namespaces {
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("invalid session limits: namespace %s: %w", ns, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (o limitsOverride) validate() error {
+	for _, v := range []struct {
+		name    string
+		value   *int
+		minimum int
+	}{
+		{"max_strokes_per_line", o.MaxStrokesPerLine, 1},
+		{"max_lines", o.MaxLines, 0},
+		{"sample_every", o.SampleEvery, 1},
+		{"session_buffer", o.SessionBuffer, 1},
+		{"recording_max_age_days", o.RecordingMaxAgeDays, 0},
+	} {
+		if v.value != nil && *v.value < v.minimum {
+			return fmt.Errorf("%s must be at least %d, got %d", v.name, v.minimum, *v.value)
+		}
+	}
+	return nil
+}
+
+func (o limitsOverride) apply(l *sessionLimits) {
+	for _, f := range []struct {
+		from *int
+		to   *int
+	}{
+		{o.MaxStrokesPerLine, &l.MaxStrokesPerLine},
+		{o.MaxLines, &l.MaxLines},
+		{o.SampleEvery, &l.SampleEvery},
+		{o.SessionBuffer, &l.SessionBuffer},
+	} {
+		if f.from != nil {
+			*f.to = *f.from
+		}
+	}
+}
+
+// validateGlobalLimits rejects negative limit flags, zero selects the default.
+func validateGlobalLimits() error {
+	for name, value := range map[string]int{
+		"max-strokes-per-line":  MaxStokesPerLine,
+		"max-lines-per-session": MaxLinesPerSession,
+		"sample-every":          SampleEvery,
+		"audit-session-buffer":  AuditSessionBuffer,
+	} {
+		if value < 0 {
+			return fmt.Errorf("--%s must not be negative, got %d", name, value)
+		}
+	}
+	return nil
+}
+
+// resolveSessionLimits returns the limits of a session starting in namespace:
+// the namespace override, then the default of the file, then the flags.
+func resolveSessionLimits(namespace string) sessionLimits {
+	l := sessionLimits{
+		MaxStrokesPerLine: MaxStokesPerLine,
+		MaxLines:          MaxLinesPerSession,
+		SampleEvery:       SampleEvery,
+		SessionBuffer:     AuditSessionBuffer,
+	}
+	if cfg := activeLimits.Load(); cfg != nil {
+		cfg.Default.apply(&l)
+		if o, ok := cfg.Namespaces[namespace]; ok {
+			o.apply(&l)
+		}
+	}
+	if l.MaxStrokesPerLine <= 0 {
+		l.MaxStrokesPerLine = 2000
+	}
+	if l.SampleEvery <= 0 {
+		l.SampleEvery = DefaultSampleEvery
+	}
+	if l.SessionBuffer <= 0 {
+		l.SessionBuffer = DefaultAuditSessionBuffer
+	}
+	return l
+}
+
+// loadLimits reads SessionLimitsFile and makes it the active config.
+func loadLimits() error {
+	raw, err := os.ReadFile(SessionLimitsFile)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseLimits(raw)
+	if err != nil {
+		return err
+	}
+	activeLimits.Store(cfg)
+	return nil
+}
+
+// reloadLimits re-reads SessionLimitsFile if its content changed. A file that
+// cannot be read or parsed keeps the current limits and is reported. Every
+// reload attempt is an admin action.
+func reloadLimits() {
+	old := activeLimits.Load()
+	raw, err := os.ReadFile(SessionLimitsFile)
+	if err == nil && old != nil && bytes.Equal(raw, old.raw) {
+		return
+	}
+	var cfg *limitsConfig
+	if err == nil {
+		cfg, err = parseLimits(raw)
+	}
+	action := adminAction{Action: "session_limits_reload", Actor: adminActor, Target: SessionLimitsFile, After: configHash(raw)}
+	if old != nil {
+		action.Before = configHash(old.raw)
+	}
+	if !auditAdmin(action, err) {
+		return
+	}
+	if err != nil {
+		sessionLimitsReloadsTotal.WithLabelValues("failure").Inc()
+		recordError("limits_reload")
+		SysLogger.Error().Err(err).Str("file", SessionLimitsFile).Msg("failed to reload session limits, keeping the current ones")
+		return
+	}
+	activeLimits.Store(cfg)
+	sessionLimitsReloadsTotal.WithLabelValues("success").Inc()
+	SysLogger.Info().Int("namespaces", len(cfg.Namespaces)).Msg("reloaded session limits")
+	emitProvenance("proxy_config")
+}
+
+// watchLimits reloads the session limits every SessionLimitsReloadInterval.
+func watchLimits(stop <-chan struct{}) {
+	ticker := clk.NewTicker(SessionLimitsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			reloadLimits()
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// limitsFile points SessionLimitsFile at a temporary file with raw, loads it,
+// and restores the globals after the test.
+func limitsFile(t *testing.T, raw string) {
+	t.Helper()
+	oldFile, oldActive := SessionLimitsFile, activeLimits.Load()
+	oldLines, oldEvery, oldBuffer := MaxLinesPerSession, SampleEvery, AuditSessionBuffer
+	t.Cleanup(func() {
+		SessionLimitsFile = oldFile
+		activeLimits.Store(oldActive)
+		MaxLinesPerSession, SampleEvery, AuditSessionBuffer = oldLines, oldEvery, oldBuffer
+	})
+	SessionLimitsFile = filepath.Join(t.TempDir(), "limits.json")
+	writeLimitsFile(t, raw)
+	if err := loadLimits(); err != nil {
+		t.Fatalf("loadLimits: %v", err)
+	}
+}
+
+func writeLimitsFile(t *testing.T, raw string) {
+	t.Helper()
+	if err := os.WriteFile(SessionLimitsFile, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseLimitsRejectsNonsense(t *testing.T) {
+	for _, raw := range []string{
+		`{"default": {"max_strokes_per_line": 0}}`,
+		`{"default": {"session_buffer": -1}}`,
+		`{"namespaces": {"ds": {"sample_every": 0}}}`,
+		`{"namespaces": {"ds": {"max_lines": -5}}}`,
+		`{"default": {"max_stroke_per_line": 100}}`,
+		`{"default": `,
+	} {
+		if _, err := parseLimits([]byte(raw)); err == nil {
+			t.Errorf("parseLimits(%s) accepted", raw)
+		}
+	}
+	if _, err := parseLimits([]byte(`{"namespaces": {"ds": {"max_lines": 0}}}`)); err != nil {
+		t.Errorf("max_lines 0 turns sampling off and must be accepted: %v", err)
+	}
+}
+
+func TestResolveSessionLimitsPrecedence(t *testing.T) {
+	withSessionMaps(t)
+	limitsFile(t, `{"default": {"max_lines": 500, "session_buffer": 2048},
+		"namespaces": {"data-science": {"max_strokes_per_line": 20000, "max_lines": 0}}}`)
+	MaxLinesPerSession, SampleEvery, AuditSessionBuffer = 100, 7, 1024
+
+	ds := resolveSessionLimits("data-science")
+	want := sessionLimits{MaxStrokesPerLine: 20000, MaxLines: 0, SampleEvery: 7, SessionBuffer: 2048}
+	if ds != want {
+		t.Fatalf("data-science limits = %+v, want %+v", ds, want)
+	}
+	other := resolveSessionLimits("payments")
+	want = sessionLimits{MaxStrokesPerLine: 2000, MaxLines: 500, SampleEvery: 7, SessionBuffer: 2048}
+	if other != want {
+		t.Fatalf("payments limits = %+v, want %+v", other, want)
+	}
+
+	activeLimits.Store(nil)
+	want = sessionLimits{MaxStrokesPerLine: 2000, MaxLines: 100, SampleEvery: 7, SessionBuffer: 1024}
+	if got := resolveSessionLimits("data-science"); got != want {
+		t.Fatalf("without a file limits = %+v, want the flags %+v", got, want)
+	}
+}
+
+func TestSessionLimitsFrozenAcrossReload(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	captureAdminEvents(t)
+	limitsFile(t, `{"namespaces": {"data-science": {"max_strokes_per_line": 5, "session_buffer": 4096}}}`)
+
+	started := registerSession("s1", sessionInfo{User: "alice", NameSpace: "data-science"})
+	writeLimitsFile(t, `{"namespaces": {"data-science": {"max_strokes_per_line": 50, "session_buffer": 8192}}}`)
+	before := testutil.ToFloat64(sessionLimitsReloadsTotal.WithLabelValues("success"))
+	reloadLimits()
+	if got := testutil.ToFloat64(sessionLimitsReloadsTotal.WithLabelValues("success")) - before; got != 1 {
+		t.Fatalf("reload counter delta = %v, want 1", got)
+	}
+	later := registerSession("s2", sessionInfo{User: "bob", NameSpace: "data-science"})
+
+	if started.Limits.MaxStrokesPerLine != 5 || later.Limits.MaxStrokesPerLine != 50 {
+		t.Fatalf("limits of s1 %+v and s2 %+v, want 5 and 50 strokes per line", started.Limits, later.Limits)
+	}
+	if b := sessionBufferFor("s1"); b.capacity != 4096 || b.info.Limits != started.Limits {
+		t.Fatalf("the buffer of s1 must keep the limits it started with, capacity %d", b.capacity)
+	}
+
+	// the line of s1 is still cut after 5 strokes
+	commands := storeOrFlush(asyncAudit{ctxid: "s1", info: sessionBufferFor("s1").info, ascii: []byte("0123456789\r")})
+	if strings.Join(commands, "|") != "012345|6789" {
+		t.Fatalf("commands of s1 = %q", commands)
+	}
+
+	items := sessionBufferFor("s1").take()
+	if len(items) != 1 || items[0].event.Event != "session_start" || items[0].event.Info.Limits.SessionBuffer != 4096 {
+		t.Fatalf("session_start must record the limits, got %+v", items)
+	}
+}
+
+func TestReloadLimitsKeepsCurrentOnError(t *testing.T) {
+	captureAdminEvents(t)
+	limitsFile(t, `{"default": {"max_lines": 10}}`)
+	writeLimitsFile(t, `{"default": {"max_lines": -1}}`)
+	before := testutil.ToFloat64(sessionLimitsReloadsTotal.WithLabelValues("failure"))
+	reloadLimits()
+	if got := testutil.ToFloat64(sessionLimitsReloadsTotal.WithLabelValues("failure")) - before; got != 1 {
+		t.Fatalf("failure counter delta = %v, want 1", got)
+	}
+	if got := resolveSessionLimits("any").MaxLines; got != 10 {
+		t.Fatalf("max lines = %d, want the previous 10", got)
+	}
+}
+
+func TestShardSamplesPastMaxLines(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	info := sessionInfo{User: "alice", Limits: sessionLimits{MaxStrokesPerLine: 2000, MaxLines: 2, SampleEvery: 3}}
+	shard := &auditShard{index: map[string]uint64{}}
+
+	var events []auditEvent
+	events = shard.process(asyncAudit{ctxid: "s1", info: info, ascii: []byte("l1\rl2\rl3\rl4\rl5\rl6\rl7\rl8\r")}, events)
+	events = shard.process(asyncAudit{ctxid: "s1", info: info, event: &auditEvent{Session: "s1", Info: info, Event: "session_end"}}, events)
+
+	var commands []string
+	for _, ev := range events[:len(events)-1] {
+		commands = append(commands, ev.Command)
+	}
+	// two in full, then every third
+	if strings.Join(commands, ",") != "l1,l2,l5,l8" {
+		t.Fatalf("audited lines %v", commands)
+	}
+	if end := events[len(events)-1]; end.SampledLines != 4 {
+		t.Fatalf("session_end counts %d sampled out lines, want 4", end.SampledLines)
+	}
+	if _, ok := shard.lines["s1"]; ok {
+		t.Fatal("line count must be dropped with the session")
+	}
+}
@@ -67,6 +67,63 @@ var auditKeystrokesTotal = prometheus.NewCounter(
 	},
 )
 
+var sessionLimitsReloadsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_session_limits_reloads_total",
+		Help: "Total number of session limits file reloads by result.",
+	},
+	[]string{"result"},
+)
+
+var identityUIDChangesTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rexec_identity_uid_changes_total",
+		Help: "Total number of sessions whose username was last seen with another UID.",
+	},
+)
+
+var adminActionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_admin_actions_total",
+		Help: "Total number of administrative actions by action and outcome, refused when they could not be audited.",
+	},
+	[]string{"action", "outcome"},
+)
+
+var checkpointsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_checkpoints_total",
+		Help: "Total number of container checkpoint requests by outcome.",
+	},
+	[]string{"outcome"},
+)
+
+var auditSinkOldestUndelivered = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "rexec_audit_sink_oldest_undelivered_seconds",
+		Help: "Age of the oldest audit event not yet delivered to the sink, 0 when it is caught up.",
+	},
+	[]string{"sink"},
+)
+
+var auditSinkDeliveryLatency = prometheus.NewSummaryVec(
+	prometheus.SummaryOpts{
+		Name:       "rexec_audit_sink_delivery_latency_seconds",
+		Help:       "Time from capture to delivery of audit events per sink, over the last 10 minutes.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+		MaxAge:     10 * time.Minute,
+	},
+	[]string{"sink"},
+)
+
+var auditSinkStale = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "rexec_audit_sink_stale",
+		Help: "1 while the oldest undelivered event of the sink is older than its staleness threshold.",
+	},
+	[]string{"sink"},
+)
+
 var sessionsTotal = prometheus.NewCounter(
 	prometheus.CounterOpts{
 		Name: "rexec_sessions_total",
@@ -89,6 +146,197 @@ var sessionStartDuration = prometheus.NewHistogram(
 	},
 )
 
+var sessionPhaseDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "rexec_session_phase_duration_seconds",
+		Help:    "Duration in seconds of the phases of recorded sessions: authn, policy, dial, first_byte, stream and teardown.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"phase"},
+)
+
+var auditPipelineAvailable = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rexec_audit_pipeline_available",
+		Help: "0 while the audit fail-closed mode finds the audit pipeline unhealthy, 1 otherwise.",
+	},
+)
+
+var auditFailClosedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_fail_closed_total",
+		Help: "Total number of sessions the audit fail-closed mode refused or terminated by action: refused or terminated.",
+	},
+	[]string{"action"},
+)
+
+var auditEmittedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_emitted_total",
+		Help: "Total number of audit occurrences written to the audit log by format: legacy or v2.",
+	},
+	[]string{"format"},
+)
+
+var auditFormatMismatchesTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_format_mismatches_total",
+		Help: "Total number of v2 audit events written with a type the v2 schema does not know, or that disagree with their legacy line.",
+	},
+)
+
+var sessionStallsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rexec_session_stalls_total",
+		Help: "Total number of times a recorded session sent no byte either way for the stall threshold while streaming.",
+	},
+)
+
+var keyringReloadsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_keyring_reloads_total",
+		Help: "Total number of keyring reloads by result.",
+	},
+	[]string{"result"},
+)
+
+var auditWorkers = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rexec_audit_workers",
+		Help: "Number of audit workers.",
+	},
+)
+
+var auditWorkersBusy = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rexec_audit_workers_busy",
+		Help: "Number of audit workers currently processing.",
+	},
+)
+
+var auditWorkerBusySeconds = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_worker_busy_seconds_total",
+		Help: "Total time in seconds audit workers spent processing, divided by the number of workers this is their utilization.",
+	},
+)
+
+var auditGapsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_gap_events_total",
+		Help: "Total number of audit gaps, where session data was dropped from the audit because the workers fell behind.",
+	},
+)
+
+var auditGapBytesTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_gap_bytes_total",
+		Help: "Total number of session bytes dropped from the audit.",
+	},
+)
+
+var wsLimitExceededTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_ws_limit_exceeded_total",
+		Help: "Total number of sessions closed for a websocket message over the size limit, by the side that sent it.",
+	},
+	[]string{"direction"},
+)
+
+var authzDecisionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_authz_webhook_decisions_total",
+		Help: "Total number of authorization webhook decisions by decision and source: the webhook, the cache or the failure policy.",
+	},
+	[]string{"decision", "source"},
+)
+
+var authzWebhookDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "rexec_authz_webhook_duration_seconds",
+		Help:    "Duration in seconds of the calls to the authorization webhook by result.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"result"},
+)
+
+var changeIDChecksTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_change_id_checks_total",
+		Help: "Total number of change ID checks of exec requests by result.",
+	},
+	[]string{"result"},
+)
+
+var changeIDWebhookDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "rexec_change_id_webhook_duration_seconds",
+		Help:    "Duration in seconds of the calls to the change ID webhook by result.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"result"},
+)
+
+var auditWebhookBatchesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_webhook_batches_total",
+		Help: "Total number of audit batches of the webhook sink by result: sent, spooled, or replayed from the spool.",
+	},
+	[]string{"result"},
+)
+
+var auditWebhookBytesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_webhook_bytes_total",
+		Help: "Total number of bytes of the audit batches the webhook took, as sent, by Content-Encoding.",
+	},
+	[]string{"encoding"},
+)
+
+var auditSpoolBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rexec_audit_spool_bytes",
+		Help: "Total size in bytes of the audit batches spooled for the webhook sink.",
+	},
+)
+
+var auditSpoolQuarantinedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rexec_audit_spool_quarantined_total",
+		Help: "Total number of audit spool segments that could not be read back and were quarantined.",
+	},
+)
+
+var recordingsDeletedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_recordings_deleted_total",
+		Help: "Total number of session recordings deleted by the retention limit that expired them: age or size.",
+	},
+	[]string{"reason"},
+)
+
+var recordingsBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rexec_recordings_bytes",
+		Help: "Total size in bytes of the session recordings kept, as of the last retention run.",
+	},
+)
+
+var startupReady = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rexec_startup_ready",
+		Help: "1 once everything sessions depend on is loaded and the exec endpoints are open.",
+	},
+)
+
+var startupRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rexec_startup_requests_total",
+		Help: "Total number of exec requests that arrived before the server was ready by outcome: admitted after waiting, rejected, queue_full, timed_out or cancelled.",
+	},
+	[]string{"outcome"},
+)
+
 func init() {
 	prometheus.MustRegister(
 		requestsTotal,
@@ -101,6 +349,38 @@ func init() {
 		sessionsTotal,
 		sessionsFailedTotal,
 		sessionStartDuration,
+		sessionPhaseDuration,
+		sessionStallsTotal,
+		keyringReloadsTotal,
+		auditWorkers,
+		auditWorkersBusy,
+		auditWorkerBusySeconds,
+		auditGapsTotal,
+		auditGapBytesTotal,
+		wsLimitExceededTotal,
+		identityUIDChangesTotal,
+		sessionLimitsReloadsTotal,
+		adminActionsTotal,
+		checkpointsTotal,
+		auditSinkOldestUndelivered,
+		auditSinkDeliveryLatency,
+		auditSinkStale,
+		auditPipelineAvailable,
+		auditFailClosedTotal,
+		auditEmittedTotal,
+		auditFormatMismatchesTotal,
+		authzDecisionsTotal,
+		authzWebhookDuration,
+		changeIDChecksTotal,
+		changeIDWebhookDuration,
+		recordingsDeletedTotal,
+		recordingsBytes,
+		auditWebhookBatchesTotal,
+		auditWebhookBytesTotal,
+		auditSpoolBytes,
+		auditSpoolQuarantinedTotal,
+		startupReady,
+		startupRequestsTotal,
 	)
 }
 
@@ -137,7 +417,7 @@ func (r *statusRecorder) Flush() {
 func instrumentHandler(handlerName string, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		rec := &statusRecorder{ResponseWriter: w}
-		start := time.Now()
+		start := clk.Now()
 
 		next(rec, r)
 
@@ -146,7 +426,7 @@ func instrumentHandler(handlerName string, next http.HandlerFunc) http.HandlerFu
 		}
 
 		requestsTotal.WithLabelValues(handlerName, strconv.Itoa(rec.status)).Inc()
-		requestDuration.WithLabelValues(handlerName).Observe(time.Since(start).Seconds())
+		requestDuration.WithLabelValues(handlerName).Observe(clk.Since(start).Seconds())
 	}
 }
 
@@ -168,6 +448,8 @@ func recordSessionStart(d time.Duration) {
 func MetricsHandler() http.Handler {
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsMux.HandleFunc("/version", versionHandler)
+	metricsMux.HandleFunc("/readyz", readyzHandler)
 	return metricsMux
 }
 
@@ -52,7 +52,7 @@ func TestInstrumentHandlerRecordsRequestMetrics(t *testing.T) {
 func TestLogCommandIncrementsAuditCommandsMetric(t *testing.T) {
 	before := testutil.ToFloat64(auditCommandsTotal)
 
-	logCommand("ls -la", "alice", "session-1", "ns", "pod", "container", "10.0.0.1")
+	logCommand("ls -la", "session-1", sessionInfo{User: "alice", NameSpace: "ns", Pod: "pod", Container: "container", ClientIP: "10.0.0.1"})
 
 	after := testutil.ToFloat64(auditCommandsTotal)
 	if after != before+1 {
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+)
+
+// Version, Commit and BuildDate describe the build, set with
+// -ldflags "-X github.com/adyen/kubectl-rexec/rexec/server.Commit=...". Commit
+// and BuildDate fall back to the VCS stamp of the binary when it has one.
+var (
+	Version   = "dev"
+	Commit    string
+	BuildDate string
+)
+
+// ClusterName labels the audit stream of this proxy with its cluster.
+var ClusterName string
+
+// proxySession is the session proxy_start and proxy_config events are numbered
+// under, so a replica's audit stream starts at index 1 with its proxy_start.
+const proxySession = "proxy"
+
+// provenance is what produced an audit stream: the build, the configuration
+// and where it runs.
+type provenance struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features"`
+	// ConfigHash is the sha256 of the settings in hashedConfig, which leaves
+	// out every secret.
+	ConfigHash string `json:"config_hash"`
+	Pod        string `json:"pod"`
+	Cluster    string `json:"cluster"`
+}
+
+// hashedConfig is the configuration ConfigHash is taken over. It must never
+// hold a secret: no shared key and no keyring secrets, only key IDs.
+type hashedConfig struct {
+	AuditTrace               bool     `json:"audit_trace"`
+	BypassUsers              []string `json:"bypass_users"`
+	BypassUIDs               []string `json:"bypass_uids"`
+	KeyringFile              string   `json:"keyring_file"`
+	KeyIDs                   []string `json:"key_ids"`
+	MaxStrokesPerLine        int      `json:"max_strokes_per_line"`
+	MaxLinesPerSession       int      `json:"max_lines_per_session"`
+	SampleEvery              int      `json:"sample_every"`
+	SessionLimitsFile        string   `json:"session_limits_file"`
+	SessionLimits            string   `json:"session_limits"`
+	MaxCommandArgs           int      `json:"max_command_args"`
+	MaxCommandBytes          int      `json:"max_command_bytes"`
+	SessionIdleTimeout       string   `json:"session_idle_timeout"`
+	SessionMaxDuration       string   `json:"session_max_duration"`
+	SessionHeartbeatInterval string   `json:"session_heartbeat_interval"`
+	SessionStallThreshold    string   `json:"session_stall_threshold"`
+	AuditShards              int      `json:"audit_shards"`
+	AuditSessionBuffer       int      `json:"audit_session_buffer"`
+	WSMaxMessageSize         int64    `json:"ws_max_message_size"`
+	IdentityMapFile          string   `json:"identity_map_file"`
+	IdentityMapSize          int      `json:"identity_map_size"`
+	ImpersonatorExtra        string   `json:"impersonator_extra"`
+	AdminAuditFailOpen       bool     `json:"admin_audit_fail_open"`
+	CheckpointGroups         []string `json:"checkpoint_groups"`
+	AuditSinkStaleness       []string `json:"audit_sink_staleness"`
+	AuditCriticalSinks       []string `json:"audit_critical_sinks"`
+	AuditFailClosed          string   `json:"audit_fail_closed"`
+	AuditFailClosedQueue     int      `json:"audit_fail_closed_queue"`
+	AuditFailClosedGrace     string   `json:"audit_fail_closed_grace"`
+	AuditFormat              string   `json:"audit_format"`
+	AuditDualUntil           string   `json:"audit_dual_until"`
+	AuditLegacyOff           []string `json:"audit_legacy_off"`
+	AuditWebhookURL          string   `json:"audit_webhook_url"`
+	AuditWebhookTimeout      string   `json:"audit_webhook_timeout"`
+	AuditWebhookCompression  string   `json:"audit_webhook_compression"`
+	AuditCompressionLevel    int      `json:"audit_compression_level"`
+	AuditSpoolDir            string   `json:"audit_spool_dir"`
+	AuditSpoolCompression    string   `json:"audit_spool_compression"`
+	AuditSpoolMaxBytes       int64    `json:"audit_spool_max_bytes"`
+	DenialMessagesFile       string   `json:"denial_messages_file"`
+	AuthzWebhookURL          string   `json:"authz_webhook_url"`
+	AuthzWebhookTimeout      string   `json:"authz_webhook_timeout"`
+	AuthzWebhookFailOpen     bool     `json:"authz_webhook_fail_open"`
+	AuthzWebhookCacheTTL     string   `json:"authz_webhook_cache_ttl"`
+	ChangeIDRulesFile        string   `json:"change_id_rules_file"`
+	ChangeIDRules            string   `json:"change_id_rules"`
+	ChangeIDWebhookURL       string   `json:"change_id_webhook_url"`
+	ChangeIDWebhookTimeout   string   `json:"change_id_webhook_timeout"`
+	ChangeIDWebhookFailOpen  bool     `json:"change_id_webhook_fail_open"`
+	ChangeIDWebhookCacheTTL  string   `json:"change_id_webhook_cache_ttl"`
+	RecordingsDir            string   `json:"recordings_dir"`
+	RecordingsMaxAge         string   `json:"recordings_max_age"`
+	RecordingsMaxBytes       int64    `json:"recordings_max_bytes"`
+	RecordingsSecureDelete   bool     `json:"recordings_secure_delete"`
+	StartupDeadline          string   `json:"startup_deadline"`
+	PreReadyQueueTimeout     string   `json:"pre_ready_queue_timeout"`
+	PreReadyQueueSize        int      `json:"pre_ready_queue_size"`
+	ClusterDomain            string   `json:"cluster_domain"`
+	ClusterName              string   `json:"cluster_name"`
+}
+
+func currentHashedConfig() hashedConfig {
+	cfg := hashedConfig{
+		AuditTrace:               AuditFullTraceLog,
+		BypassUsers:              ByPassedUsers,
+		BypassUIDs:               ByPassedUIDs,
+		KeyringFile:              KeyringFile,
+		MaxStrokesPerLine:        MaxStokesPerLine,
+		MaxLinesPerSession:       MaxLinesPerSession,
+		SampleEvery:              SampleEvery,
+		SessionLimitsFile:        SessionLimitsFile,
+		MaxCommandArgs:           MaxCommandArgs,
+		MaxCommandBytes:          MaxCommandBytes,
+		SessionIdleTimeout:       SessionIdleTimeout.String(),
+		SessionMaxDuration:       SessionMaxDuration.String(),
+		SessionHeartbeatInterval: SessionHeartbeatInterval.String(),
+		SessionStallThreshold:    SessionStallThreshold.String(),
+		AuditShards:              AuditShards,
+		AuditSessionBuffer:       AuditSessionBuffer,
+		WSMaxMessageSize:         WSMaxMessageSize,
+		IdentityMapFile:          IdentityMapFile,
+		IdentityMapSize:          IdentityMapSize,
+		ImpersonatorExtra:        ImpersonatorExtra,
+		AdminAuditFailOpen:       AdminAuditFailOpen,
+		CheckpointGroups:         CheckpointGroups,
+		AuditSinkStaleness:       AuditSinkStaleness,
+		AuditCriticalSinks:       AuditCriticalSinks,
+		AuditFailClosed:          AuditFailClosed,
+		AuditFailClosedQueue:     AuditFailClosedQueue,
+		AuditFailClosedGrace:     AuditFailClosedGrace.String(),
+		AuditFormat:              AuditFormat,
+		AuditDualUntil:           AuditDualUntil,
+		AuditLegacyOff:           AuditLegacyOff,
+		AuditWebhookURL:          AuditWebhookURL,
+		AuditWebhookTimeout:      AuditWebhookTimeout.String(),
+		AuditWebhookCompression:  AuditWebhookCompression,
+		AuditCompressionLevel:    AuditCompressionLevel,
+		AuditSpoolDir:            AuditSpoolDir,
+		AuditSpoolCompression:    AuditSpoolCompression,
+		AuditSpoolMaxBytes:       AuditSpoolMaxBytes,
+		DenialMessagesFile:       DenialMessagesFile,
+		AuthzWebhookURL:          AuthzWebhookURL,
+		AuthzWebhookTimeout:      AuthzWebhookTimeout.String(),
+		AuthzWebhookFailOpen:     AuthzWebhookFailOpen,
+		AuthzWebhookCacheTTL:     AuthzWebhookCacheTTL.String(),
+		ChangeIDRulesFile:        ChangeIDRulesFile,
+		ChangeIDWebhookURL:       ChangeIDWebhookURL,
+		ChangeIDWebhookTimeout:   ChangeIDWebhookTimeout.String(),
+		ChangeIDWebhookFailOpen:  ChangeIDWebhookFailOpen,
+		ChangeIDWebhookCacheTTL:  ChangeIDWebhookCacheTTL.String(),
+		RecordingsDir:            RecordingsDir,
+		RecordingsMaxAge:         RecordingsMaxAge.String(),
+		RecordingsMaxBytes:       RecordingsMaxBytes,
+		RecordingsSecureDelete:   RecordingsSecureDelete,
+		StartupDeadline:          StartupDeadline.String(),
+		PreReadyQueueTimeout:     PreReadyQueueTimeout.String(),
+		PreReadyQueueSize:        PreReadyQueueSize,
+		ClusterDomain:            ClusterDomain,
+		ClusterName:              ClusterName,
+	}
+	if kr := activeKeyring.Load(); kr != nil {
+		for _, k := range kr.keys {
+			cfg.KeyIDs = append(cfg.KeyIDs, k.ID)
+		}
+	}
+	if l := activeLimits.Load(); l != nil {
+		cfg.SessionLimits = configHash(l.raw)
+	}
+	if c := changeIDRules; c != nil {
+		cfg.ChangeIDRules = configHash(c.raw)
+	}
+	return cfg
+}
+
+// enabledFeatures lists the optional behaviours that are switched on.
+func enabledFeatures() []string {
+	features := []string{}
+	for name, on := range map[string]bool{
+		"audit_trace":           AuditFullTraceLog,
+		"keyring":               KeyringFile != "",
+		"session_limits_file":   SessionLimitsFile != "",
+		"line_sampling":         MaxLinesPerSession > 0,
+		"identity_map":          IdentityMapFile != "",
+		"session_idle_timeout":  SessionIdleTimeout > 0,
+		"session_max_duration":  SessionMaxDuration > 0,
+		"session_heartbeat":     SessionHeartbeatInterval > 0,
+		"session_stalls":        SessionStallThreshold > 0,
+		"admin_audit_fail_open": AdminAuditFailOpen,
+		"audit_fail_closed":     AuditFailClosed != "",
+		"audit_v2":              AuditFormat == auditFormatDual,
+		"checkpoint":            len(CheckpointGroups) > 0,
+		"authz_webhook":         AuthzWebhookURL != "",
+		"audit_webhook":         AuditWebhookURL != "",
+		"audit_spool":           AuditWebhookURL != "" && AuditSpoolDir != "",
+		"change_id":             ChangeIDRulesFile != "",
+		"recording_retention":   RecordingsDir != "",
+		"tty_recording":         RecordingsDir != "",
+		"secure_delete":         RecordingsDir != "" && RecordingsSecureDelete,
+	} {
+		if on {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+func currentProvenance() provenance {
+	p := provenance{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Features:  enabledFeatures(),
+		Cluster:   ClusterName,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && p.Commit == "":
+				p.Commit = s.Value
+			case s.Key == "vcs.time" && p.BuildDate == "":
+				p.BuildDate = s.Value
+			}
+		}
+	}
+	// the downward API sets POD_NAME, the hostname is the pod name otherwise
+	if p.Pod = os.Getenv("POD_NAME"); p.Pod == "" {
+		p.Pod, _ = os.Hostname()
+	}
+	raw, err := json.Marshal(currentHashedConfig())
+	if err == nil {
+		p.ConfigHash = configHash(raw)
+	}
+	return p
+}
+
+// emitProvenance writes a proxy_start or proxy_config event with the current
+// provenance. It is dropped, and reported, if the pipeline does not take it.
+func emitProvenance(event string) {
+	p := currentProvenance()
+	ev := auditEvent{Session: proxySession, Info: sessionInfo{User: adminActor}, Event: event, Provenance: &p, Captured: clk.Now()}
+	if !queueAuditEvent(ev) {
+		recordError("provenance_audit")
+		SysLogger.Error().Str("event", event).Msg("failed to queue the provenance audit event")
+	}
+}
+
+// versionHandler serves the provenance of the running proxy.
+func versionHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	//nolint:errcheck
+	_ = json.NewEncoder(w).Encode(currentProvenance())
+}
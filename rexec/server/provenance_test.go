@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestProvenanceEventShapeWithoutSecrets(t *testing.T) {
+	withFakeClock(t, 0, 0, 0)
+	buf := captureAuditLocked(t)
+	withKeyring(t, `{"keys": [{"id": "k1", "secret": "keyring-secret-0123456789"}]}`)
+	oldSauce, oldCluster, oldVersion, oldTrace := SecretSauce, ClusterName, Version, AuditFullTraceLog
+	t.Cleanup(func() {
+		SecretSauce, ClusterName, Version, AuditFullTraceLog = oldSauce, oldCluster, oldVersion, oldTrace
+	})
+	SecretSauce = "8d3c1f9e-shared-key-6a2b"
+	ClusterName, Version, AuditFullTraceLog = "prod-eu-1", "v1.4.0", true
+	t.Setenv("POD_NAME", "rexec-7c9f-abcde")
+
+	stop := captureAdminEvents(t)
+	emitProvenance("proxy_start")
+	events := stop()
+	if len(events) != 1 || events[0].Event != "proxy_start" || events[0].Session != proxySession {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if err := (logSink{}).Write(events); err != nil {
+		t.Fatal(err)
+	}
+
+	// the legacy line, the v2 event follows it
+	line, _, _ := strings.Cut(buf.String(), "\n")
+	var logged map[string]any
+	if err := json.Unmarshal([]byte(line), &logged); err != nil {
+		t.Fatalf("audit line is not JSON: %v\n%s", err, buf.String())
+	}
+	for key, want := range map[string]any{
+		"event": "proxy_start", "version": "v1.4.0", "go_version": runtime.Version(),
+		"proxy_pod": "rexec-7c9f-abcde", "cluster": "prod-eu-1", "session": proxySession,
+	} {
+		if logged[key] != want {
+			t.Errorf("%s = %v, want %v", key, logged[key], want)
+		}
+	}
+	if features, _ := logged["features"].([]any); len(features) != 2 || features[0] != "audit_trace" || features[1] != "audit_v2" {
+		t.Errorf("features = %v, want [audit_trace audit_v2]", logged["features"])
+	}
+	if hash, _ := logged["config_hash"].(string); len(hash) != 64 {
+		t.Errorf("config_hash = %q, want a sha256", hash)
+	}
+	for _, secret := range []string{SecretSauce, "keyring-secret-0123456789"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("secret %q logged: %s", secret, buf.String())
+		}
+	}
+}
+
+func TestConfigHashIgnoresSecrets(t *testing.T) {
+	oldSauce, oldCluster := SecretSauce, ClusterName
+	t.Cleanup(func() { SecretSauce, ClusterName = oldSauce, oldCluster })
+
+	withKeyring(t, `{"keys": [{"id": "k1", "secret": "keyring-secret-0123456789"}]}`)
+	SecretSauce = "first-shared-key"
+	base := currentProvenance().ConfigHash
+
+	SecretSauce = "second-shared-key"
+	withKeyring(t, `{"keys": [{"id": "k1", "secret": "another-secret-0123456789"}]}`)
+	if got := currentProvenance().ConfigHash; got != base {
+		t.Fatal("changing only secrets must not change the config hash")
+	}
+
+	ClusterName = "other"
+	if got := currentProvenance().ConfigHash; got == base {
+		t.Fatal("changing a setting must change the config hash")
+	}
+	raw, err := json.Marshal(currentHashedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"second-shared-key", "another-secret-0123456789"} {
+		if strings.Contains(string(raw), secret) {
+			t.Fatalf("hash input holds secret %q", secret)
+		}
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	rr := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d", rr.Code)
+	}
+	var p provenance
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Fatalf("body is not provenance: %v\n%s", err, rr.Body)
+	}
+	if p.Version != Version || p.GoVersion != runtime.Version() || p.ConfigHash == "" {
+		t.Fatalf("unexpected provenance %+v", p)
+	}
+}
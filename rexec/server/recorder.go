@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// sessionRecorders holds the recorder of every recorded TTY session, guarded
+// by mapSync.
+var sessionRecorders = map[string]*castRecorder{}
+
+// Channels of the channel.k8s.io protocols a recording follows.
+const (
+	channelStdout = 1
+	channelStderr = 2
+	channelResize = 4
+)
+
+// castRecorder writes the asciicast v2 recording of a TTY session to
+// <RecordingsDir>/<namespace>/<session>.cast: what the apiserver sends on the
+// stdout and stderr channels as output events, and the terminal sizes the
+// client sends on the resize channel as resize events. Only websocket sessions
+// are recorded, as only their frames are followed.
+type castRecorder struct {
+	ctxid string
+	path  string
+	start time.Time
+
+	// client and upstream follow the frames either way, each used by one
+	// goroutine of the stream.
+	client, upstream castFrames
+
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+	// started is set once the header is written. It takes the size of a
+	// resize coming before any output, 80x24 otherwise.
+	started bool
+	// carry is the start of a UTF-8 sequence the next output completes.
+	carry []byte
+	// failed is set once writing failed, nothing more is recorded then.
+	failed bool
+}
+
+// castFrames puts together the messages of one direction of a websocket,
+// after its HTTP head.
+type castFrames struct {
+	head    *wsStream
+	pending []byte
+	message []byte
+}
+
+// terminalSize is a message of the resize channel.
+type terminalSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// startRecording creates the recording of session ctxid. When it can't be
+// created the error is logged and the session goes on unrecorded, its
+// keystrokes are audited all the same.
+func startRecording(ctxid string, info sessionInfo) *castRecorder {
+	path := filepath.Join(RecordingsDir, info.NameSpace, ctxid+recordingExt)
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	}
+	if err != nil {
+		recordError("recording")
+		SysLogger.Error().Err(err).Str("session", ctxid).Str("file", path).Msg("failed to create the recording")
+		return nil
+	}
+	r := &castRecorder{
+		ctxid:    ctxid,
+		path:     path,
+		start:    clk.Now(),
+		client:   castFrames{head: newWSStream("client", false)},
+		upstream: castFrames{head: newWSStream("upstream", true)},
+		f:        f,
+		w:        bufio.NewWriter(f),
+	}
+	mapSync.Lock()
+	sessionRecorders[ctxid] = r
+	mapSync.Unlock()
+	return r
+}
+
+func recorderFor(ctxid string) *castRecorder {
+	mapSync.Lock()
+	defer mapSync.Unlock()
+	return sessionRecorders[ctxid]
+}
+
+// input follows what the client wrote to the apiserver for its resizes.
+func (r *castRecorder) input(p []byte) {
+	r.client.feed(p, func(message []byte) {
+		if len(message) == 0 || message[0] != channelResize {
+			return
+		}
+		var size terminalSize
+		if err := json.Unmarshal(message[1:], &size); err != nil || size.Width <= 0 || size.Height <= 0 {
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.started {
+			r.header(size)
+			return
+		}
+		r.event("r", fmt.Sprintf("%dx%d", size.Width, size.Height))
+	})
+	r.flush()
+}
+
+// output records what the apiserver sent the client.
+func (r *castRecorder) output(p []byte) {
+	r.upstream.feed(p, func(message []byte) {
+		if len(message) == 0 || (message[0] != channelStdout && message[0] != channelStderr) {
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.started {
+			r.header(terminalSize{Width: 80, Height: 24})
+		}
+		data := append(r.carry, message[1:]...)
+		data, rest := completeUTF8(data)
+		r.carry = append([]byte(nil), rest...)
+		if len(data) > 0 {
+			r.event("o", string(data))
+		}
+	})
+	r.flush()
+}
+
+// header writes the asciicast header with the terminal size. r.mu is held.
+func (r *castRecorder) header(size terminalSize) {
+	r.started = true
+	line, _ := json.Marshal(struct {
+		Version   int   `json:"version"`
+		Width     int   `json:"width"`
+		Height    int   `json:"height"`
+		Timestamp int64 `json:"timestamp"`
+	}{2, size.Width, size.Height, r.start.Unix()})
+	r.writeLine(line)
+}
+
+// event writes an event of kind at the time since the start of the session.
+// r.mu is held.
+func (r *castRecorder) event(kind, data string) {
+	elapsed := math.Round(clk.Since(r.start).Seconds()*1e6) / 1e6
+	line, _ := json.Marshal([]any{elapsed, kind, data})
+	r.writeLine(line)
+}
+
+func (r *castRecorder) writeLine(line []byte) {
+	if r.failed {
+		return
+	}
+	if _, err := r.w.Write(append(line, '\n')); err != nil {
+		r.fail(err)
+	}
+}
+
+// flush writes out what a read or write of the stream recorded, so the file
+// is current for retention and for a crash.
+func (r *castRecorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed || r.w.Buffered() == 0 {
+		return
+	}
+	if err := r.w.Flush(); err != nil {
+		r.fail(err)
+	}
+}
+
+// fail stops the recording after err. r.mu is held.
+func (r *castRecorder) fail(err error) {
+	r.failed = true
+	recordError("recording")
+	SysLogger.Error().Err(err).Str("session", r.ctxid).Str("file", r.path).Msg("failed to write the recording, the rest of the session is not recorded")
+}
+
+// close writes out what is left, closes the file and forgets the recorder.
+func (r *castRecorder) close() {
+	mapSync.Lock()
+	delete(sessionRecorders, r.ctxid)
+	mapSync.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.carry) > 0 {
+		r.event("o", string(r.carry))
+		r.carry = nil
+	}
+	if !r.failed {
+		if err := r.w.Flush(); err != nil {
+			r.fail(err)
+		}
+	}
+	if err := r.f.Close(); err != nil && !r.failed {
+		r.fail(err)
+	}
+}
+
+// feed follows p and calls message with every complete data message, which is
+// only valid during the call. Control frames are skipped, they can come
+// between the frames of a message.
+func (c *castFrames) feed(p []byte, message func([]byte)) {
+	if c.head.inHead {
+		p = p[c.head.skipHead(p):]
+	}
+	if c.head.disabled || len(p) == 0 {
+		return
+	}
+	c.pending = append(c.pending, p...)
+	consumed := 0
+	for {
+		// an error means the frame is not complete yet
+		frame, n, err := parseWebSocketFrame(c.pending[consumed:])
+		if err != nil {
+			break
+		}
+		consumed += n
+		switch {
+		case frame.Opcode >= 0x8:
+			continue
+		case frame.Opcode == 0x0:
+			c.message = append(c.message, frame.Payload...)
+		default:
+			c.message = append(c.message[:0], frame.Payload...)
+		}
+		if frame.Fin {
+			message(c.message)
+			c.message = c.message[:0]
+		}
+	}
+	c.pending = append(c.pending[:0], c.pending[consumed:]...)
+}
+
+// completeUTF8 splits p before an incomplete UTF-8 sequence at its end, which
+// the rest of the output completes.
+func completeUTF8(p []byte) (complete, rest []byte) {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i], p[i:]
+			}
+			break
+		}
+	}
+	return p, nil
+}
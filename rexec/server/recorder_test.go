@@ -0,0 +1,144 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// maskedFrame is a final binary frame as a client sends it.
+func maskedFrame(payload []byte) []byte {
+	frame := wsHeader(true, 0x2, uint64(len(payload)), true)
+	key := frame[len(frame)-4:]
+	for i, c := range payload {
+		frame = append(frame, c^key[i%4])
+	}
+	return frame
+}
+
+func channelFrame(channel byte, data string) []byte {
+	return wsFrame(0x2, append([]byte{channel}, data...))
+}
+
+func TestRecordingOfTTYSession(t *testing.T) {
+	fc := withRecordings(t, 0, 0)
+	recorder := startRecording("s1", sessionInfo{NameSpace: "payments", TTY: true})
+	if recorder == nil {
+		t.Fatal("the recording was not created")
+	}
+	if recorderFor("s1") != recorder {
+		t.Fatal("the recorder is not found by its session")
+	}
+	// é split across two frames, a message in two fragments with a ping
+	// between them, and stdin and error channels that are not output
+	fragmented := append(wsHeader(false, 0x2, 3, false), 2, 'e', 'r')
+	fragmented = append(fragmented, wsFrame(0x9, nil)...)
+	fragmented = append(fragmented, wsHeader(true, 0x0, 2, false)...)
+	fragmented = append(fragmented, 'r', '\n')
+	conn := &scriptConn{reads: [][]byte{
+		append([]byte(switchResponse), channelFrame(1, "h\xc3")...),
+		channelFrame(1, "\xa9llo\r\n"),
+		append(append(channelFrame(0, "ignored"), channelFrame(3, `{"status":"Success"}`)...), fragmented...),
+	}}
+	logger := newWSLogger(conn)
+	logger.recorder = recorder
+	read := func() {
+		t.Helper()
+		if _, err := logger.Read(make([]byte, 4096)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(p []byte) {
+		t.Helper()
+		if _, err := logger.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write([]byte(upgradeRequest))
+	write(maskedFrame(append([]byte{4}, `{"Width":120,"Height":40}`...)))
+	read()
+	fc.Advance(1500 * time.Millisecond)
+	read()
+	fc.Advance(time.Second)
+	write(maskedFrame(append([]byte{4}, `{"Width":100,"Height":30}`...)))
+	write(maskedFrame(append([]byte{0}, "ls\r"...)))
+	read()
+	recorder.close()
+
+	data, err := os.ReadFile(filepath.Join(RecordingsDir, "payments", "s1"+recordingExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`{"version":2,"width":120,"height":40,"timestamp":1700000000}`,
+		`[0,"o","h"]`,
+		`[1.5,"o","éllo\r\n"]`,
+		`[2.5,"r","100x30"]`,
+		`[2.5,"o","err\n"]`,
+	}, "\n") + "\n"
+	if string(data) != want {
+		t.Fatalf("recording =\n%s\nwant\n%s", data, want)
+	}
+	if recorderFor("s1") != nil {
+		t.Fatal("the recorder is kept after the session")
+	}
+}
+
+func TestRecordingWithoutResize(t *testing.T) {
+	withRecordings(t, 0, 0)
+	recorder := startRecording("s1", sessionInfo{NameSpace: "payments", TTY: true})
+	recorder.output(append([]byte(switchResponse), channelFrame(1, "$ ")...))
+	recorder.close()
+
+	data, err := os.ReadFile(filepath.Join(RecordingsDir, "payments", "s1"+recordingExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"version\":2,\"width\":80,\"height\":24,\"timestamp\":1700000000}\n[0,\"o\",\"$ \"]\n"; string(data) != want {
+		t.Fatalf("recording = %q, want %q", data, want)
+	}
+}
+
+func TestRecordingOfRefusedUpgrade(t *testing.T) {
+	withRecordings(t, 0, 0)
+	recorder := startRecording("s1", sessionInfo{NameSpace: "payments", TTY: true})
+	recorder.output([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 8\r\n\r\n\x82\x03\x01abc"))
+	recorder.close()
+
+	data, err := os.ReadFile(filepath.Join(RecordingsDir, "payments", "s1"+recordingExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("recorded %q of a session that was not upgraded", data)
+	}
+}
+
+func TestStartRecordingFails(t *testing.T) {
+	withRecordings(t, 0, 0)
+	if err := os.WriteFile(filepath.Join(RecordingsDir, "payments"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := startRecording("s1", sessionInfo{NameSpace: "payments", TTY: true}); recorder != nil {
+		t.Fatal("expected no recorder when the namespace directory can't be created")
+	}
+}
+
+func TestCompleteUTF8(t *testing.T) {
+	for _, tt := range []struct{ in, complete, rest string }{
+		{"abc", "abc", ""},
+		{"ab\xc3", "ab", "\xc3"},
+		{"ab\xc3\xa9", "ab\xc3\xa9", ""},
+		{"\xe2\x82", "", "\xe2\x82"},
+		// not UTF-8 at all, kept as it is
+		{"ab\xff", "ab\xff", ""},
+	} {
+		complete, rest := completeUTF8([]byte(tt.in))
+		if string(complete) != tt.complete || string(rest) != tt.rest {
+			t.Errorf("completeUTF8(%q) = %q, %q, want %q, %q", tt.in, complete, rest, tt.complete, tt.rest)
+		}
+	}
+}
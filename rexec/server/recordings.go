@@ -0,0 +1,261 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecordingsDir holds the asciicast recordings of TTY sessions, one
+// <namespace>/<session>.cast per session, see castRecorder. Sessions are only
+// recorded, and retention only enforced, when it is set.
+var RecordingsDir string
+
+// RecordingsMaxAge deletes recordings last written longer ago than this. Zero
+// keeps them regardless of age.
+var RecordingsMaxAge time.Duration
+
+// RecordingsMaxBytes deletes the oldest recordings while all of them together
+// are larger than this. Zero keeps them regardless of size.
+var RecordingsMaxBytes int64
+
+// RecordingsRetentionInterval is how often the retention limits are enforced.
+var RecordingsRetentionInterval = 10 * time.Minute
+
+// RecordingsSecureDelete overwrites the content of a recording with zeros
+// before unlinking it.
+var RecordingsSecureDelete bool
+
+// recordingExt is the extension of the asciicast files in RecordingsDir.
+const recordingExt = ".cast"
+
+// Reasons a recording is deleted for.
+const (
+	recordingDeleteAge  = "age"
+	recordingDeleteSize = "size"
+)
+
+// recording is a file in RecordingsDir. Path is relative to RecordingsDir.
+type recording struct {
+	Path      string
+	Namespace string
+	Session   string
+	Size      int64
+	ModTime   time.Time
+	// Active is set while the session of the recording is open, it is never
+	// deleted then.
+	Active bool
+}
+
+// validateRecordings checks the retention flags and that RecordingsDir is a
+// directory.
+func validateRecordings() error {
+	if RecordingsMaxAge < 0 {
+		return fmt.Errorf("--recordings-max-age must not be negative, got %s", RecordingsMaxAge)
+	}
+	if RecordingsMaxBytes < 0 {
+		return fmt.Errorf("--recordings-max-bytes must not be negative, got %d", RecordingsMaxBytes)
+	}
+	if RecordingsRetentionInterval <= 0 {
+		return fmt.Errorf("--recordings-retention-interval must be positive, got %s", RecordingsRetentionInterval)
+	}
+	info, err := os.Stat(RecordingsDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", RecordingsDir)
+	}
+	return nil
+}
+
+// recordingMaxAge returns how long the recordings of namespace are kept: the
+// recording_max_age_days of the namespace in SessionLimitsFile, then of its
+// default, then RecordingsMaxAge. pinned is set when the namespace has an
+// age of its own, its recordings are then kept that long even past
+// RecordingsMaxBytes.
+func recordingMaxAge(namespace string) (maxAge time.Duration, pinned bool) {
+	maxAge = RecordingsMaxAge
+	cfg := activeLimits.Load()
+	if cfg == nil {
+		return maxAge, false
+	}
+	if days := cfg.Default.RecordingMaxAgeDays; days != nil {
+		maxAge = time.Duration(*days) * 24 * time.Hour
+	}
+	if days := cfg.Namespaces[namespace].RecordingMaxAgeDays; days != nil {
+		return time.Duration(*days) * 24 * time.Hour, true
+	}
+	return maxAge, false
+}
+
+// listRecordings returns the recordings in RecordingsDir, oldest first. Files
+// not laid out as <namespace>/<session>.cast are not recordings and left
+// alone.
+func listRecordings() ([]recording, error) {
+	namespaces, err := os.ReadDir(RecordingsDir)
+	if err != nil {
+		return nil, err
+	}
+	var recordings []recording
+	for _, ns := range namespaces {
+		if !ns.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(RecordingsDir, ns.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			session, ok := strings.CutSuffix(f.Name(), recordingExt)
+			if !ok || session == "" || !f.Type().IsRegular() {
+				continue
+			}
+			info, err := f.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			recordings = append(recordings, recording{
+				Path:      filepath.Join(ns.Name(), f.Name()),
+				Namespace: ns.Name(),
+				Session:   session,
+				Size:      info.Size(),
+				ModTime:   info.ModTime(),
+			})
+		}
+	}
+
+	mapSync.Lock()
+	for i := range recordings {
+		_, recordings[i].Active = sessionMap[recordings[i].Session]
+	}
+	mapSync.Unlock()
+
+	sort.Slice(recordings, func(i, j int) bool {
+		if !recordings[i].ModTime.Equal(recordings[j].ModTime) {
+			return recordings[i].ModTime.Before(recordings[j].ModTime)
+		}
+		return recordings[i].Path < recordings[j].Path
+	})
+	return recordings, nil
+}
+
+// enforceRecordingRetention deletes the recordings older than the maximum age
+// of their namespace, then the oldest ones while the rest are larger than
+// RecordingsMaxBytes. Recordings of open sessions count towards the size but
+// are never deleted.
+func enforceRecordingRetention() {
+	recordings, err := listRecordings()
+	if err != nil {
+		recordError("recordings_retention")
+		SysLogger.Error().Err(err).Str("dir", RecordingsDir).Msg("failed to list the recordings")
+		return
+	}
+	var total int64
+	for _, r := range recordings {
+		total += r.Size
+	}
+
+	kept := recordings[:0]
+	for _, r := range recordings {
+		maxAge, _ := recordingMaxAge(r.Namespace)
+		if !r.Active && maxAge > 0 && clk.Since(r.ModTime) > maxAge && deleteRecording(r, recordingDeleteAge) {
+			total -= r.Size
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	if RecordingsMaxBytes > 0 {
+		for _, r := range kept {
+			if total <= RecordingsMaxBytes {
+				break
+			}
+			if r.Active {
+				continue
+			}
+			if maxAge, pinned := recordingMaxAge(r.Namespace); pinned && (maxAge == 0 || clk.Since(r.ModTime) <= maxAge) {
+				continue
+			}
+			if deleteRecording(r, recordingDeleteSize) {
+				total -= r.Size
+			}
+		}
+	}
+	recordingsBytes.Set(float64(total))
+}
+
+// deleteRecording removes r for reason, after queueing its admin event. It
+// reports whether r is gone.
+func deleteRecording(r recording, reason string) bool {
+	if !auditAdmin(adminAction{Action: "recording_delete", Actor: adminActor, Target: r.Path, Reason: reason}, nil) {
+		return false
+	}
+	path := filepath.Join(RecordingsDir, r.Path)
+	remove := os.Remove
+	if RecordingsSecureDelete {
+		remove = secureRemove
+	}
+	if err := remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		recordError("recordings_retention")
+		SysLogger.Error().Err(err).Str("file", path).Msg("failed to delete a recording")
+		return false
+	}
+	recordingsDeletedTotal.WithLabelValues(reason).Inc()
+	SysLogger.Info().Str("file", path).Str("reason", reason).Msg("deleted a recording")
+	return true
+}
+
+// secureRemove overwrites the content of the file at path with zeros, syncs
+// it to disk and unlinks it.
+func secureRemove(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, zeroReader{}, info.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// watchRecordings enforces the retention of the recordings at startup and
+// every RecordingsRetentionInterval.
+func watchRecordings(stop <-chan struct{}) {
+	ticker := clk.NewTicker(RecordingsRetentionInterval)
+	defer ticker.Stop()
+	enforceRecordingRetention()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			enforceRecordingRetention()
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	rexectest "github.com/adyen/kubectl-rexec/rexec/server/testutil"
+)
+
+// withRecordings points RecordingsDir at a temporary directory with the given
+// limits, on a fake clock, and restores the globals after the test.
+func withRecordings(t *testing.T, maxAge time.Duration, maxBytes int64) *rexectest.FakeClock {
+	t.Helper()
+	oldDir, oldAge, oldBytes, oldSecure, oldSessions := RecordingsDir, RecordingsMaxAge, RecordingsMaxBytes, RecordingsSecureDelete, sessionMap
+	t.Cleanup(func() {
+		RecordingsDir, RecordingsMaxAge, RecordingsMaxBytes, RecordingsSecureDelete, sessionMap = oldDir, oldAge, oldBytes, oldSecure, oldSessions
+	})
+	RecordingsDir, RecordingsMaxAge, RecordingsMaxBytes, RecordingsSecureDelete = t.TempDir(), maxAge, maxBytes, false
+	sessionMap = map[string]sessionInfo{}
+	return withFakeClock(t, 0, 0, 0)
+}
+
+// writeRecording creates the recording of session in namespace with size
+// bytes, last written age before the fake clock's now.
+func writeRecording(t *testing.T, fc *rexectest.FakeClock, namespace, session string, size int, age time.Duration) {
+	t.Helper()
+	path := filepath.Join(RecordingsDir, namespace, session+recordingExt)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := fc.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// remainingRecordings lists the recordings left in RecordingsDir.
+func remainingRecordings(t *testing.T) []string {
+	t.Helper()
+	recordings, err := listRecordings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, r := range recordings {
+		paths = append(paths, r.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// deletions returns target=reason of the recording_delete admin events.
+func deletions(events []auditEvent) map[string]string {
+	deleted := map[string]string{}
+	for _, ev := range events {
+		if ev.Action == "recording_delete" {
+			deleted[ev.Target] = ev.Reason
+		}
+	}
+	return deleted
+}
+
+func assertRecordings(t *testing.T, want ...string) {
+	t.Helper()
+	got := remainingRecordings(t)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("recordings left = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("recordings left = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRecordingRetentionDeletesByAge(t *testing.T) {
+	fc := withRecordings(t, 24*time.Hour, 0)
+	stop := captureAdminEvents(t)
+	writeRecording(t, fc, "payments", "old", 10, 25*time.Hour)
+	writeRecording(t, fc, "payments", "new", 10, time.Hour)
+	if err := os.WriteFile(filepath.Join(RecordingsDir, "payments", "notes.txt"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	enforceRecordingRetention()
+
+	assertRecordings(t, "payments/new.cast")
+	if _, err := os.Stat(filepath.Join(RecordingsDir, "payments", "notes.txt")); err != nil {
+		t.Fatalf("a file that is not a recording was touched: %v", err)
+	}
+	events := stop()
+	if got := deletions(events); len(got) != 1 || got["payments/old.cast"] != recordingDeleteAge {
+		t.Fatalf("deletions = %v, want payments/old.cast for age", got)
+	}
+	if ev := events[0]; ev.Event != "admin" || ev.Info.User != adminActor || ev.Outcome != "success" {
+		t.Fatalf("event = %+v, want a successful admin event of %s", ev, adminActor)
+	}
+}
+
+func TestRecordingRetentionDeletesOldestBySize(t *testing.T) {
+	fc := withRecordings(t, 0, 250)
+	stop := captureAdminEvents(t)
+	writeRecording(t, fc, "payments", "first", 100, 3*time.Hour)
+	writeRecording(t, fc, "checkout", "second", 100, 2*time.Hour)
+	writeRecording(t, fc, "payments", "third", 100, time.Hour)
+
+	enforceRecordingRetention()
+
+	assertRecordings(t, "checkout/second.cast", "payments/third.cast")
+	if got := deletions(stop()); len(got) != 1 || got["payments/first.cast"] != recordingDeleteSize {
+		t.Fatalf("deletions = %v, want payments/first.cast for size", got)
+	}
+}
+
+func TestRecordingRetentionNamespaceOverride(t *testing.T) {
+	fc := withRecordings(t, 24*time.Hour, 150)
+	limitsFile(t, `{"namespaces": {"legal": {"recording_max_age_days": 30}}}`)
+	stop := captureAdminEvents(t)
+	writeRecording(t, fc, "legal", "kept", 100, 10*24*time.Hour)
+	writeRecording(t, fc, "legal", "expired", 100, 31*24*time.Hour)
+	writeRecording(t, fc, "payments", "expired", 10, 2*24*time.Hour)
+	writeRecording(t, fc, "payments", "recent", 100, time.Hour)
+
+	enforceRecordingRetention()
+
+	// legal/kept alone is still over the size limit, it is kept for its 30
+	// days and the recent recording of the other namespace goes instead
+	assertRecordings(t, "legal/kept.cast")
+	want := map[string]string{
+		"legal/expired.cast":    recordingDeleteAge,
+		"payments/expired.cast": recordingDeleteAge,
+		"payments/recent.cast":  recordingDeleteSize,
+	}
+	got := deletions(stop())
+	if len(got) != len(want) {
+		t.Fatalf("deletions = %v, want %v", got, want)
+	}
+	for path, reason := range want {
+		if got[path] != reason {
+			t.Fatalf("deletions = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRecordingRetentionKeepsActiveSessions(t *testing.T) {
+	fc := withRecordings(t, time.Hour, 50)
+	stop := captureAdminEvents(t)
+	writeRecording(t, fc, "payments", "open", 100, 2*time.Hour)
+	writeRecording(t, fc, "payments", "closed", 10, 2*time.Hour)
+	sessionMap["open"] = sessionInfo{User: "alice", NameSpace: "payments"}
+
+	enforceRecordingRetention()
+
+	assertRecordings(t, "payments/open.cast")
+	if got := deletions(stop()); len(got) != 1 || got["payments/closed.cast"] != recordingDeleteAge {
+		t.Fatalf("deletions = %v, want only payments/closed.cast", got)
+	}
+
+	// once the session ended its recording expires like any other
+	delete(sessionMap, "open")
+	captureAdminEvents(t)
+	enforceRecordingRetention()
+	assertRecordings(t)
+}
+
+func TestRecordingRetentionRunsPeriodically(t *testing.T) {
+	fc := withRecordings(t, time.Hour, 0)
+	oldInterval := RecordingsRetentionInterval
+	t.Cleanup(func() { RecordingsRetentionInterval = oldInterval })
+	RecordingsRetentionInterval = 10 * time.Minute
+	captureAdminEvents(t)
+	writeRecording(t, fc, "payments", "session", 10, 55*time.Minute)
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		watchRecordings(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	eventually(t, "the ticker", func() bool { return fc.Waiters() == 1 })
+	assertRecordings(t, "payments/session.cast")
+
+	fc.Advance(10 * time.Minute)
+	eventually(t, "the expired recording to be deleted", func() bool { return len(remainingRecordings(t)) == 0 })
+}
+
+func TestSecureRemoveOverwritesContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.cast")
+	if err := os.WriteFile(path, []byte("$ cat /etc/secret\nhunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// a second link to the inode shows what secureRemove left on disk
+	link := filepath.Join(dir, "link")
+	if err := os.Link(path, link); err != nil {
+		t.Skipf("hard links not supported: %v", err)
+	}
+
+	if err := secureRemove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("recording still exists: %v", err)
+	}
+	data, err := os.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 26 || !bytes.Equal(data, make([]byte, len(data))) {
+		t.Fatalf("content after secure delete = %q, want 26 zero bytes", data)
+	}
+}
+
+func TestValidateRecordings(t *testing.T) {
+	withRecordings(t, 0, 0)
+	if err := validateRecordings(); err != nil {
+		t.Fatalf("validateRecordings: %v", err)
+	}
+	RecordingsMaxAge = -time.Hour
+	if err := validateRecordings(); err == nil {
+		t.Fatal("negative --recordings-max-age accepted")
+	}
+	RecordingsMaxAge = 0
+	RecordingsDir = filepath.Join(RecordingsDir, "missing")
+	if err := validateRecordings(); err == nil {
+		t.Fatal("missing --recordings-dir accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -21,13 +22,27 @@ type rexecRequest struct {
 	namespace string
 	pod       string
 	user      string
+	uid       string
+	groups    []string
+	// impersonator is who acts as user through impersonation, when the
+	// apiserver passes it on in ImpersonatorExtra.
+	impersonator string
 }
 
 type rexecExecParams struct {
-	command       []string
+	command        []string
 	needsRecording bool
-	container     string
-	clientIP      string
+	container      string
+	clientIP       string
+	tty            bool
+	// constraints are those the authorization webhook allowed the session
+	// with.
+	constraints authzConstraints
+	// changeID is the change the session was opened for, if the client sent
+	// one.
+	changeID string
+	// upload is the directory of an upload, see uploadDirectory.
+	upload string
 }
 
 func Server() {
@@ -35,7 +50,8 @@ func Server() {
 	r := mux.NewRouter()
 
 	// handling rexec request to handler
-	r.HandleFunc("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/pods/{pod}/exec", instrumentHandler("rexec", rexecHandler))
+	r.HandleFunc("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/pods/{pod}/exec", instrumentHandler("rexec", requireReady(rexecHandler)))
+	r.HandleFunc("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/pods/{pod}/checkpoint", instrumentHandler("checkpoint", requireReady(checkpointHandler)))
 	// returning some dummy json making kubeapiserver happier
 	r.HandleFunc("/apis/audit.adyen.internal/v1beta1", instrumentHandler("discovery", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -72,31 +88,54 @@ func Server() {
 // rexecHandler is responsible for rewrite the request to an exec request
 // and proxy it back to k8s api
 func rexecHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+	start := clk.Now()
 	defer recordRexecSessionStatus(w)
+	timing := &requestTiming{start: start}
 
 	req, ok := validateRexecRequest(w, r)
 	if !ok {
 		return
 	}
+	timing.authenticate()
+
+	execParams, ok := parseRexecExecParams(w, r, req)
+	if !ok {
+		return
+	}
 
 	if !prepareRexecProxyRequest(w, r, req) {
 		return
 	}
 
-	execParams, ok := parseRexecExecParams(w, r)
-	if !ok {
+	ctxid := uuid.New().String()
+	execParams.changeID = r.Header.Get(changeIDHeader)
+	if !gate.admit(w, ctxid, req.sessionInfo(execParams), strings.Join(execParams.command, " ")) {
 		return
 	}
+	if changeIDRules != nil {
+		if d, ok := checkChangeID(r.Context(), ctxid, req, execParams); !ok {
+			writeStatus(w, d.status())
+			return
+		}
+	}
+	if authzClient != nil {
+		decision := authorize(r.Context(), ctxid, req, execParams, r.Header.Get(authzReasonHeader))
+		if !decision.Allowed {
+			writeStatus(w, decision.denial(ctxid, req.sessionInfo(execParams)).status())
+			return
+		}
+		execParams.constraints = decision.Constraints
+	}
 
 	proxy := buildRexecProxy(start)
 	cmd := strings.Join(execParams.command, " ")
-	if !execParams.needsRecording {
-		serveOneoffRexecSession(w, r, proxy, req, execParams, cmd)
+	// only recorded sessions have a watchdog to enforce the constraints with
+	if !execParams.needsRecording && !execParams.constraints.watched() {
+		serveOneoffRexecSession(w, r, proxy, ctxid, req, execParams, cmd)
 		return
 	}
 
-	serveRecordingRexecSession(w, r, proxy, req, execParams, cmd)
+	serveRecordingRexecSession(w, r, proxy, ctxid, req, execParams, cmd, timing)
 }
 
 func recordRexecSessionStatus(w http.ResponseWriter) {
@@ -127,6 +166,11 @@ func validateRexecRequest(w http.ResponseWriter, r *http.Request) (rexecRequest,
 		namespace: pathParams["namespace"],
 		pod:       pathParams["pod"],
 		user:      r.Header.Get("X-Remote-User"),
+		uid:       r.Header.Get("X-Remote-Uid"),
+		groups:    r.Header.Values("X-Remote-Group"),
+	}
+	if ImpersonatorExtra != "" {
+		req.impersonator = r.Header.Get("X-Remote-Extra-" + url.PathEscape(ImpersonatorExtra))
 	}
 	if req.user == "" || req.namespace == "" || req.pod == "" {
 		w.WriteHeader(http.StatusForbidden)
@@ -139,6 +183,15 @@ func validateRexecRequest(w http.ResponseWriter, r *http.Request) (rexecRequest,
 	return req, true
 }
 
+func (req rexecRequest) sessionInfo(execParams rexecExecParams) sessionInfo {
+	return sessionInfo{
+		User: req.user, UID: req.uid, Groups: req.groups, Impersonator: req.impersonator,
+		NameSpace: req.namespace, Pod: req.pod, Container: execParams.container, ClientIP: execParams.clientIP,
+		TTY: execParams.tty, Constraints: execParams.constraints, ChangeID: execParams.changeID,
+		Upload: execParams.upload,
+	}
+}
+
 func prepareRexecProxyRequest(w http.ResponseWriter, r *http.Request, req rexecRequest) bool {
 	r.Header.Add("Kubectl-Command", "kubectl exec")
 
@@ -154,10 +207,20 @@ func prepareRexecProxyRequest(w http.ResponseWriter, r *http.Request, req rexecR
 
 	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 	r.Header.Add("Impersonate-User", req.user)
-	for _, group := range r.Header.Values("X-Remote-Group") {
+	for _, group := range req.groups {
 		r.Header.Add("Impersonate-Group", group)
 	}
-	r.Header.Add("Impersonate-Extra-Secret-Sauce", SecretSauce)
+	sauce, err := secretSauceFor(req.user)
+	if err != nil {
+		recordError("keyring")
+		SysLogger.Error().Err(err).Msg("failed to sign the secret sauce")
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := w.Write([]byte(httpInternalError)); err != nil {
+			SysLogger.Error().Err(err).Msg("failed to write internal error response")
+		}
+		return false
+	}
+	r.Header.Add("Impersonate-Extra-Secret-Sauce", sauce)
 
 	newPath := fmt.Sprintf("api/v1/namespaces/%s/pods/%s/exec", req.namespace, req.pod)
 	oldPath := fmt.Sprintf("apis/audit.adyen.internal/v1beta1/namespaces/%s/pods/%s/exec", req.namespace, req.pod)
@@ -167,7 +230,7 @@ func prepareRexecProxyRequest(w http.ResponseWriter, r *http.Request, req rexecR
 	return true
 }
 
-func parseRexecExecParams(w http.ResponseWriter, r *http.Request) (rexecExecParams, bool) {
+func parseRexecExecParams(w http.ResponseWriter, r *http.Request, req rexecRequest) (rexecExecParams, bool) {
 	params, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		recordError("request_parse")
@@ -178,12 +241,19 @@ func parseRexecExecParams(w http.ResponseWriter, r *http.Request) (rexecExecPara
 		return rexecExecParams{}, false
 	}
 
+	if perr := validateExecParams(params, "exec"); perr != nil {
+		rejectExecParams(w, req, getIP(r), perr)
+		return rexecExecParams{}, false
+	}
+
 	command, needsRecording, container := parseParams(params)
 	return rexecExecParams{
 		command:        command,
 		needsRecording: needsRecording,
 		container:      container,
 		clientIP:       getIP(r),
+		tty:            params.Get("tty") == "true",
+		upload:         uploadDirectory(params),
 	}, true
 }
 
@@ -192,7 +262,7 @@ func buildRexecProxy(start time.Time) *httputil.ReverseProxy {
 	proxy := httputil.NewSingleHostReverseProxy(apiServerURL)
 	proxy.FlushInterval = -1
 	proxy.ModifyResponse = func(*http.Response) error {
-		recordSessionStart(time.Since(start))
+		recordSessionStart(clk.Since(start))
 		return nil
 	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
@@ -203,25 +273,135 @@ func buildRexecProxy(start time.Time) *httputil.ReverseProxy {
 	return proxy
 }
 
-func serveOneoffRexecSession(w http.ResponseWriter, r *http.Request, proxy *httputil.ReverseProxy, req rexecRequest, execParams rexecExecParams, cmd string) {
+// constraintsHeader carries the constraints a session runs under, as JSON, on
+// the response that establishes it, so the client can tell its user before
+// they bite.
+const constraintsHeader = "X-Rexec-Constraints"
+
+// sessionConstraints is the value of constraintsHeader. A zero limit is not
+// enforced.
+type sessionConstraints struct {
+	Recorded           bool  `json:"recorded"`
+	MaxDurationSeconds int64 `json:"max_duration_seconds,omitempty"`
+	IdleTimeoutSeconds int64 `json:"idle_timeout_seconds,omitempty"`
+	OutputCapBytes     int64 `json:"output_cap_bytes,omitempty"`
+}
+
+// identityHeader carries, as JSON, the identity the session is audited under
+// on the response that establishes it, so a client acting through
+// impersonation can tell whose session the audit log will show.
+const identityHeader = "X-Rexec-Identity"
+
+// sessionIdentity is the value of identityHeader.
+type sessionIdentity struct {
+	User   string   `json:"user"`
+	UID    string   `json:"uid,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Impersonator is who acts as User, recorded with the session.
+	Impersonator string `json:"impersonator,omitempty"`
+}
+
+// sessionIDHeader carries the id of the session, under which its audit
+// events are logged, on the response that establishes it, so a client can
+// tell which audit session a command was.
+const sessionIDHeader = "X-Rexec-Session-Id"
+
+// ImpersonatorExtra is the user extra naming who impersonates the user, as the
+// apiserver passes it on in the X-Remote-Extra-<key> header. The apiserver
+// only passes on the extras of the impersonated user, so the client has to
+// send it with --as-user-extra, which RBAC can restrict to the name of the
+// user sending it. Empty turns it off.
+var ImpersonatorExtra = "impersonator"
+
+// announceSession sets constraintsHeader to c, identityHeader to the identity
+// of req and sessionIDHeader to ctxid on the response of proxy that
+// establishes the session: a protocol switch, or a success.
+func announceSession(proxy *httputil.ReverseProxy, ctxid string, req rexecRequest, c sessionConstraints) {
+	constraints, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	identity, err := json.Marshal(sessionIdentity{User: req.user, UID: req.uid, Groups: req.groups, Impersonator: req.impersonator})
+	if err != nil {
+		return
+	}
+	next := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusSwitchingProtocols || resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			resp.Header.Set(constraintsHeader, string(constraints))
+			resp.Header.Set(identityHeader, string(identity))
+			resp.Header.Set(sessionIDHeader, ctxid)
+		}
+		if next == nil {
+			return nil
+		}
+		return next(resp)
+	}
+}
+
+func serveOneoffRexecSession(w http.ResponseWriter, r *http.Request, proxy *httputil.ReverseProxy, ctxid string, req rexecRequest, execParams rexecExecParams, cmd string) {
 	activeSessions.WithLabelValues("oneoff").Inc()
 	defer activeSessions.WithLabelValues("oneoff").Dec()
 	proxy.Transport = apiServerTransport()
-	logCommand(cmd, req.user, "oneoff", req.namespace, req.pod, execParams.container, execParams.clientIP)
+	info := req.sessionInfo(execParams)
+	// the command is logged under the id the client is told, so a copy can
+	// be found in the audit log
+	logCommand(cmd, ctxid, info)
+	checkIdentity(ctxid, info)
+	announceSession(proxy, ctxid, req, sessionConstraints{})
 	proxy.ServeHTTP(w, r)
 }
 
-func serveRecordingRexecSession(w http.ResponseWriter, r *http.Request, proxy *httputil.ReverseProxy, req rexecRequest, execParams rexecExecParams, cmd string) {
+func serveRecordingRexecSession(w http.ResponseWriter, r *http.Request, proxy *httputil.ReverseProxy, ctxid string, req rexecRequest, execParams rexecExecParams, cmd string, timing *requestTiming) {
 	activeSessions.WithLabelValues("recording").Inc()
 	defer activeSessions.WithLabelValues("recording").Dec()
 
-	ctxid := uuid.New().String()
-	info := registerSession(ctxid, req.user, req.namespace, req.pod, execParams.container, execParams.clientIP)
-	defer endSession(ctxid)
+	// the entries of an upload can only be read from websocket frames, over
+	// SPDY its stdin is recorded as keystrokes like any other
+	websocket := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	upload := execParams.upload
+	if !websocket {
+		execParams.upload = ""
+	}
+	info := registerSession(ctxid, req.sessionInfo(execParams))
+	checkIdentity(ctxid, info)
+	if RecordingsDir != "" && websocket && info.TTY {
+		if recorder := startRecording(ctxid, info); recorder != nil {
+			defer recorder.close()
+		}
+	}
 
-	logCommand(cmd, req.user, ctxid, req.namespace, req.pod, execParams.container, execParams.clientIP)
-	proxy.Transport = auditedAPIServerTransport(ctxid, info)
+	// cancelling the request context makes the reverse proxy close the
+	// upgraded connection, which is how the watchdog ends a session
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+	watchdog := startSessionWatchdog(ctxid, info, cancel)
+	watchdog.timing.Authn, watchdog.timing.Policy = timing.admitted()
+	defer endSession(ctxid, watchdog)
+	defer watchdog.stop()
+	defer gate.track(watchdog)()
+	proxy.ErrorHandler = watchdog.errorHandler(proxy.ErrorHandler)
+	announceSession(proxy, ctxid, req, sessionConstraints{
+		Recorded:           true,
+		MaxDurationSeconds: int64(watchdog.maxDuration / time.Second),
+		IdleTimeoutSeconds: int64(SessionIdleTimeout / time.Second),
+		OutputCapBytes:     info.Constraints.OutputCap,
+	})
+
+	enqueueSessionEvent(ctxid, info, "", cmd)
+	if upload != "" && !websocket {
+		unparsed := info
+		unparsed.Upload = upload
+		enqueueEvent(sessionBufferFor(ctxid), auditEvent{
+			Session: ctxid, Info: unparsed, Event: "upload_unparsed", Captured: clk.Now(),
+			Reason: "the archive is not streamed over a websocket, its stdin is recorded as keystrokes",
+		})
+	}
+	proxy.Transport = auditedAPIServerTransport(ctxid, info, watchdog, websocket)
 	proxy.ServeHTTP(w, r)
+	// the client went away when nothing marked the end of the stream before
+	watchdog.streamEnded()
 }
 
 func ensureValidToken() error {
@@ -236,7 +416,7 @@ func ensureValidToken() error {
 		SysLogger.Error().Err(err).Msg("failed to get expiration time from service account token")
 		return err
 	}
-	if expirationTime.Before(time.Now().Add(60 * time.Second)) {
+	if expirationTime.Before(clk.Now().Add(60 * time.Second)) {
 		SysLogger.Debug().Msg("service account token is expired, getting a new one")
 		tokenSync.Lock()
 		err = loadToken()
@@ -255,7 +435,7 @@ func ensureValidToken() error {
 			SysLogger.Error().Err(err).Msg("failed to get expiration time from the new service account token")
 			return err
 		}
-		if expirationTime.Before(time.Now().Add(60 * time.Second)) {
+		if expirationTime.Before(clk.Now().Add(60 * time.Second)) {
 			SysLogger.Error().Msg("new service account token is also expired")
 			return errors.New("new service account token is also expired")
 		}
@@ -320,6 +500,13 @@ func canPass(rv admissionv1.AdmissionReview) bool {
 			return true
 		}
 	}
+	if uid := rv.Request.UserInfo.UID; uid != "" {
+		for _, bypassed := range ByPassedUIDs {
+			if bypassed == uid {
+				return true
+			}
+		}
+	}
 
 	// we will check for a shared key so we can validate the request was
 	// coming through the rexec endpoint
@@ -327,7 +514,7 @@ func canPass(rv admissionv1.AdmissionReview) bool {
 	if ok {
 		if len(sauce) > 0 {
 			for _, sauce := range sauce {
-				if sauce == SecretSauce {
+				if validSecretSauce(sauce, rv.Request.UserInfo.Username) {
 					return true
 				}
 			}
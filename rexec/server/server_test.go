@@ -8,9 +8,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	admissionv1 "k8s.io/api/admission/v1"
 	authv1 "k8s.io/api/authentication/v1"
@@ -177,6 +181,22 @@ func TestCanPassBypassUser(t *testing.T) {
 	}
 }
 
+func TestCanPassBypassUID(t *testing.T) {
+	oldUIDs := ByPassedUIDs
+	t.Cleanup(func() { ByPassedUIDs = oldUIDs })
+
+	ByPassedUIDs = []string{"7f3c-uid"}
+
+	rv := makeAdmissionReview("", "lauren", nil)
+	if canPass(rv) {
+		t.Fatal("expected canPass false for a user without a bypassed UID")
+	}
+	rv.Request.UserInfo.UID = "7f3c-uid"
+	if !canPass(rv) {
+		t.Fatal("expected canPass true for bypassed UID")
+	}
+}
+
 func TestCanPassSecretSauceMatch(t *testing.T) {
 	oldBypass := ByPassedUsers
 	oldSauce := SecretSauce
@@ -220,12 +240,17 @@ func initCleanup(t *testing.T) {
 	oldSauce := SecretSauce
 	oldExitFn := exitFn
 	oldDomain := ClusterDomain
+	oldDeadline := StartupDeadline
 	t.Cleanup(func() {
 		caPath, tokenPath = oldCAPath, oldTokenPath
 		SecretSauce = oldSauce
 		exitFn = oldExitFn
 		ClusterDomain = oldDomain
+		StartupDeadline = oldDeadline
 	})
+	// Init fails before it could get ready, the deadline must not outlive
+	// the test
+	StartupDeadline = 0
 }
 
 func TestInitMissingCA(t *testing.T) {
@@ -428,3 +453,134 @@ func TestVerifiedFrontProxy(t *testing.T) {
 		t.Fatal("expected false for a disallowed common name")
 	}
 }
+
+func TestRexecHandlerAnnouncesSession(t *testing.T) {
+	oldNames := RequestHeaderAllowedNames
+	t.Cleanup(func() { RequestHeaderAllowedNames = oldNames })
+	RequestHeaderAllowedNames = nil
+	withFakeClock(t, 15*time.Minute, time.Hour, 0)
+	withSessionMaps(t)
+	buf := captureAuditLocked(t)
+	stop := runAuditPipeline(t)
+	withFakeAPIServer(t, &fakeAPIServer{execStatus: http.StatusOK})
+
+	tests := []struct {
+		name  string
+		query string
+		// pdp is the answer of the authorization webhook, none when empty.
+		pdp  string
+		want string
+	}{
+		{"one-off", "command=ls&stdout=true", "", `{"recorded":false}`},
+		{"recorded", "command=sh&tty=true&stdin=true&stdout=true", "", `{"recorded":true,"max_duration_seconds":3600,"idle_timeout_seconds":900}`},
+		{
+			"constrained by the webhook", "command=ls&stdout=true", `{"allowed":true,"constraints":{"max_duration":"30m","output_cap":5368709120}}`,
+			`{"recorded":true,"max_duration_seconds":1800,"idle_timeout_seconds":900,"output_cap_bytes":5368709120}`,
+		},
+	}
+	var sessions []string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pdp != "" {
+				withAuthzWebhook(t, &fakePDP{answer: tt.pdp})
+			}
+			req := httptest.NewRequest(http.MethodPost, "/apis/audit.adyen.internal/v1beta1/namespaces/default/pods/web-0/exec?"+tt.query, nil)
+			req.Header.Set("X-Remote-User", "alice")
+			req.Header.Set("X-Remote-Uid", "1001")
+			req.Header.Add("X-Remote-Group", "devs")
+			req.Header.Add("X-Remote-Group", "system:authenticated")
+			req = withFrontProxyCert(req, "front-proxy-client")
+			req = mux.SetURLVars(req, map[string]string{"namespace": "default", "pod": "web-0"})
+			rr := httptest.NewRecorder()
+			rexecHandler(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body)
+			}
+			if got := rr.Header().Get(constraintsHeader); got != tt.want {
+				t.Fatalf("%s = %s, want %s", constraintsHeader, got, tt.want)
+			}
+			if got, want := rr.Header().Get(identityHeader), `{"user":"alice","uid":"1001","groups":["devs","system:authenticated"]}`; got != want {
+				t.Fatalf("%s = %s, want %s", identityHeader, got, want)
+			}
+			id := rr.Header().Get(sessionIDHeader)
+			if _, err := uuid.Parse(id); err != nil {
+				t.Fatalf("%s = %q, want a uuid", sessionIDHeader, id)
+			}
+			sessions = append(sessions, id)
+		})
+	}
+	stop()
+	// the one-off command is logged under the session announced too
+	for _, id := range sessions {
+		if !strings.Contains(buf.String(), `"session":"`+id+`"`) {
+			t.Errorf("no audit event of session %s:\n%s", id, buf.String())
+		}
+	}
+}
+
+func TestRexecHandlerAnnouncesImpersonator(t *testing.T) {
+	oldNames := RequestHeaderAllowedNames
+	t.Cleanup(func() { RequestHeaderAllowedNames = oldNames })
+	RequestHeaderAllowedNames = nil
+	withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	withAuditFormat(t, auditFormatDual, "")
+	buf := captureAuditLocked(t)
+	stop := runAuditPipeline(t)
+	withFakeAPIServer(t, &fakeAPIServer{execStatus: http.StatusOK})
+
+	for _, tt := range []struct {
+		name  string
+		extra string
+		want  string
+	}{
+		{"passed on", "impersonator", `{"user":"break-glass","impersonator":"alice"}`},
+		{"turned off", "", `{"user":"break-glass"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			old := ImpersonatorExtra
+			t.Cleanup(func() { ImpersonatorExtra = old })
+			ImpersonatorExtra = tt.extra
+			req := httptest.NewRequest(http.MethodPost, "/apis/audit.adyen.internal/v1beta1/namespaces/default/pods/web-0/exec?command=ls&stdout=true", nil)
+			req.Header.Set("X-Remote-User", "break-glass")
+			req.Header.Set("X-Remote-Extra-Impersonator", "alice")
+			req = withFrontProxyCert(req, "front-proxy-client")
+			req = mux.SetURLVars(req, map[string]string{"namespace": "default", "pod": "web-0"})
+			rr := httptest.NewRecorder()
+			rexecHandler(rr, req)
+			if got := rr.Header().Get(identityHeader); got != tt.want {
+				t.Fatalf("%s = %s, want %s", identityHeader, got, tt.want)
+			}
+		})
+	}
+	stop()
+	// the one-off command of the first request records who impersonated
+	if got := strings.Count(buf.String(), `"actor":{"user":"break-glass","uid":"","groups":[],"client_ip":"192.0.2.1:1234","impersonator":"alice"}`); got != 1 {
+		t.Fatalf("v2 events naming the impersonator: %d, want 1:\n%s", got, buf.String())
+	}
+}
+
+func TestAnnounceSessionOnlyOnSuccess(t *testing.T) {
+	proxy := &httputil.ReverseProxy{}
+	announceSession(proxy, "0f1e2d3c", rexecRequest{user: "alice"}, sessionConstraints{Recorded: true})
+	for code, want := range map[int]string{
+		http.StatusSwitchingProtocols: `{"recorded":true}`,
+		http.StatusOK:                 `{"recorded":true}`,
+		http.StatusForbidden:          "",
+		http.StatusBadGateway:         "",
+	} {
+		resp := &http.Response{StatusCode: code, Header: http.Header{}}
+		if err := proxy.ModifyResponse(resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get(constraintsHeader); got != want {
+			t.Errorf("%s on a %d = %q, want %q", constraintsHeader, code, got, want)
+		}
+		if got := resp.Header.Get(identityHeader); (got != "") != (want != "") {
+			t.Errorf("%s on a %d = %q", identityHeader, code, got)
+		}
+		if got := resp.Header.Get(sessionIDHeader); got != "0f1e2d3c" && want != "" || got != "" && want == "" {
+			t.Errorf("%s on a %d = %q", sessionIDHeader, code, got)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adyen/kubectl-rexec/rexec/server/clock"
+)
+
+// clk is the time source of the server, swapped for a fake clock in tests.
+var clk clock.Clock = clock.Real{}
+
+// SessionIdleTimeout ends a recorded session after this long without traffic
+// in either direction. Zero disables it.
+var SessionIdleTimeout time.Duration
+
+// SessionMaxDuration ends a recorded session this long after it started. Zero
+// disables it.
+var SessionMaxDuration time.Duration
+
+// SessionHeartbeatInterval emits a session_heartbeat audit event at this
+// interval while a recorded session is open. Zero disables it.
+var SessionHeartbeatInterval time.Duration
+
+// sessionWatchdog enforces the idle timeout and maximum duration of a session
+// and emits its heartbeats. It terminates the session through cancel, after
+// writing why into the terminal of a TTY through conn.
+type sessionWatchdog struct {
+	ctxid        string
+	info         sessionInfo
+	cancel       func()
+	lastActivity atomic.Int64
+	// fromClient and toClient count the bytes of the session in either
+	// direction. ended is the first reason the session ended for, none yet
+	// when the client went away.
+	fromClient, toClient atomic.Int64
+	ended                atomic.Pointer[string]
+	// conn is the upstream connection of the session once dialed, denied is
+	// set when the watchdog terminated the session.
+	conn   atomic.Pointer[TCPLogger]
+	denied atomic.Pointer[denial]
+	// maxDuration is SessionMaxDuration, or the shorter one the authorization
+	// webhook allowed. capped is signalled once more was sent to the client
+	// than its output cap.
+	maxDuration time.Duration
+	capped      chan struct{}
+	// auditLost is signalled when the audit pipeline stayed unavailable for
+	// longer than AuditFailClosedGrace.
+	auditLost chan struct{}
+
+	// timing holds the phases before the watchdog started, the others are
+	// marked in unix nanos, zero until reached, and dial is the duration of
+	// the dial.
+	timing                                   sessionTiming
+	dial, dialedAt, firstByteAt, streamEndAt atomic.Int64
+	stalls                                   atomic.Int64
+	// stallBytes, stallSince and stalled are what the stall sampler saw
+	// last, only touched by run.
+	stallBytes int64
+	stallSince time.Time
+	stalled    bool
+
+	idle      clock.Timer
+	max       clock.Timer
+	heartbeat clock.Ticker
+	stall     clock.Ticker
+	done      chan struct{}
+	exited    chan struct{}
+	stopOnce  sync.Once
+}
+
+// startSessionWatchdog creates the timers synchronously, so they exist once it
+// returns, and watches them in the background until stop is called.
+func startSessionWatchdog(ctxid string, info sessionInfo, cancel func()) *sessionWatchdog {
+	w := &sessionWatchdog{
+		ctxid: ctxid, info: info, cancel: cancel, maxDuration: SessionMaxDuration,
+		capped: make(chan struct{}, 1), auditLost: make(chan struct{}, 1), done: make(chan struct{}), exited: make(chan struct{}),
+	}
+	w.touch()
+	if SessionIdleTimeout > 0 {
+		w.idle = clk.NewTimer(SessionIdleTimeout)
+	}
+	if c := info.Constraints.MaxDuration; c > 0 && (w.maxDuration == 0 || c < w.maxDuration) {
+		w.maxDuration = c
+	}
+	if w.maxDuration > 0 {
+		w.max = clk.NewTimer(w.maxDuration)
+	}
+	if SessionHeartbeatInterval > 0 {
+		w.heartbeat = clk.NewTicker(SessionHeartbeatInterval)
+	}
+	if SessionStallThreshold > 0 {
+		w.stallSince = clk.Now()
+		w.stall = clk.NewTicker(SessionStallThreshold / stallSamples)
+	}
+	go w.run()
+	return w
+}
+
+// touch records traffic on the session. It is called on the data path, so it
+// is a single atomic store.
+func (w *sessionWatchdog) touch() {
+	if w == nil {
+		return
+	}
+	w.lastActivity.Store(clk.Now().UnixNano())
+}
+
+// transferred counts n bytes sent by, or to, the client.
+func (w *sessionWatchdog) transferred(n int, byClient bool) {
+	if w == nil {
+		return
+	}
+	if byClient {
+		w.fromClient.Add(int64(n))
+		return
+	}
+	if sent := w.toClient.Add(int64(n)); w.info.Constraints.OutputCap > 0 && sent > w.info.Constraints.OutputCap {
+		select {
+		case w.capped <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// attach makes conn the connection denials are written to.
+func (w *sessionWatchdog) attach(conn *TCPLogger) {
+	if w == nil {
+		return
+	}
+	w.conn.Store(conn)
+}
+
+// errorHandler answers a request the watchdog terminated before the apiserver
+// answered with the Status of the denial, other errors go to next.
+func (w *sessionWatchdog) errorHandler(next func(http.ResponseWriter, *http.Request, error)) func(http.ResponseWriter, *http.Request, error) {
+	return func(rw http.ResponseWriter, r *http.Request, err error) {
+		if d := w.denied.Load(); d != nil {
+			writeStatus(rw, d.status())
+			return
+		}
+		next(rw, r, err)
+	}
+}
+
+// end records why the session ended, and when the stream did, unless a reason
+// was recorded before.
+func (w *sessionWatchdog) end(reason string) {
+	if w == nil {
+		return
+	}
+	if w.ended.CompareAndSwap(nil, &reason) {
+		w.streamEnded()
+	}
+}
+
+// endReason is the recorded reason, client_cancelled when the session ended
+// without one: the client closed the connection while the command still ran.
+func (w *sessionWatchdog) endReason() string {
+	if w == nil {
+		return ""
+	}
+	if reason := w.ended.Load(); reason != nil {
+		return *reason
+	}
+	return "client_cancelled"
+}
+
+// stop ends the watchdog and waits for it, so nothing is emitted for the
+// session after stop returns.
+func (w *sessionWatchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() { close(w.done) })
+	<-w.exited
+}
+
+func (w *sessionWatchdog) run() {
+	defer close(w.exited)
+	defer w.stopTimers()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-timerC(w.idle):
+			idleFor := clk.Since(time.Unix(0, w.lastActivity.Load()))
+			if idleFor < SessionIdleTimeout {
+				w.idle.Reset(SessionIdleTimeout - idleFor)
+				continue
+			}
+			w.terminate("session_idle_timeout", fmt.Sprintf("the session was idle for %s", SessionIdleTimeout))
+			return
+		case <-timerC(w.max):
+			w.terminate("session_max_duration", fmt.Sprintf("the session reached its maximum duration of %s", w.maxDuration))
+			return
+		case <-w.capped:
+			w.terminate("session_output_cap", fmt.Sprintf("the session sent more than its output cap of %d bytes", w.info.Constraints.OutputCap))
+			return
+		case <-w.auditLost:
+			auditFailClosedTotal.WithLabelValues("terminated").Inc()
+			w.terminate("session_audit_unavailable", fmt.Sprintf("the audit pipeline was unavailable for longer than %s", AuditFailClosedGrace))
+			return
+		case <-tickerC(w.heartbeat):
+			enqueueSessionEvent(w.ctxid, w.info, "session_heartbeat", "")
+		case <-tickerC(w.stall):
+			w.sampleStall()
+		}
+	}
+}
+
+// terminate ends the session for the rule event. A TTY already streaming is
+// handed the denial message and given denialGrace to end before it is
+// cancelled, a request not answered yet gets the denial as its Status.
+func (w *sessionWatchdog) terminate(event, reason string) {
+	w.end(event)
+	enqueueSessionEvent(w.ctxid, w.info, event, "")
+	d := newDenial(event, reason, w.ctxid, w.info)
+	w.denied.Store(&d)
+	if conn := w.conn.Load(); conn != nil && conn.deny(d) {
+		grace := clk.NewTimer(denialGrace)
+		defer grace.Stop()
+		select {
+		case <-w.done:
+			return
+		case <-grace.C():
+		}
+	}
+	w.cancel()
+}
+
+func (w *sessionWatchdog) stopTimers() {
+	if w.idle != nil {
+		w.idle.Stop()
+	}
+	if w.max != nil {
+		w.max.Stop()
+	}
+	if w.heartbeat != nil {
+		w.heartbeat.Stop()
+	}
+	if w.stall != nil {
+		w.stall.Stop()
+	}
+}
+
+// timerC and tickerC return nil channels for disabled timers, which never fire
+// in a select.
+func timerC(t clock.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C()
+}
+
+func tickerC(t clock.Ticker) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C()
+}
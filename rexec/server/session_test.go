@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rexectest "github.com/adyen/kubectl-rexec/rexec/server/testutil"
+	"github.com/rs/zerolog"
+)
+
+// lockedBuffer is written by the watchdog goroutine while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) count(s string) int {
+	return strings.Count(b.String(), s)
+}
+
+func captureAuditLocked(t *testing.T) *lockedBuffer {
+	t.Helper()
+	old := auditLogger
+	buf := &lockedBuffer{}
+	auditLogger = zerolog.New(buf).Level(zerolog.InfoLevel)
+	t.Cleanup(func() { auditLogger = old })
+	return buf
+}
+
+// withFakeClock swaps the server clock and the session limits for the test.
+func withFakeClock(t *testing.T, idle, max, heartbeat time.Duration) *rexectest.FakeClock {
+	t.Helper()
+	oldClk, oldIdle, oldMax, oldHeartbeat := clk, SessionIdleTimeout, SessionMaxDuration, SessionHeartbeatInterval
+	t.Cleanup(func() {
+		clk, SessionIdleTimeout, SessionMaxDuration, SessionHeartbeatInterval = oldClk, oldIdle, oldMax, oldHeartbeat
+	})
+	fc := rexectest.NewFakeClock(time.Unix(1700000000, 0))
+	clk = fc
+	SessionIdleTimeout, SessionMaxDuration, SessionHeartbeatInterval = idle, max, heartbeat
+	return fc
+}
+
+// eventually polls cond, the watchdog reacts to the fake clock on its own
+// goroutine. Nothing here waits on wall clock time passing in the code under
+// test, the deadline only bounds a broken test.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func cancelled(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSessionWatchdogIdleTimeout(t *testing.T) {
+	fc := withFakeClock(t, 10*time.Minute, 0, 0)
+	buf := captureAuditLocked(t)
+	stopAudit := runAuditPipeline(t)
+	done := make(chan struct{})
+
+	w := startSessionWatchdog("sess", sessionInfo{User: "alice"}, func() { close(done) })
+	defer w.stop()
+
+	// activity half way through pushes the deadline out
+	fc.Advance(5 * time.Minute)
+	w.touch()
+	fc.Advance(5 * time.Minute)
+	eventually(t, "idle timer re-armed", func() bool { return fc.Waiters() == 1 })
+	if cancelled(done) {
+		t.Fatal("session ended although it was active 5m ago")
+	}
+
+	fc.Advance(4 * time.Minute)
+	if cancelled(done) {
+		t.Fatal("session ended before the idle timeout")
+	}
+	fc.Advance(time.Minute)
+	<-done
+	w.stop()
+	stopAudit()
+	if buf.count(`"event":"session_idle_timeout"`) != 1 {
+		t.Fatalf("expected one session_idle_timeout event, got: %s", buf.String())
+	}
+	eventually(t, "timers stopped", func() bool { return fc.Waiters() == 0 })
+}
+
+func TestSessionWatchdogMaxDuration(t *testing.T) {
+	fc := withFakeClock(t, 10*time.Minute, time.Hour, 0)
+	buf := captureAuditLocked(t)
+	stopAudit := runAuditPipeline(t)
+	done := make(chan struct{})
+
+	w := startSessionWatchdog("sess", sessionInfo{User: "alice"}, func() { close(done) })
+	defer w.stop()
+
+	// stay busy so the idle timeout never triggers
+	for i := 0; i < 11; i++ {
+		w.touch()
+		fc.Advance(5 * time.Minute)
+	}
+	if cancelled(done) {
+		t.Fatal("session ended before its maximum duration")
+	}
+	w.touch()
+	fc.Advance(5 * time.Minute)
+	<-done
+	w.stop()
+	stopAudit()
+	if buf.count(`"event":"session_max_duration"`) != 1 || buf.count("session_idle_timeout") != 0 {
+		t.Fatalf("expected only a session_max_duration event, got: %s", buf.String())
+	}
+	eventually(t, "timers stopped", func() bool { return fc.Waiters() == 0 })
+}
+
+func TestSessionWatchdogHeartbeat(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, time.Minute)
+	buf := captureAuditLocked(t)
+	runAuditPipeline(t)
+
+	w := startSessionWatchdog("sess", sessionInfo{User: "alice"}, func() { t.Error("heartbeat must not end the session") })
+
+	for i := 1; i <= 3; i++ {
+		fc.Advance(time.Minute)
+		eventually(t, "heartbeat", func() bool { return buf.count(`"event":"session_heartbeat"`) == i })
+	}
+
+	w.stop()
+	eventually(t, "ticker stopped", func() bool { return fc.Waiters() == 0 })
+	fc.Advance(time.Hour)
+	if n := buf.count(`"event":"session_heartbeat"`); n != 3 {
+		t.Fatalf("expected no heartbeats after stop, got %d", n)
+	}
+}
+
+func TestSessionWatchdogDisabled(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+
+	w := startSessionWatchdog("sess", sessionInfo{}, func() { t.Error("disabled watchdog ended the session") })
+	if fc.Waiters() != 0 {
+		t.Fatalf("disabled watchdog created %d timers", fc.Waiters())
+	}
+	fc.Advance(24 * time.Hour)
+	w.stop()
+	w.stop()
+
+	var nilWatchdog *sessionWatchdog
+	nilWatchdog.touch()
+	nilWatchdog.stop()
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// auditSink is a destination for audit events. Write gets the events of a
+// batch in order and either takes all of them or returns an error, in which
+// case the same batch is offered again.
+type auditSink interface {
+	Name() string
+	Write(events []auditEvent) error
+}
+
+// auditSinks are the destinations every recorded session event is fanned out
+// to, in order.
+var auditSinks = []auditSink{logSink{}}
+
+// auditSinkRetries is how often a failed batch is retried before it is dropped.
+var auditSinkRetries = 5
+
+// auditRetryBackoff is the wait before the first retry, doubled on every
+// further attempt.
+var auditRetryBackoff = 100 * time.Millisecond
+
+// deliverAudit hands batch to every sink. A failing batch is retried in place
+// before the shard moves on, so a retry can delay the sessions of the shard but
+// never reorder them. A batch that keeps failing is dropped for that sink only
+// and shows up as a gap in the session's index. The batch counts as pending on
+// every sink until that sink took or dropped it.
+func deliverAudit(batch []auditEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	id, oldest := deliverySeq.Add(1), oldestCaptured(batch)
+	for _, sink := range auditSinks {
+		lagFor(sink.Name()).begin(id, oldest)
+	}
+	for _, sink := range auditSinks {
+		deliverToSink(sink, batch)
+		lagFor(sink.Name()).end(id)
+	}
+}
+
+// deliverToSink writes batch to sink, retrying with backoff, and observes the
+// delivery latency of its events once it is taken.
+func deliverToSink(sink auditSink, batch []auditEvent) {
+	backoff := auditRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := sink.Write(batch)
+		if err == nil {
+			now, latency := clk.Now(), auditSinkDeliveryLatency.WithLabelValues(sink.Name())
+			for _, ev := range batch {
+				if !ev.Captured.IsZero() {
+					latency.Observe(now.Sub(ev.Captured).Seconds())
+				}
+			}
+			return
+		}
+		recordError("audit_sink")
+		if attempt >= auditSinkRetries {
+			SysLogger.Error().Err(err).Str("sink", sink.Name()).Int("events", len(batch)).Msg("dropping audit batch after retries")
+			return
+		}
+		SysLogger.Debug().Err(err).Str("sink", sink.Name()).Int("attempt", attempt+1).Msg("retrying audit batch")
+		if backoff > 0 {
+			timer := clk.NewTimer(backoff)
+			<-timer.C()
+			backoff *= 2
+		}
+	}
+}
+
+// logSink writes events to the audit log.
+type logSink struct{}
+
+func (logSink) Name() string { return "log" }
+
+func (logSink) Write(events []auditEvent) error {
+	for _, ev := range events {
+		emitAudit(logSink{}.Name(), auditType(ev), auditEventLevel(ev.Event), legacyEventFields(ev), ev, func(e *zerolog.Event) *zerolog.Event {
+			return auditEventFields(e, ev)
+		})
+	}
+	return nil
+}
+
+// legacyEventFields builds the flat line of ev the existing tooling parses,
+// its bytes must not change. Commands, session_start and session_end have
+// the fields they had before the v2 events, the categories added since have
+// their own after the same identity.
+func legacyEventFields(ev auditEvent) auditFields {
+	return func(e *zerolog.Event) *zerolog.Event {
+		if ev.Event != "" {
+			e = e.Str("event", ev.Event)
+		}
+		e = e.Str("user", ev.Info.User).Str("session", ev.Session).Str("namespace", ev.Info.NameSpace).Str("pod", ev.Info.Pod).Str("container", ev.Info.Container).Str("client_ip", ev.Info.ClientIP)
+		switch ev.Event {
+		case "session_start", "session_end":
+			return e
+		}
+		return auditEventFields(e, ev)
+	}
+}
+
+// auditEventFields adds the fields of the category of ev, the same on the
+// legacy line and in the data of the v2 event. The identity of the user is
+// not among them, v2 has it in the actor.
+func auditEventFields(e *zerolog.Event, ev auditEvent) *zerolog.Event {
+	switch ev.Event {
+	case "":
+		e = e.Str("command", ev.Command)
+	case "session_start":
+		l := ev.Info.Limits
+		e = e.Int("max_strokes_per_line", l.MaxStrokesPerLine).Int("max_lines", l.MaxLines).Int("sample_every", l.SampleEvery).Int("session_buffer", l.SessionBuffer)
+	case "session_end":
+		if ev.Reason != "" {
+			e = e.Str("reason", ev.Reason).Int64("bytes_from_client", ev.ClientBytes).Int64("bytes_to_client", ev.UpstreamBytes)
+		}
+		if ev.SampledLines > 0 {
+			e = e.Uint64("lines_sampled_out", ev.SampledLines)
+		}
+		if t := ev.Timing; t != nil {
+			e = e.Dur("authn_duration", t.Authn).Dur("policy_duration", t.Policy).Dur("dial_duration", t.Dial).
+				Dur("first_byte_duration", t.FirstByte).Dur("stream_duration", t.Stream).Dur("teardown_duration", t.Teardown).Int64("stalls", t.Stalls)
+		}
+	case "identity_uid_changed":
+		e = e.Str("previous_uid", ev.PreviousUID)
+	case "audit_gap":
+		e = e.Int64("bytes_lost", ev.LostBytes).Dur("gap_duration", ev.Gap)
+		if ev.Command != "" {
+			e = e.Str("partial_command", ev.Command)
+		}
+	case "proxy_start", "proxy_config":
+		p := ev.Provenance
+		e = e.Str("version", p.Version).Str("commit", p.Commit).Str("build_date", p.BuildDate).Str("go_version", p.GoVersion).
+			Strs("features", p.Features).Str("config_hash", p.ConfigHash).Str("proxy_pod", p.Pod).Str("cluster", p.Cluster)
+	case "admin":
+		e = e.Str("action", ev.Action).Str("target", ev.Target).Str("before_hash", ev.Before).Str("after_hash", ev.After).Str("outcome", ev.Outcome)
+		if ev.Reason != "" {
+			e = e.Str("reason", ev.Reason)
+		}
+	case "audit_sink_stale", "audit_sink_recovered":
+		e = e.Str("sink", ev.Sink).Dur("oldest_undelivered", ev.Lag).Dur("threshold", ev.Threshold)
+	case "audit_pipeline_unavailable":
+		e = e.Str("reason", ev.Reason)
+	case "audit_pipeline_recovered":
+		e = e.Str("reason", ev.Reason).Dur("unavailable_duration", ev.Gap).Int("refusals_not_held", ev.Unheld)
+	case "session_refused":
+		e = e.Str("command", ev.Command).Str("reason", ev.Reason)
+	case "container_checkpoint":
+		e = e.Str("node", ev.Node).Strs("archives", ev.Archives).Str("outcome", ev.Outcome)
+		if ev.Reason != "" {
+			e = e.Str("reason", ev.Reason)
+		}
+	case "authz_decision":
+		c := ev.Info.Constraints
+		e = e.Bool("tty", ev.Info.TTY).Str("command", ev.Command).
+			Str("decision", ev.Outcome).Str("source", ev.AuthzSource).Dur("latency", ev.Latency)
+		if ev.Reason != "" {
+			e = e.Str("reason", ev.Reason)
+		}
+		if c.MaxDuration > 0 {
+			e = e.Dur("max_duration", c.MaxDuration)
+		}
+		if c.OutputCap > 0 {
+			e = e.Int64("output_cap", c.OutputCap)
+		}
+		if c.RequireRecording {
+			e = e.Bool("require_recording", true)
+		}
+	case "session_limit_exceeded":
+		e = e.Str("limit", ev.Limit).Int64("limit_bytes", ev.LimitBytes).Str("direction", ev.Direction).Uint64("size", ev.Size)
+	case "upload_file":
+		u := ev.Upload
+		e = e.Str("directory", ev.Info.Upload).Str("path", u.Path).Str("entry_type", u.Type).Int64("size", u.Size).Str("mode", fmt.Sprintf("%04o", u.Mode))
+		if u.Link != "" {
+			e = e.Str("link", u.Link)
+		}
+	case "upload_unparsed":
+		e = e.Str("directory", ev.Info.Upload).Str("reason", ev.Reason)
+	}
+	return e
+}
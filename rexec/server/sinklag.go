@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditSinkStaleness holds NAME=DURATION thresholds: a sink whose oldest
+// undelivered event is older than DURATION is stale.
+var AuditSinkStaleness []string
+
+// AuditCriticalSinks are the sinks that fail /readyz while they are stale.
+var AuditCriticalSinks []string
+
+// AuditLagCheckInterval is how often the sinks are checked for staleness.
+var AuditLagCheckInterval = 5 * time.Second
+
+// auditStaleness is AuditSinkStaleness parsed by Init.
+var auditStaleness map[string]time.Duration
+
+// deliverySeq numbers the calls of deliverAudit, to tell the batches pending
+// on a sink apart.
+var deliverySeq atomic.Uint64
+
+// sinkLag tracks what a sink has not delivered yet. Only the oldest capture
+// time of each batch in flight is kept, the events carry their own.
+type sinkLag struct {
+	mu      sync.Mutex
+	pending map[uint64]time.Time
+	// stale is the state of the last check.
+	stale bool
+}
+
+var (
+	sinkLagsMu sync.Mutex
+	sinkLags   = map[string]*sinkLag{}
+)
+
+func lagFor(sink string) *sinkLag {
+	sinkLagsMu.Lock()
+	defer sinkLagsMu.Unlock()
+	l, ok := sinkLags[sink]
+	if !ok {
+		l = &sinkLag{pending: map[uint64]time.Time{}}
+		sinkLags[sink] = l
+	}
+	return l
+}
+
+func (l *sinkLag) begin(id uint64, oldest time.Time) {
+	l.mu.Lock()
+	l.pending[id] = oldest
+	l.mu.Unlock()
+}
+
+func (l *sinkLag) end(id uint64) {
+	l.mu.Lock()
+	delete(l.pending, id)
+	l.mu.Unlock()
+}
+
+// oldestAge is the age of the oldest event still undelivered, zero when the
+// sink is caught up.
+func (l *sinkLag) oldestAge(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var oldest time.Time
+	for _, captured := range l.pending {
+		if oldest.IsZero() || captured.Before(oldest) {
+			oldest = captured
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return now.Sub(oldest)
+}
+
+func (l *sinkLag) isStale() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stale
+}
+
+// setStale records the state of a check and reports whether it changed.
+func (l *sinkLag) setStale(stale bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed := l.stale != stale
+	l.stale = stale
+	return changed
+}
+
+// oldestCaptured is the earliest capture time in batch.
+func oldestCaptured(batch []auditEvent) time.Time {
+	var oldest time.Time
+	for _, ev := range batch {
+		if !ev.Captured.IsZero() && (oldest.IsZero() || ev.Captured.Before(oldest)) {
+			oldest = ev.Captured
+		}
+	}
+	return oldest
+}
+
+// parseSinkStaleness parses NAME=DURATION entries for the configured sinks.
+func parseSinkStaleness(entries []string) (map[string]time.Duration, error) {
+	thresholds := map[string]time.Duration{}
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("audit sink staleness %q is not NAME=DURATION", entry)
+		}
+		if !isAuditSink(name) {
+			return nil, fmt.Errorf("audit sink staleness %q names an unknown sink", entry)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("audit sink staleness %q needs a positive duration", entry)
+		}
+		thresholds[name] = d
+	}
+	for _, name := range AuditCriticalSinks {
+		if !isAuditSink(name) {
+			return nil, fmt.Errorf("critical audit sink %q is unknown", name)
+		}
+		if _, ok := thresholds[name]; !ok {
+			return nil, fmt.Errorf("critical audit sink %q has no staleness threshold", name)
+		}
+	}
+	return thresholds, nil
+}
+
+func isAuditSink(name string) bool {
+	for _, sink := range auditSinks {
+		if sink.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isCriticalSink(name string) bool {
+	for _, critical := range AuditCriticalSinks {
+		if critical == name {
+			return true
+		}
+	}
+	return false
+}
+
+// watchAuditSinks checks the sinks every AuditLagCheckInterval until stop is
+// closed.
+func watchAuditSinks(stop <-chan struct{}) {
+	ticker := clk.NewTicker(AuditLagCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			checkAuditSinks()
+			gate.check()
+		}
+	}
+}
+
+// checkAuditSinks updates the lag gauge of every sink and flips the sinks that
+// crossed their staleness threshold, with an audit_sink_stale or
+// audit_sink_recovered event.
+func checkAuditSinks() {
+	now := clk.Now()
+	for _, sink := range auditSinks {
+		name := sink.Name()
+		lag := lagFor(name)
+		age := lag.oldestAge(now)
+		auditSinkOldestUndelivered.WithLabelValues(name).Set(age.Seconds())
+
+		threshold, ok := auditStaleness[name]
+		if !ok {
+			continue
+		}
+		stale := age > threshold
+		if !lag.setStale(stale) {
+			continue
+		}
+		event := "audit_sink_recovered"
+		if stale {
+			event = "audit_sink_stale"
+			auditSinkStale.WithLabelValues(name).Set(1)
+			SysLogger.Warn().Str("sink", name).Dur("oldest_undelivered", age).Dur("threshold", threshold).Msg("audit sink is stale")
+		} else {
+			auditSinkStale.WithLabelValues(name).Set(0)
+		}
+		ev := auditEvent{Session: proxySession, Info: sessionInfo{User: adminActor}, Event: event, Sink: name, Lag: age, Threshold: threshold, Captured: now}
+		if !queueAuditEvent(ev) {
+			recordError("sink_lag_audit")
+			SysLogger.Error().Str("sink", name).Str("event", event).Msg("failed to queue the audit sink health event")
+		}
+	}
+}
+
+// sinkHealth is the state of one sink in the /readyz details.
+type sinkHealth struct {
+	Healthy                   bool    `json:"healthy"`
+	Critical                  bool    `json:"critical"`
+	OldestUndeliveredSeconds  float64 `json:"oldest_undelivered_seconds"`
+	StalenessThresholdSeconds float64 `json:"staleness_threshold_seconds,omitempty"`
+}
+
+// readyzHandler reports the startup barrier and the health of every sink as
+// of the last check. It fails until the barrier opened and while a critical
+// sink is stale.
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	started := startup.status()
+	ready := started.Ready
+	sinks := map[string]sinkHealth{}
+	now := clk.Now()
+	for _, sink := range auditSinks {
+		name := sink.Name()
+		lag := lagFor(name)
+		h := sinkHealth{
+			Healthy:                   !lag.isStale(),
+			Critical:                  isCriticalSink(name),
+			OldestUndeliveredSeconds:  lag.oldestAge(now).Seconds(),
+			StalenessThresholdSeconds: auditStaleness[name].Seconds(),
+		}
+		if !h.Healthy && h.Critical {
+			ready = false
+		}
+		sinks[name] = h
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	//nolint:errcheck
+	_ = json.NewEncoder(w).Encode(struct {
+		Ready   bool                  `json:"ready"`
+		Startup startupStatus         `json:"startup"`
+		Sinks   map[string]sinkHealth `json:"sinks"`
+	}{ready, started, sinks})
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// slowSink holds every Write until release is closed, like a remote sink that
+// stopped answering.
+type slowSink struct {
+	recordingSink
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newSlowSink(name string) *slowSink {
+	return &slowSink{recordingSink: recordingSink{name: name}, entered: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s *slowSink) Write(events []auditEvent) error {
+	select {
+	case s.entered <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.recordingSink.Write(events)
+}
+
+func (s *slowSink) unblock() { s.once.Do(func() { close(s.release) }) }
+
+// withSinkHealth resets the lag tracking and sets the staleness thresholds and
+// critical sinks, on a server past its startup.
+func withSinkHealth(t *testing.T, staleness map[string]time.Duration, critical ...string) {
+	t.Helper()
+	withStartupBarrier(t, startupConditions...)
+	sinkLagsMu.Lock()
+	oldLags := sinkLags
+	sinkLags = map[string]*sinkLag{}
+	sinkLagsMu.Unlock()
+	oldStaleness, oldCritical := auditStaleness, AuditCriticalSinks
+	t.Cleanup(func() {
+		sinkLagsMu.Lock()
+		sinkLags = oldLags
+		sinkLagsMu.Unlock()
+		auditStaleness, AuditCriticalSinks = oldStaleness, oldCritical
+	})
+	auditStaleness, AuditCriticalSinks = staleness, critical
+}
+
+type readyz struct {
+	Ready bool                  `json:"ready"`
+	Sinks map[string]sinkHealth `json:"sinks"`
+}
+
+func getReadyz(t *testing.T) (int, readyz) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body readyz
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("readyz body is not JSON: %v\n%s", err, rr.Body)
+	}
+	return rr.Code, body
+}
+
+func latencyQuantile(t *testing.T, sink string, q float64) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := auditSinkDeliveryLatency.WithLabelValues(sink).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	for _, quantile := range m.GetSummary().GetQuantile() {
+		if quantile.GetQuantile() == q {
+			return quantile.GetValue()
+		}
+	}
+	t.Fatalf("no quantile %v for sink %s", q, sink)
+	return 0
+}
+
+func TestSlowCriticalSinkGoesStaleAndRecovers(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	slow, fast := newSlowSink("webhook-slow"), &recordingSink{name: "log-fast"}
+	withAuditSinks(t, fast, slow)
+	withSinkHealth(t, map[string]time.Duration{"webhook-slow": 30 * time.Second, "log-fast": 30 * time.Second}, "webhook-slow")
+	stop := runAuditPipeline(t)
+	t.Cleanup(slow.unblock)
+
+	enqueueEvent(nil, auditEvent{Session: "s1", Event: "session_start", Captured: clk.Now()})
+	<-slow.entered
+
+	fc.Advance(31 * time.Second)
+	checkAuditSinks()
+	if got := testutil.ToFloat64(auditSinkOldestUndelivered.WithLabelValues("webhook-slow")); got != 31 {
+		t.Fatalf("oldest undelivered of the slow sink = %v, want 31", got)
+	}
+	if got := testutil.ToFloat64(auditSinkOldestUndelivered.WithLabelValues("log-fast")); got != 0 {
+		t.Fatalf("oldest undelivered of the fast sink = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(auditSinkStale.WithLabelValues("webhook-slow")); got != 1 {
+		t.Fatalf("stale = %v, want 1", got)
+	}
+	code, body := getReadyz(t)
+	if code != http.StatusServiceUnavailable || body.Ready || body.Sinks["webhook-slow"].Healthy || !body.Sinks["log-fast"].Healthy {
+		t.Fatalf("readyz = %d %+v, want 503 with webhook-slow unhealthy", code, body)
+	}
+
+	slow.unblock()
+	eventually(t, "the slow sink catching up", func() bool { return lagFor("webhook-slow").oldestAge(clk.Now()) == 0 })
+	checkAuditSinks()
+	if code, body := getReadyz(t); code != http.StatusOK || !body.Ready || !body.Sinks["webhook-slow"].Healthy {
+		t.Fatalf("readyz = %d %+v, want 200 once caught up", code, body)
+	}
+	if got := latencyQuantile(t, "webhook-slow", 0.99); got < 31 {
+		t.Fatalf("p99 delivery latency of the slow sink = %v, want at least 31s", got)
+	}
+	stop()
+
+	health := fast.bySession()[proxySession]
+	if len(health) != 2 || health[0].Event != "audit_sink_stale" || health[1].Event != "audit_sink_recovered" {
+		t.Fatalf("want audit_sink_stale then audit_sink_recovered, got %+v", health)
+	}
+	if ev := health[0]; ev.Sink != "webhook-slow" || ev.Lag != 31*time.Second || ev.Threshold != 30*time.Second {
+		t.Fatalf("unexpected stale event %+v", ev)
+	}
+}
+
+func TestStaleSinkNotCriticalKeepsReadiness(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	slow := newSlowSink("archive")
+	withAuditSinks(t, slow)
+	withSinkHealth(t, map[string]time.Duration{"archive": time.Minute})
+	runAuditPipeline(t)
+	t.Cleanup(slow.unblock)
+
+	enqueueEvent(nil, auditEvent{Session: "s1", Event: "session_start", Captured: clk.Now()})
+	<-slow.entered
+	fc.Advance(2 * time.Minute)
+	checkAuditSinks()
+
+	code, body := getReadyz(t)
+	if code != http.StatusOK || !body.Ready {
+		t.Fatalf("readyz = %d %+v, a non-critical sink must not fail readiness", code, body)
+	}
+	if h := body.Sinks["archive"]; h.Healthy || h.Critical || h.OldestUndeliveredSeconds != 120 || h.StalenessThresholdSeconds != 60 {
+		t.Fatalf("unexpected sink health %+v", h)
+	}
+}
+
+func TestSinkLagTracksOldestPendingBatch(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	withSinkHealth(t, nil)
+	lag := lagFor("sink")
+	start := clk.Now()
+	lag.begin(1, start.Add(10*time.Second))
+	lag.begin(2, start)
+	fc.Advance(time.Minute)
+	if got := lag.oldestAge(clk.Now()); got != time.Minute {
+		t.Fatalf("oldest age = %v, want 1m", got)
+	}
+	lag.end(2)
+	if got := lag.oldestAge(clk.Now()); got != 50*time.Second {
+		t.Fatalf("oldest age = %v, want 50s", got)
+	}
+	lag.end(1)
+	if got := lag.oldestAge(clk.Now()); got != 0 {
+		t.Fatalf("oldest age of a caught up sink = %v, want 0", got)
+	}
+}
+
+func TestParseSinkStaleness(t *testing.T) {
+	withAuditSinks(t, &recordingSink{name: "log"})
+	oldCritical := AuditCriticalSinks
+	t.Cleanup(func() { AuditCriticalSinks = oldCritical })
+
+	tests := []struct {
+		name     string
+		entries  []string
+		critical []string
+		wantErr  string
+	}{
+		{name: "valid", entries: []string{"log=30s"}, critical: []string{"log"}},
+		{name: "no duration", entries: []string{"log"}, wantErr: "NAME=DURATION"},
+		{name: "unknown sink", entries: []string{"webhook=30s"}, wantErr: "unknown sink"},
+		{name: "bad duration", entries: []string{"log=soon"}, wantErr: "positive duration"},
+		{name: "critical without threshold", critical: []string{"log"}, wantErr: "no staleness threshold"},
+		{name: "unknown critical", entries: []string{"log=30s"}, critical: []string{"webhook"}, wantErr: "is unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AuditCriticalSinks = tt.critical
+			got, err := parseSinkStaleness(tt.entries)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got["log"] != 30*time.Second {
+				t.Fatalf("got %v, %v", got, err)
+			}
+		})
+	}
+}
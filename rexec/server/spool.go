@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AuditSpoolDir holds the batches the webhook sink could not deliver, until
+// it can. Unset, a batch the webhook does not take is retried and then
+// dropped like on any other sink.
+var AuditSpoolDir string
+
+// AuditSpoolCompression is the codec new spool segments are written with,
+// zstd, gzip or identity. Every segment records its own, so a directory
+// written with several replays all the same.
+var AuditSpoolCompression = "identity"
+
+// AuditSpoolMaxBytes bounds the size of the spool, a batch that does not fit
+// is refused and retried like an undelivered one.
+var AuditSpoolMaxBytes int64 = 1 << 30
+
+// A spool segment is one batch: a header, then the batch as its codec wrote
+// it. The header is the magic, the format version, the codec, two reserved
+// bytes, the length of the encoded batch and its CRC-32C, both big endian.
+const (
+	spoolMagic     = "RXSP"
+	spoolVersion   = 1
+	spoolHeaderLen = 16
+	spoolExt       = ".seg"
+	// spoolQuarantineExt is added to a segment that can't be read back, it
+	// is then left for an operator to look at.
+	spoolQuarantineExt = ".corrupt"
+)
+
+var spoolCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// errSpoolFull is returned for a batch that would take the spool over
+// AuditSpoolMaxBytes.
+var errSpoolFull = errors.New("the audit spool is full")
+
+// auditSpool is the directory of segments of the webhook sink, oldest first.
+// It is not safe for concurrent use, the sink serializes it.
+type auditSpool struct {
+	dir      string
+	codec    auditCodec
+	maxBytes int64
+	segments []spoolSegment
+	bytes    int64
+	// next is the sequence number of the next segment.
+	next uint64
+}
+
+type spoolSegment struct {
+	name string
+	size int64
+}
+
+// spoolCorruptError is a segment that does not read back as a batch.
+type spoolCorruptError struct {
+	name   string
+	reason string
+}
+
+func (e *spoolCorruptError) Error() string {
+	return fmt.Sprintf("corrupted audit spool segment %s: %s", e.name, e.reason)
+}
+
+// openAuditSpool opens the spool in dir, creating it when missing, and picks
+// up the segments an earlier run left. Half-written segments are removed.
+func openAuditSpool(dir string, codec auditCodec, maxBytes int64) (*auditSpool, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("--audit-spool-max-bytes must be positive, got %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &auditSpool{dir: dir, codec: codec, maxBytes: maxBytes, next: 1}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seq, ok := spoolSeq(name)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, spoolSegment{name: name, size: info.Size()})
+		s.bytes += info.Size()
+		s.next = max(s.next, seq+1)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].name < s.segments[j].name })
+	auditSpoolBytes.Set(float64(s.bytes))
+	return s, nil
+}
+
+// spoolSeq is the sequence number of the segment called name.
+func spoolSeq(name string) (uint64, bool) {
+	digits, ok := strings.CutSuffix(name, spoolExt)
+	if !ok || len(digits) != 20 {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(digits, 10, 64)
+	return seq, err == nil
+}
+
+// pending reports whether segments wait to be replayed.
+func (s *auditSpool) pending() bool {
+	return len(s.segments) > 0
+}
+
+// add writes batch as the newest segment. The segment is synced before it is
+// put in place, so it is either complete or not there after a crash.
+func (s *auditSpool) add(batch []byte) error {
+	encoded, err := s.codec.encode(batch, AuditCompressionLevel)
+	if err != nil {
+		return err
+	}
+	size := int64(spoolHeaderLen + len(encoded))
+	if s.bytes+size > s.maxBytes {
+		return errSpoolFull
+	}
+	header := make([]byte, spoolHeaderLen, size)
+	copy(header, spoolMagic)
+	header[4], header[5] = spoolVersion, byte(s.codec)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(encoded)))
+	binary.BigEndian.PutUint32(header[12:], crc32.Checksum(encoded, spoolCRC))
+
+	name := fmt.Sprintf("%020d%s", s.next, spoolExt)
+	path := filepath.Join(s.dir, name)
+	if err := writeSynced(path+".tmp", append(header, encoded...)); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	s.next++
+	s.segments = append(s.segments, spoolSegment{name: name, size: size})
+	s.bytes += size
+	auditSpoolBytes.Set(float64(s.bytes))
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		//nolint:errcheck
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// replay hands the segments to send oldest first, removing each once send
+// took it, and stops at the first error of send. A corrupted segment is
+// quarantined and skipped rather than stopping the replay.
+func (s *auditSpool) replay(send func(batch []byte) error) error {
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		path := filepath.Join(s.dir, seg.name)
+		batch, err := readSegment(path)
+		var corrupt *spoolCorruptError
+		switch {
+		case errors.As(err, &corrupt):
+			auditSpoolQuarantinedTotal.Inc()
+			SysLogger.Error().Err(err).Str("file", path).Msg("quarantining the audit spool segment, its batch is lost")
+			if err := os.Rename(path, path+spoolQuarantineExt); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			if err := send(batch); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		s.segments = s.segments[1:]
+		s.bytes -= seg.size
+		auditSpoolBytes.Set(float64(s.bytes))
+	}
+	return nil
+}
+
+// readSegment reads the batch of the segment at path back. What is wrong
+// with the segment itself is a *spoolCorruptError.
+func readSegment(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	corrupt := func(format string, args ...any) error {
+		return &spoolCorruptError{name: name, reason: fmt.Sprintf(format, args...)}
+	}
+	if len(data) < spoolHeaderLen || string(data[:4]) != spoolMagic {
+		return nil, corrupt("no segment header")
+	}
+	if data[4] != spoolVersion {
+		return nil, corrupt("unsupported version %d", data[4])
+	}
+	codec := auditCodec(data[5])
+	if codec >= numAuditCodecs {
+		return nil, corrupt("unknown codec %d", data[5])
+	}
+	encoded := data[spoolHeaderLen:]
+	if length := binary.BigEndian.Uint32(data[8:]); int64(length) != int64(len(encoded)) {
+		return nil, corrupt("%d bytes of %d", len(encoded), length)
+	}
+	if sum := crc32.Checksum(encoded, spoolCRC); sum != binary.BigEndian.Uint32(data[12:]) {
+		return nil, corrupt("checksum mismatch")
+	}
+	batch, err := codec.decode(encoded)
+	if err != nil {
+		return nil, corrupt("%s: %v", codec, err)
+	}
+	return batch, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func openTestSpool(t *testing.T, dir string, codec auditCodec) *auditSpool {
+	t.Helper()
+	s, err := openAuditSpool(dir, codec, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// replayed replays s and returns the batches sent.
+func replayed(t *testing.T, s *auditSpool) []string {
+	t.Helper()
+	var got []string
+	if err := s.replay(func(batch []byte) error {
+		got = append(got, string(batch))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSpoolRoundTripsEveryCodec(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, codecIdentity)
+	var want []string
+	for c := range numAuditCodecs {
+		s.codec = auditCodec(c)
+		batch := strings.Repeat(fmt.Sprintf(`{"type":"command","data":{"command":"ls %s"}}`+"\n", auditCodec(c)), 50)
+		if err := s.add([]byte(batch)); err != nil {
+			t.Fatalf("%s: %v", auditCodec(c), err)
+		}
+		want = append(want, batch)
+	}
+
+	// a restart with another codec replays the segments of all of them
+	s = openTestSpool(t, dir, codecZstd)
+	if got := replayed(t, s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %q, want %q", got, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("replayed segments left behind: %v", entries)
+	}
+	if s.bytes != 0 || s.pending() {
+		t.Fatalf("spool not empty after replay: %d bytes", s.bytes)
+	}
+}
+
+func TestSpoolCompresses(t *testing.T) {
+	batch := []byte(strings.Repeat(`{"schema":"rexec.audit/v2","type":"command","data":{"command":"kubectl get pods"}}`+"\n", 200))
+	sizes := map[auditCodec]int64{}
+	for _, c := range []auditCodec{codecIdentity, codecGzip, codecZstd} {
+		s := openTestSpool(t, t.TempDir(), c)
+		if err := s.add(batch); err != nil {
+			t.Fatal(err)
+		}
+		sizes[c] = s.bytes
+	}
+	if sizes[codecIdentity] != int64(spoolHeaderLen+len(batch)) || sizes[codecGzip] >= sizes[codecIdentity]/10 || sizes[codecZstd] >= sizes[codecIdentity]/10 {
+		t.Fatalf("segment sizes %v of a %d byte batch", sizes, len(batch))
+	}
+}
+
+func TestSpoolQuarantinesCorruptedSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, codecZstd)
+	for i := range 5 {
+		if err := s.add([]byte(fmt.Sprintf("batch %d\n", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segment := func(i int) string { return filepath.Join(dir, s.segments[i].name) }
+	corrupt := func(path string, edit func([]byte) []byte) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, edit(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flipped, truncated, magic, codec := segment(0), segment(1), segment(2), segment(3)
+	corrupt(flipped, func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b })
+	corrupt(truncated, func(b []byte) []byte { return b[:len(b)-2] })
+	corrupt(magic, func(b []byte) []byte { copy(b, "XXXX"); return b })
+	corrupt(codec, func(b []byte) []byte { b[5] = 9; return b })
+	before := testutil.ToFloat64(auditSpoolQuarantinedTotal)
+
+	if got := replayed(t, s); !reflect.DeepEqual(got, []string{"batch 4\n"}) {
+		t.Fatalf("replayed %q, want the intact batch only", got)
+	}
+	if n := testutil.ToFloat64(auditSpoolQuarantinedTotal) - before; n != 4 {
+		t.Fatalf("quarantined %v segments, want 4", n)
+	}
+	for _, path := range []string{flipped, truncated, magic, codec} {
+		if _, err := os.Stat(path + spoolQuarantineExt); err != nil {
+			t.Errorf("%s not quarantined: %v", path, err)
+		}
+	}
+	// quarantined segments are not picked up again
+	if s := openTestSpool(t, dir, codecZstd); s.pending() {
+		t.Fatalf("reopened spool has %d segments", len(s.segments))
+	}
+}
+
+func TestReadSegmentReasons(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, codecGzip)
+	if err := s.add([]byte("batch\n")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, s.segments[0].name)
+	data, _ := os.ReadFile(path)
+	for _, tt := range []struct {
+		name   string
+		edit   func([]byte) []byte
+		reason string
+	}{
+		{"empty", func([]byte) []byte { return nil }, "no segment header"},
+		{"version", func(b []byte) []byte { b[4] = 2; return b }, "unsupported version 2"},
+		{"checksum", func(b []byte) []byte { b[12] ^= 1; return b }, "checksum mismatch"},
+		{"length", func(b []byte) []byte { return append(b, 0) }, "bytes of"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, tt.edit(append([]byte(nil), data...)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readSegment(path)
+			var corrupt *spoolCorruptError
+			if !errors.As(err, &corrupt) || !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("err = %v, want a corruption: %s", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestSpoolReplayStopsAtFailure(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), codecIdentity)
+	for _, b := range []string{"a", "b", "c"} {
+		if err := s.add([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sent []string
+	down := errors.New("webhook down")
+	err := s.replay(func(batch []byte) error {
+		if string(batch) == "b" {
+			return down
+		}
+		sent = append(sent, string(batch))
+		return nil
+	})
+	if !errors.Is(err, down) || !reflect.DeepEqual(sent, []string{"a"}) {
+		t.Fatalf("replay = %v, sent %q", err, sent)
+	}
+	if got := replayed(t, s); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("second replay sent %q, want the rest in order", got)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	s, err := openAuditSpool(t.TempDir(), codecIdentity, spoolHeaderLen+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add([]byte("x")); !errors.Is(err, errSpoolFull) {
+		t.Fatalf("err = %v, want %v", err, errSpoolFull)
+	}
+}
+
+func TestOpenSpoolResumes(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, codecIdentity)
+	if err := s.add([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// a segment a crash left half written, and a file that is not a segment
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000002.seg.tmp"), []byte("RX"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestSpool(t, dir, codecIdentity)
+	if err := s.add([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000002.seg.tmp")); !os.IsNotExist(err) {
+		t.Fatalf("half written segment kept: %v", err)
+	}
+	if got := replayed(t, s); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("replayed %q, want a then b", got)
+	}
+}
@@ -3,13 +3,12 @@ package server
 import (
 	"context"
 	"crypto/tls"
-	"encoding/hex"
-	"fmt"
+	"errors"
+	"io"
 	"net"
 	"net/http"
-	"strings"
-
-	"github.com/rs/zerolog"
+	"sync"
+	"sync/atomic"
 )
 
 func apiServerTLSConfig() *tls.Config {
@@ -33,16 +32,18 @@ func apiServerTransport() *http.Transport {
 	return tr
 }
 
-// tty exec uses tls conn wrapped in tcplogger so we can audit keystrokes
-func auditedAPIServerTransport(sessionID string, info sessionInfo) *http.Transport {
+// tty exec uses tls conn wrapped in tcplogger so we can audit keystrokes, and
+// with websocket set, enforce WSMaxMessageSize
+func auditedAPIServerTransport(sessionID string, info sessionInfo, watchdog *sessionWatchdog, websocket bool) *http.Transport {
 	tr := baseAPIServerTransport()
 	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dialAuditedConn(ctx, sessionID, info)
+		return dialAuditedConn(ctx, sessionID, info, watchdog, websocket)
 	}
 	return tr
 }
 
-func dialAuditedConn(ctx context.Context, sessionID string, info sessionInfo) (net.Conn, error) {
+func dialAuditedConn(ctx context.Context, sessionID string, info sessionInfo, watchdog *sessionWatchdog, websocket bool) (net.Conn, error) {
+	start := clk.Now()
 	raw, err := (&net.Dialer{}).DialContext(ctx, "tcp", apiServerDial)
 	if err != nil {
 		recordError("upstream_connect")
@@ -56,92 +57,213 @@ func dialAuditedConn(ctx context.Context, sessionID string, info sessionInfo) (n
 		}
 		return nil, err
 	}
-	return &TCPLogger{Conn: tlsConn, ctxid: sessionID, info: info}, nil
+	t := &TCPLogger{Conn: tlsConn, ctxid: sessionID, info: info, watchdog: watchdog, buffer: sessionBufferFor(sessionID), recorder: recorderFor(sessionID)}
+	if websocket {
+		t.client, t.upstream = newWSStream("client", false), newWSStream("upstream", true)
+	}
+	watchdog.attach(t)
+	watchdog.dialed(clk.Since(start))
+	return t, nil
 }
 
-func registerSession(ctxid, user, namespace, pod, container, clientIP string) sessionInfo {
-	info := sessionInfo{
-		User: user, NameSpace: namespace, Pod: pod, Container: container, ClientIP: clientIP,
-	}
+// registerSession starts the audit of a recorded session and returns info with
+// the limits it runs under.
+func registerSession(ctxid string, info sessionInfo) sessionInfo {
+	info.Limits = resolveSessionLimits(info.NameSpace)
 	mapSync.Lock()
 	sessionMap[ctxid] = info
+	sessionBuffers[ctxid] = newSessionBuffer(ctxid, info)
 	mapSync.Unlock()
-	logSessionEvent("session_start", user, ctxid, namespace, pod, container, clientIP)
+	enqueueSessionEvent(ctxid, info, "session_start", "")
 	return info
 }
 
-func endSession(ctxid string) {
+// endSession ends the audit of a recorded session with its session_end, which
+// carries why, after how many bytes and after what time spent where the
+// session ended as watchdog saw it.
+func endSession(ctxid string, watchdog *sessionWatchdog) {
 	mapSync.Lock()
 	info, ok := sessionMap[ctxid]
+	buffer := sessionBuffers[ctxid]
 	delete(sessionMap, ctxid)
+	delete(sessionBuffers, ctxid)
 	mapSync.Unlock()
 
-	commandSync.Lock()
-	delete(commandMap, ctxid)
-	commandSync.Unlock()
-
+	// the shard drops the keystroke buffer of the session once it reaches
+	// session_end, after everything captured before it
 	if ok {
-		logSessionEvent("session_end", info.User, ctxid, info.NameSpace, info.Pod, info.Container, info.ClientIP)
+		ev := auditEvent{Session: ctxid, Info: info, Event: "session_end", Captured: clk.Now(), Reason: watchdog.endReason()}
+		if watchdog != nil {
+			ev.ClientBytes, ev.UpstreamBytes = watchdog.fromClient.Load(), watchdog.toClient.Load()
+			timing := watchdog.timings()
+			timing.observe()
+			ev.Timing = &timing
+		}
+		enqueueEvent(buffer, ev)
 	}
 }
 
 // tcplogger is on client to apiserver websocket direction
-// write path is audited read path is pass through only
+// write path is audited read path is pass through only. The write path only
+// copies into the session buffer, the audit shards parse it.
 type TCPLogger struct {
 	net.Conn
-	ctxid string
-	info  sessionInfo
+	ctxid    string
+	info     sessionInfo
+	watchdog *sessionWatchdog
+	buffer   *sessionBuffer
+	// recorder records a TTY session, nil when it is not.
+	recorder *castRecorder
+
+	// client and upstream follow the websocket frames written and read, nil
+	// when the session is not a websocket.
+	client, upstream *wsStream
+	// upgraded is set once the apiserver switched to websocket, from then
+	// on frames can be put into the stream to the client.
+	upgraded atomic.Bool
+	// closing is set once the proxy closes the session, to what the client is
+	// handed before its stream ends: a close frame, after a denial message
+	// for a TTY. Nothing more goes upstream from then on.
+	closing   atomic.Pointer[[]byte]
+	closeOnce sync.Once
+	// farewellSent counts the bytes of closing handed to the client and
+	// closeSent is set once its stream ended. Both are only touched by Read,
+	// which the proxy calls from a single goroutine.
+	farewellSent int
+	closeSent    bool
 }
 
 func (t *TCPLogger) Write(b []byte) (n int, err error) {
+	if t.closing.Load() != nil {
+		// the session is being closed, nothing more goes upstream
+		return len(b), nil
+	}
+	if t.client != nil {
+		if start, limitErr := t.client.feed(b); limitErr != nil {
+			if start > 0 {
+				if _, err := t.write(b[:start]); err != nil {
+					return 0, err
+				}
+			}
+			t.limitExceeded(limitErr)
+			return len(b), nil
+		}
+	}
+	return t.write(b)
+}
+
+func (t *TCPLogger) write(b []byte) (n int, err error) {
 	n, err = t.Conn.Write(b)
 	if n > 0 {
-		t.auditClientFrame(b[:n])
+		t.watchdog.touch()
+		t.watchdog.transferred(n, true)
+		if t.buffer != nil {
+			t.buffer.pushFrames(b[:n])
+		}
+		if t.recorder != nil {
+			t.recorder.input(b[:n])
+		}
 	}
 	return n, err
 }
 
-func (t *TCPLogger) auditClientFrame(frameBytes []byte) {
-	// a single write operation may contain multiple combined frames. Continue
-	// parsing until the entire buffer has been processed to ensure no keystrokes
-	// are omitted from the audit log.
-	for len(frameBytes) > 0 {
-		parsed, consumed, err := parseWebSocketFrame(frameBytes)
-		if err != nil {
-			recordError("ws_parse")
-			SysLogger.Error().Err(err).Msg("failed to parse ws frame")
-			return
+func (t *TCPLogger) Read(b []byte) (n int, err error) {
+	if t.closing.Load() != nil {
+		return t.readClose(b)
+	}
+	n, err = t.Conn.Read(b)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		// the apiserver ended the stream, a close of our own is not an end
+		t.watchdog.end("completed")
+	}
+	if n > 0 {
+		t.watchdog.touch()
+		t.watchdog.received()
+		t.watchdog.transferred(n, false)
+		if t.upstream != nil {
+			if start, limitErr := t.upstream.feed(b[:n]); limitErr != nil {
+				t.limitExceeded(limitErr)
+				if start < 0 {
+					// the client already has part of the frame, a close
+					// frame can't be put in anymore
+					t.closeSent = true
+					return 0, io.EOF
+				}
+				if start > 0 {
+					return start, nil
+				}
+				return t.readClose(b)
+			}
+			if !t.upstream.inHead && !t.upstream.disabled && !t.upgraded.Load() {
+				t.upgraded.Store(true)
+			}
 		}
-		frameBytes = frameBytes[consumed:]
-
-		// websocket opcodes we might see: 0x0 continuation 0x1 text 0x2 binary
-		// 0x8 close 0x9 ping 0xA pong
-		// kubectl exec sends terminal input as 0x2 binary only that goes to async audit
-		if parsed.Opcode != 0x2 {
-			continue
+		if t.recorder != nil {
+			t.recorder.output(b[:n])
 		}
+	}
+	if err != nil && t.closing.Load() != nil {
+		// the upstream connection was closed by the proxy, because of what
+		// the client sent or a denial
+		return t.readClose(b)
+	}
+	return n, err
+}
 
-		if auditLogger.GetLevel() == zerolog.TraceLevel {
-			t.logTraceStroke(parsed.Payload)
+// readClose hands the client the frames of closing, if the stream to it is at
+// a frame boundary, and ends the stream after them.
+func (t *TCPLogger) readClose(b []byte) (int, error) {
+	if t.closeSent || t.upstream == nil || (t.farewellSent == 0 && !t.upstream.atBoundary()) {
+		return 0, io.EOF
+	}
+	farewell := *t.closing.Load()
+	n := copy(b, farewell[t.farewellSent:])
+	t.farewellSent += n
+	t.closeSent = t.farewellSent == len(farewell)
+	return n, nil
+}
+
+// closeSession sets what the client is handed and closes the upstream connection,
+// which unblocks a pending Read so the client is told. record runs before,
+// on the first close only, which close reports.
+func (t *TCPLogger) closeSession(farewell []byte, record func()) bool {
+	closed := false
+	t.closeOnce.Do(func() {
+		closed = true
+		t.closing.Store(&farewell)
+		record()
+		if err := t.Conn.Close(); err != nil {
+			SysLogger.Error().Err(err).Msg("failed to close upstream connection")
 		}
-		asyncAuditChan <- asyncAudit{ctxid: t.ctxid, info: t.info, ascii: parsed.Payload}
+	})
+	return closed
+}
+
+// deny ends the session with the message of d in the terminal of the client.
+// It reports false, doing nothing, when there is no terminal to write to: the
+// session is not a TTY, not a websocket or not upgraded yet.
+func (t *TCPLogger) deny(d denial) bool {
+	if !t.info.TTY || !t.upgraded.Load() {
+		return false
 	}
+	return t.closeSession(append(denialFrame(d), wsCloseFrame(wsClosePolicyViolation, "denied")...), func() {})
 }
 
-func (t *TCPLogger) logTraceStroke(payload []byte) {
-	stroke, err := hex.DecodeString(fmt.Sprintf("%x", payload))
-	if err != nil {
-		SysLogger.Error().Err(err).Msg("failed to parse payload")
-		return
-	}
-	auditLogger.Trace().
-		Str("user", t.info.User).
-		Str("session", t.ctxid).
-		Str("namespace", t.info.NameSpace).
-		Str("pod", t.info.Pod).
-		Str("container", t.info.Container).
-		Str("client_ip", t.info.ClientIP).
-		// tty payload has nul bytes strip for trace log
-		Str("stroke", strings.ReplaceAll(string(stroke), "\u0000", "")).
-		Msg("")
+// limitExceeded records the violation, closes the session and ends it, with a
+// denial message first for a TTY.
+func (t *TCPLogger) limitExceeded(limitErr *wsLimitError) {
+	farewell := wsCloseFrame(wsCloseMessageTooBig, "message too big")
+	if t.info.TTY {
+		d := newDenial("ws_max_message_size", limitErr.Error(), t.ctxid, t.info)
+		farewell = append(denialFrame(d), farewell...)
+	}
+	t.closeSession(farewell, func() {
+		t.watchdog.end("session_limit_exceeded")
+		wsLimitExceededTotal.WithLabelValues(limitErr.direction).Inc()
+		SysLogger.Warn().Err(limitErr).Str("session", t.ctxid).Msg("closing session")
+		enqueueEvent(t.buffer, auditEvent{
+			Session: t.ctxid, Info: t.info, Event: "session_limit_exceeded", Captured: clk.Now(),
+			Limit: "ws_max_message_size", LimitBytes: limitErr.limit, Direction: limitErr.direction, Size: limitErr.size,
+		})
+	})
 }
@@ -5,8 +5,12 @@ import (
 	"errors"
 	"io"
 	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/rs/zerolog"
 )
 
 // fake network connection
@@ -35,7 +39,7 @@ func TestAPIServerTransportsDiffer(t *testing.T) {
 		t.Fatal("non-TTY transport must not set DialTLSContext")
 	}
 
-	audited := auditedAPIServerTransport("sess", sessionInfo{})
+	audited := auditedAPIServerTransport("sess", sessionInfo{}, nil, true)
 	if audited.DialTLSContext == nil {
 		t.Fatal("TTY transport must set DialTLSContext")
 	}
@@ -46,36 +50,48 @@ func TestAPIServerTransportsDiffer(t *testing.T) {
 
 func TestEndSessionIdempotent(t *testing.T) {
 	oldSessionMap := sessionMap
-	oldCommandMap := commandMap
-	t.Cleanup(func() {
-		sessionMap = oldSessionMap
-		commandMap = oldCommandMap
-	})
-
+	t.Cleanup(func() { sessionMap = oldSessionMap })
 	sessionMap = map[string]sessionInfo{}
-	commandMap = map[string][]byte{}
+	buf := captureAudit(t)
+	stop := runAuditPipeline(t)
 
-	endSession("never-existed")
-	endSession("never-existed")
+	endSession("never-existed", nil)
+	endSession("never-existed", nil)
 
 	id := "gone"
 	sessionMap[id] = sessionInfo{User: "bob"}
+	commandSync.Lock()
 	commandMap[id] = []byte{'x'}
+	commandSync.Unlock()
+
+	endSession(id, nil)
+	endSession(id, nil)
+	stop()
 
-	endSession(id)
-	endSession(id)
+	if n := strings.Count(buf.String(), `"event":"session_end"`); n != 1 {
+		t.Fatalf("expected one session_end event, got %d: %s", n, buf.String())
+	}
 
 	if len(sessionMap) != 0 || len(commandMap) != 0 {
 		t.Fatalf("maps should be empty, sessionMap=%d commandMap=%d", len(sessionMap), len(commandMap))
 	}
 }
 
-func TestTCPLoggerWriteSkipsNonBinaryOpcode(t *testing.T) {
-	oldChan := asyncAuditChan
-	t.Cleanup(func() { asyncAuditChan = oldChan })
+// bufferedFrames returns the raw client data the logger handed to its buffer.
+func bufferedFrames(t *testing.T, logger *TCPLogger) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for _, item := range logger.buffer.take() {
+		if item.frames == nil {
+			t.Fatalf("unexpected non-frame item %+v", item)
+		}
+		frames = append(frames, item.frames)
+	}
+	return frames
+}
 
-	asyncAuditChan = make(chan asyncAudit, 1)
-	logger := &TCPLogger{Conn: &stubConn{}, ctxid: "s1"}
+func TestTCPLoggerWriteSkipsNonBinaryOpcode(t *testing.T) {
+	logger := &TCPLogger{Conn: &stubConn{}, ctxid: "s1", buffer: newSessionBuffer("s1", sessionInfo{})}
 
 	// FIN + text opcode 0x1, unmasked, empty payload
 	_, err := logger.Write([]byte{0x81, 0x00})
@@ -83,18 +99,16 @@ func TestTCPLoggerWriteSkipsNonBinaryOpcode(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	select {
-	case <-asyncAuditChan:
-		t.Fatal("text frame must not enqueue async audit")
-	default:
+	frames := bufferedFrames(t, logger)
+	if len(frames) != 1 {
+		t.Fatalf("expected the write to be buffered once, got %d", len(frames))
+	}
+	if got := clientKeystrokes("s1", sessionInfo{}, frames[0]); len(got) != 0 {
+		t.Fatalf("text frame must not produce keystrokes, got %q", got)
 	}
 }
 
 func TestTCPLoggerWriteAuditsCoalescedFrames(t *testing.T) {
-	oldChan := asyncAuditChan
-	t.Cleanup(func() { asyncAuditChan = oldChan })
-
-	asyncAuditChan = make(chan asyncAudit, 4)
 	wantInfo := sessionInfo{
 		User:      "alice",
 		NameSpace: "default",
@@ -102,7 +116,7 @@ func TestTCPLoggerWriteAuditsCoalescedFrames(t *testing.T) {
 		Container: "app",
 		ClientIP:  "192.0.2.1",
 	}
-	logger := &TCPLogger{Conn: &stubConn{}, ctxid: "s1", info: wantInfo}
+	logger := &TCPLogger{Conn: &stubConn{}, ctxid: "s1", info: wantInfo, buffer: newSessionBuffer("s1", wantInfo)}
 
 	key := [4]byte{0x01, 0x02, 0x03, 0x04}
 	first := buildFrame(0x2, []byte("echo"), true, key)
@@ -112,29 +126,53 @@ func TestTCPLoggerWriteAuditsCoalescedFrames(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	items := logger.buffer.items
+	if len(items) != 1 || !reflect.DeepEqual(items[0].info, wantInfo) {
+		t.Fatalf("buffered items = %+v, want one with info %+v", items, wantInfo)
+	}
+	payloads := clientKeystrokes("s1", wantInfo, bufferedFrames(t, logger)[0])
 	want := []string{"echo", "date"}
-	for _, w := range want {
-		select {
-		case got := <-asyncAuditChan:
-			if got.info != wantInfo {
-				t.Fatalf("audit session info = %+v, want %+v", got.info, wantInfo)
-			}
-			if string(got.ascii) != w {
-				t.Fatalf("audit payload = %q, want %q", got.ascii, w)
-			}
-		default:
-			t.Fatalf("expected coalesced frame %q to be enqueued", w)
+	if len(payloads) != len(want) {
+		t.Fatalf("got %d payloads, want %d", len(payloads), len(want))
+	}
+	for i, w := range want {
+		if string(payloads[i]) != w {
+			t.Fatalf("audit payload = %q, want %q", payloads[i], w)
 		}
 	}
 }
 
-func TestTCPLoggerWriteStillForwardsOnParseError(t *testing.T) {
-	oldChan := asyncAuditChan
-	t.Cleanup(func() { asyncAuditChan = oldChan })
+func TestTCPLoggerWriteForwardsResizeUntouched(t *testing.T) {
+	buf := captureAudit(t)
+	auditLogger = auditLogger.Level(zerolog.TraceLevel)
+	conn := &stubConn{}
+	info := sessionInfo{User: "alice", NameSpace: "default", Pod: "shell", Container: "app"}
+	logger := &TCPLogger{Conn: conn, ctxid: "s1", info: info, buffer: newSessionBuffer("s1", info)}
 
-	asyncAuditChan = make(chan asyncAudit, 1)
+	key := [4]byte{0x01, 0x02, 0x03, 0x04}
+	var written []byte
+	written = append(written, buildFrame(0x2, []byte("\x00ls"), true, key)...)
+	written = append(written, buildFrame(0x2, []byte("\x04{\"Width\":132,\"Height\":43}"), true, key)...)
+	written = append(written, buildFrame(0x2, []byte("\x00\r"), true, key)...)
+	if _, err := logger.Write(written); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conn.written) != 1 || !reflect.DeepEqual(conn.written[0], written) {
+		t.Fatalf("forwarded %q, want the frames untouched", conn.written)
+	}
+	payloads := clientKeystrokes("s1", info, bufferedFrames(t, logger)[0])
+	if len(payloads) != 2 || string(payloads[0]) != "\x00ls" || string(payloads[1]) != "\x00\r" {
+		t.Fatalf("keystroke payloads = %q, want only the stdin frames", payloads)
+	}
+	if !strings.Contains(buf.String(), `"event":"resize","width":132,"height":43`) {
+		t.Fatalf("trace audit lacks the resize: %s", buf.String())
+	}
+}
+
+func TestTCPLoggerWriteStillForwardsOnParseError(t *testing.T) {
 	conn := &stubConn{}
-	logger := &TCPLogger{Conn: conn, ctxid: "s1"}
+	logger := &TCPLogger{Conn: conn, ctxid: "s1", buffer: newSessionBuffer("s1", sessionInfo{})}
 
 	n, err := logger.Write([]byte{0x00})
 	if err != nil {
@@ -144,10 +182,8 @@ func TestTCPLoggerWriteStillForwardsOnParseError(t *testing.T) {
 		t.Fatalf("expected 1 byte forwarded, n=%d writes=%d", n, len(conn.written))
 	}
 
-	select {
-	case <-asyncAuditChan:
-		t.Fatal("invalid frame must not enqueue audit")
-	default:
+	if got := clientKeystrokes("s1", sessionInfo{}, bufferedFrames(t, logger)[0]); len(got) != 0 {
+		t.Fatalf("invalid frame must not produce keystrokes, got %q", got)
 	}
 }
 
@@ -155,7 +191,7 @@ func TestAuditedDialTLSContextCancelled(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
 
-	tr := auditedAPIServerTransport("sess", sessionInfo{})
+	tr := auditedAPIServerTransport("sess", sessionInfo{}, nil, true)
 	_, err := tr.DialTLSContext(ctx, "tcp", "unused")
 	if err == nil {
 		t.Fatal("expected error when context is already cancelled")
@@ -164,3 +200,67 @@ func TestAuditedDialTLSContextCancelled(t *testing.T) {
 		t.Fatalf("expected context.Canceled, got %v", err)
 	}
 }
+
+// readConn answers reads with data and then err.
+type readConn struct {
+	stubConn
+	data []byte
+	err  error
+}
+
+func (c *readConn) Read(b []byte) (int, error) {
+	if len(c.data) > 0 {
+		n := copy(b, c.data)
+		c.data = c.data[n:]
+		return n, nil
+	}
+	return 0, c.err
+}
+
+func TestSessionEndReason(t *testing.T) {
+	tests := []struct {
+		name    string
+		readErr error
+		ended   string
+		want    string
+	}{
+		{name: "client went away", want: `"reason":"client_cancelled","bytes_from_client":5,"bytes_to_client":7`},
+		{name: "own close", readErr: net.ErrClosed, want: `"reason":"client_cancelled","bytes_from_client":5,"bytes_to_client":7`},
+		{name: "apiserver ended the stream", readErr: io.EOF, want: `"reason":"completed","bytes_from_client":5,"bytes_to_client":7`},
+		{name: "watchdog first", readErr: io.EOF, ended: "session_idle_timeout", want: `"reason":"session_idle_timeout"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFakeClock(t, 0, 0, 0)
+			withSessionMaps(t)
+			buf := captureAudit(t)
+			stop := runAuditPipeline(t)
+
+			sessionMap["s1"] = sessionInfo{User: "bob"}
+			watchdog := startSessionWatchdog("s1", sessionInfo{User: "bob"}, func() {})
+			if tt.ended != "" {
+				watchdog.end(tt.ended)
+			}
+			logger := &TCPLogger{Conn: &readConn{data: []byte("outputs"), err: tt.readErr}, ctxid: "s1", watchdog: watchdog}
+			if _, err := logger.Write([]byte("ls -l")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 16)
+			if n, err := logger.Read(b); n != 7 || err != nil {
+				t.Fatalf("Read() = %d, %v", n, err)
+			}
+			if tt.readErr != nil {
+				if _, err := logger.Read(b); !errors.Is(err, tt.readErr) {
+					t.Fatalf("Read() error = %v, want %v", err, tt.readErr)
+				}
+			}
+			watchdog.stop()
+			endSession("s1", watchdog)
+			stop()
+
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Fatalf("session_end does not carry %s: %s", tt.want, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Package testutil holds test helpers shared by the rexec server tests.
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/adyen/kubectl-rexec/rexec/server/clock"
+)
+
+// FakeClock is a clock.Clock that only moves when Advance is called. Timers and
+// tickers fire synchronously from Advance, on channels buffered like the real
+// ones, so a ticker that is not drained drops ticks.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+var _ clock.Clock = &FakeClock{}
+
+// NewFakeClock returns a FakeClock set to start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	return fakeTimer{f.addWaiter(d, 0)}
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	return fakeTicker{f.addWaiter(d, d)}
+}
+
+// Advance moves the clock forward by d and fires every timer and ticker that
+// became due.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, w := range f.waiters {
+		if !w.active || w.fireAt.After(f.now) {
+			continue
+		}
+		select {
+		case w.c <- f.now:
+		default:
+		}
+		if w.period == 0 {
+			w.active = false
+			continue
+		}
+		for !w.fireAt.After(f.now) {
+			w.fireAt = w.fireAt.Add(w.period)
+		}
+	}
+}
+
+// Waiters returns the number of timers and tickers that are still pending,
+// which lets tests check that nothing leaked.
+func (f *FakeClock) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, w := range f.waiters {
+		if w.active {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *FakeClock) addWaiter(d, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{clock: f, c: make(chan time.Time, 1), fireAt: f.now.Add(d), period: period, active: true}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+type fakeWaiter struct {
+	clock  *FakeClock
+	c      chan time.Time
+	fireAt time.Time
+	period time.Duration
+	active bool
+}
+
+func (w *fakeWaiter) stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	wasActive := w.active
+	w.active = false
+	return wasActive
+}
+
+func (w *fakeWaiter) reset(d time.Duration) bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	wasActive := w.active
+	w.fireAt = w.clock.now.Add(d)
+	w.active = true
+	return wasActive
+}
+
+type fakeTimer struct{ w *fakeWaiter }
+
+func (t fakeTimer) C() <-chan time.Time        { return t.w.c }
+func (t fakeTimer) Stop() bool                 { return t.w.stop() }
+func (t fakeTimer) Reset(d time.Duration) bool { return t.w.reset(d) }
+
+type fakeTicker struct{ w *fakeWaiter }
+
+func (t fakeTicker) C() <-chan time.Time { return t.w.c }
+func (t fakeTicker) Stop()               { t.w.stop() }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"time"
+)
+
+// SessionStallThreshold counts a stall of a recorded session each time no
+// byte went either way for this long once the upstream started answering.
+// Zero disables it.
+var SessionStallThreshold time.Duration
+
+// stallSamples is how many times per SessionStallThreshold the byte counters
+// of a session are sampled, so a stall is counted at most a quarter of the
+// threshold late.
+const stallSamples = 4
+
+// sessionTiming is where the time of a recorded session went, on its
+// session_end:
+//   - Authn: checking the front proxy and reading the identity.
+//   - Policy: the exec parameters, the token, change ID and authorization
+//     webhook, up to the proxy taking the request.
+//   - Dial: connecting to the apiserver, TLS handshake included.
+//   - FirstByte: from connected to the first byte of the apiserver.
+//   - Stream: from that first byte to the end of the stream.
+//   - Teardown: from the end of the stream to the end of the session.
+//
+// A phase the session did not reach is zero.
+type sessionTiming struct {
+	Authn     time.Duration
+	Policy    time.Duration
+	Dial      time.Duration
+	FirstByte time.Duration
+	Stream    time.Duration
+	Teardown  time.Duration
+	// Stalls counts the times no byte went either way for
+	// SessionStallThreshold while streaming.
+	Stalls int64
+}
+
+// requestTiming marks the checks of an exec request, before it has a
+// watchdog.
+type requestTiming struct {
+	start, authenticated time.Time
+}
+
+// authenticate marks that the identity of the request is known.
+func (t *requestTiming) authenticate() {
+	t.authenticated = clk.Now()
+}
+
+// admitted returns the authn and policy phases, once the request passed
+// its checks.
+func (t *requestTiming) admitted() (authn, policy time.Duration) {
+	return t.authenticated.Sub(t.start), clk.Since(t.authenticated)
+}
+
+// sinceNanos is the time from the unix nanos from to those of to, zero when
+// either was not reached.
+func sinceNanos(from, to int64) time.Duration {
+	if from == 0 || to == 0 {
+		return 0
+	}
+	return time.Duration(to - from)
+}
+
+// dialed marks the connection to the apiserver made, after d.
+func (w *sessionWatchdog) dialed(d time.Duration) {
+	if w == nil {
+		return
+	}
+	w.dial.Store(int64(d))
+	w.dialedAt.Store(clk.Now().UnixNano())
+}
+
+// received marks the first byte of the apiserver. It is called on the data
+// path, after the first byte it is a single atomic load.
+func (w *sessionWatchdog) received() {
+	if w == nil || w.firstByteAt.Load() != 0 {
+		return
+	}
+	w.firstByteAt.CompareAndSwap(0, clk.Now().UnixNano())
+}
+
+// streamEnded marks the end of the stream, unless it was marked before.
+func (w *sessionWatchdog) streamEnded() {
+	if w == nil {
+		return
+	}
+	w.streamEndAt.CompareAndSwap(0, clk.Now().UnixNano())
+}
+
+// sampleStall checks the byte counters, at every tick of the stall sampler.
+func (w *sessionWatchdog) sampleStall() {
+	now := clk.Now()
+	bytes := w.fromClient.Load() + w.toClient.Load()
+	if bytes != w.stallBytes {
+		w.stallBytes, w.stallSince, w.stalled = bytes, now, false
+		return
+	}
+	if w.firstByteAt.Load() == 0 || w.streamEndAt.Load() != 0 || w.stalled {
+		return
+	}
+	if now.Sub(w.stallSince) >= SessionStallThreshold {
+		w.stalled = true
+		w.stalls.Add(1)
+		sessionStallsTotal.Inc()
+	}
+}
+
+// timings returns the phases of the session, ending now.
+func (w *sessionWatchdog) timings() sessionTiming {
+	t := w.timing
+	t.Dial = time.Duration(w.dial.Load())
+	t.FirstByte = sinceNanos(w.dialedAt.Load(), w.firstByteAt.Load())
+	streamEnd := w.streamEndAt.Load()
+	t.Stream = sinceNanos(w.firstByteAt.Load(), streamEnd)
+	t.Teardown = sinceNanos(streamEnd, clk.Now().UnixNano())
+	t.Stalls = w.stalls.Load()
+	return t
+}
+
+// observe records the phases the session reached in
+// rexec_session_phase_duration_seconds.
+func (t sessionTiming) observe() {
+	for phase, d := range map[string]time.Duration{
+		"authn": t.Authn, "policy": t.Policy, "dial": t.Dial,
+		"first_byte": t.FirstByte, "stream": t.Stream, "teardown": t.Teardown,
+	} {
+		if d > 0 {
+			sessionPhaseDuration.WithLabelValues(phase).Observe(d.Seconds())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	rexectest "github.com/adyen/kubectl-rexec/rexec/server/testutil"
+)
+
+func withStallThreshold(t *testing.T, threshold time.Duration) {
+	t.Helper()
+	old := SessionStallThreshold
+	t.Cleanup(func() { SessionStallThreshold = old })
+	SessionStallThreshold = threshold
+}
+
+// throttledRead is what a throttledConn answers a read with, after the fake
+// clock moved delay.
+type throttledRead struct {
+	delay time.Duration
+	data  string
+}
+
+// throttledConn is an upstream answering slowly on the fake clock, with
+// io.EOF once its reads are done.
+type throttledConn struct {
+	stubConn
+	fc    *rexectest.FakeClock
+	reads []throttledRead
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+	r := c.reads[0]
+	c.reads = c.reads[1:]
+	c.fc.Advance(r.delay)
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	return copy(b, r.data), nil
+}
+
+func TestSessionEndTiming(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	withSessionMaps(t)
+	buf := captureAudit(t)
+	stop := runAuditPipeline(t)
+
+	timing := &requestTiming{start: fc.Now()}
+	fc.Advance(2 * time.Millisecond)
+	timing.authenticate()
+	fc.Advance(30 * time.Millisecond)
+	info := sessionInfo{User: "bob"}
+	sessionMap["s1"] = info
+	watchdog := startSessionWatchdog("s1", info, func() {})
+	watchdog.timing.Authn, watchdog.timing.Policy = timing.admitted()
+	fc.Advance(15 * time.Millisecond)
+	watchdog.dialed(15 * time.Millisecond)
+
+	logger := &TCPLogger{Conn: &throttledConn{fc: fc, reads: []throttledRead{
+		{200 * time.Millisecond, "total 0\n"},
+		{time.Second, "$ "},
+		{500 * time.Millisecond, ""},
+	}}, ctxid: "s1", watchdog: watchdog}
+	b := make([]byte, 16)
+	for {
+		if _, err := logger.Read(b); err != nil {
+			break
+		}
+	}
+	fc.Advance(50 * time.Millisecond)
+	watchdog.streamEnded()
+	watchdog.stop()
+	endSession("s1", watchdog)
+	stop()
+
+	want := `"reason":"completed","bytes_from_client":0,"bytes_to_client":10,"authn_duration":2,"policy_duration":30,"dial_duration":15,` +
+		`"first_byte_duration":200,"stream_duration":1500,"teardown_duration":50,"stalls":0`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("session_end does not carry %s: %s", want, buf.String())
+	}
+}
+
+func TestSessionTimingUnreachedPhases(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	watchdog := startSessionWatchdog("s1", sessionInfo{}, func() {})
+	defer watchdog.stop()
+	watchdog.dialed(10 * time.Millisecond)
+	// the client went away before the apiserver answered
+	fc.Advance(time.Second)
+	watchdog.streamEnded()
+
+	got := watchdog.timings()
+	if got.Dial != 10*time.Millisecond || got.FirstByte != 0 || got.Stream != 0 || got.Teardown != 0 {
+		t.Fatalf("timing = %+v, want only the dial", got)
+	}
+}
+
+func TestSessionStallSampling(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	withStallThreshold(t, 4*time.Second)
+	w := &sessionWatchdog{stallSince: fc.Now()}
+	sample := func(d time.Duration, bytes int) {
+		fc.Advance(d)
+		w.transferred(bytes, false)
+		w.sampleStall()
+	}
+
+	// waiting for the first byte is not a stall
+	sample(10*time.Second, 0)
+	w.received()
+	sample(time.Second, 5)
+	// no byte for 3s, then 4s: one stall, however long it lasts
+	sample(3*time.Second, 0)
+	sample(time.Second, 0)
+	sample(10*time.Second, 0)
+	// traffic resumes, then stops again
+	sample(time.Second, 1)
+	sample(4*time.Second, 0)
+	// once the stream ended nothing is a stall
+	w.streamEnded()
+	sample(time.Second, 1)
+	sample(8*time.Second, 0)
+
+	if got := w.stalls.Load(); got != 2 {
+		t.Fatalf("stalls = %d, want 2", got)
+	}
+}
+
+func TestSessionStallsCountedWhileStreaming(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	withStallThreshold(t, 4*time.Second)
+	before := testutil.ToFloat64(sessionStallsTotal)
+	w := startSessionWatchdog("s1", sessionInfo{}, func() {})
+	defer w.stop()
+	w.received()
+	w.transferred(3, false)
+
+	// the sampler ticks every second, the counters do not move from then on
+	for i := 0; i < 6 && w.stalls.Load() == 0; i++ {
+		fc.Advance(time.Second)
+		eventually(t, "the sample", func() bool { return len(w.stall.C()) == 0 })
+	}
+	eventually(t, "the stall", func() bool { return w.stalls.Load() == 1 })
+	if got := testutil.ToFloat64(sessionStallsTotal) - before; got != 1 {
+		t.Fatalf("rexec_session_stalls_total grew by %v, want 1", got)
+	}
+}
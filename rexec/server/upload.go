@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// uploadDirectory returns the directory an exec request extracts an upload
+// into, or "" when it is not one. An upload is the command rexec cp
+// --allow-upload runs, tar reading an archive from stdin without a tty,
+// optionally behind the env prefix forcing the C locale. Its stdin is audited
+// as the entries of the archive instead of as keystrokes. Any other command is
+// recorded as before.
+func uploadDirectory(params url.Values) string {
+	if !paramTrue(params, "stdin") || paramTrue(params, "tty") {
+		return ""
+	}
+	command := params["command"]
+	if len(command) > 3 && command[0] == "env" && command[1] == "LC_ALL=C" && command[2] == "LANG=C" {
+		command = command[3:]
+	}
+	if len(command) != 5 || command[0] != "tar" || command[1] != "xf" || command[2] != "-" || command[3] != "-C" || command[4] == "" {
+		return ""
+	}
+	return command[4]
+}
+
+// maxTarMetaSize bounds the PAX and GNU long name headers of an uploaded
+// archive, which are held until the entry they describe.
+const maxTarMetaSize = 1 << 20
+
+// uploadEntry is an entry of an uploaded archive.
+type uploadEntry struct {
+	Path string
+	Type string
+	Size int64
+	Mode int64
+	Link string
+}
+
+// uploadStream follows the archive streamed as stdin of an upload, on the
+// audit shard owning the session. Client data lost to an audit gap or an
+// archive it can't follow stop it, the rest of the session is not audited as
+// entries then.
+type uploadStream struct {
+	stdin  wsStdin
+	tar    tarHeaders
+	failed bool
+}
+
+func newUploadStream() *uploadStream {
+	return &uploadStream{stdin: wsStdin{ws: newWSStream("client", false)}}
+}
+
+// feed advances the stream over the raw bytes the client wrote and returns
+// the entries whose header completed in them.
+func (u *uploadStream) feed(frames []byte) ([]uploadEntry, error) {
+	var entries []uploadEntry
+	var err error
+	u.stdin.feed(frames, func(data []byte) {
+		if err != nil {
+			return
+		}
+		var got []uploadEntry
+		got, err = u.tar.feed(data)
+		entries = append(entries, got...)
+	})
+	return entries, err
+}
+
+// pending reports whether the archive started but did not end.
+func (u *uploadStream) pending() bool {
+	return !u.failed && !u.tar.done && (u.tar.started || u.tar.have > 0)
+}
+
+// wsStdin reassembles the stdin a client streams over a websocket from the
+// raw bytes it wrote, across writes and fragmented messages. Every binary
+// message starts with the channel it is for, 0 is stdin.
+type wsStdin struct {
+	// ws skips the HTTP head of the upgrade request.
+	ws *wsStream
+
+	header [14]byte
+	have   int
+	// payload counts the bytes of the current frame still to come, offset
+	// those read, for the masking key mask.
+	payload uint64
+	offset  uint64
+	mask    [4]byte
+	// control is set for a control frame. binary is set while the message
+	// is binary, channel once its channel was read and stdin when that is 0.
+	control bool
+	binary  bool
+	channel bool
+	stdin   bool
+}
+
+// feed advances over p, handing the stdin data in it to out.
+func (s *wsStdin) feed(p []byte, out func([]byte)) {
+	if s.ws.inHead {
+		p = p[s.ws.skipHead(p):]
+	}
+	for len(p) > 0 {
+		if s.payload > 0 {
+			n := uint64(len(p))
+			if n > s.payload {
+				n = s.payload
+			}
+			s.payloadBytes(p[:n], out)
+			s.payload -= n
+			p = p[n:]
+			continue
+		}
+		s.header[s.have] = p[0]
+		s.have++
+		p = p[1:]
+		need := wsHeaderLen(s.header[:s.have])
+		if need == 0 || s.have < need {
+			continue
+		}
+		s.have = 0
+		s.frame(s.header[:need])
+	}
+}
+
+// frame starts the frame of header h.
+func (s *wsStdin) frame(h []byte) {
+	s.payload, s.offset = wsPayloadLen(h), 0
+	s.mask = [4]byte{}
+	if h[1]&0x80 != 0 {
+		copy(s.mask[:], h[len(h)-4:])
+	}
+	switch opcode := h[0] & 0x0f; {
+	case opcode&0x08 != 0:
+		// control frames may come between the fragments of a message
+		s.control = true
+	case opcode == 0:
+		// a continuation carries on the message it continues
+		s.control = false
+	default:
+		s.control = false
+		s.binary, s.channel, s.stdin = opcode == 0x2, false, false
+	}
+}
+
+// payloadBytes unmasks the payload bytes p of the current frame and hands
+// those of stdin to out.
+func (s *wsStdin) payloadBytes(p []byte, out func([]byte)) {
+	if s.control || !s.binary {
+		s.offset += uint64(len(p))
+		return
+	}
+	data := make([]byte, len(p))
+	for i, c := range p {
+		data[i] = c ^ s.mask[(s.offset+uint64(i))%4]
+	}
+	s.offset += uint64(len(p))
+	if !s.channel {
+		s.channel, s.stdin = true, data[0] == 0
+		data = data[1:]
+	}
+	if s.stdin && len(data) > 0 {
+		out(data)
+	}
+}
+
+// tarHeaders follows the headers of a tar archive fed to it in arbitrary
+// pieces, skipping the data of its entries. It understands the ustar, PAX and
+// GNU long name headers the tar implementations write.
+type tarHeaders struct {
+	block [512]byte
+	have  int
+	// skip counts the data and padding of the current entry still to come.
+	skip int64
+	// meta collects the data of a PAX or GNU long name header, metaLeft
+	// counts what is still to come of it.
+	meta     []byte
+	metaType byte
+	metaLeft int64
+	// longName, longLink and pax apply to the next entry.
+	longName, longLink string
+	pax                map[string]string
+	started, done      bool
+}
+
+// feed advances over p and returns the entries whose header completed in it.
+func (t *tarHeaders) feed(p []byte) ([]uploadEntry, error) {
+	var entries []uploadEntry
+	for len(p) > 0 && !t.done {
+		switch {
+		case t.metaLeft > 0:
+			n := min(t.metaLeft, int64(len(p)))
+			t.meta = append(t.meta, p[:n]...)
+			t.metaLeft -= n
+			p = p[n:]
+			if t.metaLeft == 0 {
+				if err := t.endMeta(); err != nil {
+					return entries, err
+				}
+			}
+		case t.skip > 0:
+			n := min(t.skip, int64(len(p)))
+			t.skip -= n
+			p = p[n:]
+		default:
+			n := copy(t.block[t.have:], p)
+			t.have += n
+			p = p[n:]
+			if t.have < len(t.block) {
+				continue
+			}
+			t.have = 0
+			entry, ok, err := t.header()
+			if err != nil {
+				return entries, err
+			}
+			if ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// header reads the header in block, reporting whether it is an entry rather
+// than the end of the archive or a header describing the next entry.
+func (t *tarHeaders) header() (uploadEntry, bool, error) {
+	b := t.block[:]
+	if bytes.Equal(b, make([]byte, len(b))) {
+		t.done = true
+		return uploadEntry{}, false, nil
+	}
+	t.started = true
+	sum, err := parseTarNumber(b[148:156])
+	if err != nil || sum != tarChecksum(b) {
+		return uploadEntry{}, false, errors.New("invalid tar header checksum")
+	}
+	size, err := parseTarNumber(b[124:136])
+	if err != nil || size < 0 {
+		return uploadEntry{}, false, errors.New("invalid tar entry size")
+	}
+	padded := size + (512-size%512)%512
+	typ := b[156]
+	switch typ {
+	case 'L', 'K', 'x', 'g':
+		if size > maxTarMetaSize {
+			return uploadEntry{}, false, fmt.Errorf("tar extended header of %d bytes exceeds the limit of %d", size, maxTarMetaSize)
+		}
+		t.meta, t.metaType, t.metaLeft, t.skip = t.meta[:0], typ, size, padded-size
+		if size == 0 {
+			return uploadEntry{}, false, t.endMeta()
+		}
+		return uploadEntry{}, false, nil
+	case 'S', 'M', 'V':
+		return uploadEntry{}, false, fmt.Errorf("unsupported tar entry type %q", typ)
+	}
+
+	mode, err := parseTarNumber(b[100:108])
+	if err != nil {
+		return uploadEntry{}, false, errors.New("invalid tar entry mode")
+	}
+	entry := uploadEntry{Path: tarString(b[0:100]), Type: tarEntryType(typ), Size: size, Mode: mode & 0o7777, Link: tarString(b[157:257])}
+	if string(b[257:265]) == "ustar\x0000" {
+		if prefix := tarString(b[345:500]); prefix != "" {
+			entry.Path = prefix + "/" + entry.Path
+		}
+	}
+	if t.longName != "" {
+		entry.Path = t.longName
+	}
+	if t.longLink != "" {
+		entry.Link = t.longLink
+	}
+	if path, ok := t.pax["path"]; ok {
+		entry.Path = path
+	}
+	if link, ok := t.pax["linkpath"]; ok {
+		entry.Link = link
+	}
+	if s, ok := t.pax["size"]; ok {
+		if entry.Size, err = strconv.ParseInt(s, 10, 64); err != nil || entry.Size < 0 {
+			return uploadEntry{}, false, errors.New("invalid tar entry size")
+		}
+		padded = entry.Size + (512-entry.Size%512)%512
+	}
+	t.longName, t.longLink, t.pax = "", "", nil
+	switch typ {
+	case '1', '2', '3', '4', '5', '6':
+		// these entries carry no data, whatever their size says
+		entry.Size, padded = 0, 0
+	}
+	t.skip = padded
+	return entry, true, nil
+}
+
+// endMeta applies the extended header collected in meta to the next entry.
+func (t *tarHeaders) endMeta() error {
+	switch t.metaType {
+	case 'L':
+		t.longName = tarString(t.meta)
+	case 'K':
+		t.longLink = tarString(t.meta)
+	case 'x':
+		records, err := parsePAXRecords(t.meta)
+		if err != nil {
+			return err
+		}
+		t.pax = records
+	}
+	// global PAX headers ('g') describe the archive, not an entry
+	return nil
+}
+
+// parsePAXRecords parses the "<length> <key>=<value>\n" records of a PAX
+// extended header.
+func parsePAXRecords(data []byte) (map[string]string, error) {
+	records := map[string]string{}
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp <= 0 {
+			return nil, errors.New("invalid PAX record")
+		}
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || n <= sp+1 || n > len(data) || data[n-1] != '\n' {
+			return nil, errors.New("invalid PAX record")
+		}
+		key, value, ok := strings.Cut(string(data[sp+1:n-1]), "=")
+		if !ok {
+			return nil, errors.New("invalid PAX record")
+		}
+		records[key] = value
+		data = data[n:]
+	}
+	return records, nil
+}
+
+// parseTarNumber parses a numeric header field, octal or, with the high bit
+// of its first byte set, GNU base-256.
+func parseTarNumber(field []byte) (int64, error) {
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		if field[0]&0x40 != 0 {
+			return 0, errors.New("negative tar number")
+		}
+		var n uint64
+		for i, c := range field {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if n>>55 != 0 {
+				return 0, errors.New("tar number out of range")
+			}
+			n = n<<8 | uint64(c)
+		}
+		return int64(n), nil
+	}
+	s := strings.Trim(string(field), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
+
+// tarChecksum sums the bytes of a header with its checksum field taken as
+// spaces.
+func tarChecksum(b []byte) int64 {
+	var sum int64
+	for i, c := range b {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		sum += int64(c)
+	}
+	return sum
+}
+
+// tarString is the NUL terminated string in field.
+func tarString(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+func tarEntryType(typ byte) string {
+	switch typ {
+	case '0', 0, '7':
+		return "file"
+	case '1':
+		return "hardlink"
+	case '2':
+		return "symlink"
+	case '3':
+		return "char"
+	case '4':
+		return "block"
+	case '5':
+		return "dir"
+	case '6':
+		return "fifo"
+	}
+	return fmt.Sprintf("unknown (%q)", typ)
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadDirectory(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"upload", "command=tar&command=xf&command=-&command=-C&command=/tmp&stdin=true&stderr=true", "/tmp"},
+		{"upload behind env", "command=env&command=LC_ALL=C&command=LANG=C&command=tar&command=xf&command=-&command=-C&command=/etc/app&stdin=true", "/etc/app"},
+		{"without stdin", "command=tar&command=xf&command=-&command=-C&command=/tmp&stdout=true", ""},
+		{"with a tty", "command=tar&command=xf&command=-&command=-C&command=/tmp&stdin=true&tty=true", ""},
+		{"more arguments", "command=tar&command=xf&command=-&command=-C&command=/tmp&command=--to-command=sh&stdin=true", ""},
+		{"another env", "command=env&command=PATH=/x&command=tar&command=xf&command=-&command=-C&command=/tmp&stdin=true", ""},
+		{"download", "command=tar&command=cf&command=-&command=-C&command=/tmp&command=--&command=x&stdin=true", ""},
+		{"shell", "command=sh&stdin=true", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := uploadDirectory(params); got != tt.want {
+				t.Errorf("uploadDirectory(%s) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+// uploadArchive is an archive of every kind of entry, with a name too long
+// for the ustar header, in format.
+func uploadArchive(t *testing.T, format tar.Format) ([]byte, []uploadEntry) {
+	t.Helper()
+	long := "conf/" + strings.Repeat("d", 120) + "/app.yaml"
+	headers := []*tar.Header{
+		{Name: "conf/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "conf/app.yaml", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1000},
+		{Name: "conf/current", Typeflag: tar.TypeSymlink, Mode: 0o777, Linkname: "app.yaml"},
+		{Name: long, Typeflag: tar.TypeReg, Mode: 0o4755, Size: 513},
+		{Name: "conf/empty", Typeflag: tar.TypeReg, Mode: 0o600},
+	}
+	want := []uploadEntry{
+		{Path: "conf/", Type: "dir", Mode: 0o755},
+		{Path: "conf/app.yaml", Type: "file", Size: 1000, Mode: 0o644},
+		{Path: "conf/current", Type: "symlink", Mode: 0o777, Link: "app.yaml"},
+		{Path: long, Type: "file", Size: 513, Mode: 0o4755},
+		{Path: "conf/empty", Type: "file", Mode: 0o600},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range headers {
+		h.Format = format
+		h.ModTime = time.Unix(1700000000, 0)
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte{'x'}, int(h.Size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), want
+}
+
+func TestTarHeaders(t *testing.T) {
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		archive, want := uploadArchive(t, format)
+		for _, chunk := range []int{1, 7, 512, 4096, len(archive)} {
+			t.Run(fmt.Sprintf("%v/%d", format, chunk), func(t *testing.T) {
+				var th tarHeaders
+				var got []uploadEntry
+				for p := archive; len(p) > 0; p = p[min(chunk, len(p)):] {
+					entries, err := th.feed(p[:min(chunk, len(p))])
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, entries...)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("entries = %+v, want %+v", got, want)
+				}
+				if !th.done {
+					t.Error("the end of the archive was not seen")
+				}
+			})
+		}
+	}
+}
+
+func TestTarHeadersInvalid(t *testing.T) {
+	archive, _ := uploadArchive(t, tar.FormatPAX)
+	corrupt := append([]byte(nil), archive...)
+	corrupt[0] ^= 0xff
+	sparse := append([]byte(nil), archive...)
+	// a GNU sparse entry keeps more headers after its own
+	sparse[156] = 'S'
+	sum := tarChecksum(sparse[:512])
+	copy(sparse[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	tests := []struct {
+		name    string
+		archive []byte
+		err     string
+	}{
+		{"checksum", corrupt, "invalid tar header checksum"},
+		{"sparse", sparse, "unsupported tar entry type 'S'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var th tarHeaders
+			if _, err := th.feed(tt.archive); err == nil || err.Error() != tt.err {
+				t.Fatalf("feed() = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseTarNumber(t *testing.T) {
+	tests := []struct {
+		field []byte
+		want  int64
+		err   bool
+	}{
+		{[]byte("0000644\x00"), 0o644, false},
+		{[]byte("   17 \x00"), 0o17, false},
+		{[]byte("\x00\x00\x00"), 0, false},
+		{[]byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x00, 0x00}, 1 << 16, false},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, 0, true},
+		{[]byte{0x80, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 0, true},
+		{[]byte("0009\x00"), 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTarNumber(tt.field)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseTarNumber(%q) = %d, %v, want %d, error %v", tt.field, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// stdinMessage is data as a client writes it to stdin: a binary message on
+// channel 0 masked like client frames are, split into fragments of at most
+// fragment bytes with a ping between them.
+func stdinMessage(data []byte, fragment int) []byte {
+	payload := append([]byte{0}, data...)
+	var out []byte
+	for first := true; len(payload) > 0; first = false {
+		n := min(fragment, len(payload))
+		opcode := byte(0x2)
+		if !first {
+			opcode = 0
+			out = append(out, buildFrame(0x9, []byte("ping"), true, [4]byte{9, 8, 7, 6})...)
+		}
+		h := wsHeader(n == len(payload), opcode, uint64(n), true)
+		out = append(out, h...)
+		for i, c := range payload[:n] {
+			out = append(out, c^h[len(h)-4+i%4])
+		}
+		payload = payload[n:]
+	}
+	return out
+}
+
+// uploadSession is the client side of an upload of archive over a websocket:
+// the upgrade request, a resize on another channel and archive in messages of
+// 32KiB.
+func uploadSession(archive []byte) []byte {
+	session := []byte(upgradeRequest)
+	session = append(session, buildFrame(0x2, []byte("\x04{\"Width\":80,\"Height\":24}"), true, [4]byte{1, 1, 1, 1})...)
+	for p := archive; len(p) > 0; p = p[min(32<<10, len(p)):] {
+		session = append(session, stdinMessage(p[:min(32<<10, len(p))], 4096)...)
+	}
+	return session
+}
+
+// processUpload hands session to a shard in writes of chunk bytes, as the
+// stream of an upload to dir would, and returns the events.
+func processUpload(shard *auditShard, info sessionInfo, session []byte, chunk int) []auditEvent {
+	var batch []auditEvent
+	for p := session; len(p) > 0; p = p[min(chunk, len(p)):] {
+		frames := append([]byte(nil), p[:min(chunk, len(p))]...)
+		batch = shard.process(asyncAudit{ctxid: "s1", info: info, frames: frames}, batch)
+	}
+	return batch
+}
+
+func TestUploadAudit(t *testing.T) {
+	withSessionMaps(t)
+	archive, want := uploadArchive(t, tar.FormatPAX)
+	info := sessionInfo{User: "alice", NameSpace: "default", Pod: "web-0", Upload: "/etc/app"}
+	for _, chunk := range []int{1, 100, 32 << 10, 1 << 20} {
+		t.Run(fmt.Sprint(chunk), func(t *testing.T) {
+			shard := &auditShard{index: map[string]uint64{}}
+			batch := processUpload(shard, info, uploadSession(archive), chunk)
+			batch = shard.process(asyncAudit{ctxid: "s1", info: info, event: &auditEvent{Session: "s1", Info: info, Event: "session_end"}}, batch)
+
+			var got []uploadEntry
+			for i, ev := range batch[:len(batch)-1] {
+				if ev.Event != "upload_file" || ev.Index != uint64(i+1) {
+					t.Fatalf("event %d = %+v, want upload_file %d", i, ev, i+1)
+				}
+				got = append(got, *ev.Upload)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("entries = %+v, want %+v", got, want)
+			}
+			if end := batch[len(batch)-1]; end.Event != "session_end" {
+				t.Errorf("last event = %+v, want session_end", end)
+			}
+			if _, ok := shard.uploads["s1"]; ok {
+				t.Error("the upload is kept after the session ended")
+			}
+		})
+	}
+}
+
+func TestUploadAuditUnparsed(t *testing.T) {
+	withSessionMaps(t)
+	archive, _ := uploadArchive(t, tar.FormatPAX)
+	info := sessionInfo{User: "alice", Upload: "/etc/app"}
+	gap := &auditEvent{Session: "s1", Info: info, Event: "audit_gap", LostBytes: 512}
+	end := &auditEvent{Session: "s1", Info: info, Event: "session_end"}
+	corrupt := append([]byte(nil), archive...)
+	// the mode of the second header
+	corrupt[512+100] = '9'
+
+	tests := []struct {
+		name  string
+		items []asyncAudit
+		want  []string
+	}{
+		{
+			"cut off",
+			[]asyncAudit{{frames: uploadSession(archive[:1536])}, {event: end}},
+			[]string{"upload_file conf/", "upload_file conf/app.yaml", "upload_unparsed the session ended before the end of the archive", "session_end"},
+		},
+		{
+			"audit gap",
+			[]asyncAudit{{frames: uploadSession(archive[:512])}, {event: gap}, {frames: stdinMessage(archive[512:], 4096)}, {event: end}},
+			[]string{"upload_file conf/", "audit_gap", "upload_unparsed client data was lost to an audit gap, the rest of the archive is not audited", "session_end"},
+		},
+		{
+			"invalid header",
+			[]asyncAudit{{frames: uploadSession(corrupt)}, {event: end}},
+			[]string{"upload_file conf/", "upload_unparsed invalid tar header checksum", "session_end"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shard := &auditShard{index: map[string]uint64{}}
+			var batch []auditEvent
+			for _, item := range tt.items {
+				item.ctxid, item.info = "s1", info
+				batch = shard.process(item, batch)
+			}
+			var got []string
+			for _, ev := range batch {
+				switch ev.Event {
+				case "upload_file":
+					got = append(got, ev.Event+" "+ev.Upload.Path)
+				case "upload_unparsed":
+					got = append(got, ev.Event+" "+ev.Reason)
+				default:
+					got = append(got, ev.Event)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
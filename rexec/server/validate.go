@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// DefaultMaxCommandArgs is the default for MaxCommandArgs.
+	DefaultMaxCommandArgs = 1024
+	// DefaultMaxCommandBytes is the default for MaxCommandBytes.
+	DefaultMaxCommandBytes = 256 * 1024
+	// maxLoggedValueLen bounds how much of an offending value ends up in the
+	// audit log, so a rejected oversized command cannot flood it instead.
+	maxLoggedValueLen = 256
+)
+
+// MaxCommandArgs caps the number of command elements an exec request may carry.
+var MaxCommandArgs = DefaultMaxCommandArgs
+
+// MaxCommandBytes caps the summed length of all command elements of an exec request.
+var MaxCommandBytes = DefaultMaxCommandBytes
+
+// execParamError describes a PodExecOptions field rejected by validateExecParams.
+type execParamError struct {
+	field   string
+	value   string
+	message string
+}
+
+func (e *execParamError) Error() string {
+	return fmt.Sprintf("%s: %s", e.field, e.message)
+}
+
+// validateExecParams checks the PodExecOptions carried in the query before any
+// upstream connection is made, so malformed requests fail fast with a clear
+// reason instead of a confusing kubelet error. Attach requests do not carry a
+// command, so only exec requires one.
+func validateExecParams(params url.Values, subresource string) *execParamError {
+	command := params["command"]
+	if subresource == "exec" && len(command) == 0 {
+		return &execParamError{field: "command", message: "must not be empty"}
+	}
+	if len(command) > MaxCommandArgs {
+		return &execParamError{
+			field:   "command",
+			value:   strings.Join(command, " "),
+			message: fmt.Sprintf("has %d elements, exceeding the limit of %d", len(command), MaxCommandArgs),
+		}
+	}
+	size := 0
+	for _, arg := range command {
+		size += len(arg)
+	}
+	if size > MaxCommandBytes {
+		return &execParamError{
+			field:   "command",
+			value:   strings.Join(command, " "),
+			message: fmt.Sprintf("is %d bytes long, exceeding the limit of %d", size, MaxCommandBytes),
+		}
+	}
+
+	if container := params.Get("container"); container != "" {
+		if errs := validation.IsDNS1123Label(container); len(errs) > 0 {
+			return &execParamError{field: "container", value: container, message: strings.Join(errs, "; ")}
+		}
+	}
+
+	if !paramTrue(params, "stdin") && !paramTrue(params, "stdout") && !paramTrue(params, "stderr") {
+		return &execParamError{field: "stdin", message: "at least one of stdin, stdout or stderr must be requested"}
+	}
+	return nil
+}
+
+func paramTrue(params url.Values, key string) bool {
+	value := params[key]
+	return len(value) > 0 && value[0] == "true"
+}
+
+// rejectExecParams audits the rejection and answers with a 400 Status object
+// naming the offending field.
+func rejectExecParams(w http.ResponseWriter, req rexecRequest, clientIP string, perr *execParamError) {
+	recordError("request_validation")
+	fields := func(e *zerolog.Event) *zerolog.Event {
+		return e.Str("field", perr.field).Str("value", truncateValue(perr.value)).Str("reason", perr.message)
+	}
+	legacy := func(e *zerolog.Event) *zerolog.Event {
+		return fields(e.Str("event", "request_rejected").Str("user", req.user).Str("namespace", req.namespace).Str("pod", req.pod).Str("client_ip", clientIP))
+	}
+	info := sessionInfo{User: req.user, UID: req.uid, Groups: req.groups, NameSpace: req.namespace, Pod: req.pod, ClientIP: clientIP}
+	emitAudit(logSink{}.Name(), "request_rejected", zerolog.WarnLevel, legacy, auditEvent{Info: info, Captured: clk.Now()}, fields)
+
+	writeStatus(w, &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: fmt.Sprintf("invalid exec request: %s", perr.Error()),
+		Reason:  metav1.StatusReasonBadRequest,
+		Details: &metav1.StatusDetails{
+			Name: req.pod,
+			Kind: "pods",
+			Causes: []metav1.StatusCause{{
+				Type:    metav1.CauseTypeFieldValueInvalid,
+				Message: perr.message,
+				Field:   perr.field,
+			}},
+		},
+		Code: http.StatusBadRequest,
+	})
+}
+
+// writeStatus writes status as a JSON metav1.Status response with its code.
+func writeStatus(w http.ResponseWriter, status *metav1.Status) {
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	body, err := json.Marshal(status)
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to encode status response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	if _, err := w.Write(body); err != nil {
+		SysLogger.Error().Err(err).Msg("failed to write status response")
+	}
+}
+
+func truncateValue(value string) string {
+	if len(value) <= maxLoggedValueLen {
+		return value
+	}
+	return value[:maxLoggedValueLen] + fmt.Sprintf("...(%d bytes truncated)", len(value)-maxLoggedValueLen)
+}
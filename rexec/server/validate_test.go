@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func withCommandLimits(t *testing.T, args, bytes int) {
+	t.Helper()
+	oldArgs, oldBytes := MaxCommandArgs, MaxCommandBytes
+	t.Cleanup(func() { MaxCommandArgs, MaxCommandBytes = oldArgs, oldBytes })
+	MaxCommandArgs, MaxCommandBytes = args, bytes
+}
+
+func execQuery(command []string, extra string) url.Values {
+	v, _ := url.ParseQuery("stdout=true&stderr=true" + extra)
+	for _, c := range command {
+		v.Add("command", c)
+	}
+	return v
+}
+
+func TestValidateExecParams(t *testing.T) {
+	withCommandLimits(t, 4, 16)
+
+	tests := []struct {
+		name        string
+		params      url.Values
+		subresource string
+		wantField   string
+	}{
+		{"valid", execQuery([]string{"ls", "-la"}, "&container=app"), "exec", ""},
+		{"args at limit", execQuery([]string{"a", "b", "c", "d"}, ""), "exec", ""},
+		{"args over limit", execQuery([]string{"a", "b", "c", "d", "e"}, ""), "exec", "command"},
+		{"bytes at limit", execQuery([]string{strings.Repeat("x", 8), strings.Repeat("y", 8)}, ""), "exec", ""},
+		{"bytes over limit", execQuery([]string{strings.Repeat("x", 8), strings.Repeat("y", 9)}, ""), "exec", "command"},
+		{"empty command exec", execQuery(nil, ""), "exec", "command"},
+		{"empty command attach", execQuery(nil, ""), "attach", ""},
+		{"container with slash", execQuery([]string{"ls"}, "&container=../app"), "exec", "container"},
+		{"container uppercase", execQuery([]string{"ls"}, "&container=App"), "exec", "container"},
+		{"container too long", execQuery([]string{"ls"}, "&container="+strings.Repeat("a", 64)), "exec", "container"},
+		{"container max length", execQuery([]string{"ls"}, "&container="+strings.Repeat("a", 63)), "exec", ""},
+		{"no streams", url.Values{"command": {"ls"}}, "exec", "stdin"},
+		{"tty with stdin only", url.Values{"command": {"sh"}, "stdin": {"true"}, "tty": {"true"}}, "exec", ""},
+		{"tty with stdout", url.Values{"command": {"sh"}, "stdin": {"true"}, "stdout": {"true"}, "tty": {"true"}}, "exec", ""},
+		// the kubelet ignores stderr with a tty, clients like the Python one ask for both
+		{"tty with stderr", url.Values{"command": {"sh"}, "stdin": {"true"}, "stdout": {"true"}, "stderr": {"true"}, "tty": {"true"}}, "exec", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perr := validateExecParams(tt.params, tt.subresource)
+			switch {
+			case tt.wantField == "" && perr != nil:
+				t.Fatalf("unexpected rejection: %v", perr)
+			case tt.wantField != "" && perr == nil:
+				t.Fatalf("expected rejection of %q, got none", tt.wantField)
+			case perr != nil && perr.field != tt.wantField:
+				t.Fatalf("rejected field = %q, want %q", perr.field, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestValidateExecParamsDefaultsAllowLargeCommands(t *testing.T) {
+	withCommandLimits(t, DefaultMaxCommandArgs, DefaultMaxCommandBytes)
+
+	// a sizeable inline script, the kind of thing people legitimately pass to sh -c
+	script := strings.Repeat("echo some diagnostic output here; ", 2000)
+	if perr := validateExecParams(execQuery([]string{"sh", "-c", script}, ""), "exec"); perr != nil {
+		t.Fatalf("unexpected rejection of a reasonable command: %v", perr)
+	}
+}
+
+func TestRexecHandlerRejectsInvalidExecParams(t *testing.T) {
+	oldNames := RequestHeaderAllowedNames
+	t.Cleanup(func() { RequestHeaderAllowedNames = oldNames })
+	RequestHeaderAllowedNames = nil
+	withCommandLimits(t, 2, 1024)
+	buf := captureAudit(t)
+
+	req := httptest.NewRequest(http.MethodGet,
+		"/apis/audit.adyen.internal/v1beta1/namespaces/ns/pods/pod/exec?command=a&command=b&command=c&stdout=true", nil)
+	req.Header.Set("X-Remote-User", "alice")
+	req = withFrontProxyCert(req, "front-proxy-client")
+	req = mux.SetURLVars(req, map[string]string{"namespace": "ns", "pod": "pod"})
+
+	rr := httptest.NewRecorder()
+	rexecHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	var status metav1.Status
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("response is not a Status: %v\n%s", err, rr.Body.String())
+	}
+	if status.Details == nil || len(status.Details.Causes) != 1 || status.Details.Causes[0].Field != "command" {
+		t.Fatalf("expected a cause naming the command field, got %+v", status.Details)
+	}
+	if !strings.Contains(buf.String(), `"event":"request_rejected"`) || !strings.Contains(buf.String(), `"level":"warn"`) {
+		t.Fatalf("expected a warn request_rejected audit event, got: %s", buf.String())
+	}
+}
+
+func TestTruncateValue(t *testing.T) {
+	if got := truncateValue("short"); got != "short" {
+		t.Fatalf("truncateValue(short) = %q", got)
+	}
+	long := strings.Repeat("x", maxLoggedValueLen+100)
+	got := truncateValue(long)
+	if !strings.HasPrefix(got, strings.Repeat("x", maxLoggedValueLen)+"...") || !strings.Contains(got, "100 bytes truncated") {
+		t.Fatalf("truncateValue(long) = %q", got)
+	}
+}
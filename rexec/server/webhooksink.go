@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// AuditWebhookURL is the https URL the events of recorded sessions are POSTed
+// to batch by batch, by a sink next to the audit log. Unset, there is none.
+var AuditWebhookURL string
+
+// AuditWebhookCAFile, AuditWebhookCertFile and AuditWebhookKeyFile are the CA
+// checking the audit webhook and the client certificate rexec presents to it.
+var AuditWebhookCAFile, AuditWebhookCertFile, AuditWebhookKeyFile string
+
+// AuditWebhookTimeout bounds a request to the audit webhook.
+var AuditWebhookTimeout = 5 * time.Second
+
+// AuditWebhookCompression is the Content-Encoding batches are sent with at
+// first, zstd, gzip or identity. A webhook that does not take it gets the
+// next one it does from then on.
+var AuditWebhookCompression = "identity"
+
+// AuditSpoolReplayInterval is how often the spool is replayed while no batch
+// comes along to do it.
+var AuditSpoolReplayInterval = 10 * time.Second
+
+// auditWebhook is the webhook sink, nil when there is none.
+var auditWebhook *webhookSink
+
+// webhookSink POSTs the v2 events of a batch as JSON lines. A batch the
+// webhook does not take goes to the spool when there is one, and every batch
+// after it too until the spool is replayed, so the webhook gets them in order.
+type webhookSink struct {
+	client *http.Client
+	url    string
+
+	mu sync.Mutex
+	// encoding is the Content-Encoding of the batches. It starts at
+	// AuditWebhookCompression and only goes down, once negotiated.
+	encoding   auditCodec
+	negotiated bool
+	spool      *auditSpool
+}
+
+// loadAuditWebhook builds the webhook sink and adds it to auditSinks.
+func loadAuditWebhook() error {
+	encoding, err := parseAuditCodec("audit-webhook-compression", AuditWebhookCompression)
+	if err != nil {
+		return err
+	}
+	if err := validateCompressionLevel(); err != nil {
+		return err
+	}
+	client, err := newWebhookClient("audit webhook", "audit-webhook", AuditWebhookURL, AuditWebhookCAFile, AuditWebhookCertFile, AuditWebhookKeyFile, AuditWebhookTimeout)
+	if err != nil {
+		return err
+	}
+	sink := &webhookSink{client: client, url: AuditWebhookURL, encoding: encoding}
+	if AuditSpoolDir != "" {
+		if AuditSpoolReplayInterval <= 0 {
+			return fmt.Errorf("--audit-spool-replay-interval must be positive, got %s", AuditSpoolReplayInterval)
+		}
+		codec, err := parseAuditCodec("audit-spool-compression", AuditSpoolCompression)
+		if err != nil {
+			return err
+		}
+		if sink.spool, err = openAuditSpool(AuditSpoolDir, codec, AuditSpoolMaxBytes); err != nil {
+			return err
+		}
+	}
+	auditWebhook = sink
+	auditSinks = append(auditSinks, sink)
+	return nil
+}
+
+func (*webhookSink) Name() string { return "webhook" }
+
+func (s *webhookSink) Write(events []auditEvent) error {
+	batch := webhookBatch(events)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spool != nil && s.spool.pending() {
+		if err := s.replayLocked(); err != nil {
+			return s.spoolLocked(batch, err)
+		}
+	}
+	if err := s.post(batch); err != nil {
+		if s.spool == nil {
+			return err
+		}
+		return s.spoolLocked(batch, err)
+	}
+	auditWebhookBatchesTotal.WithLabelValues("sent").Inc()
+	return nil
+}
+
+// webhookBatch is the v2 events of events, one line each.
+func webhookBatch(events []auditEvent) []byte {
+	var buf bytes.Buffer
+	for _, ev := range events {
+		level := auditEventLevel(ev.Event)
+		id := auditEventID(renderAudit(level, legacyEventFields(ev)))
+		buf.Write(renderAudit(level, v2Fields(id, auditType(ev), ev, func(e *zerolog.Event) *zerolog.Event {
+			return auditEventFields(e, ev)
+		})))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// spoolLocked spools batch, which the webhook did not take because of cause.
+func (s *webhookSink) spoolLocked(batch []byte, cause error) error {
+	if err := s.spool.add(batch); err != nil {
+		return fmt.Errorf("%w, and the batch can't be spooled: %w", cause, err)
+	}
+	auditWebhookBatchesTotal.WithLabelValues("spooled").Inc()
+	SysLogger.Debug().Err(cause).Str("dir", s.spool.dir).Msg("spooled an audit batch the webhook did not take")
+	return nil
+}
+
+// replayLocked sends the spooled batches, oldest first.
+func (s *webhookSink) replayLocked() error {
+	return s.spool.replay(func(batch []byte) error {
+		if err := s.post(batch); err != nil {
+			return err
+		}
+		auditWebhookBatchesTotal.WithLabelValues("replayed").Inc()
+		return nil
+	})
+}
+
+// watchSpool replays the spool every AuditSpoolReplayInterval, for batches
+// spooled when no more come after them.
+func (s *webhookSink) watchSpool(stop <-chan struct{}) {
+	ticker := clk.NewTicker(AuditSpoolReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			s.mu.Lock()
+			if s.spool.pending() {
+				if err := s.replayLocked(); err != nil {
+					SysLogger.Debug().Err(err).Str("dir", s.spool.dir).Msg("the audit spool is not replayed yet")
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// post sends batch in the negotiated encoding. A webhook answering 415 to an
+// encoding is sent the batch again in the next one it takes.
+func (s *webhookSink) post(batch []byte) error {
+	if !s.negotiated {
+		s.preflight()
+	}
+	for {
+		payload, err := s.encoding.encode(batch, AuditCompressionLevel)
+		if err != nil {
+			return err
+		}
+		hr, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		hr.Header.Set("Content-Type", "application/x-ndjson")
+		if s.encoding != codecIdentity {
+			hr.Header.Set("Content-Encoding", s.encoding.String())
+		}
+		resp, err := s.client.Do(hr)
+		if err != nil {
+			return err
+		}
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		//nolint:errcheck
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusUnsupportedMediaType && s.encoding != codecIdentity {
+			s.fallBack(resp.Header.Get("Accept-Encoding"))
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("the audit webhook answered %s: %s", resp.Status, truncateValue(string(raw)))
+		}
+		auditWebhookBytesTotal.WithLabelValues(s.encoding.String()).Add(float64(len(payload)))
+		return nil
+	}
+}
+
+// preflight asks the webhook which encodings it takes with an OPTIONS
+// request, before the first batch. A webhook that does not say is sent the
+// configured encoding, and negotiation happens on its first 415 instead.
+func (s *webhookSink) preflight() {
+	if s.encoding == codecIdentity {
+		s.negotiated = true
+		return
+	}
+	hr, err := http.NewRequest(http.MethodOptions, s.url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.client.Do(hr)
+	if err != nil {
+		// asked again before the next batch
+		return
+	}
+	//nolint:errcheck
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+	//nolint:errcheck
+	_ = resp.Body.Close()
+	s.negotiated = true
+	if accepted, ok := acceptedCodecs(resp.Header.Get("Accept-Encoding")); ok {
+		s.settle(bestCodec(s.encoding, accepted))
+	}
+}
+
+// fallBack moves to the next encoding after a 415, the best of accept, the
+// Accept-Encoding of the answer, or else the one below.
+func (s *webhookSink) fallBack(accept string) {
+	next := s.encoding - 1
+	if accepted, ok := acceptedCodecs(accept); ok {
+		next = bestCodec(next, accepted)
+	}
+	s.negotiated = true
+	s.settle(next)
+}
+
+func (s *webhookSink) settle(encoding auditCodec) {
+	if encoding == s.encoding {
+		return
+	}
+	SysLogger.Info().Str("url", s.url).Str("from", s.encoding.String()).Str("to", encoding.String()).Msg("the audit webhook does not take the encoding, falling back")
+	s.encoding = encoding
+}
+
+// acceptedCodecs parses an Accept-Encoding header. ok is false when it is
+// empty, and says nothing. identity is accepted unless excluded with q=0.
+func acceptedCodecs(header string) (accepted [numAuditCodecs]bool, ok bool) {
+	if strings.TrimSpace(header) == "" {
+		return accepted, false
+	}
+	accepted[codecIdentity] = true
+	for _, item := range strings.Split(header, ",") {
+		token, params, _ := strings.Cut(item, ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		on := true
+		for _, p := range strings.Split(params, ";") {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				on = strings.Trim(q, "0.") != ""
+			}
+		}
+		for c, name := range auditCodecNames {
+			if token == name || token == "*" {
+				accepted[c] = on
+			}
+		}
+	}
+	return accepted, true
+}
+
+// bestCodec is the best of accepted up to from, identity when none is.
+func bestCodec(from auditCodec, accepted [numAuditCodecs]bool) auditCodec {
+	for c := from; c > codecIdentity; c-- {
+		if accepted[c] {
+			return c
+		}
+	}
+	return codecIdentity
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// auditReceiver is an audit webhook taking the encodings in accepts, the
+// batches it took decoded in order.
+type auditReceiver struct {
+	t       *testing.T
+	accepts map[string]bool
+	// advertise is the Accept-Encoding it answers with, to OPTIONS and 415.
+	advertise string
+	down      bool
+
+	mu       sync.Mutex
+	batches  []string
+	requests []string
+}
+
+func (a *auditReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	encoding := r.Header.Get("Content-Encoding")
+	if encoding == "" {
+		encoding = "identity"
+	}
+	a.requests = append(a.requests, r.Method+" "+encoding)
+	if a.advertise != "" {
+		w.Header().Set("Accept-Encoding", a.advertise)
+	}
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if a.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !a.accepts[encoding] {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	codec, err := parseAuditCodec("test", encoding)
+	if err != nil {
+		a.t.Error(err)
+		return
+	}
+	raw, _ := io.ReadAll(r.Body)
+	batch, err := codec.decode(raw)
+	if err != nil {
+		a.t.Errorf("%s batch does not decode: %v", encoding, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.batches = append(a.batches, string(batch))
+}
+
+func (a *auditReceiver) took() ([]string, []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.batches...), append([]string(nil), a.requests...)
+}
+
+func newTestWebhookSink(t *testing.T, receiver *auditReceiver, encoding auditCodec) *webhookSink {
+	t.Helper()
+	receiver.t = t
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+	return &webhookSink{client: srv.Client(), url: srv.URL, encoding: encoding}
+}
+
+func testAuditBatch(n int) []auditEvent {
+	info := sessionInfo{User: "alice", UID: "1001", Groups: []string{"sre"}, NameSpace: "payments", Pod: "api-0", Container: "app", ClientIP: "192.0.2.1"}
+	events := make([]auditEvent, n)
+	for i := range events {
+		events[i] = auditEvent{Session: "s1", Info: info, Command: fmt.Sprintf("kubectl get pods -n payments # %d", i), Index: uint64(i + 1), Captured: time.Unix(1700000000, int64(i))}
+	}
+	return events
+}
+
+func TestWebhookSinkRoundTripsEveryEncoding(t *testing.T) {
+	events := testAuditBatch(3)
+	want := string(webhookBatch(events))
+	for c := range numAuditCodecs {
+		encoding := auditCodec(c)
+		t.Run(encoding.String(), func(t *testing.T) {
+			receiver := &auditReceiver{accepts: map[string]bool{encoding.String(): true}}
+			sink := newTestWebhookSink(t, receiver, encoding)
+			if err := sink.Write(events); err != nil {
+				t.Fatal(err)
+			}
+			batches, _ := receiver.took()
+			if len(batches) != 1 || batches[0] != want {
+				t.Fatalf("received %q, want %q", batches, want)
+			}
+		})
+	}
+	lines := strings.Split(strings.TrimSuffix(want, "\n"), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"schema":"`+auditSchemaV2+`"`) || !strings.Contains(lines[0], `"command":"kubectl get pods -n payments # 0"`) {
+		t.Fatalf("batch is not the v2 events, one per line:\n%s", want)
+	}
+}
+
+func TestWebhookSinkNegotiatesEncoding(t *testing.T) {
+	tests := []struct {
+		name      string
+		accepts   string
+		advertise string
+		encoding  auditCodec
+		// requests of the first and second batch
+		want []string
+	}{
+		{"taken", "zstd", "", codecZstd,
+			[]string{"OPTIONS identity", "POST zstd", "POST zstd"}},
+		{"preflight", "gzip", "gzip, identity", codecZstd,
+			[]string{"OPTIONS identity", "POST gzip", "POST gzip"}},
+		{"preflight excludes", "identity", "zstd;q=0, gzip;q=0", codecZstd,
+			[]string{"OPTIONS identity", "POST identity", "POST identity"}},
+		{"415 steps down", "identity", "", codecZstd,
+			[]string{"OPTIONS identity", "POST zstd", "POST gzip", "POST identity", "POST identity"}},
+		{"415 from gzip", "identity", "", codecGzip,
+			[]string{"OPTIONS identity", "POST gzip", "POST identity", "POST identity"}},
+		{"identity asks nothing", "identity", "", codecIdentity,
+			[]string{"POST identity", "POST identity"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepts := map[string]bool{}
+			for _, e := range strings.Split(tt.accepts, ",") {
+				accepts[e] = true
+			}
+			receiver := &auditReceiver{accepts: accepts, advertise: tt.advertise}
+			sink := newTestWebhookSink(t, receiver, tt.encoding)
+			for i := range 2 {
+				if err := sink.Write(testAuditBatch(1)); err != nil {
+					t.Fatalf("batch %d: %v", i, err)
+				}
+			}
+			batches, requests := receiver.took()
+			if len(batches) != 2 {
+				t.Fatalf("webhook took %d batches, want 2", len(batches))
+			}
+			if strings.Join(requests, ", ") != strings.Join(tt.want, ", ") {
+				t.Fatalf("requests = %q, want %q", requests, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkSpoolsUntilTheWebhookIsBack(t *testing.T) {
+	receiver := &auditReceiver{accepts: map[string]bool{"zstd": true}, down: true}
+	sink := newTestWebhookSink(t, receiver, codecZstd)
+	sink.spool = openTestSpool(t, t.TempDir(), codecZstd)
+	first, second, third := testAuditBatch(1), testAuditBatch(2), testAuditBatch(3)
+
+	for _, batch := range [][]auditEvent{first, second} {
+		if err := sink.Write(batch); err != nil {
+			t.Fatalf("a batch the spool takes is not an error: %v", err)
+		}
+	}
+	if len(sink.spool.segments) != 2 {
+		t.Fatalf("spooled %d batches, want 2", len(sink.spool.segments))
+	}
+
+	receiver.mu.Lock()
+	receiver.down = false
+	receiver.mu.Unlock()
+	if err := sink.Write(third); err != nil {
+		t.Fatal(err)
+	}
+	batches, _ := receiver.took()
+	want := []string{string(webhookBatch(first)), string(webhookBatch(second)), string(webhookBatch(third))}
+	if strings.Join(batches, "|") != strings.Join(want, "|") {
+		t.Fatalf("webhook took %q, want the spooled batches first: %q", batches, want)
+	}
+	if sink.spool.pending() {
+		t.Fatal("spool not empty once replayed")
+	}
+}
+
+func TestWebhookSinkWithoutSpoolFails(t *testing.T) {
+	receiver := &auditReceiver{down: true}
+	sink := newTestWebhookSink(t, receiver, codecIdentity)
+	err := sink.Write(testAuditBatch(1))
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("err = %v, want the answer of the webhook", err)
+	}
+}
+
+func TestWebhookSinkReplaysOnItsOwn(t *testing.T) {
+	fc := withFakeClock(t, 0, 0, 0)
+	receiver := &auditReceiver{accepts: map[string]bool{"identity": true}, down: true}
+	sink := newTestWebhookSink(t, receiver, codecIdentity)
+	sink.spool = openTestSpool(t, t.TempDir(), codecGzip)
+	if err := sink.Write(testAuditBatch(1)); err != nil {
+		t.Fatal(err)
+	}
+	receiver.mu.Lock()
+	receiver.down = false
+	receiver.mu.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go sink.watchSpool(stop)
+	eventually(t, "the replay ticker", func() bool { return fc.Waiters() > 0 })
+	fc.Advance(AuditSpoolReplayInterval)
+	eventually(t, "the spooled batch replayed", func() bool {
+		batches, _ := receiver.took()
+		return len(batches) == 1
+	})
+}
+
+func TestAcceptedCodecs(t *testing.T) {
+	for header, want := range map[string]string{
+		"gzip":                 "identity gzip",
+		"zstd, gzip":           "identity gzip zstd",
+		"ZSTD;q=0.5":           "identity zstd",
+		"*":                    "identity gzip zstd",
+		"*, zstd;q=0":          "identity gzip",
+		"identity;q=0, gzip":   "gzip",
+		"br, deflate":          "identity",
+		"gzip;q=0.000, zstd;q": "identity zstd",
+	} {
+		accepted, ok := acceptedCodecs(header)
+		var got []string
+		for c, on := range accepted {
+			if on {
+				got = append(got, auditCodec(c).String())
+			}
+		}
+		if !ok || strings.Join(got, " ") != want {
+			t.Errorf("acceptedCodecs(%q) = %q, want %q", header, got, want)
+		}
+	}
+	if _, ok := acceptedCodecs(" "); ok {
+		t.Error("an empty header says nothing")
+	}
+}
+
+// BenchmarkAuditCodecs measures the CPU cost of compressing a batch of 100
+// command events, and reports the ratio it achieves.
+func BenchmarkAuditCodecs(b *testing.B) {
+	batch := webhookBatch(testAuditBatch(100))
+	for c := range numAuditCodecs {
+		codec := auditCodec(c)
+		for _, level := range []int{1, 3, 9} {
+			if codec == codecIdentity && level != 1 {
+				continue
+			}
+			b.Run(fmt.Sprintf("%s/level-%d", codec, level), func(b *testing.B) {
+				b.SetBytes(int64(len(batch)))
+				var encoded []byte
+				for b.Loop() {
+					var err error
+					if encoded, err = codec.encode(batch, level); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(batch))/float64(len(encoded)), "ratio")
+				decoded, err := codec.decode(encoded)
+				if err != nil || !bytes.Equal(decoded, batch) {
+					b.Fatalf("round trip failed: %v", err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// WSMaxMessageSize bounds the size of a WebSocket message, summed over its
+// fragments, in either direction of a recorded session. A session exceeding it
+// is closed with status 1009 (message too big).
+var WSMaxMessageSize int64
+
+// DefaultWSMaxMessageSize is used when WSMaxMessageSize is not set. kubectl
+// and the kubelet send stdin and output in chunks of at most 32KiB, so it is
+// never reached by normal use.
+const DefaultWSMaxMessageSize = 16 << 20
+
+// wsCloseMessageTooBig is the close status sent to the client when a limit is
+// exceeded.
+const wsCloseMessageTooBig = 1009
+
+// wsClosePolicyViolation is the close status sent to the client of a denied
+// session.
+const wsClosePolicyViolation = 1008
+
+// wsLimitError is a WebSocket message over WSMaxMessageSize.
+type wsLimitError struct {
+	// direction is client for what the client sent, upstream for what the
+	// apiserver sent.
+	direction string
+	size      uint64
+	limit     int64
+}
+
+func (e *wsLimitError) Error() string {
+	return fmt.Sprintf("websocket message of %d bytes from %s exceeds the limit of %d bytes", e.size, e.direction, e.limit)
+}
+
+// wsStream follows the frames of one direction of a WebSocket connection from
+// their headers alone, payloads are skipped over without being buffered. It
+// starts at the HTTP upgrade request or response that precedes the frames.
+type wsStream struct {
+	direction string
+	limit     int64
+
+	// inHead is set until the end of the HTTP head, headEnd counts the bytes
+	// of its terminating CRLFCRLF seen so far.
+	inHead  bool
+	headEnd int
+	// status holds the start of a response head, to tell a switch to
+	// WebSocket from a plain HTTP error whose body must not be read as frames.
+	response bool
+	status   []byte
+	disabled bool
+
+	header  [14]byte
+	have    int
+	payload uint64
+	message uint64
+}
+
+func newWSStream(direction string, response bool) *wsStream {
+	limit := WSMaxMessageSize
+	if limit <= 0 {
+		limit = DefaultWSMaxMessageSize
+	}
+	return &wsStream{direction: direction, limit: limit, inHead: true, response: response}
+}
+
+// feed advances the stream over p. When a frame in p takes its message over the
+// limit it returns the offset in p its header starts at, so everything before
+// it can still be passed on, or -1 if the header started in an earlier chunk.
+func (s *wsStream) feed(p []byte) (int, *wsLimitError) {
+	if s.disabled {
+		return 0, nil
+	}
+	i := 0
+	if s.inHead {
+		i = s.skipHead(p)
+		if s.inHead || s.disabled {
+			return 0, nil
+		}
+	}
+	start := -1
+	for i < len(p) {
+		if s.payload > 0 {
+			n := uint64(len(p) - i)
+			if n > s.payload {
+				n = s.payload
+			}
+			s.payload -= n
+			i += int(n)
+			continue
+		}
+		if s.have == 0 {
+			start = i
+		}
+		s.header[s.have] = p[i]
+		s.have++
+		i++
+		need := wsHeaderLen(s.header[:s.have])
+		if need == 0 || s.have < need {
+			continue
+		}
+		s.have = 0
+		if err := s.frame(s.header[:need]); err != nil {
+			return start, err
+		}
+	}
+	return 0, nil
+}
+
+// frame accounts a complete frame header.
+func (s *wsStream) frame(h []byte) *wsLimitError {
+	length := wsPayloadLen(h)
+	fin := h[0]&0x80 != 0
+	// control frames (close, ping, pong) may come between the fragments of a
+	// message without being part of it
+	control := h[0]&0x08 != 0
+	size := length
+	if !control {
+		size += s.message
+	}
+	if length > uint64(s.limit) || size > uint64(s.limit) {
+		return &wsLimitError{direction: s.direction, size: size, limit: s.limit}
+	}
+	if !control {
+		if fin {
+			s.message = 0
+		} else {
+			s.message = size
+		}
+	}
+	s.payload = length
+	return nil
+}
+
+// atBoundary reports whether the next byte starts a frame, so a frame of our
+// own can be put in.
+func (s *wsStream) atBoundary() bool {
+	return !s.inHead && s.have == 0 && s.payload == 0
+}
+
+// skipHead consumes the HTTP head and returns the offset of the first byte
+// after it.
+func (s *wsStream) skipHead(p []byte) int {
+	const end = "\r\n\r\n"
+	for i, c := range p {
+		if s.response && len(s.status) < len("HTTP/1.1 101") {
+			s.status = append(s.status, c)
+		}
+		switch {
+		case c == end[s.headEnd]:
+			s.headEnd++
+		case c == end[0]:
+			s.headEnd = 1
+		default:
+			s.headEnd = 0
+		}
+		if s.headEnd == len(end) {
+			s.inHead = false
+			if s.response && !bytes.Equal(s.status, []byte("HTTP/1.1 101")) {
+				s.disabled = true
+			}
+			return i + 1
+		}
+	}
+	return len(p)
+}
+
+// wsHeaderLen returns the length of the frame header starting with h, or 0 if
+// h is too short to tell.
+func wsHeaderLen(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func wsPayloadLen(h []byte) uint64 {
+	switch l := h[1] & 0x7f; l {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(l)
+	}
+}
+
+// wsCloseFrame is an unmasked close frame as the server side sends it.
+func wsCloseFrame(code uint16, reason string) []byte {
+	frame := []byte{0x88, byte(2 + len(reason)), byte(code >> 8), byte(code)}
+	return append(frame, reason...)
+}
+
+// wsFrame is an unmasked final frame of opcode carrying payload.
+func wsFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	return append(frame, payload...)
+}
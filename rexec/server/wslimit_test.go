@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	upgradeRequest = "GET /api/v1/namespaces/default/pods/shell/exec?tty=true HTTP/1.1\r\nHost: apiserver\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	switchResponse = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+)
+
+// wsHeader is the header of a frame with a payload of length, which the tests
+// mostly never send.
+func wsHeader(fin bool, opcode byte, length uint64, masked bool) []byte {
+	h := []byte{opcode, 0}
+	if fin {
+		h[0] |= 0x80
+	}
+	switch {
+	case length < 126:
+		h[1] = byte(length)
+	case length <= 0xffff:
+		h[1] = 126
+		h = binary.BigEndian.AppendUint16(h, uint16(length))
+	default:
+		h[1] = 127
+		h = binary.BigEndian.AppendUint64(h, length)
+	}
+	if masked {
+		h[1] |= 0x80
+		h = append(h, 1, 2, 3, 4)
+	}
+	return h
+}
+
+func withWSMaxMessageSize(t *testing.T, limit int64) {
+	t.Helper()
+	old := WSMaxMessageSize
+	t.Cleanup(func() { WSMaxMessageSize = old })
+	WSMaxMessageSize = limit
+}
+
+func TestWSStreamLimits(t *testing.T) {
+	withWSMaxMessageSize(t, 1000)
+	frame := func(fin bool, opcode byte, length int) []byte {
+		return append(wsHeader(fin, opcode, uint64(length), true), bytes.Repeat([]byte("x"), length)...)
+	}
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name      string
+		response  bool
+		chunks    [][]byte
+		wantChunk int // index of the chunk that fails, -1 for none
+		wantStart int
+		wantSize  uint64
+	}{
+		{
+			name:      "small frames",
+			chunks:    [][]byte{[]byte(upgradeRequest[:20]), []byte(upgradeRequest[20:]), frame(true, 0x2, 500), frame(true, 0x2, 1000)},
+			wantChunk: -1,
+		},
+		{
+			name:      "oversized frame after others in one chunk",
+			chunks:    [][]byte{[]byte(upgradeRequest), cat(frame(true, 0x2, 10), wsHeader(true, 0x2, 1001, true))},
+			wantChunk: 1, wantStart: len(frame(true, 0x2, 10)), wantSize: 1001,
+		},
+		{
+			name:      "header split over chunks",
+			chunks:    [][]byte{[]byte(upgradeRequest), {0x82}, {127}, wsHeader(true, 0x2, 1<<40, false)[2:]},
+			wantChunk: 3, wantStart: -1, wantSize: 1 << 40,
+		},
+		{
+			name:      "fragments add up",
+			chunks:    [][]byte{[]byte(upgradeRequest), frame(false, 0x2, 400), frame(false, 0x0, 400), frame(true, 0x0, 400)},
+			wantChunk: 3, wantStart: 0, wantSize: 1200,
+		},
+		{
+			name:      "control frames between fragments don't count",
+			chunks:    [][]byte{[]byte(upgradeRequest), frame(false, 0x2, 500), frame(true, 0x9, 100), frame(true, 0x0, 500), frame(true, 0x2, 1000)},
+			wantChunk: -1,
+		},
+		{
+			name:      "error response body is not read as frames",
+			response:  true,
+			chunks:    [][]byte{[]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 10\r\n\r\n"), wsHeader(true, 0x2, 1<<40, false)},
+			wantChunk: -1,
+		},
+		{
+			name:      "switched response",
+			response:  true,
+			chunks:    [][]byte{[]byte(switchResponse), wsHeader(true, 0x1, 5000, false)},
+			wantChunk: 1, wantStart: 0, wantSize: 5000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newWSStream("client", tt.response)
+			for i, chunk := range tt.chunks {
+				start, err := s.feed(chunk)
+				if i != tt.wantChunk {
+					if err != nil {
+						t.Fatalf("chunk %d: unexpected %v", i, err)
+					}
+					continue
+				}
+				if err == nil {
+					t.Fatalf("chunk %d: expected the limit to be exceeded", i)
+				}
+				if start != tt.wantStart || err.size != tt.wantSize || err.limit != 1000 {
+					t.Fatalf("chunk %d: start %d size %d limit %d, want start %d size %d", i, start, err.size, err.limit, tt.wantStart, tt.wantSize)
+				}
+				return
+			}
+		})
+	}
+}
+
+// TestWSStreamLargeMessageIsStreamed checks a large but legitimate message is
+// skipped over as it passes, without any allocation.
+func TestWSStreamLargeMessageIsStreamed(t *testing.T) {
+	withWSMaxMessageSize(t, DefaultWSMaxMessageSize)
+	s := newWSStream("upstream", true)
+	if _, err := s.feed([]byte(switchResponse)); err != nil {
+		t.Fatal(err)
+	}
+	const chunk, chunks = 32 << 10, 256
+	header := wsHeader(true, 0x1, chunk*chunks, false)
+	payload := make([]byte, chunk)
+
+	allocs := testing.AllocsPerRun(5, func() {
+		if _, err := s.feed(header); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < chunks; i++ {
+			if _, err := s.feed(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("streaming an 8MiB message allocated %v times", allocs)
+	}
+	if !s.atBoundary() {
+		t.Fatal("expected to be at a frame boundary after the message")
+	}
+}
+
+// scriptConn returns reads in order, then io.EOF, or net.ErrClosed once closed.
+type scriptConn struct {
+	stubConn
+	reads  [][]byte
+	closed bool
+}
+
+func (s *scriptConn) Read(b []byte) (int, error) {
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	if len(s.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, s.reads[0])
+	s.reads = s.reads[1:]
+	return n, nil
+}
+
+func (s *scriptConn) Close() error {
+	s.closed = true
+	return nil
+}
+
+func newWSLogger(conn net.Conn) *TCPLogger {
+	return &TCPLogger{
+		Conn: conn, ctxid: "s1", info: sessionInfo{User: "mallory"},
+		buffer: newSessionBuffer("s1", sessionInfo{User: "mallory"}),
+		client: newWSStream("client", false), upstream: newWSStream("upstream", true),
+	}
+}
+
+// limitEvent returns the session_limit_exceeded event the logger queued.
+func limitEvent(t *testing.T, logger *TCPLogger) auditEvent {
+	t.Helper()
+	for _, item := range logger.buffer.take() {
+		if item.event != nil && item.event.Event == "session_limit_exceeded" {
+			return *item.event
+		}
+	}
+	t.Fatal("no session_limit_exceeded event")
+	return auditEvent{}
+}
+
+func readAll(t *testing.T, logger *TCPLogger) (data [][]byte, err error) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		b := make([]byte, 4096)
+		n, err := logger.Read(b)
+		if n > 0 {
+			data = append(data, b[:n])
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+	t.Fatal("the stream to the client did not end")
+	return nil, nil
+}
+
+func TestTCPLoggerClosesOnOversizedClientMessage(t *testing.T) {
+	withWSMaxMessageSize(t, 1024)
+	withFakeClock(t, 0, 0, 0)
+	before := testutil.ToFloat64(wsLimitExceededTotal.WithLabelValues("client"))
+	conn := &scriptConn{reads: [][]byte{[]byte(switchResponse)}}
+	logger := newWSLogger(conn)
+
+	if _, err := logger.Write([]byte(upgradeRequest)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := logger.Read(make([]byte, 4096)); err != nil || n != len(switchResponse) {
+		t.Fatalf("switch response: n=%d err=%v", n, err)
+	}
+	key := [4]byte{1, 2, 3, 4}
+	small := buildFrame(0x2, []byte("ls\r"), true, key)
+	// a small frame, then a header announcing 1GiB and the start of its payload
+	evil := append(append(append([]byte(nil), small...), wsHeader(true, 0x2, 1<<30, true)...), make([]byte, 2048)...)
+	if n, err := logger.Write(evil); err != nil || n != len(evil) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+
+	if len(conn.written) != 2 || !bytes.Equal(conn.written[1], small) {
+		t.Fatalf("only the frames before the oversized one may be forwarded, got %d writes", len(conn.written))
+	}
+	if !conn.closed {
+		t.Fatal("the upstream connection must be closed")
+	}
+	if n, _ := logger.Write(small); n != len(small) || len(conn.written) != 2 {
+		t.Fatal("nothing may be forwarded after the limit was exceeded")
+	}
+
+	data, err := readAll(t, logger)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the stream to the client to end with EOF, got %v", err)
+	}
+	if len(data) != 1 || !bytes.Equal(data[0], wsCloseFrame(wsCloseMessageTooBig, "message too big")) {
+		t.Fatalf("expected a single close frame with status 1009, got %x", data)
+	}
+
+	ev := limitEvent(t, logger)
+	if ev.Limit != "ws_max_message_size" || ev.LimitBytes != 1024 || ev.Direction != "client" || ev.Size != 1<<30 {
+		t.Fatalf("unexpected audit event %+v", ev)
+	}
+	if got := testutil.ToFloat64(wsLimitExceededTotal.WithLabelValues("client")) - before; got != 1 {
+		t.Fatalf("limit counter delta = %v, want 1", got)
+	}
+}
+
+func TestTCPLoggerClosesOnOversizedUpstreamMessage(t *testing.T) {
+	withWSMaxMessageSize(t, 1024)
+	withFakeClock(t, 0, 0, 0)
+	output := append(wsHeader(true, 0x2, 5, false), "hello"...)
+	conn := &scriptConn{reads: [][]byte{
+		append(append(append([]byte(switchResponse), output...), wsHeader(true, 0x2, 4096, false)...), make([]byte, 100)...),
+		make([]byte, 4096),
+	}}
+	logger := newWSLogger(conn)
+	if _, err := logger.Write([]byte(upgradeRequest)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readAll(t, logger)
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the stream to the client to end with EOF, got %v", err)
+	}
+	want := [][]byte{append([]byte(switchResponse), output...), wsCloseFrame(wsCloseMessageTooBig, "message too big")}
+	if len(data) != len(want) || !bytes.Equal(data[0], want[0]) || !bytes.Equal(data[1], want[1]) {
+		t.Fatalf("client got %q, want what came before the oversized frame and a close frame", data)
+	}
+	if ev := limitEvent(t, logger); ev.Direction != "upstream" || ev.Size != 4096 {
+		t.Fatalf("unexpected audit event %+v", ev)
+	}
+	if !conn.closed {
+		t.Fatal("the upstream connection must be closed")
+	}
+}